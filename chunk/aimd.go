@@ -0,0 +1,120 @@
+package chunk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fetchParallelism = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_fetch_parallelism",
+		Help:      "The current limit on parallel chunk fetches from S3.",
+	})
+	coldFetchParallelism = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_cold_fetch_parallelism",
+		Help:      "The current limit on parallel chunk fetches from S3 for queries of cold data.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(fetchParallelism)
+	prometheus.MustRegister(coldFetchParallelism)
+}
+
+// AIMDConfig configures an additive-increase, multiplicative-decrease
+// concurrency limit.
+type AIMDConfig struct {
+	// Bounds on the concurrency limit.  If Max is zero, there is no limit.
+	Min, Max int
+	// Requests slower than this are treated like errors.
+	TargetLatency time.Duration
+}
+
+// aimdLimiter is a Semaphore whose size adapts to the latency of the
+// requests made under it: it grows by one for each window of fast, successful
+// requests, and halves on errors or slow requests - at most once per
+// TargetLatency, so a burst of slow requests only backs off once.
+type aimdLimiter struct {
+	cfg   AIMDConfig
+	gauge prometheus.Gauge
+
+	mtx          sync.Mutex
+	cond         *sync.Cond
+	limit        float64
+	inflight     int
+	lastDecrease time.Time
+}
+
+func newAIMDLimiter(cfg AIMDConfig, gauge prometheus.Gauge) *aimdLimiter {
+	if cfg.Min < 1 {
+		cfg.Min = 1
+	}
+	if cfg.Max > 0 && cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	l := &aimdLimiter{
+		cfg:   cfg,
+		gauge: gauge,
+		limit: float64(cfg.Min),
+	}
+	l.cond = sync.NewCond(&l.mtx)
+	l.gauge.Set(l.limit)
+	return l
+}
+
+// Acquire implements Semaphore.
+func (l *aimdLimiter) Acquire() {
+	if l.cfg.Max == 0 {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for l.inflight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inflight++
+}
+
+// Release implements Semaphore.
+func (l *aimdLimiter) Release() {
+	if l.cfg.Max == 0 {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.inflight--
+	l.cond.Signal()
+}
+
+// observe adjusts the limit given the outcome of a request.
+func (l *aimdLimiter) observe(latency time.Duration, err error) {
+	if l.cfg.Max == 0 {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err != nil || (l.cfg.TargetLatency > 0 && latency > l.cfg.TargetLatency) {
+		now := time.Now()
+		if now.Sub(l.lastDecrease) < l.cfg.TargetLatency {
+			return
+		}
+		l.lastDecrease = now
+		l.limit /= 2
+		if l.limit < float64(l.cfg.Min) {
+			l.limit = float64(l.cfg.Min)
+		}
+	} else {
+		l.limit += 1 / l.limit
+		if l.limit > float64(l.cfg.Max) {
+			l.limit = float64(l.cfg.Max)
+		}
+		// The limit may have grown enough to admit another request.
+		l.cond.Broadcast()
+	}
+	l.gauge.Set(l.limit)
+}
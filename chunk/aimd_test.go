@@ -0,0 +1,45 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	l := newAIMDLimiter(AIMDConfig{Min: 2, Max: 4, TargetLatency: time.Hour}, fetchParallelism)
+	if l.limit != 2 {
+		t.Fatalf("expected to start at the minimum, got %v", l.limit)
+	}
+
+	// Fast requests increase the limit, up to the maximum.
+	for i := 0; i < 100; i++ {
+		l.observe(time.Millisecond, nil)
+	}
+	if l.limit != 4 {
+		t.Fatalf("expected limit to grow to the maximum, got %v", l.limit)
+	}
+
+	// Errors halve it, but only once per target latency.
+	l.observe(time.Millisecond, fmt.Errorf("SlowDown"))
+	l.observe(time.Millisecond, fmt.Errorf("SlowDown"))
+	if l.limit != 2 {
+		t.Fatalf("expected limit to halve once, got %v", l.limit)
+	}
+
+	// Acquire blocks at the limit.
+	l.Acquire()
+	l.Acquire()
+	acquired := make(chan struct{})
+	go func() {
+		l.Acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.Release()
+	<-acquired
+}
@@ -0,0 +1,139 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeAzure serves the parts of the Blob Storage REST API used by
+// azureBlobClient, for a single container, checking requests are signed.
+// Listings return one blob per page, and the first request of each blob
+// fails with a server error, to exercise retries.
+func fakeAzure(t *testing.T, client *azureBlobClient) *httptest.Server {
+	blobs := map[string][]byte{}
+	failed := map[string]bool{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "SharedKey account:" + client.sign(r, r.URL.Path, r.URL.Query(), int(r.ContentLength))
+		if auth := r.Header.Get("Authorization"); auth != want {
+			t.Errorf("bad signature %q", auth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !failed[r.URL.Path] {
+			failed[r.URL.Path] = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		switch {
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/container/"):
+			if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				t.Errorf("unexpected blob type %q", r.Header.Get("x-ms-blob-type"))
+			}
+			blobs[strings.TrimPrefix(r.URL.Path, "/container/")], _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+
+		case r.Method == "GET" && r.URL.Path == "/container":
+			var names []string
+			for name := range blobs {
+				if strings.HasPrefix(name, r.FormValue("prefix")) && name >= r.FormValue("marker") {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			var resp azureListResponse
+			if len(names) > 0 {
+				resp.Blobs.Blob = append(resp.Blobs.Blob, struct{ Name string }{names[0]})
+			}
+			if len(names) > 1 {
+				resp.NextMarker = names[1]
+			}
+			xml.NewEncoder(w).Encode(struct {
+				XMLName xml.Name `xml:"EnumerationResults"`
+				azureListResponse
+			}{azureListResponse: resp})
+
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/container/"):
+			buf, ok := blobs[strings.TrimPrefix(r.URL.Path, "/container/")]
+			if !ok {
+				w.Header().Set("x-ms-error-code", "BlobNotFound")
+				http.NotFound(w, r)
+				return
+			}
+			var start, end int
+			if n, _ := fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end); n == 2 {
+				buf = buf[start : end+1]
+			}
+			w.Write(buf)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestAzureBlobClient(t *testing.T) {
+	client := &azureBlobClient{client: http.DefaultClient, account: "account", key: []byte("key")}
+	server := fakeAzure(t, client)
+	defer server.Close()
+	client.endpoint = server.URL
+
+	keys := []string{"1/a:1:2", "1/b:1:2", "2/c:1:2"}
+	for _, key := range keys {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("container"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("data " + key)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("container"), Key: aws.String("1/b:1:2"), Range: aws.String("bytes=0-3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(buf) != "data" {
+		t.Fatalf("unexpected object %q", buf)
+	}
+
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("container"), Key: aws.String("1/missing")})
+	if awsErr, ok := err.(awserr.RequestFailure); !ok || awsErr.Code() != "NoSuchKey" || awsErr.StatusCode() != http.StatusNotFound {
+		t.Fatalf("expected NoSuchKey, got %v", err)
+	}
+
+	// Page through the user's objects, as AWSStore.listObjects does.
+	var listed []string
+	input := &s3.ListObjectsInput{Bucket: aws.String("container"), Prefix: aws.String("1/")}
+	for {
+		output, err := client.ListObjects(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range output.Contents {
+			listed = append(listed, *object.Key)
+		}
+		if !*output.IsTruncated {
+			break
+		}
+		input.Marker = output.NextMarker
+	}
+	if !reflect.DeepEqual(listed, keys[:2]) {
+		t.Fatalf("unexpected objects %v", listed)
+	}
+}
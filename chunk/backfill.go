@@ -0,0 +1,62 @@
+package chunk
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"golang.org/x/net/context"
+)
+
+// Backfill writes historical samples, for the user in ctx, straight to
+// store, bypassing the ingesters.  The samples are grouped by series and
+// encoded in as few chunks as they fit in; samples repeating a timestamp
+// already seen for their series are dropped.  It returns the number of
+// chunks written.
+//
+// Each call writes new chunks, so the samples for a series over a period
+// should be backfilled together, rather than a few at a time.  Samples
+// overlapping chunks already in the store are merged with them at query
+// time.
+func Backfill(ctx context.Context, store Store, samples []*model.Sample) (int, error) {
+	type series struct {
+		metric  model.Metric
+		samples []model.SamplePair
+	}
+	bySeries := map[model.Fingerprint]*series{}
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		ss, ok := bySeries[fp]
+		if !ok {
+			ss = &series{metric: s.Metric}
+			bySeries[fp] = ss
+		}
+		ss.samples = append(ss.samples, model.SamplePair{Timestamp: s.Timestamp, Value: s.Value})
+	}
+
+	var chunks []Chunk
+	for fp, ss := range bySeries {
+		sort.Stable(byTimestamp(ss.samples))
+		deduped := ss.samples[:1]
+		for _, s := range ss.samples[1:] {
+			if s.Timestamp != deduped[len(deduped)-1].Timestamp {
+				deduped = append(deduped, s)
+			}
+		}
+		seriesChunks, err := chunksForSamples(fp, ss.metric, prom_chunk.DefaultEncoding, deduped)
+		if err != nil {
+			return 0, err
+		}
+		chunks = append(chunks, seriesChunks...)
+	}
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+	return len(chunks), store.Put(ctx, chunks)
+}
+
+type byTimestamp []model.SamplePair
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].Timestamp < s[j].Timestamp }
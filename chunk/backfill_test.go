@@ -0,0 +1,79 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestBackfill(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+
+	// A day of samples a minute apart for two series, pushed out of order
+	// and with a repeat.
+	from := model.Now().Add(-30 * 24 * time.Hour)
+	metrics := []model.Metric{
+		{model.MetricNameLabel: "foo", "bar": "a"},
+		{model.MetricNameLabel: "foo", "bar": "b"},
+	}
+	var samples []*model.Sample
+	for i := 24*60 - 1; i >= 0; i-- {
+		for j, m := range metrics {
+			samples = append(samples, &model.Sample{Metric: m, Timestamp: from.Add(time.Duration(i) * time.Minute), Value: model.SampleValue(i + j)})
+		}
+	}
+	samples = append(samples, &model.Sample{Metric: metrics[0], Timestamp: from, Value: 1000})
+
+	written, err := Backfill(ctx, store, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written < 4 {
+		t.Fatalf("expected a day of samples to need several chunks per series, got %d chunks", written)
+	}
+
+	chunks, err := store.Get(ctx, from, from.Add(24*time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != written {
+		t.Fatalf("expected %d chunks, got %d", written, len(chunks))
+	}
+	matrix, err := ChunksToMatrix(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(matrix))
+	}
+	for _, ss := range matrix {
+		j := 0
+		if ss.Metric["bar"] == "b" {
+			j = 1
+		}
+		if !reflect.DeepEqual(model.Metric(ss.Metric), metrics[j]) {
+			t.Fatalf("unexpected series %v", ss.Metric)
+		}
+		if len(ss.Values) != 24*60 {
+			t.Fatalf("%v: expected %d samples, got %d", ss.Metric, 24*60, len(ss.Values))
+		}
+		for i, s := range ss.Values {
+			expected := model.SamplePair{Timestamp: from.Add(time.Duration(i) * time.Minute), Value: model.SampleValue(i + j)}
+			if !s.Equal(&expected) {
+				t.Fatalf("%v: expected sample %d to be %v, got %v", ss.Metric, i, expected, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	bigtableEndpoint      = "https://bigtable.googleapis.com"
+	bigtableAdminEndpoint = "https://bigtableadmin.googleapis.com"
+	bigtableDataScope     = "https://www.googleapis.com/auth/bigtable.data"
+	bigtableAdminScope    = "https://www.googleapis.com/auth/bigtable.admin.table"
+
+	// Column family holding the index entries.
+	bigtableFamily = "f"
+
+	// Cell timestamp of entries which don't expire, the end of 9999, in
+	// microseconds since the epoch.
+	bigtableNoExpiry = 253402300799000000
+)
+
+// Bigtable table IDs are at most 50 letters, digits, '-', '_' and '.', not
+// starting with '-' or '.'.
+var bigtableTableID = regexp.MustCompile(`^[_a-zA-Z0-9][-_.a-zA-Z0-9]{0,49}$`)
+
+// bigtableStorage is an IndexStorage keeping the index in a Google Cloud
+// Bigtable instance, using its REST API.  Each hash value is a row, and each
+// range value a column in the row's one column family, so the entries for a
+// hash value are read in range order from a single row.  A cell's timestamp
+// is its entry's expiry time, which reads filter on, and the column family's
+// garbage collection rule drops cells once they expire.
+type bigtableStorage struct {
+	client        *http.Client
+	endpoint      string
+	adminEndpoint string
+
+	// The instance's resource name, projects/<project>/instances/<instance>.
+	instance string
+}
+
+// NewBigtableIndexClient makes an IndexClient storing the index in the
+// Bigtable instance at the given URL, of the form
+// bigtable://project/instance?table=name, authenticating with the
+// application default credentials (eg the GKE node's service account).  The
+// name of the table to use when not using periodic tables is taken from the
+// URL's "table" parameter.
+func NewBigtableIndexClient(bigtableURL string) (IndexClient, string, error) {
+	u, err := url.Parse(bigtableURL)
+	if err != nil {
+		return nil, "", err
+	}
+	instance := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || instance == "" || strings.Contains(instance, "/") {
+		return nil, "", fmt.Errorf("bigtable URL must be bigtable://project/instance: %s", bigtableURL)
+	}
+	client, err := google.DefaultClient(context.Background(), bigtableDataScope, bigtableAdminScope)
+	if err != nil {
+		return nil, "", err
+	}
+	storage := &bigtableStorage{
+		client:        client,
+		endpoint:      bigtableEndpoint,
+		adminEndpoint: bigtableAdminEndpoint,
+		instance:      fmt.Sprintf("projects/%s/instances/%s", u.Host, instance),
+	}
+	return NewStorageIndexClient(storage), u.Query().Get("table"), nil
+}
+
+// bigtableError is an error response from Bigtable.
+type bigtableError struct {
+	statusCode int
+	message    string
+}
+
+func (e bigtableError) Error() string {
+	return e.message
+}
+
+func (s *bigtableStorage) call(method, u string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return bigtableError{
+			statusCode: resp.StatusCode,
+			message:    fmt.Sprintf("Bigtable %s %s: %s", method, req.URL.Path, body),
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *bigtableStorage) tablesURL() string {
+	return fmt.Sprintf("%s/v2/%s/tables", s.adminEndpoint, s.instance)
+}
+
+func (s *bigtableStorage) tableURL(tableName, method string) string {
+	return fmt.Sprintf("%s/v2/%s/tables/%s:%s", s.endpoint, s.instance, url.QueryEscape(tableName), method)
+}
+
+func (s *bigtableStorage) ListTables() ([]string, error) {
+	prefix := s.instance + "/tables/"
+	var tableNames []string
+	pageToken := ""
+	for {
+		var resp struct {
+			Tables []struct {
+				Name string `json:"name"`
+			} `json:"tables"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		u := s.tablesURL() + "?" + url.Values{"view": {"NAME_ONLY"}, "pageToken": {pageToken}}.Encode()
+		if err := s.call("GET", u, nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, table := range resp.Tables {
+			tableNames = append(tableNames, strings.TrimPrefix(table.Name, prefix))
+		}
+		if resp.NextPageToken == "" {
+			return tableNames, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+func (s *bigtableStorage) TableExists(tableName string) (bool, error) {
+	u := s.tablesURL() + "/" + url.QueryEscape(tableName) + "?view=NAME_ONLY"
+	err := s.call("GET", u, nil, nil)
+	if bigtableErr, ok := err.(bigtableError); ok && bigtableErr.statusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *bigtableStorage) CreateTable(tableName string) error {
+	if !bigtableTableID.MatchString(tableName) {
+		return fmt.Errorf("invalid Bigtable table name %q: must be at most 50 letters, digits, '-', '_' and '.'", tableName)
+	}
+	// Keep the latest version of each entry, until it expires.
+	gcRule := map[string]interface{}{
+		"union": map[string]interface{}{
+			"rules": []map[string]interface{}{
+				{"maxNumVersions": 1},
+				{"maxAge": "1s"},
+			},
+		},
+	}
+	err := s.call("POST", s.tablesURL(), map[string]interface{}{
+		"tableId": tableName,
+		"table": map[string]interface{}{
+			"columnFamilies": map[string]interface{}{
+				bigtableFamily: map[string]interface{}{"gcRule": gcRule},
+			},
+		},
+	}, nil)
+	if bigtableErr, ok := err.(bigtableError); ok && bigtableErr.statusCode == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+type bigtableMutation struct {
+	SetCell          *bigtableCell `json:"setCell,omitempty"`
+	DeleteFromColumn *bigtableCell `json:"deleteFromColumn,omitempty"`
+}
+
+type bigtableCell struct {
+	FamilyName      string `json:"familyName"`
+	ColumnQualifier []byte `json:"columnQualifier"`
+	TimestampMicros int64  `json:"timestampMicros,string,omitempty"`
+	Value           []byte `json:"value,omitempty"`
+}
+
+// bigtableSetCell returns the mutation writing an entry, or false if it has
+// already expired, so shouldn't be written.
+func bigtableSetCell(entry IndexEntry, now time.Time) (bigtableMutation, bool) {
+	timestamp := int64(bigtableNoExpiry)
+	if entry.Expires != 0 {
+		if entry.Expires <= now.Unix() {
+			return bigtableMutation{}, false
+		}
+		timestamp = entry.Expires * int64(time.Second/time.Microsecond)
+	}
+	return bigtableMutation{SetCell: &bigtableCell{
+		FamilyName:      bigtableFamily,
+		ColumnQualifier: entry.RangeValue,
+		TimestampMicros: timestamp,
+		Value:           entry.Value,
+	}}, true
+}
+
+// Write writes the mutations for each hash value's row atomically, but the
+// rows independently, like DynamoDB batch writes.
+func (s *bigtableStorage) Write(tableName string, entries, deletes []IndexEntry) error {
+	var rowKeys []string
+	mutations := map[string][]bigtableMutation{}
+	addMutation := func(rowKey string, mutation bigtableMutation) {
+		if _, ok := mutations[rowKey]; !ok {
+			rowKeys = append(rowKeys, rowKey)
+		}
+		mutations[rowKey] = append(mutations[rowKey], mutation)
+	}
+	now := mtime.Now()
+	for _, entry := range entries {
+		if mutation, ok := bigtableSetCell(entry, now); ok {
+			addMutation(entry.HashValue, mutation)
+		}
+	}
+	for _, entry := range deletes {
+		addMutation(entry.HashValue, bigtableMutation{DeleteFromColumn: &bigtableCell{
+			FamilyName:      bigtableFamily,
+			ColumnQualifier: entry.RangeValue,
+		}})
+	}
+	if len(rowKeys) == 0 {
+		return nil
+	}
+
+	type rowMutations struct {
+		RowKey    []byte             `json:"rowKey"`
+		Mutations []bigtableMutation `json:"mutations"`
+	}
+	var req struct {
+		Entries []rowMutations `json:"entries"`
+	}
+	for _, rowKey := range rowKeys {
+		req.Entries = append(req.Entries, rowMutations{[]byte(rowKey), mutations[rowKey]})
+	}
+	// The response is streamed, as a JSON array of messages.
+	var resps []struct {
+		Entries []struct {
+			Status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"status"`
+		} `json:"entries"`
+	}
+	if err := s.call("POST", s.tableURL(tableName, "mutateRows"), req, &resps); err != nil {
+		return err
+	}
+	for _, resp := range resps {
+		for _, entry := range resp.Entries {
+			if entry.Status.Code != 0 {
+				return fmt.Errorf("Bigtable mutateRows: %s (code %d)", entry.Status.Message, entry.Status.Code)
+			}
+		}
+	}
+	return nil
+}
+
+type bigtableFilter struct {
+	Chain                     *bigtableChain          `json:"chain,omitempty"`
+	ColumnRangeFilter         *bigtableColumnRange    `json:"columnRangeFilter,omitempty"`
+	TimestampRangeFilter      *bigtableTimestampRange `json:"timestampRangeFilter,omitempty"`
+	CellsPerColumnLimitFilter int                     `json:"cellsPerColumnLimitFilter,omitempty"`
+	CellsPerRowLimitFilter    int                     `json:"cellsPerRowLimitFilter,omitempty"`
+}
+
+type bigtableChain struct {
+	Filters []bigtableFilter `json:"filters"`
+}
+
+type bigtableColumnRange struct {
+	FamilyName           string `json:"familyName"`
+	StartQualifierClosed []byte `json:"startQualifierClosed,omitempty"`
+	EndQualifierClosed   []byte `json:"endQualifierClosed,omitempty"`
+	EndQualifierOpen     []byte `json:"endQualifierOpen,omitempty"`
+}
+
+type bigtableTimestampRange struct {
+	StartTimestampMicros int64 `json:"startTimestampMicros,string"`
+}
+
+// bigtableUnexpired filters out the cells of entries which have expired,
+// and all but the latest version of the others.
+func bigtableUnexpired(now time.Time) []bigtableFilter {
+	return []bigtableFilter{
+		{TimestampRangeFilter: &bigtableTimestampRange{
+			StartTimestampMicros: (now.Unix() + 1) * int64(time.Second/time.Microsecond),
+		}},
+		{CellsPerColumnLimitFilter: 1},
+	}
+}
+
+// PutIfNotExists writes the entry with a check-and-mutate of its row.
+func (s *bigtableStorage) PutIfNotExists(tableName string, entry IndexEntry) (bool, error) {
+	now := mtime.Now()
+	mutation, ok := bigtableSetCell(entry, now)
+	if !ok {
+		return true, nil
+	}
+	filters := append([]bigtableFilter{{ColumnRangeFilter: &bigtableColumnRange{
+		FamilyName:           bigtableFamily,
+		StartQualifierClosed: entry.RangeValue,
+		EndQualifierClosed:   entry.RangeValue,
+	}}}, bigtableUnexpired(now)...)
+	var resp struct {
+		PredicateMatched bool `json:"predicateMatched"`
+	}
+	if err := s.call("POST", s.tableURL(tableName, "checkAndMutateRow"), map[string]interface{}{
+		"rowKey":          []byte(entry.HashValue),
+		"predicateFilter": bigtableFilter{Chain: &bigtableChain{filters}},
+		"falseMutations":  []bigtableMutation{mutation},
+	}, &resp); err != nil {
+		return false, err
+	}
+	return !resp.PredicateMatched, nil
+}
+
+// bigtableReadRowsResponse is a message of a streamed readRows response.
+// A row's cells are split into chunks, each continuing the previous
+// chunk's cell unless it gives a new qualifier.
+type bigtableReadRowsResponse struct {
+	Chunks []struct {
+		Qualifier []byte `json:"qualifier"`
+		Value     []byte `json:"value"`
+		ResetRow  bool   `json:"resetRow"`
+		CommitRow bool   `json:"commitRow"`
+	} `json:"chunks"`
+}
+
+func (s *bigtableStorage) Query(query IndexQuery) ([]IndexEntry, error) {
+	filters := append([]bigtableFilter{{ColumnRangeFilter: &bigtableColumnRange{
+		FamilyName:           bigtableFamily,
+		StartQualifierClosed: query.RangeStart,
+		EndQualifierOpen:     query.RangeEnd,
+	}}}, bigtableUnexpired(mtime.Now())...)
+	filters = append(filters, bigtableFilter{CellsPerRowLimitFilter: query.Limit})
+
+	var resps []bigtableReadRowsResponse
+	if err := s.call("POST", s.tableURL(query.TableName, "readRows"), map[string]interface{}{
+		"rows":   map[string]interface{}{"rowKeys": [][]byte{[]byte(query.HashValue)}},
+		"filter": bigtableFilter{Chain: &bigtableChain{filters}},
+	}, &resps); err != nil {
+		return nil, err
+	}
+	return bigtableEntries(query.HashValue, resps)
+}
+
+// bigtableEntries returns the entries in the cells of the row read.
+func bigtableEntries(hashValue string, resps []bigtableReadRowsResponse) ([]IndexEntry, error) {
+	var entries, row []IndexEntry
+	for _, resp := range resps {
+		for _, chunk := range resp.Chunks {
+			if chunk.ResetRow {
+				row = nil
+				continue
+			}
+			if chunk.Qualifier != nil {
+				row = append(row, IndexEntry{HashValue: hashValue, RangeValue: chunk.Qualifier})
+			}
+			if len(row) == 0 {
+				return nil, fmt.Errorf("Bigtable readRows: chunk continues no cell")
+			}
+			cell := &row[len(row)-1]
+			cell.Value = append(cell.Value, chunk.Value...)
+			if chunk.CommitRow {
+				entries = append(entries, row...)
+				row = nil
+			}
+		}
+	}
+	if len(row) > 0 {
+		return nil, fmt.Errorf("Bigtable readRows: row not committed")
+	}
+	return entries, nil
+}
@@ -0,0 +1,337 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+const fakeBigtableInstance = "projects/project/instances/instance"
+
+type fakeBigtableCell struct {
+	timestamp int64
+	value     []byte
+}
+
+// fakeBigtable serves the parts of the Bigtable REST API used by
+// bigtableStorage, for a single instance, keeping one version of each
+// cell.  Cells are read back split into two chunks, in separate messages.
+func fakeBigtable(t *testing.T) *httptest.Server {
+	// Table name to row key to column qualifier to cell.
+	tables := map[string]map[string]map[string]fakeBigtableCell{}
+
+	// cells returns the cells of a row matching a filter, in column order.
+	cells := func(row map[string]fakeBigtableCell, filter bigtableFilter) []string {
+		var columns []string
+		for column := range row {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		var matched []string
+		for _, column := range columns {
+			ok := true
+			for _, f := range filter.Chain.Filters {
+				switch {
+				case f.ColumnRangeFilter != nil:
+					r := f.ColumnRangeFilter
+					ok = ok && (r.StartQualifierClosed == nil || column >= string(r.StartQualifierClosed)) &&
+						(r.EndQualifierClosed == nil || column <= string(r.EndQualifierClosed)) &&
+						(r.EndQualifierOpen == nil || column < string(r.EndQualifierOpen))
+				case f.TimestampRangeFilter != nil:
+					ok = ok && row[column].timestamp >= f.TimestampRangeFilter.StartTimestampMicros
+				case f.CellsPerRowLimitFilter != 0:
+					ok = ok && len(matched) < f.CellsPerRowLimitFilter
+				}
+			}
+			if ok {
+				matched = append(matched, column)
+			}
+		}
+		return matched
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tablesPath := "/v2/" + fakeBigtableInstance + "/tables"
+		switch {
+		case r.Method == "GET" && r.URL.Path == tablesPath:
+			resp := map[string][]map[string]string{"tables": {}}
+			for tableName := range tables {
+				resp["tables"] = append(resp["tables"], map[string]string{"name": fakeBigtableInstance + "/tables/" + tableName})
+			}
+			json.NewEncoder(w).Encode(resp)
+
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, tablesPath+"/"):
+			if _, ok := tables[strings.TrimPrefix(r.URL.Path, tablesPath+"/")]; !ok {
+				http.NotFound(w, r)
+			}
+
+		case r.Method == "POST" && r.URL.Path == tablesPath:
+			var req struct {
+				TableID string `json:"tableId"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			if _, ok := tables[req.TableID]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			tables[req.TableID] = map[string]map[string]fakeBigtableCell{}
+
+		case r.Method == "POST" && strings.HasPrefix(r.URL.Path, tablesPath+"/"):
+			parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, tablesPath+"/"), ":", 2)
+			table, ok := tables[parts[0]]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			mutate := func(rowKey []byte, mutations []bigtableMutation) {
+				row, ok := table[string(rowKey)]
+				if !ok {
+					row = map[string]fakeBigtableCell{}
+					table[string(rowKey)] = row
+				}
+				for _, mutation := range mutations {
+					if cell := mutation.SetCell; cell != nil {
+						row[string(cell.ColumnQualifier)] = fakeBigtableCell{cell.TimestampMicros, cell.Value}
+					} else {
+						delete(row, string(mutation.DeleteFromColumn.ColumnQualifier))
+					}
+				}
+			}
+
+			switch parts[1] {
+			case "mutateRows":
+				var req struct {
+					Entries []struct {
+						RowKey    []byte             `json:"rowKey"`
+						Mutations []bigtableMutation `json:"mutations"`
+					} `json:"entries"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				for _, entry := range req.Entries {
+					mutate(entry.RowKey, entry.Mutations)
+				}
+				w.Write([]byte(`[{"entries":[{"status":{}}]}]`))
+
+			case "checkAndMutateRow":
+				var req struct {
+					RowKey          []byte             `json:"rowKey"`
+					PredicateFilter bigtableFilter     `json:"predicateFilter"`
+					FalseMutations  []bigtableMutation `json:"falseMutations"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				matched := len(cells(table[string(req.RowKey)], req.PredicateFilter)) > 0
+				if !matched {
+					mutate(req.RowKey, req.FalseMutations)
+				}
+				json.NewEncoder(w).Encode(map[string]bool{"predicateMatched": matched})
+
+			case "readRows":
+				var req struct {
+					Rows struct {
+						RowKeys [][]byte `json:"rowKeys"`
+					} `json:"rows"`
+					Filter bigtableFilter `json:"filter"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				row := table[string(req.Rows.RowKeys[0])]
+				resps := []map[string][]map[string]interface{}{}
+				columns := cells(row, req.Filter)
+				for i, column := range columns {
+					value := row[column].value
+					resps = append(resps,
+						map[string][]map[string]interface{}{"chunks": {{"qualifier": []byte(column), "value": value[:len(value)/2]}}},
+						map[string][]map[string]interface{}{"chunks": {{"value": value[len(value)/2:], "commitRow": i == len(columns)-1}}},
+					)
+				}
+				json.NewEncoder(w).Encode(resps)
+
+			default:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				w.WriteHeader(http.StatusBadRequest)
+			}
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func newFakeBigtableStorage(t *testing.T) (*bigtableStorage, func()) {
+	server := fakeBigtable(t)
+	return &bigtableStorage{
+		client:        http.DefaultClient,
+		endpoint:      server.URL,
+		adminEndpoint: server.URL,
+		instance:      fakeBigtableInstance,
+	}, server.Close
+}
+
+func TestBigtableChunkStore(t *testing.T) {
+	storage, closer := newFakeBigtableStorage(t)
+	defer closer()
+	index := NewStorageIndexClient(storage)
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		DynamoDB:  index,
+		TableName: "index",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:  index,
+		S3:        NewMockS3(),
+		TableName: "index",
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestBigtableTables(t *testing.T) {
+	storage, closer := newFakeBigtableStorage(t)
+	defer closer()
+
+	if exists, err := storage.TableExists("index"); err != nil || exists {
+		t.Fatalf("expected no table, got %v, %v", exists, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := storage.CreateTable("index"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exists, err := storage.TableExists("index"); err != nil || !exists {
+		t.Fatalf("expected table, got %v, %v", exists, err)
+	}
+	if tableNames, err := storage.ListTables(); err != nil || len(tableNames) != 1 || tableNames[0] != "index" {
+		t.Fatalf("unexpected tables %v, %v", tableNames, err)
+	}
+	if err := storage.CreateTable("index/1"); err == nil {
+		t.Fatal("expected invalid table name to be rejected")
+	}
+}
+
+func TestBigtableConditionalPut(t *testing.T) {
+	storage, closer := newFakeBigtableStorage(t)
+	defer closer()
+	if err := storage.CreateTable("table"); err != nil {
+		t.Fatal(err)
+	}
+	index := NewStorageIndexClient(storage)
+
+	put := func() error {
+		_, err := index.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String("table"),
+			Item: map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String("hash")},
+				rangeKey: {B: []byte("range")},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(h)"),
+		})
+		return err
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if awsErr, ok := put().(awserr.Error); !ok || awsErr.Code() != conditionalCheckFailedException {
+		t.Fatalf("expected conditional check failure, got %v", awsErr)
+	}
+}
+
+func TestBigtableQuery(t *testing.T) {
+	storage, closer := newFakeBigtableStorage(t)
+	defer closer()
+	if err := storage.CreateTable("table"); err != nil {
+		t.Fatal(err)
+	}
+	mtime.NowForce(time.Unix(1000, 0))
+	defer mtime.NowReset()
+
+	if err := storage.Write("table", []IndexEntry{
+		{HashValue: "hash", RangeValue: []byte("a"), Value: []byte("1")},
+		{HashValue: "hash", RangeValue: []byte("b"), Value: []byte("22"), Expires: 1060},
+		{HashValue: "hash", RangeValue: []byte("c"), Value: []byte("333")},
+		{HashValue: "hash", RangeValue: []byte("d"), Expires: 900},
+		{HashValue: "other", RangeValue: []byte("a")},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("table", nil, []IndexEntry{{HashValue: "hash", RangeValue: []byte("c")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := storage.Query(IndexQuery{TableName: "table", HashValue: "hash", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0].RangeValue) != "a" || string(entries[0].Value) != "1" ||
+		string(entries[1].RangeValue) != "b" || string(entries[1].Value) != "22" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	entries, err = storage.Query(IndexQuery{TableName: "table", HashValue: "hash", RangeStart: []byte("a\x00"), Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].RangeValue) != "b" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	// Once b expires, it isn't returned.
+	mtime.NowForce(time.Unix(1060, 0))
+	entries, err = storage.Query(IndexQuery{TableName: "table", HashValue: "hash", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !bytes.Equal(entries[0].RangeValue, []byte("a")) {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestBigtableEntriesResetRow(t *testing.T) {
+	var resps []bigtableReadRowsResponse
+	if err := json.Unmarshal([]byte(`[
+		{"chunks": [{"qualifier": "YQ==", "value": "eA=="}, {"resetRow": true}]},
+		{"chunks": [{"qualifier": "YQ==", "value": "MQ=="}, {"qualifier": "Yg==", "commitRow": true}]}
+	]`), &resps); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := bigtableEntries("hash", resps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0].RangeValue) != "a" || string(entries[0].Value) != "1" ||
+		string(entries[1].RangeValue) != "b" || entries[1].Value != nil {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
@@ -0,0 +1,247 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+)
+
+const (
+	// With 10 bits per entry and 7 hash functions, about 1% of lookups for
+	// entries not in a filter aren't skipped.
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+
+	bloomVersion = 1
+)
+
+var bloomFilterSkippedLookups = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "bloom_filter_skipped_lookups_total",
+	Help:      "Index lookups not made because their bucket's bloom filter shows they would find nothing.",
+})
+
+func init() {
+	prometheus.MustRegister(bloomFilterSkippedLookups)
+}
+
+// bloomFilter is a set of strings which may report strings it doesn't
+// contain as present, but never the reverse.  See "Space/time trade-offs in
+// hash coding with allowable errors", Bloom.
+type bloomFilter struct {
+	bits []byte
+}
+
+// newBloomFilter makes a bloom filter sized for entries strings.
+func newBloomFilter(entries int) *bloomFilter {
+	size := (entries*bloomBitsPerEntry + 7) / 8
+	if size == 0 {
+		size = 1
+	}
+	return &bloomFilter{bits: make([]byte, size)}
+}
+
+// positions returns the bits set for s, derived from two halves of its hash;
+// see "Less hashing, same performance", Kirsch and Mitzenmacher.
+func (b *bloomFilter) positions(s string) [bloomHashes]uint64 {
+	sum := sha256.Sum256([]byte(s))
+	h1, h2 := binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])
+	m := uint64(len(b.bits)) * 8
+	var positions [bloomHashes]uint64
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % m
+	}
+	return positions
+}
+
+func (b *bloomFilter) add(s string) {
+	for _, p := range b.positions(s) {
+		b.bits[p/8] |= 1 << (p % 8)
+	}
+}
+
+// mayContain returns false if s was never added.
+func (b *bloomFilter) mayContain(s string) bool {
+	for _, p := range b.positions(s) {
+		if b.bits[p/8]&(1<<(p%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) encode() []byte {
+	buf := make([]byte, 1+len(b.bits))
+	buf[0] = bloomVersion
+	copy(buf[1:], b.bits)
+	return buf
+}
+
+func (b *bloomFilter) decode(buf []byte) error {
+	if len(buf) < 2 || buf[0] != bloomVersion {
+		return fmt.Errorf("invalid bloom filter")
+	}
+	b.bits = append([]byte(nil), buf[1:]...)
+	return nil
+}
+
+// bloomFilterName is the S3 key for a bucket's bloom filter.  Chunk IDs never
+// contain a '/', so this can't collide with chunkName.
+func bloomFilterName(userID, bucket string) string {
+	return fmt.Sprintf("%s/blooms/%s", userID, bucket)
+}
+
+// buildBloomFilter builds the bloom filter of the hash values the bucket's
+// series are indexed under, by metric name, indexed label and label name,
+// from all its chunks, fetched whole, and stores it in S3.  Lookups in the
+// bucket can then be skipped for shards with none of a metric's series, and
+// for metrics with no series in the bucket at all.
+func (c *AWSStore) buildBloomFilter(ctx context.Context, userID string, bucket bucketSpec, chunkIDs []string) error {
+	chunks := make([]Chunk, 0, len(chunkIDs))
+	for _, chunkID := range chunkIDs {
+		chunks = append(chunks, Chunk{ID: chunkID})
+	}
+	chunks, skipped := c.fetchChunksForRebuild(ctx, userID, chunks)
+	if skipped > 0 {
+		// A filter missing these chunks' series would skip lookups finding them.
+		return fmt.Errorf("could not fetch %d of %d chunks", skipped, len(chunkIDs))
+	}
+
+	hashValues := map[string]struct{}{}
+	for _, chunk := range chunks {
+		metricName, ok := chunk.Metric[model.MetricNameLabel]
+		if !ok {
+			return fmt.Errorf("no MetricNameLabel for chunk %s", chunk.ID)
+		}
+		fp := chunk.Metric.Fingerprint()
+		hashValues[bucket.seriesHashValue(userID, metricName, fp)] = struct{}{}
+		for _, hashValue := range bucket.indexedLabelHashValues(userID, chunk.Metric, fp) {
+			hashValues[hashValue] = struct{}{}
+		}
+		for _, hashValue := range bucket.labelNameHashValues(userID, chunk.Metric, fp) {
+			hashValues[hashValue] = struct{}{}
+		}
+	}
+	filter := newBloomFilter(len(hashValues))
+	for hashValue := range hashValues {
+		filter.add(hashValue)
+	}
+
+	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		_, err := c.cfg.S3.PutObject(c.putObjectInput(bloomFilterName(userID, bucket.bucket), bytes.NewReader(filter.encode())))
+		return err
+	})
+}
+
+func (c *AWSStore) loadBloomFilter(ctx context.Context, userID, bucket string) (*bloomFilter, error) {
+	var resp *s3.GetObjectOutput
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = c.cfg.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(c.cfg.BucketName),
+			Key:    aws.String(bloomFilterName(userID, bucket)),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	filter := &bloomFilter{}
+	if err := filter.decode(buf); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// bloomFilters caches the bloom filters loaded from S3.  A bucket's filter
+// is only rebuilt if its chunks change, so entries are keyed by the number
+// of chunks it was built from, and never expire.  When the cache is full,
+// an arbitrary entry is evicted.
+type bloomFilters struct {
+	maxEntries int
+
+	mtx     sync.Mutex
+	filters map[string]*bloomFilter
+}
+
+func newBloomFilters(maxEntries int) *bloomFilters {
+	return &bloomFilters{
+		maxEntries: maxEntries,
+		filters:    map[string]*bloomFilter{},
+	}
+}
+
+// bloomFilter returns the bloom filter for the bucket, or nil if the user's
+// bucket index shows it has none, or it can't be loaded.
+func (c *AWSStore) bloomFilter(ctx context.Context, userID string, bucket bucketSpec) *bloomFilter {
+	index := c.bucketIndex(ctx, userID)
+	if index == nil {
+		return nil
+	}
+	stats, ok := index.Buckets[bucket.bucket]
+	if !ok || stats.FilterChunks == 0 {
+		return nil
+	}
+	key := bloomFilterName(userID, bucket.bucket) + ":" + strconv.Itoa(stats.FilterChunks)
+
+	c.bloomFilters.mtx.Lock()
+	filter, ok := c.bloomFilters.filters[key]
+	c.bloomFilters.mtx.Unlock()
+	if ok {
+		return filter
+	}
+
+	filter, err := c.loadBloomFilter(ctx, userID, bucket.bucket)
+	if err != nil {
+		log.Warnf("Could not load bloom filter for %s bucket %s: %v", userID, bucket.bucket, err)
+		return nil
+	}
+	c.bloomFilters.mtx.Lock()
+	defer c.bloomFilters.mtx.Unlock()
+	if len(c.bloomFilters.filters) >= c.bloomFilters.maxEntries {
+		for evict := range c.bloomFilters.filters {
+			delete(c.bloomFilters.filters, evict)
+			break
+		}
+	}
+	c.bloomFilters.filters[key] = filter
+	return filter
+}
+
+// filterHashValues removes the hash values the bucket's bloom filter, if it
+// has one, shows to have no index entries.
+func (c *AWSStore) filterHashValues(ctx context.Context, userID string, bucket bucketSpec, hashValues []string) []string {
+	if c.cfg.BucketIndex.BloomFilters <= 0 {
+		return hashValues
+	}
+	filter := c.bloomFilter(ctx, userID, bucket)
+	if filter == nil {
+		return hashValues
+	}
+	result := make([]string, 0, len(hashValues))
+	for _, hashValue := range hashValues {
+		if !filter.mayContain(hashValue) {
+			bloomFilterSkippedLookups.Inc()
+			continue
+		}
+		result = append(result, hashValue)
+	}
+	return result
+}
@@ -0,0 +1,119 @@
+package chunk
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 1000
+	filter := newBloomFilter(n)
+	for i := 0; i < n; i++ {
+		filter.add(strconv.Itoa(i))
+	}
+
+	decoded := &bloomFilter{}
+	if err := decoded.decode(filter.encode()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if !decoded.mayContain(strconv.Itoa(i)) {
+			t.Fatalf("%d added but not found", i)
+		}
+	}
+	falsePositives := 0
+	for i := n; i < 2*n; i++ {
+		if decoded.mayContain(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/20 {
+		t.Fatalf("%d false positives in %d", falsePositives, n)
+	}
+
+	if err := decoded.decode([]byte{bloomVersion + 1, 0}); err == nil {
+		t.Fatalf("decoded a filter of an unknown version")
+	}
+}
+
+func TestBloomFilterSkipsLookups(t *testing.T) {
+	dynamoDB := &countingIndexClient{MockDynamoDB: NewMockDynamoDB(0, 0)}
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:    dynamoDB,
+		S3:          NewMockS3(),
+		BucketIndex: BucketIndexConfig{RefreshInterval: time.Hour, MinAge: time.Hour, BloomFilters: 10},
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now.Add(-72*time.Hour), 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	index, err := store.BuildBucketIndex(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stats := range index.Buckets {
+		if stats.FilterChunks != 1 {
+			t.Fatalf("expected a bloom filter, got %+v", stats)
+		}
+	}
+
+	from, through := now.Add(-73*time.Hour), now.Add(-71*time.Hour)
+	for _, tc := range []struct {
+		metricName model.LabelValue
+		chunks     int
+		queries    int32
+	}{
+		{"foo", 1, 1},
+		// The bucket has chunks, but none of bar's, so isn't looked up.
+		{"bar", 0, 0},
+	} {
+		atomic.StoreInt32(&dynamoDB.queries, 0)
+		chunks, err := store.Get(ctx, from, through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, tc.metricName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != tc.chunks {
+			t.Fatalf("%s: expected %d chunks, got %d", tc.metricName, tc.chunks, len(chunks))
+		}
+		if queries := atomic.LoadInt32(&dynamoDB.queries); queries != tc.queries {
+			t.Fatalf("%s: expected %d index queries, got %d", tc.metricName, tc.queries, queries)
+		}
+	}
+
+	// A filter whose bucket's chunks have changed is rebuilt.
+	other := newTestChunk(t, now.Add(-72*time.Hour+time.Minute), 10)
+	other.Metric[model.MetricNameLabel] = "bar"
+	other = NewChunk(model.Fingerprint(2), other.Metric, other.Data, other.From, other.Through)
+	if err := store.Put(ctx, []Chunk{other}); err != nil {
+		t.Fatal(err)
+	}
+	index, err = store.BuildBucketIndex(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stats := range index.Buckets {
+		if stats.FilterChunks != 2 {
+			t.Fatalf("expected the bloom filter to be rebuilt, got %+v", stats)
+		}
+	}
+	bucket := store.bigBuckets(chunk.From, chunk.From)[0]
+	filter, err := store.loadBloomFilter(ctx, "0", bucket.bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.mayContain(bucket.seriesHashValue("0", "bar", other.Metric.Fingerprint())) {
+		t.Fatalf("rebuilt bloom filter doesn't have bar")
+	}
+}
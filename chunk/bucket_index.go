@@ -0,0 +1,395 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+var (
+	bucketIndexBuildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "bucket_index_build_seconds",
+		Help:      "Time spent building all users' bucket indexes.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	}, []string{"operation", "status_code"})
+	bucketIndexSkippedBuckets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "bucket_index_skipped_buckets_total",
+		Help:      "Index buckets not looked up because the bucket index shows they have no chunks.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(bucketIndexBuildDuration)
+	prometheus.MustRegister(bucketIndexSkippedBuckets)
+}
+
+// BucketIndexConfig configures how queries use the per-user bucket indexes
+// built by a BucketIndexBuilder.
+type BucketIndexConfig struct {
+	// How often a user's bucket index is reloaded from S3.  If zero, bucket
+	// indexes aren't used.
+	RefreshInterval time.Duration
+
+	// Buckets are only trusted to be complete in a bucket index built at
+	// least this long after they ended, after which no more chunks are
+	// expected to be written to them.
+	MinAge time.Duration
+
+	// If non-zero, bucket indexes are built with a bloom filter for each
+	// bucket they trust, from which queries skip lookups finding nothing, and
+	// this many of the filters are cached.  Building a bucket's filter
+	// fetches all its chunks, once.  Chunks stored only in their index
+	// entries aren't in S3, so aren't in bucket indexes or the filters;
+	// NewStore refuses to use either with StoreConfig.InlineChunkMaxSize.
+	BloomFilters int
+}
+
+// BucketStats summarises the chunks in one index bucket.
+type BucketStats struct {
+	Series  int        `json:"series"`
+	Chunks  int        `json:"chunks"`
+	MinTime model.Time `json:"min_time"`
+	MaxTime model.Time `json:"max_time"`
+	// The number of chunks the bucket's bloom filter was built from; zero if
+	// it has none.
+	FilterChunks int `json:"filter_chunks,omitempty"`
+}
+
+// BucketIndex summarises a user's chunks by index bucket, so queries can
+// skip buckets with no chunks without reading the index, and so their cost
+// can be estimated before they are run.  Buckets with no chunks are absent.
+type BucketIndex struct {
+	Built   model.Time              `json:"built"`
+	Buckets map[string]*BucketStats `json:"buckets"`
+}
+
+// QueryCost estimates the cost of a query from the bucket index.
+type QueryCost struct {
+	// Index buckets covering the query.
+	Buckets int `json:"buckets"`
+	// Buckets the bucket index shows to be empty, which won't be looked up.
+	EmptyBuckets int `json:"empty_buckets"`
+	// Buckets too recent to be in the bucket index, so not estimated.
+	UnindexedBuckets int `json:"unindexed_buckets"`
+	// Upper bound on the number of chunks in the indexed buckets: a chunk
+	// spanning several buckets is counted in each.
+	Chunks int `json:"chunks"`
+	// Lower bound on the number of series in the indexed buckets: the
+	// largest number of series in any one of them.
+	Series int `json:"series"`
+}
+
+// QueryCostEstimator estimates the cost of a query for all of a user's
+// series, without reading the index.
+type QueryCostEstimator interface {
+	EstimateQueryCost(ctx context.Context, from, through model.Time) (QueryCost, error)
+}
+
+// BuildBucketIndex builds userID's bucket index from a listing of their
+// chunks in S3, and stores it in S3.  If BloomFilters is set, bloom filters
+// are built for the trusted buckets without them, or whose chunks have
+// changed since theirs were.
+func (c *AWSStore) BuildBucketIndex(ctx context.Context, userID string) (*BucketIndex, error) {
+	index := &BucketIndex{
+		Built:   model.TimeFromUnixNano(mtime.Now().UnixNano()),
+		Buckets: map[string]*BucketStats{},
+	}
+	var (
+		series   = map[string]map[model.Fingerprint]struct{}{}
+		specs    = map[string]bucketSpec{}
+		chunkIDs = map[string][]string{}
+	)
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		for _, l := range listed {
+			for _, bucket := range c.bigBuckets(l.from, l.through) {
+				stats, ok := index.Buckets[bucket.bucket]
+				if !ok {
+					stats = &BucketStats{MinTime: l.from, MaxTime: l.through}
+					index.Buckets[bucket.bucket] = stats
+					series[bucket.bucket] = map[model.Fingerprint]struct{}{}
+				}
+				stats.Chunks++
+				if l.from < stats.MinTime {
+					stats.MinTime = l.from
+				}
+				if l.through > stats.MaxTime {
+					stats.MaxTime = l.through
+				}
+				series[bucket.bucket][l.fp] = struct{}{}
+				if c.cfg.BucketIndex.BloomFilters > 0 {
+					specs[bucket.bucket] = bucket
+					chunkIDs[bucket.bucket] = append(chunkIDs[bucket.bucket], l.id)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for bucket, fps := range series {
+		index.Buckets[bucket].Series = len(fps)
+	}
+	if c.cfg.BucketIndex.BloomFilters > 0 {
+		c.buildBloomFilters(ctx, userID, index, specs, chunkIDs)
+	}
+
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	err = instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		_, err := c.cfg.S3.PutObject(c.putObjectInput(bucketIndexName(userID), bytes.NewReader(buf)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// buildBloomFilters builds the bloom filters index needs, keeping those in
+// the user's previous bucket index which are up to date.  Buckets whose
+// filters can't be built are left without one, to be retried next time.
+func (c *AWSStore) buildBloomFilters(ctx context.Context, userID string, index *BucketIndex, specs map[string]bucketSpec, chunkIDs map[string][]string) {
+	previous, err := c.loadBucketIndex(ctx, userID)
+	if err != nil {
+		previous = &BucketIndex{}
+	}
+	for bucket, stats := range index.Buckets {
+		if old, ok := previous.Buckets[bucket]; ok && old.FilterChunks == stats.Chunks {
+			stats.FilterChunks = stats.Chunks
+			continue
+		}
+		if !c.indexed(index, specs[bucket]) {
+			continue
+		}
+		if err := c.buildBloomFilter(ctx, userID, specs[bucket], chunkIDs[bucket]); err != nil {
+			log.Warnf("Could not build bloom filter for %s bucket %s: %v", userID, bucket, err)
+			continue
+		}
+		stats.FilterChunks = stats.Chunks
+	}
+}
+
+func (c *AWSStore) loadBucketIndex(ctx context.Context, userID string) (*BucketIndex, error) {
+	var resp *s3.GetObjectOutput
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = c.cfg.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(c.cfg.BucketName),
+			Key:    aws.String(bucketIndexName(userID)),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	index := &BucketIndex{}
+	if err := json.Unmarshal(buf, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// bucketIndexName is the S3 key for a user's bucket index.  Chunk IDs never
+// contain a '/', so this can't collide with chunkName.
+func bucketIndexName(userID string) string {
+	return fmt.Sprintf("%s/bucket-index", userID)
+}
+
+// bucketIndexes caches users' bucket indexes, reloading them from S3 every
+// RefreshInterval.  A user without a bucket index is cached as nil, so the
+// miss isn't retried on every query.
+type bucketIndexes struct {
+	mtx     sync.Mutex
+	indexes map[string]*cachedBucketIndex
+}
+
+type cachedBucketIndex struct {
+	index  *BucketIndex
+	loaded time.Time
+}
+
+func newBucketIndexes() *bucketIndexes {
+	return &bucketIndexes{
+		indexes: map[string]*cachedBucketIndex{},
+	}
+}
+
+// bucketIndex returns userID's bucket index, or nil if bucket indexes aren't
+// used or the user doesn't have one.
+func (c *AWSStore) bucketIndex(ctx context.Context, userID string) *BucketIndex {
+	if c.cfg.BucketIndex.RefreshInterval <= 0 {
+		return nil
+	}
+	now := mtime.Now()
+
+	c.bucketIndexes.mtx.Lock()
+	cached, ok := c.bucketIndexes.indexes[userID]
+	c.bucketIndexes.mtx.Unlock()
+	if ok && now.Sub(cached.loaded) < c.cfg.BucketIndex.RefreshInterval {
+		return cached.index
+	}
+
+	index, err := c.loadBucketIndex(ctx, userID)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NoSuchKey" {
+			log.Warnf("Could not load bucket index for %s: %v", userID, err)
+			// Keep using the old bucket index, if any, until the next refresh.
+			if cached != nil {
+				index = cached.index
+			}
+		}
+	}
+	c.bucketIndexes.mtx.Lock()
+	c.bucketIndexes.indexes[userID] = &cachedBucketIndex{index: index, loaded: now}
+	c.bucketIndexes.mtx.Unlock()
+	return index
+}
+
+// indexed returns true if the bucket index was built long enough after
+// bucket ended to be trusted to know all its chunks.
+func (c *AWSStore) indexed(index *BucketIndex, bucket bucketSpec) bool {
+	end, err := bucketEnd(bucket.bucket)
+	if err != nil {
+		return false
+	}
+	return end.Add(c.cfg.BucketIndex.MinAge) <= index.Built
+}
+
+// skipEmptyBuckets removes the buckets the user's bucket index shows to
+// have no chunks.
+func (c *AWSStore) skipEmptyBuckets(ctx context.Context, userID string, buckets []bucketSpec) []bucketSpec {
+	index := c.bucketIndex(ctx, userID)
+	if index == nil {
+		return buckets
+	}
+	result := make([]bucketSpec, 0, len(buckets))
+	for _, bucket := range buckets {
+		if _, ok := index.Buckets[bucket.bucket]; !ok && c.indexed(index, bucket) {
+			bucketIndexSkippedBuckets.Inc()
+			continue
+		}
+		result = append(result, bucket)
+	}
+	return result
+}
+
+// EstimateQueryCost implements QueryCostEstimator.
+func (c *AWSStore) EstimateQueryCost(ctx context.Context, from, through model.Time) (QueryCost, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return QueryCost{}, err
+	}
+	buckets := c.bigBuckets(from, through)
+	cost := QueryCost{Buckets: len(buckets)}
+	index := c.bucketIndex(ctx, userID)
+	if index == nil {
+		cost.UnindexedBuckets = len(buckets)
+		return cost, nil
+	}
+	for _, bucket := range buckets {
+		stats, ok := index.Buckets[bucket.bucket]
+		switch {
+		case !c.indexed(index, bucket):
+			cost.UnindexedBuckets++
+		case !ok:
+			cost.EmptyBuckets++
+		default:
+			cost.Chunks += stats.Chunks
+			if stats.Series > cost.Series {
+				cost.Series = stats.Series
+			}
+		}
+	}
+	return cost, nil
+}
+
+// BucketIndexBuilder periodically rebuilds every user's bucket index.  Only
+// one process needs to run it.
+type BucketIndexBuilder struct {
+	store    *AWSStore
+	interval time.Duration
+	done     chan struct{}
+	wait     sync.WaitGroup
+}
+
+// NewBucketIndexBuilder makes a new BucketIndexBuilder, rebuilding the
+// bucket indexes every interval.
+func NewBucketIndexBuilder(store *AWSStore, interval time.Duration) *BucketIndexBuilder {
+	return &BucketIndexBuilder{
+		store:    store,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start the BucketIndexBuilder
+func (b *BucketIndexBuilder) Start() {
+	b.wait.Add(1)
+	go b.loop()
+}
+
+// Stop the BucketIndexBuilder
+func (b *BucketIndexBuilder) Stop() {
+	close(b.done)
+	b.wait.Wait()
+}
+
+func (b *BucketIndexBuilder) loop() {
+	defer b.wait.Done()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := instrument.TimeRequestHistogram(context.Background(), "BucketIndexBuilder.buildAll", bucketIndexBuildDuration, b.buildAll); err != nil {
+			log.Errorf("Error building bucket indexes: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// buildAll builds every user's bucket index.  A failure for one user doesn't
+// stop the others being built.
+func (b *BucketIndexBuilder) buildAll(ctx context.Context) error {
+	userIDs, err := b.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, userID := range userIDs {
+		if _, err := b.store.BuildBucketIndex(ctx, userID); err != nil {
+			log.Warnf("Could not build bucket index for %s: %v", userID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,84 @@
+package chunk
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// countingIndexClient counts index queries.
+type countingIndexClient struct {
+	*MockDynamoDB
+	queries int32
+}
+
+func (c *countingIndexClient) QueryRequest(input *dynamodb.QueryInput) (dynamoRequest, *dynamodb.QueryOutput) {
+	atomic.AddInt32(&c.queries, 1)
+	return c.MockDynamoDB.QueryRequest(input)
+}
+
+func TestBucketIndex(t *testing.T) {
+	dynamoDB := &countingIndexClient{MockDynamoDB: NewMockDynamoDB(0, 0)}
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:    dynamoDB,
+		S3:          NewMockS3(),
+		BucketIndex: BucketIndexConfig{RefreshInterval: time.Hour, MinAge: time.Hour},
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now.Add(-72*time.Hour), 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	index, err := store.BuildBucketIndex(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Buckets) != 1 {
+		t.Fatalf("unexpected buckets %v", index.Buckets)
+	}
+	for _, stats := range index.Buckets {
+		if *stats != (BucketStats{Series: 1, Chunks: 1, MinTime: chunk.From, MaxTime: chunk.Through}) {
+			t.Fatalf("unexpected bucket stats %+v", stats)
+		}
+	}
+
+	// Of the four daily buckets, only the one with the chunk is looked up.
+	from, through := now.Add(-120*time.Hour), now.Add(-48*time.Hour)
+	chunks, err := store.Get(ctx, from, through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(chunks))
+	}
+	if queries := atomic.LoadInt32(&dynamoDB.queries); queries != 1 {
+		t.Fatalf("expected 1 index query, got %d", queries)
+	}
+
+	cost, err := store.EstimateQueryCost(ctx, from, through)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != (QueryCost{Buckets: 4, EmptyBuckets: 3, Chunks: 1, Series: 1}) {
+		t.Fatalf("unexpected cost %+v", cost)
+	}
+
+	// Today's bucket is too recent to be in the bucket index.
+	cost, err = store.EstimateQueryCost(ctx, now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != (QueryCost{Buckets: 1, UnindexedBuckets: 1}) {
+		t.Fatalf("unexpected cost %+v", cost)
+	}
+}
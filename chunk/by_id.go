@@ -90,3 +90,33 @@ func nWayIntersect(sets []ByID) ByID {
 		return nWayIntersect([]ByID{left, right})
 	}
 }
+
+// difference returns the chunks in a which aren't in b.  Both lists must be
+// sorted.
+func difference(a, b ByID) ByID {
+	result := make(ByID, 0, len(a))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].ID < b[j].ID {
+			result = append(result, a[i])
+			i++
+		} else if a[i].ID > b[j].ID {
+			j++
+		} else {
+			i++
+			j++
+		}
+	}
+	return append(result, a[i:]...)
+}
+
+type byFrom []Chunk
+
+func (cs byFrom) Len() int      { return len(cs) }
+func (cs byFrom) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byFrom) Less(i, j int) bool {
+	if cs[i].From != cs[j].From {
+		return cs[i].From < cs[j].From
+	}
+	return cs[i].ID < cs[j].ID
+}
@@ -4,10 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
-	"fmt"
+	"hash/crc32"
 	"io"
-	"strconv"
-	"strings"
+	"sort"
 
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/golang/snappy"
@@ -30,12 +29,21 @@ type Chunk struct {
 	Data     prom_chunk.Chunk    `json:"-"`
 
 	metadataInIndex bool
+
+	// Set for chunks stored in their index entries rather than S3; see
+	// StoreConfig.InlineChunkMaxSize.  Holds the chunk as it would have been
+	// written to S3, until decoded.
+	inline []byte
+
+	// Set if only some of the chunk's blocks were fetched, in which case
+	// Data is missing samples and the chunk must not be cached.
+	partial bool
 }
 
 // NewChunk creates a new chunk
 func NewChunk(fp model.Fingerprint, metric model.Metric, c prom_chunk.Chunk, firstTime, lastTime model.Time) Chunk {
 	return Chunk{
-		ID:       fmt.Sprintf("%d:%d:%d", fp, firstTime, lastTime),
+		ID:       ChunkKey{Fingerprint: fp, From: firstTime, Through: lastTime}.Encode(),
 		From:     firstTime,
 		Through:  lastTime,
 		Metric:   metric,
@@ -44,26 +52,6 @@ func NewChunk(fp model.Fingerprint, metric model.Metric, c prom_chunk.Chunk, fir
 	}
 }
 
-func parseChunkID(id string) (model.Fingerprint, model.Time, model.Time, error) {
-	parts := strings.Split(id, ":")
-	if len(parts) != 3 {
-		return 0, 0, 0, fmt.Errorf("invalid chunk ID")
-	}
-	fingerprint, err := strconv.ParseUint(parts[0], 10, 64)
-	if err != nil {
-		return 0, 0, 0, err
-	}
-	firstTime, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		return 0, 0, 0, err
-	}
-	lastTime, err := strconv.ParseInt(parts[2], 10, 64)
-	if err != nil {
-		return 0, 0, 0, err
-	}
-	return model.Fingerprint(fingerprint), model.Time(firstTime), model.Time(lastTime), nil
-}
-
 func (c *Chunk) reader() (io.ReadSeeker, error) {
 	// Encode chunk metadata into snappy-compressed buffer
 	var metadata bytes.Buffer
@@ -83,12 +71,19 @@ func (c *Chunk) reader() (io.ReadSeeker, error) {
 	dataLenBytes := [4]byte{}
 	binary.BigEndian.PutUint32(dataLenBytes[:], uint32(len(data)))
 
+	// The data is followed by its CRC.  The metadata is covered by the
+	// checksums in the snappy framing format.  Chunks written before the CRC
+	// was added end with the data, and older readers ignore the CRC.
+	crcBytes := [4]byte{}
+	binary.BigEndian.PutUint32(crcBytes[:], crc32.Checksum(data, castagnoliTable))
+
 	// Body is chunk bytes (uncompressed) with metadata appended on the end.
 	return ioutils.MultiReadSeeker(
 		bytes.NewReader(metadataLenBytes[:]),
 		bytes.NewReader(metadata.Bytes()),
 		bytes.NewReader(dataLenBytes[:]),
 		bytes.NewReader(data),
+		bytes.NewReader(crcBytes[:]),
 	), nil
 }
 
@@ -103,10 +98,21 @@ func (c *Chunk) decode(r io.Reader) error {
 		return c.Data.Unmarshal(r)
 	}
 
-	var metadataLen uint32
-	if err := binary.Read(r, binary.BigEndian, &metadataLen); err != nil {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
 		return err
 	}
+	if string(prefix[:len(chunkCompressedMagic)]) == chunkCompressedMagic {
+		decompressed, _, err := chunkDecompressor(io.MultiReader(bytes.NewReader(prefix[len(chunkCompressedMagic):]), r))
+		if err != nil {
+			return err
+		}
+		return c.decode(decompressed)
+	}
+	if string(prefix[:]) == chunkV2Magic {
+		return c.decodeV2(r)
+	}
+	metadataLen := binary.BigEndian.Uint32(prefix[:])
 
 	err := json.NewDecoder(snappy.NewReader(&io.LimitedReader{
 		N: int64(metadataLen),
@@ -132,15 +138,42 @@ func (c *Chunk) decode(r io.Reader) error {
 	if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil {
 		return err
 	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
 
-	return c.Data.Unmarshal(&io.LimitedReader{
-		N: int64(dataLen),
-		R: r,
-	})
+	var crcBytes [4]byte
+	switch _, err := io.ReadFull(r, crcBytes[:]); err {
+	case nil:
+		if crc32.Checksum(data, castagnoliTable) != binary.BigEndian.Uint32(crcBytes[:]) {
+			chunkChecksumFailures.Inc()
+			return ErrInvalidChecksum
+		}
+	case io.EOF:
+		// Written before chunks had a CRC.
+	default:
+		return err
+	}
+
+	return c.Data.Unmarshal(bytes.NewReader(data))
 }
 
-// ChunksToMatrix converts a slice of chunks into a model.Matrix.
+// ChunksToMatrix converts a slice of chunks into a model.Matrix.  Of samples
+// with the same timestamp in overlapping chunks, the earlier chunk's is kept.
 func ChunksToMatrix(chunks []Chunk) (model.Matrix, error) {
+	return ChunksToMatrixWithPolicy(chunks, util.KeepFirstDuplicate)
+}
+
+// ChunksToMatrixWithPolicy converts a slice of chunks into a model.Matrix,
+// resolving samples with the same timestamp in overlapping chunks, such as
+// those flushed by different replicas, with duplicatePolicy.  Chunks are
+// taken in order of start time, then ID, so the result doesn't depend on the
+// order they were fetched in.
+func ChunksToMatrixWithPolicy(chunks []Chunk, duplicatePolicy string) (model.Matrix, error) {
+	chunks = append([]Chunk(nil), chunks...)
+	sort.Sort(byFrom(chunks))
+
 	// Group chunks by series, sort and dedupe samples.
 	sampleStreams := map[model.Fingerprint]*model.SampleStream{}
 	for _, c := range chunks {
@@ -158,7 +191,7 @@ func ChunksToMatrix(chunks []Chunk) (model.Matrix, error) {
 			return nil, err
 		}
 
-		ss.Values = util.MergeSamples(ss.Values, samples)
+		ss.Values = util.MergeSamplesWithPolicy(ss.Values, samples, duplicatePolicy)
 	}
 
 	matrix := make(model.Matrix, 0, len(sampleStreams))
@@ -131,10 +131,10 @@ func (c *Cache) StoreChunkData(ctx context.Context, userID string, chunk *Chunk)
 // StoreChunks serializes and stores multiple chunks in the chunk cache.
 func (c *Cache) StoreChunks(ctx context.Context, userID string, chunks []Chunk) error {
 	errs := make(chan error)
-	for _, chunk := range chunks {
+	for i := range chunks {
 		go func(chunk *Chunk) {
 			errs <- c.StoreChunkData(ctx, userID, chunk)
-		}(&chunk)
+		}(&chunks[i])
 	}
 	var errOut error
 	for i := 0; i < len(chunks); i++ {
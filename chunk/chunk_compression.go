@@ -0,0 +1,79 @@
+package chunk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// Chunk compression codecs, selectable with StoreConfig.ChunkCompression.
+//
+// Compressed chunks are the chunk, in either format, compressed and prefixed
+// with chunkCompressedMagic and a byte naming the codec, so compressed and
+// uncompressed chunks can always be read.  Uncompressed chunks start with
+// chunkV2Magic or the version 1 metadata length, which would have to be over
+// 1GB to collide with it.
+//
+// Compressed chunks are always fetched whole, rather than with range GETs.
+const (
+	ChunkCompressionNone   = ""
+	ChunkCompressionSnappy = "snappy"
+	ChunkCompressionGzip   = "gzip"
+
+	chunkCompressedMagic = "CKz"
+
+	snappyCodec = 's'
+	gzipCodec   = 'g'
+)
+
+var chunkCodecs = map[string]byte{
+	ChunkCompressionSnappy: snappyCodec,
+	ChunkCompressionGzip:   gzipCodec,
+}
+
+// compressChunk compresses an encoded chunk.
+func compressChunk(body io.Reader, compression string) (io.ReadSeeker, error) {
+	codec, ok := chunkCodecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown chunk compression %q", compression)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(chunkCompressedMagic)
+	buf.WriteByte(codec)
+	var w io.WriteCloser
+	switch codec {
+	case snappyCodec:
+		w = snappy.NewWriter(&buf)
+	case gzipCodec:
+		w = gzip.NewWriter(&buf)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// chunkDecompressor returns a reader decompressing the rest of a compressed
+// chunk, after the magic, and the name of its compression.
+func chunkDecompressor(r io.Reader) (io.Reader, string, error) {
+	var codec [1]byte
+	if _, err := io.ReadFull(r, codec[:]); err != nil {
+		return nil, "", err
+	}
+	switch codec[0] {
+	case snappyCodec:
+		return snappy.NewReader(r), ChunkCompressionSnappy, nil
+	case gzipCodec:
+		gr, err := gzip.NewReader(r)
+		return gr, ChunkCompressionGzip, err
+	default:
+		return nil, "", fmt.Errorf("unknown chunk compression codec %q", codec[0])
+	}
+}
@@ -0,0 +1,91 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestChunkCompression(t *testing.T) {
+	chunk := newTestChunk(t, model.Time(100000), 100)
+	want, err := chunk.samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []int{ChunkFormatV1, ChunkFormatV2} {
+		for _, compression := range []string{ChunkCompressionSnappy, ChunkCompressionGzip} {
+			encoded, err := chunk.encode(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uncompressed, err := ioutil.ReadAll(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded.Seek(0, 0)
+			compressed, err := compressChunk(encoded, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadAll(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) >= len(uncompressed) {
+				t.Errorf("version %d, %s: compressed to %d bytes from %d", version, compression, len(buf), len(uncompressed))
+			}
+
+			info, err := InspectChunk(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.FormatVersion != version || info.Compression != compression || !info.Metric.Equal(chunk.Metric) || !reflect.DeepEqual(info.Samples, want) {
+				t.Errorf("version %d, %s: unexpected chunk %+v", version, compression, info)
+			}
+		}
+	}
+
+	if _, err := compressChunk(nil, "lzma"); err == nil {
+		t.Error("expected error for unknown compression")
+	}
+}
+
+func TestChunkStoreCompression(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+
+	// Chunks written compressed and uncompressed can be read by stores
+	// writing either.
+	s3, dynamoDB := NewMemoryObjectClient(), NewMemoryIndexClient()
+	stores := map[string]*AWSStore{}
+	for _, compression := range []string{ChunkCompressionNone, ChunkCompressionGzip} {
+		stores[compression] = NewAWSStore(StoreConfig{
+			S3:               s3,
+			BucketName:       "chunks",
+			DynamoDB:         dynamoDB,
+			TableName:        "index",
+			ChunkCompression: compression,
+		})
+	}
+	if err := stores[ChunkCompressionGzip].Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	for compression, store := range stores {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+			t.Fatalf("%q: unexpected chunks %v", compression, chunks)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+)
+
+// Chunk format versions, selectable with StoreConfig.ChunkFormatVersion.
+//
+// Version 1 is the metadata followed by the marshalled Prometheus chunk and
+// its CRC (which chunks written by older versions of Cortex lack).
+// Version 2 re-encodes the samples into small blocks, and lists each block's
+// time range and byte range in the header, so a query only needing a small
+// time window of a chunk can fetch just the blocks it needs with S3 range
+// GETs.
+//
+// The version 2 header holds the chunk's encoding and metric, so chunks can
+// be understood without the index, and a CRC of each block.  The header
+// itself is covered by the checksums in the snappy framing format.
+//
+// Version 2 chunks start with chunkV2Magic; version 1 chunks start with the
+// metadata length, which would have to be over 1GB to collide with it.
+const (
+	ChunkFormatV1 = 1
+	ChunkFormatV2 = 2
+
+	chunkV2Magic = "CKv2"
+
+	// Maximum number of samples per block in a version 2 chunk.
+	samplesPerBlock = 64
+)
+
+// chunkBlock describes one block of a version 2 chunk.  Offset is relative to
+// the end of the header.
+type chunkBlock struct {
+	From    model.Time `json:"from"`
+	Through model.Time `json:"through"`
+	Offset  int        `json:"offset"`
+	Length  int        `json:"length"`
+	CRC     uint32     `json:"crc"`
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInvalidChecksum is returned when a chunk, or a block of a version 2
+// chunk, doesn't match its CRC.
+var ErrInvalidChecksum = fmt.Errorf("invalid chunk checksum")
+
+var chunkChecksumFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_checksum_failures_total",
+	Help:      "Number of chunks, or blocks of version 2 chunks, read which didn't match their CRC.",
+})
+
+func init() {
+	prometheus.MustRegister(chunkChecksumFailures)
+}
+
+// chunkV2Header is the header of a version 2 chunk: the chunk's metadata plus
+// its block index.
+type chunkV2Header struct {
+	*Chunk
+	Blocks []chunkBlock `json:"blocks"`
+}
+
+// encode encodes the chunk in the given format version.
+func (c *Chunk) encode(version int) (io.ReadSeeker, error) {
+	if version != ChunkFormatV2 {
+		return c.reader()
+	}
+	buf, err := c.encodeV2()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
+
+// encodeV2 encodes the chunk in the version 2 format.
+func (c *Chunk) encodeV2() ([]byte, error) {
+	samples, err := c.samples()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		data   bytes.Buffer
+		blocks []chunkBlock
+	)
+	for len(samples) > 0 {
+		n := samplesPerBlock
+		if n > len(samples) {
+			n = len(samples)
+		}
+		block := chunkBlock{
+			From:    samples[0].Timestamp,
+			Through: samples[n-1].Timestamp,
+			Offset:  data.Len(),
+		}
+		buf := encodeBlock(samples[:n])
+		data.Write(buf)
+		block.Length = len(buf)
+		block.CRC = crc32.Checksum(buf, castagnoliTable)
+		blocks = append(blocks, block)
+		samples = samples[n:]
+	}
+
+	var header bytes.Buffer
+	if err := json.NewEncoder(snappy.NewWriter(&header)).Encode(chunkV2Header{c, blocks}); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(chunkV2Magic)+4+header.Len()+data.Len())
+	buf = append(buf, chunkV2Magic...)
+	headerLenBytes := [4]byte{}
+	binary.BigEndian.PutUint32(headerLenBytes[:], uint32(header.Len()))
+	buf = append(buf, headerLenBytes[:]...)
+	buf = append(buf, header.Bytes()...)
+	return append(buf, data.Bytes()...), nil
+}
+
+// decodeV2 decodes the remainder of a version 2 chunk, after the magic.
+func (c *Chunk) decodeV2(r io.Reader) error {
+	var headerLen uint32
+	if err := binary.Read(r, binary.BigEndian, &headerLen); err != nil {
+		return err
+	}
+	header := chunkV2Header{Chunk: c}
+	err := json.NewDecoder(snappy.NewReader(&io.LimitedReader{
+		N: int64(headerLen),
+		R: r,
+	})).Decode(&header)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.decodeBlocks(data, header.Blocks)
+}
+
+// decodeV2Header decodes the header of a version 2 chunk from buf, which must
+// start with the magic.  It returns the block index and the offset in the
+// object at which the blocks start.  errShortHeader is returned if buf does
+// not contain the whole header.
+func (c *Chunk) decodeV2Header(buf []byte) ([]chunkBlock, int, error) {
+	start := len(chunkV2Magic) + 4
+	if len(buf) < start {
+		return nil, 0, errShortHeader
+	}
+	end := start + int(binary.BigEndian.Uint32(buf[len(chunkV2Magic):start]))
+	if len(buf) < end {
+		return nil, 0, errShortHeader
+	}
+	header := chunkV2Header{Chunk: c}
+	if err := json.NewDecoder(snappy.NewReader(bytes.NewReader(buf[start:end]))).Decode(&header); err != nil {
+		return nil, 0, err
+	}
+	return header.Blocks, end, nil
+}
+
+var errShortHeader = fmt.Errorf("chunk header truncated")
+
+// decodeBlocks rebuilds the chunk's data from blocks, which must be
+// contiguous; data starts at the first block's offset.  Delta chunks are
+// rebuilt as double-delta, as when reading version 1 chunks, unless their
+// samples don't fit in a single double-delta chunk, in which case they are
+// rebuilt as delta chunks again.
+func (c *Chunk) decodeBlocks(data []byte, blocks []chunkBlock) error {
+	var samples []model.SamplePair
+	base := 0
+	if len(blocks) > 0 {
+		base = blocks[0].Offset
+	}
+	for _, block := range blocks {
+		start, end := block.Offset-base, block.Offset-base+block.Length
+		if start < 0 || end > len(data) {
+			return fmt.Errorf("chunk block out of range")
+		}
+		if crc32.Checksum(data[start:end], castagnoliTable) != block.CRC {
+			chunkChecksumFailures.Inc()
+			return ErrInvalidChecksum
+		}
+		blockSamples, err := decodeBlock(data[start:end])
+		if err != nil {
+			return err
+		}
+		samples = append(samples, blockSamples...)
+	}
+
+	encoding := c.Encoding
+	if encoding == prom_chunk.Delta {
+		encoding = prom_chunk.DoubleDelta
+	}
+	pc, err := buildChunk(encoding, samples)
+	if err == errChunkOverflow && encoding != c.Encoding {
+		encoding = c.Encoding
+		pc, err = buildChunk(encoding, samples)
+	}
+	if err == errChunkOverflow {
+		return fmt.Errorf("chunk samples overflow a single %v chunk", encoding)
+	} else if err != nil {
+		return err
+	}
+	c.Encoding, c.Data = encoding, pc
+	return nil
+}
+
+var errChunkOverflow = fmt.Errorf("chunk overflow")
+
+// buildChunk adds samples to a new Prometheus chunk with the given encoding,
+// returning errChunkOverflow if they don't fit in one.
+func buildChunk(encoding prom_chunk.Encoding, samples []model.SamplePair) (prom_chunk.Chunk, error) {
+	pc, err := prom_chunk.NewForEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range samples {
+		pcs, err := pc.Add(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(pcs) > 1 {
+			return nil, errChunkOverflow
+		}
+		pc = pcs[0]
+	}
+	return pc, nil
+}
+
+// encodeBlock encodes samples as a count, followed by each sample's
+// timestamp delta and value.
+func encodeBlock(samples []model.SamplePair) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*(1+2*len(samples)))
+	n := binary.PutUvarint(buf, uint64(len(samples)))
+	var prev model.Time
+	for _, s := range samples {
+		n += binary.PutVarint(buf[n:], int64(s.Timestamp-prev))
+		binary.BigEndian.PutUint64(buf[n:], math.Float64bits(float64(s.Value)))
+		n += 8
+		prev = s.Timestamp
+	}
+	return buf[:n]
+}
+
+func decodeBlock(buf []byte) ([]model.SamplePair, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count > uint64(len(buf)) {
+		return nil, fmt.Errorf("invalid chunk block")
+	}
+	buf = buf[n:]
+	samples := make([]model.SamplePair, 0, count)
+	var prev model.Time
+	for i := uint64(0); i < count; i++ {
+		delta, n := binary.Varint(buf)
+		if n <= 0 || len(buf) < n+8 {
+			return nil, fmt.Errorf("invalid chunk block")
+		}
+		prev += model.Time(delta)
+		samples = append(samples, model.SamplePair{
+			Timestamp: prev,
+			Value:     model.SampleValue(math.Float64frombits(binary.BigEndian.Uint64(buf[n:]))),
+		})
+		buf = buf[n+8:]
+	}
+	return samples, nil
+}
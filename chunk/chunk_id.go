@@ -0,0 +1,136 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Chunk ID versions, selectable with StoreConfig.ChunkIDVersion.  A chunk's
+// ID is its key in S3, under its user ID, and is what its index entries
+// point at.
+//
+// Version 1 IDs are fingerprint:from:through.  Version 2 IDs add the chunk's
+// checksum, fingerprint:from:through:checksum, so a chunk read can be
+// checked against the ID it was looked up by, catching objects overwritten
+// with different samples.  IDs of both versions can always be read.
+const (
+	ChunkIDV1 = 1
+	ChunkIDV2 = 2
+)
+
+// ChunkKey is a parsed chunk ID.
+type ChunkKey struct {
+	Fingerprint   model.Fingerprint
+	From, Through model.Time
+
+	// The CRC-32C of the chunk's samples; see samplesChecksum.  Only
+	// version 2 IDs have one.
+	Checksum    uint32
+	HasChecksum bool
+}
+
+// Encode returns the chunk ID for the key, of version 2 if it has a
+// checksum, and version 1 otherwise.
+func (k ChunkKey) Encode() string {
+	if k.HasChecksum {
+		return fmt.Sprintf("%d:%d:%d:%08x", k.Fingerprint, k.From, k.Through, k.Checksum)
+	}
+	return fmt.Sprintf("%d:%d:%d", k.Fingerprint, k.From, k.Through)
+}
+
+// ParseChunkKey parses a chunk ID of either version.
+func ParseChunkKey(id string) (ChunkKey, error) {
+	parts := strings.Split(id, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return ChunkKey{}, fmt.Errorf("invalid chunk ID")
+	}
+	fingerprint, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return ChunkKey{}, err
+	}
+	firstTime, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ChunkKey{}, err
+	}
+	lastTime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return ChunkKey{}, err
+	}
+	key := ChunkKey{
+		Fingerprint: model.Fingerprint(fingerprint),
+		From:        model.Time(firstTime),
+		Through:     model.Time(lastTime),
+	}
+	if len(parts) == 4 {
+		checksum, err := strconv.ParseUint(parts[3], 16, 32)
+		if err != nil {
+			return ChunkKey{}, err
+		}
+		key.Checksum, key.HasChecksum = uint32(checksum), true
+	}
+	return key, nil
+}
+
+func parseChunkID(id string) (model.Fingerprint, model.Time, model.Time, error) {
+	key, err := ParseChunkKey(id)
+	return key.Fingerprint, key.From, key.Through, err
+}
+
+// samplesChecksum returns the CRC-32C of the chunk's samples' timestamps and
+// values.  It doesn't depend on the chunk's encoding or format, so survives
+// reencoding.
+func (c *Chunk) samplesChecksum() (uint32, error) {
+	samples, err := c.samples()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 16*len(samples))
+	for i, s := range samples {
+		binary.BigEndian.PutUint64(buf[16*i:], uint64(s.Timestamp))
+		binary.BigEndian.PutUint64(buf[16*i+8:], math.Float64bits(float64(s.Value)))
+	}
+	return crc32.Checksum(buf, castagnoliTable), nil
+}
+
+// assignChunkIDs gives chunks IDs of the configured version.
+func (c *AWSStore) assignChunkIDs(chunks []Chunk) error {
+	if c.cfg.ChunkIDVersion != ChunkIDV2 {
+		return nil
+	}
+	for i := range chunks {
+		key, err := ParseChunkKey(chunks[i].ID)
+		if err != nil {
+			return err
+		}
+		if key.Checksum, err = chunks[i].samplesChecksum(); err != nil {
+			return err
+		}
+		key.HasChecksum = true
+		chunks[i].ID = key.Encode()
+	}
+	return nil
+}
+
+// verifyID checks a fully fetched chunk's samples against the checksum in
+// its ID, if it has one.
+func (c *Chunk) verifyID() error {
+	key, err := ParseChunkKey(c.ID)
+	if err != nil || !key.HasChecksum || c.partial {
+		return nil
+	}
+	checksum, err := c.samplesChecksum()
+	if err != nil {
+		return err
+	}
+	if checksum != key.Checksum {
+		chunkChecksumFailures.Inc()
+		return ErrInvalidChecksum
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package chunk
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestParseChunkKey(t *testing.T) {
+	for _, tc := range []struct {
+		id       string
+		expected ChunkKey
+		err      bool
+	}{
+		{id: "1:2:3", expected: ChunkKey{Fingerprint: 1, From: 2, Through: 3}},
+		{id: "1:2:3:0000abcd", expected: ChunkKey{Fingerprint: 1, From: 2, Through: 3, Checksum: 0xabcd, HasChecksum: true}},
+		{id: "1:2", err: true},
+		{id: "1:2:3:xyz", err: true},
+		{id: "1:2:3:4:5", err: true},
+	} {
+		key, err := ParseChunkKey(tc.id)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.id, err)
+		}
+		if key != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.id, tc.expected, key)
+		}
+		if encoded := key.Encode(); encoded != tc.id {
+			t.Errorf("%s: encoded as %s", tc.id, encoded)
+		}
+	}
+}
+
+func TestChunkIDV2(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	objects := NewMemoryObjectClient()
+	store := NewAWSStore(StoreConfig{
+		S3:             objects,
+		BucketName:     "chunks",
+		DynamoDB:       NewMemoryIndexClient(),
+		TableName:      "index",
+		ChunkIDVersion: ChunkIDV2,
+	})
+
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	v1ID := chunk.ID
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.ID != v1ID {
+		t.Fatal("Put changed the caller's chunk")
+	}
+
+	get := func() ([]Chunk, error) {
+		return store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	}
+	chunks, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || !strings.HasPrefix(chunks[0].ID, v1ID+":") {
+		t.Fatalf("expected a version 2 ID, got %v", chunks)
+	}
+	key, err := ParseChunkKey(chunks[0].ID)
+	if err != nil || !key.HasChecksum {
+		t.Fatalf("expected a checksum in %s: %v", chunks[0].ID, err)
+	}
+
+	// Overwrite the chunk with different samples under the same key; reading
+	// it fails its checksum.
+	var samples []model.SamplePair
+	for i := 9; i >= 0; i-- {
+		samples = append(samples, model.SamplePair{Timestamp: now.Add(-time.Duration(i) * time.Second), Value: 1})
+	}
+	others, err := chunksForSamples(model.Fingerprint(1), chunk.Metric, chunk.Encoding, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(others) != 1 || others[0].ID != v1ID {
+		t.Fatalf("expected a chunk with ID %s, got %v", v1ID, others)
+	}
+	body, err := others[0].encode(ChunkFormatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := objects.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("chunks"),
+		Key:    aws.String(chunkName("0", chunks[0].ID)),
+		Body:   body,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(); err == nil {
+		t.Fatal("expected reading an overwritten chunk to fail")
+	} else if _, ok := err.(*CorruptChunkError); !ok {
+		t.Fatalf("expected a CorruptChunkError, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/prometheus/common/model"
+)
+
+// ChunkInfo describes a chunk object, for debugging.
+type ChunkInfo struct {
+	Chunk
+
+	// Format version of the object; see ChunkFormatV1 and ChunkFormatV2.
+	FormatVersion int
+
+	// Size of the object, in bytes.
+	Size int
+
+	// Compression of the object; see ChunkCompressionNone.
+	Compression string
+
+	// Number of blocks, for version 2 chunks.
+	Blocks int
+
+	Samples []model.SamplePair
+}
+
+// InspectChunk decodes a chunk object, as written to the object store, for
+// debugging.  Chunks written with their metadata in the index, before it was
+// stored in the object, can't be decoded.
+func InspectChunk(buf []byte) (*ChunkInfo, error) {
+	info := &ChunkInfo{
+		FormatVersion: ChunkFormatV1,
+		Size:          len(buf),
+	}
+	if bytes.HasPrefix(buf, []byte(chunkCompressedMagic)) {
+		r, compression, err := chunkDecompressor(bytes.NewReader(buf[len(chunkCompressedMagic):]))
+		if err != nil {
+			return nil, err
+		}
+		if buf, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+		info.Compression = compression
+	}
+	if err := info.decode(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(buf, []byte(chunkV2Magic)) {
+		info.FormatVersion = ChunkFormatV2
+		blocks, _, err := (&Chunk{}).decodeV2Header(buf)
+		if err != nil {
+			return nil, err
+		}
+		info.Blocks = len(blocks)
+	}
+
+	var err error
+	info.Samples, err = info.samples()
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,39 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestInspectChunk(t *testing.T) {
+	chunk := newTestChunk(t, model.Time(100000), 100)
+	for _, version := range []int{ChunkFormatV1, ChunkFormatV2} {
+		r, err := chunk.encode(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := InspectChunk(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.FormatVersion != version || info.Size != len(buf) {
+			t.Errorf("version %d: unexpected format %d, size %d", version, info.FormatVersion, info.Size)
+		}
+		if !info.Metric.Equal(chunk.Metric) || info.From != chunk.From || info.Through != chunk.Through || info.Encoding != chunk.Encoding {
+			t.Errorf("version %d: unexpected metadata %v %v-%v %v", version, info.Metric, info.From, info.Through, info.Encoding)
+		}
+		if len(info.Samples) != 100 || info.Samples[0].Timestamp != chunk.From || info.Samples[99].Timestamp != chunk.Through {
+			t.Errorf("version %d: unexpected samples %v", version, info.Samples)
+		}
+		if version == ChunkFormatV2 && info.Blocks != 2 {
+			t.Errorf("expected 2 blocks, got %d", info.Blocks)
+		}
+	}
+}
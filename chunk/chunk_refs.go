@@ -0,0 +1,178 @@
+package chunk
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// LazyStore is a Store which can look up the chunks for a query separately
+// from fetching them, so callers can prune the chunks, or give up on the
+// query, before paying for the fetches.
+type LazyStore interface {
+	GetChunkRefs(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]ChunkRef, error)
+	FetchChunks(ctx context.Context, from, through model.Time, refs []ChunkRef) ([]Chunk, error)
+}
+
+// ChunkRef describes a chunk found in the index, without its data.
+type ChunkRef struct {
+	ID            string
+	Fingerprint   model.Fingerprint
+	From, Through model.Time
+
+	// Metric is only known without fetching the chunk if its index entries
+	// hold its metadata; otherwise it is nil.
+	Metric model.Metric
+
+	chunk Chunk
+	cold  bool
+
+	// Set for refs to downsampled chunks, which are given back this metric
+	// name once fetched.
+	rawName model.LabelValue
+}
+
+type refsByID []ChunkRef
+
+func (rs refsByID) Len() int           { return len(rs) }
+func (rs refsByID) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs refsByID) Less(i, j int) bool { return rs[i].ID < rs[j].ID }
+
+// GetChunkRefs implements LazyStore.  It does the same index lookups as
+// Get, and returns refs to the chunks it would have fetched, sorted by ID.
+func (c *AWSStore) GetChunkRefs(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]ChunkRef, error) {
+	if cutoff, downsampledMatchers, name, ok := c.downsampledQuery(from, through, matchers); ok {
+		return c.getDownsampledRefs(ctx, from, cutoff, through, downsampledMatchers, matchers, name)
+	}
+	if c.isCold(through) {
+		coldQueries.Inc()
+		var refs []ChunkRef
+		err := c.withColdQuerySlot(ctx, func() error {
+			var err error
+			refs, err = c.cold.GetChunkRefs(ctx, from, through, matchers...)
+			return err
+		})
+		for i := range refs {
+			refs[i].cold = true
+		}
+		return refs, err
+	}
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []Chunk
+	if c.namelessQuery(from, through, matchers) {
+		// The chunks are fetched to find which match, so FetchChunks
+		// needn't fetch them again.
+		chunks, err = c.scanNameless(ctx, userID, from, through, matchers)
+	} else {
+		chunks, err = c.lookupChunks(ctx, userID, from, through, matchers, func([]Chunk) {})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(ByID(chunks))
+	refs := make([]ChunkRef, 0, len(chunks))
+	for _, chunk := range chunks {
+		fp, chunkFrom, chunkThrough, err := parseChunkID(chunk.ID)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ChunkRef{
+			ID:          chunk.ID,
+			Fingerprint: fp,
+			From:        chunkFrom,
+			Through:     chunkThrough,
+			Metric:      chunk.Metric,
+			chunk:       chunk,
+		})
+	}
+	return refs, nil
+}
+
+// FetchChunks implements LazyStore.  It fetches the chunks refs, got from
+// GetChunkRefs for the same range, refer to, like Get, returning them sorted
+// by ID.  Only the data between from and through is guaranteed to be
+// fetched.
+func (c *AWSStore) FetchChunks(ctx context.Context, from, through model.Time, refs []ChunkRef) ([]Chunk, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var hot, cold, fetched []Chunk
+	for _, ref := range refs {
+		if ref.chunk.Data != nil {
+			fetched = append(fetched, ref.chunk)
+		} else if ref.cold && c.cold != nil {
+			cold = append(cold, ref.chunk)
+		} else {
+			hot = append(hot, ref.chunk)
+		}
+	}
+	chunks := fetched
+	if len(hot) > 0 {
+		hotChunks, err := c.fetchChunks(ctx, userID, from, through, hot)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, hotChunks...)
+	}
+	if len(cold) > 0 {
+		err := c.withColdQuerySlot(ctx, func() error {
+			coldChunks, err := c.cold.fetchChunks(ctx, userID, from, through, cold)
+			chunks = append(chunks, coldChunks...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(ByID(chunks))
+
+	// Give downsampled chunks back their series' names.
+	renames := map[string]model.LabelValue{}
+	for _, ref := range refs {
+		if ref.rawName != "" {
+			renames[ref.ID] = ref.rawName
+		}
+	}
+	for i := range chunks {
+		if name, ok := renames[chunks[i].ID]; ok {
+			chunks[i].Metric = chunks[i].Metric.Clone()
+			chunks[i].Metric[model.MetricNameLabel] = name
+		}
+	}
+	return chunks, nil
+}
+
+// getDownsampledRefs is getDownsampled for GetChunkRefs.
+func (c *AWSStore) getDownsampledRefs(ctx context.Context, from, cutoff, through model.Time, downsampledMatchers, matchers []*metric.LabelMatcher, name model.LabelValue) ([]ChunkRef, error) {
+	downsampledQueries.Inc()
+	refs, err := c.GetChunkRefs(ctx, from, cutoff-1, downsampledMatchers...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range refs {
+		refs[i].rawName = name
+		if refs[i].Metric != nil {
+			refs[i].Metric = refs[i].Metric.Clone()
+			refs[i].Metric[model.MetricNameLabel] = name
+		}
+	}
+	if cutoff <= through {
+		raw, err := c.GetChunkRefs(ctx, cutoff, through, append([]*metric.LabelMatcher(nil), matchers...)...)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, raw...)
+	}
+	sort.Sort(refsByID(refs))
+	return refs, nil
+}
@@ -0,0 +1,88 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestChunkRefs(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	oldChunk := newTestChunk(t, now.Add(-48*time.Hour), 10)
+	newChunk := newTestChunk(t, now, 10)
+
+	objects := &countingObjectClient{ObjectClient: NewMemoryObjectClient()}
+	coldObjects := &countingObjectClient{ObjectClient: objects.ObjectClient}
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		ColdData: ColdDataConfig{
+			MinAge: 24 * time.Hour,
+			S3:     coldObjects,
+		},
+	})
+	if err := store.Put(ctx, []Chunk{oldChunk, newChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		from, through model.Time
+		expected      []Chunk
+		gets          int32
+		coldGets      int32
+	}{
+		{now.Add(-72 * time.Hour), now, []Chunk{oldChunk, newChunk}, 2, 0},
+		{now.Add(-72 * time.Hour), now.Add(-47 * time.Hour), []Chunk{oldChunk}, 0, 1},
+	} {
+		objects.gets, coldObjects.gets = 0, 0
+		refs, err := store.GetChunkRefs(ctx, tc.from, tc.through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != len(tc.expected) {
+			t.Fatalf("expected %d refs, got %d", len(tc.expected), len(refs))
+		}
+		for i, ref := range refs {
+			chunk := tc.expected[i]
+			if ref.ID != chunk.ID || ref.Fingerprint != model.Fingerprint(1) || ref.From != chunk.From || ref.Through != chunk.Through {
+				t.Fatalf("ref %+v doesn't describe chunk %s", ref, chunk.ID)
+			}
+		}
+		if objects.gets != 0 || coldObjects.gets != 0 {
+			t.Fatalf("chunks fetched looking up refs")
+		}
+
+		chunks, err := store.FetchChunks(ctx, tc.from, tc.through, refs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.expected, chunks) {
+			t.Fatalf("wrong chunks - %s", diff(tc.expected, chunks))
+		}
+		if objects.gets != tc.gets || coldObjects.gets != tc.coldGets {
+			t.Fatalf("expected %d and %d cold gets, got %d and %d", tc.gets, tc.coldGets, objects.gets, coldObjects.gets)
+		}
+	}
+
+	// Fetching some refs only fetches their chunks.
+	refs, err := store.GetChunkRefs(ctx, now.Add(-72*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := store.FetchChunks(ctx, now.Add(-72*time.Hour), now, refs[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Chunk{newChunk}; !reflect.DeepEqual(expected, chunks) {
+		t.Fatalf("wrong chunks - %s", diff(expected, chunks))
+	}
+}
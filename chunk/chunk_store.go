@@ -1,34 +1,51 @@
 package chunk
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sort"
 	"strconv"
-	"sync/atomic"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
-	"github.com/sburnett/lexicographic-tuples"
+	"github.com/weaveworks/common/mtime"
 	"github.com/weaveworks/scope/common/instrument"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
 )
 
 const (
 	hashKey  = "h"
 	rangeKey = "r"
 	chunkKey = "c"
+	ttlKey   = "t"
+
+	// Attribute of series entries holding the chunk's metric; see
+	// seriesName.
+	metricKey = "m"
 
 	secondsInHour = int64(time.Hour / time.Second)
 	secondsInDay  = int64(24 * time.Hour / time.Second)
+
+	// MaxInlineChunkSize is the largest StoreConfig.InlineChunkMaxSize
+	// allowed.  Every index entry of an inline chunk holds a copy of it, and
+	// DynamoDB items are limited to 400KB, including the entry's keys.
+	MaxInlineChunkSize = 64 * 1024
 )
 
 var (
@@ -69,6 +86,31 @@ var (
 		Help:      "The number of chunks IDs fetched from Dynamo but later dropped for not matching (per DynamoDB request).",
 		Buckets:   prometheus.ExponentialBuckets(1, 2.0, 5),
 	})
+	queryReadFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_dynamo_read_fallbacks_total",
+		Help:      "The number of DynamoDB queries retried against the next read replica.",
+	}, []string{"reason"})
+	fetchQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_fetch_queue_length",
+		Help:      "The number of chunks waiting for a fetch worker, across all queries.",
+	})
+	corruptChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_corrupt_chunks_total",
+		Help:      "The number of chunks fetched from S3 which couldn't be decoded, eg because they didn't match their checksum.",
+	})
+	futureTableRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_future_table_rejections_total",
+		Help:      "The number of chunks not stored because they would be indexed in a periodic table which isn't expected to exist yet.",
+	})
+	inlineChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_inline_chunks_total",
+		Help:      "The number of chunks small enough to be stored in their index entries rather than S3.",
+	})
 )
 
 func init() {
@@ -78,26 +120,191 @@ func init() {
 	prometheus.MustRegister(queryDynamoLookups)
 	prometheus.MustRegister(queryRequestPages)
 	prometheus.MustRegister(queryDroppedMatches)
+	prometheus.MustRegister(queryReadFallbacks)
+	prometheus.MustRegister(fetchQueueLength)
+	prometheus.MustRegister(corruptChunks)
+	prometheus.MustRegister(futureTableRejections)
+	prometheus.MustRegister(inlineChunks)
 }
 
 // Store type stores and indexes chunks
 type Store interface {
 	Put(ctx context.Context, chunks []Chunk) error
 	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error)
+
+	// Delete deletes the samples of the series matching matchers between
+	// from and through.
+	Delete(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) error
+
+	// Scan calls callback with each of the user's chunks overlapping from
+	// and through, in no particular order, for offline jobs which need every
+	// chunk rather than those matching a query.  It stops at the first
+	// error callback returns, and returns it.
+	Scan(ctx context.Context, from, through model.Time, callback func(Chunk) error) error
+
+	// LabelValues returns the values of a label on the user's chunks
+	// between from and through, and LabelNames the names of their labels,
+	// both sorted, from the index alone, without fetching chunks.
+	LabelValues(ctx context.Context, from, through model.Time, labelName model.LabelName) (model.LabelValues, error)
+	LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error)
 }
 
 // StoreConfig specifies config for a ChunkStore
 type StoreConfig struct {
-	S3         S3Client
+	S3         ObjectClient
 	BucketName string
-	DynamoDB   DynamoDBClient
+	DynamoDB   IndexClient
 	TableName  string
 	ChunkCache *Cache
 
+	// URL of the object store holding chunks, from which NewStore makes S3
+	// and BucketName if S3 isn't set; see NewObjectClient.
+	StorageURL string
+
+	// Server-side encryption requested for objects written to S3: empty for
+	// the bucket's default, s3.ServerSideEncryptionAes256 for SSE-S3, or
+	// s3.ServerSideEncryptionAwsKms for SSE-KMS, with the KMS key
+	// SSEKMSKeyID (or the account's default key, if empty).  Other object
+	// stores ignore them.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+
+	// If non-zero, chunks are written under keys prefixed with one of this
+	// many shards, to spread writes across S3 partitions; see
+	// shardKeyPrefix.  Must not be changed once chunks have been written.
+	ChunkKeyShards int
+
+	// DynamoDB clients to read the index from, in order of preference.  If
+	// empty, reads go to DynamoDB.  Used with DynamoDB Global Tables so that
+	// queriers can read from their local region, and only go cross-region
+	// on error (or on an empty result, if ReadFallbackOnMiss is set).  All
+	// replicas must use the same table names.
+	ReadDynamoDB       []IndexClient
+	ReadFallbackOnMiss bool
+
+	// If non-zero, index entries are written with an expiry time (in the
+	// ttlKey attribute) this far in the future, so DynamoDB TTL can expire
+	// them.  TTL must be enabled on the table(s) separately, and should be
+	// matched by an S3 lifecycle rule expiring the chunks themselves.
+	IndexEntryTTL time.Duration
+
+	// If non-zero, queries matching more than this many series fail with a
+	// TooManySeriesError.
+	MaxSeriesPerQuery int
+
+	// Series count sketches are persisted for buckets which ended at least
+	// this long ago, after which no more chunks are expected to be written to
+	// them.  If zero, sketches are never persisted.
+	SeriesSketchMinAge time.Duration
+
+	// The most persisted sketches kept in memory, so the series limit's
+	// pre-flight check doesn't read them from S3 for every query.
+	SeriesSketchCacheSize int
+
+	// If set, SeriesCount persists the sketches it builds for buckets older
+	// than SeriesSketchMinAge.  Otherwise persisted sketches are only read.
+	// Either way, they are deleted when chunks in their buckets are written
+	// or deleted.
+	SeriesSketchWriteOnRead bool
+
+	// If non-zero, the maximum number of goroutines building or loading
+	// sketches for each series count.  Otherwise each bucket gets its own
+	// goroutine.
+	SeriesSketchWorkers int
+
+	// Bounds on the number of chunks fetched from S3 in parallel, across
+	// all queries.  Within them, the limit adapts to S3's latency.
+	FetchParallelism AIMDConfig
+
+	// If non-zero, the maximum number of goroutines fetching chunks for
+	// each query; the rest of its chunks queue for them.  Otherwise each
+	// chunk gets its own goroutine.
+	FetchWorkers int
+
+	// If non-zero, chunks whose encoded, compressed form is at most this
+	// many bytes are stored in the chunk attribute of each of their index
+	// entries instead of in S3, saving an S3 round trip when they're read.
+	// At most MaxInlineChunkSize.  Inline chunks are not found when
+	// rebuilding the index from S3, nor by bucket indexes, nameless queries,
+	// Purge or DeleteTenant, which list S3, so NewStore refuses to use them
+	// with BucketIndex or NamelessQueries, or without IndexEntryTTL to
+	// expire them.
+	InlineChunkMaxSize int
+
+	// Version of the IDs chunks are written with; see ChunkIDV1 and
+	// ChunkIDV2.  IDs of both versions can always be read.
+	ChunkIDVersion int
+
+	// Format chunks are written to S3 in; see ChunkFormatV1 and ChunkFormatV2.
+	// Both formats can always be read.
+	ChunkFormatVersion int
+
+	// If set, chunks which are corrupt, eg because they don't match their
+	// checksum, are left out of query results rather than failing the query.
+	SkipCorruptChunks bool
+
+	// Compression applied to chunks written to S3; see ChunkCompressionNone,
+	// ChunkCompressionSnappy and ChunkCompressionGzip.  Chunks can always be
+	// read, however they were compressed.
+	ChunkCompression string
+
+	// If non-zero, when a query needs less than this fraction of a chunk's
+	// time range, only the blocks of a version 2 chunk covering the query are
+	// fetched, with S3 range GETs.
+	RangeReadFraction float64
+
+	// Hedging of chunk fetches from S3, to cut tail latency.
+	FetchHedging HedgingConfig
+
+	// Hedging of index queries.  Hedged queries toggle ConsistentRead, so
+	// they are likely to be served by a different replica.
+	QueryHedging HedgingConfig
+
+	// If set, chunks are claimed with a conditional write before being
+	// written, so that when replicas flush the same chunk only one of them
+	// writes its object and index entries.
+	WriteDedup bool
+
+	// How often the query planner's per-label selectivity statistics are
+	// persisted to S3, so they survive restarts and are shared between
+	// queriers.  If zero, they are only kept in memory.
+	SelectivityStatsPersistInterval time.Duration
+
+	// The most metrics the query planner keeps selectivity statistics for
+	// in memory.  If zero, there is no limit.
+	SelectivityStatsCacheSize int
+
+	// If non-zero, chunks are only indexed in periodic tables up to the one
+	// covering this far in the future, which should be at most the table
+	// manager's creation grace period, so those tables exist.  Writes of
+	// chunks from further in the future, eg from clients with skewed clocks,
+	// fail without writing anything, and succeed on retry once their table
+	// is due to exist.
+	FutureTableTolerance time.Duration
+
+	// Caching of index lookups.
+	IndexCache IndexCacheConfig
+
+	// Use of per-user bucket indexes to skip index buckets with no chunks.
+	BucketIndex BucketIndexConfig
+
+	// A separate read path for queries of old data.
+	ColdData ColdDataConfig
+
+	// Downsampled resolutions, and which queries read them.
+	Downsampling DownsamplingConfig
+
+	// Fallback for queries without a metric name.
+	NamelessQueries NamelessQueryConfig
+
 	// After midnight on this day, we start bucketing indexes by day instead of by
-	// hour.  Only the day matters, not the time within the day.
+	// hour.  Only the day matters, not the time within the day.  Ignored if
+	// Schema has periods.
 	DailyBucketsFrom model.Time
 
+	// The index schemas in effect over time.
+	Schema SchemaConfig
+
 	PeriodicTableConfig
 }
 
@@ -109,77 +316,200 @@ type PeriodicTableConfig struct {
 	TablePrefix          string
 	TablePeriod          time.Duration
 	PeriodicTableStartAt time.Time
+
+	// Index buckets starting within this long of a table boundary (including
+	// PeriodicTableStartAt) are written to the tables on both sides of it,
+	// and read from both, so that a chunk is found while the table config is
+	// rolled out, whichever config it was written with.  Must be less than
+	// the table manager's creation grace period, so both tables exist, and
+	// much less than TablePeriod.
+	TableBoundaryOverlap time.Duration
 }
 
 // AWSStore implements ChunkStore for AWS
 type AWSStore struct {
 	cfg StoreConfig
 
-	dynamo *dynamoDBBackoffClient
+	dynamo       *dynamoDBBackoffClient
+	dynamoReads  []*dynamoDBBackoffClient
+	fetchLimiter *aimdLimiter
+	fetchHedger  *hedger
+	queryHedger  *hedger
+
+	selectivityStats *selectivityStats
+	bucketIndexes    *bucketIndexes
+	bloomFilters     *bloomFilters
+	sketches         *seriesSketches
+	indexCache       *indexCache // nil if index lookups aren't cached.
+
+	// Reads queries of cold data, if ColdData.MinAge is set; see
+	// ColdDataConfig.
+	cold           *AWSStore
+	coldQuerySlots chan struct{}
 }
 
 // NewAWSStore makes a new ChunkStore
 func NewAWSStore(cfg StoreConfig) *AWSStore {
-	return &AWSStore{
-		cfg:    cfg,
-		dynamo: newDynamoDBBackoffClient(cfg.DynamoDB),
+	dynamo := newDynamoDBBackoffClient(cfg.DynamoDB, cfg.PeriodicTableConfig)
+	dynamoReads := []*dynamoDBBackoffClient{dynamo}
+	if len(cfg.ReadDynamoDB) > 0 {
+		dynamoReads = make([]*dynamoDBBackoffClient, 0, len(cfg.ReadDynamoDB))
+		for _, client := range cfg.ReadDynamoDB {
+			dynamoReads = append(dynamoReads, newDynamoDBBackoffClient(client, cfg.PeriodicTableConfig))
+		}
+	}
+	store := &AWSStore{
+		cfg:          cfg,
+		dynamo:       dynamo,
+		dynamoReads:  dynamoReads,
+		fetchLimiter: newAIMDLimiter(cfg.FetchParallelism, fetchParallelism),
+		fetchHedger:  newHedger("S3.GetObject", cfg.FetchHedging),
+		queryHedger:  newHedger("DynamoDB.QueryPages", cfg.QueryHedging),
+
+		selectivityStats: newSelectivityStats(cfg.SelectivityStatsCacheSize),
+		bucketIndexes:    newBucketIndexes(),
+		bloomFilters:     newBloomFilters(cfg.BucketIndex.BloomFilters),
+		sketches:         newSeriesSketches(cfg.SeriesSketchCacheSize),
+	}
+	if cfg.IndexCache.Validity > 0 {
+		store.indexCache = newIndexCache(cfg.IndexCache)
+	}
+	if cfg.ColdData.MinAge > 0 {
+		store.cold = store.coldStore()
+		if cfg.ColdData.MaxQueries > 0 {
+			store.coldQuerySlots = make(chan struct{}, cfg.ColdData.MaxQueries)
+		}
 	}
+	return store
+}
+
+// NewStore makes a new AWSStore, first making its ObjectClient from
+// StorageURL if S3 isn't set.
+func NewStore(cfg StoreConfig) (*AWSStore, error) {
+	switch cfg.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256:
+		if cfg.SSEKMSKeyID != "" {
+			return nil, fmt.Errorf("KMS key ID given without %s server-side encryption", s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption %q", cfg.ServerSideEncryption)
+	}
+	if cfg.InlineChunkMaxSize > MaxInlineChunkSize {
+		return nil, fmt.Errorf("inline chunks can be at most %d bytes, not %d", MaxInlineChunkSize, cfg.InlineChunkMaxSize)
+	}
+	if cfg.InlineChunkMaxSize > 0 && cfg.IndexEntryTTL == 0 {
+		// Purge and DeleteTenant list the object store, so only the TTL
+		// deletes inline chunks.
+		return nil, fmt.Errorf("inline chunks need an index entry TTL to expire them, as retention and tenant deletion only find chunks in the object store")
+	}
+	if cfg.InlineChunkMaxSize > 0 && (cfg.BucketIndex.RefreshInterval > 0 || cfg.BucketIndex.BloomFilters > 0) {
+		// Queries would skip buckets, or lookups, whose only chunks are
+		// inline.
+		return nil, fmt.Errorf("inline chunks can't be used with bucket indexes or bloom filters, which only know of chunks in the object store")
+	}
+	if cfg.InlineChunkMaxSize > 0 && cfg.NamelessQueries.Enabled {
+		// The scan for queries without a metric name lists the object
+		// store, so would miss inline chunks.
+		return nil, fmt.Errorf("inline chunks can't be used with nameless queries, which only scan chunks in the object store")
+	}
+	if cfg.S3 == nil {
+		var err error
+		cfg.S3, cfg.BucketName, err = NewObjectClient(cfg.StorageURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ColdData.S3 == nil && cfg.ColdData.StorageURL != "" {
+		var (
+			bucketName string
+			err        error
+		)
+		cfg.ColdData.S3, bucketName, err = NewObjectClient(cfg.ColdData.StorageURL)
+		if err != nil {
+			return nil, err
+		}
+		if bucketName != cfg.BucketName {
+			return nil, fmt.Errorf("cold data bucket %q isn't the chunk bucket %q", bucketName, cfg.BucketName)
+		}
+	}
+	return NewAWSStore(cfg), nil
 }
 
 type bucketSpec struct {
 	tableName string
 	bucket    string
+	schema    string // See IndexSchemaV1.
+	shards    int    // If zero, hash values aren't sharded.
+
+	// Labels chunks are also indexed by, for queries without a metric name;
+	// see PeriodConfig.IndexedLabels.
+	indexedLabels []model.LabelName
+
+	// The table on the other side of a nearby table boundary, which the
+	// bucket is also written to and read from; see TableBoundaryOverlap.
+	overlapTableName string
 }
 
 // bigBuckets generates the list of "big buckets" for a given time range.
 // These buckets are used in the hash key of the inverted index, and need to
 // be deterministic for both reads and writes.
 //
-// This function deals with any changes from one bucketing scheme to another -
-// for instance, it knows the date at which to migrate from hourly buckets to
-// to weekly buckets.
+// This function deals with any changes from one bucketing scheme to another,
+// as listed in the schema config - for instance, it knows the date at which
+// to migrate from hourly buckets to daily buckets.
 func (c *AWSStore) bigBuckets(from, through model.Time) []bucketSpec {
 	var (
-		fromHour    = from.Unix() / secondsInHour
-		throughHour = through.Unix() / secondsInHour
-
-		fromDay    = from.Unix() / secondsInDay
-		throughDay = through.Unix() / secondsInDay
-
-		firstDailyBucket = c.cfg.DailyBucketsFrom.Unix() / secondsInDay
-		lastHourlyBucket = firstDailyBucket * 24
-
+		schema = c.cfg.schema()
 		result []bucketSpec
 	)
-
-	for i := fromHour; i <= throughHour; i++ {
-		if i >= lastHourlyBucket {
-			break
+	for i, period := range schema.Periods {
+		lo, hi := from.Unix(), through.Unix()
+		if start := period.start(); i > 0 && lo < start {
+			lo = start
 		}
-		result = append(result, bucketSpec{
-			tableName: c.tableForBucket(i * secondsInHour),
-			bucket:    strconv.Itoa(int(i)),
-		})
-	}
-
-	for i := fromDay; i <= throughDay; i++ {
-		if i < firstDailyBucket {
+		if end := schema.end(i); hi >= end {
+			hi = end - 1
+		}
+		if lo > hi {
 			continue
 		}
-		result = append(result, bucketSpec{
-			tableName: c.tableForBucket(i * secondsInDay),
-			bucket:    fmt.Sprintf("d%d", int(i)),
-		})
+		size := int64(period.BucketSize / time.Second)
+		for b := lo / size; b <= hi/size; b++ {
+			result = append(result, c.bucketSpec(period, b*size))
+		}
 	}
-
 	return result
 }
 
+func (c *AWSStore) bucketSpec(period PeriodConfig, bucketStart int64) bucketSpec {
+	spec := bucketSpec{
+		tableName: c.tableForBucket(bucketStart),
+		bucket:    bucketName(period.BucketSize, bucketStart),
+		schema:    period.Schema,
+		shards:    period.Shards,
+
+		indexedLabels: period.IndexedLabels,
+	}
+	if overlap := int64(c.cfg.TableBoundaryOverlap / time.Second); overlap > 0 {
+		if before := c.tableForBucket(bucketStart - overlap); before != spec.tableName {
+			spec.overlapTableName = before
+		} else if after := c.tableForBucket(bucketStart + overlap); after != spec.tableName {
+			spec.overlapTableName = after
+		}
+	}
+	return spec
+}
+
 func (c *AWSStore) tableForBucket(bucketStart int64) string {
 	if !c.cfg.UsePeriodicTables || bucketStart < (c.cfg.PeriodicTableStartAt.Unix()) {
 		return c.cfg.TableName
 	}
-	return c.cfg.TablePrefix + strconv.Itoa(int(bucketStart/int64(c.cfg.TablePeriod/time.Second)))
+	prefix := c.cfg.schema().periodAt(bucketStart).TablePrefix
+	if prefix == "" {
+		prefix = c.cfg.TablePrefix
+	}
+	return prefix + strconv.Itoa(int(bucketStart/int64(c.cfg.TablePeriod/time.Second)))
 }
 
 func chunkName(userID, chunkID string) string {
@@ -190,15 +520,34 @@ func hashValue(userID, bucket string, metricName model.LabelValue) string {
 	return fmt.Sprintf("%s:%s:%s", userID, bucket, metricName)
 }
 
-func rangeValue(label model.LabelName, value model.LabelValue, chunkID string) ([]byte, error) {
-	return lex.Encode(string(label), string(value), chunkID)
+// hashValues returns the hash values a metric's index entries in the bucket
+// are written under: one per shard.
+func (b bucketSpec) hashValues(userID string, metricName model.LabelValue) []string {
+	if b.shards == 0 {
+		return []string{hashValue(userID, b.bucket, metricName)}
+	}
+	hashValues := make([]string, 0, b.shards)
+	for shard := 0; shard < b.shards; shard++ {
+		hashValues = append(hashValues, shardedHashValue(userID, b.bucket, metricName, shard))
+	}
+	return hashValues
 }
 
-func parseRangeValue(v []byte) (label model.LabelName, value model.LabelValue, chunkID string, err error) {
-	var labelStr, valueStr string
-	_, err = lex.Decode(v, &labelStr, &valueStr, &chunkID)
-	label, value = model.LabelName(labelStr), model.LabelValue(valueStr)
-	return
+// seriesHashValue returns the hash value the index entries of the series
+// with fingerprint fp are written under in the bucket.
+func (b bucketSpec) seriesHashValue(userID string, metricName model.LabelValue, fp model.Fingerprint) string {
+	if b.shards == 0 {
+		return hashValue(userID, b.bucket, metricName)
+	}
+	return shardedHashValue(userID, b.bucket, metricName, int(uint64(fp)%uint64(b.shards)))
+}
+
+// shardedHashValue is the hash value of a shard of a metric's index entries
+// from IndexSchemaV2 on: a hash of the user, bucket and metric name, so the
+// key doesn't grow with them, followed by the shard.
+func shardedHashValue(userID, bucket string, metricName model.LabelValue, shard int) string {
+	sum := sha256.Sum256([]byte(hashValue(userID, bucket, metricName)))
+	return fmt.Sprintf("%s:%d", base64.RawURLEncoding.EncodeToString(sum[:16]), shard)
 }
 
 // Put implements ChunkStore
@@ -208,21 +557,73 @@ func (c *AWSStore) Put(ctx context.Context, chunks []Chunk) error {
 		return err
 	}
 
+	if err := c.checkFutureTables(chunks); err != nil {
+		return err
+	}
+
+	if c.cfg.ChunkIDVersion == ChunkIDV2 {
+		// Don't change the IDs of the caller's chunks.
+		chunks = append([]Chunk(nil), chunks...)
+		if err := c.assignChunkIDs(chunks); err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.WriteDedup {
+		if chunks = c.claimChunks(ctx, userID, chunks); len(chunks) == 0 {
+			return nil
+		}
+	}
+
+	if c.cfg.InlineChunkMaxSize > 0 && c.cfg.ChunkIDVersion != ChunkIDV2 {
+		// putChunks marks the chunks it inlines, so don't touch the caller's.
+		chunks = append([]Chunk(nil), chunks...)
+	}
 	err = c.putChunks(ctx, userID, chunks)
 	if err != nil {
 		return err
 	}
 
-	return c.updateIndex(ctx, userID, chunks)
+	if err := c.updateIndex(ctx, userID, chunks); err != nil {
+		return err
+	}
+
+	if c.cfg.WriteDedup {
+		return c.completeClaims(ctx, userID, chunks)
+	}
+	return nil
+}
+
+// checkFutureTables returns an error if any of the chunks could be indexed
+// in a periodic table after the one covering FutureTableTolerance from now.
+// A chunk's index entries go in tables no later than the one covering its
+// end time, plus the boundary overlap.
+func (c *AWSStore) checkFutureTables(chunks []Chunk) error {
+	if !c.cfg.UsePeriodicTables || c.cfg.FutureTableTolerance == 0 {
+		return nil
+	}
+	var (
+		tablePeriodSecs = int64(c.cfg.TablePeriod / time.Second)
+		lastTable       = mtime.Now().Add(c.cfg.FutureTableTolerance).Unix() / tablePeriodSecs
+	)
+	for _, chunk := range chunks {
+		latest := chunk.Through.Add(c.cfg.TableBoundaryOverlap).Unix()
+		if latest < c.cfg.PeriodicTableStartAt.Unix() || latest/tablePeriodSecs <= lastTable {
+			continue
+		}
+		futureTableRejections.Add(float64(len(chunks)))
+		return fmt.Errorf("chunk %s ends at %v, too far in the future: table %s may not exist yet", chunk.ID, chunk.Through, c.tableForBucket(latest))
+	}
+	return nil
 }
 
 // putChunks writes a collection of chunks to S3 in parallel.
 func (c *AWSStore) putChunks(ctx context.Context, userID string, chunks []Chunk) error {
 	incomingErrors := make(chan error)
-	for _, chunk := range chunks {
-		go func(chunk Chunk) {
-			incomingErrors <- c.putChunk(ctx, userID, &chunk)
-		}(chunk)
+	for i := range chunks {
+		go func(chunk *Chunk) {
+			incomingErrors <- c.putChunk(ctx, userID, chunk)
+		}(&chunks[i])
 	}
 
 	var lastErr error
@@ -235,20 +636,34 @@ func (c *AWSStore) putChunks(ctx context.Context, userID string, chunks []Chunk)
 	return lastErr
 }
 
-// putChunk puts a chunk into S3.
+// putChunk puts a chunk into S3, or, if it's small enough to be stored in
+// its index entries, sets its inline data instead.
 func (c *AWSStore) putChunk(ctx context.Context, userID string, chunk *Chunk) error {
-	body, err := chunk.reader()
+	body, err := chunk.encode(c.cfg.ChunkFormatVersion)
 	if err != nil {
 		return err
 	}
+	if c.cfg.ChunkCompression != ChunkCompressionNone {
+		if body, err = compressChunk(body, c.cfg.ChunkCompression); err != nil {
+			return err
+		}
+	}
+	if c.cfg.InlineChunkMaxSize > 0 {
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if len(buf) <= c.cfg.InlineChunkMaxSize {
+			inlineChunks.Inc()
+			chunk.inline = buf
+			return nil
+		}
+		body = bytes.NewReader(buf)
+	}
 
 	err = instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
 		var err error
-		_, err = c.cfg.S3.PutObject(&s3.PutObjectInput{
-			Body:   body,
-			Bucket: aws.String(c.cfg.BucketName),
-			Key:    aws.String(chunkName(userID, chunk.ID)),
-		})
+		_, err = c.cfg.S3.PutObject(c.putObjectInput(c.chunkKeys(userID, chunk.ID)[0], body))
 		return err
 	})
 	if err != nil {
@@ -263,13 +678,33 @@ func (c *AWSStore) putChunk(ctx context.Context, userID string, chunk *Chunk) er
 	return nil
 }
 
+// putObjectInput makes the input to write an object to S3, with the
+// configured server-side encryption.
+func (c *AWSStore) putObjectInput(key string, body io.ReadSeeker) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Body:   body,
+		Bucket: aws.String(c.cfg.BucketName),
+		Key:    aws.String(key),
+	}
+	if c.cfg.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(c.cfg.ServerSideEncryption)
+	}
+	if c.cfg.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.cfg.SSEKMSKeyID)
+	}
+	return input
+}
+
 func (c *AWSStore) updateIndex(ctx context.Context, userID string, chunks []Chunk) error {
 	writeReqs, err := c.calculateDynamoWrites(userID, chunks)
 	if err != nil {
 		return err
 	}
 
-	return c.dynamo.batchWriteDynamo(ctx, writeReqs)
+	if err := c.dynamo.batchWriteDynamo(ctx, writeReqs); err != nil {
+		return err
+	}
+	return c.invalidateSketches(ctx, userID, chunks)
 }
 
 // calculateDynamoWrites creates a set of batched WriteRequests to dynamo for all
@@ -278,6 +713,12 @@ func (c *AWSStore) updateIndex(ctx context.Context, userID string, chunks []Chun
 // Creates one WriteRequest per bucket per metric per chunk.
 func (c *AWSStore) calculateDynamoWrites(userID string, chunks []Chunk) (map[string][]*dynamodb.WriteRequest, error) {
 	writeReqs := map[string][]*dynamodb.WriteRequest{}
+	var expiry *dynamodb.AttributeValue
+	if c.cfg.IndexEntryTTL > 0 {
+		expiry = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(mtime.Now().Add(c.cfg.IndexEntryTTL).Unix(), 10)),
+		}
+	}
 	for _, chunk := range chunks {
 		metricName, ok := chunk.Metric[model.MetricNameLabel]
 		if !ok {
@@ -285,26 +726,89 @@ func (c *AWSStore) calculateDynamoWrites(userID string, chunks []Chunk) (map[str
 		}
 
 		entries := 0
+		addEntry := func(bucket bucketSpec, hashValue string, label model.LabelName, value model.LabelValue, metric []byte) error {
+			entries++
+			rangeValue, err := rangeValue(bucket.schema, label, value, chunk.ID)
+			if err != nil {
+				return err
+			}
+			item := map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String(hashValue)},
+				rangeKey: {B: rangeValue},
+			}
+			if expiry != nil {
+				item[ttlKey] = expiry
+			}
+			if chunk.inline != nil {
+				item[chunkKey] = &dynamodb.AttributeValue{B: chunk.inline}
+			}
+			if metric != nil {
+				item[metricKey] = &dynamodb.AttributeValue{B: metric}
+			}
+			writeReqs[bucket.tableName] = append(writeReqs[bucket.tableName], &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{
+					Item: item,
+				},
+			})
+			if bucket.overlapTableName != "" {
+				writeReqs[bucket.overlapTableName] = append(writeReqs[bucket.overlapTableName], &dynamodb.WriteRequest{
+					PutRequest: &dynamodb.PutRequest{
+						Item: item,
+					},
+				})
+			}
+			return nil
+		}
+
+		fp := chunk.Metric.Fingerprint()
 		for _, bucket := range c.bigBuckets(chunk.From, chunk.Through) {
-			hashValue := hashValue(userID, bucket.bucket, metricName)
+			hashValue := bucket.seriesHashValue(userID, metricName, fp)
 			for label, value := range chunk.Metric {
 				if label == model.MetricNameLabel {
 					continue
 				}
+				if err := addEntry(bucket, hashValue, label, value, nil); err != nil {
+					return nil, err
+				}
+			}
+
+			// Entries under indexed labels include one for the metric name,
+			// which queries looked up by them may match on.
+			for _, hashValue := range bucket.indexedLabelHashValues(userID, chunk.Metric, fp) {
+				for label, value := range chunk.Metric {
+					if err := addEntry(bucket, hashValue, label, value, nil); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			if labelNameEntries(bucket.schema) {
+				namesHashValue := bucket.seriesHashValue(userID, labelNamesName(metricName), fp)
+				allNamesHashValue := bucket.seriesHashValue(userID, allLabelNamesName, fp)
+				for label, value := range chunk.Metric {
+					if err := addEntry(bucket, bucket.seriesHashValue(userID, labelValuesName(label), fp), label, value, nil); err != nil {
+						return nil, err
+					}
+					if err := addEntry(bucket, allNamesHashValue, label, "", nil); err != nil {
+						return nil, err
+					}
+					if label == model.MetricNameLabel {
+						continue
+					}
+					if err := addEntry(bucket, namesHashValue, label, "", nil); err != nil {
+						return nil, err
+					}
+				}
+			}
 
-				entries++
-				rangeValue, err := rangeValue(label, value, chunk.ID)
+			if seriesEntries(bucket.schema) {
+				metric, err := json.Marshal(chunk.Metric)
 				if err != nil {
 					return nil, err
 				}
-				writeReqs[bucket.tableName] = append(writeReqs[bucket.tableName], &dynamodb.WriteRequest{
-					PutRequest: &dynamodb.PutRequest{
-						Item: map[string]*dynamodb.AttributeValue{
-							hashKey:  {S: aws.String(hashValue)},
-							rangeKey: {B: rangeValue},
-						},
-					},
-				})
+				if err := addEntry(bucket, bucket.seriesHashValue(userID, seriesName(metricName), fp), model.MetricNameLabel, metricName, metric); err != nil {
+					return nil, err
+				}
 			}
 		}
 		indexEntriesPerChunk.Observe(float64(entries))
@@ -314,18 +818,76 @@ func (c *AWSStore) calculateDynamoWrites(userID string, chunks []Chunk) (map[str
 
 // Get implements ChunkStore
 func (c *AWSStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	if cutoff, downsampledMatchers, name, ok := c.downsampledQuery(from, through, matchers); ok {
+		chunks, err := c.getDownsampled(ctx, from, cutoff, through, downsampledMatchers, matchers, name)
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(ByID(chunks))
+		return chunks, nil
+	}
+	if c.isCold(through) {
+		return c.getCold(ctx, from, through, matchers)
+	}
 	userID, err := user.GetID(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if c.namelessQuery(from, through, matchers) {
+		return c.scanNameless(ctx, userID, from, through, matchers)
+	}
 
-	missing, err := c.lookupChunks(ctx, userID, from, through, matchers)
+	// Chunks are fetched as each bucket's index lookup completes, overlapping
+	// the index lookups with the fetches.
+	type fetchResult struct {
+		chunks []Chunk
+		err    error
+	}
+	results := make(chan fetchResult)
+	fetches := 0
+	_, err = c.lookupChunks(ctx, userID, from, through, matchers, func(chunks []Chunk) {
+		fetches++
+		go func() {
+			chunks, err := c.fetchChunks(ctx, userID, from, through, chunks)
+			results <- fetchResult{chunks, err}
+		}()
+	})
+
+	// Always wait for the fetches, even if the lookup failed, so as not to
+	// leak goroutines.
+	var allChunks []Chunk
+	for i := 0; i < fetches; i++ {
+		result := <-results
+		if result.err != nil {
+			if err == nil {
+				err = result.err
+			}
+			continue
+		}
+		allChunks = append(allChunks, result.chunks...)
+	}
 	if err != nil {
 		return nil, err
 	}
-	queryChunks.Observe(float64(len(missing)))
 
-	var fromCache []Chunk
+	// TODO instead of doing this sort, propagate an index and assign chunks
+	// into the result based on that index.
+	sort.Sort(ByID(allChunks))
+	return allChunks, nil
+}
+
+// fetchChunks fetches the data for chunks, from the cache if possible and
+// otherwise from S3.  Only the data between from and through is guaranteed
+// to be fetched.
+func (c *AWSStore) fetchChunks(ctx context.Context, userID string, from, through model.Time, missing []Chunk) ([]Chunk, error) {
+	var (
+		fromCache []Chunk
+		err       error
+	)
+	fromIndex, missing, err := c.decodeInlineChunks(missing)
+	if err != nil {
+		return nil, err
+	}
 	if c.cfg.ChunkCache != nil {
 		fromCache, missing, err = c.cfg.ChunkCache.FetchChunkData(ctx, userID, missing)
 		if err != nil {
@@ -333,22 +895,71 @@ func (c *AWSStore) Get(ctx context.Context, from, through model.Time, matchers .
 		}
 	}
 
-	fromS3, err := c.fetchChunkData(ctx, userID, missing)
+	fromS3, err := c.fetchChunkData(ctx, userID, from, through, missing)
 	if err != nil {
 		return nil, err
 	}
 
 	if c.cfg.ChunkCache != nil {
-		if err = c.cfg.ChunkCache.StoreChunks(ctx, userID, fromS3); err != nil {
+		complete := make([]Chunk, 0, len(fromS3))
+		for _, chunk := range fromS3 {
+			if !chunk.partial {
+				complete = append(complete, chunk)
+			}
+		}
+		if err = c.cfg.ChunkCache.StoreChunks(ctx, userID, complete); err != nil {
 			log.Warnf("Could not store chunks in chunk cache: %v", err)
 		}
 	}
+	return append(append(fromIndex, fromCache...), fromS3...), nil
+}
 
-	// TODO instead of doing this sort, propagate an index and assign chunks
-	// into the result based on that index.
-	allChunks := append(fromCache, fromS3...)
-	sort.Sort(ByID(allChunks))
-	return allChunks, nil
+// decodeInlineChunks decodes the chunks stored in their index entries,
+// returning them and the chunks which need fetching.
+func (c *AWSStore) decodeInlineChunks(chunks []Chunk) ([]Chunk, []Chunk, error) {
+	var decoded, rest []Chunk
+	for _, chunk := range chunks {
+		if chunk.inline == nil {
+			rest = append(rest, chunk)
+			continue
+		}
+		err := chunk.decode(bytes.NewReader(chunk.inline))
+		if err == nil {
+			err = chunk.verifyID()
+		}
+		err = corruptChunkError(&chunk, err)
+		chunk.inline = nil
+		if err != nil {
+			if err = c.fetchError(err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		decoded = append(decoded, chunk)
+	}
+	return decoded, rest, nil
+}
+
+// lookupName returns the name chunks matching a query in buckets are
+// indexed under, and the query's other matchers: its metric name, or else
+// one of its indexed labels.  Failing those, if the buckets have label name
+// entries, the name is empty, and each matcher is looked up under its
+// label's; see matcherLookupName.
+func lookupName(buckets []bucketSpec, matchers []*metric.LabelMatcher) (model.LabelValue, []*metric.LabelMatcher, error) {
+	metricName, rest, err := extractMetricName(matchers)
+	if err == nil {
+		return metricName, rest, nil
+	}
+	name, rest, ok := extractIndexedLabel(buckets, matchers)
+	if ok {
+		namelessQueries.WithLabelValues("index").Inc()
+		return name, rest, nil
+	}
+	if labelEntryLookups(buckets, matchers) {
+		namelessQueries.WithLabelValues("labels").Inc()
+		return "", matchers, nil
+	}
+	return "", nil, err
 }
 
 func extractMetricName(matchers []*metric.LabelMatcher) (model.LabelValue, []*metric.LabelMatcher, error) {
@@ -366,20 +977,36 @@ func extractMetricName(matchers []*metric.LabelMatcher) (model.LabelValue, []*me
 	return "", nil, fmt.Errorf("no matcher for MetricNameLabel")
 }
 
-func (c *AWSStore) lookupChunks(ctx context.Context, userID string, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, error) {
-	metricName, matchers, err := extractMetricName(matchers)
+// lookupChunks looks up the chunks matching a query in the index.  As each
+// bucket's lookup completes, the chunks in it which are in the query's time
+// range and haven't been seen in another bucket are passed to fetch.  fetch is
+// called from a single goroutine, and is not called once the query is known
+// to match too many series.
+func (c *AWSStore) lookupChunks(ctx context.Context, userID string, from, through model.Time, matchers []*metric.LabelMatcher, fetch func([]Chunk)) ([]Chunk, error) {
+	buckets := c.bigBuckets(from, through)
+	metricName, matchers, err := lookupName(buckets, matchers)
 	if err != nil {
 		return nil, err
 	}
 
+	// For queries on just the metric name, persisted sketches give a lower
+	// bound on the number of series without reading the index.  Allow for
+	// the sketch's error before rejecting the query.
+	if c.cfg.MaxSeriesPerQuery > 0 && len(matchers) == 0 {
+		estimate := c.persistedSeriesCount(ctx, userID, from, through, metricName)
+		if estimate > uint64(c.cfg.MaxSeriesPerQuery)*105/100 {
+			return nil, c.tooManySeriesError(ctx, userID, buckets[len(buckets)-1], metricName, int(estimate))
+		}
+	}
+	buckets = c.skipEmptyBuckets(ctx, userID, buckets)
+
 	incomingChunkSets := make(chan ByID)
 	incomingErrors := make(chan error)
-	buckets := c.bigBuckets(from, through)
-	totalLookups := int32(0)
+	stats := NewLookupStats()
 	for _, b := range buckets {
 		go func(bucket bucketSpec) {
-			incoming, lookups, err := c.lookupChunksFor(ctx, userID, bucket, metricName, matchers)
-			atomic.AddInt32(&totalLookups, lookups)
+			incoming, lookups, err := c.lookupChunksFor(ctx, userID, bucket, metricName, matchers, from)
+			stats.add(bucket.bucket, lookups, len(incoming))
 			if err != nil {
 				incomingErrors <- err
 			} else {
@@ -388,45 +1015,109 @@ func (c *AWSStore) lookupChunks(ctx context.Context, userID string, from, throug
 		}(b)
 	}
 
-	var chunks ByID
-	var lastErr error
+	var (
+		filtered     []Chunk
+		seen         = map[string]struct{}{}
+		fingerprints = map[model.Fingerprint]struct{}{}
+		tooMany      bool
+		lastErr      error
+	)
 	for i := 0; i < len(buckets); i++ {
+		var incoming ByID
 		select {
-		case incoming := <-incomingChunkSets:
-			chunks = merge(chunks, incoming)
+		case incoming = <-incomingChunkSets:
 		case err := <-incomingErrors:
 			lastErr = err
+			continue
 		}
-	}
 
-	// Filter out chunks that are not in the selected time range.
-	filtered := make([]Chunk, 0, len(chunks))
-	for _, chunk := range chunks {
-		_, chunkFrom, chunkThrough, err := parseChunkID(chunk.ID)
-		if err != nil {
-			return nil, err
+		// Filter out chunks that are not in the selected time range, or that
+		// have already been found in another bucket.
+		var batch []Chunk
+		for _, chunk := range incoming {
+			if _, ok := seen[chunk.ID]; ok {
+				continue
+			}
+			seen[chunk.ID] = struct{}{}
+
+			fp, chunkFrom, chunkThrough, err := parseChunkID(chunk.ID)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if chunkThrough < from || through < chunkFrom {
+				continue
+			}
+			fingerprints[fp] = struct{}{}
+			batch = append(batch, chunk)
 		}
-		if chunkThrough < from || through < chunkFrom {
-			continue
+		filtered = append(filtered, batch...)
+
+		if c.cfg.MaxSeriesPerQuery > 0 && len(fingerprints) > c.cfg.MaxSeriesPerQuery {
+			tooMany = true
+		}
+		if len(batch) > 0 && !tooMany && lastErr == nil {
+			fetch(batch)
 		}
-		filtered = append(filtered, chunk)
 	}
 
-	queryDynamoLookups.Observe(float64(atomic.LoadInt32(&totalLookups)))
-	return filtered, lastErr
+	queryDynamoLookups.Observe(float64(stats.Lookups()))
+	if queryStats := lookupStatsFromContext(ctx); queryStats != nil {
+		queryStats.merge(stats)
+	}
+	queryChunks.Observe(float64(len(filtered)))
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	if tooMany {
+		// Sample the most recent bucket, as the one most likely to have the
+		// offending series.
+		return nil, c.tooManySeriesError(ctx, userID, buckets[len(buckets)-1], metricName, len(fingerprints))
+	}
+	return filtered, nil
 }
 
-func (c *AWSStore) lookupChunksFor(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matchers []*metric.LabelMatcher) (ByID, int32, error) {
-	if len(matchers) == 0 {
-		return c.lookupChunksForMetricName(ctx, userID, bucket, metricName)
+// lookupChunksFor looks up the chunks matching matchers in a bucket, and
+// returns them with the number of index lookups made.  Matchers which can be
+// looked up are, and the chunks they all match are the candidates; if there
+// are none, every chunk of the metric is.  Matchers matching the empty string
+// are then applied to the candidates, by removing the chunks their
+// complements match.
+func (c *AWSStore) lookupChunksFor(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matchers []*metric.LabelMatcher, from model.Time) (ByID, int, error) {
+	positive, negative := splitNegativeMatchers(matchers)
+	var (
+		candidates ByID
+		lookups    int
+		err        error
+	)
+	if len(positive) == 0 {
+		candidates, lookups, err = c.lookupChunksForMetricName(ctx, userID, bucket, metricName)
+	} else {
+		candidates, lookups, err = c.lookupChunksForMatchers(ctx, userID, bucket, metricName, positive, from)
 	}
+	if err != nil || len(negative) == 0 || len(candidates) == 0 {
+		return candidates, lookups, err
+	}
+
+	queryPlannerLookups.WithLabelValues("negative").Inc()
+	excluded, err := c.lookupComplements(ctx, userID, bucket, metricName, negative, from)
+	return difference(candidates, excluded), lookups + len(negative), err
+}
 
+// lookupComplements looks up the complements of matchers in parallel, and
+// returns the chunks any of them match.
+func (c *AWSStore) lookupComplements(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matchers []*metric.LabelMatcher, from model.Time) (ByID, error) {
 	incomingChunkSets := make(chan ByID)
 	incomingErrors := make(chan error)
-
 	for _, matcher := range matchers {
 		go func(matcher *metric.LabelMatcher) {
-			incoming, err := c.lookupChunksForMatcher(ctx, userID, bucket, metricName, matcher)
+			complement, err := complementMatcher(matcher)
+			if err != nil {
+				incomingErrors <- err
+				return
+			}
+			incoming, err := c.lookupChunksForMatcher(ctx, userID, bucket, metricName, complement, from)
 			if err != nil {
 				incomingErrors <- err
 			} else {
@@ -435,7 +1126,71 @@ func (c *AWSStore) lookupChunksFor(ctx context.Context, userID string, bucket bu
 		}(matcher)
 	}
 
+	var (
+		excluded ByID
+		lastErr  error
+	)
+	for i := 0; i < len(matchers); i++ {
+		select {
+		case incoming := <-incomingChunkSets:
+			excluded = merge(excluded, incoming)
+		case err := <-incomingErrors:
+			lastErr = err
+		}
+	}
+	return excluded, lastErr
+}
+
+// lookupChunksForMatchers looks up the chunks matching all of matchers,
+// which mustn't match the empty string.
+func (c *AWSStore) lookupChunksForMatchers(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matchers []*metric.LabelMatcher, from model.Time) (ByID, int, error) {
+	// If one matcher is known to be much more selective than the rest, look
+	// it up first: if it matches nothing, the others needn't be looked up,
+	// and otherwise they needn't read entries for chunks ending before any
+	// it found.
+	matchers, selective := c.planMatchers(ctx, userID, metricName, bucket.bucket, matchers)
 	var chunkSets []ByID
+	lookups := 0
+	restFrom := from
+	if selective {
+		incoming, err := c.lookupChunksForMatcher(ctx, userID, bucket, metricName, matchers[0], from)
+		lookups++
+		if err != nil {
+			return nil, lookups, err
+		}
+		c.recordSelectivity(userID, metricName, bucket.bucket, matchers[0].Name, len(incoming))
+		if len(incoming) == 0 {
+			queryPlannerLookups.WithLabelValues("short_circuit").Inc()
+			return nil, lookups, nil
+		}
+		queryPlannerLookups.WithLabelValues("selective_first").Inc()
+		chunkSets = append(chunkSets, incoming)
+		matchers = matchers[1:]
+		if timeRangeValues(bucket.schema) {
+			restFrom = earliestThrough(incoming, from)
+		}
+	} else if len(matchers) > 1 {
+		queryPlannerLookups.WithLabelValues("parallel").Inc()
+	}
+
+	incomingChunkSets := make(chan ByID)
+	incomingErrors := make(chan error)
+
+	for _, matcher := range matchers {
+		go func(matcher *metric.LabelMatcher) {
+			incoming, err := c.lookupChunksForMatcher(ctx, userID, bucket, metricName, matcher, restFrom)
+			if err != nil {
+				incomingErrors <- err
+			} else {
+				// Narrowed lookups understate the matcher's cardinality.
+				if restFrom == from {
+					c.recordSelectivity(userID, metricName, bucket.bucket, matcher.Name, len(incoming))
+				}
+				incomingChunkSets <- incoming
+			}
+		}(matcher)
+	}
+
 	var lastErr error
 	for i := 0; i < len(matchers); i++ {
 		select {
@@ -445,13 +1200,79 @@ func (c *AWSStore) lookupChunksFor(ctx context.Context, userID string, bucket bu
 			lastErr = err
 		}
 	}
-	return nWayIntersect(chunkSets), int32(len(matchers)), lastErr
+	return nWayIntersect(chunkSets), lookups + len(matchers), lastErr
 }
 
-func (c *AWSStore) lookupChunksForMetricName(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue) (ByID, int32, error) {
-	hashValue := hashValue(userID, bucket.bucket, metricName)
-	input := &dynamodb.QueryInput{
-		TableName: aws.String(bucket.tableName),
+func (c *AWSStore) lookupChunksForMetricName(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue) (ByID, int, error) {
+	chunkSet, err := c.queryShards(ctx, userID, bucket, metricName, nil, 0)
+	if err != nil {
+		return nil, 1, err
+	}
+	return unique(chunkSet), 1, nil
+}
+
+func (c *AWSStore) lookupChunksForMatcher(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matcher *metric.LabelMatcher, from model.Time) (ByID, error) {
+	return c.queryShards(ctx, userID, bucket, matcherLookupName(metricName, matcher), matcher, from)
+}
+
+// queryShards queries each shard of a metric's index entries in a bucket in
+// parallel, for the entries which might match matcher, or all of them if it
+// is nil, and merges the results.  Entries for chunks ending before from
+// may be skipped; see matcherQueryInput.
+func (c *AWSStore) queryShards(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matcher *metric.LabelMatcher, from model.Time) (ByID, error) {
+	hashValues := c.filterHashValues(ctx, userID, bucket, bucket.hashValues(userID, metricName))
+	if len(hashValues) == 0 {
+		return nil, nil
+	}
+	inputs := make([]*dynamodb.QueryInput, 0, len(hashValues))
+	for _, hashValue := range hashValues {
+		input := metricNameQueryInput(bucket.tableName, hashValue)
+		if matcher != nil {
+			var err error
+			if input, err = matcherQueryInput(bucket.tableName, hashValue, bucket.schema, matcher, from); err != nil {
+				return nil, err
+			}
+		}
+		inputs = append(inputs, input)
+	}
+	if len(inputs) == 1 {
+		return c.queryBucketChunkSet(ctx, bucket, inputs[0], matcher)
+	}
+
+	type result struct {
+		chunkSet ByID
+		err      error
+	}
+	results := make(chan result, len(inputs))
+	for _, input := range inputs {
+		go func(input *dynamodb.QueryInput) {
+			chunkSet, err := c.queryBucketChunkSet(ctx, bucket, input, matcher)
+			results <- result{chunkSet, err}
+		}(input)
+	}
+	var (
+		chunkSet ByID
+		lastErr  error
+	)
+	for range inputs {
+		result := <-results
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		chunkSet = merge(chunkSet, result.chunkSet)
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return chunkSet, nil
+}
+
+// metricNameQueryInput makes a query for all the index entries under a hash
+// value.
+func metricNameQueryInput(tableName, hashValue string) *dynamodb.QueryInput {
+	return &dynamodb.QueryInput{
+		TableName: aws.String(tableName),
 		KeyConditions: map[string]*dynamodb.Condition{
 			hashKey: {
 				AttributeValueList: []*dynamodb.AttributeValue{
@@ -462,65 +1283,147 @@ func (c *AWSStore) lookupChunksForMetricName(ctx context.Context, userID string,
 		},
 		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
+}
 
-	chunkSet := ByID{}
-	var processingError error
-	var pages, totalDropped int
-	defer func() {
-		queryRequestPages.Observe(float64(pages))
-		queryDroppedMatches.Observe(float64(totalDropped))
-	}()
+// matcherQueryInput makes a query for the index entries under a hash value
+// written with schema which might match matcher: those for its label value
+// if it is an equality matcher, or else those for its label.  If the
+// schema's range values allow it, entries for chunks ending before from are
+// skipped; a zero from skips none.
+func matcherQueryInput(tableName, hashValue, schema string, matcher *metric.LabelMatcher, from model.Time) (*dynamodb.QueryInput, error) {
+	input := metricNameQueryInput(tableName, hashValue)
+	if lower, upper, ok := rangeBounds(schema, matcher, from); ok {
+		input.KeyConditions[rangeKey] = &dynamodb.Condition{
+			AttributeValueList: []*dynamodb.AttributeValue{
+				{B: lower},
+				{B: upper},
+			},
+			ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBetween),
+		}
+		return input, nil
+	}
 
-	if err := c.dynamo.queryPages(ctx, input, func(resp interface{}, lastPage bool) (shouldContinue bool) {
-		var dropped int
-		dropped, processingError = processResponse(resp.(*dynamodb.QueryOutput), &chunkSet, nil)
-		totalDropped += dropped
-		pages++
-		return processingError != nil && !lastPage
-	}); err != nil {
-		log.Errorf("Error querying DynamoDB: %v", err)
-		return nil, 1, err
-	} else if processingError != nil {
-		log.Errorf("Error processing DynamoDB response: %v", processingError)
-		return nil, 1, processingError
+	rangePrefix, err := rangePrefix(schema, matcher)
+	if err != nil {
+		return nil, err
 	}
-	sort.Sort(ByID(chunkSet))
-	chunkSet = unique(chunkSet)
-	return chunkSet, 1, nil
+	input.KeyConditions[rangeKey] = &dynamodb.Condition{
+		AttributeValueList: []*dynamodb.AttributeValue{
+			{B: rangePrefix},
+		},
+		ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBeginsWith),
+	}
+	return input, nil
 }
 
-func (c *AWSStore) lookupChunksForMatcher(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, matcher *metric.LabelMatcher) (ByID, error) {
-	hashValue := hashValue(userID, bucket.bucket, metricName)
+// queryBucketChunkSet runs a query for a bucket against its table and, if
+// it is near a table boundary, the table on the other side, merging the
+// results.  The other table not existing isn't an error.  Results are
+// served from the index cache, if there is one.
+func (c *AWSStore) queryBucketChunkSet(ctx context.Context, bucket bucketSpec, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) (ByID, error) {
+	if c.indexCache == nil {
+		return c.queryBucketChunkSetUncached(ctx, bucket, input, matcher)
+	}
+	return c.indexCache.get(ctx, indexCacheKey(bucket, input, matcher), func(ctx context.Context) (ByID, error) {
+		return c.queryBucketChunkSetUncached(ctx, bucket, input, matcher)
+	})
+}
+
+// indexCacheKey identifies a query by its tables, hash value, range prefix
+// and matcher.
+func indexCacheKey(bucket bucketSpec, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) string {
 	var rangePrefix []byte
-	var err error
-	if matcher.Type == metric.Equal {
-		rangePrefix, err = lex.Encode(string(matcher.Name), string(matcher.Value))
-	} else {
-		rangePrefix, err = lex.Encode(string(matcher.Name))
+	if cond, ok := input.KeyConditions[rangeKey]; ok {
+		rangePrefix = cond.AttributeValueList[0].B
+	}
+	var matcherString string
+	if matcher != nil {
+		matcherString = matcher.String()
 	}
+	return strings.Join([]string{
+		aws.StringValue(input.TableName),
+		bucket.overlapTableName,
+		aws.StringValue(input.KeyConditions[hashKey].AttributeValueList[0].S),
+		string(rangePrefix),
+		matcherString,
+	}, "\x00")
+}
+
+func (c *AWSStore) queryBucketChunkSetUncached(ctx context.Context, bucket bucketSpec, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) (ByID, error) {
+	if bucket.overlapTableName == "" {
+		return c.queryChunkSet(ctx, input, matcher)
+	}
+
+	type result struct {
+		chunkSet ByID
+		err      error
+	}
+	overlapResult := make(chan result)
+	go func() {
+		overlapInput := *input
+		overlapInput.TableName = aws.String(bucket.overlapTableName)
+		chunkSet, err := c.queryChunkSet(ctx, &overlapInput, matcher)
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == resourceNotFoundException {
+			chunkSet, err = nil, nil
+		}
+		overlapResult <- result{chunkSet, err}
+	}()
+
+	chunkSet, err := c.queryChunkSet(ctx, input, matcher)
+	overlap := <-overlapResult
 	if err != nil {
 		return nil, err
 	}
+	if overlap.err != nil {
+		return nil, overlap.err
+	}
+	return merge(chunkSet, overlap.chunkSet), nil
+}
 
-	input := &dynamodb.QueryInput{
-		TableName: aws.String(bucket.tableName),
-		KeyConditions: map[string]*dynamodb.Condition{
-			hashKey: {
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{S: aws.String(hashValue)},
-				},
-				ComparisonOperator: aws.String("EQ"),
-			},
-			rangeKey: {
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{B: rangePrefix},
-				},
-				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBeginsWith),
-			},
-		},
-		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+// queryChunkSet runs a query against the read replicas in order of
+// preference, falling back to the next replica on error (and optionally on an
+// empty result).  The returned chunks are sorted by ID.
+func (c *AWSStore) queryChunkSet(ctx context.Context, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) (ByID, error) {
+	var (
+		chunkSet ByID
+		err      error
+	)
+	for i, dynamo := range c.dynamoReads {
+		chunkSet, err = c.hedgedQueryChunkSetFrom(ctx, dynamo, input, matcher)
+		if i == len(c.dynamoReads)-1 {
+			break
+		}
+		if err != nil {
+			queryReadFallbacks.WithLabelValues("error").Inc()
+			continue
+		}
+		if len(chunkSet) == 0 && c.cfg.ReadFallbackOnMiss {
+			queryReadFallbacks.WithLabelValues("miss").Inc()
+			continue
+		}
+		break
+	}
+	return chunkSet, err
+}
+
+// hedgedQueryChunkSetFrom runs queryChunkSetFrom, hedging the query if
+// configured.
+func (c *AWSStore) hedgedQueryChunkSetFrom(ctx context.Context, dynamo *dynamoDBBackoffClient, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) (ByID, error) {
+	chunkSet, err := c.queryHedger.do(func(hedged bool) (interface{}, error) {
+		if hedged {
+			toggled := *input
+			toggled.ConsistentRead = aws.Bool(!aws.BoolValue(input.ConsistentRead))
+			return c.queryChunkSetFrom(ctx, dynamo, &toggled, matcher)
+		}
+		return c.queryChunkSetFrom(ctx, dynamo, input, matcher)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return chunkSet.(ByID), nil
+}
 
+func (c *AWSStore) queryChunkSetFrom(ctx context.Context, dynamo *dynamoDBBackoffClient, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) (ByID, error) {
 	chunkSet := ByID{}
 	var processingError error
 	var pages, totalDropped int
@@ -528,17 +1431,17 @@ func (c *AWSStore) lookupChunksForMatcher(ctx context.Context, userID string, bu
 		queryRequestPages.Observe(float64(pages))
 		queryDroppedMatches.Observe(float64(totalDropped))
 	}()
-	if err := c.dynamo.queryPages(ctx, input, func(resp interface{}, lastPage bool) (shouldContinue bool) {
+	if err := dynamo.queryPages(ctx, input, func(resp interface{}, lastPage bool) (shouldContinue bool) {
 		var dropped int
 		dropped, processingError = processResponse(resp.(*dynamodb.QueryOutput), &chunkSet, matcher)
 		totalDropped += dropped
 		pages++
 		return processingError != nil && !lastPage
 	}); err != nil {
-		log.Errorf("Error querying DynamoDB: %v", err)
+		log.Errorf("Error querying DynamoDB: %v request_id=%s", err, util.GetRequestID(ctx))
 		return nil, err
 	} else if processingError != nil {
-		log.Errorf("Error processing DynamoDB response: %v", processingError)
+		log.Errorf("Error processing DynamoDB response: %v request_id=%s", processingError, util.GetRequestID(ctx))
 		return nil, processingError
 	}
 
@@ -562,11 +1465,16 @@ func processResponse(resp *dynamodb.QueryOutput, chunkSet *ByID, matcher *metric
 			ID: chunkID,
 		}
 
-		if chunkValue, ok := item[chunkKey]; ok && chunkValue.B != nil {
-			if err := json.Unmarshal(chunkValue.B, &chunk); err != nil {
+		// The chunk attribute holds either a legacy chunk's JSON metadata, or
+		// a whole chunk stored inline, which never starts with a brace.
+		if chunkValue, ok := item[chunkKey]; ok && len(chunkValue.B) > 0 {
+			if chunkValue.B[0] != '{' {
+				chunk.inline = chunkValue.B
+			} else if err := json.Unmarshal(chunkValue.B, &chunk); err != nil {
 				return dropped, err
+			} else {
+				chunk.metadataInIndex = true
 			}
-			chunk.metadataInIndex = true
 		}
 
 		if matcher != nil && (label != matcher.Name || !matcher.Match(value)) {
@@ -579,31 +1487,100 @@ func processResponse(resp *dynamodb.QueryOutput, chunkSet *ByID, matcher *metric
 	return dropped, nil
 }
 
-func (c *AWSStore) fetchChunkData(ctx context.Context, userID string, chunkSet []Chunk) ([]Chunk, error) {
-	incomingChunks := make(chan Chunk)
-	incomingErrors := make(chan error)
-	for _, chunk := range chunkSet {
-		go func(chunk Chunk) {
-			var resp *s3.GetObjectOutput
-			err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
-				var err error
-				resp, err = c.cfg.S3.GetObject(&s3.GetObjectInput{
-					Bucket: aws.String(c.cfg.BucketName),
-					Key:    aws.String(chunkName(userID, chunk.ID)),
-				})
-				return err
-			})
+// fetchedObject is an object fetched from S3, with its ETag if the object
+// client returned one.
+type fetchedObject struct {
+	buf  []byte
+	etag *string
+}
+
+// fetchObject fetches an object from S3, hedging the request if configured.
+// It returns the object's ETag too, or nil if the object client doesn't
+// return them.
+func (c *AWSStore) fetchObject(ctx context.Context, input *s3.GetObjectInput) ([]byte, *string, error) {
+	obj, err := c.fetchHedger.do(func(bool) (interface{}, error) {
+		var obj fetchedObject
+		err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+			resp, err := c.cfg.S3.GetObject(input)
 			if err != nil {
-				incomingErrors <- err
-				return
+				return err
 			}
 			defer resp.Body.Close()
-			if err := chunk.decode(resp.Body); err != nil {
-				incomingErrors <- err
-				return
+			obj.etag = resp.ETag
+			obj.buf, err = ioutil.ReadAll(resp.Body)
+			return err
+		})
+		return obj, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return obj.(fetchedObject).buf, obj.(fetchedObject).etag, nil
+}
+
+// CorruptChunkError is returned when a chunk fetched from S3 can't be
+// decoded, eg because it doesn't match its checksum.
+type CorruptChunkError struct {
+	ChunkID string
+	Err     error
+}
+
+func (e *CorruptChunkError) Error() string {
+	return fmt.Sprintf("corrupt chunk %s: %v", e.ChunkID, e.Err)
+}
+
+// corruptChunkError wraps an error decoding chunk, if any, in a
+// CorruptChunkError.
+func corruptChunkError(chunk *Chunk, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CorruptChunkError{ChunkID: chunk.ID, Err: err}
+}
+
+// fetchError counts corrupt chunks, returning nil for those that should be
+// left out of query results, and other errors unchanged.
+func (c *AWSStore) fetchError(err error) error {
+	corrupt, ok := err.(*CorruptChunkError)
+	if !ok {
+		return err
+	}
+	corruptChunks.Inc()
+	if c.cfg.SkipCorruptChunks {
+		log.Errorf("Skipping %v", corrupt)
+		return nil
+	}
+	return err
+}
+
+func (c *AWSStore) fetchChunkData(ctx context.Context, userID string, from, through model.Time, chunkSet []Chunk) ([]Chunk, error) {
+	// Chunks are queued for a bounded number of workers, rather than each
+	// getting a goroutine, so queries matching many chunks don't start tens
+	// of thousands of goroutines.
+	workers := len(chunkSet)
+	if c.cfg.FetchWorkers > 0 && c.cfg.FetchWorkers < workers {
+		workers = c.cfg.FetchWorkers
+	}
+	queue := make(chan Chunk, len(chunkSet))
+	for _, chunk := range chunkSet {
+		queue <- chunk
+	}
+	close(queue)
+	fetchQueueLength.Add(float64(len(chunkSet)))
+
+	incomingChunks := make(chan Chunk)
+	incomingErrors := make(chan error)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for chunk := range queue {
+				fetchQueueLength.Dec()
+				if err := c.fetchChunk(ctx, userID, from, through, &chunk); err != nil {
+					incomingErrors <- c.fetchError(err)
+					continue
+				}
+				incomingChunks <- chunk
 			}
-			incomingChunks <- chunk
-		}(chunk)
+		}()
 	}
 
 	chunks := []Chunk{}
@@ -613,7 +1590,10 @@ func (c *AWSStore) fetchChunkData(ctx context.Context, userID string, chunkSet [
 		case chunk := <-incomingChunks:
 			chunks = append(chunks, chunk)
 		case err := <-incomingErrors:
-			errors = append(errors, err)
+			// Skipped chunks are reported as nil errors.
+			if err != nil {
+				errors = append(errors, err)
+			}
 		}
 	}
 	if len(errors) > 0 {
@@ -621,3 +1601,25 @@ func (c *AWSStore) fetchChunkData(ctx context.Context, userID string, chunkSet [
 	}
 	return chunks, nil
 }
+
+// fetchChunk fetches and decodes a chunk, or the part of it between from and
+// through.
+func (c *AWSStore) fetchChunk(ctx context.Context, userID string, from, through model.Time, chunk *Chunk) error {
+	c.fetchLimiter.Acquire()
+	defer c.fetchLimiter.Release()
+
+	if c.wantRangeRead(chunk, from, through) {
+		return c.fetchChunkRange(ctx, userID, chunk, from, through)
+	}
+
+	start := time.Now()
+	buf, _, err := c.fetchChunkObject(ctx, userID, chunk.ID, nil, nil)
+	c.fetchLimiter.observe(time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	if err := chunk.decode(bytes.NewReader(buf)); err != nil {
+		return corruptChunkError(chunk, err)
+	}
+	return corruptChunkError(chunk, chunk.verifyID())
+}
@@ -1,17 +1,23 @@
 package chunk
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/pmezard/go-difflib/difflib"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/cortex/user"
@@ -21,7 +27,7 @@ func init() {
 	spew.Config.SortKeys = true // :\
 }
 
-func setupDynamodb(t *testing.T, dynamoDB DynamoDBClient) {
+func setupDynamodb(t *testing.T, dynamoDB IndexClient) {
 	tableManager, err := NewDynamoTableManager(TableManagerConfig{
 		DynamoDB: dynamoDB,
 	})
@@ -48,8 +54,8 @@ func TestChunkStoreUnprocessed(t *testing.T) {
 		model.Fingerprint(1),
 		model.Metric{
 			model.MetricNameLabel: "foo",
-			"bar":  "baz",
-			"toms": "code",
+			"bar":                 "baz",
+			"toms":                "code",
 		},
 		chunks[0],
 		now.Add(-time.Hour),
@@ -78,14 +84,16 @@ func TestChunkStore(t *testing.T) {
 
 	ctx := user.WithID(context.Background(), "0")
 	now := model.Now()
+	// Chunks are encoded in parallel, so each needs its own data.
 	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	chunks2, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
 
 	chunk1 := NewChunk(
 		model.Fingerprint(1),
 		model.Metric{
 			model.MetricNameLabel: "foo",
-			"bar":  "baz",
-			"toms": "code",
+			"bar":                 "baz",
+			"toms":                "code",
 		},
 		chunks[0],
 		now.Add(-time.Hour),
@@ -95,10 +103,10 @@ func TestChunkStore(t *testing.T) {
 		model.Fingerprint(2),
 		model.Metric{
 			model.MetricNameLabel: "foo",
-			"bar":  "beep",
-			"toms": "code",
+			"bar":                 "beep",
+			"toms":                "code",
 		},
-		chunks[0],
+		chunks2[0],
 		now.Add(-time.Hour),
 		now,
 	)
@@ -132,6 +140,366 @@ func TestChunkStore(t *testing.T) {
 	test("Multiple matchers II", []Chunk{chunk1}, nameMatcher, mustNewLabelMatcher(metric.Equal, "toms", "code"), mustNewLabelMatcher(metric.Equal, "bar", "baz"))
 }
 
+func TestChunkStoreRangeRead(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:           dynamoDB,
+		S3:                 NewMockS3(),
+		ChunkFormatVersion: ChunkFormatV2,
+		RangeReadFraction:  0.5,
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 500)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	allSamples, _ := chunk.samples()
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+
+	for _, tc := range []struct {
+		from, through model.Time
+		partial       bool
+	}{
+		{chunk.From, chunk.Through, false},
+		{chunk.From.Add(100 * time.Second), chunk.From.Add(150 * time.Second), true},
+		{chunk.Through.Add(-10 * time.Second), chunk.Through, true},
+	} {
+		chunks, err := store.Get(ctx, tc.from, tc.through, nameMatcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != 1 {
+			t.Fatalf("expected 1 chunk, got %d", len(chunks))
+		}
+		if chunks[0].partial != tc.partial {
+			t.Fatalf("%v-%v: expected partial=%v", tc.from, tc.through, tc.partial)
+		}
+
+		samples, _ := chunks[0].samples()
+		var want, have []model.SamplePair
+		for _, s := range allSamples {
+			if s.Timestamp >= tc.from && s.Timestamp <= tc.through {
+				want = append(want, s)
+			}
+		}
+		for _, s := range samples {
+			if s.Timestamp >= tc.from && s.Timestamp <= tc.through {
+				have = append(have, s)
+			}
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Fatalf("%v-%v: wrong samples - %s", tc.from, tc.through, diff(want, have))
+		}
+		if tc.partial && len(samples) >= len(allSamples) {
+			t.Fatalf("%v-%v: fetched all %d samples", tc.from, tc.through, len(samples))
+		}
+	}
+}
+
+// rewritingClient is an ObjectClient which replaces an object with rewrite
+// after its first range GET, as if it was re-encoded between the GETs of a
+// range read.
+type rewritingClient struct {
+	ObjectClient
+	rewrite []byte
+}
+
+func (c *rewritingClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	output, err := c.ObjectClient.GetObject(input)
+	if err == nil && input.Range != nil && c.rewrite != nil {
+		_, err = c.ObjectClient.PutObject(&s3.PutObjectInput{
+			Bucket: input.Bucket,
+			Key:    input.Key,
+			Body:   bytes.NewReader(c.rewrite),
+		})
+		c.rewrite = nil
+	}
+	return output, err
+}
+
+func TestChunkStoreRangeReadRewritten(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	client := &rewritingClient{ObjectClient: NewMockS3()}
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:           dynamoDB,
+		S3:                 client,
+		ChunkFormatVersion: ChunkFormatV2,
+		RangeReadFraction:  0.5,
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	c := newTestChunk(t, model.Now(), 500)
+	if err := store.Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+	allSamples, _ := c.samples()
+
+	// The chunk is rewritten in the version 1 format after its header is
+	// fetched, so the blocks in that header are no longer where it says.
+	r, err := c.encode(ChunkFormatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.rewrite, err = ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Get(ctx, c.Through.Add(-10*time.Second), c.Through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.rewrite != nil {
+		t.Fatal("expected the chunk to be range read")
+	}
+	if len(chunks) != 1 || chunks[0].partial {
+		t.Fatalf("expected 1 whole chunk, got %v", chunks)
+	}
+	samples, _ := chunks[0].samples()
+	if !reflect.DeepEqual(allSamples, samples) {
+		t.Fatalf("wrong samples - %s", diff(allSamples, samples))
+	}
+}
+
+func TestChunkStoreReadFallback(t *testing.T) {
+	primary, replica := NewMockDynamoDB(0, 0), NewMockDynamoDB(0, 0)
+	setupDynamodb(t, primary)
+	setupDynamodb(t, replica)
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	chunk := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{
+			model.MetricNameLabel: "foo",
+			"bar":                 "baz",
+		},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+	want := []Chunk{chunk}
+
+	s3 := NewMockS3()
+	writer := NewAWSStore(StoreConfig{
+		DynamoDB: primary,
+		S3:       s3,
+	})
+	if err := writer.Put(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		fallbackOnMiss bool
+		want           []Chunk
+	}{
+		{"no fallback on miss", false, nil},
+		{"fallback on miss", true, want},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The replica is empty, as if replication hadn't caught up yet.
+			reader := NewAWSStore(StoreConfig{
+				DynamoDB:           primary,
+				S3:                 s3,
+				ReadDynamoDB:       []IndexClient{replica, primary},
+				ReadFallbackOnMiss: tc.fallbackOnMiss,
+			})
+			have, err := reader.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Fatalf("wrong chunks - %s", diff(tc.want, have))
+			}
+		})
+	}
+}
+
+func TestChunkStoreSeriesLimit(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:          dynamoDB,
+		S3:                NewMockS3(),
+		MaxSeriesPerQuery: 2,
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	var want []Chunk
+	for i, m := range []model.Metric{
+		{model.MetricNameLabel: "foo", "job": "x", "instance": "a"},
+		{model.MetricNameLabel: "foo", "job": "x", "instance": "b"},
+		{model.MetricNameLabel: "foo", "job": "y", "instance": "c"},
+	} {
+		chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+		want = append(want, NewChunk(model.Fingerprint(i), m, chunks[0], now.Add(-time.Hour), now))
+	}
+	if err := store.Put(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+
+	// Constraining the query to 2 series is allowed.
+	have, err := store.Get(ctx, now.Add(-time.Hour), now,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.Equal, "job", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(have))
+	}
+
+	_, err = store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	tooMany, ok := err.(*TooManySeriesError)
+	if !ok {
+		t.Fatalf("expected TooManySeriesError, got %v", err)
+	}
+	wantErr := &TooManySeriesError{
+		MetricName: "foo",
+		Series:     3,
+		Limit:      2,
+		Top: []LabelValueCount{
+			{"job", "x", 2},
+			{"instance", "a", 1},
+			{"instance", "b", 1},
+			{"instance", "c", 1},
+			{"job", "y", 1},
+		},
+	}
+	if !reflect.DeepEqual(wantErr, tooMany) {
+		t.Fatalf("wrong error - %s", diff(wantErr, tooMany))
+	}
+}
+
+func TestChunkStoreSeriesCount(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	s3 := NewMockS3()
+	cfg := StoreConfig{
+		DynamoDB:                dynamoDB,
+		S3:                      s3,
+		SeriesSketchMinAge:      30 * time.Minute,
+		SeriesSketchCacheSize:   10,
+		SeriesSketchWriteOnRead: true,
+		SeriesSketchWorkers:     2,
+	}
+	store := NewAWSStore(cfg)
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	from, through := now.Add(-72*time.Hour), now.Add(-71*time.Hour)
+	newChunk := func(fp model.Fingerprint, instance model.LabelValue) Chunk {
+		chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: from, Value: 0})
+		return NewChunk(fp, model.Metric{model.MetricNameLabel: "foo", "instance": instance}, chunks[0], from, through)
+	}
+	put := func(fp model.Fingerprint, instance model.LabelValue) {
+		if err := store.Put(ctx, []Chunk{newChunk(fp, instance)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seriesCount := func(want uint64) {
+		count, err := store.SeriesCount(ctx, from, through, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Fatalf("expected %d series, got %d", want, count)
+		}
+	}
+	sketchObjects := func() int {
+		s3.mtx.Lock()
+		defer s3.mtx.Unlock()
+		n := 0
+		for _, bucket := range s3.buckets {
+			for key := range bucket.objects {
+				if strings.Contains(key, "/sketches/") {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	put(1, "a")
+	put(2, "b")
+	put(3, "c")
+	seriesCount(3)
+	if sketchObjects() == 0 {
+		t.Fatal("expected sketches to be persisted")
+	}
+
+	// Writing to the buckets deletes their persisted sketches, so the next
+	// count sees the new series.
+	put(4, "d")
+	if n := sketchObjects(); n != 0 {
+		t.Fatalf("expected sketches to be deleted, got %d", n)
+	}
+	seriesCount(4)
+
+	// As does deleting from them.
+	if err := store.deleteIndexEntries(ctx, "0", []Chunk{newChunk(4, "d")}); err != nil {
+		t.Fatal(err)
+	}
+	seriesCount(3)
+
+	// The persisted sketches are cached, so the pre-flight check doesn't
+	// read them from S3 again.
+	s3.mtx.Lock()
+	s3.buckets = map[string]*mockS3Bucket{}
+	s3.mtx.Unlock()
+	if count := store.persistedSeriesCount(ctx, "0", from, through, "foo"); count != 3 {
+		t.Fatalf("expected 3 series from cached sketches, got %d", count)
+	}
+
+	// Without write on read, counts don't persist sketches.
+	cfg.SeriesSketchWriteOnRead = false
+	store = NewAWSStore(cfg)
+	seriesCount(3)
+	if n := sketchObjects(); n != 0 {
+		t.Fatalf("expected no sketches to be persisted, got %d", n)
+	}
+}
+
+func TestIndexEntryTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	store := NewAWSStore(StoreConfig{
+		TableName:     "table",
+		IndexEntryTTL: time.Hour,
+	})
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: 0, Value: 0})
+	c := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{
+			model.MetricNameLabel: "foo",
+			"bar":                 "baz",
+		},
+		chunks[0],
+		0,
+		0,
+	)
+	writeReqs, err := store.calculateDynamoWrites("0", []Chunk{c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writeReqs["table"]) == 0 {
+		t.Fatal("no index entries written")
+	}
+	for _, req := range writeReqs["table"] {
+		expiry, ok := req.PutRequest.Item[ttlKey]
+		if !ok || *expiry.N != "4600" {
+			t.Fatalf("wrong expiry: %v", expiry)
+		}
+	}
+}
+
 func mustNewLabelMatcher(matchType metric.MatchType, name model.LabelName, value model.LabelValue) *metric.LabelMatcher {
 	matcher, err := metric.NewLabelMatcher(matchType, name, value)
 	if err != nil {
@@ -163,6 +531,7 @@ func TestBigBuckets(t *testing.T) {
 			result = append(result, bucketSpec{
 				tableName: tableName,
 				bucket:    b,
+				schema:    IndexSchemaV1,
 			})
 		}
 		return result
@@ -272,3 +641,138 @@ func TestBigBuckets(t *testing.T) {
 		})
 	}
 }
+
+func TestChunkStoreCorruptChunks(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	c := newTestChunk(t, now, 10)
+
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	cfg := StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	}
+	if err := NewAWSStore(cfg).Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range objects.objects["chunks"] {
+		buf[len(buf)-5] ^= 1
+	}
+
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	_, err := NewAWSStore(cfg).Get(ctx, now.Add(-time.Hour), now, matcher)
+	if _, ok := err.(*CorruptChunkError); !ok {
+		t.Fatalf("expected CorruptChunkError, got %v", err)
+	}
+
+	cfg.SkipCorruptChunks = true
+	chunks, err := NewAWSStore(cfg).Get(ctx, now.Add(-time.Hour), now, matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("expected corrupt chunk to be skipped, got %v", chunks)
+	}
+}
+
+// concurrencyTrackingClient is an ObjectClient recording the most GetObject
+// calls in flight at once.
+type concurrencyTrackingClient struct {
+	ObjectClient
+	mtx           sync.Mutex
+	inflight, max int
+}
+
+func (c *concurrencyTrackingClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	c.mtx.Lock()
+	c.inflight++
+	if c.inflight > c.max {
+		c.max = c.inflight
+	}
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		c.inflight--
+		c.mtx.Unlock()
+	}()
+	time.Sleep(time.Millisecond)
+	return c.ObjectClient.GetObject(input)
+}
+
+func TestChunkStoreFetchWorkers(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	client := &concurrencyTrackingClient{ObjectClient: NewMemoryObjectClient()}
+	store := NewAWSStore(StoreConfig{
+		S3:           client,
+		BucketName:   "chunks",
+		DynamoDB:     NewMemoryIndexClient(),
+		TableName:    "index",
+		FetchWorkers: 2,
+	})
+	chunks := []Chunk{}
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, newTestChunk(t, now.Add(-time.Duration(i)*time.Minute), 10))
+	}
+	if err := store.Put(ctx, chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != len(chunks) {
+		t.Fatalf("expected %d chunks, got %d", len(chunks), len(fetched))
+	}
+	if client.max > 2 {
+		t.Fatalf("expected at most 2 fetches in flight, got %d", client.max)
+	}
+}
+
+func TestChunkStoreInlineChunks(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	c := newTestChunk(t, now, 10)
+
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	cfg := StoreConfig{
+		S3:                 objects,
+		BucketName:         "chunks",
+		DynamoDB:           NewMemoryIndexClient(),
+		TableName:          "index",
+		InlineChunkMaxSize: 1,
+	}
+	if err := NewAWSStore(cfg).Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects.objects["chunks"]) != 1 {
+		t.Fatalf("expected chunk over the size limit in S3, got %v", objects.objects)
+	}
+
+	cfg.DynamoDB = NewMemoryIndexClient()
+	cfg.InlineChunkMaxSize = 64 * 1024
+	objects.objects = map[string]map[string][]byte{}
+	store := NewAWSStore(cfg)
+	if err := store.Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects.objects["chunks"]) != 0 {
+		t.Fatalf("expected inline chunk not to be written to S3, got %v", objects.objects)
+	}
+
+	for _, matchers := range [][]*metric.LabelMatcher{
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")},
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz")},
+	} {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]Chunk{c}, chunks) {
+			t.Fatalf("wrong chunks - %s", diff([]Chunk{c}, chunks))
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package chunk
 
 import (
-	//"bytes"
-	//"io/ioutil"
+	"bytes"
+	"io/ioutil"
 	"reflect"
 	"testing"
 	"time"
@@ -20,8 +20,8 @@ func TestChunkCodec(t *testing.T) {
 		Through: now,
 		Metric: model.Metric{
 			model.MetricNameLabel: "foo",
-			"bar":  "baz",
-			"toms": "code",
+			"bar":                 "baz",
+			"toms":                "code",
 		},
 		Encoding: chunk.DoubleDelta,
 		Data:     cs[0],
@@ -41,3 +41,144 @@ func TestChunkCodec(t *testing.T) {
 		t.Fatalf("wrong chunks - " + diff(want, have))
 	}
 }
+
+func TestChunkCodecV2(t *testing.T) {
+	now := model.Now()
+	want := newTestChunk(t, now, 200)
+
+	r, err := want.encode(ChunkFormatV2)
+	if err != nil {
+		t.Fatalf("encode() error: %v", err)
+	}
+
+	have := Chunk{}
+	if err := have.decode(r); err != nil {
+		t.Fatalf("decode() error: %v", err)
+	}
+
+	wantSamples, _ := want.samples()
+	haveSamples, _ := have.samples()
+	if !reflect.DeepEqual(wantSamples, haveSamples) {
+		t.Fatalf("wrong samples - %s", diff(wantSamples, haveSamples))
+	}
+	want.Data, have.Data = nil, nil
+	have.ID = want.ID
+	if !reflect.DeepEqual(want, have) {
+		t.Fatalf("wrong chunks - %s", diff(want, have))
+	}
+}
+
+// newTestChunk returns a chunk of n samples, one a second, ending at through.
+func newTestChunk(t *testing.T, through model.Time, n int) Chunk {
+	from := through.Add(-time.Duration(n-1) * time.Second)
+	pc := chunk.New()
+	for i := 0; i < n; i++ {
+		pcs, err := pc.Add(model.SamplePair{Timestamp: from.Add(time.Duration(i) * time.Second), Value: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pcs) > 1 {
+			t.Fatalf("%d samples overflow a chunk", n)
+		}
+		pc = pcs[0]
+	}
+	return NewChunk(
+		model.Fingerprint(1),
+		model.Metric{
+			model.MetricNameLabel: "foo",
+			"bar":                 "baz",
+		},
+		pc,
+		from,
+		through,
+	)
+}
+
+func TestChunkCodecV2Checksum(t *testing.T) {
+	c := newTestChunk(t, model.Now(), 200)
+	buf, err := c.encodeV2()
+	if err != nil {
+		t.Fatalf("encodeV2() error: %v", err)
+	}
+
+	// Flip a bit in the last sample's value.
+	buf[len(buf)-1] ^= 1
+	have := Chunk{}
+	if err := have.decode(bytes.NewReader(buf)); err != ErrInvalidChecksum {
+		t.Fatalf("expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func TestChunkCodecV1Checksum(t *testing.T) {
+	c := newTestChunk(t, model.Now(), 200)
+	r, err := c.reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks written before the CRC was added can still be read.
+	have := Chunk{}
+	if err := have.decode(bytes.NewReader(buf[:len(buf)-4])); err != nil {
+		t.Fatalf("decode() without CRC error: %v", err)
+	}
+
+	// Flip a bit in the last byte of the data, before the CRC.
+	buf[len(buf)-5] ^= 1
+	have = Chunk{}
+	if err := have.decode(bytes.NewReader(buf)); err != ErrInvalidChecksum {
+		t.Fatalf("expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func TestChunkCodecV2DeltaOverflow(t *testing.T) {
+	// Fill a delta chunk with samples which don't fit in a single
+	// double-delta chunk.
+	now := model.Now()
+	pc, err := chunk.NewForEncoding(chunk.Delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []model.SamplePair
+	for i := 0; ; i++ {
+		s := model.SamplePair{
+			Timestamp: now.Add(time.Duration(i*i) * time.Millisecond),
+			Value:     model.SampleValue(i) + 0.5,
+		}
+		pcs, err := pc.Add(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pcs) > 1 {
+			break
+		}
+		pc = pcs[0]
+		samples = append(samples, s)
+	}
+	if _, err := buildChunk(chunk.DoubleDelta, samples); err != errChunkOverflow {
+		t.Fatalf("expected %d samples to overflow a double-delta chunk, got %v", len(samples), err)
+	}
+
+	want := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo"}, pc, samples[0].Timestamp, samples[len(samples)-1].Timestamp)
+	r, err := want.encode(ChunkFormatV2)
+	if err != nil {
+		t.Fatalf("encode() error: %v", err)
+	}
+	have := Chunk{}
+	if err := have.decode(r); err != nil {
+		t.Fatalf("decode() error: %v", err)
+	}
+	if have.Encoding != chunk.Delta {
+		t.Fatalf("expected a delta chunk, got %v", have.Encoding)
+	}
+	haveSamples, err := have.samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(samples, haveSamples) {
+		t.Fatalf("wrong samples - %s", diff(samples, haveSamples))
+	}
+}
@@ -0,0 +1,116 @@
+package chunk
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+)
+
+var (
+	coldQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_cold_queries_total",
+		Help:      "The number of queries only of cold data, which were served with the cold data clients and limits.",
+	})
+	coldQueriesWaiting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_cold_queries_waiting",
+		Help:      "The number of queries of cold data waiting for one of the others to finish.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(coldQueries)
+	prometheus.MustRegister(coldQueriesWaiting)
+}
+
+// ColdDataConfig configures a separate, lower priority read path for queries
+// only of old ("cold") data, such as backfills and long-range reports, so
+// they can't crowd out queries of recent data, such as dashboards, for S3
+// and DynamoDB capacity, connections or fetch parallelism.
+type ColdDataConfig struct {
+	// Queries which end at least this long ago are cold.  If zero, all
+	// queries take the same path.  To only catch queries of closed index
+	// buckets, this should be longer than the bucket size.
+	MinAge time.Duration
+
+	// Clients to read cold data with, eg with their own HTTP connection
+	// pools, or rate limits.  They must read the same bucket and tables as
+	// the store's main clients, which are used if they aren't set.
+	// NewStore makes S3 from StorageURL if it is set.
+	S3         ObjectClient
+	StorageURL string
+	DynamoDB   IndexClient
+
+	// Bounds on the number of cold chunks fetched from S3 in parallel, and
+	// the maximum number of goroutines fetching them for each query; see
+	// StoreConfig.FetchParallelism and FetchWorkers.
+	FetchParallelism AIMDConfig
+	FetchWorkers     int
+
+	// If non-zero, the maximum number of cold queries run at once; the rest
+	// wait for them.
+	MaxQueries int
+}
+
+// coldStore returns a copy of the store reading with the cold data clients
+// and limits.  It shares the store's caches.
+func (c *AWSStore) coldStore() *AWSStore {
+	cold := *c
+	cold.cfg.ColdData = ColdDataConfig{}
+	cold.cfg.FetchParallelism = c.cfg.ColdData.FetchParallelism
+	cold.cfg.FetchWorkers = c.cfg.ColdData.FetchWorkers
+	cold.fetchLimiter = newAIMDLimiter(c.cfg.ColdData.FetchParallelism, coldFetchParallelism)
+	if c.cfg.ColdData.S3 != nil {
+		cold.cfg.S3 = c.cfg.ColdData.S3
+	}
+	if c.cfg.ColdData.DynamoDB != nil {
+		cold.cfg.DynamoDB = c.cfg.ColdData.DynamoDB
+		cold.cfg.ReadDynamoDB = nil
+		cold.dynamo = newDynamoDBBackoffClient(c.cfg.ColdData.DynamoDB, c.cfg.PeriodicTableConfig)
+		cold.dynamoReads = []*dynamoDBBackoffClient{cold.dynamo}
+	}
+	return &cold
+}
+
+// isCold returns whether a query ending at through is only of cold data.
+func (c *AWSStore) isCold(through model.Time) bool {
+	if c.cold == nil {
+		return false
+	}
+	return through.Before(model.TimeFromUnixNano(mtime.Now().Add(-c.cfg.ColdData.MinAge).UnixNano()))
+}
+
+// getCold runs Get on the cold store, once fewer than MaxQueries other cold
+// queries are running.
+func (c *AWSStore) getCold(ctx context.Context, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, error) {
+	coldQueries.Inc()
+	var chunks []Chunk
+	err := c.withColdQuerySlot(ctx, func() error {
+		var err error
+		chunks, err = c.cold.Get(ctx, from, through, matchers...)
+		return err
+	})
+	return chunks, err
+}
+
+// withColdQuerySlot runs f once fewer than MaxQueries other cold queries are
+// running.
+func (c *AWSStore) withColdQuerySlot(ctx context.Context, f func() error) error {
+	if c.coldQuerySlots != nil {
+		coldQueriesWaiting.Inc()
+		select {
+		case c.coldQuerySlots <- struct{}{}:
+			coldQueriesWaiting.Dec()
+		case <-ctx.Done():
+			coldQueriesWaiting.Dec()
+			return ctx.Err()
+		}
+		defer func() { <-c.coldQuerySlots }()
+	}
+	return f()
+}
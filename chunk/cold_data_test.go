@@ -0,0 +1,74 @@
+package chunk
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// countingObjectClient counts the objects got through it.
+type countingObjectClient struct {
+	ObjectClient
+	gets int32
+}
+
+func (c *countingObjectClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.ObjectClient.GetObject(input)
+}
+
+func TestColdDataQueries(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	oldChunk := newTestChunk(t, now.Add(-48*time.Hour), 10)
+	newChunk := newTestChunk(t, now, 10)
+
+	objects := NewMemoryObjectClient()
+	coldObjects := &countingObjectClient{ObjectClient: objects}
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		ColdData: ColdDataConfig{
+			MinAge:     24 * time.Hour,
+			S3:         coldObjects,
+			MaxQueries: 1,
+		},
+	})
+	if err := store.Put(ctx, []Chunk{oldChunk, newChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	for _, tc := range []struct {
+		from, through model.Time
+		expected      []Chunk
+		coldGets      int32
+	}{
+		{now.Add(-72 * time.Hour), now.Add(-47 * time.Hour), []Chunk{oldChunk}, 1},
+		{now.Add(-time.Hour), now, []Chunk{newChunk}, 0},
+		// Queries reaching recent data aren't cold, however far back they go.
+		{now.Add(-72 * time.Hour), now, []Chunk{oldChunk, newChunk}, 0},
+	} {
+		atomic.StoreInt32(&coldObjects.gets, 0)
+		chunks, err := store.Get(ctx, tc.from, tc.through, matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.expected, chunks) {
+			t.Fatalf("wrong chunks - %s", diff(tc.expected, chunks))
+		}
+		if gets := atomic.LoadInt32(&coldObjects.gets); gets != tc.coldGets {
+			t.Errorf("%v-%v: expected %d cold fetches, got %d", tc.from, tc.through, tc.coldGets, gets)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package chunk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	compactionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_compaction_seconds",
+		Help:      "Time spent compacting all users' small chunks.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	}, []string{"operation", "status_code"})
+	compactedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_compacted_chunks_total",
+		Help:      "The number of chunks handled by compaction, by outcome: merged into larger chunks, written by merging, or skipped.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(compactionDuration)
+	prometheus.MustRegister(compactedChunks)
+}
+
+// CompactionConfig configures chunk compaction.
+type CompactionConfig struct {
+	// Only chunks whose objects are at most this many bytes are merged.
+	MaxChunkSize int
+
+	// Only chunks of a series starting in the same aligned period of this
+	// long are merged, so compacted chunks don't span too many index
+	// buckets.
+	Period time.Duration
+
+	// How long the Compactor leaves merged chunks' objects after removing
+	// them from the index before deleting them.  Queries may still fetch
+	// them until then, having looked them up in the index, or in an index
+	// cache, beforehand; it should exceed queriers' index cache Validity
+	// plus MaxStaleness, and the longest queries.
+	DeleteDelay time.Duration
+}
+
+// CompactStats reports the outcome of Compact.
+type CompactStats struct {
+	Merged  int // Small chunks merged into larger ones.
+	Written int // Chunks written by merging small ones.
+	Skipped int // Chunks which couldn't be fetched or decoded.
+
+	// IDs of the chunks merged, whose objects are still to be deleted.
+	Superseded []string
+}
+
+// Compact merges userID's small chunks which ended between from and
+// through, and belong to the same series and period, into as few chunks as
+// their samples fit in, and rewriting the index entries.  Overlapping
+// samples are deduplicated.  The originals' objects are left for the caller
+// to delete, with DeleteChunkObjects, once no query can still be fetching
+// them.  Like Delete, the new chunks are written before the old ones are
+// removed from the index, so a failed Compact loses nothing and can be
+// retried.  Chunks whose metadata is in the index are skipped.  Only chunks in index buckets which are closed, so no more
+// chunks are written to them, should be compacted.
+func (c *AWSStore) Compact(ctx context.Context, userID string, from, through model.Time, cfg CompactionConfig) (CompactStats, error) {
+	type group struct {
+		fp     model.Fingerprint
+		period int64
+	}
+	groups := map[group][]Chunk{}
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		for _, l := range listed {
+			if l.size > int64(cfg.MaxChunkSize) || l.through < from || l.through >= through {
+				continue
+			}
+			g := group{fp: l.fp}
+			if cfg.Period > 0 {
+				g.period = int64(l.from) / int64(cfg.Period/time.Millisecond)
+			}
+			groups[g] = append(groups[g], Chunk{ID: l.id})
+		}
+		return nil
+	})
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	var stats CompactStats
+	for _, chunks := range groups {
+		if len(chunks) < 2 {
+			continue
+		}
+		if err := c.compactChunks(ctx, userID, chunks, &stats); err != nil {
+			return stats, err
+		}
+	}
+	log.Infof("Compacted %d chunks of user %s into %d, skipped %d", stats.Merged, userID, stats.Written, stats.Skipped)
+	return stats, nil
+}
+
+// compactChunks merges chunks, all of one series, into as few chunks as
+// possible, if that is fewer than there are.
+func (c *AWSStore) compactChunks(ctx context.Context, userID string, chunks []Chunk, stats *CompactStats) error {
+	chunks, skipped := c.fetchChunksForRebuild(ctx, userID, chunks)
+	stats.Skipped += skipped
+	compactedChunks.WithLabelValues("skipped").Add(float64(skipped))
+	if len(chunks) < 2 {
+		return nil
+	}
+
+	fp, _, _, err := parseChunkID(chunks[0].ID)
+	if err != nil {
+		return err
+	}
+	var samples []model.SamplePair
+	for _, chunk := range chunks {
+		chunkSamples, err := chunk.samples()
+		if err != nil {
+			return err
+		}
+		samples = util.MergeSamples(samples, chunkSamples)
+	}
+	merged, err := chunksForSamples(fp, chunks[0].Metric, chunks[0].Encoding, samples)
+	if err != nil {
+		return err
+	}
+	if len(merged) >= len(chunks) {
+		return nil
+	}
+	if err := c.assignChunkIDs(merged); err != nil {
+		return err
+	}
+	// A merged chunk has the same ID as an old one if that spanned all the
+	// others.  Deleting the old one would delete the merged one, and
+	// overwriting it isn't safe with write dedup, so leave them be.
+	old := make(map[string]struct{}, len(chunks))
+	for _, chunk := range chunks {
+		old[chunk.ID] = struct{}{}
+	}
+	for _, chunk := range merged {
+		if _, ok := old[chunk.ID]; ok {
+			return nil
+		}
+	}
+
+	if err := c.Put(user.WithID(ctx, userID), merged); err != nil {
+		return err
+	}
+	if err := c.deleteIndexEntries(ctx, userID, chunks); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		stats.Superseded = append(stats.Superseded, chunk.ID)
+	}
+	stats.Merged += len(chunks)
+	stats.Written += len(merged)
+	compactedChunks.WithLabelValues("merged").Add(float64(len(chunks)))
+	compactedChunks.WithLabelValues("written").Add(float64(len(merged)))
+	return nil
+}
+
+// DeleteChunkObjects deletes the objects of userID's chunks with the given
+// IDs, such as those superseded by Compact.
+func (c *AWSStore) DeleteChunkObjects(ctx context.Context, userID string, chunkIDs []string) error {
+	for _, chunkID := range chunkIDs {
+		if err := c.deleteChunkObjects(ctx, userID, chunkID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteChunkObjects deletes a chunk's object from every key it may be
+// stored under.
+func (c *AWSStore) deleteChunkObjects(ctx context.Context, userID, chunkID string) error {
+	for _, key := range c.chunkKeys(userID, chunkID) {
+		err := instrument.TimeRequestHistogram(ctx, "S3.DeleteObject", s3RequestDuration, func(_ context.Context) error {
+			_, err := c.cfg.S3.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(c.cfg.BucketName),
+				Key:    aws.String(key),
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compactor periodically compacts every user's small chunks, once their
+// index buckets have closed, deleting the chunks merged cfg.DeleteDelay
+// later.  Only one process needs to run it.  Chunks still to be deleted
+// when it stops are left behind; they are no longer in the index, so
+// queries don't see them.
+type Compactor struct {
+	store    *AWSStore
+	cfg      CompactionConfig
+	minAge   time.Duration
+	interval time.Duration
+	done     chan struct{}
+	wait     sync.WaitGroup
+
+	// Chunks which ended before this have been compacted.
+	compactedThrough model.Time
+
+	// Chunks merged, to delete once their delay is up.
+	superseded []supersededChunks
+}
+
+type supersededChunks struct {
+	userID      string
+	chunkIDs    []string
+	deleteAfter time.Time
+}
+
+// NewCompactor makes a new Compactor, compacting chunks every interval, once
+// they ended at least minAge ago.  minAge should be long enough that no more
+// chunks are written to their index buckets.
+func NewCompactor(store *AWSStore, cfg CompactionConfig, minAge, interval time.Duration) *Compactor {
+	return &Compactor{
+		store:    store,
+		cfg:      cfg,
+		minAge:   minAge,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start the Compactor
+func (c *Compactor) Start() {
+	c.wait.Add(1)
+	go c.loop()
+}
+
+// Stop the Compactor
+func (c *Compactor) Stop() {
+	close(c.done)
+	c.wait.Wait()
+}
+
+func (c *Compactor) loop() {
+	defer c.wait.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := instrument.TimeRequestHistogram(context.Background(), "Compactor.compactAll", compactionDuration, c.compactAll); err != nil {
+			log.Errorf("Error compacting chunks: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// compactAll deletes the chunks merged whose delay is up, and compacts
+// every user's chunks which have closed since the last run.  If any user's
+// chunks fail, they are all retried next time.
+func (c *Compactor) compactAll(ctx context.Context) error {
+	now := mtime.Now()
+	c.deleteSuperseded(ctx, now)
+
+	through := model.TimeFromUnixNano(now.Add(-c.minAge).UnixNano())
+	userIDs, err := c.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, userID := range userIDs {
+		stats, err := c.store.Compact(ctx, userID, c.compactedThrough, through, c.cfg)
+		if len(stats.Superseded) > 0 {
+			c.superseded = append(c.superseded, supersededChunks{
+				userID:      userID,
+				chunkIDs:    stats.Superseded,
+				deleteAfter: now.Add(c.cfg.DeleteDelay),
+			})
+		}
+		if err != nil {
+			log.Warnf("Could not compact chunks of %s: %v", userID, err)
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		c.compactedThrough = through
+	}
+	return lastErr
+}
+
+// deleteSuperseded deletes the chunks merged whose delay is up at now.
+// Those which fail are retried next time.
+func (c *Compactor) deleteSuperseded(ctx context.Context, now time.Time) {
+	remaining := c.superseded[:0]
+	for _, s := range c.superseded {
+		if now.Before(s.deleteAfter) {
+			remaining = append(remaining, s)
+			continue
+		}
+		if err := c.store.DeleteChunkObjects(ctx, s.userID, s.chunkIDs); err != nil {
+			log.Warnf("Could not delete compacted chunks of %s: %v", s.userID, err)
+			remaining = append(remaining, s)
+		}
+	}
+	c.superseded = remaining
+}
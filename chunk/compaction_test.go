@@ -0,0 +1,177 @@
+package chunk
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestCompact(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+
+	// Six small chunks of a series ten minutes apart, two of which overlap,
+	// and one of another series.
+	start := model.Now().Add(-48 * time.Hour)
+	start -= start % model.Time(24*time.Hour/time.Millisecond)
+	var small []Chunk
+	for i := 0; i < 6; i++ {
+		small = append(small, newTestChunk(t, start.Add(time.Duration(i)*10*time.Minute+time.Hour), 10))
+	}
+	small = append(small, newTestChunk(t, start.Add(time.Hour+5*time.Second), 10))
+	other := newTestChunk(t, start.Add(time.Hour), 10)
+	other.Metric = model.Metric{model.MetricNameLabel: "foo", "bar": "other"}
+	other = NewChunk(model.Fingerprint(2), other.Metric, other.Data, other.From, other.Through)
+	if err := store.Put(ctx, append(small, other)); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() model.Matrix {
+		chunks, err := store.Get(ctx, start, start.Add(24*time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		matrix, err := ChunksToMatrix(chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(matrix)
+		return matrix
+	}
+	before := get()
+
+	stats, err := store.Compact(ctx, "0", 0, model.Now(), CompactionConfig{MaxChunkSize: 1 << 20, Period: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Merged != len(small) || stats.Written != 1 || stats.Skipped != 0 || len(stats.Superseded) != len(small) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(objects.objects["chunks"]) != len(small)+2 {
+		t.Fatalf("expected the merged chunks to be kept, got %d chunk objects", len(objects.objects["chunks"]))
+	}
+	if err := store.DeleteChunkObjects(ctx, "0", stats.Superseded); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects.objects["chunks"]) != 2 {
+		t.Fatalf("expected 2 chunk objects, got %d", len(objects.objects["chunks"]))
+	}
+	if after := get(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("compaction changed samples: %v, %v", before, after)
+	}
+	chunks, err := store.Get(ctx, start, start.Add(24*time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks in the index, got %d", len(chunks))
+	}
+
+	// Compacting again changes nothing.
+	stats, err = store.Compact(ctx, "0", 0, model.Now(), CompactionConfig{MaxChunkSize: 1 << 20, Period: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Merged != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// Queries served from a warm index cache may fetch chunks compacted since,
+// so the Compactor only deletes them once the cached lookups have expired.
+func TestCompactorWithIndexCache(t *testing.T) {
+	now := time.Now()
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	ctx := user.WithID(context.Background(), "0")
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		IndexCache: IndexCacheConfig{Validity: time.Minute, MaxStaleness: time.Minute},
+	})
+
+	start := model.TimeFromUnixNano(now.Add(-48 * time.Hour).UnixNano())
+	start -= start % model.Time(24*time.Hour/time.Millisecond)
+	var small []Chunk
+	for i := 0; i < 4; i++ {
+		small = append(small, newTestChunk(t, start.Add(time.Duration(i)*10*time.Minute+time.Hour), 10))
+	}
+	if err := store.Put(ctx, small); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() (int, model.Matrix) {
+		chunks, err := store.Get(ctx, start, start.Add(24*time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		matrix, err := ChunksToMatrix(chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(chunks), matrix
+	}
+	_, before := get()
+
+	compactor := NewCompactor(store, CompactionConfig{MaxChunkSize: 1 << 20, Period: 24 * time.Hour, DeleteDelay: 5 * time.Minute}, time.Hour, time.Hour)
+	if err := compactor.compactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached lookup still returns the merged chunks, which can still be
+	// fetched, while it's valid and while it's stale.
+	for _, age := range []time.Duration{30 * time.Second, 90 * time.Second} {
+		mtime.NowForce(now.Add(age))
+		n, after := get()
+		if n != len(small) {
+			t.Fatalf("expected the cached lookup's %d chunks after %v, got %d", len(small), age, n)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Fatalf("compaction changed samples after %v: %v, %v", age, before, after)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if n, _ := get(); n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale lookup never refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once the delay is up, they are deleted.
+	mtime.NowForce(now.Add(10 * time.Minute))
+	if err := compactor.compactAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects.objects["chunks"]) != 1 {
+		t.Fatalf("expected 1 chunk object, got %d", len(objects.objects["chunks"]))
+	}
+	n, after := get()
+	if n != 1 {
+		t.Fatalf("expected the compacted chunk, got %d chunks", n)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("compaction changed samples: %v, %v", before, after)
+	}
+}
@@ -0,0 +1,138 @@
+package chunk
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+var deletedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_deleted_chunks_total",
+	Help:      "The number of chunks deleted by delete series requests, by whether they were deleted whole or rewritten without the deleted range.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(deletedChunks)
+}
+
+// Delete implements Store.  It deletes the chunks of the series matching
+// matchers which overlap from-through, and their index entries.  Samples of
+// those chunks outside from-through are kept, by writing them to new chunks
+// before the old ones are deleted, so a failed Delete can be retried.
+func (c *AWSStore) Delete(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) error {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return err
+	}
+	// lookupChunks reorders matchers, which callers may reuse.
+	matchers = append([]*metric.LabelMatcher{}, matchers...)
+	chunks, err := c.lookupChunks(ctx, userID, from, through, matchers, func([]Chunk) {})
+	if err != nil || len(chunks) == 0 {
+		return err
+	}
+	// Chunks are fetched whole, for the metadata their index entries are
+	// calculated from, and the samples to keep.
+	chunks, err = c.fetchChunks(ctx, userID, 0, model.Latest, chunks)
+	if err != nil {
+		return err
+	}
+
+	var kept []Chunk
+	for _, chunk := range chunks {
+		if from <= chunk.From && chunk.Through <= through {
+			continue
+		}
+		rest, err := chunk.without(from, through)
+		if err != nil {
+			return err
+		}
+		kept = append(kept, rest...)
+	}
+	if len(kept) > 0 {
+		if err := c.Put(ctx, kept); err != nil {
+			return err
+		}
+	}
+
+	if err := c.deleteIndexEntries(ctx, userID, chunks); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := c.deleteChunkObjects(ctx, userID, chunk.ID); err != nil {
+			return err
+		}
+		if from <= chunk.From && chunk.Through <= through {
+			deletedChunks.WithLabelValues("deleted").Inc()
+		} else {
+			deletedChunks.WithLabelValues("rewritten").Inc()
+		}
+	}
+	log.Infof("Deleted %d chunks of user %s, rewriting %d chunks of samples outside %v-%v", len(chunks), userID, len(kept), from, through)
+	return nil
+}
+
+// without returns new chunks holding the chunk's samples outside
+// from-through.  Samples before and after the range go in separate chunks,
+// so no new chunk has the same ID as the old one.
+func (c *Chunk) without(from, through model.Time) ([]Chunk, error) {
+	fp, _, _, err := parseChunkID(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := c.samples()
+	if err != nil {
+		return nil, err
+	}
+	var before, after []model.SamplePair
+	for _, s := range samples {
+		if s.Timestamp < from {
+			before = append(before, s)
+		} else if s.Timestamp > through {
+			after = append(after, s)
+		}
+	}
+
+	var chunks []Chunk
+	for _, run := range [][]model.SamplePair{before, after} {
+		runChunks, err := chunksForSamples(fp, c.Metric, c.Encoding, run)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, runChunks...)
+	}
+	return chunks, nil
+}
+
+// chunksForSamples encodes samples in as many chunks as they need.
+func chunksForSamples(fp model.Fingerprint, metric model.Metric, encoding prom_chunk.Encoding, samples []model.SamplePair) ([]Chunk, error) {
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	pc, err := prom_chunk.NewForEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		chunks []Chunk
+		first  int
+	)
+	for i, s := range samples {
+		pcs, err := pc.Add(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(pcs) > 1 {
+			chunks = append(chunks, NewChunk(fp, metric, pcs[0], samples[first].Timestamp, samples[i-1].Timestamp))
+			first = i
+		}
+		pc = pcs[len(pcs)-1]
+	}
+	chunks = append(chunks, NewChunk(fp, metric, pc, samples[first].Timestamp, samples[len(samples)-1].Timestamp))
+	return chunks, nil
+}
@@ -0,0 +1,56 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestDelete(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	oldChunk := newTestChunk(t, now.Add(-time.Hour), 10)
+	newChunk := newTestChunk(t, now, 10)
+
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+	if err := store.Put(ctx, []Chunk{oldChunk, newChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the last 6 samples of the old chunk.
+	err := store.Delete(ctx, now.Add(-time.Hour-5*time.Second), now.Add(-time.Minute),
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects.objects["chunks"][chunkName("0", oldChunk.ID)]; ok {
+		t.Fatal("old chunk not deleted")
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-2*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || chunks[1].ID != newChunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+	samples, err := chunks[0].samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 4 || samples[3].Timestamp != now.Add(-time.Hour-6*time.Second) {
+		t.Fatalf("unexpected samples kept %v", samples)
+	}
+}
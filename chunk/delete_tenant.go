@@ -0,0 +1,163 @@
+package chunk
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+)
+
+// DeleteTenantStats reports the progress of DeleteTenant.
+type DeleteTenantStats struct {
+	Chunks       int // Chunks found in S3, whose index entries are looked up.
+	Skipped      int // Chunks which couldn't be fetched or decoded.
+	IndexEntries int // Index entries deleted.
+	Objects      int // S3 objects deleted: chunks, series sketches, selectivity stats and the bucket index.
+}
+
+// DeleteTenant deletes all of userID's data: every index entry for the
+// metrics of their chunks, in every bucket and periodic table the chunks
+// span, and then every object under their prefixes in S3.  Index entries
+// are deleted first, as they are found from the chunks, so a failed
+// DeleteTenant can be retried.  progress, if non-nil, is called with the
+// stats so far as each step completes.
+//
+// The index entries of skipped chunks, and of chunks stored inline in the
+// index, are only deleted if other chunks of the same metric are in the
+// same index buckets.  The tenant's data should be checked for those of
+// skipped chunks afterwards, eg with a table scan; inline chunks expire
+// with IndexEntryTTL, which NewStore requires with them.
+func (c *AWSStore) DeleteTenant(ctx context.Context, userID string, progress func(DeleteTenantStats)) (DeleteTenantStats, error) {
+	var stats DeleteTenantStats
+	report := func() {
+		if progress != nil {
+			progress(stats)
+		}
+	}
+
+	// The hash values of the tenant's index rows, by table.
+	hashValues := map[string]map[string]struct{}{}
+	addHashValue := func(tableName, hashValue string) {
+		if hashValues[tableName] == nil {
+			hashValues[tableName] = map[string]struct{}{}
+		}
+		hashValues[tableName][hashValue] = struct{}{}
+	}
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		if len(listed) == 0 {
+			return nil
+		}
+		chunks := make([]Chunk, 0, len(listed))
+		for _, l := range listed {
+			chunks = append(chunks, Chunk{ID: l.id})
+		}
+
+		chunks, skipped := c.fetchChunksForRebuild(ctx, userID, chunks)
+		stats.Skipped += skipped
+		stats.Chunks += len(chunks) + skipped
+		for _, chunk := range chunks {
+			metricName, fp := chunk.Metric[model.MetricNameLabel], chunk.Metric.Fingerprint()
+			for _, bucket := range c.bigBuckets(chunk.From, chunk.Through) {
+				hashValues := append(bucket.indexedLabelHashValues(userID, chunk.Metric, fp), bucket.seriesHashValue(userID, metricName, fp))
+				hashValues = append(hashValues, bucket.labelNameHashValues(userID, chunk.Metric, fp)...)
+				hashValues = append(hashValues, bucket.seriesEntryHashValues(userID, metricName, fp)...)
+				for _, hashValue := range hashValues {
+					addHashValue(bucket.tableName, hashValue)
+					if bucket.overlapTableName != "" {
+						addHashValue(bucket.overlapTableName, hashValue)
+					}
+				}
+			}
+			if c.cfg.WriteDedup {
+				claim := c.claimItem(userID, &chunk, "")
+				addHashValue(c.claimTable(&chunk), aws.StringValue(claim[hashKey].S))
+			}
+		}
+		report()
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	tableNames := make([]string, 0, len(hashValues))
+	for tableName := range hashValues {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	for _, tableName := range tableNames {
+		tableEntries := 0
+		for hashValue := range hashValues[tableName] {
+			deleted, err := c.deleteHashValue(ctx, tableName, hashValue)
+			if err != nil {
+				return stats, err
+			}
+			tableEntries += deleted
+		}
+		stats.IndexEntries += tableEntries
+		log.Infof("Deleted %d index entries of user %s from table %s", tableEntries, userID, tableName)
+		report()
+	}
+
+	for _, prefix := range c.chunkPrefixes(userID) {
+		err := c.listObjects(ctx, prefix, "", func(output *s3.ListObjectsOutput) error {
+			for _, object := range output.Contents {
+				key := aws.StringValue(object.Key)
+				err := instrument.TimeRequestHistogram(ctx, "S3.DeleteObject", s3RequestDuration, func(_ context.Context) error {
+					_, err := c.cfg.S3.DeleteObject(&s3.DeleteObjectInput{
+						Bucket: aws.String(c.cfg.BucketName),
+						Key:    aws.String(key),
+					})
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				stats.Objects++
+			}
+			report()
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	log.Infof("Deleted user %s: %d chunks found, %d skipped, %d index entries and %d objects deleted", userID, stats.Chunks, stats.Skipped, stats.IndexEntries, stats.Objects)
+	return stats, nil
+}
+
+// deleteHashValue deletes every index row with hashValue in tableName,
+// returning how many it deleted.  A table which doesn't exist has none.
+func (c *AWSStore) deleteHashValue(ctx context.Context, tableName, hashValue string) (int, error) {
+	var deleteReqs []*dynamodb.WriteRequest
+	err := c.dynamo.queryPages(ctx, metricNameQueryInput(tableName, hashValue), func(resp interface{}, lastPage bool) bool {
+		for _, item := range resp.(*dynamodb.QueryOutput).Items {
+			deleteReqs = append(deleteReqs, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{
+					Key: map[string]*dynamodb.AttributeValue{
+						hashKey:  {S: aws.String(hashValue)},
+						rangeKey: item[rangeKey],
+					},
+				},
+			})
+		}
+		return true
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == resourceNotFoundException {
+		return 0, nil
+	}
+	if err != nil || len(deleteReqs) == 0 {
+		return 0, err
+	}
+	err = c.dynamo.batchWriteDynamo(ctx, map[string][]*dynamodb.WriteRequest{tableName: deleteReqs})
+	if err != nil {
+		return 0, err
+	}
+	return len(deleteReqs), nil
+}
@@ -0,0 +1,77 @@
+package chunk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestDeleteTenant(t *testing.T) {
+	now := model.Now()
+	chunks := []Chunk{
+		newTestChunk(t, now.Add(-30*24*time.Hour), 10),
+		newTestChunk(t, now, 10),
+	}
+
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	store := NewAWSStore(StoreConfig{
+		S3:             objects,
+		BucketName:     "chunks",
+		DynamoDB:       NewMemoryIndexClient(),
+		TableName:      "index",
+		ChunkKeyShards: 4,
+		WriteDedup:     true,
+	})
+	for _, userID := range []string{"0", "1"} {
+		if err := store.Put(user.WithID(context.Background(), userID), chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.storeSelectivity(context.Background(), selectivityName("0", "foo"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports int
+	stats, err := store.DeleteTenant(context.Background(), "0", func(DeleteTenantStats) { reports++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks != 2 || stats.Skipped != 0 || stats.IndexEntries == 0 || stats.Objects != 3 || reports == 0 {
+		t.Fatalf("unexpected stats %+v, %d reports", stats, reports)
+	}
+	for key := range objects.objects["chunks"] {
+		if strings.HasPrefix(key, "0/") || strings.Contains(key, "/0/") {
+			t.Errorf("object %s not deleted", key)
+		}
+	}
+
+	for userID, expected := range map[string][]Chunk{"0": nil, "1": chunks} {
+		found, err := store.Get(user.WithID(context.Background(), userID), now.Add(-31*24*time.Hour), now,
+			mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+			mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) == 0 && len(found) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(expected, found) {
+			t.Fatalf("%s: wrong chunks - %s", userID, diff(expected, found))
+		}
+	}
+
+	// The deleted user's chunks can be written again, as their claims are gone.
+	if err := store.Put(user.WithID(context.Background(), "0"), chunks); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects.objects["chunks"][store.chunkKeys("0", chunks[0].ID)[0]]; !ok {
+		t.Fatal("chunk not written again")
+	}
+}
@@ -0,0 +1,365 @@
+package chunk
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	downsampleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_downsample_seconds",
+		Help:      "Time spent downsampling all users' chunks.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	}, []string{"operation", "status_code"})
+	downsampledChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_downsampled_chunks_total",
+		Help:      "The number of downsampled chunks written.",
+	})
+	downsampledQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_downsampled_queries_total",
+		Help:      "The number of queries which read downsampled rather than raw samples.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(downsampleDuration)
+	prometheus.MustRegister(downsampledChunks)
+	prometheus.MustRegister(downsampledQueries)
+}
+
+// The aggregates each series is downsampled to.  Each is stored as its own
+// series; see DownsampledMetricName.
+const (
+	DownsampleMin   = "min"
+	DownsampleMax   = "max"
+	DownsampleAvg   = "avg"
+	DownsampleCount = "count"
+)
+
+var downsampleAggregates = []string{DownsampleMin, DownsampleMax, DownsampleAvg, DownsampleCount}
+
+const downsampledNameMarker = ":downsample_"
+
+// DownsamplingConfig configures the resolutions series are downsampled to,
+// and which queries read them.
+type DownsamplingConfig struct {
+	Resolutions []Resolution
+
+	// Queries only read downsampled samples older than this, as newer ones
+	// may not have been downsampled yet, and raw samples after that.  It
+	// should be longer than the Downsampler's minAge plus its interval.  If
+	// zero, queries only read raw samples.
+	QueryLag time.Duration
+}
+
+// Resolution is a resolution series are downsampled to.
+type Resolution struct {
+	// Samples are aggregated over aligned periods of this long, each giving
+	// a downsampled sample at its start.
+	Step time.Duration
+
+	// Queries over at least this long read the average of the samples at
+	// this resolution, or the coarsest one they are long enough for, rather
+	// than the raw samples.
+	MinQueryRange time.Duration
+}
+
+// DownsampledMetricName returns the metric name the aggregate of a series
+// named name is stored under at a resolution of step, eg
+// http_requests_total:downsample_1h:max.  Downsampled series can be queried
+// by these names directly.
+func DownsampledMetricName(name model.LabelValue, step time.Duration, aggregate string) model.LabelValue {
+	return model.LabelValue(fmt.Sprintf("%s%s%s:%s", name, downsampledNameMarker, model.Duration(step), aggregate))
+}
+
+func isDownsampled(name model.LabelValue) bool {
+	return strings.Contains(string(name), downsampledNameMarker)
+}
+
+// Downsample writes downsampled series for userID's samples between from and
+// through, which should be aligned to the coarsest resolution's step, so no
+// period is split between calls.  All chunks overlapping that range are
+// read, so all of them should have been flushed.  Rerunning it writes the
+// same chunks, so is harmless.  It returns the number of chunks written.
+func (c *AWSStore) Downsample(ctx context.Context, userID string, from, through model.Time) (int, error) {
+	bySeries := map[model.Fingerprint][]Chunk{}
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		for _, l := range listed {
+			if l.through < from || l.from >= through {
+				continue
+			}
+			bySeries[l.fp] = append(bySeries[l.fp], Chunk{ID: l.id})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, chunks := range bySeries {
+		n, err := c.downsampleSeries(ctx, userID, from, through, chunks)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	log.Infof("Downsampled %d series of user %s into %d chunks", len(bySeries), userID, written)
+	return written, nil
+}
+
+// downsampleSeries writes the downsampled series for chunks, all of one
+// series, at every resolution.
+func (c *AWSStore) downsampleSeries(ctx context.Context, userID string, from, through model.Time, chunks []Chunk) (int, error) {
+	chunks, _ = c.fetchChunksForRebuild(ctx, userID, chunks)
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+	name := chunks[0].Metric[model.MetricNameLabel]
+	if name == "" || isDownsampled(name) {
+		return 0, nil
+	}
+
+	var samples []model.SamplePair
+	for _, chunk := range chunks {
+		chunkSamples, err := chunk.samples()
+		if err != nil {
+			return 0, err
+		}
+		samples = util.MergeSamples(samples, chunkSamples)
+	}
+
+	var downsampled []Chunk
+	for _, resolution := range c.cfg.Downsampling.Resolutions {
+		aggregates := downsample(samples, from, through, resolution.Step)
+		for _, aggregate := range downsampleAggregates {
+			metric := chunks[0].Metric.Clone()
+			metric[model.MetricNameLabel] = DownsampledMetricName(name, resolution.Step, aggregate)
+			aggregateChunks, err := chunksForSamples(metric.Fingerprint(), metric, prom_chunk.DefaultEncoding, aggregates[aggregate])
+			if err != nil {
+				return 0, err
+			}
+			downsampled = append(downsampled, aggregateChunks...)
+		}
+	}
+	if len(downsampled) == 0 {
+		return 0, nil
+	}
+	if err := c.Put(user.WithID(ctx, userID), downsampled); err != nil {
+		return 0, err
+	}
+	downsampledChunks.Add(float64(len(downsampled)))
+	return len(downsampled), nil
+}
+
+// downsample aggregates the sorted samples between from and through over
+// aligned periods of step, returning, for each aggregate, a sample at the
+// start of each period with samples.  Staleness markers are left out.
+func downsample(samples []model.SamplePair, from, through model.Time, step time.Duration) map[string][]model.SamplePair {
+	var (
+		stepMs        = int64(step / time.Millisecond)
+		result        = map[string][]model.SamplePair{}
+		period        model.Time
+		min, max, sum float64
+		count         int
+	)
+	flush := func() {
+		result[DownsampleMin] = append(result[DownsampleMin], model.SamplePair{Timestamp: period, Value: model.SampleValue(min)})
+		result[DownsampleMax] = append(result[DownsampleMax], model.SamplePair{Timestamp: period, Value: model.SampleValue(max)})
+		result[DownsampleAvg] = append(result[DownsampleAvg], model.SamplePair{Timestamp: period, Value: model.SampleValue(sum / float64(count))})
+		result[DownsampleCount] = append(result[DownsampleCount], model.SamplePair{Timestamp: period, Value: model.SampleValue(count)})
+	}
+	for _, s := range samples {
+		if s.Timestamp < from || s.Timestamp >= through || util.IsStaleNaN(s.Value) {
+			continue
+		}
+		samplePeriod := s.Timestamp - model.Time(int64(s.Timestamp)%stepMs)
+		if count > 0 && samplePeriod != period {
+			flush()
+			count = 0
+		}
+		v := float64(s.Value)
+		if count == 0 {
+			period, min, max, sum = samplePeriod, v, v, 0
+		}
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		sum += v
+		count++
+	}
+	if count > 0 {
+		flush()
+	}
+	return result
+}
+
+// downsampledQuery returns whether a query should read downsampled samples
+// before some cutoff, and raw samples after it.  If so, it returns the
+// cutoff, the matchers for the averages at the coarsest resolution the
+// query is long enough for, and the metric name to give them back.
+func (c *AWSStore) downsampledQuery(from, through model.Time, matchers []*metric.LabelMatcher) (model.Time, []*metric.LabelMatcher, model.LabelValue, bool) {
+	cfg := c.cfg.Downsampling
+	if cfg.QueryLag <= 0 {
+		return 0, nil, "", false
+	}
+	var step time.Duration
+	for _, resolution := range cfg.Resolutions {
+		if through.Sub(from) >= resolution.MinQueryRange && resolution.Step > step {
+			step = resolution.Step
+		}
+	}
+	if step == 0 {
+		return 0, nil, "", false
+	}
+	cutoff := model.TimeFromUnixNano(mtime.Now().Add(-cfg.QueryLag).UnixNano())
+	cutoff -= model.Time(int64(cutoff) % int64(step/time.Millisecond))
+	if cutoff <= from {
+		return 0, nil, "", false
+	}
+
+	for i, matcher := range matchers {
+		if matcher.Name != model.MetricNameLabel || matcher.Type != metric.Equal || isDownsampled(matcher.Value) {
+			continue
+		}
+		downsampled, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, DownsampledMetricName(matcher.Value, step, DownsampleAvg))
+		if err != nil {
+			return 0, nil, "", false
+		}
+		result := append([]*metric.LabelMatcher(nil), matchers...)
+		result[i] = downsampled
+		return cutoff, result, matcher.Value, true
+	}
+	return 0, nil, "", false
+}
+
+// getDownsampled runs Get for the downsampled samples from from to cutoff,
+// giving them back the metric name name, and for the raw samples from
+// cutoff to through.
+func (c *AWSStore) getDownsampled(ctx context.Context, from, cutoff, through model.Time, downsampledMatchers, matchers []*metric.LabelMatcher, name model.LabelValue) ([]Chunk, error) {
+	downsampledQueries.Inc()
+	chunks, err := c.Get(ctx, from, cutoff-1, downsampledMatchers...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chunks {
+		chunks[i].Metric = chunks[i].Metric.Clone()
+		chunks[i].Metric[model.MetricNameLabel] = name
+	}
+	if cutoff <= through {
+		raw, err := c.Get(ctx, cutoff, through, append([]*metric.LabelMatcher(nil), matchers...)...)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, raw...)
+	}
+	return chunks, nil
+}
+
+// Downsampler periodically downsamples every user's chunks, once they have
+// been flushed.  Only one process needs to run it.
+type Downsampler struct {
+	store    *AWSStore
+	minAge   time.Duration
+	interval time.Duration
+	done     chan struct{}
+	wait     sync.WaitGroup
+
+	// Samples before this have been downsampled.
+	downsampledThrough model.Time
+}
+
+// NewDownsampler makes a new Downsampler, downsampling samples every
+// interval, once they are at least minAge old.  minAge should be long enough
+// that all chunks holding them have been flushed.
+func NewDownsampler(store *AWSStore, minAge, interval time.Duration) *Downsampler {
+	return &Downsampler{
+		store:    store,
+		minAge:   minAge,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start the Downsampler
+func (d *Downsampler) Start() {
+	d.wait.Add(1)
+	go d.loop()
+}
+
+// Stop the Downsampler
+func (d *Downsampler) Stop() {
+	close(d.done)
+	d.wait.Wait()
+}
+
+func (d *Downsampler) loop() {
+	defer d.wait.Done()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := instrument.TimeRequestHistogram(context.Background(), "Downsampler.downsampleAll", downsampleDuration, d.downsampleAll); err != nil {
+			log.Errorf("Error downsampling chunks: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// downsampleAll downsamples every user's samples since the last run, up to
+// the end of the last whole period of the coarsest resolution at least
+// minAge ago.  If any user's samples fail, they are all retried next time.
+func (d *Downsampler) downsampleAll(ctx context.Context) error {
+	var step int64
+	for _, resolution := range d.store.cfg.Downsampling.Resolutions {
+		if s := int64(resolution.Step / time.Millisecond); s > step {
+			step = s
+		}
+	}
+	if step == 0 {
+		return nil
+	}
+	through := model.TimeFromUnixNano(mtime.Now().Add(-d.minAge).UnixNano())
+	through -= model.Time(int64(through) % step)
+	if through <= d.downsampledThrough {
+		return nil
+	}
+
+	userIDs, err := d.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, userID := range userIDs {
+		if _, err := d.store.Downsample(ctx, userID, d.downsampledThrough, through); err != nil {
+			log.Warnf("Could not downsample chunks of %s: %v", userID, err)
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		d.downsampledThrough = through
+	}
+	return lastErr
+}
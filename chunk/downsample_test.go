@@ -0,0 +1,137 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestDownsample(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Downsampling: DownsamplingConfig{
+			Resolutions: []Resolution{
+				{Step: 5 * time.Minute, MinQueryRange: 24 * time.Hour},
+				{Step: time.Hour, MinQueryRange: 72 * time.Hour},
+			},
+			QueryLag: 24 * time.Hour,
+		},
+	})
+
+	// Two days of samples a minute apart, valued by their minute, ending
+	// five days ago.
+	const days = 2
+	start := model.Now().Add(-7 * 24 * time.Hour)
+	start -= start % model.Time(24*time.Hour/time.Millisecond)
+	end := start.Add(days * 24 * time.Hour)
+	m := model.Metric{model.MetricNameLabel: "foo", "bar": "a"}
+	var samples []*model.Sample
+	for i := 0; i < days*24*60; i++ {
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: start.Add(time.Duration(i) * time.Minute), Value: model.SampleValue(i)})
+	}
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := store.Downsample(ctx, "0", start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written == 0 {
+		t.Fatal("expected downsampled chunks to be written")
+	}
+
+	get := func(from, through model.Time, name model.LabelValue) *model.SampleStream {
+		chunks, err := store.Get(ctx, from, through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		matrix, err := ChunksToMatrix(chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matrix) != 1 {
+			t.Fatalf("%s: expected 1 series, got %v", name, matrix)
+		}
+		return matrix[0]
+	}
+
+	// Each aggregate can be queried by name.
+	for aggregate, expected := range map[string]func(hour int) model.SampleValue{
+		DownsampleMin:   func(hour int) model.SampleValue { return model.SampleValue(hour * 60) },
+		DownsampleMax:   func(hour int) model.SampleValue { return model.SampleValue(hour*60 + 59) },
+		DownsampleAvg:   func(hour int) model.SampleValue { return model.SampleValue(hour*60) + 29.5 },
+		DownsampleCount: func(hour int) model.SampleValue { return 60 },
+	} {
+		name := DownsampledMetricName("foo", time.Hour, aggregate)
+		ss := get(start, end, name)
+		if ss.Metric[model.MetricNameLabel] != name || ss.Metric["bar"] != "a" {
+			t.Fatalf("unexpected series %v", ss.Metric)
+		}
+		if len(ss.Values) != days*24 {
+			t.Fatalf("%s: expected %d samples, got %d", name, days*24, len(ss.Values))
+		}
+		for hour, s := range ss.Values {
+			if s.Timestamp != start.Add(time.Duration(hour)*time.Hour) || s.Value != expected(hour) {
+				t.Fatalf("%s: unexpected sample %d: %v", name, hour, s)
+			}
+		}
+	}
+
+	// Long queries read averages at the coarsest resolution they are long
+	// enough for, under the raw name, and short ones raw samples.
+	for _, tc := range []struct {
+		from, through model.Time
+		expected      int
+	}{
+		{start, start.Add(12 * time.Hour), 12*60 + 1},
+		{start, end, days * 24 * 12},
+		{start, end.Add(48 * time.Hour), days * 24},
+	} {
+		ss := get(tc.from, tc.through, "foo")
+		if ss.Metric[model.MetricNameLabel] != "foo" {
+			t.Fatalf("unexpected series %v", ss.Metric)
+		}
+		if n := samplesBetween(ss, tc.from, tc.through); n != tc.expected {
+			t.Fatalf("from %v: expected %d samples, got %d", tc.from, tc.expected, n)
+		}
+
+		// Looking the chunks up lazily finds the same ones.
+		refs, err := store.GetChunkRefs(ctx, tc.from, tc.through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := store.FetchChunks(ctx, tc.from, tc.through, refs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matrix, err := ChunksToMatrix(chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matrix) != 1 || matrix[0].Metric[model.MetricNameLabel] != "foo" || samplesBetween(matrix[0], tc.from, tc.through) != tc.expected {
+			t.Fatalf("from %v: unexpected lazy result %v", tc.from, matrix)
+		}
+	}
+}
+
+// samplesBetween counts ss's samples between from and through, as queries
+// return whole chunks.
+func samplesBetween(ss *model.SampleStream, from, through model.Time) int {
+	n := 0
+	for _, s := range ss.Values {
+		if s.Timestamp >= from && s.Timestamp <= through {
+			n++
+		}
+	}
+	return n
+}
@@ -41,17 +41,36 @@ func init() {
 
 // TableManagerConfig is the config for a DynamoTableManager
 type TableManagerConfig struct {
-	DynamoDB             DynamoDBClient
+	DynamoDB             IndexClient
 	TableName            string
 	DynamoDBPollInterval time.Duration
 
 	PeriodicTableConfig
 
+	// Index schema periods with their own table prefixes have tables made
+	// with each prefix in effect during the tables' periods.
+	Schema SchemaConfig
+
 	// duration a table will be created before it is needed.
-	CreationGracePeriod        time.Duration
+	CreationGracePeriod time.Duration
+	// duration past the max chunk age after a table's period ends that it
+	// keeps its write throughput, for chunks flushed late.
+	InactiveGracePeriod        time.Duration
 	MaxChunkAge                time.Duration
 	ProvisionedWriteThroughput int64
 	ProvisionedReadThroughput  int64
+
+	// If non-zero, periodic tables are deleted once all the chunks indexed
+	// in them are this much older than the max chunk age and inactive grace
+	// period after the tables' periods end.  It should be the chunk
+	// retention period; see RetentionConfig.  Tables are never deleted by
+	// index clients which can't delete them.
+	RetentionPeriod time.Duration
+}
+
+// tableDeleter is implemented by index clients which can delete tables.
+type tableDeleter interface {
+	DeleteTable(*dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error)
 }
 
 // DynamoTableManager creates and manages the provisioned throughput on DynamoDB tables
@@ -112,7 +131,7 @@ func (m *DynamoTableManager) syncTables(ctx context.Context) error {
 	expected := m.calculateExpectedTables()
 	log.Infof("Expecting %d tables", len(expected))
 
-	toCreate, toCheckThroughput, err := m.partitionTables(ctx, expected)
+	toCreate, toCheckThroughput, toDelete, err := m.partitionTables(ctx, expected, m.calculateExpiredTables())
 	if err != nil {
 		return err
 	}
@@ -121,7 +140,11 @@ func (m *DynamoTableManager) syncTables(ctx context.Context) error {
 		return err
 	}
 
-	return m.updateTables(ctx, toCheckThroughput)
+	if err := m.updateTables(ctx, toCheckThroughput); err != nil {
+		return err
+	}
+
+	return m.deleteTables(ctx, toDelete)
 }
 
 type tableDescription struct {
@@ -150,12 +173,14 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 	result := []tableDescription{}
 
 	var (
-		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
-		gracePeriodSecs = int64(m.cfg.CreationGracePeriod / time.Second)
-		maxChunkAgeSecs = int64(m.cfg.MaxChunkAge / time.Second)
-		firstTable      = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
-		lastTable       = (mtime.Now().Unix() + gracePeriodSecs) / tablePeriodSecs
-		now             = mtime.Now().Unix()
+		tablePeriodSecs         = int64(m.cfg.TablePeriod / time.Second)
+		gracePeriodSecs         = int64(m.cfg.CreationGracePeriod / time.Second)
+		inactiveGracePeriodSecs = int64(m.cfg.InactiveGracePeriod / time.Second)
+		maxChunkAgeSecs         = int64(m.cfg.MaxChunkAge / time.Second)
+		startTable              = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
+		firstTable              = m.firstUnexpiredTable()
+		lastTable               = (mtime.Now().Unix() + gracePeriodSecs) / tablePeriodSecs
+		now                     = mtime.Now().Unix()
 	)
 
 	// Add the legacy table
@@ -167,36 +192,93 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		}
 
 		// if we are before the switch to periodic table, we need to give this table write throughput
-		if now < (firstTable*tablePeriodSecs)+gracePeriodSecs+maxChunkAgeSecs {
+		if now < (startTable*tablePeriodSecs)+maxChunkAgeSecs+inactiveGracePeriodSecs {
 			legacyTable.provisionedWrite = m.cfg.ProvisionedWriteThroughput
 		}
 		result = append(result, legacyTable)
 	}
 
 	for i := firstTable; i <= lastTable; i++ {
-		table := tableDescription{
-			// Name construction needs to be consistent with chunk_store.bigBuckets
-			name:             m.cfg.TablePrefix + strconv.Itoa(int(i)),
-			provisionedRead:  m.cfg.ProvisionedReadThroughput,
-			provisionedWrite: minWriteCapacity,
-		}
+		for _, prefix := range m.cfg.Schema.tablePrefixes(m.cfg.TablePrefix, i*tablePeriodSecs, (i+1)*tablePeriodSecs) {
+			table := tableDescription{
+				// Name construction needs to be consistent with chunk_store.bigBuckets
+				name:             prefix + strconv.Itoa(int(i)),
+				provisionedRead:  m.cfg.ProvisionedReadThroughput,
+				provisionedWrite: minWriteCapacity,
+			}
 
-		// if now is within table [start - grace, end + grace), then we need some write throughput
-		if (i*tablePeriodSecs)-gracePeriodSecs <= now && now < (i*tablePeriodSecs)+tablePeriodSecs+gracePeriodSecs+maxChunkAgeSecs {
-			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			// if now is within table [start - grace, end + max chunk age + inactive grace), then we need some write throughput
+			if (i*tablePeriodSecs)-gracePeriodSecs <= now && now < (i*tablePeriodSecs)+tablePeriodSecs+maxChunkAgeSecs+inactiveGracePeriodSecs {
+				table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			}
+			result = append(result, table)
 		}
-		result = append(result, table)
 	}
 
 	sort.Sort(byName(result))
 	return result
 }
 
-// partitionTables works out tables that need to be created vs tables that need to be updated
-func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription) ([]tableDescription, []tableDescription, error) {
+// firstUnexpiredTable returns the number of the first periodic table which
+// isn't past the retention period.
+func (m *DynamoTableManager) firstUnexpiredTable() int64 {
+	var (
+		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
+		firstTable      = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
+	)
+	if m.cfg.RetentionPeriod <= 0 {
+		return firstTable
+	}
+
+	// Tables hold the entries of chunks starting before their period ends,
+	// which end at most the max chunk age later.
+	expiredBefore := mtime.Now().Add(-m.cfg.RetentionPeriod - m.cfg.InactiveGracePeriod - m.cfg.MaxChunkAge).Unix()
+	if unexpired := expiredBefore / tablePeriodSecs; unexpired > firstTable {
+		return unexpired
+	}
+	return firstTable
+}
+
+// calculateExpiredTables returns the names of the periodic tables past the
+// retention period, sorted.
+func (m *DynamoTableManager) calculateExpiredTables() []string {
+	if !m.cfg.UsePeriodicTables {
+		return nil
+	}
+
+	var (
+		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
+		firstTable      = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
+		result          []string
+	)
+	for i := firstTable; i < m.firstUnexpiredTable(); i++ {
+		for _, prefix := range m.cfg.Schema.tablePrefixes(m.cfg.TablePrefix, i*tablePeriodSecs, (i+1)*tablePeriodSecs) {
+			result = append(result, prefix+strconv.Itoa(int(i)))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// partitionTables works out tables that need to be created vs tables that
+// need to be updated, and which of the expired tables need to be deleted.
+func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription, expired []string) ([]tableDescription, []tableDescription, []string, error) {
 	existingTables, err := m.listTables(ctx)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+
+	toDelete := []string{}
+	for i, j := 0, 0; i < len(expired) && j < len(existingTables); {
+		if expired[i] < existingTables[j] {
+			i++
+		} else if expired[i] > existingTables[j] {
+			j++
+		} else {
+			toDelete = append(toDelete, expired[i])
+			i++
+			j++
+		}
 	}
 
 	toCreate, toCheckThroughput := []tableDescription{}, []tableDescription{}
@@ -220,12 +302,12 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 		toCreate = append(toCreate, descriptions[i])
 	}
 
-	return toCreate, toCheckThroughput, nil
+	return toCreate, toCheckThroughput, toDelete, nil
 }
 
 func (m *DynamoTableManager) listTables(ctx context.Context) ([]string, error) {
 	table := []string{}
-	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListTablesPages", dynamoRequestDuration, func(_ context.Context) error {
+	if err := timeDynamoRequest(ctx, "DynamoDB.ListTablesPages", noTable, func(_ context.Context) error {
 		return m.cfg.DynamoDB.ListTablesPages(&dynamodb.ListTablesInput{}, func(resp *dynamodb.ListTablesOutput, _ bool) bool {
 			for _, s := range resp.TableNames {
 				table = append(table, *s)
@@ -269,7 +351,7 @@ func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []ta
 			},
 		}
 		log.Infof("Creating table %s", desc.name)
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.CreateTable", dynamoRequestDuration, func(_ context.Context) error {
+		if err := timeDynamoRequest(ctx, "DynamoDB.CreateTable", m.cfg.tableLabel(desc.name), func(_ context.Context) error {
 			_, err := m.cfg.DynamoDB.CreateTable(params)
 			return err
 		}); err != nil {
@@ -283,7 +365,7 @@ func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []ta
 	for _, desc := range descriptions {
 		log.Infof("Checking provisioned throughput on table %s", desc.name)
 		var out *dynamodb.DescribeTableOutput
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
+		if err := timeDynamoRequest(ctx, "DynamoDB.DescribeTable", m.cfg.tableLabel(desc.name), func(_ context.Context) error {
 			var err error
 			out, err = m.cfg.DynamoDB.DescribeTable(&dynamodb.DescribeTableInput{
 				TableName: aws.String(desc.name),
@@ -307,7 +389,7 @@ func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []ta
 		}
 
 		log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
+		if err := timeDynamoRequest(ctx, "DynamoDB.DescribeTable", m.cfg.tableLabel(desc.name), func(_ context.Context) error {
 			_, err := m.cfg.DynamoDB.UpdateTable(&dynamodb.UpdateTableInput{
 				TableName: aws.String(desc.name),
 				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
@@ -322,3 +404,26 @@ func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []ta
 	}
 	return nil
 }
+
+func (m *DynamoTableManager) deleteTables(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	deleter, ok := m.cfg.DynamoDB.(tableDeleter)
+	if !ok {
+		log.Warnf("Not deleting %d tables past the retention period: index client can't delete tables", len(names))
+		return nil
+	}
+	for _, name := range names {
+		log.Infof("Deleting table %s, past the retention period", name)
+		if err := timeDynamoRequest(ctx, "DynamoDB.DeleteTable", m.cfg.tableLabel(name), func(_ context.Context) error {
+			_, err := deleter.DeleteTable(&dynamodb.DeleteTableInput{
+				TableName: aws.String(name),
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
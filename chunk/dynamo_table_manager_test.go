@@ -1,11 +1,13 @@
 package chunk
 
 import (
+	"fmt"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/weaveworks/common/mtime"
 	"golang.org/x/net/context"
@@ -34,6 +36,7 @@ func TestDynamoTableManager(t *testing.T) {
 		},
 
 		CreationGracePeriod:        gracePeriod,
+		InactiveGracePeriod:        gracePeriod,
 		MaxChunkAge:                maxChunkAge,
 		ProvisionedWriteThroughput: write,
 		ProvisionedReadThroughput:  read,
@@ -138,7 +141,103 @@ func TestDynamoTableManager(t *testing.T) {
 	)
 }
 
-func expectTables(t *testing.T, dynamo DynamoDBClient, expected []tableDescription) {
+func TestDynamoTableManagerRetention(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	const (
+		leadTime        = time.Hour
+		retentionPeriod = 2 * tablePeriod
+	)
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		DynamoDB: dynamoDB,
+
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          tablePrefix,
+			TablePeriod:          tablePeriod,
+			PeriodicTableStartAt: time.Unix(0, 0),
+		},
+
+		CreationGracePeriod:        leadTime,
+		InactiveGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		RetentionPeriod:            retentionPeriod,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mtime.NowReset()
+
+	test := func(name string, tm time.Time, expected []tableDescription) {
+		t.Run(name, func(t *testing.T) {
+			mtime.NowForce(tm)
+			if err := tableManager.syncTables(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			expectTables(t, dynamoDB, expected)
+		})
+	}
+
+	// The next table is made the lead time before it is needed.
+	test(
+		"Lead time before the second table",
+		time.Unix(0, 0).Add(tablePeriod-leadTime),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// The first table keeps its write throughput until the inactive grace
+	// period past the max chunk age after it ends.
+	end := time.Unix(0, 0).Add(tablePeriod)
+	test(
+		"Before the first table is inactive",
+		end.Add(maxChunkAge+gracePeriod-time.Second),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+	test(
+		"First table inactive",
+		end.Add(maxChunkAge+gracePeriod),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// Tables are deleted once their chunks are past the retention period.
+	expired := end.Add(maxChunkAge + gracePeriod + retentionPeriod)
+	test(
+		"Before the first table expires",
+		expired.Add(-time.Second),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+	test(
+		"First table expired",
+		expired,
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: minWriteCapacity},
+			{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+}
+
+func expectTables(t *testing.T, dynamo IndexClient, expected []tableDescription) {
 	tables := []string{}
 	if err := dynamo.ListTablesPages(&dynamodb.ListTablesInput{}, func(resp *dynamodb.ListTablesOutput, _ bool) bool {
 		for _, s := range resp.TableNames {
@@ -177,3 +276,45 @@ func expectTables(t *testing.T, dynamo DynamoDBClient, expected []tableDescripti
 		}
 	}
 }
+
+func TestTableLabel(t *testing.T) {
+	mtime.NowForce(time.Unix(0, 0).Add(10 * 7 * 24 * time.Hour))
+	defer mtime.NowReset()
+
+	cfg := PeriodicTableConfig{
+		UsePeriodicTables: true,
+		TablePrefix:       "cortex_",
+		TablePeriod:       7 * 24 * time.Hour,
+	}
+	for _, tc := range []struct {
+		table, want string
+	}{
+		{"cortex", "cortex"},
+		{"cortex_11", "cortex_11"},
+		{"cortex_10", "cortex_10"},
+		{"cortex_7", "cortex_7"},
+		{"cortex_6", "cortex_old"},
+		{"cortex_foo", "cortex_foo"},
+	} {
+		if have := cfg.tableLabel(tc.table); have != tc.want {
+			t.Errorf("tableLabel(%q) = %q, want %q", tc.table, have, tc.want)
+		}
+	}
+}
+
+func TestDynamoStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "200"},
+		{awserr.New(provisionedThroughputExceededException, "", nil), "throttled"},
+		{awserr.NewRequestFailure(awserr.New("ValidationException", "", nil), 400, ""), "4xx"},
+		{awserr.NewRequestFailure(awserr.New("InternalServerError", "", nil), 500, ""), "5xx"},
+		{fmt.Errorf("other"), "500"},
+	} {
+		if have := dynamoStatusCode(tc.err); have != tc.want {
+			t.Errorf("dynamoStatusCode(%v) = %q, want %q", tc.err, have, tc.want)
+		}
+	}
+}
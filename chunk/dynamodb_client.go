@@ -3,6 +3,7 @@ package chunk
 import (
 	"math/rand"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,8 +12,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/weaveworks/scope/common/instrument"
+	"github.com/weaveworks/common/mtime"
 	"golang.org/x/net/context"
 )
 
@@ -33,6 +36,15 @@ const (
 	dynamoMaxBatchSize = 25
 
 	provisionedThroughputExceededException = "ProvisionedThroughputExceededException"
+	throttlingException                    = "ThrottlingException"
+	resourceNotFoundException              = "ResourceNotFoundException"
+
+	// Periodic tables older than this many periods are collapsed into a
+	// single table label, to bound the cardinality of per-table metrics.
+	tableMetricsRecentPeriods = 3
+	oldTablesSuffix           = "old"
+	noTable                   = "none"
+	multipleTables            = "multiple"
 )
 
 var (
@@ -44,7 +56,7 @@ var (
 		// DynamoDB latency seems to range from a few ms to a few sec and is
 		// important.  So use 8 buckets from 64us to 8s.
 		Buckets: prometheus.ExponentialBuckets(0.000128, 4, 8),
-	}, []string{"operation", "status_code"})
+	}, []string{"operation", "status_code", "table"})
 	dynamoConsumedCapacity = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_consumed_capacity_total",
@@ -54,7 +66,7 @@ var (
 		Namespace: "cortex",
 		Name:      "dynamo_failures_total",
 		Help:      "The total number of errors while storing chunks to the chunk store.",
-	}, []string{errorReasonLabel})
+	}, []string{errorReasonLabel, "table"})
 	dynamoUnprocessedItems = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_unprocessed_items_total",
@@ -69,22 +81,83 @@ func init() {
 	prometheus.MustRegister(dynamoUnprocessedItems)
 }
 
-func recordDynamoError(err error) {
+func recordDynamoError(table string, err error) {
 	if awsErr, ok := err.(awserr.Error); ok {
-		dynamoFailures.WithLabelValues(awsErr.Code()).Add(float64(1))
+		dynamoFailures.WithLabelValues(awsErr.Code(), table).Add(float64(1))
 	} else {
-		dynamoFailures.WithLabelValues(otherError).Add(float64(1))
+		dynamoFailures.WithLabelValues(otherError, table).Add(float64(1))
 	}
 }
 
-// DynamoDBClient is a client for DynamoDB
-type DynamoDBClient interface {
+// timeDynamoRequest runs f, recording its duration by operation, table and
+// status.  It emits an OpenTracing span like instrument.TimeRequestHistogram.
+func timeDynamoRequest(ctx context.Context, operation, table string, f func(context.Context) error) error {
+	sp, newCtx := opentracing.StartSpanFromContext(ctx, operation)
+	ext.SpanKindRPCClient.Set(sp)
+	startTime := time.Now()
+
+	err := f(newCtx)
+
+	if err != nil {
+		ext.Error.Set(sp, true)
+	}
+	sp.Finish()
+	dynamoRequestDuration.WithLabelValues(operation, dynamoStatusCode(err), table).Observe(time.Now().Sub(startTime).Seconds())
+	return err
+}
+
+// dynamoStatusCode classifies errors from DynamoDB, distinguishing
+// throttling from other client errors.
+func dynamoStatusCode(err error) string {
+	if err == nil {
+		return "200"
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case provisionedThroughputExceededException, throttlingException:
+			return "throttled"
+		}
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() / 100 {
+		case 4:
+			return "4xx"
+		case 5:
+			return "5xx"
+		}
+	}
+	return "500"
+}
+
+// tableLabel returns the table label to use in metrics for the given table.
+// Periodic tables more than tableMetricsRecentPeriods old are collapsed into
+// a single label.
+func (cfg PeriodicTableConfig) tableLabel(table string) string {
+	if !cfg.UsePeriodicTables || cfg.TablePeriod <= 0 || !strings.HasPrefix(table, cfg.TablePrefix) {
+		return table
+	}
+	period, err := strconv.ParseInt(strings.TrimPrefix(table, cfg.TablePrefix), 10, 64)
+	if err != nil {
+		return table
+	}
+	current := mtime.Now().Unix() / int64(cfg.TablePeriod/time.Second)
+	if period < current-tableMetricsRecentPeriods {
+		return cfg.TablePrefix + oldTablesSuffix
+	}
+	return table
+}
+
+// IndexClient is a client for the index: tables of items with a hash and
+// range key.  It has the DynamoDB API, which other backends implement; see
+// NewIndexClient.  Any IndexClient can be used with any ObjectClient.
+type IndexClient interface {
 	ListTablesPages(*dynamodb.ListTablesInput, func(p *dynamodb.ListTablesOutput, lastPage bool) (shouldContinue bool)) error
 	CreateTable(*dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error)
 	DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error)
 	UpdateTable(*dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error)
 
 	BatchWriteItem(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+	PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
 	QueryRequest(*dynamodb.QueryInput) (req dynamoRequest, output *dynamodb.QueryOutput)
 }
 
@@ -97,12 +170,34 @@ type dynamoRequest interface {
 	Error() error
 }
 
-// NewDynamoDBClient makes a new DynamoDBClient
-func NewDynamoDBClient(dynamoDBURL string) (DynamoDBClient, string, error) {
+// NewIndexClient makes a new IndexClient.  postgres:// URLs give a
+// client storing the index in a SQL database; see NewSQLIndexClient.
+// cassandra:// URLs give a client storing it in a Cassandra keyspace; see
+// NewCassandraIndexClient.  bigtable:// URLs give a client storing it in
+// Google Cloud Bigtable; see NewBigtableIndexClient.  file:// URLs give a
+// client storing it in a local LevelDB database; see NewLevelDBIndexClient.
+// inmemory://table URLs give a client keeping it in memory; see
+// NewMemoryIndexClient.
+func NewIndexClient(dynamoDBURL string) (IndexClient, string, error) {
 	url, err := url.Parse(dynamoDBURL)
 	if err != nil {
 		return nil, "", err
 	}
+	if url.Scheme == "postgres" || url.Scheme == "postgresql" {
+		return NewSQLIndexClient(dynamoDBURL)
+	}
+	if url.Scheme == "cassandra" {
+		return NewCassandraIndexClient(dynamoDBURL)
+	}
+	if url.Scheme == "bigtable" {
+		return NewBigtableIndexClient(dynamoDBURL)
+	}
+	if url.Scheme == "file" {
+		return NewLevelDBIndexClient(dynamoDBURL)
+	}
+	if url.Scheme == "inmemory" {
+		return NewMemoryIndexClient(), url.Host, nil
+	}
 
 	dynamoDBConfig, err := awsConfigFromURL(url)
 	if err != nil {
@@ -147,13 +242,29 @@ func (d dynamoRequestAdapter) Error() error {
 }
 
 type dynamoDBBackoffClient struct {
-	client DynamoDBClient
+	client IndexClient
+	tables PeriodicTableConfig
 }
 
-func newDynamoDBBackoffClient(client DynamoDBClient) *dynamoDBBackoffClient {
+func newDynamoDBBackoffClient(client IndexClient, tables PeriodicTableConfig) *dynamoDBBackoffClient {
 	return &dynamoDBBackoffClient{
 		client: client,
+		tables: tables,
+	}
+}
+
+// batchTableLabel returns the table label for a batch write, which may span
+// tables.
+func (c *dynamoDBBackoffClient) batchTableLabel(reqs map[string][]*dynamodb.WriteRequest) string {
+	label := noTable
+	for table := range reqs {
+		tableLabel := c.tables.tableLabel(table)
+		if label != noTable && label != tableLabel {
+			return multipleTables
+		}
+		label = tableLabel
 	}
+	return label
 }
 
 // batchWriteDynamo writes many requests to dynamo in a single batch.
@@ -205,7 +316,8 @@ func (c *dynamoDBBackoffClient) batchWriteDynamo(ctx context.Context, reqs map[s
 		fillReq(outstanding, reqs)
 
 		var resp *dynamodb.BatchWriteItemOutput
-		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.BatchWriteItem", dynamoRequestDuration, func(_ context.Context) error {
+		tableLabel := c.batchTableLabel(reqs)
+		err := timeDynamoRequest(ctx, "DynamoDB.BatchWriteItem", tableLabel, func(_ context.Context) error {
 			var err error
 			resp, err = c.client.BatchWriteItem(&dynamodb.BatchWriteItemInput{
 				RequestItems:           reqs,
@@ -219,7 +331,7 @@ func (c *dynamoDBBackoffClient) batchWriteDynamo(ctx context.Context, reqs map[s
 		}
 
 		if err != nil {
-			recordDynamoError(err)
+			recordDynamoError(tableLabel, err)
 		}
 
 		// If there are unprocessed items, backoff and retry those items.
@@ -252,10 +364,11 @@ func (c *dynamoDBBackoffClient) batchWriteDynamo(ctx context.Context, reqs map[s
 
 func (c *dynamoDBBackoffClient) queryPages(ctx context.Context, input *dynamodb.QueryInput, callback func(resp interface{}, lastPage bool) (shouldContinue bool)) error {
 	request, _ := c.client.QueryRequest(input)
+	tableLabel := c.tables.tableLabel(*input.TableName)
 	backoff := minBackoff
 
 	for page := request; page != nil; page = page.NextPage() {
-		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.QueryPages", dynamoRequestDuration, func(_ context.Context) error {
+		err := timeDynamoRequest(ctx, "DynamoDB.QueryPages", tableLabel, func(_ context.Context) error {
 			return page.Send()
 		})
 
@@ -265,7 +378,7 @@ func (c *dynamoDBBackoffClient) queryPages(ctx context.Context, input *dynamodb.
 		}
 
 		if err != nil {
-			recordDynamoError(err)
+			recordDynamoError(tableLabel, err)
 
 			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException {
 				time.Sleep(backoff)
@@ -116,6 +116,18 @@ func (m *MockDynamoDB) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.
 	return &dynamodb.UpdateTableOutput{}, nil
 }
 
+func (m *MockDynamoDB) DeleteTable(input *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.tables[*input.TableName]; !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	delete(m.tables, *input.TableName)
+
+	return &dynamodb.DeleteTableOutput{}, nil
+}
+
 func (m *MockDynamoDB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -142,28 +154,69 @@ func (m *MockDynamoDB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dyn
 				continue
 			}
 
-			hashValue := *writeRequest.PutRequest.Item[table.hashKey].S
-			rangeValue := writeRequest.PutRequest.Item[table.rangeKey].B
-			log.Printf("Write %s/%x", hashValue, rangeValue)
-
-			items := table.items[hashValue]
-
-			// insert in order
-			i := sort.Search(len(items), func(i int) bool {
-				return bytes.Compare(items[i][table.rangeKey].B, rangeValue) >= 0
-			})
-			if i >= len(items) || !bytes.Equal(items[i][table.rangeKey].B, rangeValue) {
-				items = append(items, nil)
-				copy(items[i+1:], items[i:])
+			if writeRequest.DeleteRequest != nil {
+				table.delete(writeRequest.DeleteRequest.Key)
+				continue
 			}
-			items[i] = writeRequest.PutRequest.Item
-
-			table.items[hashValue] = items
+			table.put(writeRequest.PutRequest.Item)
 		}
 	}
 	return resp, nil
 }
 
+// PutItem only supports the condition that the item doesn't exist.
+func (m *MockDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	table, ok := m.tables[*input.TableName]
+	if !ok {
+		return nil, fmt.Errorf("table not found")
+	}
+	if input.ConditionExpression != nil {
+		if *input.ConditionExpression != fmt.Sprintf("attribute_not_exists(%s)", table.hashKey) {
+			panic(fmt.Sprintf("%s not supported", *input.ConditionExpression))
+		}
+		if _, ok := table.find(input.Item); ok {
+			return nil, awserr.New(conditionalCheckFailedException, "", nil)
+		}
+	}
+	table.put(input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// find returns the position of item in the table, or where it would go.
+func (t *mockDynamoDBTable) find(item mockDynamoDBItem) (int, bool) {
+	items := t.items[*item[t.hashKey].S]
+	rangeValue := item[t.rangeKey].B
+	i := sort.Search(len(items), func(i int) bool {
+		return bytes.Compare(items[i][t.rangeKey].B, rangeValue) >= 0
+	})
+	return i, i < len(items) && bytes.Equal(items[i][t.rangeKey].B, rangeValue)
+}
+
+func (t *mockDynamoDBTable) put(item mockDynamoDBItem) {
+	hashValue := *item[t.hashKey].S
+	log.Printf("Write %s/%x", hashValue, item[t.rangeKey].B)
+
+	// insert in order
+	items := t.items[hashValue]
+	i, ok := t.find(item)
+	if !ok {
+		items = append(items, nil)
+		copy(items[i+1:], items[i:])
+	}
+	items[i] = item
+	t.items[hashValue] = items
+}
+
+func (t *mockDynamoDBTable) delete(key mockDynamoDBItem) {
+	hashValue := *key[t.hashKey].S
+	if i, ok := t.find(key); ok {
+		t.items[hashValue] = append(t.items[hashValue][:i], t.items[hashValue][i+1:]...)
+	}
+}
+
 func (m *MockDynamoDB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -208,6 +261,13 @@ func (m *MockDynamoDB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput,
 			return &dynamodb.QueryOutput{}, nil
 		}
 		found = items[i:j]
+	} else if *rangeKeyCondition.ComparisonOperator == dynamodb.ComparisonOperatorEq {
+		if i, ok := table.find(mockDynamoDBItem{
+			table.hashKey:  hashValueCondition.AttributeValueList[0],
+			table.rangeKey: rangeKeyCondition.AttributeValueList[0],
+		}); ok {
+			found = items[i : i+1]
+		}
 	} else if *rangeKeyCondition.ComparisonOperator == dynamodb.ComparisonOperatorBeginsWith {
 		prefix := rangeKeyCondition.AttributeValueList[0].B
 
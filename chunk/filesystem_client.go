@@ -0,0 +1,328 @@
+package chunk
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Number of characters of an object's name naming each level of shard
+	// directories.
+	shardWidth = 2
+
+	// Prefix of files being written, which are ignored when listing.
+	tempFilePrefix = ".tmp-"
+
+	defaultMaxKeys = 1000
+)
+
+func init() {
+	RegisterObjectClient("file", newFilesystemClientFromURL)
+}
+
+// FilesystemConfig configures a filesystem ObjectClient.
+type FilesystemConfig struct {
+	// Directory holding a directory for each bucket.
+	Directory string
+
+	// Objects are stored in this many levels of directories named by
+	// successive characters of their names, so no directory gets too big.
+	// Chunk names start with the series fingerprint, so chunks are spread
+	// evenly.
+	ShardLevels int
+
+	// Sync files, and the directories they are written to, before
+	// completing writes, so writes survive a crash.
+	Fsync bool
+}
+
+// filesystemClient is an ObjectClient storing objects as files, for use with
+// local disks or network filesystems such as NFS.  Objects are written to a
+// temporary file which is renamed into place, so readers never see partial
+// objects.
+type filesystemClient struct {
+	cfg FilesystemConfig
+}
+
+// NewFilesystemClient makes a new filesystem ObjectClient.
+func NewFilesystemClient(cfg FilesystemConfig) ObjectClient {
+	return &filesystemClient{cfg: cfg}
+}
+
+// newFilesystemClientFromURL makes a filesystem ObjectClient from a URL like
+// file:///mnt/nfs/chunks?shard-levels=2&fsync=true.  The last element of
+// the path is the bucket.
+func newFilesystemClientFromURL(u *url.URL) (ObjectClient, string, error) {
+	cfg := FilesystemConfig{
+		Directory:   filepath.Dir(u.Path),
+		ShardLevels: 2,
+	}
+	query := u.Query()
+	if levels := query.Get("shard-levels"); levels != "" {
+		var err error
+		if cfg.ShardLevels, err = strconv.Atoi(levels); err != nil {
+			return nil, "", fmt.Errorf("invalid shard-levels: %v", err)
+		}
+	}
+	if fsync := query.Get("fsync"); fsync != "" {
+		var err error
+		if cfg.Fsync, err = strconv.ParseBool(fsync); err != nil {
+			return nil, "", fmt.Errorf("invalid fsync: %v", err)
+		}
+	}
+	return NewFilesystemClient(cfg), filepath.Base(u.Path), nil
+}
+
+// objectPath returns the path of the file holding an object.
+func (f *filesystemClient) objectPath(bucket, key string) (string, error) {
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return "", fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	dir, name := path.Split(key)
+	if name == "" || strings.HasPrefix(name, tempFilePrefix) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	for _, element := range strings.Split(dir, "/") {
+		if element == "." || element == ".." {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+
+	elements := []string{f.cfg.Directory, bucket, filepath.FromSlash(dir)}
+	for i := 0; i < f.shardLevels(name); i++ {
+		elements = append(elements, name[i*shardWidth:(i+1)*shardWidth])
+	}
+	return filepath.Join(append(elements, name)...), nil
+}
+
+// shardLevels returns the number of shard directories for an object name;
+// names too short for all the levels get fewer.
+func (f *filesystemClient) shardLevels(name string) int {
+	levels := len(name) / shardWidth
+	if levels > f.cfg.ShardLevels {
+		levels = f.cfg.ShardLevels
+	}
+	return levels
+}
+
+func (f *filesystemClient) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	filename, err := f.objectPath(aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tempFilePrefix+filepath.Base(filename))
+	if err != nil {
+		return nil, err
+	}
+	if err := f.writeFile(tmp, input.Body); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if f.cfg.Fsync {
+		if err := syncDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *filesystemClient) writeFile(file *os.File, body io.Reader) error {
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	if f.cfg.Fsync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (f *filesystemClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	filename, err := f.objectPath(aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, awserr.New("NoSuchKey", fmt.Sprintf("object %s not found", aws.StringValue(input.Key)), err)
+	} else if err != nil {
+		return nil, err
+	}
+	// Objects are replaced by renaming new files over them, so the open
+	// file's modification time and size identify its content.
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	if input.IfMatch != nil && *input.IfMatch != etag {
+		file.Close()
+		return nil, preconditionFailedError(aws.StringValue(input.Key))
+	}
+	if input.Range == nil {
+		return &s3.GetObjectOutput{Body: file, ETag: aws.String(etag)}, nil
+	}
+
+	start, end, hasEnd, err := parseByteRange(*input.Range)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	var body io.Reader = file
+	if hasEnd {
+		body = io.LimitReader(file, end-start+1)
+	}
+	return &s3.GetObjectOutput{
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{body, file},
+		ETag: aws.String(etag),
+	}, nil
+}
+
+// DeleteObject deletes an object's file.  Like S3, deleting an object which
+// doesn't exist succeeds.
+func (f *filesystemClient) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	filename, err := f.objectPath(aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjects lists objects by walking the directories under the prefix.
+func (f *filesystemClient) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	keys, err := f.keys(aws.StringValue(input.Bucket), aws.StringValue(input.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	return listKeys(keys, input), nil
+}
+
+// parseByteRange parses an HTTP Range header for a single range of bytes,
+// as used in a GetObjectInput.  The end is inclusive, and hasEnd is false
+// for a range to the end of the object.
+func parseByteRange(rng string) (start, end int64, hasEnd bool, err error) {
+	n, _ := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+	if n == 0 || (n == 2 && start > end) {
+		return 0, 0, false, fmt.Errorf("invalid range %q", rng)
+	}
+	return start, end, n == 2, nil
+}
+
+// listKeys returns the page of a listing of the sorted keys that S3 would
+// return for the input.
+func listKeys(keys []string, input *s3.ListObjectsInput) *s3.ListObjectsOutput {
+	prefix, delimiter, marker := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter), aws.StringValue(input.Marker)
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	output := &s3.ListObjectsOutput{IsTruncated: aws.Bool(false)}
+	var last string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		entry, isPrefix := key, false
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry, isPrefix = key[:len(prefix)+i+len(delimiter)], true
+			if entry == marker || entry == last {
+				continue
+			}
+		}
+		if len(output.Contents)+len(output.CommonPrefixes) == maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			break
+		}
+		if isPrefix {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+		} else {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(entry)})
+		}
+		last = entry
+	}
+	if delimiter != "" && last != "" {
+		output.NextMarker = aws.String(last)
+	}
+	return output
+}
+
+// keys returns the sorted keys of the objects in the directory holding
+// those with the given prefix.
+func (f *filesystemClient) keys(bucket, prefix string) ([]string, error) {
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	root := filepath.Join(f.cfg.Directory, bucket)
+	dir, _ := path.Split(prefix)
+
+	var keys []string
+	err := filepath.Walk(filepath.Join(root, filepath.FromSlash(dir)), func(filename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		elements := strings.Split(filepath.ToSlash(rel), "/")
+		name := elements[len(elements)-1]
+		dirElements := elements[:len(elements)-1-f.shardLevels(name)]
+		keys = append(keys, path.Join(append(dirElements, name)...))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
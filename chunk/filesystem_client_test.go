@@ -0,0 +1,93 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestFilesystemClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := NewFilesystemClient(FilesystemConfig{Directory: dir, ShardLevels: 2, Fsync: true})
+
+	keys := []string{"1/abcdef:1:2", "1/abcdef:3:4", "1/stats/a", "2/0123:1:2"}
+	for _, key := range keys {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("chunks"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("0123456789" + key)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Objects are sharded by the start of their names.
+	if _, err := os.Stat(filepath.Join(dir, "chunks", "1", "ab", "cd", "abcdef:1:2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "chunks", "1", "stats", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(key string, rng *string) string {
+		resp, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("chunks"), Key: aws.String(key), Range: rng})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	if got := get("1/abcdef:3:4", nil); got != "01234567891/abcdef:3:4" {
+		t.Fatalf("unexpected object %q", got)
+	}
+	if got := get("1/abcdef:3:4", aws.String("bytes=2-4")); got != "234" {
+		t.Fatalf("unexpected range %q", got)
+	}
+	if got := get("1/abcdef:3:4", aws.String("bytes=15-")); got != "def:3:4" {
+		t.Fatalf("unexpected range %q", got)
+	}
+	if _, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("chunks"), Key: aws.String("1/missing")}); err == nil {
+		t.Fatal("expected error getting missing object")
+	}
+	if _, err := client.PutObject(&s3.PutObjectInput{Bucket: aws.String("chunks"), Key: aws.String("../escape"), Body: bytes.NewReader(nil)}); err == nil {
+		t.Fatal("expected error putting object outside bucket")
+	}
+
+	list := func(input *s3.ListObjectsInput) (contents, prefixes []string) {
+		input.Bucket = aws.String("chunks")
+		output, err := client.ListObjects(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range output.Contents {
+			contents = append(contents, *object.Key)
+		}
+		for _, prefix := range output.CommonPrefixes {
+			prefixes = append(prefixes, *prefix.Prefix)
+		}
+		return contents, prefixes
+	}
+	if _, prefixes := list(&s3.ListObjectsInput{Delimiter: aws.String("/")}); !reflect.DeepEqual(prefixes, []string{"1/", "2/"}) {
+		t.Fatalf("unexpected users %v", prefixes)
+	}
+	if contents, _ := list(&s3.ListObjectsInput{Prefix: aws.String("1/")}); !reflect.DeepEqual(contents, keys[:3]) {
+		t.Fatalf("unexpected objects %v", contents)
+	}
+	if contents, _ := list(&s3.ListObjectsInput{Prefix: aws.String("1/"), Marker: aws.String(keys[0]), MaxKeys: aws.Int64(1)}); !reflect.DeepEqual(contents, keys[1:2]) {
+		t.Fatalf("unexpected page %v", contents)
+	}
+}
@@ -0,0 +1,184 @@
+package chunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsEndpoint = "https://www.googleapis.com"
+	gcsScope    = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// gcsClient is an ObjectClient storing objects in Google Cloud Storage, using
+// its JSON API.  Listings are paginated with GCS page tokens, which are
+// returned as NextMarker, so the Marker of a ListObjectsInput must be the
+// NextMarker of the previous page.
+type gcsClient struct {
+	client   *http.Client
+	endpoint string
+}
+
+func init() {
+	RegisterObjectClient("gs", newGCSClientFromURL)
+	RegisterObjectClient("gcs", newGCSClientFromURL)
+}
+
+// NewGCSClient makes a new ObjectClient for Google Cloud Storage,
+// authenticating with the application default credentials (eg the GKE
+// node's service account).
+func NewGCSClient() (ObjectClient, error) {
+	client, err := google.DefaultClient(context.Background(), gcsScope)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsClient{client: client, endpoint: gcsEndpoint}, nil
+}
+
+// newGCSClientFromURL makes a GCS client from a URL like gs://bucket.
+func newGCSClientFromURL(u *url.URL) (ObjectClient, string, error) {
+	client, err := NewGCSClient()
+	return client, u.Host, err
+}
+
+func (g *gcsClient) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", g.endpoint, url.QueryEscape(aws.StringValue(input.Bucket)), url.Values{
+		"uploadType": {"media"},
+		"name":       {aws.StringValue(input.Key)},
+	}.Encode())
+	req, err := http.NewRequest("POST", u, input.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := g.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &s3.PutObjectOutput{}, nil
+}
+
+// GetObject fetches an object.  Its generation is returned as its ETag, and
+// an IfMatch is a generation to match.
+func (g *gcsClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	params := url.Values{"alt": {"media"}}
+	if input.IfMatch != nil {
+		params.Set("ifGenerationMatch", *input.IfMatch)
+	}
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?%s", g.endpoint, url.QueryEscape(aws.StringValue(input.Bucket)), url.QueryEscape(aws.StringValue(input.Key)), params.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if input.Range != nil {
+		req.Header.Set("Range", *input.Range)
+	}
+	resp, err := g.do(req)
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.GetObjectOutput{Body: resp.Body}
+	if generation := resp.Header.Get("X-Goog-Generation"); generation != "" {
+		output.ETag = aws.String(generation)
+	}
+	return output, nil
+}
+
+// DeleteObject deletes an object.  Like S3, deleting an object which doesn't
+// exist succeeds.
+func (g *gcsClient) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", g.endpoint, url.QueryEscape(aws.StringValue(input.Bucket)), url.QueryEscape(aws.StringValue(input.Key)))
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.do(req)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+		return &s3.DeleteObjectOutput{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+type gcsListResponse struct {
+	Items []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	Prefixes      []string `json:"prefixes"`
+	NextPageToken string   `json:"nextPageToken"`
+}
+
+func (g *gcsClient) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	params := url.Values{}
+	if input.Prefix != nil {
+		params.Set("prefix", *input.Prefix)
+	}
+	if input.Delimiter != nil {
+		params.Set("delimiter", *input.Delimiter)
+	}
+	if input.Marker != nil {
+		params.Set("pageToken", *input.Marker)
+	}
+	if input.MaxKeys != nil {
+		params.Set("maxResults", fmt.Sprint(*input.MaxKeys))
+	}
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", g.endpoint, url.QueryEscape(aws.StringValue(input.Bucket)), params.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list gcsListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	output := &s3.ListObjectsOutput{IsTruncated: aws.Bool(list.NextPageToken != "")}
+	for _, item := range list.Items {
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(item.Name)})
+	}
+	for _, prefix := range list.Prefixes {
+		output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(prefix)})
+	}
+	if list.NextPageToken != "" {
+		output.NextMarker = aws.String(list.NextPageToken)
+	}
+	return output, nil
+}
+
+// do sends a request, turning error responses into errors like those from
+// S3, so they are classified and reported the same way.
+func (g *gcsClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	code := "RequestError"
+	if resp.StatusCode == http.StatusNotFound {
+		code = "NoSuchKey"
+	} else if resp.StatusCode == http.StatusPreconditionFailed {
+		code = "PreconditionFailed"
+	}
+	return nil, awserr.NewRequestFailure(awserr.New(code, fmt.Sprintf("GCS %s %s: %s", req.Method, req.URL.Path, body), nil), resp.StatusCode, "")
+}
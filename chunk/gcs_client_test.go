@@ -0,0 +1,117 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeGCS serves the parts of the GCS JSON API used by gcsClient, for a
+// single bucket.  Listings return one key per page.
+func fakeGCS(t *testing.T) *httptest.Server {
+	objects := map[string][]byte{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+			objects[r.FormValue("name")], _ = ioutil.ReadAll(r.Body)
+
+		case r.Method == "GET" && r.URL.Path == "/storage/v1/b/bucket/o":
+			var keys []string
+			for key := range objects {
+				if strings.HasPrefix(key, r.FormValue("prefix")) && key > r.FormValue("pageToken") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			resp := gcsListResponse{}
+			if len(keys) > 0 {
+				resp.Items = append(resp.Items, struct {
+					Name string `json:"name"`
+				}{keys[0]})
+			}
+			if len(keys) > 1 {
+				resp.NextPageToken = keys[0]
+			}
+			json.NewEncoder(w).Encode(resp)
+
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+			buf, ok := objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			var start, end int
+			if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 {
+				buf = buf[start : end+1]
+			}
+			w.Write(buf)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestGCSClient(t *testing.T) {
+	server := fakeGCS(t)
+	defer server.Close()
+	client := &gcsClient{client: http.DefaultClient, endpoint: server.URL}
+
+	keys := []string{"1/a:1:2", "1/b:1:2", "2/c:1:2"}
+	for _, key := range keys {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("data " + key)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("1/b:1:2"), Range: aws.String("bytes=0-3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(buf) != "data" {
+		t.Fatalf("unexpected object %q", buf)
+	}
+
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("1/missing")})
+	if awsErr, ok := err.(awserr.RequestFailure); !ok || awsErr.Code() != "NoSuchKey" || awsErr.StatusCode() != http.StatusNotFound {
+		t.Fatalf("expected NoSuchKey, got %v", err)
+	}
+
+	// Page through the user's objects, as AWSStore.listObjects does.
+	var listed []string
+	input := &s3.ListObjectsInput{Bucket: aws.String("bucket"), Prefix: aws.String("1/")}
+	for {
+		output, err := client.ListObjects(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range output.Contents {
+			listed = append(listed, *object.Key)
+		}
+		if !*output.IsTruncated {
+			break
+		}
+		input.Marker = output.NextMarker
+	}
+	if !reflect.DeepEqual(listed, keys[:2]) {
+		t.Fatalf("unexpected objects %v", listed)
+	}
+}
@@ -0,0 +1,194 @@
+package chunk
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Number of recent request latencies the hedging delay is computed from.
+	hedgingLatencySamples = 1000
+	// Requests aren't hedged until this many latencies have been observed,
+	// and the delay is recomputed after every this many.
+	hedgingMinSamples = 100
+)
+
+var hedgedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_hedged_requests_total",
+	Help:      "Requests outliving the hedging delay, by operation and outcome: whether the hedged request or the original won, or no hedged request was sent because of the rate limit.",
+}, []string{"operation", "outcome"})
+
+func init() {
+	prometheus.MustRegister(hedgedRequests)
+}
+
+// HedgingConfig configures hedged requests: requests which haven't
+// completed within a quantile of recent latencies are sent again, and the
+// first response is used.
+type HedgingConfig struct {
+	// Quantile of recent latencies after which to hedge, eg 0.9.  If zero,
+	// requests aren't hedged.
+	Quantile float64
+	// Maximum number of hedged requests per second, so hedging doesn't
+	// double the load when everything is slow.
+	MaxPerSecond float64
+}
+
+type hedger struct {
+	operation string
+	cfg       HedgingConfig
+	latencies latencyTracker
+	budget    tokenBucket
+}
+
+func newHedger(operation string, cfg HedgingConfig) *hedger {
+	burst := cfg.MaxPerSecond
+	if burst < 1 {
+		burst = 1
+	}
+	return &hedger{
+		operation: operation,
+		cfg:       cfg,
+		latencies: latencyTracker{quantile: cfg.Quantile},
+		budget:    tokenBucket{rate: cfg.MaxPerSecond, burst: burst},
+	}
+}
+
+type hedgedResult struct {
+	value  interface{}
+	err    error
+	hedged bool
+}
+
+// do calls f, calling it again if it takes longer than the hedging delay,
+// and returns the first successful result.  f is told whether it is the
+// hedged call.
+func (h *hedger) do(f func(hedged bool) (interface{}, error)) (interface{}, error) {
+	if h.cfg.Quantile <= 0 {
+		return f(false)
+	}
+
+	results := make(chan hedgedResult, 2)
+	attempt := func(hedged bool) {
+		start := time.Now()
+		value, err := f(hedged)
+		if err == nil {
+			h.latencies.observe(time.Since(start))
+		}
+		results <- hedgedResult{value, err, hedged}
+	}
+	go attempt(false)
+
+	delay := h.latencies.get()
+	if delay <= 0 {
+		result := <-results
+		return result.value, result.err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result.value, result.err
+	case <-timer.C:
+	}
+
+	if !h.budget.take(time.Now()) {
+		hedgedRequests.WithLabelValues(h.operation, "rate_limited").Inc()
+		result := <-results
+		return result.value, result.err
+	}
+	go attempt(true)
+
+	// Use the first success, or the last error if both fail.
+	var result hedgedResult
+	for i := 0; i < 2; i++ {
+		result = <-results
+		if result.err == nil {
+			break
+		}
+	}
+	if result.err == nil {
+		if result.hedged {
+			hedgedRequests.WithLabelValues(h.operation, "hedge_won").Inc()
+		} else {
+			hedgedRequests.WithLabelValues(h.operation, "original_won").Inc()
+		}
+	}
+	return result.value, result.err
+}
+
+// latencyTracker keeps a quantile of recent request latencies.
+type latencyTracker struct {
+	quantile float64
+
+	mtx     sync.Mutex
+	samples []time.Duration
+	next    int
+	pending int
+	value   time.Duration
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(t.samples) < hedgingLatencySamples {
+		t.samples = append(t.samples, d)
+	} else {
+		t.samples[t.next] = d
+		t.next = (t.next + 1) % hedgingLatencySamples
+	}
+
+	t.pending++
+	if t.pending < hedgingMinSamples {
+		return
+	}
+	t.pending = 0
+	sorted := append([]time.Duration{}, t.samples...)
+	sort.Sort(durations(sorted))
+	t.value = sorted[int(t.quantile*float64(len(sorted)-1))]
+}
+
+// get returns the quantile, or zero if too few latencies have been observed.
+func (t *latencyTracker) get() time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.value
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+
+// tokenBucket is a rate limiter allowing bursts of up to burst events.
+type tokenBucket struct {
+	rate, burst float64
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,115 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestHedger(t *testing.T) {
+	h := newHedger("test", HedgingConfig{Quantile: 0.9, MaxPerSecond: 1})
+
+	// Requests aren't hedged until enough latencies have been observed.
+	for i := 0; i < hedgingMinSamples; i++ {
+		if _, err := h.do(func(bool) (interface{}, error) { return nil, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delay := h.latencies.get(); delay <= 0 || delay > 10*time.Millisecond {
+		t.Fatalf("unexpected hedging delay %s", delay)
+	}
+
+	// A slow request is hedged, and the hedged request's response used.
+	slowThenFast := func(hedged bool) (interface{}, error) {
+		if !hedged {
+			time.Sleep(time.Second)
+			return []byte("slow"), nil
+		}
+		return []byte("fast"), nil
+	}
+	start := time.Now()
+	buf, err := h.do(slowThenFast)
+	if err != nil || string(buf.([]byte)) != "fast" {
+		t.Fatalf("expected hedged response, got %q (%v)", buf, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedged request took %s", elapsed)
+	}
+
+	// The rate limit allows no more hedged requests for now.
+	buf, err = h.do(slowThenFast)
+	if err != nil || string(buf.([]byte)) != "slow" {
+		t.Fatalf("expected original response, got %q (%v)", buf, err)
+	}
+}
+
+func TestHedgerErrors(t *testing.T) {
+	h := newHedger("test", HedgingConfig{Quantile: 0.5, MaxPerSecond: 100})
+	for i := 0; i < hedgingMinSamples; i++ {
+		h.do(func(bool) (interface{}, error) { return nil, nil })
+	}
+
+	// When the hedged request fails, the original's response is used.
+	buf, err := h.do(func(hedged bool) (interface{}, error) {
+		if !hedged {
+			time.Sleep(100 * time.Millisecond)
+			return []byte("original"), nil
+		}
+		return nil, fmt.Errorf("hedged request failed")
+	})
+	if err != nil || string(buf.([]byte)) != "original" {
+		t.Fatalf("expected original response, got %q (%v)", buf, err)
+	}
+}
+
+// slowIndexClient is slow to serve eventually consistent queries.
+type slowIndexClient struct {
+	*MockDynamoDB
+}
+
+func (s slowIndexClient) QueryRequest(input *dynamodb.QueryInput) (dynamoRequest, *dynamodb.QueryOutput) {
+	if !aws.BoolValue(input.ConsistentRead) {
+		time.Sleep(time.Second)
+	}
+	return s.MockDynamoDB.QueryRequest(input)
+}
+
+func TestQueryHedging(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:     slowIndexClient{dynamoDB},
+		S3:           NewMockS3(),
+		QueryHedging: HedgingConfig{Quantile: 0.9, MaxPerSecond: 100},
+	})
+	for i := 0; i < hedgingMinSamples; i++ {
+		store.queryHedger.latencies.observe(time.Millisecond)
+	}
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	if err := store.Put(ctx, []Chunk{newTestChunk(t, now, 10)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hedged query is a consistent read, which answers quickly.
+	start := time.Now()
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(chunks))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedged query took %s", elapsed)
+	}
+}
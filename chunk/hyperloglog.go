@@ -0,0 +1,98 @@
+package chunk
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// With 2^12 registers the standard error is about 1.6%, and a sketch is
+	// 4KB.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+
+	hllVersion = 1
+)
+
+// hyperLogLog is a sketch estimating the number of distinct series it has
+// seen.  See "HyperLogLog: the analysis of a near-optimal cardinality
+// estimation algorithm", Flajolet et al.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+// insert adds a series to the sketch.
+func (h *hyperLogLog) insert(fp model.Fingerprint) {
+	x := mix64(uint64(fp))
+	idx := x >> (64 - hllPrecision)
+	rho := uint8(1)
+	for w := x << hllPrecision; w&(1<<63) == 0 && rho <= 64-hllPrecision; w <<= 1 {
+		rho++
+	}
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+}
+
+// merge adds all the series seen by other to the sketch.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// count estimates the number of distinct series seen.
+func (h *hyperLogLog) count() uint64 {
+	const m = float64(hllRegisters)
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Use linear counting for small cardinalities, where it is more accurate.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func (h *hyperLogLog) encode() []byte {
+	buf := make([]byte, 1+hllRegisters)
+	buf[0] = hllVersion
+	copy(buf[1:], h.registers[:])
+	return buf
+}
+
+func (h *hyperLogLog) decode(buf []byte) error {
+	if len(buf) != 1+hllRegisters || buf[0] != hllVersion {
+		return fmt.Errorf("invalid sketch")
+	}
+	copy(h.registers[:], buf[1:])
+	return nil
+}
+
+// mix64 is the finalizer from MurmurHash3, used to spread the bits of the
+// fingerprint evenly.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,55 @@
+package chunk
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.insert(model.Fingerprint(i))
+			// Duplicates shouldn't change the count.
+			h.insert(model.Fingerprint(i))
+		}
+		if err := within(h.count(), n); err != nil {
+			t.Errorf("%d series: %v", n, err)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b := newHyperLogLog(), newHyperLogLog()
+	for i := 0; i < 6000; i++ {
+		a.insert(model.Fingerprint(i))
+	}
+	for i := 4000; i < 10000; i++ {
+		b.insert(model.Fingerprint(i))
+	}
+	a.merge(b)
+	if err := within(a.count(), 10000); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newHyperLogLog()
+	if err := c.decode(a.encode()); err != nil {
+		t.Fatal(err)
+	}
+	if a.count() != c.count() {
+		t.Fatalf("decoded sketch differs: %d != %d", c.count(), a.count())
+	}
+	if err := c.decode([]byte{hllVersion}); err == nil {
+		t.Fatal("expected error decoding truncated sketch")
+	}
+}
+
+func within(have uint64, want int) error {
+	if math.Abs(float64(have)-float64(want)) > 0.05*float64(want)+1 {
+		return fmt.Errorf("estimate %d, want %d", have, want)
+	}
+	return nil
+}
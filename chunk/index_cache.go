@@ -0,0 +1,149 @@
+package chunk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+)
+
+var indexCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "index_cache_requests_total",
+	Help:      "Index lookups by how the index cache served them: hit, stale (served while being refreshed) or miss.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(indexCacheRequests)
+}
+
+// IndexCacheConfig configures the in-process cache of index lookups.
+type IndexCacheConfig struct {
+	// How long a lookup's result is served without being refreshed.  If
+	// zero, lookups aren't cached.
+	Validity time.Duration
+
+	// How long after it stops being valid a result may still be served,
+	// while a single background lookup refreshes it.  Dashboards refreshing
+	// on the same tick then don't all miss the cache, and query the index,
+	// at once.
+	MaxStaleness time.Duration
+
+	// The most results kept; beyond it, arbitrary ones are evicted.  If
+	// zero, there is no limit.
+	MaxEntries int
+}
+
+// indexCache caches index lookups' results by key.  Concurrent lookups of
+// the same key which miss share a single lookup, and stale results are
+// refreshed by a single lookup in the background.
+type indexCache struct {
+	cfg IndexCacheConfig
+
+	mtx      sync.Mutex
+	entries  map[string]*indexCacheEntry
+	inflight map[string]*indexCacheLookup
+}
+
+type indexCacheEntry struct {
+	chunkSet ByID
+	fetched  time.Time
+}
+
+// indexCacheLookup is a lookup in progress; done is closed once chunkSet and
+// err are set.
+type indexCacheLookup struct {
+	done     chan struct{}
+	chunkSet ByID
+	err      error
+}
+
+func newIndexCache(cfg IndexCacheConfig) *indexCache {
+	return &indexCache{
+		cfg:      cfg,
+		entries:  map[string]*indexCacheEntry{},
+		inflight: map[string]*indexCacheLookup{},
+	}
+}
+
+// get returns the result of lookup for key, from the cache if it is there
+// and not too stale.  The returned ByID belongs to the caller.
+func (c *indexCache) get(ctx context.Context, key string, lookup func(context.Context) (ByID, error)) (ByID, error) {
+	now := mtime.Now()
+	c.mtx.Lock()
+	if entry, ok := c.entries[key]; ok {
+		age := now.Sub(entry.fetched)
+		if age < c.cfg.Validity {
+			c.mtx.Unlock()
+			indexCacheRequests.WithLabelValues("hit").Inc()
+			return copyChunkSet(entry.chunkSet), nil
+		}
+		if age < c.cfg.Validity+c.cfg.MaxStaleness {
+			if _, ok := c.inflight[key]; !ok {
+				// The query this refresh is for may finish first, so the
+				// refresh mustn't be cancelled with it.
+				c.startLookup(context.Background(), key, lookup)
+			}
+			c.mtx.Unlock()
+			indexCacheRequests.WithLabelValues("stale").Inc()
+			return copyChunkSet(entry.chunkSet), nil
+		}
+	}
+	l, ok := c.inflight[key]
+	if !ok {
+		l = c.startLookup(ctx, key, lookup)
+	}
+	c.mtx.Unlock()
+	indexCacheRequests.WithLabelValues("miss").Inc()
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return copyChunkSet(l.chunkSet), nil
+}
+
+// startLookup runs lookup for key in the background, caching its result if
+// it succeeds.  Errors are logged by the lookup itself.  c.mtx must be held.
+func (c *indexCache) startLookup(ctx context.Context, key string, lookup func(context.Context) (ByID, error)) *indexCacheLookup {
+	l := &indexCacheLookup{done: make(chan struct{})}
+	c.inflight[key] = l
+	go func() {
+		fetched := mtime.Now()
+		l.chunkSet, l.err = lookup(ctx)
+
+		c.mtx.Lock()
+		delete(c.inflight, key)
+		if l.err == nil {
+			c.put(key, &indexCacheEntry{chunkSet: l.chunkSet, fetched: fetched})
+		}
+		c.mtx.Unlock()
+		close(l.done)
+	}()
+	return l
+}
+
+// put adds entry to the cache, evicting another if it is full.  c.mtx must
+// be held.
+func (c *indexCache) put(key string, entry *indexCacheEntry) {
+	if _, ok := c.entries[key]; !ok && c.cfg.MaxEntries > 0 && len(c.entries) >= c.cfg.MaxEntries {
+		for evict := range c.entries {
+			delete(c.entries, evict)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+func copyChunkSet(chunkSet ByID) ByID {
+	if chunkSet == nil {
+		return nil
+	}
+	return append(make(ByID, 0, len(chunkSet)), chunkSet...)
+}
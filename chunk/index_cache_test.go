@@ -0,0 +1,90 @@
+package chunk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+)
+
+func TestIndexCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	ctx := context.Background()
+	cache := newIndexCache(IndexCacheConfig{Validity: time.Minute, MaxStaleness: time.Minute})
+
+	var (
+		mtx     sync.Mutex
+		lookups int
+		release = make(chan struct{})
+	)
+	lookup := func(context.Context) (ByID, error) {
+		<-release
+		mtx.Lock()
+		defer mtx.Unlock()
+		lookups++
+		return ByID{{ID: string(rune('a' + lookups - 1))}}, nil
+	}
+	get := func() ByID {
+		chunkSet, err := cache.get(ctx, "key", lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chunkSet
+	}
+
+	// Concurrent misses share one lookup.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if chunkSet := get(); len(chunkSet) != 1 || chunkSet[0].ID != "a" {
+				t.Errorf("unexpected result %v", chunkSet)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if lookups != 1 {
+		t.Fatalf("expected 1 lookup, got %d", lookups)
+	}
+
+	// Fresh results are served from the cache.
+	mtime.NowForce(now.Add(30 * time.Second))
+	if chunkSet := get(); chunkSet[0].ID != "a" || lookups != 1 {
+		t.Fatalf("expected a cache hit, got %v after %d lookups", chunkSet, lookups)
+	}
+
+	// Stale ones are served while being refreshed in the background.
+	mtime.NowForce(now.Add(90 * time.Second))
+	if chunkSet := get(); chunkSet[0].ID != "a" {
+		t.Fatalf("expected the stale result, got %v", chunkSet)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if chunkSet := get(); chunkSet[0].ID == "b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale result never refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mtx.Lock()
+	if lookups != 2 {
+		t.Fatalf("expected 2 lookups, got %d", lookups)
+	}
+	mtx.Unlock()
+
+	// Ones too stale to serve are looked up again.
+	mtime.NowForce(now.Add(time.Hour))
+	if chunkSet := get(); chunkSet[0].ID != "c" {
+		t.Fatalf("expected a fresh result, got %v", chunkSet)
+	}
+}
@@ -0,0 +1,174 @@
+package chunk
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+)
+
+// IndexRow is an index entry read by DebugIndexQuery.
+type IndexRow struct {
+	Table     string
+	HashValue string
+	Label     model.LabelName
+	Value     model.LabelValue
+	ChunkID   string
+
+	// Whether the entry matched the matcher it was read for.  Entries read
+	// for the metric name alone always match.
+	Matched bool
+}
+
+// IndexBucketResult is what DebugIndexQuery found in one index bucket.
+type IndexBucketResult struct {
+	Bucket string
+	Tables []string
+	Rows   []IndexRow
+
+	// Chunks found in the bucket matching all the matchers and overlapping
+	// the time range.
+	ChunkIDs []string
+}
+
+// IndexBucketer names the index buckets chunks are indexed in, for
+// debugging.
+type IndexBucketer interface {
+	IndexBuckets(from, through model.Time) []string
+}
+
+// IndexBuckets implements IndexBucketer, naming the buckets chunks between
+// from and through are indexed in, as table/bucket.
+func (c *AWSStore) IndexBuckets(from, through model.Time) []string {
+	var result []string
+	for _, bucket := range c.bigBuckets(from, through) {
+		result = append(result, bucket.tableName+"/"+bucket.bucket)
+	}
+	return result
+}
+
+// DebugIndexQuery looks up the chunks for userID matching matchers between
+// from and through as Get does, reading every index bucket directly from the
+// index, bypassing the query planner, bucket indexes, read replicas and
+// caches.  It returns the raw index entries read and the chunks found for
+// each bucket, to debug reports of missing data.
+func (c *AWSStore) DebugIndexQuery(ctx context.Context, userID string, from, through model.Time, matchers ...*metric.LabelMatcher) ([]IndexBucketResult, error) {
+	buckets := c.bigBuckets(from, through)
+	metricName, matchers, err := lookupName(buckets, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []IndexBucketResult
+	for _, bucket := range buckets {
+		result := IndexBucketResult{
+			Bucket: bucket.bucket,
+			Tables: []string{bucket.tableName},
+		}
+		if bucket.overlapTableName != "" {
+			result.Tables = append(result.Tables, bucket.overlapTableName)
+		}
+
+		// Chunks may be indexed in either table, so union what each matcher
+		// finds across tables and shards, and then intersect the results.
+		var found map[string]struct{}
+		for _, matcher := range queryMatchers(matchers) {
+			hashValues := bucket.hashValues(userID, matcherLookupName(metricName, matcher))
+			matched := map[string]struct{}{}
+			for _, table := range result.Tables {
+				for _, hashValue := range hashValues {
+					input := metricNameQueryInput(table, hashValue)
+					if matcher != nil {
+						if input, err = matcherQueryInput(table, hashValue, bucket.schema, matcher, from); err != nil {
+							return nil, err
+						}
+					}
+					rows, err := c.debugQuery(ctx, input, matcher)
+					if err != nil {
+						return nil, err
+					}
+					result.Rows = append(result.Rows, rows...)
+					for _, row := range rows {
+						if row.Matched {
+							matched[row.ChunkID] = struct{}{}
+						}
+					}
+				}
+			}
+			if found == nil {
+				found = matched
+				continue
+			}
+			for id := range found {
+				if _, ok := matched[id]; !ok {
+					delete(found, id)
+				}
+			}
+		}
+		for id := range found {
+			_, chunkFrom, chunkThrough, err := parseChunkID(id)
+			if err != nil {
+				return nil, err
+			}
+			if chunkThrough < from || through < chunkFrom {
+				continue
+			}
+			result.ChunkIDs = append(result.ChunkIDs, id)
+		}
+		sort.Strings(result.ChunkIDs)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// debugQuery reads all the index entries for a query, noting whether each
+// matches matcher.  A table which doesn't exist has no entries.
+func (c *AWSStore) debugQuery(ctx context.Context, input *dynamodb.QueryInput, matcher *metric.LabelMatcher) ([]IndexRow, error) {
+	var (
+		rows       []IndexRow
+		processErr error
+	)
+	err := c.dynamo.queryPages(ctx, input, func(resp interface{}, lastPage bool) bool {
+		for _, item := range resp.(*dynamodb.QueryOutput).Items {
+			rangeValue := item[rangeKey].B
+			if rangeValue == nil {
+				processErr = fmt.Errorf("invalid item: %v", item)
+				return false
+			}
+			label, value, chunkID, err := parseRangeValue(rangeValue)
+			if err != nil {
+				processErr = err
+				return false
+			}
+			rows = append(rows, IndexRow{
+				Table:     *input.TableName,
+				HashValue: *input.KeyConditions[hashKey].AttributeValueList[0].S,
+				Label:     label,
+				Value:     value,
+				ChunkID:   chunkID,
+				Matched:   matcher == nil || (label == matcher.Name && matcher.Match(value)),
+			})
+		}
+		return true
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == resourceNotFoundException {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rows, processErr
+}
+
+// queryMatchers returns the matchers to look up in each bucket: a nil
+// matcher, for the metric name alone, if there are none.
+func queryMatchers(matchers []*metric.LabelMatcher) []*metric.LabelMatcher {
+	if len(matchers) == 0 {
+		return []*metric.LabelMatcher{nil}
+	}
+	return matchers
+}
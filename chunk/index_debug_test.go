@@ -0,0 +1,57 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestDebugIndexQuery(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := user.WithID(context.Background(), "0")
+	// An hour into a day, so the query is in a single daily bucket.
+	now := model.TimeFromUnix(1000*secondsInDay + secondsInHour)
+	chunk := newTestChunk(t, now, 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		matchers []*metric.LabelMatcher
+		rows     int
+		matched  int
+		chunkIDs []string
+	}{
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")}, 1, 1, []string{chunk.ID}},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz")}, 1, 1, []string{chunk.ID}},
+		// The bar entry is read, but doesn't match.
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.RegexMatch, "bar", ".*x")}, 1, 0, nil},
+		// With a literal prefix, the bar entry isn't read at all.
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.RegexMatch, "bar", "x.*")}, 0, 0, nil},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar")}, 0, 0, nil},
+	} {
+		results, err := store.DebugIndexQuery(ctx, "0", now.Add(-time.Minute), now, tc.matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("%v: expected one bucket, got %v", tc.matchers, results)
+		}
+		result := results[0]
+		matched := 0
+		for _, row := range result.Rows {
+			if row.Matched {
+				matched++
+			}
+		}
+		if len(result.Rows) != tc.rows || matched != tc.matched || !reflect.DeepEqual(result.ChunkIDs, tc.chunkIDs) {
+			t.Errorf("%v: unexpected result %+v", tc.matchers, result)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package chunk
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+)
+
+// RebuildStats reports the outcome of RebuildIndex.
+type RebuildStats struct {
+	Chunks  int // Chunks whose index entries were written.
+	Skipped int // Chunks which couldn't be fetched or decoded, including legacy ones.
+}
+
+// ListUsers returns the IDs of all users with objects in S3.
+func (c *AWSStore) ListUsers(ctx context.Context) ([]string, error) {
+	var (
+		userIDs []string
+		seen    = map[string]struct{}{}
+		shards  []string
+	)
+	list := func(prefix string) error {
+		return c.listObjects(ctx, prefix, "/", func(output *s3.ListObjectsOutput) error {
+			for _, p := range output.CommonPrefixes {
+				name := strings.TrimPrefix(aws.StringValue(p.Prefix), prefix)
+				if prefix == "" && isShardPrefix(name) {
+					shards = append(shards, name)
+					continue
+				}
+				userID := strings.TrimSuffix(name, "/")
+				if _, ok := seen[userID]; !ok {
+					seen[userID] = struct{}{}
+					userIDs = append(userIDs, userID)
+				}
+			}
+			return nil
+		})
+	}
+	if err := list(""); err != nil {
+		return nil, err
+	}
+	for _, shard := range shards {
+		if err := list(shard); err != nil {
+			return nil, err
+		}
+	}
+	return userIDs, nil
+}
+
+// RebuildIndex regenerates the index entries for userID's chunks in S3 which
+// overlap from and through, for recovery after losing the index.  The
+// chunks' metadata is read from the chunks themselves, so chunks written
+// with their metadata in the index can't be decoded, and are skipped and
+// counted along with those which can't be fetched.  Chunks are fetched by at
+// most StoreConfig.FetchWorkers goroutines.  Writing index entries which
+// still exist is harmless.
+func (c *AWSStore) RebuildIndex(ctx context.Context, userID string, from, through model.Time) (RebuildStats, error) {
+	var stats RebuildStats
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		var chunks []Chunk
+		for _, l := range listed {
+			if l.through < from || through < l.from {
+				continue
+			}
+			chunks = append(chunks, Chunk{ID: l.id})
+		}
+
+		chunks, skipped := c.fetchChunksForRebuild(ctx, userID, chunks)
+		stats.Skipped += skipped
+		if len(chunks) == 0 {
+			return nil
+		}
+		if err := c.updateIndex(ctx, userID, chunks); err != nil {
+			return err
+		}
+		stats.Chunks += len(chunks)
+		log.Infof("Rebuilt index entries for %d chunks of user %s", stats.Chunks, userID)
+		return nil
+	})
+	return stats, err
+}
+
+// fetchChunksForRebuild fetches chunks whole, skipping (and counting) those
+// which can't be fetched or decoded, rather than failing.  As in
+// fetchChunkData, the chunks are queued for a bounded number of workers.
+func (c *AWSStore) fetchChunksForRebuild(ctx context.Context, userID string, chunks []Chunk) ([]Chunk, int) {
+	workers := len(chunks)
+	if c.cfg.FetchWorkers > 0 && c.cfg.FetchWorkers < workers {
+		workers = c.cfg.FetchWorkers
+	}
+	queue := make(chan Chunk, len(chunks))
+	for _, chunk := range chunks {
+		queue <- chunk
+	}
+	close(queue)
+
+	type result struct {
+		chunk Chunk
+		err   error
+	}
+	results := make(chan result)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for chunk := range queue {
+				fetched, err := c.fetchChunkData(ctx, userID, 0, model.Latest, []Chunk{chunk})
+				if err != nil {
+					results <- result{chunk, err}
+					continue
+				}
+				results <- result{fetched[0], nil}
+			}
+		}()
+	}
+
+	var (
+		fetched []Chunk
+		skipped int
+	)
+	for range chunks {
+		result := <-results
+		if result.err != nil {
+			log.Warnf("Skipping chunk %s: %v", result.chunk.ID, result.err)
+			skipped++
+			continue
+		}
+		fetched = append(fetched, result.chunk)
+	}
+	return fetched, skipped
+}
+
+// listObjects calls f with each page of the objects in the bucket under
+// prefix.
+func (c *AWSStore) listObjects(ctx context.Context, prefix, delimiter string, f func(*s3.ListObjectsOutput) error) error {
+	input := &s3.ListObjectsInput{
+		Bucket: aws.String(c.cfg.BucketName),
+		Prefix: aws.String(prefix),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	for {
+		var output *s3.ListObjectsOutput
+		err := instrument.TimeRequestHistogram(ctx, "S3.ListObjects", s3RequestDuration, func(_ context.Context) error {
+			var err error
+			output, err = c.cfg.S3.ListObjects(input)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := f(output); err != nil {
+			return err
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			return nil
+		}
+
+		// NextMarker is only returned when a delimiter is used.
+		marker := output.NextMarker
+		if marker == nil && len(output.Contents) > 0 {
+			marker = output.Contents[len(output.Contents)-1].Key
+		}
+		if marker == nil {
+			return nil
+		}
+		input.Marker = marker
+	}
+}
+
+// listedChunk is a chunk found by listing a user's chunks in S3.
+type listedChunk struct {
+	key           string
+	id            string
+	fp            model.Fingerprint
+	from, through model.Time
+	size          int64
+}
+
+// listChunkIDs lists userID's chunks in S3, under each of the prefixes they
+// may be stored under, calling f with the chunks in each page of the
+// listing.  Other objects, such as series sketches and the bucket index, are
+// skipped.
+func (c *AWSStore) listChunkIDs(ctx context.Context, userID string, f func([]listedChunk) error) error {
+	for _, prefix := range c.chunkPrefixes(userID) {
+		err := c.listObjects(ctx, prefix, "", func(output *s3.ListObjectsOutput) error {
+			chunks := make([]listedChunk, 0, len(output.Contents))
+			for _, object := range output.Contents {
+				key := aws.StringValue(object.Key)
+				chunkID := strings.TrimPrefix(key, prefix)
+				// Other objects, such as series sketches, have a / in their name.
+				if strings.Contains(chunkID, "/") {
+					continue
+				}
+				fp, from, through, err := parseChunkID(chunkID)
+				if err != nil {
+					log.Debugf("Skipping object %s: %v", key, err)
+					continue
+				}
+				chunks = append(chunks, listedChunk{
+					key:     key,
+					id:      chunkID,
+					fp:      fp,
+					from:    from,
+					through: through,
+					size:    aws.Int64Value(object.Size),
+				})
+			}
+			return f(chunks)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
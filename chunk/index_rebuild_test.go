@@ -0,0 +1,105 @@
+package chunk
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	s3sdk "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestRebuildIndex(t *testing.T) {
+	s3 := NewMockS3()
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB: dynamoDB,
+		S3:       s3,
+	})
+
+	now := model.Now()
+	var want []Chunk
+	for _, userID := range []string{"1", "2"} {
+		ctx := user.WithID(context.Background(), userID)
+		var chunks []Chunk
+		for i := 0; i < 5; i++ {
+			// Chunks are encoded in parallel, and encoding writes to the
+			// chunk's data, so each needs its own.
+			pcs, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+			chunks = append(chunks, NewChunk(
+				model.Fingerprint(i),
+				model.Metric{
+					model.MetricNameLabel: "foo",
+					"i":                   model.LabelValue(strconv.Itoa(i)),
+				},
+				pcs[0],
+				now.Add(-time.Hour),
+				now,
+			))
+		}
+		if err := store.Put(ctx, chunks); err != nil {
+			t.Fatal(err)
+		}
+		if userID == "1" {
+			want = chunks
+		}
+	}
+
+	// A legacy chunk, written without its metadata, can't be decoded.
+	pcs, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	legacy := NewChunk(model.Fingerprint(5), model.Metric{model.MetricNameLabel: "foo"}, pcs[0], now.Add(-time.Hour), now)
+	var buf bytes.Buffer
+	if err := legacy.Data.Marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.PutObject(&s3sdk.PutObjectInput{
+		Body:   bytes.NewReader(buf.Bytes()),
+		Bucket: aws.String(""),
+		Key:    aws.String(chunkName("1", legacy.ID)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the index.
+	dynamoDB = NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	store = NewAWSStore(StoreConfig{
+		DynamoDB:     dynamoDB,
+		S3:           s3,
+		FetchWorkers: 2,
+	})
+
+	ctx := context.Background()
+	userIDs, err := store.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"1", "2"}, userIDs) {
+		t.Fatalf("wrong users - %s", diff([]string{"1", "2"}, userIDs))
+	}
+
+	stats, err := store.RebuildIndex(ctx, "1", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RebuildStats{Chunks: 5, Skipped: 1}) {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	have, err := store.Get(user.WithID(ctx, "1"), now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Fatalf("wrong chunks - %s", diff(want, have))
+	}
+}
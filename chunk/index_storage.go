@@ -0,0 +1,357 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Default number of entries returned per page of a query to an
+// IndexStorage.
+const storagePageSize = 1000
+
+// IndexStorage is a store of index entries, with no knowledge of the
+// DynamoDB API, for backends which don't implement it themselves; see
+// NewStorageIndexClient.  Tables hold entries keyed by hash and range value,
+// and range values are ordered bytewise.
+type IndexStorage interface {
+	ListTables() ([]string, error)
+	TableExists(tableName string) (bool, error)
+	CreateTable(tableName string) error
+
+	// Write writes entries, replacing any with the same keys, and deletes
+	// the entries with the keys of deletes.  The writes need not be atomic.
+	Write(tableName string, entries, deletes []IndexEntry) error
+
+	// PutIfNotExists writes entry unless there is already one with its
+	// keys, returning whether it did.
+	PutIfNotExists(tableName string, entry IndexEntry) (bool, error)
+
+	// Query returns, in range order, up to query.Limit unexpired entries
+	// matching the query.
+	Query(query IndexQuery) ([]IndexEntry, error)
+}
+
+// IndexEntry is an entry in an IndexStorage table.
+type IndexEntry struct {
+	HashValue  string
+	RangeValue []byte
+
+	// The entry's other attributes, opaque to the storage.
+	Value []byte
+
+	// When the entry expires, in seconds since the epoch, or zero if it
+	// doesn't.  Storage may keep expired entries, but mustn't return them.
+	Expires int64
+}
+
+// IndexQuery selects the entries with a hash value and range values from
+// RangeStart (inclusive) to RangeEnd (exclusive).  A nil RangeStart or
+// RangeEnd leaves that end of the range unbounded.
+type IndexQuery struct {
+	TableName  string
+	HashValue  string
+	RangeStart []byte
+	RangeEnd   []byte
+	Limit      int
+}
+
+// newIndexEntry makes an entry from a DynamoDB item.  Attributes other than
+// the keys and expiry are JSON-encoded in its value.
+func newIndexEntry(item map[string]*dynamodb.AttributeValue) (IndexEntry, error) {
+	hashValue, rangeValue := item[hashKey], item[rangeKey]
+	if hashValue == nil || hashValue.S == nil || rangeValue == nil || rangeValue.B == nil {
+		return IndexEntry{}, fmt.Errorf("item must have hash and range values")
+	}
+	entry := IndexEntry{
+		HashValue:  *hashValue.S,
+		RangeValue: rangeValue.B,
+	}
+
+	attributes := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		switch name {
+		case hashKey, rangeKey:
+		case ttlKey:
+			expires, err := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+			if err != nil {
+				return IndexEntry{}, err
+			}
+			entry.Expires = expires
+		default:
+			attributes[name] = value
+		}
+	}
+	if len(attributes) > 0 {
+		value, err := json.Marshal(attributes)
+		if err != nil {
+			return IndexEntry{}, err
+		}
+		entry.Value = value
+	}
+	return entry, nil
+}
+
+// item returns the DynamoDB item for an entry, without its expiry.
+func (e IndexEntry) item() (map[string]*dynamodb.AttributeValue, error) {
+	item := map[string]*dynamodb.AttributeValue{}
+	if e.Value != nil {
+		if err := json.Unmarshal(e.Value, &item); err != nil {
+			return nil, err
+		}
+	}
+	item[hashKey] = &dynamodb.AttributeValue{S: aws.String(e.HashValue)}
+	item[rangeKey] = &dynamodb.AttributeValue{B: e.RangeValue}
+	return item, nil
+}
+
+// newIndexQuery translates the key conditions of a DynamoDB query to an
+// IndexQuery, for entries with range values after the given one.
+func newIndexQuery(input *dynamodb.QueryInput, after []byte, limit int) (IndexQuery, error) {
+	hashCondition, ok := input.KeyConditions[hashKey]
+	if !ok || *hashCondition.ComparisonOperator != dynamodb.ComparisonOperatorEq {
+		return IndexQuery{}, fmt.Errorf("must specify hash value equality condition")
+	}
+	query := IndexQuery{
+		TableName: *input.TableName,
+		HashValue: *hashCondition.AttributeValueList[0].S,
+		Limit:     limit,
+	}
+
+	if rangeCondition, ok := input.KeyConditions[rangeKey]; ok {
+		values := rangeCondition.AttributeValueList
+		switch *rangeCondition.ComparisonOperator {
+		case dynamodb.ComparisonOperatorEq:
+			query.RangeStart = values[0].B
+			query.RangeEnd = successor(values[0].B)
+		case dynamodb.ComparisonOperatorBetween:
+			query.RangeStart = values[0].B
+			query.RangeEnd = successor(values[1].B)
+		case dynamodb.ComparisonOperatorBeginsWith:
+			query.RangeStart = values[0].B
+			query.RangeEnd = prefixEnd(values[0].B)
+		default:
+			return IndexQuery{}, fmt.Errorf("comparison %s not supported", *rangeCondition.ComparisonOperator)
+		}
+	}
+	if after != nil {
+		if start := successor(after); query.RangeStart == nil || bytes.Compare(start, query.RangeStart) > 0 {
+			query.RangeStart = start
+		}
+	}
+	return query, nil
+}
+
+// successor returns the smallest value greater than value.
+func successor(value []byte) []byte {
+	return append(append([]byte{}, value...), 0)
+}
+
+// storageIndexClient is an IndexClient on an IndexStorage.  Storage has no
+// provisioned throughput; that requested by the table manager is
+// remembered, so it doesn't try to update it again.
+type storageIndexClient struct {
+	storage  IndexStorage
+	pageSize int
+
+	mtx        sync.Mutex
+	throughput map[string]*dynamodb.ProvisionedThroughput
+}
+
+// NewStorageIndexClient makes an IndexClient storing the index in storage.
+func NewStorageIndexClient(storage IndexStorage) IndexClient {
+	return &storageIndexClient{
+		storage:    storage,
+		pageSize:   storagePageSize,
+		throughput: map[string]*dynamodb.ProvisionedThroughput{},
+	}
+}
+
+func (c *storageIndexClient) ListTablesPages(_ *dynamodb.ListTablesInput, fn func(p *dynamodb.ListTablesOutput, lastPage bool) (shouldContinue bool)) error {
+	tableNames, err := c.storage.ListTables()
+	if err != nil {
+		return err
+	}
+	fn(&dynamodb.ListTablesOutput{TableNames: aws.StringSlice(tableNames)}, true)
+	return nil
+}
+
+func (c *storageIndexClient) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	if err := c.storage.CreateTable(*input.TableName); err != nil {
+		return nil, err
+	}
+	c.setThroughput(*input.TableName, input.ProvisionedThroughput)
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (c *storageIndexClient) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	exists, err := c.storage.TableExists(*input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, awserr.New(resourceNotFoundException, fmt.Sprintf("table %s not found", *input.TableName), nil)
+	}
+
+	c.mtx.Lock()
+	throughput, ok := c.throughput[*input.TableName]
+	c.mtx.Unlock()
+	if !ok {
+		throughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(0),
+			WriteCapacityUnits: aws.Int64(0),
+		}
+	}
+	return &dynamodb.DescribeTableOutput{
+		Table: &dynamodb.TableDescription{
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{
+				ReadCapacityUnits:  throughput.ReadCapacityUnits,
+				WriteCapacityUnits: throughput.WriteCapacityUnits,
+			},
+			TableStatus: aws.String(dynamodb.TableStatusActive),
+		},
+	}, nil
+}
+
+func (c *storageIndexClient) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	c.setThroughput(*input.TableName, input.ProvisionedThroughput)
+	return &dynamodb.UpdateTableOutput{}, nil
+}
+
+func (c *storageIndexClient) setThroughput(tableName string, throughput *dynamodb.ProvisionedThroughput) {
+	if throughput == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.throughput[tableName] = throughput
+}
+
+func (c *storageIndexClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	for tableName, writeRequests := range input.RequestItems {
+		var entries, deletes []IndexEntry
+		for _, writeRequest := range writeRequests {
+			if writeRequest.DeleteRequest != nil {
+				entry, err := newIndexEntry(writeRequest.DeleteRequest.Key)
+				if err != nil {
+					return nil, err
+				}
+				deletes = append(deletes, entry)
+				continue
+			}
+			entry, err := newIndexEntry(writeRequest.PutRequest.Item)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		if err := c.storage.Write(tableName, entries, deletes); err != nil {
+			return nil, err
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+// PutItem only supports the condition that the item doesn't exist.
+func (c *storageIndexClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	entry, err := newIndexEntry(input.Item)
+	if err != nil {
+		return nil, err
+	}
+	if input.ConditionExpression == nil {
+		if err := c.storage.Write(*input.TableName, []IndexEntry{entry}, nil); err != nil {
+			return nil, err
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}
+
+	if *input.ConditionExpression != fmt.Sprintf("attribute_not_exists(%s)", hashKey) {
+		return nil, fmt.Errorf("condition %s not supported", *input.ConditionExpression)
+	}
+	written, err := c.storage.PutIfNotExists(*input.TableName, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !written {
+		return nil, awserr.New(conditionalCheckFailedException, "item exists", nil)
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *storageIndexClient) QueryRequest(input *dynamodb.QueryInput) (dynamoRequest, *dynamodb.QueryOutput) {
+	req := &storageQueryRequest{
+		client: c,
+		input:  input,
+		output: &dynamodb.QueryOutput{},
+	}
+	return req, req.output
+}
+
+// storageQueryRequest is a page of a query.  Pages are read in range order,
+// each starting after the last range value of the previous one.
+type storageQueryRequest struct {
+	client *storageIndexClient
+	input  *dynamodb.QueryInput
+	after  []byte
+
+	output    *dynamodb.QueryOutput
+	lastRange []byte
+	more      bool
+	err       error
+}
+
+func (r *storageQueryRequest) NextPage() dynamoRequest {
+	if !r.more {
+		return nil
+	}
+	return &storageQueryRequest{
+		client: r.client,
+		input:  r.input,
+		after:  r.lastRange,
+		output: &dynamodb.QueryOutput{},
+	}
+}
+
+func (r *storageQueryRequest) HasNextPage() bool     { return r.more }
+func (r *storageQueryRequest) Data() interface{}     { return r.output }
+func (r *storageQueryRequest) OperationName() string { return "Query" }
+func (r *storageQueryRequest) Error() error          { return r.err }
+
+func (r *storageQueryRequest) Send() error {
+	r.err = r.send()
+	return r.err
+}
+
+func (r *storageQueryRequest) send() error {
+	limit := r.client.pageSize
+	if r.input.Limit != nil && int(*r.input.Limit) < limit {
+		limit = int(*r.input.Limit)
+	}
+	query, err := newIndexQuery(r.input, r.after, limit+1)
+	if err != nil {
+		return err
+	}
+	entries, err := r.client.storage.Query(query)
+	if err != nil {
+		return err
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		r.more = true
+	}
+	for _, entry := range entries {
+		item, err := entry.item()
+		if err != nil {
+			return err
+		}
+		r.output.Items = append(r.output.Items, item)
+		r.lastRange = entry.RangeValue
+	}
+	return nil
+}
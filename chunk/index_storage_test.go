@@ -0,0 +1,269 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// mapStorage is an IndexStorage keeping entries in memory, unsorted.
+type mapStorage struct {
+	tables map[string]map[string]IndexEntry
+}
+
+func newMapStorage() *mapStorage {
+	return &mapStorage{tables: map[string]map[string]IndexEntry{}}
+}
+
+func mapStorageKey(entry IndexEntry) string {
+	return entry.HashValue + "\x00" + string(entry.RangeValue)
+}
+
+func (s *mapStorage) ListTables() ([]string, error) {
+	var tableNames []string
+	for tableName := range s.tables {
+		tableNames = append(tableNames, tableName)
+	}
+	return tableNames, nil
+}
+
+func (s *mapStorage) TableExists(tableName string) (bool, error) {
+	_, ok := s.tables[tableName]
+	return ok, nil
+}
+
+func (s *mapStorage) CreateTable(tableName string) error {
+	if _, ok := s.tables[tableName]; !ok {
+		s.tables[tableName] = map[string]IndexEntry{}
+	}
+	return nil
+}
+
+func (s *mapStorage) table(tableName string) (map[string]IndexEntry, error) {
+	table, ok := s.tables[tableName]
+	if !ok {
+		return nil, fmt.Errorf("no table %s", tableName)
+	}
+	return table, nil
+}
+
+func (s *mapStorage) Write(tableName string, entries, deletes []IndexEntry) error {
+	table, err := s.table(tableName)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		table[mapStorageKey(entry)] = entry
+	}
+	for _, entry := range deletes {
+		delete(table, mapStorageKey(entry))
+	}
+	return nil
+}
+
+func (s *mapStorage) PutIfNotExists(tableName string, entry IndexEntry) (bool, error) {
+	table, err := s.table(tableName)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := table[mapStorageKey(entry)]; ok {
+		return false, nil
+	}
+	table[mapStorageKey(entry)] = entry
+	return true, nil
+}
+
+type byRangeValue []IndexEntry
+
+func (es byRangeValue) Len() int      { return len(es) }
+func (es byRangeValue) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es byRangeValue) Less(i, j int) bool {
+	return bytes.Compare(es[i].RangeValue, es[j].RangeValue) < 0
+}
+
+func (s *mapStorage) Query(query IndexQuery) ([]IndexEntry, error) {
+	table, err := s.table(query.TableName)
+	if err != nil {
+		return nil, err
+	}
+	var entries []IndexEntry
+	for _, entry := range table {
+		if entry.HashValue != query.HashValue ||
+			(query.RangeStart != nil && bytes.Compare(entry.RangeValue, query.RangeStart) < 0) ||
+			(query.RangeEnd != nil && bytes.Compare(entry.RangeValue, query.RangeEnd) >= 0) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Sort(byRangeValue(entries))
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entries, nil
+}
+
+func TestStorageChunkStore(t *testing.T) {
+	index := NewStorageIndexClient(newMapStorage())
+	setupDynamodb(t, index)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB: index,
+		S3:       NewMockS3(),
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+
+	chunks, err = store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestStorageConditionalPut(t *testing.T) {
+	storage := newMapStorage()
+	storage.CreateTable("table")
+	index := NewStorageIndexClient(storage)
+
+	put := func() error {
+		_, err := index.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String("table"),
+			Item: map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String("hash")},
+				rangeKey: {B: []byte("range")},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(h)"),
+		})
+		return err
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if awsErr, ok := put().(awserr.Error); !ok || awsErr.Code() != conditionalCheckFailedException {
+		t.Fatalf("expected conditional check failure, got %v", awsErr)
+	}
+}
+
+func TestStorageQueryPages(t *testing.T) {
+	storage := newMapStorage()
+	index := NewStorageIndexClient(storage).(*storageIndexClient)
+	index.pageSize = 2
+	storage.CreateTable("table")
+
+	var entries []IndexEntry
+	for _, rangeValue := range []string{"a", "a\x00", "ab", "abc", "b", "c"} {
+		entries = append(entries, IndexEntry{HashValue: "hash", RangeValue: []byte(rangeValue)})
+	}
+	entries = append(entries, IndexEntry{HashValue: "other", RangeValue: []byte("a")})
+	if err := storage.Write("table", entries, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rangeCondition *dynamodb.Condition
+		expected       []string
+	}{
+		{nil, []string{"a", "a\x00", "ab", "abc", "b", "c"}},
+		{
+			&dynamodb.Condition{
+				AttributeValueList: []*dynamodb.AttributeValue{{B: []byte("a")}},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq),
+			},
+			[]string{"a"},
+		},
+		{
+			&dynamodb.Condition{
+				AttributeValueList: []*dynamodb.AttributeValue{{B: []byte("a")}},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBeginsWith),
+			},
+			[]string{"a", "a\x00", "ab", "abc"},
+		},
+		{
+			&dynamodb.Condition{
+				AttributeValueList: []*dynamodb.AttributeValue{{B: []byte("a\x00")}, {B: []byte("b")}},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBetween),
+			},
+			[]string{"a\x00", "ab", "abc", "b"},
+		},
+	} {
+		input := &dynamodb.QueryInput{
+			TableName: aws.String("table"),
+			KeyConditions: map[string]*dynamodb.Condition{
+				hashKey: {
+					AttributeValueList: []*dynamodb.AttributeValue{{S: aws.String("hash")}},
+					ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq),
+				},
+			},
+		}
+		if tc.rangeCondition != nil {
+			input.KeyConditions[rangeKey] = tc.rangeCondition
+		}
+
+		var got []string
+		req, _ := index.QueryRequest(input)
+		for req != nil {
+			if err := req.Send(); err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range req.Data().(*dynamodb.QueryOutput).Items {
+				got = append(got, string(item[rangeKey].B))
+			}
+			req = req.NextPage()
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("expected %q, got %q", tc.expected, got)
+		}
+	}
+}
+
+func TestIndexEntryRoundTrip(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		hashKey:       {S: aws.String("userID:claim:1")},
+		rangeKey:      {B: []byte{0}},
+		claimStateKey: {S: aws.String(claimDone)},
+		ttlKey:        {N: aws.String("12345")},
+	}
+	entry, err := newIndexEntry(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Expires != 12345 {
+		t.Fatalf("unexpected expiry %d", entry.Expires)
+	}
+
+	// The expiry isn't returned; everything else is.
+	delete(item, ttlKey)
+	got, err := entry.item()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, item) {
+		t.Fatalf("expected %v, got %v", item, got)
+	}
+}
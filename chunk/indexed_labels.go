@@ -0,0 +1,65 @@
+package chunk
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// indexedLabelName is the name chunks with a value of an indexed label are
+// indexed under, in place of a metric name; see PeriodConfig.IndexedLabels.
+// Metric names can't contain "=", so it can't clash with one.
+func indexedLabelName(name model.LabelName, value model.LabelValue) model.LabelValue {
+	return model.LabelValue(name) + "=" + value
+}
+
+// indexes returns whether chunks in the bucket are also indexed by label.
+func (b bucketSpec) indexes(label model.LabelName) bool {
+	for _, indexed := range b.indexedLabels {
+		if indexed == label {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedLabelHashValues returns the hash values the index entries of the
+// series with metric m and fingerprint fp are written under in the bucket
+// for its indexed labels, besides the one for its metric name.
+func (b bucketSpec) indexedLabelHashValues(userID string, m model.Metric, fp model.Fingerprint) []string {
+	var hashValues []string
+	for _, label := range b.indexedLabels {
+		if value, ok := m[label]; ok {
+			hashValues = append(hashValues, b.seriesHashValue(userID, indexedLabelName(label, value), fp))
+		}
+	}
+	return hashValues
+}
+
+// extractIndexedLabel is extractMetricName for queries without a metric name
+// equality matcher: it finds an equality matcher on a label indexed in all
+// the buckets, and returns the name chunks are indexed under for it, and the
+// other matchers.  It returns false if there is none.
+func extractIndexedLabel(buckets []bucketSpec, matchers []*metric.LabelMatcher) (model.LabelValue, []*metric.LabelMatcher, bool) {
+	for i, matcher := range matchers {
+		// An empty value matches series without the label, which aren't
+		// indexed by it.
+		if matcher.Type != metric.Equal || matcher.Value == "" {
+			continue
+		}
+		indexed := true
+		for _, bucket := range buckets {
+			if !bucket.indexes(matcher.Name) {
+				indexed = false
+				break
+			}
+		}
+		if !indexed {
+			continue
+		}
+		rest := make([]*metric.LabelMatcher, 0, len(matchers)-1)
+		rest = append(rest, matchers[:i]...)
+		rest = append(rest, matchers[i+1:]...)
+		return indexedLabelName(matcher.Name, matcher.Value), rest, true
+	}
+	return "", nil, false
+}
@@ -0,0 +1,77 @@
+package chunk
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// Chunk keys are sharded, if StoreConfig.ChunkKeyShards is set, by
+// prefixing them with shardKeyPrefix and a shard number derived from a hash
+// of the unsharded key, so writes for one user spread across S3's key-range
+// partitions rather than all landing under the user ID.  Chunks written
+// before sharding was enabled are still read from their unsharded keys, but
+// the number of shards can't be changed, or sharding disabled, without
+// losing track of chunks written with it.
+const shardKeyPrefix = "shard-"
+
+// shardPrefix returns the key prefix for a shard.
+func shardPrefix(shard uint32) string {
+	return fmt.Sprintf("%s%02x/", shardKeyPrefix, shard)
+}
+
+// chunkKeys returns the keys a chunk may be stored under: the one to write
+// it to first, followed by the one it may have been written to before key
+// sharding was enabled.
+func (c *AWSStore) chunkKeys(userID, chunkID string) []string {
+	name := chunkName(userID, chunkID)
+	if c.cfg.ChunkKeyShards <= 0 {
+		return []string{name}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return []string{shardPrefix(h.Sum32()%uint32(c.cfg.ChunkKeyShards)) + name, name}
+}
+
+// chunkPrefixes returns the prefixes to list userID's chunks under.
+func (c *AWSStore) chunkPrefixes(userID string) []string {
+	prefixes := []string{userID + "/"}
+	for shard := 0; shard < c.cfg.ChunkKeyShards; shard++ {
+		prefixes = append(prefixes, shardPrefix(uint32(shard))+userID+"/")
+	}
+	return prefixes
+}
+
+// fetchChunkObject fetches a chunk object, or byteRange of it if non-nil,
+// from whichever of its keys it is stored under.  If ifMatch is non-nil the
+// fetch fails unless the object's ETag matches it.  It returns the object's
+// ETag, if the object client returns them.
+func (c *AWSStore) fetchChunkObject(ctx context.Context, userID, chunkID string, byteRange, ifMatch *string) ([]byte, *string, error) {
+	var err error
+	for _, key := range c.chunkKeys(userID, chunkID) {
+		var buf []byte
+		var etag *string
+		buf, etag, err = c.fetchObject(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(c.cfg.BucketName),
+			Key:     aws.String(key),
+			Range:   byteRange,
+			IfMatch: ifMatch,
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+			continue
+		}
+		return buf, etag, err
+	}
+	return nil, nil, err
+}
+
+// isShardPrefix returns whether a top-level prefix in the bucket holds a
+// shard of chunks, rather than a user's objects.
+func isShardPrefix(prefix string) bool {
+	return strings.HasPrefix(prefix, shardKeyPrefix)
+}
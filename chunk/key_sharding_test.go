@@ -0,0 +1,101 @@
+package chunk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestChunkKeySharding(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	oldChunk := newTestChunk(t, now.Add(-time.Minute), 10)
+	newChunk := newTestChunk(t, now, 10)
+
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	cfg := StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	}
+	if err := NewAWSStore(cfg).Put(ctx, []Chunk{oldChunk}); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChunkKeyShards = 16
+	store := NewAWSStore(cfg)
+	if err := store.Put(ctx, []Chunk{newChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for key := range objects.objects["chunks"] {
+		keys = append(keys, key)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 objects, got %v", keys)
+	}
+	sharded := store.chunkKeys("0", newChunk.ID)[0]
+	if !strings.HasPrefix(sharded, shardKeyPrefix) || !strings.HasSuffix(sharded, chunkName("0", newChunk.ID)) {
+		t.Fatalf("unexpected sharded key %s", sharded)
+	}
+	if _, ok := objects.objects["chunks"][sharded]; !ok {
+		t.Fatalf("chunk not written to %s: %v", sharded, keys)
+	}
+
+	// Chunks written with and without sharding can both be read.
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %v", chunks)
+	}
+
+	userIDs, err := store.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(userIDs, []string{"0"}) {
+		t.Fatalf("unexpected users %v", userIDs)
+	}
+
+	index, err := store.BuildBucketIndex(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, stats := range index.Buckets {
+		total += stats.Chunks
+	}
+	if total != 2 {
+		t.Fatalf("expected 2 chunks in bucket index, got %+v", index.Buckets)
+	}
+
+	// Listing finds the chunks under both keys, and skips other objects,
+	// such as the bucket index just written.
+	listed := map[string]string{}
+	err = store.listChunkIDs(ctx, "0", func(chunks []listedChunk) error {
+		for _, l := range chunks {
+			listed[l.id] = l.key
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		oldChunk.ID: chunkName("0", oldChunk.ID),
+		newChunk.ID: sharded,
+	}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("expected chunks %v, got %v", expected, listed)
+	}
+}
@@ -0,0 +1,142 @@
+package chunk
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// labelValuesName is the name chunks are indexed under for each of their
+// labels from IndexSchemaV4 on, in place of a metric name, with an entry
+// for the label's value, so the values of a label can be listed without
+// knowing which metrics have it.  Braces can't appear in metric or label
+// names, so it can't clash with either.
+func labelValuesName(label model.LabelName) model.LabelValue {
+	return "{" + model.LabelValue(label) + "}"
+}
+
+// labelNamesName is the name chunks are indexed under for their metric's
+// label names from IndexSchemaV4 on, with an entry with an empty value for
+// each label besides the metric name.
+func labelNamesName(metricName model.LabelValue) model.LabelValue {
+	return metricName + "{}"
+}
+
+// allLabelNamesName is the name chunks are indexed under for all their
+// label names from IndexSchemaV4 on, with an entry with an empty value for
+// each label, including the metric name.
+const allLabelNamesName = model.LabelValue("{}")
+
+// labelNameEntries returns whether index entries keyed by label name are
+// written under schema.
+func labelNameEntries(schema string) bool {
+	return schema == IndexSchemaV4 || schema == IndexSchemaV5 || schema == IndexSchemaV6
+}
+
+// labelNameHashValues returns the hash values the label name entries of the
+// series with metric m and fingerprint fp are written under in the bucket,
+// if any.
+func (b bucketSpec) labelNameHashValues(userID string, m model.Metric, fp model.Fingerprint) []string {
+	if !labelNameEntries(b.schema) {
+		return nil
+	}
+	hashValues := []string{
+		b.seriesHashValue(userID, labelNamesName(m[model.MetricNameLabel]), fp),
+		b.seriesHashValue(userID, allLabelNamesName, fp),
+	}
+	for label := range m {
+		hashValues = append(hashValues, b.seriesHashValue(userID, labelValuesName(label), fp))
+	}
+	return hashValues
+}
+
+// LabelValues implements Store.  Only buckets written with IndexSchemaV4 or
+// later have the entries to answer it, so older buckets contribute nothing.
+func (c *AWSStore) LabelValues(ctx context.Context, from, through model.Time, label model.LabelName) (model.LabelValues, error) {
+	values := map[model.LabelValue]struct{}{}
+	if err := c.readLabelNameEntries(ctx, from, through, labelValuesName(label), func(row IndexRow) {
+		values[row.Value] = struct{}{}
+	}); err != nil {
+		return nil, err
+	}
+
+	result := make(model.LabelValues, 0, len(values))
+	for value := range values {
+		result = append(result, value)
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// LabelNames implements Store.  As for LabelValues, only buckets from
+// IndexSchemaV4 on contribute.
+func (c *AWSStore) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	return c.readLabelNames(ctx, from, through, allLabelNamesName)
+}
+
+// LabelNamesForMetricName returns the names of the labels, besides the
+// metric name, on the user's chunks for metricName between from and
+// through, sorted.  As for LabelValues, only buckets from IndexSchemaV4 on
+// contribute.
+func (c *AWSStore) LabelNamesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue) (model.LabelNames, error) {
+	return c.readLabelNames(ctx, from, through, labelNamesName(metricName))
+}
+
+// readLabelNames returns the label names of the entries under name, sorted.
+func (c *AWSStore) readLabelNames(ctx context.Context, from, through model.Time, name model.LabelValue) (model.LabelNames, error) {
+	names := map[model.LabelName]struct{}{}
+	if err := c.readLabelNameEntries(ctx, from, through, name, func(row IndexRow) {
+		names[row.Label] = struct{}{}
+	}); err != nil {
+		return nil, err
+	}
+
+	result := make(model.LabelNames, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// readLabelNameEntries calls callback with each of the user's index entries
+// under name, in every table and shard of the buckets with label name
+// entries between from and through, for chunks overlapping the range.
+func (c *AWSStore) readLabelNameEntries(ctx context.Context, from, through model.Time, name model.LabelValue, callback func(IndexRow)) error {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range c.bigBuckets(from, through) {
+		if !labelNameEntries(bucket.schema) {
+			continue
+		}
+		tables := []string{bucket.tableName}
+		if bucket.overlapTableName != "" {
+			tables = append(tables, bucket.overlapTableName)
+		}
+		for _, table := range tables {
+			for _, hashValue := range bucket.hashValues(userID, name) {
+				rows, err := c.debugQuery(ctx, metricNameQueryInput(table, hashValue), nil)
+				if err != nil {
+					return err
+				}
+				for _, row := range rows {
+					_, chunkFrom, chunkThrough, err := parseChunkID(row.ChunkID)
+					if err != nil {
+						return err
+					}
+					if chunkThrough < from || through < chunkFrom {
+						continue
+					}
+					callback(row)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestLabelNameEntries(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV3, BucketSize: 24 * time.Hour, Shards: 2},
+			{From: now.Add(-48 * time.Hour), Schema: IndexSchemaV4, BucketSize: 24 * time.Hour, Shards: 2},
+		}},
+	})
+
+	var samples []*model.Sample
+	for _, m := range []model.Metric{
+		{model.MetricNameLabel: "foo", "job": "a", "instance": "1"},
+		{model.MetricNameLabel: "bar", "job": "b", "zone": "x"},
+		{model.MetricNameLabel: "foo", "job": "c"},
+	} {
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: now, Value: 1})
+	}
+	// Written before label name entries, so not listed.
+	samples = append(samples, &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "foo", "job": "d", "old": "y"},
+		Timestamp: now.Add(-72 * time.Hour),
+		Value:     1,
+	})
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	from := now.Add(-96 * time.Hour)
+	values, err := store.LabelValues(ctx, from, now, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (model.LabelValues{"a", "b", "c"}); !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+	values, err = store.LabelValues(ctx, from, now, model.MetricNameLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (model.LabelValues{"bar", "foo"}); !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+
+	// Chunks outside the range aren't listed.
+	values, err = store.LabelValues(ctx, now.Add(-96*time.Hour), now.Add(-90*time.Hour), "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("expected no values, got %v", values)
+	}
+
+	names, err := store.LabelNamesForMetricName(ctx, from, now, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (model.LabelNames{"instance", "job"}); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	names, err = store.LabelNames(ctx, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (model.LabelNames{model.MetricNameLabel, "instance", "job", "zone"}); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,275 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/weaveworks/common/mtime"
+)
+
+// Key prefixes in the LevelDB database.
+var (
+	leveldbTablePrefix = []byte("table\x00")
+	leveldbItemPrefix  = []byte("item\x00")
+)
+
+// leveldbIndexClient is an IndexClient storing the index in a local LevelDB
+// database, for development and single-process deployments.  Items are
+// keyed by table, hash and range value, so queries are range scans.
+// Tables needn't be created before use; CreateTable only records them so
+// they are listed.  Queries return all their results in a single page.
+type leveldbIndexClient struct {
+	db *leveldb.DB
+
+	// Serialises conditional writes.
+	mtx sync.Mutex
+}
+
+// NewLevelDBIndexClient makes an IndexClient storing the index in a LevelDB
+// database in the directory at the given file:// URL, which is created if
+// it doesn't exist.  The name of the table to use when not using periodic
+// tables is taken from the URL's "table" parameter.
+func NewLevelDBIndexClient(leveldbURL string) (IndexClient, string, error) {
+	u, err := url.Parse(leveldbURL)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := newLevelDBIndexClient(u.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, u.Query().Get("table"), nil
+}
+
+func newLevelDBIndexClient(directory string) (*leveldbIndexClient, error) {
+	db, err := leveldb.OpenFile(directory, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &leveldbIndexClient{db: db}, nil
+}
+
+func leveldbItemKey(table, hashValue string, rangeValue []byte) []byte {
+	key := append([]byte{}, leveldbItemPrefix...)
+	key = append(key, table...)
+	key = append(key, 0)
+	key = append(key, hashValue...)
+	key = append(key, 0)
+	return append(key, rangeValue...)
+}
+
+func (c *leveldbIndexClient) ListTablesPages(_ *dynamodb.ListTablesInput, fn func(p *dynamodb.ListTablesOutput, lastPage bool) (shouldContinue bool)) error {
+	var tableNames []*string
+	it := c.db.NewIterator(util.BytesPrefix(leveldbTablePrefix), nil)
+	defer it.Release()
+	for it.Next() {
+		tableNames = append(tableNames, aws.String(string(bytes.TrimPrefix(it.Key(), leveldbTablePrefix))))
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	fn(&dynamodb.ListTablesOutput{TableNames: tableNames}, true)
+	return nil
+}
+
+func (c *leveldbIndexClient) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	if err := c.putThroughput(*input.TableName, input.ProvisionedThroughput); err != nil {
+		return nil, err
+	}
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (c *leveldbIndexClient) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	buf, err := c.db.Get(append(leveldbTablePrefix, *input.TableName...), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, awserr.New(resourceNotFoundException, fmt.Sprintf("table %s not found", *input.TableName), nil)
+	} else if err != nil {
+		return nil, err
+	}
+	var throughput dynamodb.ProvisionedThroughput
+	if err := json.Unmarshal(buf, &throughput); err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{
+		Table: &dynamodb.TableDescription{
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{
+				ReadCapacityUnits:  throughput.ReadCapacityUnits,
+				WriteCapacityUnits: throughput.WriteCapacityUnits,
+			},
+			TableStatus: aws.String(dynamodb.TableStatusActive),
+		},
+	}, nil
+}
+
+func (c *leveldbIndexClient) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	if err := c.putThroughput(*input.TableName, input.ProvisionedThroughput); err != nil {
+		return nil, err
+	}
+	return &dynamodb.UpdateTableOutput{}, nil
+}
+
+// putThroughput records a table, with the provisioned throughput requested
+// for it so the table manager doesn't try to update it again.
+func (c *leveldbIndexClient) putThroughput(tableName string, throughput *dynamodb.ProvisionedThroughput) error {
+	if throughput == nil {
+		throughput = &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(0), WriteCapacityUnits: aws.Int64(0)}
+	}
+	buf, err := json.Marshal(throughput)
+	if err != nil {
+		return err
+	}
+	return c.db.Put(append(leveldbTablePrefix, tableName...), buf, nil)
+}
+
+func (c *leveldbIndexClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	batch := new(leveldb.Batch)
+	for tableName, writeRequests := range input.RequestItems {
+		for _, writeRequest := range writeRequests {
+			if writeRequest.DeleteRequest != nil {
+				key, _, err := leveldbItem(tableName, writeRequest.DeleteRequest.Key)
+				if err != nil {
+					return nil, err
+				}
+				batch.Delete(key)
+				continue
+			}
+			key, value, err := leveldbItem(tableName, writeRequest.PutRequest.Item)
+			if err != nil {
+				return nil, err
+			}
+			batch.Put(key, value)
+		}
+	}
+	if err := c.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+// PutItem only supports the condition that the item doesn't exist.
+func (c *leveldbIndexClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	key, value, err := leveldbItem(*input.TableName, input.Item)
+	if err != nil {
+		return nil, err
+	}
+	if input.ConditionExpression != nil {
+		if *input.ConditionExpression != fmt.Sprintf("attribute_not_exists(%s)", hashKey) {
+			return nil, fmt.Errorf("condition %s not supported", *input.ConditionExpression)
+		}
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if exists, err := c.db.Has(key, nil); err != nil {
+			return nil, err
+		} else if exists {
+			return nil, awserr.New(conditionalCheckFailedException, "item exists", nil)
+		}
+	}
+	if err := c.db.Put(key, value, nil); err != nil {
+		return nil, err
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// leveldbItem returns the key and value for an item: the value holds all
+// its attributes but the hash and range values, which are in the key.
+func leveldbItem(tableName string, item map[string]*dynamodb.AttributeValue) ([]byte, []byte, error) {
+	hashValue, rangeValue := item[hashKey], item[rangeKey]
+	if hashValue == nil || hashValue.S == nil || rangeValue == nil || rangeValue.B == nil {
+		return nil, nil, fmt.Errorf("item must have hash and range values")
+	}
+	attributes := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		if name != hashKey && name != rangeKey {
+			attributes[name] = value
+		}
+	}
+	value, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leveldbItemKey(tableName, *hashValue.S, rangeValue.B), value, nil
+}
+
+func (c *leveldbIndexClient) QueryRequest(input *dynamodb.QueryInput) (dynamoRequest, *dynamodb.QueryOutput) {
+	req := &leveldbQueryRequest{
+		client: c,
+		input:  input,
+		output: &dynamodb.QueryOutput{},
+	}
+	return req, req.output
+}
+
+func (c *leveldbIndexClient) query(input *dynamodb.QueryInput, output *dynamodb.QueryOutput) error {
+	hashCondition, ok := input.KeyConditions[hashKey]
+	if !ok || *hashCondition.ComparisonOperator != dynamodb.ComparisonOperatorEq {
+		return fmt.Errorf("must specify hash value equality condition")
+	}
+	hashValue := *hashCondition.AttributeValueList[0].S
+	prefix := leveldbItemKey(*input.TableName, hashValue, nil)
+
+	rng := util.BytesPrefix(prefix)
+	if rangeCondition, ok := input.KeyConditions[rangeKey]; ok {
+		values := rangeCondition.AttributeValueList
+		switch *rangeCondition.ComparisonOperator {
+		case dynamodb.ComparisonOperatorEq:
+			key := leveldbItemKey(*input.TableName, hashValue, values[0].B)
+			rng = &util.Range{Start: key, Limit: append(key[:len(key):len(key)], 0)}
+		case dynamodb.ComparisonOperatorBetween:
+			end := leveldbItemKey(*input.TableName, hashValue, values[1].B)
+			rng = &util.Range{Start: leveldbItemKey(*input.TableName, hashValue, values[0].B), Limit: append(end, 0)}
+		case dynamodb.ComparisonOperatorBeginsWith:
+			rng = util.BytesPrefix(leveldbItemKey(*input.TableName, hashValue, values[0].B))
+		default:
+			return fmt.Errorf("comparison %s not supported", *rangeCondition.ComparisonOperator)
+		}
+	}
+
+	now := mtime.Now().Unix()
+	it := c.db.NewIterator(rng, nil)
+	defer it.Release()
+	for it.Next() {
+		if input.Limit != nil && int64(len(output.Items)) >= *input.Limit {
+			break
+		}
+		item := map[string]*dynamodb.AttributeValue{}
+		if err := json.Unmarshal(it.Value(), &item); err != nil {
+			return err
+		}
+		if ttl, ok := item[ttlKey]; ok {
+			if expires, err := strconv.ParseInt(aws.StringValue(ttl.N), 10, 64); err == nil && expires <= now {
+				continue
+			}
+		}
+		item[hashKey] = &dynamodb.AttributeValue{S: aws.String(hashValue)}
+		item[rangeKey] = &dynamodb.AttributeValue{B: append([]byte{}, it.Key()[len(prefix):]...)}
+		output.Items = append(output.Items, item)
+	}
+	return it.Error()
+}
+
+type leveldbQueryRequest struct {
+	client *leveldbIndexClient
+	input  *dynamodb.QueryInput
+	output *dynamodb.QueryOutput
+	err    error
+}
+
+func (r *leveldbQueryRequest) NextPage() dynamoRequest { return nil }
+func (r *leveldbQueryRequest) HasNextPage() bool       { return false }
+func (r *leveldbQueryRequest) Data() interface{}       { return r.output }
+func (r *leveldbQueryRequest) OperationName() string   { return "Query" }
+func (r *leveldbQueryRequest) Error() error            { return r.err }
+
+func (r *leveldbQueryRequest) Send() error {
+	r.err = r.client.query(r.input, r.output)
+	return r.err
+}
@@ -0,0 +1,94 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestLevelDBChunkStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex-leveldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, tableName, err := NewIndexClient("file://" + filepath.Join(dir, "index") + "?table=cortex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tableName != "cortex" {
+		t.Fatalf("unexpected table name %q", tableName)
+	}
+	setupDynamodb(t, index)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:   index,
+		S3:         NewFilesystemClient(FilesystemConfig{Directory: filepath.Join(dir, "chunks")}),
+		BucketName: "chunks",
+		TableName:  tableName,
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+
+	chunks, err = store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestLevelDBConditionalPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex-leveldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, err := newLevelDBIndexClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func() error {
+		_, err := client.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String("table"),
+			Item: map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String("hash")},
+				rangeKey: {B: []byte("range")},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(h)"),
+		})
+		return err
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if awsErr, ok := put().(awserr.Error); !ok || awsErr.Code() != conditionalCheckFailedException {
+		t.Fatalf("expected conditional check failure, got %v", awsErr)
+	}
+}
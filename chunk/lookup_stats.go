@@ -0,0 +1,97 @@
+package chunk
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// BucketLookupStats describes the index lookups made in one bucket.
+type BucketLookupStats struct {
+	Bucket string `json:"bucket"`
+
+	// Index queries made, one per matcher looked up.
+	Lookups int `json:"lookups"`
+
+	// Chunks found, before filtering by time range and removing those
+	// already found in other buckets.
+	Chunks int `json:"chunks"`
+}
+
+// LookupStats collects the index lookups made by the chunk store's lookups
+// of queries' chunks, by bucket.  Buckets are looked up in parallel, so it
+// is safe for concurrent use.
+type LookupStats struct {
+	mtx     sync.Mutex
+	buckets map[string]*BucketLookupStats
+}
+
+// NewLookupStats makes a new LookupStats.
+func NewLookupStats() *LookupStats {
+	return &LookupStats{
+		buckets: map[string]*BucketLookupStats{},
+	}
+}
+
+func (s *LookupStats) add(bucket string, lookups, chunks int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats, ok := s.buckets[bucket]
+	if !ok {
+		stats = &BucketLookupStats{Bucket: bucket}
+		s.buckets[bucket] = stats
+	}
+	stats.Lookups += lookups
+	stats.Chunks += chunks
+}
+
+func (s *LookupStats) merge(other *LookupStats) {
+	for _, stats := range other.Buckets() {
+		s.add(stats.Bucket, stats.Lookups, stats.Chunks)
+	}
+}
+
+// Buckets returns the stats of each bucket, sorted by bucket.
+func (s *LookupStats) Buckets() []BucketLookupStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]BucketLookupStats, 0, len(s.buckets))
+	for _, stats := range s.buckets {
+		result = append(result, *stats)
+	}
+	sort.Sort(byBucket(result))
+	return result
+}
+
+// Lookups returns the total number of index queries made.
+func (s *LookupStats) Lookups() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	total := 0
+	for _, stats := range s.buckets {
+		total += stats.Lookups
+	}
+	return total
+}
+
+type lookupStatsKey int
+
+const queryLookupStatsKey lookupStatsKey = 0
+
+// WithLookupStats returns a context in which the chunk store adds the index
+// lookups it makes to stats, for reporting per-query stats.
+func WithLookupStats(ctx context.Context, stats *LookupStats) context.Context {
+	return context.WithValue(ctx, queryLookupStatsKey, stats)
+}
+
+func lookupStatsFromContext(ctx context.Context) *LookupStats {
+	stats, _ := ctx.Value(queryLookupStatsKey).(*LookupStats)
+	return stats
+}
+
+type byBucket []BucketLookupStats
+
+func (bs byBucket) Len() int           { return len(bs) }
+func (bs byBucket) Swap(i, j int)      { bs[i], bs[j] = bs[j], bs[i] }
+func (bs byBucket) Less(i, j int) bool { return bs[i].Bucket < bs[j].Bucket }
@@ -0,0 +1,98 @@
+package chunk
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestLookupStats(t *testing.T) {
+	stats := NewLookupStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stats.add(strconv.Itoa(i%2), 1, i)
+		}(i)
+	}
+	wg.Wait()
+
+	expected := []BucketLookupStats{
+		{Bucket: "0", Lookups: 5, Chunks: 0 + 2 + 4 + 6 + 8},
+		{Bucket: "1", Lookups: 5, Chunks: 1 + 3 + 5 + 7 + 9},
+	}
+	buckets := stats.Buckets()
+	if len(buckets) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, buckets)
+	}
+	for i := range expected {
+		if buckets[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, buckets)
+		}
+	}
+	if stats.Lookups() != 10 {
+		t.Fatalf("expected 10 lookups, got %d", stats.Lookups())
+	}
+}
+
+func TestWithLookupStats(t *testing.T) {
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	if _, err := Backfill(ctx, store, []*model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "job": "a"}, Timestamp: now.Add(-time.Minute), Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "job": "b"}, Timestamp: now.Add(-time.Minute), Value: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries without a collector in their context aren't counted.
+	get := func(ctx context.Context) ([]Chunk, error) {
+		return store.Get(ctx, now.Add(-time.Hour), now,
+			mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+			mustNewLabelMatcher(metric.Equal, "job", "a"),
+		)
+	}
+	if _, err := get(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := NewLookupStats()
+	chunks, err := get(WithLookupStats(ctx, stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(chunks))
+	}
+	buckets := stats.Buckets()
+	lookups, found := 0, 0
+	for _, bucket := range buckets {
+		lookups += bucket.Lookups
+		found += bucket.Chunks
+	}
+	if len(buckets) == 0 || lookups == 0 || lookups != stats.Lookups() || found != 1 {
+		t.Fatalf("unexpected stats %+v", buckets)
+	}
+
+	// Collectors add up the lookups of every query made with them.
+	if _, err := get(WithLookupStats(ctx, stats)); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Lookups() != 2*lookups {
+		t.Fatalf("expected %d lookups, got %d", 2*lookups, stats.Lookups())
+	}
+}
@@ -0,0 +1,132 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+const (
+	memoryBucketName = "chunks"
+	memoryTableName  = "index"
+)
+
+func init() {
+	RegisterObjectClient("inmemory", func(u *url.URL) (ObjectClient, string, error) {
+		return NewMemoryObjectClient(), u.Host, nil
+	})
+}
+
+// NewMemoryStore makes a chunk store keeping the index and chunks in
+// memory, for tests and for running a single process with no dependencies.
+// Everything is lost when the process exits.
+func NewMemoryStore() *AWSStore {
+	return NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: memoryBucketName,
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  memoryTableName,
+	})
+}
+
+// NewMemoryIndexClient makes an IndexClient keeping the index in memory.  It
+// is a LevelDB index client over in-memory storage.
+func NewMemoryIndexClient() IndexClient {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		// Opening fresh in-memory storage can't fail.
+		panic(err)
+	}
+	return &leveldbIndexClient{db: db}
+}
+
+// memoryObjectClient is an ObjectClient keeping objects in memory.
+type memoryObjectClient struct {
+	mtx     sync.RWMutex
+	objects map[string]map[string][]byte
+}
+
+// NewMemoryObjectClient makes an ObjectClient keeping objects in memory.
+func NewMemoryObjectClient() ObjectClient {
+	return &memoryObjectClient{
+		objects: map[string]map[string][]byte{},
+	}
+}
+
+func (m *memoryObjectClient) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	buf, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	bucket := aws.StringValue(input.Bucket)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.objects[bucket]; !ok {
+		m.objects[bucket] = map[string][]byte{}
+	}
+	m.objects[bucket][aws.StringValue(input.Key)] = buf
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *memoryObjectClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.mtx.RLock()
+	buf, ok := m.objects[aws.StringValue(input.Bucket)][aws.StringValue(input.Key)]
+	m.mtx.RUnlock()
+	if !ok {
+		return nil, awserr.New("NoSuchKey", fmt.Sprintf("object %s not found", aws.StringValue(input.Key)), nil)
+	}
+	etag := contentETag(buf)
+	if input.IfMatch != nil && *input.IfMatch != etag {
+		return nil, preconditionFailedError(aws.StringValue(input.Key))
+	}
+
+	if input.Range != nil {
+		start, end, hasEnd, err := parseByteRange(*input.Range)
+		if err != nil {
+			return nil, err
+		}
+		if !hasEnd || end >= int64(len(buf)) {
+			end = int64(len(buf)) - 1
+		}
+		if start > end {
+			return nil, fmt.Errorf("range %q not satisfiable", *input.Range)
+		}
+		buf = buf[start : end+1]
+	}
+	// Objects are never modified in place, so buf can be shared.
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(buf)), ETag: aws.String(etag)}, nil
+}
+
+func (m *memoryObjectClient) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.objects[aws.StringValue(input.Bucket)], aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memoryObjectClient) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	prefix := aws.StringValue(input.Prefix)
+
+	m.mtx.RLock()
+	var keys []string
+	for key := range m.objects[aws.StringValue(input.Bucket)] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	m.mtx.RUnlock()
+
+	sort.Strings(keys)
+	return listKeys(keys, input), nil
+}
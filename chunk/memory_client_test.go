@@ -0,0 +1,86 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+
+	// Other users' chunks aren't visible.
+	chunks, err = store.Get(user.WithID(context.Background(), "1"), now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestMemoryObjectClient(t *testing.T) {
+	client := NewMemoryObjectClient()
+	keys := []string{"1/a:1:2", "1/b:1:2", "1/stats/foo", "2/c:1:2"}
+	for _, key := range keys {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("data " + key)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("1/b:1:2"), Range: aws.String("bytes=5-")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if string(buf) != "1/b:1:2" {
+		t.Fatalf("unexpected range %q", buf)
+	}
+	if _, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("1/missing")}); err == nil {
+		t.Fatal("expected error getting missing object")
+	}
+
+	output, err := client.ListObjects(&s3.ListObjectsInput{Bucket: aws.String("bucket"), Prefix: aws.String("1/"), Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents, prefixes []string
+	for _, object := range output.Contents {
+		contents = append(contents, *object.Key)
+	}
+	for _, prefix := range output.CommonPrefixes {
+		prefixes = append(prefixes, *prefix.Prefix)
+	}
+	if !reflect.DeepEqual(contents, keys[:2]) || !reflect.DeepEqual(prefixes, []string{"1/stats/"}) {
+		t.Fatalf("unexpected listing %v %v", contents, prefixes)
+	}
+}
@@ -0,0 +1,153 @@
+package chunk
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+)
+
+var namelessQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_nameless_queries_total",
+	Help:      "Queries without a metric name, by how they were answered.",
+}, []string{"method"})
+
+func init() {
+	prometheus.MustRegister(namelessQueries)
+}
+
+// NamelessQueryConfig configures the fallback for queries without a metric
+// name equality matcher, such as {job="foo"}, which the index can't serve.
+type NamelessQueryConfig struct {
+	// If set, such queries are answered by scanning the user's chunks in S3,
+	// within the limits below, rather than being rejected, unless they can
+	// be looked up by an indexed label; see PeriodConfig.IndexedLabels.
+	// Chunks stored only in their index entries wouldn't be found, so
+	// NewStore refuses to enable this with StoreConfig.InlineChunkMaxSize.
+	Enabled bool
+
+	// The longest time range such a query may cover.  If zero, there is no
+	// limit.
+	MaxRange time.Duration
+
+	// The most chunks in its time range such a query may fetch to check
+	// against its matchers.  If zero, there is no limit.
+	MaxChunks int
+
+	// The most chunks, in its time range or not, such a query may list
+	// before giving up, bounding the cost of listing a large tenant's
+	// chunks.  If zero, there is no limit.
+	MaxListedChunks int
+}
+
+// hasMetricName returns whether matchers have the equality matcher on the
+// metric name which the index needs.
+func hasMetricName(matchers []*metric.LabelMatcher) bool {
+	for _, matcher := range matchers {
+		if matcher.Name == model.MetricNameLabel && matcher.Type == metric.Equal {
+			return true
+		}
+	}
+	return false
+}
+
+// namelessQuery returns whether a query with matchers should be answered by
+// the nameless query fallback, as it has no metric name, and can't be looked
+// up by an indexed label or label name entries instead.
+func (c *AWSStore) namelessQuery(from, through model.Time, matchers []*metric.LabelMatcher) bool {
+	if !c.cfg.NamelessQueries.Enabled || hasMetricName(matchers) {
+		return false
+	}
+	buckets := c.bigBuckets(from, through)
+	_, _, indexed := extractIndexedLabel(buckets, matchers)
+	return !indexed && !labelEntryLookups(buckets, matchers)
+}
+
+// labelEntryLookups returns whether a query without a metric name can be
+// looked up in buckets by the label name entries written from
+// IndexSchemaV4 on, each of its matchers under the name of the entries for
+// its label's values: all the buckets must have them, and one of the
+// matchers mustn't match the empty string, or every chunk would have to be
+// read.
+func labelEntryLookups(buckets []bucketSpec, matchers []*metric.LabelMatcher) bool {
+	for _, bucket := range buckets {
+		if !labelNameEntries(bucket.schema) {
+			return false
+		}
+	}
+	positive, _ := splitNegativeMatchers(matchers)
+	return len(positive) > 0
+}
+
+// matcherLookupName returns the name chunks matching matcher are indexed
+// under: metricName, or, for queries looked up by label name entries, which
+// have none, the name of the entries for matcher's label's values.
+func matcherLookupName(metricName model.LabelValue, matcher *metric.LabelMatcher) model.LabelValue {
+	if metricName != "" || matcher == nil {
+		return metricName
+	}
+	return labelValuesName(matcher.Name)
+}
+
+// scanNameless answers a query without a metric name by listing userID's
+// chunks in S3, fetching those overlapping the query, and keeping those
+// matching matchers.  The chunks are returned sorted by ID.
+func (c *AWSStore) scanNameless(ctx context.Context, userID string, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, error) {
+	cfg := c.cfg.NamelessQueries
+	if cfg.MaxRange > 0 && through.Sub(from) > cfg.MaxRange {
+		return nil, fmt.Errorf("queries without a metric name may cover at most %v", cfg.MaxRange)
+	}
+	namelessQueries.WithLabelValues("scan").Inc()
+
+	var (
+		candidates []Chunk
+		listed     int
+	)
+	err := c.listChunkIDs(ctx, userID, func(page []listedChunk) error {
+		listed += len(page)
+		if cfg.MaxListedChunks > 0 && listed > cfg.MaxListedChunks {
+			return fmt.Errorf("query without a metric name would list more than %d chunks", cfg.MaxListedChunks)
+		}
+		for _, l := range page {
+			if l.through < from || through < l.from {
+				continue
+			}
+			candidates = append(candidates, Chunk{ID: l.id})
+			if cfg.MaxChunks > 0 && len(candidates) > cfg.MaxChunks {
+				return fmt.Errorf("query without a metric name would scan more than %d chunks", cfg.MaxChunks)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fetched, err := c.fetchChunks(ctx, userID, from, through, candidates)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	for _, chunk := range fetched {
+		if matchesAll(chunk.Metric, matchers) {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Sort(ByID(chunks))
+	return chunks, nil
+}
+
+// matchesAll returns whether m matches all matchers.
+func matchesAll(m model.Metric, matchers []*metric.LabelMatcher) bool {
+	for _, matcher := range matchers {
+		if !matcher.Match(m[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package chunk
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestNamelessQueries(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	cfg := StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	}
+	store := NewAWSStore(cfg)
+
+	now := model.Now()
+	var samples []*model.Sample
+	for _, m := range []model.Metric{
+		{model.MetricNameLabel: "foo", "job": "a"},
+		{model.MetricNameLabel: "bar", "job": "a"},
+		{model.MetricNameLabel: "foo", "job": "b"},
+	} {
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: now, Value: 1})
+	}
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	job := mustNewLabelMatcher(metric.Equal, "job", "a")
+	if _, err := store.Get(ctx, now.Add(-time.Hour), now, job); err == nil {
+		t.Fatal("expected a query without a metric name to fail")
+	}
+
+	cfg.NamelessQueries = NamelessQueryConfig{Enabled: true, MaxRange: 2 * time.Hour, MaxChunks: 3}
+	store = NewAWSStore(cfg)
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %v", chunks)
+	}
+	for _, chunk := range chunks {
+		if chunk.Metric["job"] != "a" {
+			t.Fatalf("unexpected chunk %v", chunk.Metric)
+		}
+	}
+
+	// The lazy path finds the same chunks.
+	refs, err := store.GetChunkRefs(ctx, now.Add(-time.Hour), now, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks, err = store.FetchChunks(ctx, now.Add(-time.Hour), now, refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %v", chunks)
+	}
+
+	// Queries over the limits fail.
+	if _, err := store.Get(ctx, now.Add(-3*time.Hour), now, job); err == nil {
+		t.Fatal("expected a query over the maximum range to fail")
+	}
+	cfg.NamelessQueries.MaxChunks = 2
+	store = NewAWSStore(cfg)
+	if _, err := store.Get(ctx, now.Add(-time.Hour), now, job); err == nil {
+		t.Fatal("expected a query over the maximum chunks to fail")
+	}
+	cfg.NamelessQueries.MaxChunks = 0
+	cfg.NamelessQueries.MaxListedChunks = 2
+	store = NewAWSStore(cfg)
+	if _, err := store.Get(ctx, now.Add(-time.Hour), now, job); err == nil {
+		t.Fatal("expected a query listing over the maximum chunks to fail")
+	}
+}
+
+func TestIndexedLabels(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV1, BucketSize: 24 * time.Hour},
+			{From: now.Add(-48 * time.Hour), Schema: IndexSchemaV3, BucketSize: 24 * time.Hour, Shards: 2, IndexedLabels: []model.LabelName{"job"}},
+		}},
+	})
+
+	var samples []*model.Sample
+	for _, m := range []model.Metric{
+		{model.MetricNameLabel: "foo", "job": "a", "instance": "1"},
+		{model.MetricNameLabel: "bar", "job": "a", "instance": "2"},
+		{model.MetricNameLabel: "foo", "job": "b", "instance": "1"},
+		{model.MetricNameLabel: "foo", "instance": "1"},
+	} {
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: now, Value: 1})
+	}
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		matchers []*metric.LabelMatcher
+		expected int
+	}{
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "a")}, 2},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "a"), mustNewLabelMatcher(metric.Equal, "instance", "2")}, 1},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "a"), mustNewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, "f.*")}, 1},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "c")}, 0},
+		// Queries with a metric name still use it.
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")}, 3},
+	} {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, tc.matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != tc.expected {
+			t.Fatalf("%v: expected %d chunks, got %v", tc.matchers, tc.expected, chunks)
+		}
+	}
+
+	// Queries reaching back before the label was indexed can't be looked up.
+	if _, err := store.Get(ctx, now.Add(-72*time.Hour), now, mustNewLabelMatcher(metric.Equal, "job", "a")); err == nil {
+		t.Fatal("expected a query before the label was indexed to fail")
+	}
+}
+
+func TestLabelEntryLookups(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV3, BucketSize: 24 * time.Hour, Shards: 2},
+			{From: now.Add(-48 * time.Hour), Schema: IndexSchemaV6, BucketSize: 24 * time.Hour, Shards: 2},
+		}},
+	})
+
+	var samples []*model.Sample
+	for _, m := range []model.Metric{
+		{model.MetricNameLabel: "foo", "job": "a", "instance": "1"},
+		{model.MetricNameLabel: "bar", "job": "a", "instance": "2"},
+		{model.MetricNameLabel: "foo", "job": "b", "instance": "1"},
+		{model.MetricNameLabel: "baz", "instance": "1"},
+	} {
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: now, Value: 1})
+	}
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		matchers []*metric.LabelMatcher
+		expected []model.LabelValue
+	}{
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "a")}, []model.LabelValue{"bar", "foo"}},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "a"), mustNewLabelMatcher(metric.Equal, "instance", "2")}, []model.LabelValue{"bar"}},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.RegexMatch, "job", "a|b"), mustNewLabelMatcher(metric.NotEqual, model.MetricNameLabel, "bar")}, []model.LabelValue{"foo", "foo"}},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "instance", "1"), mustNewLabelMatcher(metric.Equal, "job", "")}, []model.LabelValue{"baz"}},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, "ba.*")}, []model.LabelValue{"bar", "baz"}},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "c")}, nil},
+	} {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, tc.matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []model.LabelValue
+		for _, chunk := range chunks {
+			names = append(names, chunk.Metric[model.MetricNameLabel])
+		}
+		sort.Sort(model.LabelValues(names))
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Fatalf("%v: expected %v, got %v", tc.matchers, tc.expected, names)
+		}
+	}
+
+	// Queries matching every series, or reaching back before label name
+	// entries were written, can't be looked up.
+	if _, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.NotEqual, "job", "a")); err == nil {
+		t.Fatal("expected a query with only negative matchers to fail")
+	}
+	if _, err := store.Get(ctx, now.Add(-72*time.Hour), now, mustNewLabelMatcher(metric.Equal, "job", "a")); err == nil {
+		t.Fatal("expected a query before label name entries were written to fail")
+	}
+}
@@ -0,0 +1,352 @@
+package chunk
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Weight given to each new observation of a matcher's selectivity.
+	selectivityDecay = 0.2
+
+	// A matcher is looked up on its own first if it is expected to match at
+	// most this fraction of the chunks the next best matcher does.
+	selectiveRatio = 0.5
+
+	// The number of recent buckets per metric for which the planner keeps
+	// the number of chunks each label's lookup matched.
+	maxSelectivityBuckets = 100
+)
+
+var queryPlannerLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "query_planner_lookups_total",
+	Help:      "Index lookups with several matchers, by how the planner ran them.",
+}, []string{"plan"})
+
+func init() {
+	prometheus.MustRegister(queryPlannerLookups)
+}
+
+// metricSelectivity holds, for one user's metric, a moving average of the
+// number of chunks matched by a single bucket's lookup of each label.  A
+// label's cardinality changes over time, so the number of chunks the last
+// lookup of each label in a recent bucket matched is also kept, in memory
+// only, and preferred for planning further lookups in that bucket.
+type metricSelectivity struct {
+	Labels map[model.LabelName]float64 `json:"labels"`
+
+	persisted time.Time
+
+	buckets     map[string]map[model.LabelName]int
+	bucketOrder []string // Oldest first, for eviction.
+}
+
+// recordBucket records the number of chunks a lookup of labelName in bucket
+// matched, evicting the least recently added bucket if there are too many.
+func (s *metricSelectivity) recordBucket(bucket string, labelName model.LabelName, chunks int) {
+	if s.buckets == nil {
+		s.buckets = map[string]map[model.LabelName]int{}
+	}
+	labels, ok := s.buckets[bucket]
+	if !ok {
+		if len(s.bucketOrder) >= maxSelectivityBuckets {
+			delete(s.buckets, s.bucketOrder[0])
+			s.bucketOrder = s.bucketOrder[1:]
+		}
+		labels = map[model.LabelName]int{}
+		s.buckets[bucket] = labels
+		s.bucketOrder = append(s.bucketOrder, bucket)
+	}
+	labels[labelName] = chunks
+}
+
+// selectivityStats are the statistics the query planner uses to order
+// matchers, keyed by user and metric name.  They are gathered by every
+// lookup, and persisted to S3 so they survive restarts and are shared by
+// queriers.  At most maxMetrics metrics' statistics are kept in memory, the
+// least recently used being evicted.
+type selectivityStats struct {
+	maxMetrics int
+
+	mtx     sync.Mutex
+	metrics map[string]*list.Element // Of *selectivityEntry.
+	lru     *list.List               // Most recently used first.
+}
+
+type selectivityEntry struct {
+	key   string
+	stats *metricSelectivity
+}
+
+func newSelectivityStats(maxMetrics int) *selectivityStats {
+	return &selectivityStats{
+		maxMetrics: maxMetrics,
+		metrics:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// get returns the statistics for key, if any, marking them used.  The
+// caller must hold mtx.
+func (s *selectivityStats) get(key string) (*metricSelectivity, bool) {
+	elem, ok := s.metrics[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*selectivityEntry).stats, true
+}
+
+// add adds statistics for key, evicting the least recently used if there
+// are too many.  The caller must hold mtx.
+func (s *selectivityStats) add(key string, stats *metricSelectivity) {
+	if s.maxMetrics > 0 && s.lru.Len() >= s.maxMetrics {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.metrics, oldest.Value.(*selectivityEntry).key)
+	}
+	s.metrics[key] = s.lru.PushFront(&selectivityEntry{key: key, stats: stats})
+}
+
+// planMatchers orders matchers by the number of chunks each is expected to
+// match in bucket, most selective first.  Matchers without statistics go
+// last.  It also returns whether the first matcher is selective enough to be
+// worth looking up before the others.
+func (c *AWSStore) planMatchers(ctx context.Context, userID string, metricName model.LabelValue, bucket string, matchers []*metric.LabelMatcher) ([]*metric.LabelMatcher, bool) {
+	if len(matchers) < 2 {
+		return matchers, false
+	}
+	stats := c.selectivity(ctx, userID, metricName, bucket)
+	if stats == nil {
+		return matchers, false
+	}
+
+	planned := make([]plannedMatcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		expected, ok := stats[matcher.Name]
+		planned = append(planned, plannedMatcher{matcher, expected, ok})
+	}
+	sort.Stable(byExpectedChunks(planned))
+
+	result := make([]*metric.LabelMatcher, 0, len(planned))
+	for _, p := range planned {
+		result = append(result, p.matcher)
+	}
+	selective := planned[0].known && planned[1].known && planned[0].expected <= selectiveRatio*planned[1].expected
+	return result, selective
+}
+
+// earliestThrough returns the earliest end time of chunks, or from if that
+// is later: chunks ending before it can't be in the intersection of chunks
+// with another set.  Chunks with invalid IDs are ignored.
+func earliestThrough(chunks ByID, from model.Time) model.Time {
+	earliest := model.Latest
+	for _, chunk := range chunks {
+		_, _, through, err := parseChunkID(chunk.ID)
+		if err == nil && through < earliest {
+			earliest = through
+		}
+	}
+	if earliest == model.Latest || earliest < from {
+		return from
+	}
+	return earliest
+}
+
+// splitNegativeMatchers separates the matchers which can be looked up in the
+// index from those which match the empty string, and so match series without
+// their label, which have no index entries for it.  The latter, typically !=
+// and !~ matchers, are applied to the chunks the others match instead; see
+// complementMatcher.
+func splitNegativeMatchers(matchers []*metric.LabelMatcher) (positive, negative []*metric.LabelMatcher) {
+	for _, matcher := range matchers {
+		if matcher.Match("") {
+			negative = append(negative, matcher)
+		} else {
+			positive = append(positive, matcher)
+		}
+	}
+	return positive, negative
+}
+
+// complementMatcher returns the matcher matching the label values matcher
+// doesn't.  For a matcher matching the empty string, the complement doesn't,
+// so it can be looked up in the index, and the chunks it matches removed
+// from a candidate set: x!="a" is applied by looking up x="a", which reads
+// only the entries for that value.
+func complementMatcher(matcher *metric.LabelMatcher) (*metric.LabelMatcher, error) {
+	var matchType metric.MatchType
+	switch matcher.Type {
+	case metric.Equal:
+		matchType = metric.NotEqual
+	case metric.NotEqual:
+		matchType = metric.Equal
+	case metric.RegexMatch:
+		matchType = metric.RegexNoMatch
+	case metric.RegexNoMatch:
+		matchType = metric.RegexMatch
+	default:
+		return nil, fmt.Errorf("unknown match type %v", matcher.Type)
+	}
+	return metric.NewLabelMatcher(matchType, matcher.Name, matcher.Value)
+}
+
+// selectivity returns a copy of the statistics for the user's metric in
+// bucket, loading them from S3 the first time they are needed.
+func (c *AWSStore) selectivity(ctx context.Context, userID string, metricName model.LabelValue, bucket string) map[model.LabelName]float64 {
+	if c.selectivityStats == nil {
+		return nil
+	}
+	key := selectivityName(userID, metricName)
+
+	c.selectivityStats.mtx.Lock()
+	stats, ok := c.selectivityStats.get(key)
+	c.selectivityStats.mtx.Unlock()
+
+	if !ok && c.cfg.SelectivityStatsPersistInterval > 0 {
+		loaded, err := c.loadSelectivity(ctx, key)
+		if err != nil {
+			log.Debugf("No selectivity statistics for %s: %v", key, err)
+			loaded = &metricSelectivity{Labels: map[model.LabelName]float64{}, persisted: mtime.Now()}
+		}
+		c.selectivityStats.mtx.Lock()
+		if stats, ok = c.selectivityStats.get(key); !ok {
+			stats = loaded
+			c.selectivityStats.add(key, stats)
+		}
+		c.selectivityStats.mtx.Unlock()
+	}
+	if stats == nil {
+		return nil
+	}
+
+	c.selectivityStats.mtx.Lock()
+	defer c.selectivityStats.mtx.Unlock()
+	result := make(map[model.LabelName]float64, len(stats.Labels))
+	for name, expected := range stats.Labels {
+		result[name] = expected
+	}
+	for name, chunks := range stats.buckets[bucket] {
+		result[name] = float64(chunks)
+	}
+	return result
+}
+
+// recordSelectivity updates the statistics with the number of chunks a
+// lookup of labelName in bucket matched, and persists them if they haven't
+// been for SelectivityStatsPersistInterval.
+func (c *AWSStore) recordSelectivity(userID string, metricName model.LabelValue, bucket string, labelName model.LabelName, chunks int) {
+	if c.selectivityStats == nil {
+		return
+	}
+	key := selectivityName(userID, metricName)
+	now := mtime.Now()
+
+	c.selectivityStats.mtx.Lock()
+	stats, ok := c.selectivityStats.get(key)
+	if !ok {
+		stats = &metricSelectivity{Labels: map[model.LabelName]float64{}, persisted: now}
+		c.selectivityStats.add(key, stats)
+	}
+	if expected, ok := stats.Labels[labelName]; ok {
+		stats.Labels[labelName] = expected + selectivityDecay*(float64(chunks)-expected)
+	} else {
+		stats.Labels[labelName] = float64(chunks)
+	}
+	stats.recordBucket(bucket, labelName, chunks)
+
+	interval := c.cfg.SelectivityStatsPersistInterval
+	if interval <= 0 || now.Sub(stats.persisted) < interval {
+		c.selectivityStats.mtx.Unlock()
+		return
+	}
+	stats.persisted = now
+	buf, err := json.Marshal(stats)
+	c.selectivityStats.mtx.Unlock()
+	if err != nil {
+		log.Warnf("Could not encode selectivity statistics for %s: %v", key, err)
+		return
+	}
+
+	go func() {
+		if err := c.storeSelectivity(context.Background(), key, buf); err != nil {
+			log.Warnf("Could not store selectivity statistics for %s: %v", key, err)
+		}
+	}()
+}
+
+func (c *AWSStore) loadSelectivity(ctx context.Context, key string) (*metricSelectivity, error) {
+	var resp *s3.GetObjectOutput
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = c.cfg.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(c.cfg.BucketName),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	stats := &metricSelectivity{}
+	if err := json.Unmarshal(buf, stats); err != nil {
+		return nil, err
+	}
+	if stats.Labels == nil {
+		stats.Labels = map[model.LabelName]float64{}
+	}
+	stats.persisted = mtime.Now()
+	return stats, nil
+}
+
+func (c *AWSStore) storeSelectivity(ctx context.Context, key string, buf []byte) error {
+	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		_, err := c.cfg.S3.PutObject(c.putObjectInput(key, bytes.NewReader(buf)))
+		return err
+	})
+}
+
+// selectivityName is the S3 key for a metric's selectivity statistics.
+// Chunk IDs never contain a '/', so these can't collide with chunkName.
+func selectivityName(userID string, metricName model.LabelValue) string {
+	return fmt.Sprintf("%s/stats/%s", userID, metricName)
+}
+
+type plannedMatcher struct {
+	matcher  *metric.LabelMatcher
+	expected float64
+	known    bool
+}
+
+type byExpectedChunks []plannedMatcher
+
+func (p byExpectedChunks) Len() int      { return len(p) }
+func (p byExpectedChunks) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byExpectedChunks) Less(i, j int) bool {
+	if p[i].known != p[j].known {
+		return p[i].known
+	}
+	return p[i].expected < p[j].expected
+}
@@ -0,0 +1,264 @@
+package chunk
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestQueryPlanner(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	s3 := NewMockS3()
+	cfg := StoreConfig{
+		DynamoDB:                        dynamoDB,
+		S3:                              s3,
+		SelectivityStatsPersistInterval: time.Minute,
+	}
+	store := NewAWSStore(cfg)
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	var chunks []Chunk
+	for i := 0; i < 10; i++ {
+		samples, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+		metric := model.Metric{
+			model.MetricNameLabel: "foo",
+			"toms":                "code",
+		}
+		if i == 0 {
+			metric["bar"] = "baz"
+		}
+		chunks = append(chunks, NewChunk(model.Fingerprint(i), metric, samples[0], now.Add(-time.Hour), now))
+	}
+	if err := store.Put(ctx, chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	tomsMatcher := mustNewLabelMatcher(metric.Equal, "toms", "code")
+	barMatcher := mustNewLabelMatcher(metric.Equal, "bar", "baz")
+	noneMatcher := mustNewLabelMatcher(metric.Equal, "bar", "none")
+
+	// Without statistics, matchers are looked up in parallel.
+	if _, selective := store.planMatchers(ctx, "0", "foo", "", []*metric.LabelMatcher{tomsMatcher, barMatcher}); selective {
+		t.Fatalf("planned a selective lookup without statistics")
+	}
+	found, err := store.Get(ctx, now.Add(-time.Hour), now, nameMatcher, tomsMatcher, barMatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(found))
+	}
+
+	// Now bar is known to be more selective than toms, so it goes first,
+	// and when it matches nothing toms isn't looked up.
+	planned, selective := store.planMatchers(ctx, "0", "foo", "", []*metric.LabelMatcher{tomsMatcher, barMatcher})
+	if !selective || planned[0] != barMatcher {
+		t.Fatalf("expected bar to be looked up first, got %v (selective=%v)", planned, selective)
+	}
+	bucket := store.bigBuckets(now, now)[0]
+	result, lookups, err := store.lookupChunksFor(ctx, "0", bucket, "foo", []*metric.LabelMatcher{tomsMatcher, noneMatcher}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 || lookups != 1 {
+		t.Fatalf("expected a single lookup finding nothing, got %d lookups finding %d chunks", lookups, len(result))
+	}
+
+	// The statistics are persisted once the interval has passed, and
+	// loaded by other stores.
+	mtime.NowForce(time.Now().Add(2 * time.Minute))
+	defer mtime.NowReset()
+	store.recordSelectivity("0", "foo", "", "bar", 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.loadSelectivity(ctx, selectivityName("0", "foo")); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("statistics not persisted: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other := NewAWSStore(cfg)
+	if planned, selective := other.planMatchers(ctx, "0", "foo", "", []*metric.LabelMatcher{tomsMatcher, barMatcher}); !selective || planned[0] != barMatcher {
+		t.Fatalf("persisted statistics not used: %v (selective=%v)", planned, selective)
+	}
+}
+
+func TestQueryPlannerBucketStats(t *testing.T) {
+	store := NewAWSStore(StoreConfig{
+		DynamoDB: NewMockDynamoDB(0, 0),
+		S3:       NewMockS3(),
+	})
+	ctx := user.WithID(context.Background(), "0")
+	tomsMatcher := mustNewLabelMatcher(metric.Equal, "toms", "code")
+	barMatcher := mustNewLabelMatcher(metric.Equal, "bar", "baz")
+
+	// On average bar is more selective, but not in bucket b.
+	for _, bucket := range []string{"a", "b"} {
+		store.recordSelectivity("0", "foo", bucket, "toms", 10)
+	}
+	store.recordSelectivity("0", "foo", "a", "bar", 1)
+	store.recordSelectivity("0", "foo", "b", "bar", 100)
+	for i := 0; i < 10; i++ {
+		store.recordSelectivity("0", "foo", "a", "bar", 1)
+	}
+	if planned, selective := store.planMatchers(ctx, "0", "foo", "a", []*metric.LabelMatcher{tomsMatcher, barMatcher}); !selective || planned[0] != barMatcher {
+		t.Fatalf("expected bar to be looked up first in bucket a, got %v (selective=%v)", planned, selective)
+	}
+	if planned, selective := store.planMatchers(ctx, "0", "foo", "b", []*metric.LabelMatcher{tomsMatcher, barMatcher}); !selective || planned[0] != tomsMatcher {
+		t.Fatalf("expected toms to be looked up first in bucket b, got %v (selective=%v)", planned, selective)
+	}
+	if planned, _ := store.planMatchers(ctx, "0", "foo", "c", []*metric.LabelMatcher{tomsMatcher, barMatcher}); planned[0] != barMatcher {
+		t.Fatalf("expected the averages to be used for bucket c, got %v", planned)
+	}
+
+	// Only the most recent buckets are kept.
+	for i := 0; i < maxSelectivityBuckets; i++ {
+		store.recordSelectivity("0", "foo", strconv.Itoa(i), "toms", 10)
+	}
+	if planned, _ := store.planMatchers(ctx, "0", "foo", "b", []*metric.LabelMatcher{tomsMatcher, barMatcher}); planned[0] != barMatcher {
+		t.Fatalf("expected bucket b to have been evicted, got %v", planned)
+	}
+}
+
+func TestEarliestThrough(t *testing.T) {
+	chunks := ByID{
+		{ID: ChunkKey{Fingerprint: 1, From: 10, Through: 30}.Encode()},
+		{ID: ChunkKey{Fingerprint: 2, From: 15, Through: 20}.Encode()},
+	}
+	for _, tc := range []struct {
+		chunks   ByID
+		from     model.Time
+		expected model.Time
+	}{
+		{chunks, 0, 20},
+		{chunks, 25, 25},
+		{nil, 5, 5},
+	} {
+		if got := earliestThrough(tc.chunks, tc.from); got != tc.expected {
+			t.Fatalf("earliestThrough(%v, %d): expected %d, got %d", tc.chunks, tc.from, tc.expected, got)
+		}
+	}
+}
+
+func TestNegativeMatchers(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	store := NewAWSStore(StoreConfig{
+		DynamoDB: dynamoDB,
+		S3:       NewMockS3(),
+	})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	// Series 0 has no job label.
+	jobs := []model.LabelValue{"", "a", "b", "c"}
+	var chunks []Chunk
+	for i, job := range jobs {
+		samples, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+		metric := model.Metric{
+			model.MetricNameLabel: "foo",
+			"toms":                "code",
+		}
+		if job != "" {
+			metric["job"] = job
+		}
+		chunks = append(chunks, NewChunk(model.Fingerprint(i), metric, samples[0], now.Add(-time.Hour), now))
+	}
+	if err := store.Put(ctx, chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		matchers []*metric.LabelMatcher
+		expected []model.LabelValue
+	}{
+		{
+			[]*metric.LabelMatcher{mustNewLabelMatcher(metric.NotEqual, "job", "a")},
+			[]model.LabelValue{"", "b", "c"},
+		},
+		{
+			[]*metric.LabelMatcher{mustNewLabelMatcher(metric.RegexNoMatch, "job", "a|b")},
+			[]model.LabelValue{"", "c"},
+		},
+		{
+			[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, "job", "")},
+			[]model.LabelValue{""},
+		},
+		{
+			[]*metric.LabelMatcher{mustNewLabelMatcher(metric.RegexMatch, "job", "a|")},
+			[]model.LabelValue{"", "a"},
+		},
+		{
+			[]*metric.LabelMatcher{mustNewLabelMatcher(metric.NotEqual, "job", "")},
+			[]model.LabelValue{"a", "b", "c"},
+		},
+		{
+			[]*metric.LabelMatcher{
+				mustNewLabelMatcher(metric.Equal, "toms", "code"),
+				mustNewLabelMatcher(metric.NotEqual, "job", "a"),
+				mustNewLabelMatcher(metric.RegexNoMatch, "job", "c"),
+			},
+			[]model.LabelValue{"", "b"},
+		},
+	} {
+		matchers := append([]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")}, tc.matchers...)
+		found, err := store.Get(ctx, now.Add(-time.Hour), now, matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []model.LabelValue
+		for _, c := range found {
+			got = append(got, c.Metric["job"])
+		}
+		if len(got) != len(tc.expected) {
+			t.Fatalf("%v: expected %v, got %v", tc.matchers, tc.expected, got)
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Fatalf("%v: expected %v, got %v", tc.matchers, tc.expected, got)
+			}
+		}
+	}
+
+	// Negative matchers aren't applied when nothing else matches.
+	bucket := store.bigBuckets(now, now)[0]
+	result, lookups, err := store.lookupChunksFor(ctx, "0", bucket, "foo", []*metric.LabelMatcher{
+		mustNewLabelMatcher(metric.Equal, "job", "none"),
+		mustNewLabelMatcher(metric.NotEqual, "job", "a"),
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 || lookups != 1 {
+		t.Fatalf("expected a single lookup finding nothing, got %d lookups finding %d chunks", lookups, len(result))
+	}
+}
+
+func TestSelectivityStatsEviction(t *testing.T) {
+	stats := newSelectivityStats(2)
+	stats.add("a", &metricSelectivity{})
+	stats.add("b", &metricSelectivity{})
+	if _, ok := stats.get("a"); !ok {
+		t.Fatal("a not found")
+	}
+	// b is now the least recently used.
+	stats.add("c", &metricSelectivity{})
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := stats.get(key); ok != want {
+			t.Errorf("%s: got %v, want %v", key, ok, want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/sburnett/lexicographic-tuples"
+)
+
+// Range values are written in one of two encodings, both of which can always
+// be read.  Version 1 is a lex tuple of label name, label value and chunk
+// ID, which can't hold a label value containing the tuple separator, a null
+// byte.  Version 2, written from IndexSchemaV3 on, starts with
+// rangeValueV2Prefix, followed by the base64-encoded label name and value
+// and the chunk ID, each null-terminated, so label values may hold anything.
+// Label names can't start with a digit, so version 1 range values can't
+// start with the prefix.
+const rangeValueV2Prefix = '2'
+
+// Version 3 range values, written from IndexSchemaV6 on, are version 2 range
+// values starting with rangeValueV3Prefix, with the chunk's end time, as
+// fixed-width hex, before the chunk ID.  Entries for a label value are so
+// ordered by the end time of their chunks, and lookups can skip those for
+// chunks ending before the query with a range key condition.
+const rangeValueV3Prefix = '3'
+
+// The granularity of the start times of lookups of version 3 range values,
+// so repeated queries, eg from dashboards, share index cache entries.
+const rangeValueTimeGranularity = model.Time(time.Hour / time.Millisecond)
+
+var rangeValueEncoding = base64.RawURLEncoding
+
+// base64RangeValues returns whether index entries are written with version 2
+// range values under schema.
+func base64RangeValues(schema string) bool {
+	return schema == IndexSchemaV3 || schema == IndexSchemaV4 || schema == IndexSchemaV5 || schema == IndexSchemaV6
+}
+
+// timeRangeValues returns whether index entries are written with version 3
+// range values under schema.
+func timeRangeValues(schema string) bool {
+	return schema == IndexSchemaV6
+}
+
+// rangeValue encodes the range value of the index entry for a label of a
+// chunk, as written under schema.
+func rangeValue(schema string, label model.LabelName, value model.LabelValue, chunkID string) ([]byte, error) {
+	if !base64RangeValues(schema) {
+		return lex.Encode(string(label), string(value), chunkID)
+	}
+	if timeRangeValues(schema) {
+		_, _, through, err := parseChunkID(chunkID)
+		if err != nil {
+			return nil, err
+		}
+		return encodeRangeValue(rangeValueV3Prefix, string(label), string(value), encodeRangeTime(through), chunkID), nil
+	}
+	return encodeRangeValue(rangeValueV2Prefix, string(label), string(value), chunkID), nil
+}
+
+// rangePrefix returns the prefix of the range values of the index entries
+// under schema which might match matcher: those for its label value if it is
+// an equality matcher, those for values starting with its literal prefix if
+// it is a regex matcher with one, such as api_.*, or else those for its
+// label.
+func rangePrefix(schema string, matcher *metric.LabelMatcher) ([]byte, error) {
+	valuePrefix := regexPrefix(matcher)
+	if !base64RangeValues(schema) {
+		if matcher.Type == metric.Equal {
+			return lex.Encode(string(matcher.Name), string(matcher.Value))
+		}
+		prefix, err := lex.Encode(string(matcher.Name))
+		if err != nil {
+			return nil, err
+		}
+		// Values are written as is, so a prefix of one is a prefix of its
+		// encoding, unless it holds the tuple separator.
+		if !strings.ContainsRune(valuePrefix, 0) {
+			prefix = append(prefix, valuePrefix...)
+		}
+		return prefix, nil
+	}
+	version := byte(rangeValueV2Prefix)
+	if timeRangeValues(schema) {
+		version = rangeValueV3Prefix
+	}
+	if matcher.Type == metric.Equal {
+		return encodeRangeValue(version, string(matcher.Name), string(matcher.Value)), nil
+	}
+	prefix := encodeRangeValue(version, string(matcher.Name))
+	// Each 3 bytes of a value encode to 4 base64 characters, so only whole
+	// groups of 3 bytes of a prefix of it are a prefix of its encoding.
+	if n := len(valuePrefix) / 3 * 3; n > 0 {
+		prefix = append(prefix, rangeValueEncoding.EncodeToString([]byte(valuePrefix[:n]))...)
+	}
+	return prefix, nil
+}
+
+// regexPrefix returns the literal prefix of the values matched by matcher if
+// it is a regex matcher, or else the empty string.  Prometheus anchors
+// regex matchers, so every value they match starts with the literal prefix
+// of the unanchored regex.
+func regexPrefix(matcher *metric.LabelMatcher) string {
+	if matcher.Type != metric.RegexMatch {
+		return ""
+	}
+	re, err := regexp.Compile(string(matcher.Value))
+	if err != nil {
+		return ""
+	}
+	prefix, _ := re.LiteralPrefix()
+	return prefix
+}
+
+// rangeBounds returns the bounds of the range values of the index entries
+// under schema which might match an equality matcher, for chunks ending at
+// or after from, or false if the entries can't be bounded by time, as they
+// aren't written with version 3 range values.  from is rounded down to
+// rangeValueTimeGranularity.
+func rangeBounds(schema string, matcher *metric.LabelMatcher, from model.Time) ([]byte, []byte, bool) {
+	if !timeRangeValues(schema) || matcher.Type != metric.Equal || from <= 0 {
+		return nil, nil, false
+	}
+	from -= from % rangeValueTimeGranularity
+	prefix := encodeRangeValue(rangeValueV3Prefix, string(matcher.Name), string(matcher.Value))
+	lower := append(append([]byte{}, prefix...), encodeRangeTime(from)...)
+	// End times are hex, so sort before 0xff.
+	upper := append(append([]byte{}, prefix...), 0xff)
+	return lower, upper, true
+}
+
+// encodeRangeTime encodes a chunk's end time in a version 3 range value.
+func encodeRangeTime(t model.Time) string {
+	return fmt.Sprintf("%016x", uint64(t))
+}
+
+// encodeRangeValue encodes components, the last of which is the chunk ID, as a
+// version 2 or 3 range value, or a prefix of one.
+func encodeRangeValue(version byte, components ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(version)
+	for i, component := range components {
+		if i < 2 {
+			buf.WriteString(rangeValueEncoding.EncodeToString([]byte(component)))
+		} else {
+			buf.WriteString(component)
+		}
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// parseRangeValue decodes a range value of any encoding.
+func parseRangeValue(v []byte) (label model.LabelName, value model.LabelValue, chunkID string, err error) {
+	if len(v) == 0 || (v[0] != rangeValueV2Prefix && v[0] != rangeValueV3Prefix) {
+		var labelStr, valueStr string
+		_, err = lex.Decode(v, &labelStr, &valueStr, &chunkID)
+		label, value = model.LabelName(labelStr), model.LabelValue(valueStr)
+		return
+	}
+
+	parts := bytes.Split(v[1:], []byte{0})
+	if v[0] == rangeValueV3Prefix {
+		// Drop the end time, which is also in the chunk ID.
+		if len(parts) != 5 {
+			return "", "", "", fmt.Errorf("invalid range value %q", v)
+		}
+		parts = append(parts[:2], parts[3:]...)
+	}
+	if len(parts) != 4 || len(parts[3]) != 0 {
+		return "", "", "", fmt.Errorf("invalid range value %q", v)
+	}
+	labelBytes, err := rangeValueEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid range value %q: %v", v, err)
+	}
+	valueBytes, err := rangeValueEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid range value %q: %v", v, err)
+	}
+	return model.LabelName(labelBytes), model.LabelValue(valueBytes), string(parts[2]), nil
+}
@@ -0,0 +1,175 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestRangeValues(t *testing.T) {
+	for _, schema := range []string{IndexSchemaV1, IndexSchemaV3, IndexSchemaV6} {
+		for _, value := range []model.LabelValue{"bar", "", "with\x00null", "\xff\x01binary"} {
+			if schema == IndexSchemaV1 && value == "with\x00null" {
+				continue
+			}
+			encoded, err := rangeValue(schema, "foo", value, "1:2:3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			label, decodedValue, chunkID, err := parseRangeValue(encoded)
+			if err != nil {
+				t.Fatalf("%s %q: %v", schema, value, err)
+			}
+			if label != "foo" || decodedValue != value || chunkID != "1:2:3" {
+				t.Fatalf("%s %q: decoded as %q %q %q", schema, value, label, decodedValue, chunkID)
+			}
+
+			// Entries are found by their matchers' prefixes.
+			for _, matcher := range []*metric.LabelMatcher{
+				mustNewLabelMatcher(metric.Equal, "foo", value),
+				mustNewLabelMatcher(metric.RegexMatch, "foo", ".*"),
+			} {
+				prefix, err := rangePrefix(schema, matcher)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(prefix) > len(encoded) || string(encoded[:len(prefix)]) != string(prefix) {
+					t.Fatalf("%s %q: %q isn't a prefix of %q", schema, value, prefix, encoded)
+				}
+			}
+		}
+	}
+}
+
+func TestIndexSchemaV3(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV1, BucketSize: 24 * time.Hour},
+			{From: model.Now().Add(-48 * time.Hour), Schema: IndexSchemaV3, BucketSize: 24 * time.Hour, Shards: 1},
+		}},
+	})
+
+	now := model.Now()
+	var samples []*model.Sample
+	for _, value := range []model.LabelValue{"a", "with\x00null", "with\x00"} {
+		m := model.Metric{model.MetricNameLabel: "foo", "bar": value}
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: now, Value: 1})
+	}
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "with\x00null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].Metric["bar"] != "with\x00null" {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestRegexRangePrefix(t *testing.T) {
+	for _, schema := range []string{IndexSchemaV1, IndexSchemaV3, IndexSchemaV6} {
+		for _, tc := range []struct {
+			regex    model.LabelValue
+			found    []model.LabelValue
+			notFound []model.LabelValue
+		}{
+			// Prefixes shorter than 3 bytes can't be pushed down to base64
+			// range values, so aren't expected to exclude anything.
+			{"a.*", []model.LabelValue{"a", "api"}, nil},
+			{"api_.*", []model.LabelValue{"api_", "api_foo"}, []model.LabelValue{"web_foo", "ap"}},
+			{"api_(foo|bar)", []model.LabelValue{"api_foo", "api_bar"}, []model.LabelValue{"web_foo"}},
+			{"(?i)api_.*", []model.LabelValue{"API_foo", "api_foo"}, nil},
+			{"api_.*|web_.*", []model.LabelValue{"api_foo", "web_foo"}, nil},
+		} {
+			prefix, err := rangePrefix(schema, mustNewLabelMatcher(metric.RegexMatch, "foo", tc.regex))
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(values []model.LabelValue, expected bool) {
+				for _, value := range values {
+					encoded, err := rangeValue(schema, "foo", value, "1:2:3")
+					if err != nil {
+						t.Fatal(err)
+					}
+					found := len(prefix) <= len(encoded) && string(encoded[:len(prefix)]) == string(prefix)
+					if found != expected {
+						t.Fatalf("%s %q: found by %q is %v, expected %v", schema, value, tc.regex, found, expected)
+					}
+				}
+			}
+			check(tc.found, true)
+			check(tc.notFound, false)
+		}
+	}
+}
+
+func TestTimeRangeValues(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV6, BucketSize: 24 * time.Hour, Shards: 1},
+		}},
+	})
+
+	// Two series with chunks early and late in the same bucket.
+	day := model.Time(24 * time.Hour / time.Millisecond)
+	start := model.Now()
+	start -= start % day
+	early := model.Metric{model.MetricNameLabel: "foo", "job": "a", "instance": "1"}
+	late := model.Metric{model.MetricNameLabel: "foo", "job": "a", "instance": "2"}
+	if _, err := Backfill(ctx, store, []*model.Sample{
+		{Metric: early, Timestamp: start.Add(time.Minute), Value: 1},
+		{Metric: late, Timestamp: start.Add(3 * time.Hour), Value: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Looking up the job from after the early chunk ends reads only the late
+	// chunk's entry.
+	matcher := mustNewLabelMatcher(metric.Equal, "job", "a")
+	bucket := store.bigBuckets(start, start)[0]
+	for _, tc := range []struct {
+		from     model.Time
+		expected int
+	}{
+		{0, 2},
+		{start, 2},
+		{start.Add(2 * time.Hour), 1},
+		{start.Add(4 * time.Hour), 0},
+	} {
+		input, err := matcherQueryInput(bucket.tableName, bucket.hashValues("0", "foo")[0], bucket.schema, matcher, tc.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := store.debugQuery(ctx, input, matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != tc.expected {
+			t.Fatalf("from %v: expected %d entries, got %v", tc.from, tc.expected, rows)
+		}
+	}
+
+	chunks, err := store.Get(ctx, start.Add(2*time.Hour), start.Add(4*time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || !chunks[0].Metric.Equal(late) {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
@@ -0,0 +1,238 @@
+package chunk
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+)
+
+var (
+	reencodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_reencode_seconds",
+		Help:      "Time spent re-encoding all users' old chunks.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	}, []string{"operation", "status_code"})
+	reencodedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_reencoded_chunks_total",
+		Help:      "The number of old chunks read for re-encoding, by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(reencodeDuration)
+	prometheus.MustRegister(reencodedChunks)
+}
+
+// ReencodeStats reports the outcome of Reencode.
+type ReencodeStats struct {
+	Chunks    int // Chunks re-encoded.
+	Unchanged int // Chunks already in the encoding, or whose samples don't fit one chunk in it.
+	Skipped   int // Chunks which couldn't be fetched or decoded.
+}
+
+// Reencode rewrites userID's chunks in S3 which ended between from and
+// through, and aren't already in the given Prometheus chunk encoding, in
+// that encoding and the store's configured chunk format and compression.
+// Each chunk is rewritten in place, under the same key and ID, so its index
+// entries don't change, and readers see either the old or the new object;
+// range reads which see both fall back to fetching the new object whole.
+// Chunks whose samples don't fit in a single chunk in the new encoding are
+// left alone, as are chunks whose metadata is in the index.  Only chunks in
+// index buckets which are closed, so no more chunks are written to them,
+// should be re-encoded.
+func (c *AWSStore) Reencode(ctx context.Context, userID string, from, through model.Time, encoding prom_chunk.Encoding) (ReencodeStats, error) {
+	var stats ReencodeStats
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		for _, l := range listed {
+			if l.through < from || l.through >= through {
+				continue
+			}
+			if err := c.reencodeChunk(ctx, l.key, l.id, encoding, &stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	log.Infof("Re-encoded %d chunks of user %s, left %d unchanged, skipped %d", stats.Chunks, userID, stats.Unchanged, stats.Skipped)
+	return stats, nil
+}
+
+// reencodeChunk re-encodes the chunk stored under key, if it needs it.
+// Failures to read the chunk are counted as skipped; failures to write it
+// back are returned.
+func (c *AWSStore) reencodeChunk(ctx context.Context, key, chunkID string, encoding prom_chunk.Encoding, stats *ReencodeStats) error {
+	buf, _, err := c.fetchObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.cfg.BucketName),
+		Key:    aws.String(key),
+	})
+	var chunk Chunk
+	if err == nil {
+		chunk = Chunk{ID: chunkID}
+		err = chunk.decode(bytes.NewReader(buf))
+	}
+	if err != nil {
+		log.Warnf("Skipping chunk %s: %v", key, err)
+		reencodedChunks.WithLabelValues("skipped").Inc()
+		stats.Skipped++
+		return nil
+	}
+
+	reencoded, ok, err := chunk.reencode(encoding)
+	if err != nil {
+		log.Warnf("Skipping chunk %s: %v", key, err)
+		reencodedChunks.WithLabelValues("skipped").Inc()
+		stats.Skipped++
+		return nil
+	}
+	if !ok {
+		reencodedChunks.WithLabelValues("unchanged").Inc()
+		stats.Unchanged++
+		return nil
+	}
+
+	body, err := reencoded.encode(c.cfg.ChunkFormatVersion)
+	if err != nil {
+		return err
+	}
+	if c.cfg.ChunkCompression != ChunkCompressionNone {
+		if body, err = compressChunk(body, c.cfg.ChunkCompression); err != nil {
+			return err
+		}
+	}
+	err = instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		_, err := c.cfg.S3.PutObject(c.putObjectInput(key, body))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	reencodedChunks.WithLabelValues("reencoded").Inc()
+	stats.Chunks++
+	return nil
+}
+
+// reencode returns the chunk with its samples in the given encoding, and
+// whether that changed it: chunks already in the encoding, or whose samples
+// don't fit in one chunk in it, are not re-encoded.
+func (c *Chunk) reencode(encoding prom_chunk.Encoding) (Chunk, bool, error) {
+	if c.Encoding == encoding {
+		return Chunk{}, false, nil
+	}
+	samples, err := c.samples()
+	if err != nil {
+		return Chunk{}, false, err
+	}
+	pc, err := prom_chunk.NewForEncoding(encoding)
+	if err != nil {
+		return Chunk{}, false, err
+	}
+	for _, s := range samples {
+		pcs, err := pc.Add(s)
+		if err != nil {
+			return Chunk{}, false, err
+		}
+		if len(pcs) > 1 {
+			return Chunk{}, false, nil
+		}
+		pc = pcs[0]
+	}
+	reencoded := *c
+	reencoded.Encoding = encoding
+	reencoded.Data = pc
+	return reencoded, true, nil
+}
+
+// Reencoder periodically re-encodes every user's chunks in closed index
+// buckets which aren't in the given encoding.  Each run only looks at chunks
+// which have closed since the last, so only the first run re-encodes the
+// whole history.  Only one process needs to run it.
+type Reencoder struct {
+	store    *AWSStore
+	encoding prom_chunk.Encoding
+	minAge   time.Duration
+	interval time.Duration
+	done     chan struct{}
+	wait     sync.WaitGroup
+
+	// Chunks which ended before this have been re-encoded.
+	reencodedThrough model.Time
+}
+
+// NewReencoder makes a new Reencoder, re-encoding chunks into encoding every
+// interval, once they ended at least minAge ago.  minAge should be long
+// enough that no more chunks are written to their index buckets.
+func NewReencoder(store *AWSStore, encoding prom_chunk.Encoding, minAge, interval time.Duration) *Reencoder {
+	return &Reencoder{
+		store:    store,
+		encoding: encoding,
+		minAge:   minAge,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start the Reencoder
+func (r *Reencoder) Start() {
+	r.wait.Add(1)
+	go r.loop()
+}
+
+// Stop the Reencoder
+func (r *Reencoder) Stop() {
+	close(r.done)
+	r.wait.Wait()
+}
+
+func (r *Reencoder) loop() {
+	defer r.wait.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := instrument.TimeRequestHistogram(context.Background(), "Reencoder.reencodeAll", reencodeDuration, r.reencodeAll); err != nil {
+			log.Errorf("Error re-encoding chunks: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// reencodeAll re-encodes every user's chunks which have closed since the
+// last run.  If any user's chunks fail, they are all retried next time.
+func (r *Reencoder) reencodeAll(ctx context.Context) error {
+	through := model.TimeFromUnixNano(mtime.Now().Add(-r.minAge).UnixNano())
+	userIDs, err := r.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, userID := range userIDs {
+		if _, err := r.store.Reencode(ctx, userID, r.reencodedThrough, through, r.encoding); err != nil {
+			log.Warnf("Could not re-encode chunks of %s: %v", userID, err)
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		r.reencodedThrough = through
+	}
+	return lastErr
+}
@@ -0,0 +1,78 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestReencode(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	c := newTestChunk(t, now.Add(-48*time.Hour), 100)
+	if c.Encoding != prom_chunk.DoubleDelta {
+		t.Fatalf("expected a double-delta chunk, got %v", c.Encoding)
+	}
+	expected, err := c.samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewAWSStore(StoreConfig{
+		S3:                 NewMemoryObjectClient(),
+		BucketName:         "chunks",
+		DynamoDB:           NewMemoryIndexClient(),
+		TableName:          "index",
+		ChunkFormatVersion: ChunkFormatV2,
+	})
+	if err := store.Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks ending after the time range are left alone.
+	stats, err := store.Reencode(ctx, "0", 0, now.Add(-72*time.Hour), prom_chunk.Varbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (ReencodeStats{}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	stats, err = store.Reencode(ctx, "0", 0, now.Add(-24*time.Hour), prom_chunk.Varbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (ReencodeStats{Chunks: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-72*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].Encoding != prom_chunk.Varbit {
+		t.Fatalf("expected one varbit chunk, got %v", chunks)
+	}
+	samples, err := chunks[0].samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, samples) {
+		t.Fatalf("re-encoding changed samples: expected %v, got %v", expected, samples)
+	}
+
+	stats, err = store.Reencode(ctx, "0", 0, now.Add(-24*time.Hour), prom_chunk.Varbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (ReencodeStats{Unchanged: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,239 @@
+package chunk
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+)
+
+var (
+	purgeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_purge_seconds",
+		Help:      "Time spent deleting all users' chunks older than their retention period.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	}, []string{"operation", "status_code"})
+	purgedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_purged_chunks_total",
+		Help:      "The number of chunks deleted, with their index entries, for being older than their retention period.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(purgeDuration)
+	prometheus.MustRegister(purgedChunks)
+}
+
+// RetentionConfig configures how long chunks are kept before being deleted,
+// with their index entries, by Purge.
+type RetentionConfig struct {
+	// Chunks which ended longer ago than this are deleted.  If zero, chunks
+	// are kept forever.
+	Period time.Duration
+
+	// Overrides of Period by user.  Zero keeps a user's chunks forever.
+	UserPeriods map[string]time.Duration
+}
+
+// PeriodFor returns the retention period for userID's chunks.
+func (cfg RetentionConfig) PeriodFor(userID string) time.Duration {
+	if period, ok := cfg.UserPeriods[userID]; ok {
+		return period
+	}
+	return cfg.Period
+}
+
+// ParseRetentionOverrides parses per-user retention periods, in the form
+// "user=720h;other-user=0".
+func ParseRetentionOverrides(s string) (map[string]time.Duration, error) {
+	periods := map[string]time.Duration{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid retention override %q, expected user=period", entry)
+		}
+		period, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention override %q: %v", entry, err)
+		}
+		periods[parts[0]] = period
+	}
+	return periods, nil
+}
+
+// PurgeStats reports the outcome of Purge.
+type PurgeStats struct {
+	Chunks  int // Chunks deleted, with their index entries.
+	Skipped int // Chunks which couldn't be fetched or decoded, so weren't deleted.
+}
+
+// Purge deletes userID's chunks in S3 which ended before before, and their
+// index entries.  A chunk's index entries are found from its metadata, so
+// they are deleted before it is, and chunks whose metadata is in the index,
+// or which can't be read, are skipped.  Chunks stored inline in the index
+// aren't found; NewStore requires IndexEntryTTL to expire them, and it
+// should be at most the retention period.
+func (c *AWSStore) Purge(ctx context.Context, userID string, before model.Time) (PurgeStats, error) {
+	var stats PurgeStats
+	err := c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		return c.purge(ctx, userID, listed, before, &stats)
+	})
+	return stats, err
+}
+
+// purge deletes the listed chunks which ended before before.
+func (c *AWSStore) purge(ctx context.Context, userID string, listed []listedChunk, before model.Time, stats *PurgeStats) error {
+	var chunks []Chunk
+	keys := map[string]string{}
+	for _, l := range listed {
+		if l.through >= before {
+			continue
+		}
+		chunks = append(chunks, Chunk{ID: l.id})
+		keys[l.id] = l.key
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	chunks, skipped := c.fetchChunksForRebuild(ctx, userID, chunks)
+	stats.Skipped += skipped
+	if len(chunks) == 0 {
+		return nil
+	}
+	if err := c.deleteIndexEntries(ctx, userID, chunks); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		key := keys[chunk.ID]
+		err := instrument.TimeRequestHistogram(ctx, "S3.DeleteObject", s3RequestDuration, func(_ context.Context) error {
+			_, err := c.cfg.S3.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(c.cfg.BucketName),
+				Key:    aws.String(key),
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		purgedChunks.Inc()
+		stats.Chunks++
+	}
+	log.Infof("Deleted %d chunks of user %s", stats.Chunks, userID)
+	return nil
+}
+
+// deleteIndexEntries deletes the index entries written for chunks, and the
+// persisted sketches of their buckets.
+func (c *AWSStore) deleteIndexEntries(ctx context.Context, userID string, chunks []Chunk) error {
+	writeReqs, err := c.calculateDynamoWrites(userID, chunks)
+	if err != nil {
+		return err
+	}
+	deleteReqs := make(map[string][]*dynamodb.WriteRequest, len(writeReqs))
+	for tableName, reqs := range writeReqs {
+		for _, req := range reqs {
+			item := req.PutRequest.Item
+			deleteReqs[tableName] = append(deleteReqs[tableName], &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{
+					Key: map[string]*dynamodb.AttributeValue{
+						hashKey:  item[hashKey],
+						rangeKey: item[rangeKey],
+					},
+				},
+			})
+		}
+	}
+	if err := c.dynamo.batchWriteDynamo(ctx, deleteReqs); err != nil {
+		return err
+	}
+	return c.invalidateSketches(ctx, userID, chunks)
+}
+
+// Purger periodically deletes every user's chunks older than their retention
+// period.  Only one process needs to run it.
+type Purger struct {
+	store    *AWSStore
+	cfg      RetentionConfig
+	interval time.Duration
+	done     chan struct{}
+	wait     sync.WaitGroup
+}
+
+// NewPurger makes a new Purger, purging chunks every interval.
+func NewPurger(store *AWSStore, cfg RetentionConfig, interval time.Duration) *Purger {
+	return &Purger{
+		store:    store,
+		cfg:      cfg,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start the Purger
+func (p *Purger) Start() {
+	p.wait.Add(1)
+	go p.loop()
+}
+
+// Stop the Purger
+func (p *Purger) Stop() {
+	close(p.done)
+	p.wait.Wait()
+}
+
+func (p *Purger) loop() {
+	defer p.wait.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := instrument.TimeRequestHistogram(context.Background(), "Purger.purgeAll", purgeDuration, p.purgeAll); err != nil {
+			log.Errorf("Error purging chunks: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// purgeAll purges every user's old chunks.  A failure for one user doesn't
+// stop the others being purged.
+func (p *Purger) purgeAll(ctx context.Context) error {
+	userIDs, err := p.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, userID := range userIDs {
+		period := p.cfg.PeriodFor(userID)
+		if period <= 0 {
+			continue
+		}
+		before := model.TimeFromUnixNano(mtime.Now().Add(-period).UnixNano())
+		if _, err := p.store.Purge(ctx, userID, before); err != nil {
+			log.Warnf("Could not purge chunks of %s: %v", userID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
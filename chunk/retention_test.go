@@ -0,0 +1,73 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestPurge(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	oldChunk := newTestChunk(t, now.Add(-48*time.Hour), 10)
+	newChunk := newTestChunk(t, now, 10)
+
+	objects := NewMemoryObjectClient().(*memoryObjectClient)
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+	if err := store.Put(ctx, []Chunk{oldChunk, newChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.Purge(ctx, "0", now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (PurgeStats{Chunks: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, ok := objects.objects["chunks"][chunkName("0", oldChunk.ID)]; ok {
+		t.Fatal("old chunk not deleted")
+	}
+
+	// The old chunk's index entries are gone too, so querying its time range
+	// doesn't fail fetching it.
+	for _, matchers := range [][]*metric.LabelMatcher{
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")},
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz")},
+	} {
+		chunks, err := store.Get(ctx, now.Add(-72*time.Hour), now, matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]Chunk{newChunk}, chunks) {
+			t.Fatalf("wrong chunks - %s", diff([]Chunk{newChunk}, chunks))
+		}
+	}
+}
+
+func TestRetentionPeriods(t *testing.T) {
+	periods, err := ParseRetentionOverrides("a=720h; b=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := RetentionConfig{Period: time.Hour, UserPeriods: periods}
+	for userID, expected := range map[string]time.Duration{"a": 720 * time.Hour, "b": 0, "c": time.Hour} {
+		if period := cfg.PeriodFor(userID); period != expected {
+			t.Errorf("%s: expected %v, got %v", userID, expected, period)
+		}
+	}
+	if _, err := ParseRetentionOverrides("a"); err == nil {
+		t.Error("expected error for override without a period")
+	}
+}
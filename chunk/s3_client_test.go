@@ -0,0 +1,129 @@
+package chunk
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestRegisterObjectClient(t *testing.T) {
+	mock := NewMockS3()
+	RegisterObjectClient("mock", func(u *url.URL) (ObjectClient, string, error) {
+		return mock, u.Host, nil
+	})
+
+	client, bucketName, err := NewObjectClient("mock://bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != mock || bucketName != "bucket" {
+		t.Fatalf("unexpected client %v for bucket %q", client, bucketName)
+	}
+
+	// Built in object stores are registered too.
+	if client, bucketName, err = NewObjectClient("inmemory://chunks"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.(*memoryObjectClient); !ok || bucketName != "chunks" {
+		t.Fatalf("unexpected client %T for bucket %q", client, bucketName)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a scheme twice to panic")
+		}
+	}()
+	RegisterObjectClient("mock", nil)
+}
+
+func TestNewStoreStorageURL(t *testing.T) {
+	store, err := NewStore(StoreConfig{StorageURL: "inmemory://chunks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.cfg.S3.(*memoryObjectClient); !ok || store.cfg.BucketName != "chunks" {
+		t.Fatalf("unexpected client %T for bucket %q", store.cfg.S3, store.cfg.BucketName)
+	}
+}
+
+func TestNewStoreInlineChunks(t *testing.T) {
+	for _, tc := range []struct {
+		maxSize     int
+		ttl         time.Duration
+		bucketIndex BucketIndexConfig
+		nameless    bool
+		err         bool
+	}{
+		{100, time.Hour, BucketIndexConfig{}, false, false},
+		{MaxInlineChunkSize, time.Hour, BucketIndexConfig{}, false, false},
+		{MaxInlineChunkSize + 1, time.Hour, BucketIndexConfig{}, false, true},
+		{100, 0, BucketIndexConfig{}, false, true},
+		{100, time.Hour, BucketIndexConfig{RefreshInterval: time.Minute}, false, true},
+		{100, time.Hour, BucketIndexConfig{BloomFilters: 10}, false, true},
+		{100, time.Hour, BucketIndexConfig{}, true, true},
+	} {
+		_, err := NewStore(StoreConfig{
+			StorageURL:         "inmemory://chunks",
+			InlineChunkMaxSize: tc.maxSize,
+			IndexEntryTTL:      tc.ttl,
+			BucketIndex:        tc.bucketIndex,
+			NamelessQueries:    NamelessQueryConfig{Enabled: tc.nameless},
+		})
+		if (err != nil) != tc.err {
+			t.Errorf("max size %d, TTL %v, %+v, nameless %v: expected error %v, got %v", tc.maxSize, tc.ttl, tc.bucketIndex, tc.nameless, tc.err, err)
+		}
+	}
+}
+
+// putRecordingClient is an ObjectClient recording the inputs to PutObject.
+type putRecordingClient struct {
+	ObjectClient
+	inputs []*s3.PutObjectInput
+}
+
+func (c *putRecordingClient) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	c.inputs = append(c.inputs, input)
+	return c.ObjectClient.PutObject(input)
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	for _, cfg := range []StoreConfig{
+		{ServerSideEncryption: "AES128"},
+		{ServerSideEncryption: s3.ServerSideEncryptionAes256, SSEKMSKeyID: "key"},
+	} {
+		if _, err := NewStore(cfg); err == nil {
+			t.Errorf("expected error for %q with key %q", cfg.ServerSideEncryption, cfg.SSEKMSKeyID)
+		}
+	}
+
+	client := &putRecordingClient{ObjectClient: NewMemoryObjectClient()}
+	store, err := NewStore(StoreConfig{
+		S3:                   client,
+		BucketName:           "chunks",
+		DynamoDB:             NewMemoryIndexClient(),
+		TableName:            "index",
+		ServerSideEncryption: s3.ServerSideEncryptionAwsKms,
+		SSEKMSKeyID:          "key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := user.WithID(context.Background(), "0")
+	if err := store.Put(ctx, []Chunk{newTestChunk(t, model.Now(), 10)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.inputs) != 1 {
+		t.Fatalf("expected 1 object written, got %d", len(client.inputs))
+	}
+	input := client.inputs[0]
+	if aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms || aws.StringValue(input.SSEKMSKeyId) != "key" {
+		t.Fatalf("unexpected encryption %v with key %v", input.ServerSideEncryption, input.SSEKMSKeyId)
+	}
+}
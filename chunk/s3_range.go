@@ -0,0 +1,179 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// Number of bytes fetched from the start of a chunk before its header has
+// been decoded.  Large enough to hold the header of most chunks, and all of
+// a typical version 1 chunk.
+const rangeReadPrefetch = 4096
+
+var s3RangeReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "s3_range_reads_total",
+	Help:      "Chunks fetched with S3 range GETs, by how much of the chunk was fetched.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(s3RangeReads)
+}
+
+// wantRangeRead returns true if the query between from and through only
+// needs a small enough part of chunk to be worth fetching with range GETs.
+// Chunks found in the index only have an ID, so their time range is taken
+// from that.
+func (c *AWSStore) wantRangeRead(chunk *Chunk, from, through model.Time) bool {
+	if c.cfg.RangeReadFraction <= 0 || chunk.metadataInIndex {
+		return false
+	}
+	_, chunkFrom, chunkThrough, err := parseChunkID(chunk.ID)
+	if err != nil || chunkThrough <= chunkFrom {
+		return false
+	}
+	if from < chunkFrom {
+		from = chunkFrom
+	}
+	if through > chunkThrough {
+		through = chunkThrough
+	}
+	return float64(through-from) < c.cfg.RangeReadFraction*float64(chunkThrough-chunkFrom)
+}
+
+// fetchChunkRange fetches the blocks of chunk overlapping from and through.
+// The start of the chunk is fetched first, to find its block index; version
+// 1 chunks, and version 2 chunks whose header doesn't fit in that, are
+// fetched whole.
+//
+// Chunks can be rewritten in place, eg by re-encoding, so the blocks are
+// only fetched if the chunk's ETag still matches the one its start was
+// fetched with.  If it doesn't, or the object client doesn't return ETags,
+// the chunk is fetched whole instead.
+func (c *AWSStore) fetchChunkRange(ctx context.Context, userID string, chunk *Chunk, from, through model.Time) error {
+	prefix, etag, complete, err := c.getObjectRange(ctx, userID, chunk.ID, 0, rangeReadPrefetch, nil)
+	if err != nil {
+		return err
+	}
+	if complete {
+		s3RangeReads.WithLabelValues("whole").Inc()
+		return corruptChunkError(chunk, chunk.decode(bytes.NewReader(prefix)))
+	}
+
+	var blocks []chunkBlock
+	dataStart := 0
+	if bytes.HasPrefix(prefix, []byte(chunkV2Magic)) {
+		blocks, dataStart, err = chunk.decodeV2Header(prefix)
+		if err != nil && err != errShortHeader {
+			return corruptChunkError(chunk, err)
+		}
+	}
+	if blocks == nil {
+		s3RangeReads.WithLabelValues("fallback").Inc()
+		return c.fetchWholeChunk(ctx, userID, chunk)
+	}
+
+	first, last := -1, -1
+	for i, block := range blocks {
+		if block.Through >= from && block.From <= through {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		s3RangeReads.WithLabelValues("none").Inc()
+		chunk.partial = true
+		return chunk.decodeBlocks(nil, nil)
+	}
+	blocks = blocks[first : last+1]
+
+	start := dataStart + blocks[0].Offset
+	end := dataStart + blocks[len(blocks)-1].Offset + blocks[len(blocks)-1].Length
+	var data []byte
+	if end <= len(prefix) {
+		data = prefix[start:end]
+	} else {
+		if etag == nil {
+			s3RangeReads.WithLabelValues("fallback").Inc()
+			return c.fetchWholeChunk(ctx, userID, chunk)
+		}
+		data, _, _, err = c.getObjectRange(ctx, userID, chunk.ID, start, end-start, etag)
+		if isPreconditionFailed(err) {
+			s3RangeReads.WithLabelValues("changed").Inc()
+			return c.fetchWholeChunk(ctx, userID, chunk)
+		} else if err != nil {
+			return err
+		}
+		if len(data) != end-start {
+			return fmt.Errorf("short range read of chunk %s: got %d bytes, wanted %d", chunk.ID, len(data), end-start)
+		}
+	}
+	s3RangeReads.WithLabelValues("partial").Inc()
+	chunk.partial = true
+	return corruptChunkError(chunk, chunk.decodeBlocks(data, blocks))
+}
+
+// fetchWholeChunk fetches and decodes all of chunk.
+func (c *AWSStore) fetchWholeChunk(ctx context.Context, userID string, chunk *Chunk) error {
+	buf, _, _, err := c.getObjectRange(ctx, userID, chunk.ID, 0, -1, nil)
+	if err != nil {
+		return err
+	}
+	return corruptChunkError(chunk, chunk.decode(bytes.NewReader(buf)))
+}
+
+// getObjectRange fetches length bytes of a chunk from offset, or the rest of
+// the chunk if length is negative, failing if ifMatch is non-nil and doesn't
+// match the chunk's ETag.  It also returns the chunk's ETag, if known, and
+// whether the result holds the whole chunk.
+func (c *AWSStore) getObjectRange(ctx context.Context, userID, chunkID string, offset, length int, ifMatch *string) ([]byte, *string, bool, error) {
+	var byteRange *string
+	if length >= 0 {
+		byteRange = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		byteRange = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	start := time.Now()
+	buf, etag, err := c.fetchChunkObject(ctx, userID, chunkID, byteRange, ifMatch)
+	c.fetchLimiter.observe(time.Since(start), err)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return buf, etag, offset == 0 && (length < 0 || len(buf) < length), nil
+}
+
+// contentETag returns an ETag for an object's content, for object clients
+// which emulate S3's.
+func contentETag(buf []byte) string {
+	sum := md5.Sum(buf)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// preconditionFailedError is the error object clients emulating S3 return
+// when a GET's IfMatch doesn't match the object's ETag.
+func preconditionFailedError(key string) error {
+	return awserr.NewRequestFailure(awserr.New("PreconditionFailed", fmt.Sprintf("object %s has changed", key), nil), http.StatusPreconditionFailed, "")
+}
+
+// isPreconditionFailed returns whether err is from a GET whose IfMatch didn't
+// match the object's ETag.
+func isPreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusPreconditionFailed {
+		return true
+	}
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "PreconditionFailed"
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -59,8 +62,84 @@ func (m *MockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error
 	if !ok {
 		return nil, fmt.Errorf("not found")
 	}
+	etag := contentETag(buf)
+	if input.IfMatch != nil && *input.IfMatch != etag {
+		return nil, preconditionFailedError(*input.Key)
+	}
+
+	if input.Range != nil {
+		var start, end int
+		if n, _ := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); n == 0 {
+			return nil, fmt.Errorf("invalid range %q", *input.Range)
+		} else if n == 1 || end >= len(buf) {
+			end = len(buf) - 1
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid range %q", *input.Range)
+		}
+		buf = buf[start : end+1]
+	}
 
 	return &s3.GetObjectOutput{
 		Body: ioutil.NopCloser(bytes.NewBuffer(buf)),
+		ETag: aws.String(etag),
 	}, nil
 }
+
+func (m *MockS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if bucket, ok := m.buckets[*input.Bucket]; ok {
+		delete(bucket.objects, *input.Key)
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjects returns at most two keys or common prefixes per page, to
+// exercise pagination.
+func (m *MockS3) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	output := &s3.ListObjectsOutput{IsTruncated: aws.Bool(false)}
+	bucket, ok := m.buckets[*input.Bucket]
+	if !ok {
+		return output, nil
+	}
+
+	var keys []string
+	for key := range bucket.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	prefix, delimiter, marker := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter), aws.StringValue(input.Marker)
+	var last string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		entry, isPrefix := key, false
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry, isPrefix = key[:len(prefix)+i+len(delimiter)], true
+			if entry == marker || entry == last {
+				continue
+			}
+		}
+		if len(output.Contents)+len(output.CommonPrefixes) == 2 {
+			output.IsTruncated = aws.Bool(true)
+			break
+		}
+		if isPrefix {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+		} else {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(entry)})
+		}
+		last = entry
+	}
+	if delimiter != "" && last != "" {
+		output.NextMarker = aws.String(last)
+	}
+	return output, nil
+}
@@ -0,0 +1,50 @@
+package chunk
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// Scan implements Store.  It lists the user's chunks in S3, rather than
+// reading the index, so it needs no metric names, and fetches them whole a
+// page of the listing at a time.  Chunks stored only in their index entries
+// aren't visited, and chunks which can't be fetched or decoded, including
+// those written with their metadata in the index, are logged and skipped.
+func (c *AWSStore) Scan(ctx context.Context, from, through model.Time, callback func(Chunk) error) error {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return err
+	}
+
+	var scanned, skipped int
+	err = c.listChunkIDs(ctx, userID, func(listed []listedChunk) error {
+		var chunks []Chunk
+		for _, l := range listed {
+			if l.through < from || through < l.from {
+				continue
+			}
+			chunks = append(chunks, Chunk{ID: l.id})
+		}
+
+		chunks, pageSkipped := c.fetchChunksForRebuild(ctx, userID, chunks)
+		skipped += pageSkipped
+		sort.Sort(ByID(chunks))
+		for _, chunk := range chunks {
+			if err := callback(chunk); err != nil {
+				return err
+			}
+			scanned++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Scanned %d chunks of user %s, skipped %d", scanned, userID, skipped)
+	return nil
+}
@@ -0,0 +1,69 @@
+package chunk
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestScan(t *testing.T) {
+	now := model.Now()
+	oldChunk := newTestChunk(t, now.Add(-48*time.Hour), 10)
+	newChunk := newTestChunk(t, now, 10)
+
+	store := NewAWSStore(StoreConfig{
+		S3:             NewMemoryObjectClient(),
+		BucketName:     "chunks",
+		DynamoDB:       NewMemoryIndexClient(),
+		TableName:      "index",
+		ChunkKeyShards: 4,
+	})
+	for _, userID := range []string{"0", "1"} {
+		if err := store.Put(user.WithID(context.Background(), userID), []Chunk{oldChunk, newChunk}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.storeSelectivity(context.Background(), selectivityName("0", "foo"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := user.WithID(context.Background(), "0")
+	for _, tc := range []struct {
+		from, through model.Time
+		expected      []Chunk
+	}{
+		{0, now, []Chunk{oldChunk, newChunk}},
+		{now.Add(-time.Hour), now, []Chunk{newChunk}},
+		{now.Add(-72 * time.Hour), now.Add(-47 * time.Hour), []Chunk{oldChunk}},
+		{now.Add(-24 * time.Hour), now.Add(-time.Hour), nil},
+	} {
+		var scanned []Chunk
+		if err := store.Scan(ctx, tc.from, tc.through, func(chunk Chunk) error {
+			scanned = append(scanned, chunk)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(ByID(scanned))
+		if !reflect.DeepEqual(tc.expected, scanned) {
+			t.Fatalf("wrong chunks - %s", diff(tc.expected, scanned))
+		}
+	}
+
+	// The scan stops at the callback's first error.
+	calls := 0
+	err := store.Scan(ctx, 0, now, func(Chunk) error {
+		calls++
+		return fmt.Errorf("stop")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("expected scan to stop after 1 call with an error, got %d calls and %v", calls, err)
+	}
+}
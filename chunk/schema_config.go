@@ -0,0 +1,264 @@
+package chunk
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Versions of the layout of index entries' hash and range keys.
+const (
+	// IndexSchemaV1 hashes entries by user, bucket and metric name, and
+	// ranges them by label name, label value and chunk ID.
+	IndexSchemaV1 = "v1"
+	// IndexSchemaV2 is IndexSchemaV1 with hashed hash keys, spreading each
+	// metric's entries over PeriodConfig.Shards shards by series, so heavy
+	// metrics don't make hot partitions.  Reads query every shard.
+	IndexSchemaV2 = "v2"
+	// IndexSchemaV3 is IndexSchemaV2 with base64-encoded label names and
+	// values in range keys, so label values may hold any bytes; see
+	// rangeValueV2Prefix.
+	IndexSchemaV3 = "v3"
+	// IndexSchemaV4 is IndexSchemaV3 with extra entries keyed by label name,
+	// so label values, and the label names of all series or of a metric, can
+	// be listed without reading every series' entries, and queries without a
+	// metric name looked up; see labelValuesName.
+	IndexSchemaV4 = "v4"
+	// IndexSchemaV5 is IndexSchemaV4 with an extra entry per chunk holding
+	// its whole metric, so series can be listed without reading chunks; see
+	// seriesName.
+	IndexSchemaV5 = "v5"
+	// IndexSchemaV6 is IndexSchemaV5 with chunks' end times in range keys,
+	// before their IDs, so lookups of equality matchers skip the entries of
+	// chunks ending before the query in the index itself; see
+	// rangeValueV3Prefix.
+	IndexSchemaV6 = "v6"
+
+	// Shards of periods from IndexSchemaV2 on parsed without a number of
+	// shards.
+	defaultIndexShards = 16
+)
+
+// SchemaConfig lists the index schemas in effect over time, so that new
+// index layouts, bucket sizes and tables can be rolled out for new data by
+// config alone, while older data is still read with the schema it was
+// written with.
+type SchemaConfig struct {
+	// In order of From.  The first period is in effect from the beginning
+	// of time, and each until the next one's From.  If empty, buckets are
+	// hourly until StoreConfig.DailyBucketsFrom, and daily after.
+	Periods []PeriodConfig
+}
+
+// PeriodConfig is the index schema in effect from a day on.
+type PeriodConfig struct {
+	// Only the day matters, not the time within the day.
+	From model.Time
+
+	// Layout of index entries; see IndexSchemaV1.
+	Schema string
+
+	// Size of the buckets index entries are hashed by: time.Hour or
+	// 24*time.Hour.
+	BucketSize time.Duration
+
+	// Prefix of the periodic tables the index is written to, if periodic
+	// tables are used.  If empty, PeriodicTableConfig.TablePrefix.
+	TablePrefix string
+
+	// Number of shards each metric's entries are spread over, for
+	// IndexSchemaV2 and later.
+	Shards int
+
+	// Labels, eg job or namespace, chunks are also indexed by, as if each
+	// of their values were a metric name, so queries without a metric name
+	// but with an equality matcher on one of them can be looked up in the
+	// index.
+	IndexedLabels []model.LabelName
+}
+
+// Validate returns an error if the periods are out of order, or use an
+// unknown schema or bucket size.
+func (cfg SchemaConfig) Validate() error {
+	for i, p := range cfg.Periods {
+		switch p.Schema {
+		case IndexSchemaV1:
+			if p.Shards != 0 {
+				return fmt.Errorf("index schema %s can't be sharded", p.Schema)
+			}
+		case IndexSchemaV2, IndexSchemaV3, IndexSchemaV4, IndexSchemaV5, IndexSchemaV6:
+			if p.Shards <= 0 {
+				return fmt.Errorf("index schema %s needs a positive number of shards", p.Schema)
+			}
+		default:
+			return fmt.Errorf("unknown index schema %q", p.Schema)
+		}
+		switch p.BucketSize {
+		case time.Hour, 24 * time.Hour:
+		default:
+			return fmt.Errorf("invalid index bucket size %v: must be 1h or 24h", p.BucketSize)
+		}
+		for _, label := range p.IndexedLabels {
+			if !label.IsValid() || label == model.MetricNameLabel {
+				return fmt.Errorf("invalid indexed label %q", label)
+			}
+		}
+		if i > 0 && p.start() <= cfg.Periods[i-1].start() {
+			return fmt.Errorf("index schema periods must start on increasing days, but %v follows %v", p.From, cfg.Periods[i-1].From)
+		}
+	}
+	return nil
+}
+
+// ParseSchemaConfig parses schema periods, in the form
+// "2017-01-01=v1,1h;2017-06-01=v1,24h,cortex_daily_;2017-09-01=v2,24h,,32,job+namespace",
+// where each period gives the day it starts, its schema, its bucket size
+// and, optionally, its table prefix, number of shards and indexed labels.
+func ParseSchemaConfig(s string) (SchemaConfig, error) {
+	var cfg SchemaConfig
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return SchemaConfig{}, fmt.Errorf("invalid index schema period %q, expected date=schema,bucket-size[,table-prefix[,shards[,indexed-labels]]]", entry)
+		}
+		from, err := time.Parse("2006-01-02", parts[0])
+		if err != nil {
+			return SchemaConfig{}, fmt.Errorf("invalid index schema period %q: %v", entry, err)
+		}
+		fields := strings.Split(parts[1], ",")
+		if len(fields) < 2 || len(fields) > 5 {
+			return SchemaConfig{}, fmt.Errorf("invalid index schema period %q, expected date=schema,bucket-size[,table-prefix[,shards[,indexed-labels]]]", entry)
+		}
+		bucketSize, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return SchemaConfig{}, fmt.Errorf("invalid index schema period %q: %v", entry, err)
+		}
+		period := PeriodConfig{
+			From:       model.TimeFromUnix(from.Unix()),
+			Schema:     fields[0],
+			BucketSize: bucketSize,
+		}
+		if len(fields) > 2 {
+			period.TablePrefix = fields[2]
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			if period.Shards, err = strconv.Atoi(fields[3]); err != nil {
+				return SchemaConfig{}, fmt.Errorf("invalid index schema period %q: %v", entry, err)
+			}
+		} else if period.Schema != IndexSchemaV1 {
+			period.Shards = defaultIndexShards
+		}
+		if len(fields) > 4 {
+			for _, label := range strings.Split(fields[4], "+") {
+				period.IndexedLabels = append(period.IndexedLabels, model.LabelName(label))
+			}
+		}
+		cfg.Periods = append(cfg.Periods, period)
+	}
+	return cfg, cfg.Validate()
+}
+
+// IndexesLabels returns whether any period indexes chunks by labels besides
+// their metric name.
+func (cfg SchemaConfig) IndexesLabels() bool {
+	for _, p := range cfg.Periods {
+		if len(p.IndexedLabels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelNameEntries returns whether any period writes index entries keyed by
+// label name, by which queries without a metric name can be looked up.
+func (cfg SchemaConfig) LabelNameEntries() bool {
+	for _, p := range cfg.Periods {
+		if labelNameEntries(p.Schema) {
+			return true
+		}
+	}
+	return false
+}
+
+// start returns the Unix time at which the period starts.
+func (p PeriodConfig) start() int64 {
+	return p.From.Unix() / secondsInDay * secondsInDay
+}
+
+// bucketName returns the name of the bucket of size bucketSize, which must
+// be an hour or a day, starting at bucketStart.
+func bucketName(bucketSize time.Duration, bucketStart int64) string {
+	if bucketSize == time.Hour {
+		return strconv.Itoa(int(bucketStart / secondsInHour))
+	}
+	return fmt.Sprintf("d%d", int(bucketStart/secondsInDay))
+}
+
+// end returns the Unix time at which the i'th period ends.
+func (cfg SchemaConfig) end(i int) int64 {
+	if i+1 < len(cfg.Periods) {
+		return cfg.Periods[i+1].start()
+	}
+	return math.MaxInt64
+}
+
+// periodAt returns the period in effect at Unix time t.
+func (cfg SchemaConfig) periodAt(t int64) PeriodConfig {
+	i := sort.Search(len(cfg.Periods), func(i int) bool {
+		return cfg.Periods[i].start() > t
+	})
+	if i > 0 {
+		i--
+	}
+	return cfg.Periods[i]
+}
+
+// tablePrefixes returns the distinct prefixes of periodic tables used
+// between Unix times from and through, exclusive, where defaultPrefix is
+// used by periods without their own.
+func (cfg SchemaConfig) tablePrefixes(defaultPrefix string, from, through int64) []string {
+	if len(cfg.Periods) == 0 {
+		return []string{defaultPrefix}
+	}
+	var (
+		seen     = map[string]struct{}{}
+		prefixes []string
+	)
+	for i, p := range cfg.Periods {
+		if cfg.end(i) <= from || (i > 0 && p.start() >= through) {
+			continue
+		}
+		prefix := p.TablePrefix
+		if prefix == "" {
+			prefix = defaultPrefix
+		}
+		if _, ok := seen[prefix]; !ok {
+			seen[prefix] = struct{}{}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// schema returns the configured schema, or else the legacy one: hourly
+// buckets until DailyBucketsFrom, and daily ones after.
+func (cfg StoreConfig) schema() SchemaConfig {
+	if len(cfg.Schema.Periods) > 0 {
+		return cfg.Schema
+	}
+	return SchemaConfig{
+		Periods: []PeriodConfig{
+			{Schema: IndexSchemaV1, BucketSize: time.Hour},
+			{From: cfg.DailyBucketsFrom, Schema: IndexSchemaV1, BucketSize: 24 * time.Hour},
+		},
+	}
+}
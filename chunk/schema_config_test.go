@@ -0,0 +1,142 @@
+package chunk
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestParseSchemaConfig(t *testing.T) {
+	cfg, err := ParseSchemaConfig("1970-01-01=v1,1h; 1970-01-02=v1,24h,daily_; 1970-01-03=v2,24h; 1970-01-04=v2,24h,,4; 1970-01-05=v3,24h,,,job+namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SchemaConfig{Periods: []PeriodConfig{
+		{From: 0, Schema: IndexSchemaV1, BucketSize: time.Hour},
+		{From: model.TimeFromUnix(secondsInDay), Schema: IndexSchemaV1, BucketSize: 24 * time.Hour, TablePrefix: "daily_"},
+		{From: model.TimeFromUnix(2 * secondsInDay), Schema: IndexSchemaV2, BucketSize: 24 * time.Hour, Shards: defaultIndexShards},
+		{From: model.TimeFromUnix(3 * secondsInDay), Schema: IndexSchemaV2, BucketSize: 24 * time.Hour, Shards: 4},
+		{From: model.TimeFromUnix(4 * secondsInDay), Schema: IndexSchemaV3, BucketSize: 24 * time.Hour, Shards: defaultIndexShards, IndexedLabels: []model.LabelName{"job", "namespace"}},
+	}}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, cfg)
+	}
+
+	for _, s := range []string{
+		"1970-01-01",
+		"1970-01-01=v1",
+		"1970-01-01=v0,1h",
+		"1970-01-01=v1,2h",
+		"1970-01-02=v1,1h;1970-01-01=v1,24h",
+		"1970-01-01=v1,1h;1970-01-01=v1,24h",
+		"1970-01-01=v2,1h,,0",
+		"1970-01-01=v2,1h,,x",
+		"1970-01-01=v2,1h,,,__name__",
+		"1970-01-01=v2,1h,,,0job",
+	} {
+		if _, err := ParseSchemaConfig(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestSchemaConfigBuckets(t *testing.T) {
+	day := func(d int64) model.Time { return model.TimeFromUnix(d * secondsInDay) }
+	store := &AWSStore{
+		cfg: StoreConfig{
+			TableName: "table",
+			Schema: SchemaConfig{Periods: []PeriodConfig{
+				{From: day(0), Schema: IndexSchemaV1, BucketSize: 24 * time.Hour},
+				{From: day(2), Schema: IndexSchemaV1, BucketSize: time.Hour, TablePrefix: "hourly_"},
+				{From: day(3), Schema: IndexSchemaV1, BucketSize: 24 * time.Hour},
+			}},
+			PeriodicTableConfig: PeriodicTableConfig{
+				UsePeriodicTables: true,
+				TablePrefix:       "daily_",
+				TablePeriod:       24 * time.Hour,
+			},
+		},
+	}
+
+	var expected []bucketSpec
+	expected = append(expected,
+		bucketSpec{tableName: "daily_0", bucket: "d0", schema: IndexSchemaV1},
+		bucketSpec{tableName: "daily_1", bucket: "d1", schema: IndexSchemaV1},
+	)
+	for h := 48; h < 72; h++ {
+		expected = append(expected, bucketSpec{tableName: "hourly_2", bucket: bucketName(time.Hour, int64(h)*secondsInHour), schema: IndexSchemaV1})
+	}
+	expected = append(expected, bucketSpec{tableName: "daily_3", bucket: "d3", schema: IndexSchemaV1})
+
+	if buckets := store.bigBuckets(day(0), day(4)-1); !reflect.DeepEqual(buckets, expected) {
+		t.Fatalf("expected %v, got %v", expected, buckets)
+	}
+
+	// The table manager makes a table for each prefix in use.
+	if prefixes := store.cfg.Schema.tablePrefixes("daily_", 2*secondsInDay-1, 3*secondsInDay+1); !reflect.DeepEqual(prefixes, []string{"daily_", "hourly_"}) {
+		t.Fatalf("unexpected table prefixes %v", prefixes)
+	}
+}
+
+func TestIndexSchemaV2(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	store := NewAWSStore(StoreConfig{
+		S3:         NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV2, BucketSize: 24 * time.Hour, Shards: 4},
+		}},
+	})
+
+	const series = 20
+	now := model.Now()
+	var samples []*model.Sample
+	for i := 0; i < series; i++ {
+		m := model.Metric{model.MetricNameLabel: "foo", "bar": model.LabelValue(fmt.Sprint(i)), "baz": "a"}
+		samples = append(samples, &model.Sample{Metric: m, Timestamp: now, Value: 1})
+	}
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		matchers []*metric.LabelMatcher
+		expected int
+	}{
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")}, series},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "baz", "a")}, series},
+		{[]*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "7")}, 1},
+	} {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, tc.matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != tc.expected {
+			t.Fatalf("%v: expected %d chunks, got %d", tc.matchers, tc.expected, len(chunks))
+		}
+	}
+
+	// The series' entries are spread over the shards.
+	results, err := store.DebugIndexQuery(ctx, "0", now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashValues := map[string]struct{}{}
+	for _, result := range results {
+		for _, row := range result.Rows {
+			hashValues[row.HashValue] = struct{}{}
+		}
+	}
+	if len(hashValues) < 2 {
+		t.Fatalf("expected entries under several hash values, got %v", hashValues)
+	}
+}
@@ -0,0 +1,335 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/scope/common/instrument"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+const (
+	// Persisted sketches found to be missing are looked up again after this
+	// long.
+	missingSketchTTL = time.Minute
+
+	// Cached sketches are reloaded after this long, as they are deleted when
+	// chunks in their buckets are written or deleted, perhaps by another
+	// process.
+	sketchCacheTTL = 10 * time.Minute
+)
+
+// SeriesCounter estimates the number of series for a metric without fetching
+// any chunks.
+type SeriesCounter interface {
+	SeriesCount(ctx context.Context, from, through model.Time, metricName model.LabelValue) (uint64, error)
+}
+
+// SeriesCount implements SeriesCounter.  It reads only the index, building a
+// HyperLogLog sketch per bucket; the persisted sketches for buckets older
+// than SeriesSketchMinAge are used instead, and, with SeriesSketchWriteOnRead,
+// those built for them are persisted to S3 so later counts don't have to read
+// the index again.  The count is at bucket granularity, so may include series
+// just outside the requested range.
+func (c *AWSStore) SeriesCount(ctx context.Context, from, through model.Time, metricName model.LabelValue) (uint64, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := c.mergeBucketSketches(c.bigBuckets(from, through), func(bucket bucketSpec) (*hyperLogLog, error) {
+		return c.bucketSketch(ctx, userID, bucket, metricName)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.count(), nil
+}
+
+// persistedSeriesCount estimates a lower bound on the number of series for a
+// metric using only persisted sketches, for use as a cheap pre-flight check.
+// Sketches are loaded in parallel, and cached.
+func (c *AWSStore) persistedSeriesCount(ctx context.Context, userID string, from, through model.Time, metricName model.LabelValue) uint64 {
+	var buckets []bucketSpec
+	for _, bucket := range c.bigBuckets(from, through) {
+		if c.sketchPersistable(bucket) {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	result, _ := c.mergeBucketSketches(buckets, func(bucket bucketSpec) (*hyperLogLog, error) {
+		sketch, err := c.cachedSketch(ctx, userID, bucket, metricName)
+		if err != nil {
+			return nil, nil
+		}
+		return sketch, nil
+	})
+	return result.count()
+}
+
+// mergeBucketSketches merges the sketches sketch returns for buckets, which
+// may be nil, calling it in parallel in at most SeriesSketchWorkers
+// goroutines.
+func (c *AWSStore) mergeBucketSketches(buckets []bucketSpec, sketch func(bucketSpec) (*hyperLogLog, error)) (*hyperLogLog, error) {
+	workers := len(buckets)
+	if c.cfg.SeriesSketchWorkers > 0 && c.cfg.SeriesSketchWorkers < workers {
+		workers = c.cfg.SeriesSketchWorkers
+	}
+	queue := make(chan bucketSpec, len(buckets))
+	for _, bucket := range buckets {
+		queue <- bucket
+	}
+	close(queue)
+
+	incomingSketches := make(chan *hyperLogLog)
+	incomingErrors := make(chan error)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for bucket := range queue {
+				s, err := sketch(bucket)
+				if err != nil {
+					incomingErrors <- err
+					continue
+				}
+				incomingSketches <- s
+			}
+		}()
+	}
+
+	result := newHyperLogLog()
+	var lastErr error
+	for i := 0; i < len(buckets); i++ {
+		select {
+		case s := <-incomingSketches:
+			if s != nil {
+				result.merge(s)
+			}
+		case err := <-incomingErrors:
+			lastErr = err
+		}
+	}
+	return result, lastErr
+}
+
+func (c *AWSStore) bucketSketch(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue) (*hyperLogLog, error) {
+	persistable := c.sketchPersistable(bucket)
+	if persistable {
+		if sketch, err := c.cachedSketch(ctx, userID, bucket, metricName); err == nil && sketch != nil {
+			return sketch, nil
+		}
+	}
+
+	chunks, _, err := c.lookupChunksForMetricName(ctx, userID, bucket, metricName)
+	if err != nil {
+		return nil, err
+	}
+	sketch := newHyperLogLog()
+	for _, chunk := range chunks {
+		fp, _, _, err := parseChunkID(chunk.ID)
+		if err != nil {
+			return nil, err
+		}
+		sketch.insert(fp)
+	}
+
+	if persistable && c.cfg.SeriesSketchWriteOnRead {
+		if err := c.storeSketch(ctx, userID, bucket, metricName, sketch); err != nil {
+			log.Warnf("Could not store series sketch for %s: %v", metricName, err)
+		} else {
+			c.sketches.put(sketchName(userID, bucket.bucket, metricName), sketch)
+		}
+	}
+	return sketch, nil
+}
+
+// seriesSketches caches persisted sketches for sketchCacheTTL.  Sketches
+// found to be missing are cached for missingSketchTTL, as they may be
+// persisted by the next count.  When the cache is full, an arbitrary entry is
+// evicted.
+type seriesSketches struct {
+	maxEntries int
+
+	mtx      sync.Mutex
+	sketches map[string]*seriesSketchEntry
+}
+
+type seriesSketchEntry struct {
+	sketch  *hyperLogLog // nil if the sketch is missing.
+	expires time.Time
+}
+
+func newSeriesSketches(maxEntries int) *seriesSketches {
+	return &seriesSketches{
+		maxEntries: maxEntries,
+		sketches:   map[string]*seriesSketchEntry{},
+	}
+}
+
+func (s *seriesSketches) get(key string) (*seriesSketchEntry, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entry, ok := s.sketches[key]
+	if ok && mtime.Now().After(entry.expires) {
+		delete(s.sketches, key)
+		return nil, false
+	}
+	return entry, ok
+}
+
+// put caches sketch under key; a nil sketch records that it is missing.
+func (s *seriesSketches) put(key string, sketch *hyperLogLog) {
+	if s.maxEntries <= 0 {
+		return
+	}
+	entry := &seriesSketchEntry{sketch: sketch, expires: mtime.Now().Add(sketchCacheTTL)}
+	if sketch == nil {
+		entry.expires = mtime.Now().Add(missingSketchTTL)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.sketches[key]; !ok && len(s.sketches) >= s.maxEntries {
+		for evict := range s.sketches {
+			delete(s.sketches, evict)
+			break
+		}
+	}
+	s.sketches[key] = entry
+}
+
+func (s *seriesSketches) delete(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.sketches, key)
+}
+
+// cachedSketch returns the persisted sketch for the bucket, loading it from
+// S3 if it isn't cached, or nil if it hasn't been persisted.
+func (c *AWSStore) cachedSketch(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue) (*hyperLogLog, error) {
+	key := sketchName(userID, bucket.bucket, metricName)
+	if entry, ok := c.sketches.get(key); ok {
+		return entry.sketch, nil
+	}
+	sketch, err := c.loadSketch(ctx, userID, bucket, metricName)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+			c.sketches.put(key, nil)
+			return nil, nil
+		}
+		return nil, err
+	}
+	c.sketches.put(key, sketch)
+	return sketch, nil
+}
+
+// sketchPersistable returns true if the bucket ended long enough ago that no
+// more chunks are expected to be written to it.
+func (c *AWSStore) sketchPersistable(bucket bucketSpec) bool {
+	if c.cfg.SeriesSketchMinAge <= 0 {
+		return false
+	}
+	end, err := bucketEnd(bucket.bucket)
+	if err != nil {
+		return false
+	}
+	return end.Add(c.cfg.SeriesSketchMinAge).Before(model.TimeFromUnixNano(mtime.Now().UnixNano()))
+}
+
+func (c *AWSStore) loadSketch(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue) (*hyperLogLog, error) {
+	var resp *s3.GetObjectOutput
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = c.cfg.S3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(c.cfg.BucketName),
+			Key:    aws.String(sketchName(userID, bucket.bucket, metricName)),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	sketch := newHyperLogLog()
+	if err := sketch.decode(buf); err != nil {
+		return nil, err
+	}
+	return sketch, nil
+}
+
+func (c *AWSStore) storeSketch(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, sketch *hyperLogLog) error {
+	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		_, err := c.cfg.S3.PutObject(c.putObjectInput(sketchName(userID, bucket.bucket, metricName), bytes.NewReader(sketch.encode())))
+		return err
+	})
+}
+
+// invalidateSketches deletes the persisted sketches of the buckets chunks
+// span, once their index entries have been written or deleted, so they are
+// rebuilt from the index.  Only buckets old enough to have sketches are
+// affected, so chunks flushed by ingesters cost nothing.
+func (c *AWSStore) invalidateSketches(ctx context.Context, userID string, chunks []Chunk) error {
+	if c.cfg.SeriesSketchMinAge <= 0 {
+		return nil
+	}
+	keys := map[string]struct{}{}
+	for _, chunk := range chunks {
+		metricName := chunk.Metric[model.MetricNameLabel]
+		for _, bucket := range c.bigBuckets(chunk.From, chunk.Through) {
+			if c.sketchPersistable(bucket) {
+				keys[sketchName(userID, bucket.bucket, metricName)] = struct{}{}
+			}
+		}
+	}
+	for key := range keys {
+		c.sketches.delete(key)
+		err := instrument.TimeRequestHistogram(ctx, "S3.DeleteObject", s3RequestDuration, func(_ context.Context) error {
+			_, err := c.cfg.S3.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(c.cfg.BucketName),
+				Key:    aws.String(key),
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sketchName is the S3 key for a sketch.  Chunk IDs never contain a '/', so
+// these can't collide with chunkName.
+func sketchName(userID, bucket string, metricName model.LabelValue) string {
+	return fmt.Sprintf("%s/sketches/%s/%s", userID, bucket, metricName)
+}
+
+// bucketEnd returns the time at which a bucket (as generated by bigBuckets)
+// ends.
+func bucketEnd(bucket string) (model.Time, error) {
+	period := int64(secondsInHour)
+	if strings.HasPrefix(bucket, "d") {
+		period = secondsInDay
+		bucket = bucket[1:]
+	}
+	i, err := strconv.ParseInt(bucket, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return model.TimeFromUnix((i + 1) * period), nil
+}
@@ -0,0 +1,134 @@
+package chunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// SeriesStore lists the series matching a query from the index alone,
+// without fetching any chunks.
+type SeriesStore interface {
+	MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]model.Metric, error)
+}
+
+// seriesName is the name chunks are indexed under from IndexSchemaV5 on with
+// a single entry holding their whole metric, in the metricKey attribute, so
+// a metric's series can be listed without fetching its chunks.
+func seriesName(metricName model.LabelValue) model.LabelValue {
+	return metricName + "{series}"
+}
+
+// seriesEntries returns whether series entries are written under schema.
+func seriesEntries(schema string) bool {
+	return schema == IndexSchemaV5 || schema == IndexSchemaV6
+}
+
+// seriesEntryHashValues returns the hash values the series entries of the
+// series with metric name metricName and fingerprint fp are written under in
+// the bucket, if any.
+func (b bucketSpec) seriesEntryHashValues(userID string, metricName model.LabelValue, fp model.Fingerprint) []string {
+	if !seriesEntries(b.schema) {
+		return nil
+	}
+	return []string{b.seriesHashValue(userID, seriesName(metricName), fp)}
+}
+
+// MetricsForLabelMatchers implements SeriesStore.  Series are indexed by
+// metric name, so queries without a metric name equality matcher fail, and
+// only buckets written with IndexSchemaV5 or later have the entries to
+// answer it, so older buckets contribute nothing.  The metrics are sorted.
+func (c *AWSStore) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]model.Metric, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metricName, matchers, err := extractMetricName(matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := map[model.Fingerprint]model.Metric{}
+	for _, bucket := range c.bigBuckets(from, through) {
+		if !seriesEntries(bucket.schema) {
+			continue
+		}
+		tables := []string{bucket.tableName}
+		if bucket.overlapTableName != "" {
+			tables = append(tables, bucket.overlapTableName)
+		}
+		for _, table := range tables {
+			for _, hashValue := range bucket.hashValues(userID, seriesName(metricName)) {
+				if err := c.querySeries(ctx, metricNameQueryInput(table, hashValue), from, through, metrics); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	result := make([]model.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if matchesAll(m, matchers) {
+			result = append(result, m)
+		}
+	}
+	sort.Sort(byMetric(result))
+	return result, nil
+}
+
+// querySeries adds the metrics of the series entries read by input, for
+// chunks overlapping from and through, to metrics.  A table which doesn't
+// exist has no entries.
+func (c *AWSStore) querySeries(ctx context.Context, input *dynamodb.QueryInput, from, through model.Time, metrics map[model.Fingerprint]model.Metric) error {
+	var processErr error
+	err := c.dynamo.queryPages(ctx, input, func(resp interface{}, lastPage bool) bool {
+		for _, item := range resp.(*dynamodb.QueryOutput).Items {
+			rangeValue, metricValue := item[rangeKey], item[metricKey]
+			if rangeValue == nil || rangeValue.B == nil || metricValue == nil {
+				processErr = fmt.Errorf("invalid item: %v", item)
+				return false
+			}
+			_, _, chunkID, err := parseRangeValue(rangeValue.B)
+			if err != nil {
+				processErr = err
+				return false
+			}
+			fp, chunkFrom, chunkThrough, err := parseChunkID(chunkID)
+			if err != nil {
+				processErr = err
+				return false
+			}
+			if _, ok := metrics[fp]; ok || chunkThrough < from || through < chunkFrom {
+				continue
+			}
+			var m model.Metric
+			if err := json.Unmarshal(metricValue.B, &m); err != nil {
+				processErr = err
+				return false
+			}
+			metrics[fp] = m
+		}
+		return true
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == resourceNotFoundException {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return processErr
+}
+
+type byMetric []model.Metric
+
+func (ms byMetric) Len() int           { return len(ms) }
+func (ms byMetric) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
+func (ms byMetric) Less(i, j int) bool { return ms[i].String() < ms[j].String() }
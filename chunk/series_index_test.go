@@ -0,0 +1,77 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestMetricsForLabelMatchers(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	objects := NewMemoryObjectClient()
+	store := NewAWSStore(StoreConfig{
+		S3:         objects,
+		BucketName: "chunks",
+		DynamoDB:   NewMemoryIndexClient(),
+		TableName:  "index",
+		Schema: SchemaConfig{Periods: []PeriodConfig{
+			{Schema: IndexSchemaV4, BucketSize: 24 * time.Hour, Shards: 2},
+			{From: now.Add(-48 * time.Hour), Schema: IndexSchemaV5, BucketSize: 24 * time.Hour, Shards: 2},
+		}},
+	})
+
+	var (
+		foo1 = model.Metric{model.MetricNameLabel: "foo", "job": "a", "instance": "1"}
+		foo2 = model.Metric{model.MetricNameLabel: "foo", "job": "b", "instance": "2"}
+		bar  = model.Metric{model.MetricNameLabel: "bar", "job": "a"}
+		// Written before series entries, so not listed.
+		old = model.Metric{model.MetricNameLabel: "foo", "job": "c"}
+	)
+	var samples []*model.Sample
+	for _, m := range []model.Metric{foo1, foo2, bar} {
+		// Several chunks of each series.
+		for _, ts := range []model.Time{now.Add(-2 * time.Hour), now} {
+			samples = append(samples, &model.Sample{Metric: m, Timestamp: ts, Value: 1})
+		}
+	}
+	samples = append(samples, &model.Sample{Metric: old, Timestamp: now.Add(-72 * time.Hour), Value: 1})
+	if _, err := Backfill(ctx, store, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		from     model.Time
+		matchers []*metric.LabelMatcher
+		expected []model.Metric
+	}{
+		{now.Add(-96 * time.Hour), []*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")}, []model.Metric{foo1, foo2}},
+		{now.Add(-96 * time.Hour), []*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "job", "b")}, []model.Metric{foo2}},
+		{now.Add(-time.Hour), []*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar")}, []model.Metric{bar}},
+		{now.Add(-time.Hour), []*metric.LabelMatcher{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "baz")}, []model.Metric{}},
+	} {
+		metrics, err := store.MetricsForLabelMatchers(ctx, tc.from, now, tc.matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(metrics, tc.expected) {
+			t.Fatalf("%v: expected %v, got %v", tc.matchers, tc.expected, metrics)
+		}
+	}
+
+	// Series are listed from the index alone.
+	objects.(*memoryObjectClient).objects = map[string]map[string][]byte{}
+	metrics, err := store.MetricsForLabelMatchers(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []model.Metric{bar}; !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("expected %v, got %v", expected, metrics)
+	}
+}
@@ -0,0 +1,170 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// How many index entries to read when sampling for a TooManySeriesError.
+	seriesLimitSampleSize = 1000
+	// How many label values to report in a TooManySeriesError.
+	seriesLimitTopValues = 5
+)
+
+// LabelValueCount is the number of series, in a sample, with a given label value.
+type LabelValueCount struct {
+	Name   model.LabelName
+	Value  model.LabelValue
+	Series int
+}
+
+// TooManySeriesError is returned when a query matches more series than
+// allowed.  It includes the label values matching the most series in a sample
+// of the index, so users can see which label to constrain.
+type TooManySeriesError struct {
+	MetricName model.LabelValue
+	Series     int
+	Limit      int
+	Top        []LabelValueCount
+}
+
+// ErrorCode implements util.CodedError.
+func (e *TooManySeriesError) ErrorCode() util.ErrorCode {
+	return util.ErrLimitExceeded
+}
+
+func (e *TooManySeriesError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "query for %s matched %d series, more than the limit of %d", e.MetricName, e.Series, e.Limit)
+	if len(e.Top) > 0 {
+		buf.WriteString("; most common label values in a sample of the index:")
+		for i, top := range e.Top {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, " %s=%q (%d series)", top.Name, top.Value, top.Series)
+		}
+	}
+	return buf.String()
+}
+
+// tooManySeriesError builds a TooManySeriesError, sampling the index for the
+// given bucket to find the label values that match the most series.  Only
+// the first shard is sampled, as series are spread evenly over them.  If the
+// sample fails the error is still returned, just without the details.
+func (c *AWSStore) tooManySeriesError(ctx context.Context, userID string, bucket bucketSpec, metricName model.LabelValue, series int) error {
+	err := &TooManySeriesError{
+		MetricName: metricName,
+		Series:     series,
+		Limit:      c.cfg.MaxSeriesPerQuery,
+	}
+	input := &dynamodb.QueryInput{
+		TableName: aws.String(bucket.tableName),
+		KeyConditions: map[string]*dynamodb.Condition{
+			hashKey: {
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{S: aws.String(bucket.hashValues(userID, metricName)[0])},
+				},
+				ComparisonOperator: aws.String("EQ"),
+			},
+		},
+		Limit:                  aws.Int64(seriesLimitSampleSize),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	top, sampleErr := c.sampleLabelValues(ctx, input)
+	if sampleErr == nil {
+		err.Top = top
+	}
+	return err
+}
+
+// sampleLabelValues reads a single page of index entries, and returns the
+// label values matching the most series in it.  Label values shared by every
+// sampled series are left out, as constraining on them wouldn't help.
+func (c *AWSStore) sampleLabelValues(ctx context.Context, input *dynamodb.QueryInput) ([]LabelValueCount, error) {
+	type labelValue struct {
+		name  model.LabelName
+		value model.LabelValue
+	}
+	var (
+		series     = map[labelValue]map[model.Fingerprint]struct{}{}
+		allSeries  = map[model.Fingerprint]struct{}{}
+		entries    int
+		processErr error
+	)
+	if err := c.dynamoReads[0].queryPages(ctx, input, func(resp interface{}, lastPage bool) bool {
+		for _, item := range resp.(*dynamodb.QueryOutput).Items {
+			if entries >= seriesLimitSampleSize {
+				break
+			}
+			entries++
+
+			rangeValue := item[rangeKey].B
+			if rangeValue == nil {
+				processErr = fmt.Errorf("invalid item: %v", item)
+				return false
+			}
+			label, value, chunkID, err := parseRangeValue(rangeValue)
+			if err != nil {
+				processErr = err
+				return false
+			}
+			fp, _, _, err := parseChunkID(chunkID)
+			if err != nil {
+				processErr = err
+				return false
+			}
+			allSeries[fp] = struct{}{}
+			lv := labelValue{label, value}
+			if series[lv] == nil {
+				series[lv] = map[model.Fingerprint]struct{}{}
+			}
+			series[lv][fp] = struct{}{}
+		}
+		return false
+	}); err != nil {
+		return nil, err
+	} else if processErr != nil {
+		return nil, processErr
+	}
+
+	counts := make([]LabelValueCount, 0, len(series))
+	for lv, fps := range series {
+		if len(fps) == len(allSeries) {
+			continue
+		}
+		counts = append(counts, LabelValueCount{
+			Name:   lv.name,
+			Value:  lv.value,
+			Series: len(fps),
+		})
+	}
+	sort.Sort(byLabelValueCount(counts))
+	if len(counts) > seriesLimitTopValues {
+		counts = counts[:seriesLimitTopValues]
+	}
+	return counts, nil
+}
+
+type byLabelValueCount []LabelValueCount
+
+func (cs byLabelValueCount) Len() int      { return len(cs) }
+func (cs byLabelValueCount) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byLabelValueCount) Less(i, j int) bool {
+	if cs[i].Series != cs[j].Series {
+		return cs[i].Series > cs[j].Series
+	}
+	if cs[i].Name != cs[j].Name {
+		return cs[i].Name < cs[j].Name
+	}
+	return cs[i].Value < cs[j].Value
+}
@@ -0,0 +1,388 @@
+package chunk
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/weaveworks/common/mtime"
+)
+
+const (
+	// Name of the database/sql driver used for postgres:// URLs.  The
+	// driver, github.com/lib/pq, is linked in by the binaries' mains.
+	sqlDriverName = "postgres"
+
+	// Default number of rows returned per page of a query.
+	sqlPageSize = 1000
+)
+
+// sqlIndexClient is an IndexClient storing the index in a PostgreSQL, or
+// PostgreSQL-compatible (eg CockroachDB), database.  Each table has a hash
+// and range column, with a composite primary key on them so queries are
+// served by the primary index in range order, and a value column holding
+// any other attributes.  Expiry times are kept in their own column, and
+// expired rows are filtered out of queries, but not deleted.
+//
+// Databases have no provisioned throughput; that requested by the table
+// manager is remembered, so it doesn't try to update it again.
+type sqlIndexClient struct {
+	db       *sql.DB
+	pageSize int
+
+	mtx        sync.Mutex
+	throughput map[string]*dynamodb.ProvisionedThroughput
+}
+
+// NewSQLIndexClient makes an IndexClient storing the index in the SQL
+// database at the given postgres:// URL.  The name of the table to use when
+// not using periodic tables is taken from the URL's "table" parameter.
+func NewSQLIndexClient(sqlURL string) (IndexClient, string, error) {
+	u, err := url.Parse(sqlURL)
+	if err != nil {
+		return nil, "", err
+	}
+	query := u.Query()
+	tableName := query.Get("table")
+	query.Del("table")
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open(sqlDriverName, u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	return newSQLIndexClient(db), tableName, nil
+}
+
+func newSQLIndexClient(db *sql.DB) *sqlIndexClient {
+	return &sqlIndexClient{
+		db:         db,
+		pageSize:   sqlPageSize,
+		throughput: map[string]*dynamodb.ProvisionedThroughput{},
+	}
+}
+
+func (c *sqlIndexClient) ListTablesPages(_ *dynamodb.ListTablesInput, fn func(p *dynamodb.ListTablesOutput, lastPage bool) (shouldContinue bool)) error {
+	rows, err := c.db.Query("SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var tableNames []*string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return err
+		}
+		tableNames = append(tableNames, aws.String(tableName))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	fn(&dynamodb.ListTablesOutput{TableNames: tableNames}, true)
+	return nil
+}
+
+func (c *sqlIndexClient) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	_, err := c.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		hash_value  TEXT NOT NULL,
+		range_value BYTEA NOT NULL,
+		value       BYTEA,
+		expires     BIGINT,
+		PRIMARY KEY (hash_value, range_value)
+	)`, quoteIdentifier(*input.TableName)))
+	if err != nil {
+		return nil, err
+	}
+	c.setThroughput(*input.TableName, input.ProvisionedThroughput)
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (c *sqlIndexClient) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	var exists bool
+	if err := c.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1)",
+		*input.TableName,
+	).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, awserr.New(resourceNotFoundException, fmt.Sprintf("table %s not found", *input.TableName), nil)
+	}
+
+	c.mtx.Lock()
+	throughput, ok := c.throughput[*input.TableName]
+	c.mtx.Unlock()
+	if !ok {
+		throughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(0),
+			WriteCapacityUnits: aws.Int64(0),
+		}
+	}
+	return &dynamodb.DescribeTableOutput{
+		Table: &dynamodb.TableDescription{
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{
+				ReadCapacityUnits:  throughput.ReadCapacityUnits,
+				WriteCapacityUnits: throughput.WriteCapacityUnits,
+			},
+			TableStatus: aws.String(dynamodb.TableStatusActive),
+		},
+	}, nil
+}
+
+func (c *sqlIndexClient) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	c.setThroughput(*input.TableName, input.ProvisionedThroughput)
+	return &dynamodb.UpdateTableOutput{}, nil
+}
+
+func (c *sqlIndexClient) setThroughput(tableName string, throughput *dynamodb.ProvisionedThroughput) {
+	if throughput == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.throughput[tableName] = throughput
+}
+
+// BatchWriteItem writes all the items in a single transaction, replacing
+// existing items with the same keys.
+func (c *sqlIndexClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for tableName, writeRequests := range input.RequestItems {
+		for _, writeRequest := range writeRequests {
+			if writeRequest.DeleteRequest != nil {
+				row, err := newSQLRow(writeRequest.DeleteRequest.Key)
+				if err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE hash_value = $1 AND range_value = $2`,
+					quoteIdentifier(tableName)), row.hashValue, row.rangeValue); err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				continue
+			}
+			row, err := newSQLRow(writeRequest.PutRequest.Item)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (hash_value, range_value, value, expires) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (hash_value, range_value) DO UPDATE SET value = excluded.value, expires = excluded.expires`,
+				quoteIdentifier(tableName)), row.args()...); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+// PutItem only supports the condition that the item doesn't exist.
+func (c *sqlIndexClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	row, err := newSQLRow(input.Item)
+	if err != nil {
+		return nil, err
+	}
+	onConflict := "ON CONFLICT (hash_value, range_value) DO UPDATE SET value = excluded.value, expires = excluded.expires"
+	if input.ConditionExpression != nil {
+		if *input.ConditionExpression != fmt.Sprintf("attribute_not_exists(%s)", hashKey) {
+			return nil, fmt.Errorf("condition %s not supported", *input.ConditionExpression)
+		}
+		onConflict = "ON CONFLICT (hash_value, range_value) DO NOTHING"
+	}
+	result, err := c.db.Exec(fmt.Sprintf("INSERT INTO %s (hash_value, range_value, value, expires) VALUES ($1, $2, $3, $4) %s",
+		quoteIdentifier(*input.TableName), onConflict), row.args()...)
+	if err != nil {
+		return nil, err
+	}
+	if input.ConditionExpression != nil {
+		if affected, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if affected == 0 {
+			return nil, awserr.New(conditionalCheckFailedException, "item exists", nil)
+		}
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *sqlIndexClient) QueryRequest(input *dynamodb.QueryInput) (dynamoRequest, *dynamodb.QueryOutput) {
+	req := &sqlQueryRequest{
+		client: c,
+		input:  input,
+		output: &dynamodb.QueryOutput{},
+	}
+	return req, req.output
+}
+
+// sqlQueryRequest is a page of a query.  Pages are read in range order, each
+// starting after the last range value of the previous one.
+type sqlQueryRequest struct {
+	client *sqlIndexClient
+	input  *dynamodb.QueryInput
+	after  []byte
+
+	output    *dynamodb.QueryOutput
+	lastRange []byte
+	more      bool
+	err       error
+}
+
+func (r *sqlQueryRequest) NextPage() dynamoRequest {
+	if !r.more {
+		return nil
+	}
+	return &sqlQueryRequest{
+		client: r.client,
+		input:  r.input,
+		after:  r.lastRange,
+		output: &dynamodb.QueryOutput{},
+	}
+}
+
+func (r *sqlQueryRequest) HasNextPage() bool     { return r.more }
+func (r *sqlQueryRequest) Data() interface{}     { return r.output }
+func (r *sqlQueryRequest) OperationName() string { return "Query" }
+func (r *sqlQueryRequest) Error() error          { return r.err }
+
+func (r *sqlQueryRequest) Send() error {
+	r.err = r.send()
+	return r.err
+}
+
+func (r *sqlQueryRequest) send() error {
+	limit := r.client.pageSize
+	if r.input.Limit != nil && int(*r.input.Limit) < limit {
+		limit = int(*r.input.Limit)
+	}
+	query, args, err := buildSQLQuery(r.input, r.after, mtime.Now().Unix(), limit+1)
+	if err != nil {
+		return err
+	}
+	rows, err := r.client.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if len(r.output.Items) == limit {
+			r.more = true
+			break
+		}
+		var row sqlRow
+		if err := rows.Scan(&row.hashValue, &row.rangeValue, &row.value); err != nil {
+			return err
+		}
+		item, err := row.item()
+		if err != nil {
+			return err
+		}
+		r.output.Items = append(r.output.Items, item)
+		r.lastRange = row.rangeValue
+	}
+	return rows.Err()
+}
+
+// buildSQLQuery translates the key conditions of a DynamoDB query to SQL,
+// for rows with range values after the given one.  Prefix conditions are
+// expressed as ranges, so they are served by the primary key.
+func buildSQLQuery(input *dynamodb.QueryInput, after []byte, now int64, limit int) (string, []interface{}, error) {
+	hashCondition, ok := input.KeyConditions[hashKey]
+	if !ok || *hashCondition.ComparisonOperator != dynamodb.ComparisonOperatorEq {
+		return "", nil, fmt.Errorf("must specify hash value equality condition")
+	}
+	conditions := []string{"hash_value = $1", "(expires IS NULL OR expires > $2)"}
+	args := []interface{}{*hashCondition.AttributeValueList[0].S, now}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if rangeCondition, ok := input.KeyConditions[rangeKey]; ok {
+		values := rangeCondition.AttributeValueList
+		switch *rangeCondition.ComparisonOperator {
+		case dynamodb.ComparisonOperatorEq:
+			addCondition("range_value = $%d", values[0].B)
+		case dynamodb.ComparisonOperatorBetween:
+			addCondition("range_value >= $%d", values[0].B)
+			addCondition("range_value <= $%d", values[1].B)
+		case dynamodb.ComparisonOperatorBeginsWith:
+			addCondition("range_value >= $%d", values[0].B)
+			if end := prefixEnd(values[0].B); end != nil {
+				addCondition("range_value < $%d", end)
+			}
+		default:
+			return "", nil, fmt.Errorf("comparison %s not supported", *rangeCondition.ComparisonOperator)
+		}
+	}
+	if after != nil {
+		addCondition("range_value > $%d", after)
+	}
+
+	query := fmt.Sprintf("SELECT hash_value, range_value, value FROM %s WHERE %s ORDER BY range_value LIMIT %d",
+		quoteIdentifier(*input.TableName), strings.Join(conditions, " AND "), limit)
+	return query, args, nil
+}
+
+// prefixEnd returns the smallest value greater than all values with the
+// given prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqlRow is an item as stored in a SQL table.
+type sqlRow struct {
+	hashValue  string
+	rangeValue []byte
+	value      []byte
+	expires    sql.NullInt64
+}
+
+func newSQLRow(item map[string]*dynamodb.AttributeValue) (sqlRow, error) {
+	entry, err := newIndexEntry(item)
+	if err != nil {
+		return sqlRow{}, err
+	}
+	row := sqlRow{
+		hashValue:  entry.HashValue,
+		rangeValue: entry.RangeValue,
+		value:      entry.Value,
+	}
+	if entry.Expires != 0 {
+		row.expires = sql.NullInt64{Int64: entry.Expires, Valid: true}
+	}
+	return row, nil
+}
+
+func (r sqlRow) args() []interface{} {
+	return []interface{}{r.hashValue, r.rangeValue, r.value, r.expires}
+}
+
+func (r sqlRow) item() (map[string]*dynamodb.AttributeValue, error) {
+	return IndexEntry{HashValue: r.hashValue, RangeValue: r.rangeValue, Value: r.value}.item()
+}
@@ -0,0 +1,170 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	_ "github.com/lib/pq" // Linked into binaries by their mains.
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// postgresURLEnv names the environment variable giving a PostgreSQL
+// database to test against, eg postgres://localhost/cortex?sslmode=disable.
+const postgresURLEnv = "CORTEX_TEST_POSTGRES_URL"
+
+func TestNewSQLIndexClient(t *testing.T) {
+	// Opening doesn't connect, but fails if the driver isn't linked in.
+	client, tableName, err := NewIndexClient("postgres://localhost/cortex?table=index&sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.(*sqlIndexClient).db.Close()
+	if tableName != "index" {
+		t.Fatalf("unexpected table name %q", tableName)
+	}
+}
+
+func TestSQLChunkStore(t *testing.T) {
+	postgresURL := os.Getenv(postgresURLEnv)
+	if postgresURL == "" {
+		t.Skipf("%s not set", postgresURLEnv)
+	}
+	index, _, err := NewSQLIndexClient(postgresURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := index.(*sqlIndexClient).db
+	defer db.Close()
+
+	tableName := fmt.Sprintf("cortex_test_%d", time.Now().UnixNano())
+	if _, err := index.CreateTable(&dynamodb.CreateTableInput{TableName: aws.String(tableName)}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP TABLE " + quoteIdentifier(tableName))
+
+	store := NewAWSStore(StoreConfig{
+		DynamoDB:  index,
+		S3:        NewMockS3(),
+		TableName: tableName,
+	})
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	if err := store.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestBuildSQLQuery(t *testing.T) {
+	hashCondition := &dynamodb.Condition{
+		AttributeValueList: []*dynamodb.AttributeValue{{S: aws.String("userID:d1:foo")}},
+		ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq),
+	}
+	for _, tc := range []struct {
+		rangeCondition *dynamodb.Condition
+		after          []byte
+		query          string
+		args           []interface{}
+	}{
+		{
+			nil, nil,
+			`SELECT hash_value, range_value, value FROM "index" WHERE hash_value = $1 AND (expires IS NULL OR expires > $2) ORDER BY range_value LIMIT 10`,
+			[]interface{}{"userID:d1:foo", int64(100)},
+		},
+		{
+			&dynamodb.Condition{
+				AttributeValueList: []*dynamodb.AttributeValue{{B: []byte("ab\xff")}},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBeginsWith),
+			},
+			[]byte("ab\xff1"),
+			`SELECT hash_value, range_value, value FROM "index" WHERE hash_value = $1 AND (expires IS NULL OR expires > $2) AND range_value >= $3 AND range_value < $4 AND range_value > $5 ORDER BY range_value LIMIT 10`,
+			[]interface{}{"userID:d1:foo", int64(100), []byte("ab\xff"), []byte("ac"), []byte("ab\xff1")},
+		},
+		{
+			&dynamodb.Condition{
+				AttributeValueList: []*dynamodb.AttributeValue{{B: []byte("a")}, {B: []byte("b")}},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorBetween),
+			},
+			nil,
+			`SELECT hash_value, range_value, value FROM "index" WHERE hash_value = $1 AND (expires IS NULL OR expires > $2) AND range_value >= $3 AND range_value <= $4 ORDER BY range_value LIMIT 10`,
+			[]interface{}{"userID:d1:foo", int64(100), []byte("a"), []byte("b")},
+		},
+	} {
+		input := &dynamodb.QueryInput{
+			TableName:     aws.String("index"),
+			KeyConditions: map[string]*dynamodb.Condition{hashKey: hashCondition},
+		}
+		if tc.rangeCondition != nil {
+			input.KeyConditions[rangeKey] = tc.rangeCondition
+		}
+		query, args, err := buildSQLQuery(input, tc.after, 100, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tc.query {
+			t.Errorf("expected query:\n%s\ngot:\n%s", tc.query, query)
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("expected args %q, got %q", tc.args, args)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, end []byte
+	}{
+		{[]byte("a"), []byte("b")},
+		{[]byte("a\xff\xff"), []byte("b")},
+		{[]byte("\xff"), nil},
+		{[]byte{}, nil},
+	} {
+		if end := prefixEnd(tc.prefix); !bytes.Equal(end, tc.end) || (end == nil) != (tc.end == nil) {
+			t.Errorf("prefixEnd(%q): expected %q, got %q", tc.prefix, tc.end, end)
+		}
+	}
+}
+
+func TestSQLRowRoundTrip(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		hashKey:       {S: aws.String("userID:claim:1")},
+		rangeKey:      {B: []byte{0}},
+		claimStateKey: {S: aws.String(claimDone)},
+		ttlKey:        {N: aws.String("12345")},
+	}
+	row, err := newSQLRow(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !row.expires.Valid || row.expires.Int64 != 12345 {
+		t.Fatalf("unexpected expiry %v", row.expires)
+	}
+
+	// The expiry isn't returned; everything else is.
+	delete(item, ttlKey)
+	got, err := row.item()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, item) {
+		t.Fatalf("expected %v, got %v", item, got)
+	}
+}
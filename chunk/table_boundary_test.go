@@ -0,0 +1,190 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+const (
+	boundaryTablePeriod = 7 * 24 * time.Hour
+	boundaryTable       = 400
+)
+
+// tableBoundary is the start of table cortex_400.
+var tableBoundary = model.TimeFromUnix(boundaryTable * int64(boundaryTablePeriod/time.Second))
+
+func boundaryStoreConfig(dynamoDB IndexClient, s3 ObjectClient, startAt model.Time, overlap time.Duration) StoreConfig {
+	return StoreConfig{
+		DynamoDB:  dynamoDB,
+		S3:        s3,
+		TableName: "index",
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          "cortex_",
+			TablePeriod:          boundaryTablePeriod,
+			PeriodicTableStartAt: startAt.Time(),
+			TableBoundaryOverlap: overlap,
+		},
+	}
+}
+
+func createTables(t *testing.T, dynamoDB IndexClient, names ...string) {
+	for _, name := range names {
+		if _, err := dynamoDB.CreateTable(&dynamodb.CreateTableInput{
+			TableName: aws.String(name),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String(hashKey), KeyType: aws.String("HASH")},
+				{AttributeName: aws.String(rangeKey), KeyType: aws.String("RANGE")},
+			},
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBucketSpecOverlap(t *testing.T) {
+	store := NewAWSStore(boundaryStoreConfig(nil, nil, tableBoundary.Add(-boundaryTablePeriod), 2*time.Hour))
+
+	for _, tc := range []struct {
+		at                  model.Time
+		table, overlapTable string
+	}{
+		// Well within a table.
+		{tableBoundary.Add(-3 * 24 * time.Hour), "cortex_399", ""},
+		// The bucket just before the boundary starts a day before it, further
+		// than the overlap.
+		{tableBoundary.Add(-time.Hour), "cortex_399", ""},
+		// Buckets starting at or just after the boundary.
+		{tableBoundary, "cortex_400", "cortex_399"},
+		{tableBoundary.Add(23 * time.Hour), "cortex_400", "cortex_399"},
+		{tableBoundary.Add(24 * time.Hour), "cortex_400", ""},
+		// Buckets at PeriodicTableStartAt overlap the non-periodic table.
+		{tableBoundary.Add(-boundaryTablePeriod), "cortex_399", "index"},
+		{tableBoundary.Add(-boundaryTablePeriod - time.Hour), "index", ""},
+	} {
+		buckets := store.bigBuckets(tc.at, tc.at)
+		if len(buckets) != 1 {
+			t.Fatalf("%v: expected one bucket, got %v", tc.at, buckets)
+		}
+		if buckets[0].tableName != tc.table || buckets[0].overlapTableName != tc.overlapTable {
+			t.Errorf("%v: expected tables %q and %q, got %q and %q", tc.at, tc.table, tc.overlapTable, buckets[0].tableName, buckets[0].overlapTableName)
+		}
+	}
+}
+
+// TestTableBoundaryRollout moves the periodic table start time back a
+// period, as a config rollout would, and checks chunks on the boundary are
+// found whichever config they were written and read with.
+func TestTableBoundaryRollout(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	createTables(t, dynamoDB, "index", "cortex_399", "cortex_400", "cortex_401")
+	s3 := NewMockS3()
+
+	// The old config starts periodic tables at cortex_401, so the chunk goes
+	// in the non-periodic table; the new one starts them at cortex_400.
+	oldStore := NewAWSStore(boundaryStoreConfig(dynamoDB, s3, tableBoundary.Add(boundaryTablePeriod), 0))
+	newStore := NewAWSStore(boundaryStoreConfig(dynamoDB, s3, tableBoundary, 24*time.Hour))
+
+	ctx := user.WithID(context.Background(), "0")
+	oldChunk := newTestChunk(t, tableBoundary.Add(time.Hour), 10)
+	if err := oldStore.Put(ctx, []Chunk{oldChunk}); err != nil {
+		t.Fatal(err)
+	}
+	newChunk := newTestChunk(t, tableBoundary.Add(2*time.Hour), 10)
+	if err := newStore.Put(ctx, []Chunk{newChunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(store *AWSStore, matchers ...*metric.LabelMatcher) []string {
+		chunks, err := store.Get(ctx, tableBoundary, tableBoundary.Add(3*time.Hour), matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, chunk := range chunks {
+			ids = append(ids, chunk.ID)
+		}
+		return ids
+	}
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	labelMatcher := mustNewLabelMatcher(metric.Equal, "bar", "baz")
+	for _, tc := range []struct {
+		name     string
+		store    *AWSStore
+		matchers []*metric.LabelMatcher
+	}{
+		{"old config, metric name", oldStore, []*metric.LabelMatcher{nameMatcher}},
+		{"old config, label matcher", oldStore, []*metric.LabelMatcher{nameMatcher, labelMatcher}},
+		{"new config, metric name", newStore, []*metric.LabelMatcher{nameMatcher}},
+		{"new config, label matcher", newStore, []*metric.LabelMatcher{nameMatcher, labelMatcher}},
+	} {
+		ids := get(tc.store, tc.matchers...)
+		if len(ids) != 2 || ids[0] == ids[1] {
+			t.Errorf("%s: expected both chunks once, got %v", tc.name, ids)
+		}
+	}
+}
+
+func TestTableBoundaryMissingOverlapTable(t *testing.T) {
+	dynamoDB := NewMemoryIndexClient()
+	createTables(t, dynamoDB, "index", "cortex_400")
+	s3 := NewMemoryObjectClient()
+
+	// With no overlap the chunk is only written to cortex_400; querying
+	// cortex_399 too, which doesn't exist, isn't an error.
+	ctx := user.WithID(context.Background(), "0")
+	chunk := newTestChunk(t, tableBoundary.Add(time.Hour), 10)
+	if err := NewAWSStore(boundaryStoreConfig(dynamoDB, s3, tableBoundary.Add(-boundaryTablePeriod), 0)).Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	store := NewAWSStore(boundaryStoreConfig(dynamoDB, s3, tableBoundary.Add(-boundaryTablePeriod), 24*time.Hour))
+	chunks, err := store.Get(ctx, tableBoundary, tableBoundary.Add(time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+}
+
+func TestFutureTableTolerance(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	createTables(t, dynamoDB, "index", "cortex_399", "cortex_400")
+	cfg := boundaryStoreConfig(dynamoDB, NewMockS3(), tableBoundary.Add(-boundaryTablePeriod), 0)
+	cfg.FutureTableTolerance = 10 * time.Minute
+	store := NewAWSStore(cfg)
+	ctx := user.WithID(context.Background(), "0")
+
+	// A little before the boundary cortex_400 is due to exist, so chunks
+	// slightly ahead of the clock can be written to it, but not those beyond
+	// the next boundary.
+	mtime.NowForce(tableBoundary.Add(-5 * time.Minute).Time())
+	defer mtime.NowReset()
+	if err := store.Put(ctx, []Chunk{newTestChunk(t, tableBoundary.Add(time.Minute), 10)}); err != nil {
+		t.Fatal(err)
+	}
+	future := newTestChunk(t, tableBoundary.Add(boundaryTablePeriod+time.Minute), 10)
+	if err := store.Put(ctx, []Chunk{future}); err == nil {
+		t.Fatal("expected error writing chunk for a table which doesn't exist yet")
+	}
+
+	// Once time catches up, the chunk can be written.
+	createTables(t, dynamoDB, "cortex_401")
+	mtime.NowForce(tableBoundary.Add(boundaryTablePeriod - 5*time.Minute).Time())
+	if err := store.Put(ctx, []Chunk{future}); err != nil {
+		t.Fatal(err)
+	}
+}
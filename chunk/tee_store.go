@@ -0,0 +1,206 @@
+package chunk
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+)
+
+var (
+	teeStoreWriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "tee_store_write_failures_total",
+		Help:      "Number of failed writes of batches of chunks by a tee store, by store (primary or secondary).",
+	}, []string{"store"})
+	teeStoreReadFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "tee_store_read_fallbacks_total",
+		Help:      "Number of reads by a tee store which failed on the primary store and were retried on the secondary.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(teeStoreWriteFailures)
+	prometheus.MustRegister(teeStoreReadFallbacks)
+}
+
+// TeeStore is a Store which writes chunks, and so their index entries, to
+// both a primary and a secondary store, and reads from the primary, falling
+// back to the secondary on error.  It is for migrating between backends (eg
+// from S3 to GCS) without downtime: once the chunks written before the
+// migration have been copied to the secondary, and its index rebuilt, the
+// stores can be swapped, and later the old one dropped.
+//
+// SeriesCount, EstimateQueryCost, GetChunkRefs, FetchChunks,
+// MetricsForLabelMatchers and IndexBuckets are served by the primary, if it
+// supports them.
+type TeeStore struct {
+	primary, secondary Store
+}
+
+// NewTeeStore makes a new TeeStore.
+func NewTeeStore(primary, secondary Store) *TeeStore {
+	return &TeeStore{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+// Put implements Store.  Chunks are written to both stores in parallel, and
+// an error is returned unless both succeed, so the chunks are retried and
+// the secondary doesn't miss any.  Encoding a chunk writes its length into
+// its data, so the secondary is given copies of the chunks to encode.
+func (t *TeeStore) Put(ctx context.Context, chunks []Chunk) error {
+	copies, err := copyChunks(chunks)
+	if err != nil {
+		return err
+	}
+	secondaryErr := make(chan error)
+	go func() {
+		secondaryErr <- t.secondary.Put(ctx, copies)
+	}()
+
+	err = t.primary.Put(ctx, chunks)
+	if err != nil {
+		teeStoreWriteFailures.WithLabelValues("primary").Inc()
+	}
+	if err2 := <-secondaryErr; err2 != nil {
+		teeStoreWriteFailures.WithLabelValues("secondary").Inc()
+		if err == nil {
+			err = fmt.Errorf("error writing to secondary store: %v", err2)
+		}
+	}
+	return err
+}
+
+// copyChunks returns copies of chunks with their own data.
+func copyChunks(chunks []Chunk) ([]Chunk, error) {
+	result := make([]Chunk, len(chunks))
+	for i, c := range chunks {
+		buf := make([]byte, prom_chunk.ChunkLen)
+		if err := c.Data.MarshalToBuf(buf); err != nil {
+			return nil, err
+		}
+		data, err := prom_chunk.NewForEncoding(c.Data.Encoding())
+		if err != nil {
+			return nil, err
+		}
+		if err := data.UnmarshalFromBuf(buf); err != nil {
+			return nil, err
+		}
+		c.Data = data
+		result[i] = c
+	}
+	return result, nil
+}
+
+// Get implements Store.
+func (t *TeeStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	chunks, err := t.primary.Get(ctx, from, through, matchers...)
+	if err == nil {
+		return chunks, nil
+	}
+	log.Warnf("Error reading from primary store, falling back to secondary: %v", err)
+	teeStoreReadFallbacks.Inc()
+	return t.secondary.Get(ctx, from, through, matchers...)
+}
+
+// Delete implements Store.  Samples are deleted from both stores, so they
+// don't reappear when the stores are swapped.
+func (t *TeeStore) Delete(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) error {
+	if err := t.primary.Delete(ctx, from, through, matchers...); err != nil {
+		return err
+	}
+	if err := t.secondary.Delete(ctx, from, through, matchers...); err != nil {
+		return fmt.Errorf("error deleting from secondary store: %v", err)
+	}
+	return nil
+}
+
+// Scan implements Store.  Only the primary store is scanned, as it has all
+// the chunks the secondary does.
+func (t *TeeStore) Scan(ctx context.Context, from, through model.Time, callback func(Chunk) error) error {
+	return t.primary.Scan(ctx, from, through, callback)
+}
+
+// LabelValues implements Store.
+func (t *TeeStore) LabelValues(ctx context.Context, from, through model.Time, labelName model.LabelName) (model.LabelValues, error) {
+	values, err := t.primary.LabelValues(ctx, from, through, labelName)
+	if err == nil {
+		return values, nil
+	}
+	log.Warnf("Error reading from primary store, falling back to secondary: %v", err)
+	teeStoreReadFallbacks.Inc()
+	return t.secondary.LabelValues(ctx, from, through, labelName)
+}
+
+// LabelNames implements Store.
+func (t *TeeStore) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	names, err := t.primary.LabelNames(ctx, from, through)
+	if err == nil {
+		return names, nil
+	}
+	log.Warnf("Error reading from primary store, falling back to secondary: %v", err)
+	teeStoreReadFallbacks.Inc()
+	return t.secondary.LabelNames(ctx, from, through)
+}
+
+// MetricsForLabelMatchers implements SeriesStore.
+func (t *TeeStore) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]model.Metric, error) {
+	series, ok := t.primary.(SeriesStore)
+	if !ok {
+		return nil, fmt.Errorf("primary store can't list series")
+	}
+	return series.MetricsForLabelMatchers(ctx, from, through, matchers...)
+}
+
+// SeriesCount implements SeriesCounter.
+func (t *TeeStore) SeriesCount(ctx context.Context, from, through model.Time, metricName model.LabelValue) (uint64, error) {
+	counter, ok := t.primary.(SeriesCounter)
+	if !ok {
+		return 0, fmt.Errorf("primary store can't count series")
+	}
+	return counter.SeriesCount(ctx, from, through, metricName)
+}
+
+// EstimateQueryCost implements QueryCostEstimator.
+func (t *TeeStore) EstimateQueryCost(ctx context.Context, from, through model.Time) (QueryCost, error) {
+	estimator, ok := t.primary.(QueryCostEstimator)
+	if !ok {
+		return QueryCost{}, fmt.Errorf("primary store can't estimate query costs")
+	}
+	return estimator.EstimateQueryCost(ctx, from, through)
+}
+
+// GetChunkRefs implements LazyStore.
+func (t *TeeStore) GetChunkRefs(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]ChunkRef, error) {
+	lazy, ok := t.primary.(LazyStore)
+	if !ok {
+		return nil, fmt.Errorf("primary store can't look up chunk refs")
+	}
+	return lazy.GetChunkRefs(ctx, from, through, matchers...)
+}
+
+// FetchChunks implements LazyStore.
+func (t *TeeStore) FetchChunks(ctx context.Context, from, through model.Time, refs []ChunkRef) ([]Chunk, error) {
+	lazy, ok := t.primary.(LazyStore)
+	if !ok {
+		return nil, fmt.Errorf("primary store can't fetch chunk refs")
+	}
+	return lazy.FetchChunks(ctx, from, through, refs)
+}
+
+// IndexBuckets implements IndexBucketer.  It returns nothing if the primary
+// doesn't.
+func (t *TeeStore) IndexBuckets(from, through model.Time) []string {
+	bucketer, ok := t.primary.(IndexBucketer)
+	if !ok {
+		return nil
+	}
+	return bucketer.IndexBuckets(from, through)
+}
@@ -0,0 +1,77 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// failingStore is a Store whose every call fails.
+type failingStore struct{}
+
+func (failingStore) Put(context.Context, []Chunk) error {
+	return fmt.Errorf("put failed")
+}
+
+func (failingStore) Get(context.Context, model.Time, model.Time, ...*metric.LabelMatcher) ([]Chunk, error) {
+	return nil, fmt.Errorf("get failed")
+}
+
+func (failingStore) Delete(context.Context, model.Time, model.Time, ...*metric.LabelMatcher) error {
+	return fmt.Errorf("delete failed")
+}
+
+func (failingStore) Scan(context.Context, model.Time, model.Time, func(Chunk) error) error {
+	return fmt.Errorf("scan failed")
+}
+
+func (failingStore) LabelValues(context.Context, model.Time, model.Time, model.LabelName) (model.LabelValues, error) {
+	return nil, fmt.Errorf("label values failed")
+}
+
+func (failingStore) LabelNames(context.Context, model.Time, model.Time) (model.LabelNames, error) {
+	return nil, fmt.Errorf("label names failed")
+}
+
+func TestTeeStore(t *testing.T) {
+	primary, secondary := NewMemoryStore(), NewMemoryStore()
+	tee := NewTeeStore(primary, secondary)
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk := newTestChunk(t, now, 10)
+	if err := tee.Put(ctx, []Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both stores have the chunk.
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	for _, store := range []Store{primary, secondary, tee} {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+			t.Fatalf("unexpected chunks %v", chunks)
+		}
+	}
+
+	// Reads fall back to the secondary, but writes need both stores.
+	tee = NewTeeStore(failingStore{}, secondary)
+	chunks, err := tee.Get(ctx, now.Add(-time.Hour), now, matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != chunk.ID {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+	if err := NewTeeStore(primary, failingStore{}).Put(ctx, []Chunk{chunk}); err == nil {
+		t.Fatal("expected error when the secondary store fails")
+	}
+}
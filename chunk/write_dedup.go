@@ -0,0 +1,178 @@
+package chunk
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+)
+
+const (
+	conditionalCheckFailedException = "ConditionalCheckFailedException"
+
+	// Attribute holding the state of a claim.
+	claimStateKey = "s"
+	claimPending  = "pending"
+	claimDone     = "done"
+)
+
+// Range value of claim records.  Claims have their own hash values, so this
+// needn't be unique.
+var claimRangeValue = []byte{0}
+
+var chunkWriteDedup = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_write_dedup_total",
+	Help:      "Chunks put with write deduplication enabled, by outcome.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(chunkWriteDedup)
+}
+
+// Outcomes of claiming a chunk.
+const (
+	dedupClaimed    = "claimed"     // We claimed the chunk, and wrote it.
+	dedupSkipped    = "skipped"     // Another replica wrote the chunk.
+	dedupUnverified = "unverified"  // Another replica claimed the chunk but hasn't finished writing it, so we wrote it too.
+	dedupError      = "claim_error" // The claim failed, so we wrote the chunk anyway.
+)
+
+// claimChunks claims each chunk with a conditional write to the index, so
+// that when the same chunk is flushed by several replicas, only the first
+// writes it.  It returns the chunks this replica should write.  A chunk
+// claimed by another replica is only skipped once that replica has
+// completed its claim, so a replica failing part way through doesn't lose
+// the chunk; if in doubt, chunks are written again, which is harmless.
+func (c *AWSStore) claimChunks(ctx context.Context, userID string, chunks []Chunk) []Chunk {
+	type result struct {
+		chunk   Chunk
+		outcome string
+	}
+	results := make(chan result)
+	for _, chunk := range chunks {
+		go func(chunk Chunk) {
+			results <- result{chunk, c.claimChunk(ctx, userID, &chunk)}
+		}(chunk)
+	}
+
+	toWrite := make([]Chunk, 0, len(chunks))
+	for range chunks {
+		result := <-results
+		chunkWriteDedup.WithLabelValues(result.outcome).Inc()
+		if result.outcome != dedupSkipped {
+			toWrite = append(toWrite, result.chunk)
+		}
+	}
+	return toWrite
+}
+
+func (c *AWSStore) claimChunk(ctx context.Context, userID string, chunk *Chunk) string {
+	tableName := c.claimTable(chunk)
+	item := c.claimItem(userID, chunk, claimPending)
+	err := timeDynamoRequest(ctx, "DynamoDB.PutItem", c.dynamo.tables.tableLabel(tableName), func(_ context.Context) error {
+		_, err := c.cfg.DynamoDB.PutItem(&dynamodb.PutItemInput{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%s)", hashKey)),
+		})
+		return err
+	})
+	if err == nil {
+		return dedupClaimed
+	}
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != conditionalCheckFailedException {
+		recordDynamoError(c.dynamo.tables.tableLabel(tableName), err)
+		log.Warnf("Error claiming chunk %s, writing it anyway: %v", chunk.ID, err)
+		return dedupError
+	}
+
+	state, err := c.claimState(ctx, userID, chunk)
+	if err != nil {
+		log.Warnf("Error verifying claim on chunk %s, writing it anyway: %v", chunk.ID, err)
+		return dedupUnverified
+	}
+	if state != claimDone {
+		return dedupUnverified
+	}
+	return dedupSkipped
+}
+
+// claimState returns the state of another replica's claim on a chunk.
+func (c *AWSStore) claimState(ctx context.Context, userID string, chunk *Chunk) (string, error) {
+	item := c.claimItem(userID, chunk, "")
+	input := &dynamodb.QueryInput{
+		TableName: aws.String(c.claimTable(chunk)),
+		KeyConditions: map[string]*dynamodb.Condition{
+			hashKey: {
+				AttributeValueList: []*dynamodb.AttributeValue{item[hashKey]},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq),
+			},
+			rangeKey: {
+				AttributeValueList: []*dynamodb.AttributeValue{item[rangeKey]},
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	state := ""
+	err := c.dynamo.queryPages(ctx, input, func(resp interface{}, lastPage bool) bool {
+		for _, item := range resp.(*dynamodb.QueryOutput).Items {
+			if v, ok := item[claimStateKey]; ok && v.S != nil {
+				state = *v.S
+			}
+		}
+		return !lastPage
+	})
+	return state, err
+}
+
+// completeClaims marks the claims on chunks as done, once their objects and
+// index entries have been written.
+func (c *AWSStore) completeClaims(ctx context.Context, userID string, chunks []Chunk) error {
+	writeReqs := map[string][]*dynamodb.WriteRequest{}
+	for i := range chunks {
+		tableName := c.claimTable(&chunks[i])
+		writeReqs[tableName] = append(writeReqs[tableName], &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: c.claimItem(userID, &chunks[i], claimDone),
+			},
+		})
+	}
+	return c.dynamo.batchWriteDynamo(ctx, writeReqs)
+}
+
+// claimTable is the table holding the claim on a chunk: that of the last
+// bucket the chunk is indexed in.
+func (c *AWSStore) claimTable(chunk *Chunk) string {
+	buckets := c.bigBuckets(chunk.Through, chunk.Through)
+	return buckets[len(buckets)-1].tableName
+}
+
+// claimItem is the claim record for a chunk, with the hash value
+// "<user>:claim:<chunk ID>".  Index entries' hash values are either
+// "<user>:<bucket>:<metric name>", where the bucket is an hour number or "d"
+// followed by a day number, so never "claim", or a hash and shard number
+// (see shardedHashValue), which have one colon, so claims can't collide with
+// them.
+func (c *AWSStore) claimItem(userID string, chunk *Chunk, state string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		hashKey:  {S: aws.String(fmt.Sprintf("%s:claim:%s", userID, chunk.ID))},
+		rangeKey: {B: claimRangeValue},
+	}
+	if state != "" {
+		item[claimStateKey] = &dynamodb.AttributeValue{S: aws.String(state)}
+	}
+	if c.cfg.IndexEntryTTL > 0 {
+		item[ttlKey] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(mtime.Now().Add(c.cfg.IndexEntryTTL).Unix(), 10)),
+		}
+	}
+	return item
+}
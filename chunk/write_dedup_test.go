@@ -0,0 +1,76 @@
+package chunk
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+type countingS3 struct {
+	ObjectClient
+	puts int32
+}
+
+func (c *countingS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	atomic.AddInt32(&c.puts, 1)
+	return c.ObjectClient.PutObject(input)
+}
+
+func TestWriteDedup(t *testing.T) {
+	dynamoDB := NewMockDynamoDB(0, 0)
+	setupDynamodb(t, dynamoDB)
+	s3 := &countingS3{ObjectClient: NewMockS3()}
+	cfg := StoreConfig{
+		DynamoDB:   dynamoDB,
+		S3:         s3,
+		WriteDedup: true,
+	}
+	replica1, replica2 := NewAWSStore(cfg), NewAWSStore(cfg)
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunk1 := newTestChunk(t, now, 10)
+	chunk2 := newTestChunk(t, now.Add(-time.Minute), 10)
+
+	// The first replica to put a chunk writes it; the others skip it.
+	if err := replica1.Put(ctx, []Chunk{chunk1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica2.Put(ctx, []Chunk{chunk1}); err != nil {
+		t.Fatal(err)
+	}
+	if puts := atomic.LoadInt32(&s3.puts); puts != 1 {
+		t.Fatalf("expected 1 S3 put, got %d", puts)
+	}
+
+	// A chunk claimed by a replica which hasn't finished writing it is
+	// written again.
+	if outcome := replica1.claimChunk(ctx, "0", &chunk2); outcome != dedupClaimed {
+		t.Fatalf("expected to claim chunk, got %s", outcome)
+	}
+	if err := replica2.Put(ctx, []Chunk{chunk2}); err != nil {
+		t.Fatal(err)
+	}
+	if puts := atomic.LoadInt32(&s3.puts); puts != 2 {
+		t.Fatalf("expected 2 S3 puts, got %d", puts)
+	}
+	if state, err := replica1.claimState(ctx, "0", &chunk2); err != nil || state != claimDone {
+		t.Fatalf("expected claim to be done, got %q (%v)", state, err)
+	}
+
+	// The chunks are indexed.
+	chunks, err := replica1.Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	_ "github.com/lib/pq" // Driver for postgres:// index URLs.
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	cortex_export "github.com/weaveworks/cortex/export"
+	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/user"
+)
+
+const usage = `Usage: cortex_chunk_tool <command> [flags] <arguments>
+
+Commands:
+  inspect [-s3.url URL] [-csv] <user/chunk-id | file>
+        Print a chunk's metric, time range, encoding and sample count.  The
+        chunk is fetched from the object store if -s3.url is set, and read
+        from a file otherwise.  With -csv, its samples are printed as CSV.
+
+  index-query -user ID -from TIME [-through TIME] [flags] <selector>
+        Look up the chunks matching a selector, like {__name__="foo"}, in the
+        index, and print the index entries read and the chunks found in each
+        index bucket.  The index flags must match those used to write it.
+
+  delete-tenant -user ID -s3.url URL -dynamodb.url URL [-configs.url URL]
+                [flags]
+        Delete all of a user's chunks and other objects from the object
+        store, and their index entries from every periodic table, printing
+        progress as it goes.  The bucketing, periodic table and key sharding
+        flags must match those the chunks were written with.  If
+        -configs.url is set, their rules config and its history are also
+        deleted from the configs API server, so rulers stop evaluating
+        their rules.
+
+  export -user ID -from TIME [-through TIME] -s3.url URL -dynamodb.url URL
+         [-block-duration DURATION] [-out DIR] [flags] <selector>...
+        Export the series matching the selectors, like {__name__="foo"}, to
+        Prometheus 2 TSDB blocks in the output directory, which can be
+        copied into a Prometheus server's data directory.  The store flags
+        are as for delete-tenant.
+`
+
+var encodingNames = map[prom_chunk.Encoding]string{
+	prom_chunk.Delta:       "delta",
+	prom_chunk.DoubleDelta: "double-delta",
+	prom_chunk.Varbit:      "varbit",
+}
+
+// cortex_chunk_tool is a collection of commands for looking at and managing
+// chunks, for support and debugging.
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "inspect":
+		inspect(flag.Args()[1:])
+	case "index-query":
+		indexQuery(flag.Args()[1:])
+	case "delete-tenant":
+		deleteTenant(flag.Args()[1:])
+	case "export":
+		export(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func inspect(args []string) {
+	var (
+		flags   = flag.NewFlagSet("inspect", flag.ExitOnError)
+		s3URL   = flags.String("s3.url", "", "Object store URL to fetch the chunk from; see cortex -s3.url. If empty, the chunk is read from a file.")
+		dumpCSV = flags.Bool("csv", false, "Print the chunk's samples as CSV, with the timestamp in milliseconds.")
+	)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+
+	buf, err := readChunk(*s3URL, name)
+	if err != nil {
+		log.Fatalf("Error reading chunk %s: %v", name, err)
+	}
+	info, err := chunk.InspectChunk(buf)
+	if err != nil {
+		log.Fatalf("Error decoding chunk %s: %v", name, err)
+	}
+
+	fmt.Printf("Chunk:    %s\n", name)
+	fmt.Printf("Format:   version %d, %d bytes", info.FormatVersion, info.Size)
+	if info.Compression != chunk.ChunkCompressionNone {
+		fmt.Printf(", %s compressed", info.Compression)
+	}
+	if info.FormatVersion == chunk.ChunkFormatV2 {
+		fmt.Printf(", %d blocks", info.Blocks)
+	}
+	fmt.Println()
+	fmt.Printf("Encoding: %s (%s)\n", encodingNames[info.Encoding], info.Encoding)
+	fmt.Printf("Metric:   %s\n", info.Metric)
+	fmt.Printf("From:     %s (%d)\n", formatTime(info.From), info.From)
+	fmt.Printf("Through:  %s (%d)\n", formatTime(info.Through), info.Through)
+	fmt.Printf("Samples:  %d\n", len(info.Samples))
+
+	if *dumpCSV {
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"timestamp", "value"})
+		for _, sample := range info.Samples {
+			w.Write([]string{
+				strconv.FormatInt(int64(sample.Timestamp), 10),
+				strconv.FormatFloat(float64(sample.Value), 'g', -1, 64),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatalf("Error writing samples: %v", err)
+		}
+	}
+}
+
+func indexQuery(args []string) {
+	var (
+		flags                = flag.NewFlagSet("index-query", flag.ExitOnError)
+		dynamodbURL          = flags.String("dynamodb.url", "localhost:8000", "Index URL; see cortex -dynamodb.url.")
+		userID               = flags.String("user", "", "User to look up chunks for.")
+		from                 = flags.String("from", "", "Start of the time range to look up, in RFC3339 format.")
+		through              = flags.String("through", "", "End of the time range to look up, in RFC3339 format. Defaults to now.")
+		dailyBucketsFrom     = flags.String("dynamodb.daily-buckets-from", "9999-01-01", "The date in the format YYYY-MM-DD of the first day for which DynamoDB index buckets should be day-sized vs. hour-sized.")
+		periodicTableStartAt = flags.String("dynamodb.periodic-table.start", "", "DynamoDB periodic tables start time. If unspecified, don't use periodic tables.")
+		tablePrefix          = flags.String("dynamodb.periodic-table.prefix", "cortex_", "DynamoDB table prefix for the periodic tables.")
+		tablePeriod          = flags.Duration("dynamodb.periodic-table.period", 7*24*time.Hour, "DynamoDB periodic tables period.")
+		boundaryOverlap      = flags.Duration("dynamodb.periodic-table.boundary-overlap", 0, "Periodic table boundary overlap; see cortex -dynamodb.periodic-table.boundary-overlap.")
+	)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *userID == "" || *from == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	matchers, err := promql.ParseMetricSelector(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error parsing selector: %v", err)
+	}
+	fromTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("Error parsing from: %v", err)
+	}
+	throughTime := time.Now()
+	if *through != "" {
+		if throughTime, err = time.Parse(time.RFC3339, *through); err != nil {
+			log.Fatalf("Error parsing through: %v", err)
+		}
+	}
+
+	cfg := chunk.StoreConfig{
+		PeriodicTableConfig: chunk.PeriodicTableConfig{
+			TablePrefix:          *tablePrefix,
+			TablePeriod:          *tablePeriod,
+			TableBoundaryOverlap: *boundaryOverlap,
+		},
+	}
+	cfg.DynamoDB, cfg.TableName, err = chunk.NewIndexClient(*dynamodbURL)
+	if err != nil {
+		log.Fatalf("Error creating DynamoDB client: %v", err)
+	}
+	dailyBucketsFromTime, err := time.Parse("2006-01-02", *dailyBucketsFrom)
+	if err != nil {
+		log.Fatalf("Error parsing dynamodb.daily-buckets-from: %v", err)
+	}
+	cfg.DailyBucketsFrom = model.TimeFromUnix(dailyBucketsFromTime.Unix())
+	if *periodicTableStartAt != "" {
+		cfg.UsePeriodicTables = true
+		cfg.PeriodicTableStartAt, err = time.Parse(time.RFC3339, *periodicTableStartAt)
+		if err != nil {
+			log.Fatalf("Error parsing dynamodb.periodic-table.start: %v", err)
+		}
+	}
+	store := chunk.NewAWSStore(cfg)
+
+	results, err := store.DebugIndexQuery(context.Background(), *userID,
+		model.TimeFromUnixNano(fromTime.UnixNano()), model.TimeFromUnixNano(throughTime.UnixNano()), matchers...)
+	if err != nil {
+		log.Fatalf("Error querying index: %v", err)
+	}
+	chunkIDs := map[string]struct{}{}
+	for _, result := range results {
+		fmt.Printf("Bucket %s (%s): %d entries, %d chunks\n", result.Bucket, strings.Join(result.Tables, ", "), len(result.Rows), len(result.ChunkIDs))
+		for _, row := range result.Rows {
+			matched := "matched"
+			if !row.Matched {
+				matched = "not matched"
+			}
+			fmt.Printf("  entry %s %s %s=%q %s (%s)\n", row.Table, row.HashValue, row.Label, row.Value, row.ChunkID, matched)
+		}
+		for _, id := range result.ChunkIDs {
+			fmt.Printf("  chunk %s\n", id)
+			chunkIDs[id] = struct{}{}
+		}
+	}
+	fmt.Printf("%d chunks in %d buckets\n", len(chunkIDs), len(results))
+}
+
+func deleteTenant(args []string) {
+	var (
+		flags      = flag.NewFlagSet("delete-tenant", flag.ExitOnError)
+		storeFlags = registerStoreFlags(flags)
+		userID     = flags.String("user", "", "User to delete.")
+		configsURL = flags.String("configs.url", "", "If set, also delete the user's rules config from the configs API server at this URL.")
+	)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 || *userID == "" || *storeFlags.s3URL == "" || *storeFlags.dynamodbURL == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	store := storeFlags.store()
+
+	stats, err := store.DeleteTenant(context.Background(), *userID, func(stats chunk.DeleteTenantStats) {
+		fmt.Printf("%d chunks found, %d skipped, %d index entries deleted, %d objects deleted\n", stats.Chunks, stats.Skipped, stats.IndexEntries, stats.Objects)
+	})
+	if err != nil {
+		log.Fatalf("Error deleting user %s, which can be retried: %v", *userID, err)
+	}
+	fmt.Printf("Deleted user %s: %d index entries and %d objects\n", *userID, stats.IndexEntries, stats.Objects)
+	if stats.Skipped > 0 {
+		fmt.Printf("%d chunks couldn't be read, so some of their index entries may remain\n", stats.Skipped)
+	}
+
+	if *configsURL != "" {
+		u, err := url.Parse(*configsURL)
+		if err != nil {
+			log.Fatalf("Invalid -configs.url: %v", err)
+		}
+		if err := ruler.DeleteOrgConfig(http.DefaultClient, u, *userID); err != nil {
+			log.Fatalf("Error deleting rules config of user %s, which can be retried: %v", *userID, err)
+		}
+		fmt.Printf("Deleted rules config of user %s\n", *userID)
+	}
+}
+
+func export(args []string) {
+	var (
+		flags         = flag.NewFlagSet("export", flag.ExitOnError)
+		storeFlags    = registerStoreFlags(flags)
+		userID        = flags.String("user", "", "User to export the series of.")
+		from          = flags.String("from", "", "Start of the time range to export, in RFC3339 format.")
+		through       = flags.String("through", "", "End of the time range to export, in RFC3339 format. Defaults to now.")
+		blockDuration = flags.Duration("block-duration", 2*time.Hour, "Write a block for each aligned period of this long. If zero, write a single block.")
+		outDir        = flags.String("out", ".", "Directory to write blocks to.")
+	)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *userID == "" || *from == "" || *storeFlags.s3URL == "" || *storeFlags.dynamodbURL == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg := cortex_export.Config{BlockDuration: *blockDuration}
+	for _, selector := range flags.Args() {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			log.Fatalf("Error parsing selector %s: %v", selector, err)
+		}
+		cfg.MatcherSets = append(cfg.MatcherSets, matchers)
+	}
+	fromTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("Error parsing from: %v", err)
+	}
+	throughTime := time.Now()
+	if *through != "" {
+		if throughTime, err = time.Parse(time.RFC3339, *through); err != nil {
+			log.Fatalf("Error parsing through: %v", err)
+		}
+	}
+	cfg.From = model.TimeFromUnixNano(fromTime.UnixNano())
+	cfg.Through = model.TimeFromUnixNano(throughTime.UnixNano())
+	if err := os.MkdirAll(*outDir, 0777); err != nil {
+		log.Fatalf("Error creating output directory: %v", err)
+	}
+
+	metas, err := cortex_export.Export(user.WithID(context.Background(), *userID), storeFlags.store(), cfg, *outDir)
+	if err != nil {
+		log.Fatalf("Error exporting: %v", err)
+	}
+	for _, meta := range metas {
+		fmt.Printf("Block %s: %s to %s, %d series, %d samples\n", meta.ULID,
+			formatTime(model.Time(meta.MinTime)), formatTime(model.Time(meta.MaxTime)), meta.Stats.NumSeries, meta.Stats.NumSamples)
+	}
+	fmt.Printf("Wrote %d blocks to %s\n", len(metas), *outDir)
+}
+
+// storeFlags are the flags needed to read a chunk store; see
+// registerStoreFlags.
+type storeFlags struct {
+	s3URL                *string
+	chunkKeyShards       *int
+	dynamodbURL          *string
+	dailyBucketsFrom     *string
+	periodicTableStartAt *string
+	tablePrefix          *string
+	tablePeriod          *time.Duration
+	boundaryOverlap      *time.Duration
+	writeDedup           *bool
+}
+
+// registerStoreFlags registers the chunk store flags in flags.  Those
+// affecting where chunks and their index entries are must match those the
+// chunks were written with.
+func registerStoreFlags(flags *flag.FlagSet) storeFlags {
+	return storeFlags{
+		s3URL:                flags.String("s3.url", "", "Object store URL; see cortex -s3.url."),
+		chunkKeyShards:       flags.Int("s3.chunk-key-shards", 0, "Number of chunk key shards; see cortex -s3.chunk-key-shards."),
+		dynamodbURL:          flags.String("dynamodb.url", "", "Index URL; see cortex -dynamodb.url."),
+		dailyBucketsFrom:     flags.String("dynamodb.daily-buckets-from", "9999-01-01", "The date in the format YYYY-MM-DD of the first day for which DynamoDB index buckets should be day-sized vs. hour-sized."),
+		periodicTableStartAt: flags.String("dynamodb.periodic-table.start", "", "DynamoDB periodic tables start time. If unspecified, don't use periodic tables."),
+		tablePrefix:          flags.String("dynamodb.periodic-table.prefix", "cortex_", "DynamoDB table prefix for the periodic tables."),
+		tablePeriod:          flags.Duration("dynamodb.periodic-table.period", 7*24*time.Hour, "DynamoDB periodic tables period."),
+		boundaryOverlap:      flags.Duration("dynamodb.periodic-table.boundary-overlap", 0, "Periodic table boundary overlap; see cortex -dynamodb.periodic-table.boundary-overlap."),
+		writeDedup:           flags.Bool("chunk.write-dedup", false, "Whether chunks were written with write claims; see cortex -chunk.write-dedup."),
+	}
+}
+
+// store makes the chunk store the flags describe, exiting on error.
+func (f storeFlags) store() *chunk.AWSStore {
+	cfg := chunk.StoreConfig{
+		StorageURL:     *f.s3URL,
+		ChunkKeyShards: *f.chunkKeyShards,
+		WriteDedup:     *f.writeDedup,
+		PeriodicTableConfig: chunk.PeriodicTableConfig{
+			TablePrefix:          *f.tablePrefix,
+			TablePeriod:          *f.tablePeriod,
+			TableBoundaryOverlap: *f.boundaryOverlap,
+		},
+	}
+	var err error
+	cfg.DynamoDB, cfg.TableName, err = chunk.NewIndexClient(*f.dynamodbURL)
+	if err != nil {
+		log.Fatalf("Error creating DynamoDB client: %v", err)
+	}
+	dailyBucketsFromTime, err := time.Parse("2006-01-02", *f.dailyBucketsFrom)
+	if err != nil {
+		log.Fatalf("Error parsing dynamodb.daily-buckets-from: %v", err)
+	}
+	cfg.DailyBucketsFrom = model.TimeFromUnix(dailyBucketsFromTime.Unix())
+	if *f.periodicTableStartAt != "" {
+		cfg.UsePeriodicTables = true
+		cfg.PeriodicTableStartAt, err = time.Parse(time.RFC3339, *f.periodicTableStartAt)
+		if err != nil {
+			log.Fatalf("Error parsing dynamodb.periodic-table.start: %v", err)
+		}
+	}
+	store, err := chunk.NewStore(cfg)
+	if err != nil {
+		log.Fatalf("Error creating object store client: %v", err)
+	}
+	return store
+}
+
+// readChunk reads a chunk object from the object store at storageURL, where
+// name is its key (user ID and chunk ID), or from the file name if
+// storageURL is empty.
+func readChunk(storageURL, name string) ([]byte, error) {
+	if storageURL == "" {
+		return ioutil.ReadFile(name)
+	}
+	client, bucketName, err := chunk.NewObjectClient(storageURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func formatTime(t model.Time) string {
+	return t.Time().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // Driver for postgres:// index URLs.
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+)
+
+// cortex_index_rebuild regenerates the DynamoDB index from the chunks in S3,
+// for recovery after losing index tables.  The index tables must already
+// exist, and the bucketing and periodic table flags must match those the
+// chunks were written with.
+func main() {
+	var (
+		s3URL                = flag.String("s3.url", "localhost:4569", "Object store URL; see cortex -s3.url.")
+		chunkKeyShards       = flag.Int("s3.chunk-key-shards", 0, "Number of chunk key shards; see cortex -s3.chunk-key-shards.")
+		dynamodbURL          = flag.String("dynamodb.url", "localhost:8000", "DynamoDB endpoint URL.")
+		dailyBucketsFrom     = flag.String("dynamodb.daily-buckets-from", "9999-01-01", "The date in the format YYYY-MM-DD of the first day for which DynamoDB index buckets should be day-sized vs. hour-sized.")
+		periodicTableStartAt = flag.String("dynamodb.periodic-table.start", "", "DynamoDB periodic tables start time. If unspecified, don't use periodic tables.")
+		tablePrefix          = flag.String("dynamodb.periodic-table.prefix", "cortex_", "DynamoDB table prefix for the periodic tables.")
+		tablePeriod          = flag.Duration("dynamodb.periodic-table.period", 7*24*time.Hour, "DynamoDB periodic tables period.")
+		from                 = flag.String("from", "", "Rebuild the index for chunks overlapping the time range starting at this RFC3339 time.")
+		through              = flag.String("through", "", "Rebuild the index for chunks overlapping the time range ending at this RFC3339 time. Defaults to now.")
+		users                = flag.String("users", "", "Comma-separated list of users to rebuild the index for. If empty, all users found in S3.")
+		fetchWorkers         = flag.Int("fetch-workers", 16, "Maximum number of chunks to fetch from S3 at once.")
+	)
+	flag.Parse()
+
+	fromTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("Error parsing from: %v", err)
+	}
+	throughTime := time.Now()
+	if *through != "" {
+		if throughTime, err = time.Parse(time.RFC3339, *through); err != nil {
+			log.Fatalf("Error parsing through: %v", err)
+		}
+	}
+
+	cfg := chunk.StoreConfig{
+		StorageURL:     *s3URL,
+		ChunkKeyShards: *chunkKeyShards,
+		FetchWorkers:   *fetchWorkers,
+		PeriodicTableConfig: chunk.PeriodicTableConfig{
+			TablePrefix: *tablePrefix,
+			TablePeriod: *tablePeriod,
+		},
+	}
+	cfg.DynamoDB, cfg.TableName, err = chunk.NewIndexClient(*dynamodbURL)
+	if err != nil {
+		log.Fatalf("Error creating DynamoDB client: %v", err)
+	}
+	dailyBucketsFromTime, err := time.Parse("2006-01-02", *dailyBucketsFrom)
+	if err != nil {
+		log.Fatalf("Error parsing dynamodb.daily-buckets-from: %v", err)
+	}
+	cfg.DailyBucketsFrom = model.TimeFromUnix(dailyBucketsFromTime.Unix())
+	if *periodicTableStartAt != "" {
+		cfg.UsePeriodicTables = true
+		cfg.PeriodicTableStartAt, err = time.Parse(time.RFC3339, *periodicTableStartAt)
+		if err != nil {
+			log.Fatalf("Error parsing dynamodb.periodic-table.start: %v", err)
+		}
+	}
+	store, err := chunk.NewStore(cfg)
+	if err != nil {
+		log.Fatalf("Error creating object store client: %v", err)
+	}
+
+	ctx := context.Background()
+	var userIDs []string
+	if *users != "" {
+		userIDs = strings.Split(*users, ",")
+	} else if userIDs, err = store.ListUsers(ctx); err != nil {
+		log.Fatalf("Error listing users: %v", err)
+	}
+
+	var total chunk.RebuildStats
+	for _, userID := range userIDs {
+		stats, err := store.RebuildIndex(ctx, userID, model.TimeFromUnixNano(fromTime.UnixNano()), model.TimeFromUnixNano(throughTime.UnixNano()))
+		if err != nil {
+			log.Fatalf("Error rebuilding index for user %s: %v", userID, err)
+		}
+		log.Infof("User %s: rebuilt index for %d chunks, skipped %d", userID, stats.Chunks, stats.Skipped)
+		total.Chunks += stats.Chunks
+		total.Skipped += stats.Skipped
+	}
+	log.Infof("Rebuilt index for %d chunks of %d users, skipped %d", total.Chunks, len(userIDs), total.Skipped)
+}
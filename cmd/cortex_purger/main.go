@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // Driver for postgres:// index URLs.
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+)
+
+// cortex_purger deletes chunks older than their user's retention period from
+// S3, with their index entries, once, as cortex -chunk.purge-interval does
+// periodically.  The bucketing and periodic table flags must match those the
+// chunks were written with, so their index entries are found.
+func main() {
+	var (
+		s3URL                = flag.String("s3.url", "localhost:4569", "Object store URL; see cortex -s3.url.")
+		chunkKeyShards       = flag.Int("s3.chunk-key-shards", 0, "Number of chunk key shards; see cortex -s3.chunk-key-shards.")
+		dynamodbURL          = flag.String("dynamodb.url", "localhost:8000", "DynamoDB endpoint URL.")
+		dailyBucketsFrom     = flag.String("dynamodb.daily-buckets-from", "9999-01-01", "The date in the format YYYY-MM-DD of the first day for which DynamoDB index buckets should be day-sized vs. hour-sized.")
+		periodicTableStartAt = flag.String("dynamodb.periodic-table.start", "", "DynamoDB periodic tables start time. If unspecified, don't use periodic tables.")
+		tablePrefix          = flag.String("dynamodb.periodic-table.prefix", "cortex_", "DynamoDB table prefix for the periodic tables.")
+		tablePeriod          = flag.Duration("dynamodb.periodic-table.period", 7*24*time.Hour, "DynamoDB periodic tables period.")
+		retentionPeriod      = flag.Duration("chunk.retention-period", 0, "Delete chunks which ended longer ago than this. If zero, keep chunks forever.")
+		retentionOverrides   = flag.String("chunk.retention-overrides", "", "Per-user retention periods; see cortex -chunk.retention-overrides.")
+		users                = flag.String("users", "", "Comma-separated list of users to delete old chunks of. If empty, all users found in S3.")
+	)
+	flag.Parse()
+
+	retention := chunk.RetentionConfig{Period: *retentionPeriod}
+	var err error
+	if retention.UserPeriods, err = chunk.ParseRetentionOverrides(*retentionOverrides); err != nil {
+		log.Fatalf("Error parsing retention overrides: %v", err)
+	}
+
+	cfg := chunk.StoreConfig{
+		StorageURL:     *s3URL,
+		ChunkKeyShards: *chunkKeyShards,
+		PeriodicTableConfig: chunk.PeriodicTableConfig{
+			TablePrefix: *tablePrefix,
+			TablePeriod: *tablePeriod,
+		},
+	}
+	cfg.DynamoDB, cfg.TableName, err = chunk.NewIndexClient(*dynamodbURL)
+	if err != nil {
+		log.Fatalf("Error creating DynamoDB client: %v", err)
+	}
+	dailyBucketsFromTime, err := time.Parse("2006-01-02", *dailyBucketsFrom)
+	if err != nil {
+		log.Fatalf("Error parsing dynamodb.daily-buckets-from: %v", err)
+	}
+	cfg.DailyBucketsFrom = model.TimeFromUnix(dailyBucketsFromTime.Unix())
+	if *periodicTableStartAt != "" {
+		cfg.UsePeriodicTables = true
+		cfg.PeriodicTableStartAt, err = time.Parse(time.RFC3339, *periodicTableStartAt)
+		if err != nil {
+			log.Fatalf("Error parsing dynamodb.periodic-table.start: %v", err)
+		}
+	}
+	store, err := chunk.NewStore(cfg)
+	if err != nil {
+		log.Fatalf("Error creating object store client: %v", err)
+	}
+
+	ctx := context.Background()
+	var userIDs []string
+	if *users != "" {
+		userIDs = strings.Split(*users, ",")
+	} else if userIDs, err = store.ListUsers(ctx); err != nil {
+		log.Fatalf("Error listing users: %v", err)
+	}
+
+	var total chunk.PurgeStats
+	now := time.Now()
+	for _, userID := range userIDs {
+		period := retention.PeriodFor(userID)
+		if period <= 0 {
+			continue
+		}
+		before := model.TimeFromUnixNano(now.Add(-period).UnixNano())
+		stats, err := store.Purge(ctx, userID, before)
+		if err != nil {
+			log.Fatalf("Error deleting old chunks of user %s: %v", userID, err)
+		}
+		log.Infof("User %s: deleted %d chunks older than %v, skipped %d", userID, stats.Chunks, period, stats.Skipped)
+		total.Chunks += stats.Chunks
+		total.Skipped += stats.Skipped
+	}
+	log.Infof("Deleted %d chunks of %d users, skipped %d", total.Chunks, len(userIDs), total.Skipped)
+}
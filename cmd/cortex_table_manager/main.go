@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"time"
 
+	_ "github.com/lib/pq" // Driver for postgres:// index URLs.
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 
@@ -23,9 +24,12 @@ func main() {
 	periodicTableStartAt := flag.String("dynamodb.periodic-table.start", "", "DynamoDB periodic tables start time.")
 	dynamodbURL := flag.String("dynamodb.url", "localhost:8000", "DynamoDB endpoint URL.")
 	flag.StringVar(&cfg.TablePrefix, "dynamodb.periodic-table.prefix", "cortex_", "DynamoDB table prefix for the periodic tables.")
+	indexSchema := flag.String("chunk.index-schema", "", "Index schema periods, as used by the chunk store; tables are made with each period's table prefix.")
 	flag.DurationVar(&cfg.TablePeriod, "dynamodb.periodic-table.period", 7*24*time.Hour, "DynamoDB periodic tables period.")
-	flag.DurationVar(&cfg.CreationGracePeriod, "dynamodb.periodic-table.grace-period", 10*time.Minute, "DynamoDB periodic tables grace period (duration which table will be created/deleted before/after it's needed).")
+	flag.DurationVar(&cfg.CreationGracePeriod, "dynamodb.periodic-table.grace-period", 10*time.Minute, "DynamoDB periodic tables grace period (duration which table will be created before it's needed).")
+	flag.DurationVar(&cfg.InactiveGracePeriod, "dynamodb.periodic-table.inactive-grace-period", 10*time.Minute, "Duration past the max chunk age after a periodic table's period ends that it keeps its write throughput.")
 	flag.DurationVar(&cfg.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
+	flag.DurationVar(&cfg.RetentionPeriod, "chunk.retention-period", 0, "If non-zero, delete periodic tables once all the chunks indexed in them ended longer ago than this; see cortex -chunk.retention-period. Per-tenant overrides longer than this are not honoured.")
 	flag.Int64Var(&cfg.ProvisionedWriteThroughput, "dynamodb.periodic-table.write-throughput", 3000, "DynamoDB periodic tables write throughput")
 	flag.Int64Var(&cfg.ProvisionedReadThroughput, "dynamodb.periodic-table.read-throughput", 300, "DynamoDB periodic tables read throughput")
 	flag.Parse()
@@ -36,7 +40,12 @@ func main() {
 		log.Fatalf("Error parsing dynamodb.periodic-table.start: %v", err)
 	}
 
-	cfg.DynamoDB, cfg.TableName, err = chunk.NewDynamoDBClient(*dynamodbURL)
+	cfg.Schema, err = chunk.ParseSchemaConfig(*indexSchema)
+	if err != nil {
+		log.Fatalf("Error parsing chunk.index-schema: %v", err)
+	}
+
+	cfg.DynamoDB, cfg.TableName, err = chunk.NewIndexClient(*dynamodbURL)
 	if err != nil {
 		log.Fatalf("Error creating DynamoDB client: %v", err)
 	}
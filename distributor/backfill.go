@@ -0,0 +1,57 @@
+package distributor
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// BackfillHandler returns a http.Handler which accepts WriteRequests of
+// historical samples, eg from a Prometheus server being migrated, and
+// writes them straight to the chunk store, bypassing the ingesters.  Labels
+// are validated as for pushes, and requests with samples newer than
+// BackfillMinAge, which could overlap the ingesters' chunks, are rejected
+// whole.
+func (d *Distributor) BackfillHandler(store chunk.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req remote.WriteRequest
+		ctx, abort := util.ParseProtoRequest(w, r, &req, true)
+		if abort {
+			return
+		}
+		userID, err := user.GetID(ctx)
+		if err != nil {
+			util.WriteError(w, err)
+			return
+		}
+
+		if err := d.validateLabels(&req); err != nil {
+			util.WriteError(w, err)
+			return
+		}
+		samples := util.FromWriteRequest(&req)
+		minAge := model.Now().Add(-d.cfg.BackfillMinAge)
+		for _, sample := range samples {
+			if sample.Timestamp > minAge {
+				util.WriteError(w, ValidationError{fmt.Errorf("sample for %s at %s is too recent to backfill: the limit is %s", sample.Metric, sample.Timestamp.Time().UTC(), d.cfg.BackfillMinAge)})
+				return
+			}
+		}
+
+		chunks, err := chunk.Backfill(ctx, store, samples)
+		if err != nil {
+			log.Errorf("backfill err: %v", err)
+			util.WriteError(w, err)
+			return
+		}
+		d.backfilledSamples.WithLabelValues(userID).Add(float64(len(samples)))
+		d.backfilledChunks.WithLabelValues(userID).Add(float64(chunks))
+	})
+}
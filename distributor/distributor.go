@@ -1,8 +1,10 @@
 package distributor
 
 import (
+	"crypto/tls"
 	"fmt"
 	"hash/fnv"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,9 +12,11 @@ import (
 	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
 	"github.com/mwitkow/go-grpc-middleware"
 	"github.com/opentracing/opentracing-go"
+	"github.com/weaveworks/common/mtime"
 	"github.com/weaveworks/scope/common/instrument"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
@@ -40,14 +44,25 @@ type Distributor struct {
 	cfg        Config
 	clientsMtx sync.RWMutex
 	clients    map[string]cortex.IngesterClient
+	clientTLS  *tls.Config
+
+	forwarders       map[string]*forwarder
+	forwarderMetrics *forwarderMetrics
+	reservedLabels   map[model.LabelName]struct{}
+	exporter         SampleExporter
 
 	queryDuration          *prometheus.HistogramVec
 	receivedSamples        prometheus.Counter
+	sampleLag              *prometheus.HistogramVec
 	sendDuration           *prometheus.HistogramVec
 	ingesterAppends        *prometheus.CounterVec
 	ingesterAppendFailures *prometheus.CounterVec
 	ingesterQueries        *prometheus.CounterVec
 	ingesterQueryFailures  *prometheus.CounterVec
+	labelViolations        *prometheus.CounterVec
+	discardedSamples       *prometheus.CounterVec
+	backfilledSamples      *prometheus.CounterVec
+	backfilledChunks       *prometheus.CounterVec
 }
 
 // ReadRing represents the read inferface to the ring.
@@ -56,7 +71,7 @@ type ReadRing interface {
 
 	Get(key uint32, n int, op ring.Operation) ([]ring.IngesterDesc, error)
 	BatchGet(keys []uint32, n int, op ring.Operation) ([][]ring.IngesterDesc, error)
-	GetAll() []ring.IngesterDesc
+	GetAll() ([]ring.IngesterDesc, int)
 }
 
 // Config contains the configuration require to
@@ -68,6 +83,59 @@ type Config struct {
 	MinReadSuccesses  int
 	HeartbeatTimeout  time.Duration
 	RemoteTimeout     time.Duration
+
+	Forwarding ForwardingConfig
+
+	// Hooks into the push path, in order; see WriteInterceptor.
+	WriteInterceptors []WriteInterceptor
+
+	// Labels clients may not push, and whether to reject or strip series
+	// with them.  If the policy is empty, no checks are made.
+	ReservedLabels      []model.LabelName
+	ReservedLabelPolicy string
+
+	// Whether to reject or strip series with duplicate label names.  If
+	// empty, they are accepted, as they always have been.
+	DuplicateLabelPolicy string
+
+	// If set, series are sharded across ingesters by all their labels rather
+	// than just the metric name, so one very busy metric doesn't overload a
+	// few ingesters.  Queries then have to go to all ingesters.
+	ShardByAllLabels bool
+
+	// If set, queries go to all ingesters even if ShardByAllLabels isn't, so
+	// series written under either sharding scheme are found.  Set this on
+	// queriers while distributors change scheme, in either direction, and
+	// for as long as ingesters keep series in memory afterwards.
+	ShardingMigration bool
+
+	// Limits on the age of pushed samples, for all tenants, and overriding
+	// them for particular tenants.
+	SampleAgeLimits    SampleAgeLimits
+	SampleAgeOverrides map[string]SampleAgeLimits
+
+	// Backfilled samples must be at least this old, so they don't overlap
+	// chunks still being built in the ingesters.
+	BackfillMinAge time.Duration
+
+	// TLS for connections to ingesters, for writes and queries.
+	IngesterClientTLS util.TLSConfig
+
+	// How to resolve samples with the same timestamp but different values
+	// from different ingesters, taking them in ring order.  Empty keeps the
+	// first.
+	DuplicatePolicy string
+
+	// If set, queries without a metric name equality matcher are sent to
+	// every ingester, rather than rejected, for the chunk store's nameless
+	// query fallback.
+	NamelessQueries bool
+}
+
+// SampleExporter is a hook for publishing accepted samples to downstream
+// pipelines.  Export must not block.
+type SampleExporter interface {
+	Export(userID string, samples []*model.Sample)
 }
 
 // New constructs a new Distributor
@@ -78,9 +146,59 @@ func New(cfg Config) (*Distributor, error) {
 	if cfg.MinReadSuccesses > cfg.ReplicationFactor {
 		return nil, fmt.Errorf("MinReadSuccesses > ReplicationFactor: %d > %d", cfg.MinReadSuccesses, cfg.ReplicationFactor)
 	}
+	switch cfg.ReservedLabelPolicy {
+	case "", RejectLabels, StripLabels:
+	default:
+		return nil, fmt.Errorf("invalid reserved label policy: %q", cfg.ReservedLabelPolicy)
+	}
+	switch cfg.DuplicateLabelPolicy {
+	case "", RejectLabels, StripLabels:
+	default:
+		return nil, fmt.Errorf("invalid duplicate label policy: %q", cfg.DuplicateLabelPolicy)
+	}
+	if cfg.DuplicatePolicy != "" {
+		if err := util.ValidateDuplicatePolicy(cfg.DuplicatePolicy); err != nil {
+			return nil, err
+		}
+	}
+	reservedLabels := map[model.LabelName]struct{}{}
+	for _, l := range cfg.ReservedLabels {
+		reservedLabels[l] = struct{}{}
+	}
+
+	clientTLS, err := cfg.IngesterClientTLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	forwarderMetrics := newForwarderMetrics()
+	forwarders := map[string]*forwarder{}
+	for _, urls := range cfg.Forwarding.Rules {
+		for _, url := range urls {
+			if _, ok := forwarders[url]; !ok {
+				forwarders[url] = newForwarder(url, cfg.Forwarding, cfg.RemoteTimeout, forwarderMetrics)
+			}
+		}
+	}
 	return &Distributor{
-		cfg:     cfg,
-		clients: map[string]cortex.IngesterClient{},
+		cfg:              cfg,
+		clients:          map[string]cortex.IngesterClient{},
+		clientTLS:        clientTLS,
+		forwarders:       forwarders,
+		forwarderMetrics: forwarderMetrics,
+		reservedLabels:   reservedLabels,
+		labelViolations:  newLabelViolationsCounter(),
+		discardedSamples: newDiscardedSamplesCounter(),
+		backfilledSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_backfilled_samples_total",
+			Help:      "The total number of samples backfilled straight to the chunk store, by user.",
+		}, []string{"user"}),
+		backfilledChunks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_backfilled_chunks_total",
+			Help:      "The total number of chunks written by backfills, by user.",
+		}, []string{"user"}),
 		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_query_duration_seconds",
@@ -92,6 +210,14 @@ func New(cfg Config) (*Distributor, error) {
 			Name:      "distributor_received_samples_total",
 			Help:      "The total number of received samples.",
 		}),
+		// Samples timestamped in the future, eg by clients with skewed
+		// clocks, have a negative lag.
+		sampleLag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cortex",
+			Name:      "distributor_sample_lag_seconds",
+			Help:      "Time between a sample's timestamp and its arrival at the distributor, by user.",
+			Buckets:   []float64{-60, -10, -1, 0, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 4 * 3600, 24 * 3600},
+		}, []string{"user"}),
 		sendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_send_duration_seconds",
@@ -121,6 +247,12 @@ func New(cfg Config) (*Distributor, error) {
 	}, nil
 }
 
+// SetExporter sets an exporter to pass accepted samples to.  It must be
+// called before any samples are pushed.
+func (d *Distributor) SetExporter(e SampleExporter) {
+	d.exporter = e
+}
+
 func (d *Distributor) getClientFor(ingester ring.IngesterDesc) (cortex.IngesterClient, error) {
 	d.clientsMtx.RLock()
 	client, ok := d.clients[ingester.Hostname]
@@ -137,12 +269,17 @@ func (d *Distributor) getClientFor(ingester ring.IngesterDesc) (cortex.IngesterC
 	}
 
 	if ingester.GRPCHostname != "" {
+		transport := grpc.WithInsecure()
+		if d.clientTLS != nil {
+			transport = grpc.WithTransportCredentials(credentials.NewTLS(d.clientTLS))
+		}
 		conn, err := grpc.Dial(
 			ingester.GRPCHostname,
-			grpc.WithInsecure(),
+			transport,
 			grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
 				otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
 				middleware.ClientUserHeaderInterceptor,
+				middleware.ClientRequestIDInterceptor,
 			)),
 		)
 		if err != nil {
@@ -151,7 +288,7 @@ func (d *Distributor) getClientFor(ingester ring.IngesterDesc) (cortex.IngesterC
 		client = cortex.NewIngesterClient(conn)
 	} else {
 		var err error
-		client, err = NewHTTPIngesterClient(ingester.Hostname, d.cfg.RemoteTimeout)
+		client, err = NewHTTPIngesterClient(ingester.Hostname, d.cfg.RemoteTimeout, d.clientTLS)
 		if err != nil {
 			return nil, err
 		}
@@ -161,11 +298,33 @@ func (d *Distributor) getClientFor(ingester ring.IngesterDesc) (cortex.IngesterC
 	return client, nil
 }
 
-func tokenForMetric(userID string, metric model.Metric) uint32 {
+func (d *Distributor) tokenForMetric(userID string, metric model.Metric) uint32 {
+	if d.cfg.ShardByAllLabels {
+		return tokenForLabels(userID, metric)
+	}
 	name := metric[model.MetricNameLabel]
 	return tokenFor(userID, name)
 }
 
+// tokenForLabels hashes all of a metric's labels, in order of name.
+func tokenForLabels(userID string, metric model.Metric) uint32 {
+	names := make(model.LabelNames, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	for _, name := range names {
+		h.Write([]byte{model.SeparatorByte})
+		h.Write([]byte(name))
+		h.Write([]byte{model.SeparatorByte})
+		h.Write([]byte(metric[name]))
+	}
+	return h.Sum32()
+}
+
 func tokenFor(userID string, name model.LabelValue) uint32 {
 	h := fnv.New32()
 	h.Write([]byte(userID))
@@ -186,12 +345,27 @@ func (d *Distributor) Push(ctx context.Context, req *remote.WriteRequest) (*cort
 		return nil, err
 	}
 
+	if err := d.validateLabels(req); err != nil {
+		return nil, err
+	}
+
 	samples := util.FromWriteRequest(req)
 	d.receivedSamples.Add(float64(len(samples)))
+	d.observeSampleLag(userID, samples)
+
+	// Samples outside the tenant's age limits are discarded, and the push
+	// fails, but only once the rest have been ingested.
+	samples, discardErr := d.validateSampleAges(userID, samples)
+	if len(samples) == 0 && discardErr != nil {
+		return nil, discardErr
+	}
+	if samples, err = d.beforeWrite(ctx, userID, samples); err != nil {
+		return nil, err
+	}
 
 	keys := make([]uint32, len(samples), len(samples))
 	for i, sample := range samples {
-		keys[i] = tokenForMetric(userID, sample.Metric)
+		keys[i] = d.tokenForMetric(userID, sample.Metric)
 	}
 
 	ingesters, err := d.cfg.Ring.BatchGet(keys, d.cfg.ReplicationFactor, ring.Write)
@@ -222,7 +396,7 @@ func (d *Distributor) Push(ctx context.Context, req *remote.WriteRequest) (*cort
 		// This is just a shortcut - if there are not minSuccess available ingesters,
 		// after filtering out dead ones, don't even both trying.
 		if len(liveIngesters) < sampleTrackers[i].minSuccess {
-			return nil, fmt.Errorf("wanted at least %d live ingesters to process write, had %d",
+			return nil, util.NewError(util.ErrUnavailable, "wanted at least %d live ingesters to process write, had %d",
 				sampleTrackers[i].minSuccess, len(liveIngesters))
 		}
 
@@ -247,13 +421,62 @@ func (d *Distributor) Push(ctx context.Context, req *remote.WriteRequest) (*cort
 	}
 	for i := range sampleTrackers {
 		if sampleTrackers[i].succeeded < int32(sampleTrackers[i].minSuccess) {
-			return nil, fmt.Errorf("need %d successful writes, only got %d, last error was: %v",
+			return nil, util.NewError(util.ErrorCodeOf(lastErr), "need %d successful writes, only got %d, last error was: %v",
 				sampleTrackers[i].minSuccess, sampleTrackers[i].succeeded, lastErr)
 		}
 	}
+	d.forward(userID, samples)
+	if d.exporter != nil {
+		d.exporter.Export(userID, samples)
+	}
+	d.afterWrite(ctx, userID, samples)
+	if discardErr != nil {
+		return nil, discardErr
+	}
 	return &cortex.WriteResponse{}, nil
 }
 
+// observeSampleLag records how far behind the arrival time each sample's
+// timestamp is.
+func (d *Distributor) observeSampleLag(userID string, samples []*model.Sample) {
+	sampleLag := d.sampleLag.WithLabelValues(userID)
+	now := model.TimeFromUnixNano(mtime.Now().UnixNano())
+	for _, sample := range samples {
+		sampleLag.Observe(float64(now-sample.Timestamp) / 1000)
+	}
+}
+
+// forward queues samples which have been successfully ingested to be
+// forwarded to the tenant's remote write endpoints, if any.
+func (d *Distributor) forward(userID string, samples []*model.Sample) {
+	for _, url := range d.forwardingURLs(userID) {
+		d.forwarders[url].enqueue(userID, samples)
+	}
+}
+
+// forwardingURLs returns the URLs in the tenant's forwarding rule and the
+// "*" rule, each once, so samples aren't sent twice to a URL in both.
+func (d *Distributor) forwardingURLs(userID string) []string {
+	var urls []string
+	seen := map[string]struct{}{}
+	for _, tenant := range []string{userID, "*"} {
+		for _, url := range d.cfg.Forwarding.Rules[tenant] {
+			if _, ok := seen[url]; !ok {
+				seen[url] = struct{}{}
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// Stop stops the distributor, sending any samples queued for forwarding.
+func (d *Distributor) Stop() {
+	for _, f := range d.forwarders {
+		f.stop()
+	}
+}
+
 func (d *Distributor) sendSamples(ctx context.Context, ingester ring.IngesterDesc, sampleTrackers []*sampleTracker) error {
 	client, err := d.getClientFor(ingester)
 	if err != nil {
@@ -281,12 +504,12 @@ func metricNameFromLabelMatchers(matchers ...*metric.LabelMatcher) (model.LabelV
 	for _, m := range matchers {
 		if m.Name == model.MetricNameLabel {
 			if m.Type != metric.Equal {
-				return "", fmt.Errorf("non-equality matchers are not supported on the metric name")
+				return "", util.NewError(util.ErrBadData, "non-equality matchers are not supported on the metric name")
 			}
 			return m.Value, nil
 		}
 	}
-	return "", fmt.Errorf("no metric name matcher found")
+	return "", util.NewError(util.ErrBadData, "no metric name matcher found")
 }
 
 // Query implements Querier.
@@ -296,7 +519,7 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 		fpToSampleStream := map[model.Fingerprint]*model.SampleStream{}
 
 		metricName, err := metricNameFromLabelMatchers(matchers...)
-		if err != nil {
+		if err != nil && !d.cfg.NamelessQueries {
 			return err
 		}
 
@@ -305,39 +528,61 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 			return err
 		}
 
-		ingesters, err := d.cfg.Ring.Get(tokenFor(userID, metricName), d.cfg.ReplicationFactor, ring.Read)
+		ingesters, minSuccesses, err := d.queryIngesters(userID, metricName)
 		if err != nil {
 			return err
 		}
 
-		if len(ingesters) < d.cfg.MinReadSuccesses {
-			return fmt.Errorf("could only find %d ingesters for query. Need at least %d", len(ingesters), d.cfg.MinReadSuccesses)
+		req, err := util.ToQueryRequest(from, to, matchers)
+		if err != nil {
+			return err
 		}
 
-		// Fetch samples from multiple ingesters and group them by fingerprint (unsorted
-		// and with overlap).
+		// Fetch samples from multiple ingesters.
+		type queryResult struct {
+			index int
+			resp  *cortex.QueryResponse
+			err   error
+		}
+		results := make(chan queryResult)
+		for i, ing := range ingesters {
+			go func(i int, ing ring.IngesterDesc) {
+				client, err := d.getClientFor(ing)
+				if err != nil {
+					results <- queryResult{i, nil, err}
+					return
+				}
+				resp, err := client.Query(ctx, req)
+				results <- queryResult{i, resp, err}
+			}(i, ing)
+		}
+
+		responses := make([]*cortex.QueryResponse, len(ingesters))
 		successes := 0
 		var lastErr error
-		for _, ing := range ingesters {
-			client, err := d.getClientFor(ing)
-			if err != nil {
-				return err
+		for range ingesters {
+			res := <-results
+			hostname := ingesters[res.index].Hostname
+			d.ingesterQueries.WithLabelValues(hostname).Inc()
+			if res.err != nil {
+				lastErr = res.err
+				d.ingesterQueryFailures.WithLabelValues(hostname).Inc()
+				continue
 			}
+			successes++
+			responses[res.index] = res.resp
+		}
 
-			req, err := util.ToQueryRequest(from, to, matchers)
-			if err != nil {
-				return err
-			}
+		if successes < minSuccesses {
+			return util.NewError(util.ErrorCodeOf(lastErr), "too few successful reads, last error was: %v", lastErr)
+		}
 
-			resp, err := client.Query(ctx, req)
-			d.ingesterQueries.WithLabelValues(ing.Hostname).Inc()
-			if err != nil {
-				lastErr = err
-				d.ingesterQueryFailures.WithLabelValues(ing.Hostname).Inc()
+		// Group them by fingerprint (unsorted and with overlap), merging in
+		// ring order so duplicates are resolved the same way every time.
+		for _, resp := range responses {
+			if resp == nil {
 				continue
 			}
-			successes++
-
 			for _, ss := range util.FromQueryResponse(resp) {
 				fp := ss.Metric.Fingerprint()
 				if mss, ok := fpToSampleStream[fp]; !ok {
@@ -346,15 +591,11 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 						Values: ss.Values,
 					}
 				} else {
-					mss.Values = util.MergeSamples(fpToSampleStream[fp].Values, ss.Values)
+					mss.Values = util.MergeSamplesWithPolicy(mss.Values, ss.Values, d.cfg.DuplicatePolicy)
 				}
 			}
 		}
 
-		if successes < d.cfg.MinReadSuccesses {
-			return fmt.Errorf("too few successful reads, last error was: %v", lastErr)
-		}
-
 		result = make(model.Matrix, 0, len(fpToSampleStream))
 		for _, ss := range fpToSampleStream {
 			result = append(result, ss)
@@ -365,10 +606,43 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 	return result, err
 }
 
+// queryIngesters returns the ingesters to send a query for metricName to,
+// and how many of them must succeed.  When series may be sharded by all
+// labels, or there is no metric name, every ingester is queried; each
+// series is still on ReplicationFactor of them, so the query can tolerate
+// as many failures as a query to just those would, less one for each
+// ingester in the ring which is unavailable, as it may hold a replica.
+func (d *Distributor) queryIngesters(userID string, metricName model.LabelValue) ([]ring.IngesterDesc, int, error) {
+	if metricName != "" && !d.cfg.ShardByAllLabels && !d.cfg.ShardingMigration {
+		ingesters, err := d.cfg.Ring.Get(tokenFor(userID, metricName), d.cfg.ReplicationFactor, ring.Read)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(ingesters) < d.cfg.MinReadSuccesses {
+			return nil, 0, util.NewError(util.ErrUnavailable, "could only find %d ingesters for query. Need at least %d", len(ingesters), d.cfg.MinReadSuccesses)
+		}
+		return ingesters, d.cfg.MinReadSuccesses, nil
+	}
+
+	ingesters, unhealthy := d.cfg.Ring.GetAll()
+	maxFailures := d.cfg.ReplicationFactor - d.cfg.MinReadSuccesses - unhealthy
+	if maxFailures < 0 {
+		return nil, 0, util.NewError(util.ErrUnavailable, "%d ingesters are unavailable. At most %d can be", unhealthy, d.cfg.ReplicationFactor-d.cfg.MinReadSuccesses)
+	}
+	minSuccesses := len(ingesters) - maxFailures
+	if minSuccesses < d.cfg.MinReadSuccesses {
+		minSuccesses = d.cfg.MinReadSuccesses
+	}
+	if len(ingesters) < minSuccesses {
+		return nil, 0, util.NewError(util.ErrUnavailable, "could only find %d ingesters for query. Need at least %d", len(ingesters), minSuccesses)
+	}
+	return ingesters, minSuccesses, nil
+}
+
 // forAllIngesters runs f, in parallel, for all ingesters
 func (d *Distributor) forAllIngesters(f func(cortex.IngesterClient) (interface{}, error)) ([]interface{}, error) {
 	resps, errs := make(chan interface{}), make(chan error)
-	ingesters := d.cfg.Ring.GetAll()
+	ingesters, _ := d.cfg.Ring.GetAll()
 	for _, ingester := range ingesters {
 		go func(ingester ring.IngesterDesc) {
 			client, err := d.getClientFor(ingester)
@@ -455,9 +729,11 @@ func (d *Distributor) MetricsForLabelMatchers(ctx context.Context, from, through
 	return result, nil
 }
 
-// UserStats returns statistics about the current user.
-func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
-	req := &cortex.UserStatsRequest{}
+// UserStats returns statistics about the current user.  The stats of their
+// series in ingesters' memory, which ingesters must walk all the series for,
+// are only included if includeSeriesStats is set.
+func (d *Distributor) UserStats(ctx context.Context, includeSeriesStats bool) (*UserStats, error) {
+	req := &cortex.UserStatsRequest{IncludeSeriesStats: includeSeriesStats}
 	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
 		return client.UserStats(ctx, req)
 	})
@@ -465,14 +741,38 @@ func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 		return nil, err
 	}
 
-	totalStats := &UserStats{}
+	totalStats := &UserStats{
+		SeriesCountByMetricName: map[string]uint64{},
+	}
 	for _, resp := range resps {
-		totalStats.IngestionRate += resp.(*cortex.UserStatsResponse).IngestionRate
-		totalStats.NumSeries += resp.(*cortex.UserStatsResponse).NumSeries
+		r := resp.(*cortex.UserStatsResponse)
+		totalStats.IngestionRate += r.IngestionRate
+		totalStats.NumSeries += r.NumSeries
+		totalStats.NumChunks += r.NumChunks
+		totalStats.MemoryBytes += r.MemoryBytes
+		for _, c := range r.SeriesCountByMetricName {
+			totalStats.SeriesCountByMetricName[c.MetricName] += c.NumSeries
+		}
+		// Ingesters with no samples for the user report no time range.
+		if r.NewestSampleMs == 0 {
+			continue
+		}
+		if totalStats.NewestSampleMs == 0 || r.OldestSampleMs < totalStats.OldestSampleMs {
+			totalStats.OldestSampleMs = r.OldestSampleMs
+		}
+		if r.NewestSampleMs > totalStats.NewestSampleMs {
+			totalStats.NewestSampleMs = r.NewestSampleMs
+		}
 	}
 
+	// Each series is held by as many ingesters as it is replicated to.
 	totalStats.IngestionRate /= float64(d.cfg.ReplicationFactor)
 	totalStats.NumSeries /= uint64(d.cfg.ReplicationFactor)
+	totalStats.NumChunks /= uint64(d.cfg.ReplicationFactor)
+	totalStats.MemoryBytes /= uint64(d.cfg.ReplicationFactor)
+	for name, count := range totalStats.SeriesCountByMetricName {
+		totalStats.SeriesCountByMetricName[name] = count / uint64(d.cfg.ReplicationFactor)
+	}
 
 	return totalStats, nil
 }
@@ -481,6 +781,7 @@ func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 func (d *Distributor) Describe(ch chan<- *prometheus.Desc) {
 	d.queryDuration.Describe(ch)
 	ch <- d.receivedSamples.Desc()
+	d.sampleLag.Describe(ch)
 	d.sendDuration.Describe(ch)
 	d.cfg.Ring.Describe(ch)
 	ch <- numClientsDesc
@@ -488,18 +789,29 @@ func (d *Distributor) Describe(ch chan<- *prometheus.Desc) {
 	d.ingesterAppendFailures.Describe(ch)
 	d.ingesterQueries.Describe(ch)
 	d.ingesterQueryFailures.Describe(ch)
+	d.forwarderMetrics.Describe(ch)
+	d.labelViolations.Describe(ch)
+	d.discardedSamples.Describe(ch)
+	d.backfilledSamples.Describe(ch)
+	d.backfilledChunks.Describe(ch)
 }
 
 // Collect implements prometheus.Collector.
 func (d *Distributor) Collect(ch chan<- prometheus.Metric) {
 	d.queryDuration.Collect(ch)
 	ch <- d.receivedSamples
+	d.sampleLag.Collect(ch)
 	d.sendDuration.Collect(ch)
 	d.cfg.Ring.Collect(ch)
 	d.ingesterAppends.Collect(ch)
 	d.ingesterAppendFailures.Collect(ch)
 	d.ingesterQueries.Collect(ch)
 	d.ingesterQueryFailures.Collect(ch)
+	d.forwarderMetrics.Collect(ch)
+	d.labelViolations.Collect(ch)
+	d.discardedSamples.Collect(ch)
+	d.backfilledSamples.Collect(ch)
+	d.backfilledChunks.Collect(ch)
 	d.clientsMtx.RLock()
 	defer d.clientsMtx.RUnlock()
 	ch <- prometheus.MustNewConstMetric(
@@ -0,0 +1,273 @@
+package distributor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// mockRing is a ring of ingesters, all of which own every key, and
+// unhealthy more which are unavailable.
+type mockRing struct {
+	ingesters []ring.IngesterDesc
+	unhealthy int
+}
+
+func (r mockRing) Describe(ch chan<- *prometheus.Desc) {}
+
+func (r mockRing) Collect(ch chan<- prometheus.Metric) {}
+
+func (r mockRing) Get(key uint32, n int, op ring.Operation) ([]ring.IngesterDesc, error) {
+	if n > len(r.ingesters) {
+		n = len(r.ingesters)
+	}
+	return r.ingesters[:n], nil
+}
+
+func (r mockRing) BatchGet(keys []uint32, n int, op ring.Operation) ([][]ring.IngesterDesc, error) {
+	result := make([][]ring.IngesterDesc, len(keys))
+	for i := range keys {
+		result[i], _ = r.Get(keys[i], n, op)
+	}
+	return result, nil
+}
+
+func (r mockRing) GetAll() ([]ring.IngesterDesc, int) {
+	return r.ingesters, r.unhealthy
+}
+
+type mockIngester struct {
+	failing bool
+}
+
+func (i mockIngester) Push(ctx context.Context, in *remote.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	if i.failing {
+		return nil, fmt.Errorf("ingester failed")
+	}
+	return &cortex.WriteResponse{}, nil
+}
+
+func (i mockIngester) Query(ctx context.Context, in *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	if i.failing {
+		return nil, fmt.Errorf("ingester failed")
+	}
+	return &cortex.QueryResponse{}, nil
+}
+
+func (i mockIngester) LabelValues(ctx context.Context, in *cortex.LabelValuesRequest, opts ...grpc.CallOption) (*cortex.LabelValuesResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (i mockIngester) UserStats(ctx context.Context, in *cortex.UserStatsRequest, opts ...grpc.CallOption) (*cortex.UserStatsResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (i mockIngester) MetricsForLabelMatchers(ctx context.Context, in *cortex.MetricsForLabelMatchersRequest, opts ...grpc.CallOption) (*cortex.MetricsForLabelMatchersResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// newTestDistributor makes a distributor for numIngesters ingesters, the
+// first numFailing of which fail every request, and numUnhealthy more which
+// are unavailable.
+func newTestDistributor(t *testing.T, cfg Config, numIngesters, numFailing, numUnhealthy int) *Distributor {
+	r := mockRing{unhealthy: numUnhealthy}
+	for i := 0; i < numIngesters; i++ {
+		r.ingesters = append(r.ingesters, ring.IngesterDesc{Hostname: fmt.Sprintf("ingester%d", i), Timestamp: time.Now()})
+	}
+	cfg.Ring = r
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ing := range r.ingesters {
+		d.clients[ing.Hostname] = mockIngester{failing: i < numFailing}
+	}
+	return d
+}
+
+func TestQueryIngesters(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		numIngesters     int
+		numUnhealthy     int
+		shardByAllLabels bool
+		metricName       model.LabelValue
+		wantIngesters    int
+		wantMinSuccesses int
+		wantErr          bool
+	}{
+		{"by metric name", 5, 0, false, "foo", 3, 2, false},
+		{"without a metric name", 5, 0, false, "", 5, 4, false},
+		{"by all labels", 5, 0, true, "foo", 5, 4, false},
+		{"by all labels, RF ingesters", 3, 0, true, "foo", 3, 2, false},
+		// len(all) - (RF - MinReadSuccesses) is less than MinReadSuccesses.
+		{"by all labels, fewer than RF ingesters", 2, 0, true, "foo", 2, 2, false},
+		{"by all labels, too few ingesters", 1, 0, true, "foo", 0, 0, true},
+		// The unhealthy ingester uses up the one failure allowed.
+		{"by all labels, one unhealthy", 5, 1, true, "foo", 5, 5, false},
+		{"by all labels, too many unhealthy", 5, 2, true, "foo", 0, 0, true},
+	} {
+		d := newTestDistributor(t, Config{
+			ReplicationFactor: 3,
+			MinReadSuccesses:  2,
+			ShardByAllLabels:  tc.shardByAllLabels,
+		}, tc.numIngesters, 0, tc.numUnhealthy)
+		ingesters, minSuccesses, err := d.queryIngesters("user", tc.metricName)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if len(ingesters) != tc.wantIngesters || minSuccesses != tc.wantMinSuccesses {
+			t.Errorf("%s: got %d ingesters needing %d successes, want %d needing %d", tc.name, len(ingesters), minSuccesses, tc.wantIngesters, tc.wantMinSuccesses)
+		}
+	}
+}
+
+func TestQueryFailedIngesters(t *testing.T) {
+	ctx := user.WithID(context.Background(), "user")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		shardByAllLabels bool
+		numFailing       int
+		numUnhealthy     int
+		wantErr          bool
+	}{
+		{false, 0, 0, false},
+		{false, 1, 0, false},
+		{false, 2, 0, true},
+		{true, 0, 0, false},
+		{true, 1, 0, false},
+		{true, 2, 0, true},
+		{true, 0, 1, false},
+		{true, 1, 1, true},
+	} {
+		d := newTestDistributor(t, Config{
+			ReplicationFactor: 3,
+			MinReadSuccesses:  2,
+			ShardByAllLabels:  tc.shardByAllLabels,
+		}, 5, tc.numFailing, tc.numUnhealthy)
+		_, err := d.Query(ctx, 0, 1000, matcher)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("shard by all labels %v, %d failing, %d unhealthy: unexpected error %v", tc.shardByAllLabels, tc.numFailing, tc.numUnhealthy, err)
+		}
+	}
+}
+
+// A URL in both a tenant's forwarding rule and the "*" rule is only sent the
+// tenant's samples once.
+func TestForwardingOverlappingRules(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		received = map[string]int{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		received[r.URL.Path+" "+r.Header.Get(user.UserIDHeaderName)]++
+		mtx.Unlock()
+	}))
+	defer server.Close()
+
+	d := newTestDistributor(t, Config{
+		ReplicationFactor: 3,
+		MinReadSuccesses:  2,
+		RemoteTimeout:     time.Second,
+		Forwarding: ForwardingConfig{
+			Rules: map[string][]string{
+				"user": {server.URL + "/both", server.URL + "/user", server.URL + "/user"},
+				"*":    {server.URL + "/both", server.URL + "/all"},
+			},
+			QueueCapacity: 10,
+		},
+	}, 3, 0, 0)
+	samples := []*model.Sample{{Metric: model.Metric{model.MetricNameLabel: "foo"}, Timestamp: 1, Value: 1}}
+	d.forward("user", samples)
+	d.forward("other", samples)
+	d.Stop()
+
+	want := map[string]int{
+		"/both user":  1,
+		"/user user":  1,
+		"/all user":   1,
+		"/both other": 1,
+		"/all other":  1,
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if !reflect.DeepEqual(want, received) {
+		t.Fatalf("expected requests %v, got %v", want, received)
+	}
+}
+
+func TestSampleLag(t *testing.T) {
+	now := time.Unix(1000, 0)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	d := newTestDistributor(t, Config{
+		ReplicationFactor: 3,
+		MinReadSuccesses:  2,
+		RemoteTimeout:     time.Second,
+		HeartbeatTimeout:  time.Minute,
+	}, 3, 0, 0)
+	defer d.Stop()
+
+	var samples []*model.Sample
+	for i, lag := range []time.Duration{-5 * time.Second, 0, 20 * time.Second, 90 * time.Second} {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "foo", "i": model.LabelValue(fmt.Sprint(i))},
+			Timestamp: model.TimeFromUnixNano(now.Add(-lag).UnixNano()),
+			Value:     1,
+		})
+	}
+	if _, err := d.Push(user.WithID(context.Background(), "user"), util.ToWriteRequest(samples)); err != nil {
+		t.Fatal(err)
+	}
+
+	var m dto.Metric
+	if err := d.sampleLag.WithLabelValues("user").Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	h := m.GetHistogram()
+	if h.GetSampleCount() != 4 {
+		t.Errorf("expected 4 samples observed, got %d", h.GetSampleCount())
+	}
+	if h.GetSampleSum() != 105 {
+		t.Errorf("expected lag sum 105s, got %v", h.GetSampleSum())
+	}
+	want := map[float64]uint64{-1: 1, 0: 2, 15: 2, 30: 3, 60: 3, 120: 4}
+	for _, b := range h.GetBucket() {
+		if count, ok := want[b.GetUpperBound()]; ok && b.GetCumulativeCount() != count {
+			t.Errorf("expected %d samples with lag <= %vs, got %d", count, b.GetUpperBound(), b.GetCumulativeCount())
+		}
+	}
+
+	m.Reset()
+	if err := d.sampleLag.WithLabelValues("other").Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if count := m.GetHistogram().GetSampleCount(); count != 0 {
+		t.Errorf("expected no samples observed for another user, got %d", count)
+	}
+}
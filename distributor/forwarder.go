@@ -0,0 +1,222 @@
+package distributor
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	forwardMinBackoff = 100 * time.Millisecond
+	forwardMaxBackoff = 10 * time.Second
+)
+
+// ForwardingConfig configures forwarding of ingested samples to external
+// remote_write endpoints.
+type ForwardingConfig struct {
+	// Remote write URLs to forward each tenant's samples to.  The URLs for
+	// the tenant "*" are used for all tenants.
+	Rules map[string][]string
+
+	// How many batches to buffer per URL before dropping samples.
+	QueueCapacity int
+	// How many times to retry a failed batch before dropping it.
+	MaxRetries int
+}
+
+// ParseForwardingRules parses forwarding rules of the form
+// "tenant=url,url;tenant=url".
+func ParseForwardingRules(s string) (map[string][]string, error) {
+	rules := map[string][]string{}
+	if s == "" {
+		return rules, nil
+	}
+	for _, rule := range strings.Split(s, ";") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid forwarding rule %q", rule)
+		}
+		for _, u := range strings.Split(parts[1], ",") {
+			if _, err := url.Parse(u); err != nil {
+				return nil, fmt.Errorf("invalid forwarding URL %q: %v", u, err)
+			}
+			rules[parts[0]] = append(rules[parts[0]], u)
+		}
+	}
+	return rules, nil
+}
+
+type forwardBatch struct {
+	userID  string
+	samples []*model.Sample
+}
+
+// forwarder sends batches of samples to a single remote_write endpoint,
+// buffering them so pushes aren't held up by the endpoint.
+type forwarder struct {
+	url        string
+	client     http.Client
+	maxRetries int
+	metrics    *forwarderMetrics
+
+	queue chan forwardBatch
+	quit  chan struct{}
+	done  sync.WaitGroup
+}
+
+type forwarderMetrics struct {
+	sent    *prometheus.CounterVec
+	failed  *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+}
+
+func newForwarderMetrics() *forwarderMetrics {
+	return &forwarderMetrics{
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_forwarded_samples_total",
+			Help:      "The total number of samples forwarded to remote write endpoints.",
+		}, []string{"url"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_forward_failed_samples_total",
+			Help:      "The total number of samples which could not be forwarded, after retries.",
+		}, []string{"url"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_forward_dropped_samples_total",
+			Help:      "The total number of samples dropped because the forwarding queue was full.",
+		}, []string{"url"}),
+	}
+}
+
+func (m *forwarderMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.sent.Describe(ch)
+	m.failed.Describe(ch)
+	m.dropped.Describe(ch)
+}
+
+func (m *forwarderMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.sent.Collect(ch)
+	m.failed.Collect(ch)
+	m.dropped.Collect(ch)
+}
+
+func newForwarder(url string, cfg ForwardingConfig, timeout time.Duration, metrics *forwarderMetrics) *forwarder {
+	f := &forwarder{
+		url: url,
+		client: http.Client{
+			Timeout: timeout,
+		},
+		maxRetries: cfg.MaxRetries,
+		metrics:    metrics,
+		queue:      make(chan forwardBatch, cfg.QueueCapacity),
+		quit:       make(chan struct{}),
+	}
+	f.done.Add(1)
+	go f.loop()
+	return f
+}
+
+// enqueue queues samples to be forwarded, dropping them if the queue is full.
+func (f *forwarder) enqueue(userID string, samples []*model.Sample) {
+	select {
+	case f.queue <- forwardBatch{userID, samples}:
+	default:
+		f.metrics.dropped.WithLabelValues(f.url).Add(float64(len(samples)))
+	}
+}
+
+// stop sends the batches already queued, then stops the forwarder.
+func (f *forwarder) stop() {
+	close(f.quit)
+	f.done.Wait()
+}
+
+func (f *forwarder) loop() {
+	defer f.done.Done()
+	for {
+		select {
+		case batch := <-f.queue:
+			f.send(batch)
+		case <-f.quit:
+			for {
+				select {
+				case batch := <-f.queue:
+					f.send(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (f *forwarder) send(batch forwardBatch) {
+	backoff := forwardMinBackoff
+	for tries := 0; ; tries++ {
+		err := f.sendOnce(batch)
+		if err == nil {
+			f.metrics.sent.WithLabelValues(f.url).Add(float64(len(batch.samples)))
+			return
+		}
+
+		// Don't retry requests the endpoint has rejected as bad.
+		if !util.ErrorCodeOf(err).Retryable() || tries >= f.maxRetries {
+			log.Warnf("Error forwarding %d samples for %s to %s: %v", len(batch.samples), batch.userID, f.url, err)
+			f.metrics.failed.WithLabelValues(f.url).Add(float64(len(batch.samples)))
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-f.quit:
+			// Retry without waiting while shutting down.
+		}
+		backoff *= 2
+		if backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+func (f *forwarder) sendOnce(batch forwardBatch) error {
+	data, err := proto.Marshal(util.ToWriteRequest(batch.samples))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writer := snappy.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", f.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Add(user.UserIDHeaderName, batch.userID)
+	req.Header.Set("Content-Encoding", "snappy")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errStatusCode(resp.StatusCode, resp.Status)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package distributor
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,10 +18,12 @@ import (
 
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
 )
 
 // httpIngesterClient is a client library for the ingester
 type httpIngesterClient struct {
+	scheme  string
 	address string
 	client  http.Client
 	timeout time.Duration
@@ -43,16 +46,28 @@ func (i IngesterError) Error() string {
 	return i.err.Error()
 }
 
+// ErrorCode implements util.CodedError.
+func (i IngesterError) ErrorCode() util.ErrorCode {
+	return util.ErrorCodeForHTTPStatus(i.StatusCode)
+}
+
 // NewHTTPIngesterClient makes a new IngesterClient.  This client is careful to
-// propagate the user ID from Distributor -> Ingester.
-func NewHTTPIngesterClient(address string, timeout time.Duration) (cortex.IngesterClient, error) {
-	return &httpIngesterClient{
+// propagate the user ID from Distributor -> Ingester.  If tlsConfig is
+// non-nil, requests are made over HTTPS with it.
+func NewHTTPIngesterClient(address string, timeout time.Duration, tlsConfig *tls.Config) (cortex.IngesterClient, error) {
+	client := &httpIngesterClient{
+		scheme:  "http",
 		address: address,
 		client: http.Client{
 			Timeout: timeout,
 		},
 		timeout: timeout,
-	}, nil
+	}
+	if tlsConfig != nil {
+		client.scheme = "https"
+		client.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return client, nil
 }
 
 // Push adds new samples to the ingester
@@ -88,7 +103,7 @@ func (*httpIngesterClient) MetricsForLabelMatchers(_ context.Context, _ *cortex.
 // UserStats returns stats for the current user.
 func (c *httpIngesterClient) UserStats(ctx context.Context, in *cortex.UserStatsRequest, _ ...grpc.CallOption) (*cortex.UserStatsResponse, error) {
 	resp := &cortex.UserStatsResponse{}
-	err := c.doRequest(ctx, "/user_stats", nil, resp, false)
+	err := c.doRequest(ctx, "/user_stats", in, resp, false)
 	if err != nil {
 		return nil, err
 	}
@@ -117,11 +132,15 @@ func (c *httpIngesterClient) doRequest(ctx context.Context, endpoint string, req
 		}
 	}
 
-	httpReq, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", c.address, endpoint), &buf)
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s", c.scheme, c.address, endpoint), &buf)
 	if err != nil {
 		return fmt.Errorf("unable to create request: %v", err)
 	}
+	httpReq = httpReq.WithContext(ctx)
 	httpReq.Header.Add(user.UserIDHeaderName, userID)
+	if requestID := util.GetRequestID(ctx); requestID != "" {
+		httpReq.Header.Set(util.RequestIDHeaderName, requestID)
+	}
 	// TODO: This isn't actually the correct Content-type.
 	httpReq.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
 	httpResp, err := c.client.Do(httpReq)
@@ -21,17 +21,12 @@ func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, err := d.Push(ctx, &req)
 	if err != nil {
-		switch e := err.(type) {
-		case IngesterError:
-			switch {
-			case 400 <= e.StatusCode && e.StatusCode < 500:
-				log.Warnf("push err: %v", err)
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+		if util.ErrorCodeOf(err).Retryable() {
+			log.Errorf("append err: %v", err)
+		} else {
+			log.Warnf("push err: %v", err)
 		}
-		log.Errorf("append err: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.WriteError(w, err)
 	}
 }
 
@@ -39,6 +34,15 @@ func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
 type UserStats struct {
 	IngestionRate float64 `json:"ingestionRate"`
 	NumSeries     uint64  `json:"numSeries"`
+
+	// Stats of the user's series in ingesters' memory, only filled in if
+	// asked for. The sample times are in milliseconds since the epoch, and
+	// zero if there are no samples.
+	NumChunks               uint64            `json:"numChunks"`
+	MemoryBytes             uint64            `json:"memoryBytes"`
+	OldestSampleMs          int64             `json:"oldestSampleMs"`
+	NewestSampleMs          int64             `json:"newestSampleMs"`
+	SeriesCountByMetricName map[string]uint64 `json:"seriesCountByMetricName"`
 }
 
 // UserStatsHandler handles user stats to the Distributor.
@@ -48,9 +52,9 @@ func (d *Distributor) UserStatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats, err := d.UserStats(ctx)
+	stats, err := d.UserStats(ctx, false)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.WriteError(w, err)
 		return
 	}
 
@@ -0,0 +1,95 @@
+package distributor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+// WriteInterceptor hooks into the push path, for operators to add custom
+// validation, enrichment or billing without changing the distributor.
+// Interceptors are configured in order: each push's samples are passed
+// through every interceptor's BeforeWrite in turn, each seeing the samples
+// returned by the one before, and, once the samples have been ingested, to
+// every interceptor's AfterWrite in the same order.
+type WriteInterceptor interface {
+	// BeforeWrite is called with a push's samples after they have passed the
+	// distributor's own validation, and returns the samples to ingest, which
+	// it may modify, drop or add to.  An error rejects the whole push: no
+	// samples are ingested, later interceptors aren't called, and the error
+	// is returned to the client.  Return a util.CodedError, eg from
+	// util.NewError with util.ErrBadData, to control how the client sees it;
+	// other errors are internal errors.
+	BeforeWrite(ctx context.Context, userID string, samples []*model.Sample) ([]*model.Sample, error)
+
+	// AfterWrite is called with the samples ingested by a successful push.
+	// It is not called if the push fails, and must not block.
+	AfterWrite(ctx context.Context, userID string, samples []*model.Sample)
+}
+
+var (
+	writeInterceptorsMtx sync.Mutex
+	writeInterceptors    = map[string]WriteInterceptor{}
+)
+
+// RegisterWriteInterceptor makes interceptor available to
+// WriteInterceptorsByName as name.  It is for the init functions of
+// operators' packages linked into their build of Cortex, and panics if name
+// is already registered.
+func RegisterWriteInterceptor(name string, interceptor WriteInterceptor) {
+	writeInterceptorsMtx.Lock()
+	defer writeInterceptorsMtx.Unlock()
+	if _, ok := writeInterceptors[name]; ok {
+		panic(fmt.Sprintf("write interceptor %q registered twice", name))
+	}
+	writeInterceptors[name] = interceptor
+}
+
+// WriteInterceptorsByName returns the registered interceptors named in s, a
+// comma-separated list, in order.
+func WriteInterceptorsByName(s string) ([]WriteInterceptor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	writeInterceptorsMtx.Lock()
+	defer writeInterceptorsMtx.Unlock()
+	var interceptors []WriteInterceptor
+	for _, name := range strings.Split(s, ",") {
+		interceptor, ok := writeInterceptors[name]
+		if !ok {
+			registered := make([]string, 0, len(writeInterceptors))
+			for name := range writeInterceptors {
+				registered = append(registered, name)
+			}
+			sort.Strings(registered)
+			return nil, fmt.Errorf("unknown write interceptor %q; registered interceptors are %v", name, registered)
+		}
+		interceptors = append(interceptors, interceptor)
+	}
+	return interceptors, nil
+}
+
+// beforeWrite passes samples through the configured interceptors'
+// BeforeWrite, stopping at the first error.
+func (d *Distributor) beforeWrite(ctx context.Context, userID string, samples []*model.Sample) ([]*model.Sample, error) {
+	for _, interceptor := range d.cfg.WriteInterceptors {
+		var err error
+		if samples, err = interceptor.BeforeWrite(ctx, userID, samples); err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// afterWrite passes ingested samples to the configured interceptors'
+// AfterWrite.
+func (d *Distributor) afterWrite(ctx context.Context, userID string, samples []*model.Sample) {
+	for _, interceptor := range d.cfg.WriteInterceptors {
+		interceptor.AfterWrite(ctx, userID, samples)
+	}
+}
@@ -0,0 +1,185 @@
+package distributor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Policies for series with reserved or duplicate labels.  Series with
+// duplicate labels are accepted unless a policy is set for them.
+const (
+	RejectLabels = "reject"
+	StripLabels  = "strip"
+)
+
+// Reasons a series' labels are invalid.
+const (
+	reasonReservedLabel  = "reserved_label"
+	reasonDuplicateLabel = "duplicate_label"
+)
+
+// Reasons a sample is discarded.
+const (
+	reasonTooOld         = "too_old"
+	reasonTooFarInFuture = "too_far_in_future"
+)
+
+// ValidationError is returned for pushes with invalid labels or samples.
+type ValidationError struct {
+	err error
+}
+
+func (e ValidationError) Error() string {
+	return e.err.Error()
+}
+
+// ErrorCode implements util.CodedError.
+func (e ValidationError) ErrorCode() util.ErrorCode {
+	return util.ErrBadData
+}
+
+func newLabelViolationsCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "distributor_label_violations_total",
+		Help:      "The total number of series pushed with reserved or duplicate labels, which were rejected or stripped.",
+	}, []string{"reason"})
+}
+
+// validateLabels checks the series in a push for reserved labels (eg a
+// label later injected by federation to identify the tenant, which clients
+// mustn't be able to spoof) and duplicate labels.  Depending on the
+// configured policies, it either rejects the push or strips the offending
+// labels in place, keeping the first of any duplicates.
+func (d *Distributor) validateLabels(req *remote.WriteRequest) error {
+	if d.cfg.ReservedLabelPolicy == "" && d.cfg.DuplicateLabelPolicy == "" {
+		return nil
+	}
+	for _, ts := range req.Timeseries {
+		seen := make(map[string]struct{}, len(ts.Labels))
+		labels := ts.Labels[:0]
+		for _, l := range ts.Labels {
+			reason, policy := "", ""
+			if _, ok := d.reservedLabels[model.LabelName(l.Name)]; ok && d.cfg.ReservedLabelPolicy != "" {
+				reason, policy = reasonReservedLabel, d.cfg.ReservedLabelPolicy
+			} else if _, ok := seen[l.Name]; ok && d.cfg.DuplicateLabelPolicy != "" {
+				reason, policy = reasonDuplicateLabel, d.cfg.DuplicateLabelPolicy
+			}
+			if reason == "" {
+				seen[l.Name] = struct{}{}
+				labels = append(labels, l)
+				continue
+			}
+
+			d.labelViolations.WithLabelValues(reason).Inc()
+			if policy != StripLabels {
+				if reason == reasonReservedLabel {
+					return ValidationError{fmt.Errorf("series has reserved label %q", l.Name)}
+				}
+				return ValidationError{fmt.Errorf("series has duplicate label %q", l.Name)}
+			}
+		}
+		ts.Labels = labels
+	}
+	return nil
+}
+
+func newDiscardedSamplesCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "distributor_discarded_samples_total",
+		Help:      "The total number of samples discarded for being too old or too far in the future, by user.",
+	}, []string{"reason", "user"})
+}
+
+// SampleAgeLimits bounds the timestamps of pushed samples, relative to the
+// time they arrive.  Zero durations disable the checks.
+type SampleAgeLimits struct {
+	// Samples older than this are discarded.
+	MaxAge time.Duration
+	// Samples further than this in the future are discarded.
+	FutureGrace time.Duration
+}
+
+// ParseSampleAgeOverrides parses per-tenant sample age limits of the form
+// "tenant=max-age/future-grace;tenant=max-age/future-grace", eg
+// "team-a=168h/10m;team-b=0/5m".
+func ParseSampleAgeOverrides(s string) (map[string]SampleAgeLimits, error) {
+	overrides := map[string]SampleAgeLimits{}
+	if s == "" {
+		return overrides, nil
+	}
+	for _, override := range strings.Split(s, ";") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid sample age override %q", override)
+		}
+		durations := strings.Split(parts[1], "/")
+		if len(durations) != 2 {
+			return nil, fmt.Errorf("invalid sample age override %q: expected max-age/future-grace", override)
+		}
+		var (
+			limits SampleAgeLimits
+			err    error
+		)
+		if limits.MaxAge, err = time.ParseDuration(durations[0]); err != nil {
+			return nil, fmt.Errorf("invalid sample age override %q: %v", override, err)
+		}
+		if limits.FutureGrace, err = time.ParseDuration(durations[1]); err != nil {
+			return nil, fmt.Errorf("invalid sample age override %q: %v", override, err)
+		}
+		overrides[parts[0]] = limits
+	}
+	return overrides, nil
+}
+
+// validateSampleAges discards samples outside userID's sample age limits,
+// returning the rest, and an error describing the first sample discarded,
+// if any.
+func (d *Distributor) validateSampleAges(userID string, samples []*model.Sample) ([]*model.Sample, error) {
+	limits, ok := d.cfg.SampleAgeOverrides[userID]
+	if !ok {
+		limits = d.cfg.SampleAgeLimits
+	}
+	if limits.MaxAge == 0 && limits.FutureGrace == 0 {
+		return samples, nil
+	}
+
+	var (
+		now      = model.Now()
+		minTime  = now.Add(-limits.MaxAge)
+		maxTime  = now.Add(limits.FutureGrace)
+		firstErr error
+		valid    = samples[:0]
+	)
+	for _, sample := range samples {
+		reason := ""
+		if limits.MaxAge > 0 && sample.Timestamp < minTime {
+			reason = reasonTooOld
+		} else if limits.FutureGrace > 0 && sample.Timestamp > maxTime {
+			reason = reasonTooFarInFuture
+		}
+		if reason == "" {
+			valid = append(valid, sample)
+			continue
+		}
+
+		d.discardedSamples.WithLabelValues(reason, userID).Inc()
+		if firstErr != nil {
+			continue
+		}
+		if reason == reasonTooOld {
+			firstErr = ValidationError{fmt.Errorf("sample for %s at %s is too old: the limit is %s", sample.Metric, sample.Timestamp.Time().UTC(), limits.MaxAge)}
+		} else {
+			firstErr = ValidationError{fmt.Errorf("sample for %s at %s is too far in the future: the limit is %s", sample.Metric, sample.Timestamp.Time().UTC(), limits.FutureGrace)}
+		}
+	}
+	return valid, firstErr
+}
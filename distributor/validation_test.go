@@ -0,0 +1,87 @@
+package distributor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestValidateLabels(t *testing.T) {
+	series := func(labels ...string) *remote.WriteRequest {
+		ts := &remote.TimeSeries{}
+		for i := 0; i < len(labels); i += 2 {
+			ts.Labels = append(ts.Labels, &remote.LabelPair{Name: labels[i], Value: labels[i+1]})
+		}
+		return &remote.WriteRequest{Timeseries: []*remote.TimeSeries{ts}}
+	}
+
+	for _, tc := range []struct {
+		name            string
+		reservedPolicy  string
+		duplicatePolicy string
+		in              *remote.WriteRequest
+		want            *remote.WriteRequest
+		err             bool
+	}{
+		{
+			name: "no policies",
+			in:   series("__name__", "foo", "tenant", "a", "job", "a", "job", "b"),
+			want: series("__name__", "foo", "tenant", "a", "job", "a", "job", "b"),
+		},
+		{
+			name:           "duplicates accepted by default",
+			reservedPolicy: RejectLabels,
+			in:             series("__name__", "foo", "job", "a", "job", "b"),
+			want:           series("__name__", "foo", "job", "a", "job", "b"),
+		},
+		{
+			name:           "reserved rejected",
+			reservedPolicy: RejectLabels,
+			in:             series("__name__", "foo", "tenant", "a"),
+			err:            true,
+		},
+		{
+			name:           "reserved stripped",
+			reservedPolicy: StripLabels,
+			in:             series("__name__", "foo", "tenant", "a", "job", "a"),
+			want:           series("__name__", "foo", "job", "a"),
+		},
+		{
+			name:            "duplicates rejected",
+			duplicatePolicy: RejectLabels,
+			in:              series("__name__", "foo", "job", "a", "job", "b"),
+			err:             true,
+		},
+		{
+			name:            "duplicates stripped",
+			duplicatePolicy: StripLabels,
+			in:              series("__name__", "foo", "job", "a", "job", "b"),
+			want:            series("__name__", "foo", "job", "a"),
+		},
+		{
+			name:            "reserved accepted without a policy",
+			duplicatePolicy: RejectLabels,
+			in:              series("__name__", "foo", "tenant", "a"),
+			want:            series("__name__", "foo", "tenant", "a"),
+		},
+	} {
+		d := &Distributor{
+			cfg: Config{
+				ReservedLabelPolicy:  tc.reservedPolicy,
+				DuplicateLabelPolicy: tc.duplicatePolicy,
+			},
+			reservedLabels:  map[model.LabelName]struct{}{"tenant": {}},
+			labelViolations: newLabelViolationsCounter(),
+		}
+		err := d.validateLabels(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(tc.want, tc.in) {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.in, tc.want)
+		}
+	}
+}
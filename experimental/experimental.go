@@ -0,0 +1,97 @@
+// Package experimental is the registry of experimental features.  Each is
+// disabled unless enabled with its -experimental.<name> flag, and the code
+// implementing it checks Enabled before turning on the risky behaviour.
+package experimental
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Feature is an experimental feature.
+type Feature struct {
+	Name    string `json:"name"`
+	Help    string `json:"help"`
+	enabled bool
+}
+
+var features = map[string]*Feature{}
+
+// The experimental features.
+var (
+	ChunkFormatV2   = register("chunk-format-v2", "Allow writing chunks in format version 2, with -chunk.format-version=2.")
+	ChunkIDV2       = register("chunk-id-v2", "Allow writing chunks with version 2 IDs, with -chunk.id-version=2.")
+	S3RangeReads    = register("s3-range-reads", "Allow fetching parts of chunks with S3 range GETs, with -s3.range-read-fraction.")
+	RemoteRuler     = register("remote-ruler", "Allow evaluating rules via the querier's HTTP API, with -ruler.querier.url.")
+	IndexSchemaV2   = register("index-schema-v2", "Allow index schema v2, sharding each metric's entries, in -chunk.index-schema.")
+	IndexSchemaV3   = register("index-schema-v3", "Allow index schema v3, base64-encoding label names and values, in -chunk.index-schema.")
+	IndexSchemaV4   = register("index-schema-v4", "Allow index schema v4, with entries keyed by label name, in -chunk.index-schema.")
+	IndexSchemaV5   = register("index-schema-v5", "Allow index schema v5, with an entry per chunk holding its metric, in -chunk.index-schema.")
+	IndexSchemaV6   = register("index-schema-v6", "Allow index schema v6, with chunks' end times in range keys, in -chunk.index-schema.")
+	InlineChunks    = register("inline-chunks", "Allow storing small chunks in their index entries, with -dynamodb.inline-chunk-max-size.")
+	NamelessQueries = register("nameless-queries", "Allow answering queries without a metric name by scanning chunks, with -chunk.nameless-queries.enabled.")
+	Kafka           = register("kafka", "Allow consuming samples from and exporting them to Kafka, with -kafka.consumer.topics and -kafka.exporter.enabled.")
+)
+
+func register(name, help string) *Feature {
+	if _, ok := features[name]; ok {
+		panic(fmt.Sprintf("experimental feature %q registered twice", name))
+	}
+	f := &Feature{Name: name, Help: help}
+	features[name] = f
+	return f
+}
+
+// Enabled returns true if the feature has been enabled.
+func (f *Feature) Enabled() bool {
+	return f.enabled
+}
+
+// Require returns an error saying how to enable the feature, if what (the
+// setting which needs it) is used while it is disabled.
+func (f *Feature) Require(what string) error {
+	if f.enabled {
+		return nil
+	}
+	return fmt.Errorf("%s is experimental; enable it with -experimental.%s", what, f.Name)
+}
+
+// RegisterFlags registers an -experimental.<name> flag for each feature.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, f := range Features() {
+		fs.BoolVar(&f.enabled, "experimental."+f.Name, false, "Enable experimental feature: "+f.Help)
+	}
+}
+
+// Features returns all the features, sorted by name.
+func Features() []*Feature {
+	result := make([]*Feature, 0, len(features))
+	for _, f := range features {
+		result = append(result, f)
+	}
+	sort.Sort(byName(result))
+	return result
+}
+
+type byName []*Feature
+
+func (fs byName) Len() int           { return len(fs) }
+func (fs byName) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs byName) Less(i, j int) bool { return fs[i].Name < fs[j].Name }
+
+// Handler lists the features, and whether each is enabled, as JSON.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	type feature struct {
+		*Feature
+		Enabled bool `json:"enabled"`
+	}
+	var result []feature
+	for _, f := range Features() {
+		result = append(result, feature{f, f.enabled})
+	}
+	util.WriteJSONResponse(w, result)
+}
@@ -0,0 +1,45 @@
+package experimental
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-experimental.remote-ruler"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { RemoteRuler.enabled = false }()
+
+	if !RemoteRuler.Enabled() || ChunkFormatV2.Enabled() {
+		t.Fatalf("wrong features enabled: remote-ruler=%v chunk-format-v2=%v", RemoteRuler.Enabled(), ChunkFormatV2.Enabled())
+	}
+	if err := RemoteRuler.Require("-ruler.querier.url"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ChunkFormatV2.Require("-chunk.format-version=2"); err == nil {
+		t.Fatal("expected error for disabled feature")
+	}
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/experiments", nil))
+	var listed []struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(features) {
+		t.Fatalf("expected %d features, got %d", len(features), len(listed))
+	}
+	for _, f := range listed {
+		if f.Enabled != (f.Name == RemoteRuler.Name) {
+			t.Fatalf("wrong state listed for %s: %v", f.Name, f.Enabled)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package export
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	indexMagic       = 0xBAAAD700
+	indexFormatV2    = 2
+	chunksMagic      = 0x85BD40DD
+	chunksFormatV1   = 1
+	maxSegmentSize   = 512 * 1024 * 1024
+	samplesPerChunk  = 120
+	seriesAlignment  = 16
+	ulidAlphabet     = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	blockMetaVersion = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BlockMeta is a block's meta.json.
+type BlockMeta struct {
+	ULID    string `json:"ulid"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"` // Exclusive.
+	Stats   struct {
+		NumSamples uint64 `json:"numSamples"`
+		NumSeries  uint64 `json:"numSeries"`
+		NumChunks  uint64 `json:"numChunks"`
+	} `json:"stats"`
+	Compaction struct {
+		Level   int      `json:"level"`
+		Sources []string `json:"sources"`
+	} `json:"compaction"`
+	Version int `json:"version"`
+}
+
+// chunkMeta locates one of a series' chunks in the block's chunk files.
+type chunkMeta struct {
+	ref              uint64
+	minTime, maxTime model.Time
+}
+
+// labelPair is a label of a series, in the block's sorted order.
+type labelPair struct {
+	name, value string
+}
+
+// byLabelPair sorts label pairs by name, then value.
+type byLabelPair []labelPair
+
+func (ps byLabelPair) Len() int      { return len(ps) }
+func (ps byLabelPair) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byLabelPair) Less(i, j int) bool {
+	if ps[i].name != ps[j].name {
+		return ps[i].name < ps[j].name
+	}
+	return ps[i].value < ps[j].value
+}
+
+// seriesEntry is a series to write to a block, with the label set it is
+// sorted by.
+type seriesEntry struct {
+	labels []labelPair
+	values []model.SamplePair
+	chunks []chunkMeta
+}
+
+// bySeriesLabels sorts series by their label sets.
+type bySeriesLabels []seriesEntry
+
+func (es bySeriesLabels) Len() int           { return len(es) }
+func (es bySeriesLabels) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es bySeriesLabels) Less(i, j int) bool { return compareLabels(es[i].labels, es[j].labels) < 0 }
+
+// WriteBlock writes series, whose samples must be sorted and not
+// duplicated, to a new Prometheus 2 TSDB block in a directory named after
+// its ULID under dir, returning its metadata.  Series without samples are
+// left out.  The block is written to a temporary directory first, so
+// Prometheus never sees a partial block.
+func WriteBlock(dir string, series model.Matrix) (BlockMeta, error) {
+	var meta BlockMeta
+	ulid, err := newULID(time.Now())
+	if err != nil {
+		return meta, err
+	}
+	meta.ULID = ulid
+	meta.Version = blockMetaVersion
+	meta.Compaction.Level = 1
+	meta.Compaction.Sources = []string{ulid}
+
+	tmp := filepath.Join(dir, ulid+".tmp")
+	if err := os.MkdirAll(filepath.Join(tmp, "chunks"), 0777); err != nil {
+		return meta, err
+	}
+
+	// Series are written in the order of their sorted label sets.
+	var entries []seriesEntry
+	for _, ss := range series {
+		if len(ss.Values) == 0 {
+			continue
+		}
+		labels := make([]labelPair, 0, len(ss.Metric))
+		for name, value := range ss.Metric {
+			labels = append(labels, labelPair{string(name), string(value)})
+		}
+		sort.Sort(byLabelPair(labels))
+		entries = append(entries, seriesEntry{labels: labels, values: ss.Values})
+	}
+	sort.Sort(bySeriesLabels(entries))
+
+	cw := &chunkWriter{dir: filepath.Join(tmp, "chunks")}
+	meta.MinTime, meta.MaxTime = int64(model.Latest), int64(model.Earliest)
+	for i := range entries {
+		values := entries[i].values
+		for start := 0; start < len(values); start += samplesPerChunk {
+			end := start + samplesPerChunk
+			if end > len(values) {
+				end = len(values)
+			}
+			c := newXORChunk()
+			for _, s := range values[start:end] {
+				c.append(s)
+			}
+			ref, err := cw.write(c.bytes())
+			if err != nil {
+				cw.close()
+				return meta, err
+			}
+			entries[i].chunks = append(entries[i].chunks, chunkMeta{ref, c.minTime, c.maxTime})
+			meta.Stats.NumChunks++
+		}
+		meta.Stats.NumSamples += uint64(len(values))
+		meta.Stats.NumSeries++
+		if t := int64(values[0].Timestamp); t < meta.MinTime {
+			meta.MinTime = t
+		}
+		if t := int64(values[len(values)-1].Timestamp) + 1; t > meta.MaxTime {
+			meta.MaxTime = t
+		}
+	}
+	if err := cw.close(); err != nil {
+		return meta, err
+	}
+	if len(entries) == 0 {
+		meta.MinTime, meta.MaxTime = 0, 0
+	}
+
+	labels := make([][]labelPair, len(entries))
+	chunks := make([][]chunkMeta, len(entries))
+	for i, e := range entries {
+		labels[i], chunks[i] = e.labels, e.chunks
+	}
+	if err := writeIndex(filepath.Join(tmp, "index"), labels, chunks); err != nil {
+		return meta, err
+	}
+
+	buf, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return meta, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "meta.json"), buf, 0666); err != nil {
+		return meta, err
+	}
+	return meta, os.Rename(tmp, filepath.Join(dir, ulid))
+}
+
+func compareLabels(a, b []labelPair) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].name != b[i].name {
+			if a[i].name < b[i].name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].value != b[i].value {
+			if a[i].value < b[i].value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// chunkWriter writes chunks to numbered segment files.
+type chunkWriter struct {
+	dir  string
+	seq  uint64
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// write writes a chunk, returning its reference: its segment's sequence
+// number in the upper 32 bits, and its offset in the segment in the lower.
+func (w *chunkWriter) write(data []byte) (uint64, error) {
+	var header [binary.MaxVarintLen32 + 1]byte
+	n := binary.PutUvarint(header[:], uint64(len(data)))
+	header[n] = xorEncoding
+	length := int64(n+1+len(data)) + crc32.Size
+
+	if w.f == nil || w.size+length > maxSegmentSize {
+		if err := w.cut(); err != nil {
+			return 0, err
+		}
+	}
+	ref := (w.seq-1)<<32 | uint64(w.size)
+
+	crc := crc32.New(castagnoli)
+	crc.Write(header[n : n+1])
+	crc.Write(data)
+	w.w.Write(header[:n+1])
+	w.w.Write(data)
+	if _, err := w.w.Write(crc.Sum(nil)); err != nil {
+		return 0, err
+	}
+	w.size += length
+	return ref, nil
+}
+
+// cut starts a new segment file.
+func (w *chunkWriter) cut() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	w.seq++
+	f, err := os.Create(filepath.Join(w.dir, fmt.Sprintf("%06d", w.seq)))
+	if err != nil {
+		return err
+	}
+	w.f, w.w = f, bufio.NewWriter(f)
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], chunksMagic)
+	header[4] = chunksFormatV1
+	_, err = w.w.Write(header[:])
+	w.size = int64(len(header))
+	return err
+}
+
+func (w *chunkWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.w.Flush()
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	w.f = nil
+	return err
+}
+
+// indexWriter writes the sections of an index file, tracking the offset.
+type indexWriter struct {
+	buf []byte
+}
+
+func (w *indexWriter) putBE32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *indexWriter) putBE64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *indexWriter) putUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (w *indexWriter) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (w *indexWriter) putUvarintString(s string) {
+	w.putUvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// section writes a section with a 4-byte length before and a CRC32 after
+// the contents written by f.
+func (w *indexWriter) section(f func()) {
+	start := len(w.buf)
+	w.putBE32(0)
+	f()
+	binary.BigEndian.PutUint32(w.buf[start:], uint32(len(w.buf)-start-4))
+	w.putCRC(start + 4)
+}
+
+func (w *indexWriter) putCRC(from int) {
+	w.putBE32(crc32.Checksum(w.buf[from:], castagnoli))
+}
+
+// writeIndex writes a version 2 index of the series with the given sorted
+// label sets and chunks.
+func writeIndex(filename string, labels [][]labelPair, chunks [][]chunkMeta) error {
+	w := &indexWriter{}
+	w.putBE32(indexMagic)
+	w.buf = append(w.buf, indexFormatV2)
+
+	// Symbols are referred to by their position in the sorted table.
+	symbolSet := map[string]struct{}{}
+	values := map[string]map[string]struct{}{}
+	for _, ls := range labels {
+		for _, l := range ls {
+			symbolSet[l.name] = struct{}{}
+			symbolSet[l.value] = struct{}{}
+			if values[l.name] == nil {
+				values[l.name] = map[string]struct{}{}
+			}
+			values[l.name][l.value] = struct{}{}
+		}
+	}
+	symbols := sortedStrings(symbolSet)
+	symbolRefs := make(map[string]uint32, len(symbols))
+	for i, s := range symbols {
+		symbolRefs[s] = uint32(i)
+	}
+	symbolsOffset := uint64(len(w.buf))
+	w.section(func() {
+		w.putBE32(uint32(len(symbols)))
+		for _, s := range symbols {
+			w.putUvarintString(s)
+		}
+	})
+
+	// Series are 16-byte aligned, and referred to by their offset / 16.
+	seriesOffset := uint64(len(w.buf))
+	seriesRefs := make([]uint32, len(labels))
+	postings := map[labelPair][]uint32{}
+	for i, ls := range labels {
+		for len(w.buf)%seriesAlignment != 0 {
+			w.buf = append(w.buf, 0)
+		}
+		seriesRefs[i] = uint32(len(w.buf) / seriesAlignment)
+		postings[labelPair{}] = append(postings[labelPair{}], seriesRefs[i])
+		for _, l := range ls {
+			postings[l] = append(postings[l], seriesRefs[i])
+		}
+
+		entry := &indexWriter{}
+		entry.putUvarint(uint64(len(ls)))
+		for _, l := range ls {
+			entry.putUvarint(uint64(symbolRefs[l.name]))
+			entry.putUvarint(uint64(symbolRefs[l.value]))
+		}
+		entry.putUvarint(uint64(len(chunks[i])))
+		for j, c := range chunks[i] {
+			if j == 0 {
+				entry.putVarint(int64(c.minTime))
+				entry.putUvarint(uint64(c.maxTime - c.minTime))
+				entry.putUvarint(c.ref)
+				continue
+			}
+			prev := chunks[i][j-1]
+			entry.putUvarint(uint64(c.minTime - prev.maxTime))
+			entry.putUvarint(uint64(c.maxTime - c.minTime))
+			entry.putVarint(int64(c.ref) - int64(prev.ref))
+		}
+		w.putUvarint(uint64(len(entry.buf)))
+		w.buf = append(w.buf, entry.buf...)
+		w.buf = append(w.buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], crc32.Checksum(entry.buf, castagnoli))
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labelIndicesOffset := uint64(len(w.buf))
+	labelIndexOffsets := make([]uint64, len(names))
+	for i, name := range names {
+		labelIndexOffsets[i] = uint64(len(w.buf))
+		nameValues := sortedStrings(values[name])
+		w.section(func() {
+			w.putBE32(1)
+			w.putBE32(uint32(len(nameValues)))
+			for _, v := range nameValues {
+				w.putBE32(symbolRefs[v])
+			}
+		})
+	}
+
+	// Postings are written in label order, starting with all series.
+	pairs := make([]labelPair, 0, len(postings))
+	for pair := range postings {
+		pairs = append(pairs, pair)
+	}
+	sort.Sort(byLabelPair(pairs))
+	postingsOffset := uint64(len(w.buf))
+	postingsOffsets := make([]uint64, len(pairs))
+	for i, pair := range pairs {
+		postingsOffsets[i] = uint64(len(w.buf))
+		refs := postings[pair]
+		w.section(func() {
+			w.putBE32(uint32(len(refs)))
+			for _, ref := range refs {
+				w.putBE32(ref)
+			}
+		})
+	}
+
+	labelOffsetTableOffset := uint64(len(w.buf))
+	w.section(func() {
+		w.putBE32(uint32(len(names)))
+		for i, name := range names {
+			w.putUvarint(1)
+			w.putUvarintString(name)
+			w.putUvarint(labelIndexOffsets[i])
+		}
+	})
+
+	postingsOffsetTableOffset := uint64(len(w.buf))
+	w.section(func() {
+		w.putBE32(uint32(len(pairs)))
+		for i, pair := range pairs {
+			w.putUvarint(2)
+			w.putUvarintString(pair.name)
+			w.putUvarintString(pair.value)
+			w.putUvarint(postingsOffsets[i])
+		}
+	})
+
+	tocOffset := len(w.buf)
+	for _, offset := range []uint64{symbolsOffset, seriesOffset, labelIndicesOffset, labelOffsetTableOffset, postingsOffset, postingsOffsetTableOffset} {
+		w.putBE64(offset)
+	}
+	w.putCRC(tocOffset)
+
+	return writeFileSync(filename, w.buf)
+}
+
+func sortedStrings(set map[string]struct{}) []string {
+	strs := make([]string, 0, len(set))
+	for s := range set {
+		strs = append(strs, s)
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func writeFileSync(filename string, buf []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newULID makes a ULID for a block: a 48-bit millisecond timestamp and 80
+// random bits, in Crockford's base32.
+func newULID(t time.Time) (string, error) {
+	var id [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> uint(8*(5-i)))
+	}
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	n := new(big.Int).SetBytes(id[:])
+	var out [26]byte
+	mask := big.NewInt(31)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = ulidAlphabet[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(out[:]), nil
+}
@@ -0,0 +1,118 @@
+// Package export writes chunks from a chunk store out as Prometheus 2 TSDB
+// blocks, so users can take their data out of Cortex.
+package export
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Config configures an Export.
+type Config struct {
+	// Samples between From and Through are exported.
+	From, Through model.Time
+
+	// Samples are written to a block for each aligned period of this long,
+	// like those Prometheus writes from its head.  If zero, all samples are
+	// written to one block.
+	BlockDuration time.Duration
+
+	// The series to export, as sets of label matchers, each of which must
+	// include an equality matcher for the metric name.
+	MatcherSets []metric.LabelMatchers
+}
+
+// Export reads the series matching cfg.MatcherSets between cfg.From and
+// cfg.Through from store, for the user in ctx, and writes them to TSDB
+// blocks under dir, which can be copied into a Prometheus server's data
+// directory.  Series matched by more than one matcher set are only written
+// once.  Periods without samples don't get a block.
+func Export(ctx context.Context, store chunk.Store, cfg Config, dir string) ([]BlockMeta, error) {
+	if cfg.Through < cfg.From {
+		return nil, fmt.Errorf("export range ends before it starts")
+	}
+	var metas []BlockMeta
+	for _, r := range blockRanges(cfg.From, cfg.Through, cfg.BlockDuration) {
+		from, through := r[0], r[1]
+		series := map[model.Fingerprint]*model.SampleStream{}
+		for _, matchers := range cfg.MatcherSets {
+			// Get reorders the matchers, so it gets its own copy.
+			chunks, err := store.Get(ctx, from, through, append(metric.LabelMatchers{}, matchers...)...)
+			if err != nil {
+				return metas, err
+			}
+			matrix, err := chunk.ChunksToMatrix(chunks)
+			if err != nil {
+				return metas, err
+			}
+			for _, ss := range matrix {
+				fp := ss.Metric.Fingerprint()
+				if existing, ok := series[fp]; ok {
+					existing.Values = util.MergeSamples(existing.Values, ss.Values)
+				} else {
+					series[fp] = ss
+				}
+			}
+		}
+
+		// Chunks overlapping the block's period may have samples outside it.
+		matrix := make(model.Matrix, 0, len(series))
+		for _, ss := range series {
+			ss.Values = samplesBetween(ss.Values, from, through)
+			if len(ss.Values) > 0 {
+				matrix = append(matrix, ss)
+			}
+		}
+		if len(matrix) == 0 {
+			continue
+		}
+		meta, err := WriteBlock(dir, matrix)
+		if err != nil {
+			return metas, err
+		}
+		log.Infof("Wrote block %s of %d series, %d samples, from %v to %v", meta.ULID, meta.Stats.NumSeries, meta.Stats.NumSamples, from, through)
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// blockRanges splits from-through into inclusive ranges aligned to
+// multiples of duration.
+func blockRanges(from, through model.Time, duration time.Duration) [][2]model.Time {
+	if duration <= 0 {
+		return [][2]model.Time{{from, through}}
+	}
+	step := model.Time(duration / time.Millisecond)
+	var ranges [][2]model.Time
+	for start := from; start <= through; {
+		end := start - start%step + step
+		if end > through {
+			ranges = append(ranges, [2]model.Time{start, through})
+			break
+		}
+		ranges = append(ranges, [2]model.Time{start, end - 1})
+		start = end
+	}
+	return ranges
+}
+
+// samplesBetween returns the sorted samples between from and through.
+func samplesBetween(samples []model.SamplePair, from, through model.Time) []model.SamplePair {
+	start := 0
+	for start < len(samples) && samples[start].Timestamp < from {
+		start++
+	}
+	end := start
+	for end < len(samples) && samples[end].Timestamp <= through {
+		end++
+	}
+	return samples[start:end]
+}
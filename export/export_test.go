@@ -0,0 +1,255 @@
+package export
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/user"
+)
+
+// bitReader reads a bstream.
+type bitReader struct {
+	b   []byte
+	pos uint
+}
+
+func (r *bitReader) readBit() bool {
+	bit := r.b[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return bit
+}
+
+func (r *bitReader) readBits(n uint) uint64 {
+	var u uint64
+	for i := uint(0); i < n; i++ {
+		u <<= 1
+		if r.readBit() {
+			u |= 1
+		}
+	}
+	return u
+}
+
+func (r *bitReader) ReadByte() (byte, error) {
+	return byte(r.readBits(8)), nil
+}
+
+// decodeXOR decodes an XOR chunk as Prometheus does.
+func decodeXOR(b []byte) []model.SamplePair {
+	num := int(binary.BigEndian.Uint16(b))
+	r := &bitReader{b: b[2:]}
+	var (
+		samples           []model.SamplePair
+		t, tDelta         int64
+		v                 uint64
+		leading, trailing uint
+	)
+	readValue := func() {
+		if !r.readBit() {
+			return
+		}
+		if r.readBit() {
+			leading = uint(r.readBits(5))
+			sigbits := uint(r.readBits(6))
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			trailing = 64 - leading - sigbits
+		}
+		v ^= r.readBits(64-leading-trailing) << trailing
+	}
+	for i := 0; i < num; i++ {
+		switch i {
+		case 0:
+			t, _ = binary.ReadVarint(r)
+			v = r.readBits(64)
+		case 1:
+			d, _ := binary.ReadUvarint(r)
+			tDelta = int64(d)
+			t += tDelta
+			readValue()
+		default:
+			var prefix uint
+			for j := 0; j < 4 && r.readBit(); j++ {
+				prefix++
+			}
+			var dod int64
+			if sz := []uint{0, 14, 17, 20, 64}[prefix]; sz > 0 {
+				bits := r.readBits(sz)
+				if sz != 64 && bits > 1<<(sz-1) {
+					bits -= 1 << sz
+				}
+				dod = int64(bits)
+			}
+			tDelta += dod
+			t += tDelta
+			readValue()
+		}
+		samples = append(samples, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(math.Float64frombits(v))})
+	}
+	return samples
+}
+
+func TestXORChunk(t *testing.T) {
+	var samples []model.SamplePair
+	ts := model.Time(1500000000000)
+	for i, delta := range []time.Duration{0, 15, 15, 15, 16, 14, 30, 600, 15, 86400, 15, 1, 15} {
+		ts = ts.Add(delta * time.Second)
+		samples = append(samples, model.SamplePair{Timestamp: ts, Value: model.SampleValue(float64(i*i) / 3)})
+	}
+	samples = append(samples, model.SamplePair{Timestamp: ts + 1, Value: model.SampleValue(math.Inf(1))})
+	samples = append(samples, model.SamplePair{Timestamp: ts + 2, Value: model.SampleValue(math.Inf(1))})
+	samples = append(samples, model.SamplePair{Timestamp: ts + 3, Value: -1})
+
+	c := newXORChunk()
+	for _, s := range samples {
+		c.append(s)
+	}
+	if decoded := decodeXOR(c.bytes()); !reflect.DeepEqual(samples, decoded) {
+		t.Fatalf("expected %v, got %v", samples, decoded)
+	}
+}
+
+func TestZeroBitCounts(t *testing.T) {
+	for _, tc := range []struct {
+		x                 uint64
+		leading, trailing int
+	}{
+		{0, 64, 64},
+		{1, 63, 0},
+		{1 << 63, 0, 63},
+		{0xf0, 56, 4},
+		{math.MaxUint64, 0, 0},
+	} {
+		if leading, trailing := leadingZeros(tc.x), trailingZeros(tc.x); leading != tc.leading || trailing != tc.trailing {
+			t.Errorf("%#x: expected %d leading and %d trailing zeros, got %d and %d", tc.x, tc.leading, tc.trailing, leading, trailing)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	store := chunk.NewAWSStore(chunk.StoreConfig{
+		S3:         chunk.NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   chunk.NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+
+	// Two series of a sample a minute for three hours, from an aligned start.
+	from := model.Time(1500000000000 - 1500000000000%int64(2*time.Hour/time.Millisecond))
+	var chunks []chunk.Chunk
+	for i, metric := range []model.Metric{
+		{model.MetricNameLabel: "foo", "bar": "a"},
+		{model.MetricNameLabel: "foo", "bar": "b"},
+	} {
+		pc := prom_chunk.New()
+		chunkFrom := from
+		for ts := from; ts < from.Add(3*time.Hour); ts = ts.Add(time.Minute) {
+			pcs, err := pc.Add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pcs) > 1 {
+				chunks = append(chunks, chunk.NewChunk(metric.Fingerprint(), metric, pcs[0], chunkFrom, ts.Add(-time.Minute)))
+				chunkFrom = ts
+			}
+			pc = pcs[len(pcs)-1]
+		}
+		chunks = append(chunks, chunk.NewChunk(metric.Fingerprint(), metric, pc, chunkFrom, from.Add(3*time.Hour-time.Minute)))
+	}
+	if err := store.Put(ctx, chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metas, err := Export(ctx, store, Config{
+		From:          from,
+		Through:       from.Add(4 * time.Hour),
+		BlockDuration: 2 * time.Hour,
+		MatcherSets: []metric.LabelMatchers{{
+			mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		}},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(metas))
+	}
+	for i, expectedSamples := range []uint64{2 * 120, 2 * 60} {
+		meta := metas[i]
+		if meta.Stats.NumSeries != 2 || meta.Stats.NumSamples != expectedSamples || meta.Stats.NumChunks != 2 {
+			t.Errorf("block %d: unexpected stats %+v", i, meta.Stats)
+		}
+		blockFrom := from.Add(time.Duration(i) * 2 * time.Hour)
+		if meta.MinTime != int64(blockFrom) {
+			t.Errorf("block %d: expected min time %d, got %d", i, blockFrom, meta.MinTime)
+		}
+
+		var written BlockMeta
+		buf, err := ioutil.ReadFile(filepath.Join(dir, meta.ULID, "meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(buf, &written); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(meta, written) {
+			t.Errorf("block %d: expected meta.json %+v, got %+v", i, meta, written)
+		}
+
+		index, err := ioutil.ReadFile(filepath.Join(dir, meta.ULID, "index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint32(index) != indexMagic || index[4] != indexFormatV2 {
+			t.Fatalf("block %d: bad index header", i)
+		}
+		toc := index[len(index)-52:]
+		if crc32.Checksum(toc[:48], castagnoli) != binary.BigEndian.Uint32(toc[48:]) {
+			t.Fatalf("block %d: bad index TOC checksum", i)
+		}
+
+		segment, err := ioutil.ReadFile(filepath.Join(dir, meta.ULID, "chunks", "000001"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint32(segment) != chunksMagic {
+			t.Fatalf("block %d: bad chunks header", i)
+		}
+		// The first chunk is the first series', with a sample a minute.
+		length, n := binary.Uvarint(segment[8:])
+		data := segment[8+n+1 : 8+n+1+int(length)]
+		samples := decodeXOR(data)
+		if len(samples) != int(expectedSamples/2) || samples[0].Timestamp != blockFrom || samples[1].Timestamp != blockFrom.Add(time.Minute) {
+			t.Fatalf("block %d: unexpected first chunk %v", i, samples)
+		}
+	}
+}
+
+func mustNewLabelMatcher(matchType metric.MatchType, name model.LabelName, value model.LabelValue) *metric.LabelMatcher {
+	m, err := metric.NewLabelMatcher(matchType, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
@@ -0,0 +1,165 @@
+package export
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+// bstream is a stream of bits, written most significant bit first.
+type bstream struct {
+	stream []byte
+	count  uint8 // How many bits of the last byte are free.
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	for i := 7; i >= 0; i-- {
+		b.writeBit(byt&(1<<uint(i)) != 0)
+	}
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	for i := nbits - 1; i >= 0; i-- {
+		b.writeBit(u&(1<<uint(i)) != 0)
+	}
+}
+
+// xorChunk is a chunk in the Prometheus 2 "XOR" encoding: Gorilla-style
+// delta-of-delta timestamps and XORed values, after a big-endian 16-bit
+// sample count.
+type xorChunk struct {
+	b       bstream
+	num     uint16
+	t       int64
+	v       float64
+	tDelta  uint64
+	leading uint8
+	trail   uint8
+
+	minTime, maxTime model.Time
+}
+
+// xorEncoding is the encoding byte of XOR chunks in TSDB chunk files.
+const xorEncoding = 1
+
+func newXORChunk() *xorChunk {
+	return &xorChunk{b: bstream{stream: make([]byte, 2)}, leading: 0xff}
+}
+
+// bytes returns the chunk's encoded form.
+func (c *xorChunk) bytes() []byte {
+	binary.BigEndian.PutUint16(c.b.stream, c.num)
+	return c.b.stream
+}
+
+// append adds a sample, which must be after the chunk's last.
+func (c *xorChunk) append(s model.SamplePair) {
+	t, v := int64(s.Timestamp), float64(s.Value)
+	switch c.num {
+	case 0:
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+		c.minTime = s.Timestamp
+	case 1:
+		tDelta := uint64(t - c.t)
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeVDelta(v)
+		c.tDelta = tDelta
+	default:
+		tDelta := uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0x02, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0x06, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0x0e, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0x0f, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeVDelta(v)
+		c.tDelta = tDelta
+	}
+	c.t, c.v = t, v
+	c.maxTime = s.Timestamp
+	c.num++
+}
+
+// bitRange returns whether x fits in a signed nbits-bit delta.
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// leadingZeros returns the number of leading zero bits in x.
+func leadingZeros(x uint64) int {
+	n := 0
+	for ; n < 64 && x&(1<<63) == 0; n++ {
+		x <<= 1
+	}
+	return n
+}
+
+// trailingZeros returns the number of trailing zero bits in x.
+func trailingZeros(x uint64) int {
+	n := 0
+	for ; n < 64 && x&1 == 0; n++ {
+		x >>= 1
+	}
+	return n
+}
+
+func (c *xorChunk) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if vDelta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(leadingZeros(vDelta))
+	trailing := uint8(trailingZeros(vDelta))
+	// The leading count is written in 5 bits.
+	if leading >= 32 {
+		leading = 31
+	}
+
+	// Reuse the previous value's window of significant bits if it has one
+	// and this value fits in it.
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trail {
+		c.b.writeBit(false)
+		c.b.writeBits(vDelta>>c.trail, 64-int(c.leading)-int(c.trail))
+		return
+	}
+	c.leading, c.trail = leading, trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+	// 64 significant bits are written as 0, which readers interpret as 64.
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(vDelta>>trailing, int(sigbits))
+}
@@ -0,0 +1,301 @@
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/user"
+)
+
+var (
+	queueDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_queue_duration_seconds",
+		Help:      "Time spent by requests queued in the query frontend before a querier took them.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_queue_length",
+		Help:      "Number of requests queued in the query frontend.",
+	})
+	queryRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_retries_total",
+		Help:      "Number of requests the query frontend retried after a querier failed them.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueDuration)
+	prometheus.MustRegister(queueLength)
+	prometheus.MustRegister(queryRetries)
+}
+
+var errTooManyRequests = errors.New("too many outstanding requests")
+
+// Config configures a Frontend.
+type Config struct {
+	// The most requests a tenant may have queued; further requests are
+	// rejected with a 429.  If zero, there is no limit.
+	MaxOutstandingPerTenant int
+
+	// How many times a request is retried when the querier serving it fails,
+	// either by going away or with a 5xx response.
+	MaxRetries int
+
+	// Split range queries into one query per day, which queriers serve in
+	// parallel, and which can be cached separately.
+	SplitQueriesByDay bool
+
+	ResultsCache ResultsCacheConfig
+}
+
+// Frontend queues queries for queriers, which pull them with Process.  Each
+// tenant has its own queue, and queriers take requests from the tenants'
+// queues in turn, so one tenant's burst of queries doesn't hold up the
+// others'.  Range queries may be split by day, and their results cached.
+// Requests are retried when the querier serving them fails, so querier
+// crashes and restarts aren't seen by clients.
+type Frontend struct {
+	cfg   Config
+	cache *resultsCache
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	queues  map[string][]*request
+	tenants []string // Tenants with queued requests, in the order they are served.
+	next    int
+}
+
+// request is a request queued for a querier.  Its response or error is sent
+// on response or err, which are buffered so queriers never block on
+// requests whose clients have gone away.
+type request struct {
+	ctx      context.Context
+	request  *cortex.HTTPRequest
+	enqueued time.Time
+	response chan *cortex.HTTPResponse
+	err      chan error
+}
+
+// New makes a new Frontend.
+func New(cfg Config) *Frontend {
+	f := &Frontend{
+		cfg:    cfg,
+		queues: map[string][]*request{},
+	}
+	f.cond = sync.NewCond(&f.mtx)
+	if cfg.ResultsCache.MaxEntries > 0 {
+		f.cache = newResultsCache(cfg.ResultsCache)
+	}
+	return f
+}
+
+// ServeHTTP queues the request for a querier and writes its response.
+func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get(user.UserIDHeaderName)
+	if userID == "" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	ctx := user.WithID(r.Context(), userID)
+
+	var (
+		resp *cortex.HTTPResponse
+		err  error
+	)
+	if strings.HasSuffix(r.URL.Path, "/query_range") {
+		resp, err = f.queryRange(ctx, userID, r)
+	} else {
+		var req *cortex.HTTPRequest
+		if req, err = toHTTPRequest(r); err == nil {
+			resp, err = f.roundTrip(ctx, userID, req)
+		}
+	}
+	if err == errTooManyRequests {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		log.Errorf("Error serving query for user %s: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeHTTPResponse(w, resp)
+}
+
+// roundTrip queues req for a querier and returns its response, retrying if
+// the querier fails.  After the last retry, the last response or error is
+// returned.
+func (f *Frontend) roundTrip(ctx context.Context, userID string, req *cortex.HTTPRequest) (*cortex.HTTPResponse, error) {
+	var (
+		resp *cortex.HTTPResponse
+		err  error
+	)
+	for tries := 0; tries <= f.cfg.MaxRetries; tries++ {
+		if tries > 0 {
+			queryRetries.Inc()
+		}
+		resp, err = f.queue(ctx, userID, req)
+		if err == errTooManyRequests || ctx.Err() != nil {
+			return nil, err
+		}
+		if err == nil && resp.Code/100 != 5 {
+			return resp, nil
+		}
+	}
+	return resp, err
+}
+
+// queue queues req in the user's queue, and waits for a querier to serve it.
+func (f *Frontend) queue(ctx context.Context, userID string, req *cortex.HTTPRequest) (*cortex.HTTPResponse, error) {
+	r := &request{
+		ctx:      ctx,
+		request:  req,
+		enqueued: time.Now(),
+		response: make(chan *cortex.HTTPResponse, 1),
+		err:      make(chan error, 1),
+	}
+
+	f.mtx.Lock()
+	queue := f.queues[userID]
+	if f.cfg.MaxOutstandingPerTenant > 0 && len(queue) >= f.cfg.MaxOutstandingPerTenant {
+		f.mtx.Unlock()
+		return nil, errTooManyRequests
+	}
+	if len(queue) == 0 {
+		f.tenants = append(f.tenants, userID)
+	}
+	f.queues[userID] = append(queue, r)
+	queueLength.Inc()
+	f.cond.Signal()
+	f.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case resp := <-r.response:
+		return resp, nil
+	case err := <-r.err:
+		return nil, err
+	}
+}
+
+// getNextRequest waits for a queued request, and takes it from the queue of
+// the next tenant in turn.  Requests whose clients have gone away are
+// dropped.
+func (f *Frontend) getNextRequest(ctx context.Context) (*request, error) {
+	// Waiting on the condition isn't interrupted by ctx, so wake the waiters
+	// when it is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.mtx.Lock()
+			f.cond.Broadcast()
+			f.mtx.Unlock()
+		case <-done:
+		}
+	}()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for {
+		for len(f.tenants) == 0 && ctx.Err() == nil {
+			f.cond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if f.next >= len(f.tenants) {
+			f.next = 0
+		}
+		userID := f.tenants[f.next]
+		queue := f.queues[userID]
+		r := queue[0]
+		queue[0] = nil
+		if queue = queue[1:]; len(queue) == 0 {
+			delete(f.queues, userID)
+			f.tenants = append(f.tenants[:f.next], f.tenants[f.next+1:]...)
+		} else {
+			f.queues[userID] = queue
+			f.next++
+		}
+		queueLength.Dec()
+
+		if r.ctx.Err() == nil {
+			queueDuration.Observe(time.Since(r.enqueued).Seconds())
+			return r, nil
+		}
+	}
+}
+
+// Process implements cortex.FrontendServer.  It sends the querier queued
+// requests one at a time, each once it has sent the response to the last.
+// If the querier goes away, the request it was serving fails, and is
+// retried by roundTrip.
+func (f *Frontend) Process(server cortex.Frontend_ProcessServer) error {
+	for {
+		r, err := f.getNextRequest(server.Context())
+		if err != nil {
+			return err
+		}
+		if err := server.Send(&cortex.ProcessRequest{HttpRequest: r.request}); err != nil {
+			r.err <- err
+			return err
+		}
+		resp, err := server.Recv()
+		if err != nil {
+			r.err <- err
+			return err
+		}
+		if resp.HttpResponse == nil {
+			err := fmt.Errorf("querier sent no response")
+			r.err <- err
+			return err
+		}
+		r.response <- resp.HttpResponse
+	}
+}
+
+// toHTTPRequest converts r to be sent to a querier.
+func toHTTPRequest(r *http.Request) (*cortex.HTTPRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &cortex.HTTPRequest{
+		Method:  r.Method,
+		Url:     r.URL.String(),
+		Headers: toHTTPHeaders(r.Header),
+		Body:    body,
+	}, nil
+}
+
+func toHTTPHeaders(header http.Header) []*cortex.HTTPHeader {
+	headers := make([]*cortex.HTTPHeader, 0, len(header))
+	for key, values := range header {
+		headers = append(headers, &cortex.HTTPHeader{Key: key, Values: values})
+	}
+	return headers
+}
+
+func writeHTTPResponse(w http.ResponseWriter, resp *cortex.HTTPResponse) {
+	for _, header := range resp.Headers {
+		w.Header()[header.Key] = header.Values
+	}
+	w.WriteHeader(int(resp.Code))
+	w.Write(resp.Body)
+}
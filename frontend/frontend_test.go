@@ -0,0 +1,306 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/user"
+)
+
+// processServer is a querier's connection to the frontend, serving the
+// requests it is sent with handler.  If crash is set, it fails instead.
+type processServer struct {
+	grpc.ServerStream
+	ctx     context.Context
+	handler http.Handler
+	crash   bool
+	resp    *cortex.HTTPResponse
+}
+
+func (s *processServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *processServer) Send(req *cortex.ProcessRequest) error {
+	if s.crash {
+		return nil
+	}
+	r, err := http.NewRequest(req.HttpRequest.Method, req.HttpRequest.Url, bytes.NewReader(req.HttpRequest.Body))
+	if err != nil {
+		return err
+	}
+	for _, header := range req.HttpRequest.Headers {
+		r.Header[header.Key] = header.Values
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	s.resp = &cortex.HTTPResponse{
+		Code:    int32(w.Code),
+		Headers: toHTTPHeaders(w.HeaderMap),
+		Body:    w.Body.Bytes(),
+	}
+	return nil
+}
+
+func (s *processServer) Recv() (*cortex.ProcessResponse, error) {
+	if s.crash {
+		return nil, fmt.Errorf("querier crashed")
+	}
+	return &cortex.ProcessResponse{HttpResponse: s.resp}, nil
+}
+
+func startQuerier(ctx context.Context, f *Frontend, handler http.Handler, crash bool) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Process(&processServer{ctx: ctx, handler: handler, crash: crash})
+	}()
+	return done
+}
+
+func query(f *Frontend, userID, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set(user.UserIDHeaderName, userID)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	return w
+}
+
+func TestFrontendRetries(t *testing.T) {
+	f := New(Config{MaxRetries: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first querier to take the query crashes, and the query is retried
+	// by the next.
+	crashed := startQuerier(ctx, f, nil, true)
+	go func() {
+		<-crashed
+		startQuerier(ctx, f, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(user.UserIDHeaderName) != "1" {
+				t.Errorf("unexpected user %q", r.Header.Get(user.UserIDHeaderName))
+			}
+			w.Write([]byte("ok"))
+		}), false)
+	}()
+
+	w := query(f, "1", "/api/prom/api/v1/query?query=up")
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+
+	// Once the retries are used up, the last response is returned.
+	failing := New(Config{MaxRetries: 2})
+	var calls int32
+	startQuerier(ctx, failing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}), false)
+	w = query(failing, "1", "/api/prom/api/v1/query?query=up")
+	if w.Code != http.StatusServiceUnavailable || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected 3 attempts and a 503, got %d attempts and a %d", calls, w.Code)
+	}
+}
+
+func TestFrontendTooManyRequests(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 1})
+
+	// With no queriers, the first request stays queued.
+	r := httptest.NewRequest("GET", "/api/prom/api/v1/query?query=up", nil)
+	r.Header.Set(user.UserIDHeaderName, "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan struct{})
+	go func() {
+		f.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+		close(queued)
+	}()
+	for {
+		f.mtx.Lock()
+		n := len(f.queues["1"])
+		f.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if w := query(f, "1", "/api/prom/api/v1/query?query=up"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429, got %d", w.Code)
+	}
+	if w := query(f, "", "/api/prom/api/v1/query?query=up"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a 401, got %d", w.Code)
+	}
+	cancel()
+	<-queued
+}
+
+func TestFrontendFairness(t *testing.T) {
+	f := New(Config{})
+	ctx := context.Background()
+	for i, userID := range []string{"a", "a", "a", "b", "c"} {
+		go f.queue(ctx, userID, &cortex.HTTPRequest{Url: userID})
+		// Wait for each to be queued, so they are queued in order.
+		for {
+			f.mtx.Lock()
+			n := 0
+			for _, queue := range f.queues {
+				n += len(queue)
+			}
+			f.mtx.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var order []string
+	for i := 0; i < 5; i++ {
+		r, err := f.getNextRequest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, r.request.Url)
+		r.response <- &cortex.HTTPResponse{}
+	}
+	if expected := []string{"a", "b", "c", "a", "a"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected requests to be served in order %v, got %v", expected, order)
+	}
+}
+
+func TestSplitByDay(t *testing.T) {
+	day := model.Time(millisecondsPerDay)
+	for _, tc := range []struct {
+		start, end model.Time
+		step       time.Duration
+		expected   []timeRange
+	}{
+		// Ranges end at their last evaluation time.
+		{0, day - 1, time.Hour, []timeRange{{0, day - model.Time(time.Hour/time.Millisecond)}}},
+		{0, day, time.Hour, []timeRange{{0, day - model.Time(time.Hour/time.Millisecond)}, {day, day}}},
+		{
+			day / 2, 2 * day, 7 * time.Hour,
+			// 12h, 19h, then 26h, 33h, 40h, 47h, then 54h > 48h.
+			[]timeRange{{day / 2, day/2 + 7*3600*1000}, {day/2 + 14*3600*1000, day/2 + 35*3600*1000}},
+		},
+	} {
+		if got := splitByDay(tc.start, tc.end, tc.step); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("splitByDay(%d, %d, %s): expected %v, got %v", tc.start, tc.end, tc.step, tc.expected, got)
+		}
+	}
+}
+
+// prometheusAPI serves range queries of a single series with the value of
+// each sample being its timestamp.
+func prometheusAPI(calls *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		params, err := parseQueryRangeParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ss := &model.SampleStream{Metric: model.Metric{"foo": "bar"}}
+		for t := params.start; t <= params.end; t = t.Add(params.step) {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(t)})
+		}
+		var resp queryRangeResponse
+		resp.Status = "success"
+		resp.Data.ResultType = model.ValMatrix.String()
+		resp.Data.Result = model.Matrix{ss}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func TestFrontendSplitAndCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int32
+	f := New(Config{
+		SplitQueriesByDay: true,
+		ResultsCache:      ResultsCacheConfig{MaxEntries: 10},
+	})
+	for i := 0; i < 3; i++ {
+		startQuerier(ctx, f, prometheusAPI(&calls), false)
+	}
+	unsplit := New(Config{})
+	startQuerier(ctx, unsplit, prometheusAPI(new(int32)), false)
+
+	start := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	path := "/api/prom/api/v1/query_range?" + url.Values{
+		"query": {"foo"},
+		"start": {start.Format(time.RFC3339)},
+		"end":   {start.Add(60 * time.Hour).Format(time.RFC3339)},
+		"step":  {"300"},
+	}.Encode()
+	expected := query(unsplit, "1", path)
+	if expected.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %q", expected.Code, expected.Body.String())
+	}
+
+	var expectedResp queryRangeResponse
+	if err := json.Unmarshal(expected.Body.Bytes(), &expectedResp); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		w := query(f, "1", path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+		var resp queryRangeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp, expectedResp) {
+			t.Fatalf("split query returned %v, expected %v", resp, expectedResp)
+		}
+		// The query covers parts of 4 days, and is then served from the
+		// cache.
+		if n := atomic.LoadInt32(&calls); n != 4 {
+			t.Fatalf("expected 4 queries, got %d", n)
+		}
+	}
+
+	// Other tenants' queries aren't served from the cache.
+	if w := query(f, "2", path); w.Code != http.StatusOK || atomic.LoadInt32(&calls) != 8 {
+		t.Fatalf("expected 8 queries, got %d (status %d)", calls, w.Code)
+	}
+
+	// Queries with non-standard parameters are neither split nor cached.
+	for i := 0; i < 2; i++ {
+		if w := query(f, "1", path+"&debug=provenance"); w.Code != http.StatusOK || atomic.LoadInt32(&calls) != int32(9+i) {
+			t.Fatalf("expected %d queries, got %d (status %d)", 9+i, calls, w.Code)
+		}
+	}
+}
+
+func TestResultsCacheTTL(t *testing.T) {
+	defer mtime.NowReset()
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	mtime.NowForce(now)
+
+	c := newResultsCache(ResultsCacheConfig{MaxEntries: 10, TTL: time.Hour})
+	resp := &cortex.HTTPResponse{Code: http.StatusOK}
+	c.put("key", model.TimeFromUnixNano(now.Add(-time.Hour).UnixNano()), resp)
+	if cached, ok := c.get("key"); !ok || cached != resp {
+		t.Fatalf("expected cached response, got %v", cached)
+	}
+	mtime.NowForce(now.Add(time.Hour))
+	if cached, ok := c.get("key"); ok {
+		t.Fatalf("expected expired response, got %v", cached)
+	}
+}
@@ -0,0 +1,105 @@
+package frontend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/mtime"
+
+	"github.com/weaveworks/cortex"
+)
+
+var resultsCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "query_frontend_results_cache_requests_total",
+	Help:      "Range queries, or days of them when split, by whether the results cache had their results: hit or miss.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(resultsCacheRequests)
+}
+
+// ResultsCacheConfig configures the query frontend's cache of range query
+// results.
+type ResultsCacheConfig struct {
+	// The most results kept; beyond it, arbitrary ones are evicted.  If
+	// zero, results aren't cached.
+	MaxEntries int
+
+	// Only the results of queries ending at least this long ago are cached,
+	// as samples may still arrive for more recent times, eg from ingesters
+	// catching up.
+	MinAge time.Duration
+
+	// How long results are cached for.  Old samples can still change, eg
+	// when they are backfilled or their series are deleted, so this bounds
+	// how long stale results are served.  If zero, results are kept until
+	// evicted.
+	TTL time.Duration
+}
+
+// resultsCache caches successful range query responses by tenant, query,
+// step and time range.  Query results rarely change once the samples in their
+// range have all arrived, so entries are kept for the configured TTL.
+type resultsCache struct {
+	cfg ResultsCacheConfig
+
+	mtx     sync.Mutex
+	entries map[string]resultsCacheEntry
+}
+
+type resultsCacheEntry struct {
+	resp    *cortex.HTTPResponse
+	expires time.Time // Zero if the entry doesn't expire.
+}
+
+func newResultsCache(cfg ResultsCacheConfig) *resultsCache {
+	return &resultsCache{
+		cfg:     cfg,
+		entries: map[string]resultsCacheEntry{},
+	}
+}
+
+func resultsCacheKey(userID, query string, step time.Duration, tr timeRange) string {
+	return fmt.Sprintf("%s:%s:%d:%d:%d", userID, query, step, tr.start, tr.end)
+}
+
+func (c *resultsCache) get(key string) (*cortex.HTTPResponse, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry, ok := c.entries[key]
+	if ok && !entry.expires.IsZero() && !mtime.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if ok {
+		resultsCacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		resultsCacheRequests.WithLabelValues("miss").Inc()
+	}
+	return entry.resp, ok
+}
+
+// put caches resp for key, if the query's range, ending at end, is old
+// enough.  Responses are never modified, so they are shared.
+func (c *resultsCache) put(key string, end model.Time, resp *cortex.HTTPResponse) {
+	if mtime.Now().Sub(end.Time()) < c.cfg.MinAge {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.cfg.MaxEntries {
+		for evict := range c.entries {
+			delete(c.entries, evict)
+			break
+		}
+	}
+	entry := resultsCacheEntry{resp: resp}
+	if c.cfg.TTL > 0 {
+		entry.expires = mtime.Now().Add(c.cfg.TTL)
+	}
+	c.entries[key] = entry
+}
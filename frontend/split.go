@@ -0,0 +1,272 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+)
+
+const millisecondsPerDay = int64(24 * time.Hour / time.Millisecond)
+
+// queryRangeParams are the parameters of a range query.
+type queryRangeParams struct {
+	query      string
+	start, end model.Time
+	step       time.Duration
+}
+
+type timeRange struct {
+	start, end model.Time
+}
+
+// standardQueryRangeParams are the range query parameters the frontend
+// understands.  Queries with others, such as debug=provenance, may have
+// responses it can't merge or cache, so they are passed to a querier whole.
+var standardQueryRangeParams = map[string]bool{
+	"query":   true,
+	"start":   true,
+	"end":     true,
+	"step":    true,
+	"timeout": true,
+}
+
+// queryRange serves a range query: split by day if configured, from the
+// results cache where possible, and otherwise by queriers.  Queries whose
+// parameters can't be parsed are passed to a querier as they are, to report
+// the error, as are queries with non-standard parameters.
+func (f *Frontend) queryRange(ctx context.Context, userID string, r *http.Request) (*cortex.HTTPResponse, error) {
+	req, err := toHTTPRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	// The body has been read; parse the form from the copy.
+	r.Body = ioutil.NopCloser(bytes.NewReader(req.Body))
+	params, err := parseQueryRangeParams(r)
+	if err != nil {
+		return f.roundTrip(ctx, userID, req)
+	}
+	for name := range r.Form {
+		if !standardQueryRangeParams[name] {
+			return f.roundTrip(ctx, userID, req)
+		}
+	}
+
+	ranges := []timeRange{{params.start, params.end}}
+	if f.cfg.SplitQueriesByDay {
+		ranges = splitByDay(params.start, params.end, params.step)
+	}
+
+	type result struct {
+		resp *cortex.HTTPResponse
+		err  error
+	}
+	results := make([]chan result, len(ranges))
+	for i, tr := range ranges {
+		results[i] = make(chan result, 1)
+		go func(tr timeRange, results chan result) {
+			resp, err := f.querySubRange(ctx, userID, r, params, tr)
+			results <- result{resp, err}
+		}(tr, results[i])
+	}
+
+	responses := make([]*cortex.HTTPResponse, 0, len(ranges))
+	for _, results := range results {
+		result := <-results
+		if result.err != nil {
+			return nil, result.err
+		}
+		responses = append(responses, result.resp)
+	}
+	if len(responses) == 1 {
+		return responses[0], nil
+	}
+	for _, resp := range responses {
+		if resp.Code != http.StatusOK {
+			return resp, nil
+		}
+	}
+	return mergeMatrixResponses(responses)
+}
+
+// querySubRange serves the range query with parameters params for the time
+// range tr, from the results cache if it is there.
+func (f *Frontend) querySubRange(ctx context.Context, userID string, r *http.Request, params queryRangeParams, tr timeRange) (*cortex.HTTPResponse, error) {
+	key := resultsCacheKey(userID, params.query, params.step, tr)
+	if f.cache != nil {
+		if resp, ok := f.cache.get(key); ok {
+			return resp, nil
+		}
+	}
+
+	form := url.Values{}
+	for name, values := range r.Form {
+		form[name] = values
+	}
+	form.Set("start", formatTime(tr.start))
+	form.Set("end", formatTime(tr.end))
+	u := *r.URL
+	u.RawQuery = form.Encode()
+	header := http.Header{}
+	for name, values := range r.Header {
+		header[name] = values
+	}
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+
+	resp, err := f.roundTrip(ctx, userID, &cortex.HTTPRequest{
+		Method:  "GET",
+		Url:     u.String(),
+		Headers: toHTTPHeaders(header),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.cache != nil && resp.Code == http.StatusOK {
+		f.cache.put(key, tr.end, resp)
+	}
+	return resp, nil
+}
+
+// splitByDay splits the range query from start to end into queries for each
+// day it covers.  Each starts at an evaluation time of the original query, so
+// together they are evaluated at the same times.
+func splitByDay(start, end model.Time, step time.Duration) []timeRange {
+	stepMs := int64(step / time.Millisecond)
+	if stepMs <= 0 {
+		return []timeRange{{start, end}}
+	}
+	var ranges []timeRange
+	for t := start; t <= end; {
+		dayEnd := (int64(t)/millisecondsPerDay + 1) * millisecondsPerDay
+		// The last evaluation time before the end of the day.
+		subEnd := t + model.Time((dayEnd-int64(t)-1)/stepMs*stepMs)
+		if subEnd > end {
+			subEnd = end
+		}
+		ranges = append(ranges, timeRange{t, subEnd})
+		t = subEnd + model.Time(stepMs)
+	}
+	return ranges
+}
+
+// parseQueryRangeParams parses a range query's parameters as the Prometheus
+// API does.
+func parseQueryRangeParams(r *http.Request) (queryRangeParams, error) {
+	var (
+		params queryRangeParams
+		err    error
+	)
+	params.query = r.FormValue("query")
+	if params.start, err = parseTime(r.FormValue("start")); err != nil {
+		return params, err
+	}
+	if params.end, err = parseTime(r.FormValue("end")); err != nil {
+		return params, err
+	}
+	if params.end < params.start {
+		return params, fmt.Errorf("end timestamp must not be before start time")
+	}
+	if params.step, err = parseDuration(r.FormValue("step")); err != nil {
+		return params, err
+	}
+	if params.step <= 0 {
+		return params, fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	return params, nil
+}
+
+func parseTime(s string) (model.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		return model.TimeFromUnixNano(int64(s)*int64(time.Second) + int64(ns*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return model.TimeFromUnixNano(t.UnixNano()), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+func formatTime(t model.Time) string {
+	return strconv.FormatFloat(float64(t)/1e3, 'f', -1, 64)
+}
+
+// queryRangeResponse is a Prometheus API range query response.
+type queryRangeResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	} `json:"data"`
+}
+
+// mergeMatrixResponses merges the successful responses to range queries for
+// consecutive time ranges, in order, into one.
+func mergeMatrixResponses(responses []*cortex.HTTPResponse) (*cortex.HTTPResponse, error) {
+	var (
+		merged  queryRangeResponse
+		series  = map[model.Fingerprint]*model.SampleStream{}
+		headers []*cortex.HTTPHeader
+	)
+	for _, resp := range responses {
+		var decoded queryRangeResponse
+		if err := json.Unmarshal(resp.Body, &decoded); err != nil {
+			return nil, err
+		}
+		if decoded.Data.ResultType != model.ValMatrix.String() {
+			return nil, fmt.Errorf("unexpected result type %q", decoded.Data.ResultType)
+		}
+		for _, ss := range decoded.Data.Result {
+			fp := ss.Metric.Fingerprint()
+			if existing, ok := series[fp]; ok {
+				existing.Values = append(existing.Values, ss.Values...)
+				continue
+			}
+			series[fp] = ss
+			merged.Data.Result = append(merged.Data.Result, ss)
+		}
+		headers = resp.Headers
+	}
+	merged.Status = "success"
+	merged.Data.ResultType = model.ValMatrix.String()
+	if merged.Data.Result == nil {
+		merged.Data.Result = model.Matrix{}
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	var mergedHeaders []*cortex.HTTPHeader
+	for _, header := range headers {
+		if !strings.EqualFold(header.Key, "Content-Length") {
+			mergedHeaders = append(mergedHeaders, header)
+		}
+	}
+	return &cortex.HTTPResponse{
+		Code:    http.StatusOK,
+		Headers: mergedHeaders,
+		Body:    body,
+	}, nil
+}
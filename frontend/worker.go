@@ -0,0 +1,179 @@
+package frontend
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	minWorkerBackoff = 100 * time.Millisecond
+	maxWorkerBackoff = 5 * time.Second
+)
+
+// WorkerConfig configures a Worker.
+type WorkerConfig struct {
+	// Address of the frontend's gRPC server.
+	Address string
+
+	// How many queries are served at once.
+	Parallelism int
+
+	TLS util.TLSConfig
+}
+
+// Worker connects out to a Frontend and serves the queries it pulls from it
+// with a handler, so queriers need no address reachable by the frontend, and
+// are scaled by running more of them.
+type Worker struct {
+	cfg     WorkerConfig
+	handler http.Handler
+	conn    *grpc.ClientConn
+	client  cortex.FrontendClient
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wait   sync.WaitGroup
+}
+
+// NewWorker makes a new Worker, serving queries with handler.
+func NewWorker(cfg WorkerConfig, handler http.Handler) (*Worker, error) {
+	clientTLS, err := cfg.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := grpc.WithInsecure()
+	if clientTLS != nil {
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(clientTLS))
+	}
+	conn, err := grpc.Dial(cfg.Address, transport)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Worker{
+		cfg:     cfg,
+		handler: handler,
+		conn:    conn,
+		client:  cortex.NewFrontendClient(conn),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// Start the Worker
+func (w *Worker) Start() {
+	for i := 0; i < w.cfg.Parallelism; i++ {
+		w.wait.Add(1)
+		go w.loop()
+	}
+}
+
+// Stop the Worker.  Queries being served are abandoned, and retried by the
+// frontend.
+func (w *Worker) Stop() {
+	w.cancel()
+	w.wait.Wait()
+	w.conn.Close()
+}
+
+// loop serves queries over a connection to the frontend, reconnecting with
+// backoff if it fails.
+func (w *Worker) loop() {
+	defer w.wait.Done()
+
+	backoff := minWorkerBackoff
+	for w.ctx.Err() == nil {
+		err := w.process()
+		if w.ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Error processing queries from frontend %s: %v", w.cfg.Address, err)
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxWorkerBackoff {
+			backoff = maxWorkerBackoff
+		}
+	}
+}
+
+// process serves queries from the frontend, one at a time, until the
+// connection fails.
+func (w *Worker) process() error {
+	stream, err := w.client.Process(w.ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		resp := w.serve(req.HttpRequest)
+		if err := stream.Send(&cortex.ProcessResponse{HttpResponse: resp}); err != nil {
+			return err
+		}
+	}
+}
+
+// serve serves req with the handler.  Requests which can't be converted are
+// answered with a 400.
+func (w *Worker) serve(req *cortex.HTTPRequest) *cortex.HTTPResponse {
+	if req == nil {
+		return &cortex.HTTPResponse{Code: http.StatusBadRequest, Body: []byte("no request")}
+	}
+	r, err := http.NewRequest(req.Method, req.Url, bytes.NewReader(req.Body))
+	if err != nil {
+		return &cortex.HTTPResponse{Code: http.StatusBadRequest, Body: []byte(err.Error())}
+	}
+	for _, header := range req.Headers {
+		r.Header[header.Key] = header.Values
+	}
+	r.RequestURI = req.Url
+
+	recorder := &responseRecorder{header: http.Header{}, code: http.StatusOK}
+	w.handler.ServeHTTP(recorder, r.WithContext(w.ctx))
+	return &cortex.HTTPResponse{
+		Code:    int32(recorder.code),
+		Headers: toHTTPHeaders(recorder.header),
+		Body:    recorder.body.Bytes(),
+	}
+}
+
+// responseRecorder is an http.ResponseWriter keeping the response, to be sent
+// back to the frontend.
+type responseRecorder struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.code = code
+	r.wroteHeader = true
+}
+
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(buf)
+}
@@ -0,0 +1,42 @@
+package frontend
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestWorker(t *testing.T) {
+	f := New(Config{})
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	cortex.RegisterFrontendServer(server, f)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	worker, err := NewWorker(WorkerConfig{Address: lis.Addr().String(), Parallelism: 2}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(r.Header.Get(user.UserIDHeaderName) + " " + r.URL.Path + " " + r.FormValue("query")))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.Start()
+	defer worker.Stop()
+
+	for i := 0; i < 3; i++ {
+		w := query(f, "1", "/api/prom/api/v1/query?query=up")
+		if w.Code != http.StatusAccepted || w.Header().Get("X-Test") != "yes" || w.Body.String() != "1 /api/prom/api/v1/query up" {
+			t.Fatalf("unexpected response %d %v %q", w.Code, w.Header(), w.Body.String())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package ingester
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/prometheus/common/log"
@@ -20,14 +21,12 @@ func (i *Ingester) PushHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, err := i.Push(ctx, &req)
 	if err != nil {
-		switch err {
-		case ErrOutOfOrderSample, ErrDuplicateSampleForTimestamp:
-			log.Warnf("append err: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		default:
+		if util.ErrorCodeOf(err).Retryable() {
 			log.Errorf("append err: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			log.Warnf("append err: %v", err)
 		}
+		util.WriteError(w, err)
 	}
 }
 
@@ -42,7 +41,7 @@ func (i *Ingester) QueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := i.Query(ctx, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.WriteError(w, err)
 		return
 	}
 
@@ -59,7 +58,7 @@ func (i *Ingester) LabelValuesHandler(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := i.LabelValues(ctx, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.WriteError(w, err)
 		return
 	}
 
@@ -68,27 +67,42 @@ func (i *Ingester) LabelValuesHandler(w http.ResponseWriter, r *http.Request) {
 
 // UserStatsHandler handles user stats requests to the Ingester.
 func (i *Ingester) UserStatsHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+	var req cortex.UserStatsRequest
+	ctx, abort := util.ParseProtoRequest(w, r, &req, false)
 	if abort {
 		return
 	}
 
-	resp, err := i.UserStats(ctx, &cortex.UserStatsRequest{})
+	resp, err := i.UserStats(ctx, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.WriteError(w, err)
 		return
 	}
 
 	util.WriteProtoResponse(w, resp)
 }
 
-// ReadinessHandler returns 204 when the ingester is ready,
-// 500 otherwise.  It's used by kubernetes to indicate if the ingester
-// pool is ready to have ingesters added / removed.
+// ReadinessHandler returns 204 when the ingester is ready, and 500 listing
+// the readiness stages otherwise.  It's used by kubernetes to indicate if the
+// ingester pool is ready to have ingesters added / removed, and whether to
+// send the ingester traffic.
 func (i *Ingester) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
-	if i.Ready() {
+	stages := i.readinessStages()
+	ready := true
+	for _, stage := range stages {
+		ready = ready && stage.ready
+	}
+	if ready {
 		w.WriteHeader(http.StatusNoContent)
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	for _, stage := range stages {
+		if stage.ready {
+			fmt.Fprintf(w, "%s: ready\n", stage.name)
+		} else {
+			fmt.Fprintf(w, "%s: not ready: %s\n", stage.name, stage.reason)
+		}
 	}
 }
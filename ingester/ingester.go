@@ -50,12 +50,12 @@ var (
 
 	// ErrOutOfOrderSample is returned if a sample has a timestamp before the latest
 	// timestamp in the series it is appended to.
-	ErrOutOfOrderSample = fmt.Errorf("sample timestamp out of order")
+	ErrOutOfOrderSample = util.NewError(util.ErrBadData, "sample timestamp out of order")
 	// ErrDuplicateSampleForTimestamp is returned if a sample has the same
 	// timestamp as the latest sample in the series it is appended to but a
 	// different value. (Appending an identical sample is a no-op and does
 	// not cause an error.)
-	ErrDuplicateSampleForTimestamp = fmt.Errorf("sample with repeated timestamp but different value")
+	ErrDuplicateSampleForTimestamp = util.NewError(util.ErrBadData, "sample with repeated timestamp but different value")
 )
 
 // Ingester deals with "in flight" chunks.
@@ -68,6 +68,9 @@ type Ingester struct {
 	quit       chan struct{}
 	done       sync.WaitGroup
 
+	// Closed once recovered data has been replayed.
+	replayed chan struct{}
+
 	userStateLock sync.Mutex
 	userState     map[string]*userState
 
@@ -76,6 +79,7 @@ type Ingester struct {
 	flushQueues []*util.PriorityQueue
 
 	ingestedSamples  prometheus.Counter
+	rejectedSamples  *prometheus.CounterVec
 	chunkUtilization prometheus.Histogram
 	chunkLength      prometheus.Histogram
 	chunkAge         prometheus.Histogram
@@ -93,7 +97,18 @@ type Config struct {
 	ConcurrentFlushes int
 	GRPCListenPort    int
 
+	// ID of this ingester in the ring.
+	ID   string
 	Ring *ring.Ring
+
+	// The ingester isn't ready until the ring's membership has been stable
+	// for this long.
+	MinReadyDuration time.Duration
+
+	// How to handle a sample with the same timestamp as the last one in its
+	// series but a different value: util.RejectDuplicates (the default if
+	// empty), util.KeepFirstDuplicate or util.KeepLastDuplicate.
+	DuplicatePolicy string
 }
 
 type userState struct {
@@ -134,11 +149,17 @@ func New(cfg Config, chunkStore cortex_chunk.Store) (*Ingester, error) {
 	if cfg.ConcurrentFlushes <= 0 {
 		cfg.ConcurrentFlushes = DefaultConcurrentFlush
 	}
+	if cfg.DuplicatePolicy != "" {
+		if err := util.ValidateDuplicatePolicy(cfg.DuplicatePolicy); err != nil {
+			return nil, err
+		}
+	}
 
 	i := &Ingester{
 		cfg:        cfg,
 		chunkStore: chunkStore,
 		quit:       make(chan struct{}),
+		replayed:   make(chan struct{}),
 
 		userState:   map[string]*userState{},
 		flushQueues: make([]*util.PriorityQueue, cfg.ConcurrentFlushes, cfg.ConcurrentFlushes),
@@ -147,6 +168,10 @@ func New(cfg Config, chunkStore cortex_chunk.Store) (*Ingester, error) {
 			Name: "cortex_ingester_ingested_samples_total",
 			Help: "The total number of samples ingested.",
 		}),
+		rejectedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingester_rejected_samples_total",
+			Help: "The total number of samples rejected, by reason (out_of_order or duplicate_timestamp).",
+		}, []string{"reason"}),
 		chunkUtilization: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "cortex_ingester_chunk_utilization",
 			Help:    "Distribution of stored chunk utilization (when stored).",
@@ -182,23 +207,49 @@ func New(cfg Config, chunkStore cortex_chunk.Store) (*Ingester, error) {
 		go i.flushLoop(j)
 	}
 
+	// There is nothing to replay yet.
+	close(i.replayed)
+
 	i.done.Add(1)
 	go i.loop()
 	return i, nil
 }
 
 // Ready is used to indicate to k8s when the ingesters are ready for
-// the addition / removal of another ingester.
+// the addition / removal of another ingester, and for traffic.
 func (i *Ingester) Ready() bool {
-	return i.cfg.Ring.Ready()
+	for _, stage := range i.readinessStages() {
+		if !stage.ready {
+			return false
+		}
+	}
+	return true
 }
 
-// Push implements cortex.IngesterServer
+// Push implements cortex.IngesterServer.  Samples out of order, or
+// duplicating the timestamp of the last sample in their series, don't stop
+// the rest of the request being appended; the error for the first of them
+// is returned afterwards.
 func (i *Ingester) Push(ctx context.Context, req *remote.WriteRequest) (*cortex.WriteResponse, error) {
+	var rejectErr error
 	for _, sample := range util.FromWriteRequest(req) {
-		if err := i.append(ctx, sample); err != nil {
+		err := i.append(ctx, sample)
+		switch err {
+		case nil:
+			continue
+		case ErrOutOfOrderSample:
+			i.rejectedSamples.WithLabelValues("out_of_order").Inc()
+		case ErrDuplicateSampleForTimestamp:
+			i.rejectedSamples.WithLabelValues("duplicate_timestamp").Inc()
+		default:
 			return nil, err
 		}
+		if rejectErr == nil {
+			rejectErr = err
+		}
+	}
+	if rejectErr != nil {
+		return nil, rejectErr
 	}
 	return &cortex.WriteResponse{}, nil
 }
@@ -233,7 +284,7 @@ func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
 	if err := series.add(model.SamplePair{
 		Value:     sample.Value,
 		Timestamp: sample.Timestamp,
-	}); err != nil {
+	}, i.cfg.DuplicatePolicy); err != nil {
 		return err
 	}
 
@@ -389,16 +440,54 @@ func (i *Ingester) MetricsForLabelMatchers(ctx context.Context, req *cortex.Metr
 	return util.ToMetricsForLabelMatchersResponse(result), nil
 }
 
-// UserStats returns ingestion statistics for the current user.
+// UserStats returns ingestion statistics for the current user, and how many
+// series it has in memory.  If the request asks for series stats, it also
+// walks those series, returning their counts by metric name, their chunks,
+// an estimate of the memory they take, and the range of time their samples
+// cover.
 func (i *Ingester) UserStats(ctx context.Context, req *cortex.UserStatsRequest) (*cortex.UserStatsResponse, error) {
 	state, err := i.getStateFor(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &cortex.UserStatsResponse{
+	resp := &cortex.UserStatsResponse{
 		IngestionRate: state.ingestedSamples.rate(),
-		NumSeries:     uint64(state.fpToSeries.length()),
-	}, nil
+	}
+	if !req.IncludeSeriesStats {
+		resp.NumSeries = uint64(state.fpToSeries.length())
+		return resp, nil
+	}
+
+	seriesByMetricName := map[model.LabelValue]uint64{}
+	oldest, newest := model.Latest, model.Earliest
+	for pair := range state.fpToSeries.iter() {
+		state.fpLocker.Lock(pair.fp)
+		series := pair.series
+		resp.NumSeries++
+		resp.NumChunks += uint64(len(series.chunkDescs))
+		resp.MemoryBytes += series.memoryBytes()
+		seriesByMetricName[series.metric[model.MetricNameLabel]]++
+		if len(series.chunkDescs) > 0 {
+			if first := series.firstTime(); first.Before(oldest) {
+				oldest = first
+			}
+			if last := series.head().LastTime; last.After(newest) {
+				newest = last
+			}
+		}
+		state.fpLocker.Unlock(pair.fp)
+	}
+	if oldest <= newest {
+		resp.OldestSampleMs = int64(oldest)
+		resp.NewestSampleMs = int64(newest)
+	}
+	for name, count := range seriesByMetricName {
+		resp.SeriesCountByMetricName = append(resp.SeriesCountByMetricName, &cortex.MetricSeriesCount{
+			MetricName: string(name),
+			NumSeries:  count,
+		})
+	}
+	return resp, nil
 }
 
 // Stop stops the Ingester.
@@ -496,6 +585,11 @@ func (i *Ingester) shouldFlushSeries(series *memorySeries, immediate bool) bool
 		return true
 	}
 
+	// Or if they have gone away, in which case no more samples are expected.
+	if len(series.chunkDescs) > 0 && series.isStale() {
+		return true
+	}
+
 	// Or if the only existing chunk need flushing
 	if len(series.chunkDescs) > 0 {
 		return i.shouldFlushChunk(series.chunkDescs[0])
@@ -558,7 +652,7 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 
 	// Assume we're going to flush everything, and maybe don't flush the head chunk if it doesn't need it.
 	chunks := series.chunkDescs
-	if immediate || (len(chunks) > 0 && i.shouldFlushChunk(series.head())) {
+	if immediate || (len(chunks) > 0 && (series.isStale() || i.shouldFlushChunk(series.head()))) {
 		series.closeHead()
 	} else {
 		chunks = chunks[:len(chunks)-1]
@@ -614,6 +708,7 @@ func (i *Ingester) Describe(ch chan<- *prometheus.Desc) {
 	ch <- memoryUsersDesc
 	ch <- flushQueueLengthDesc
 	ch <- i.ingestedSamples.Desc()
+	i.rejectedSamples.Describe(ch)
 	ch <- i.chunkUtilization.Desc()
 	ch <- i.chunkLength.Desc()
 	ch <- i.chunkAge.Desc()
@@ -653,6 +748,7 @@ func (i *Ingester) Collect(ch chan<- prometheus.Metric) {
 		float64(flushQueueLength),
 	)
 	ch <- i.ingestedSamples
+	i.rejectedSamples.Collect(ch)
 	ch <- i.chunkUtilization
 	ch <- i.chunkLength
 	ch <- i.chunkAge
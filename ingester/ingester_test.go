@@ -9,9 +9,11 @@ import (
 	"time"
 
 	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
 
+	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/user"
 	"github.com/weaveworks/cortex/util"
@@ -39,6 +41,22 @@ func (s *testStore) Get(ctx context.Context, from, through model.Time, matchers
 	return nil, nil
 }
 
+func (s *testStore) Delete(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) error {
+	return nil
+}
+
+func (s *testStore) Scan(ctx context.Context, from, through model.Time, callback func(chunk.Chunk) error) error {
+	return nil
+}
+
+func (s *testStore) LabelValues(ctx context.Context, from, through model.Time, labelName model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (s *testStore) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	return nil, nil
+}
+
 func (s *testStore) Stop() {}
 
 func buildTestMatrix(numSeries int, samplesPerSeries int, offset int) model.Matrix {
@@ -146,3 +164,164 @@ func TestIngesterAppend(t *testing.T) {
 		}
 	}
 }
+
+func TestIngesterStalenessMarker(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		MaxChunkAge:      99999 * time.Hour,
+	}
+	ing, err := New(cfg, &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ing.Stop()
+
+	ctx := user.WithID(context.Background(), "1")
+	m := model.Metric{model.MetricNameLabel: "foo"}
+	samples := []*model.Sample{
+		{Metric: m, Timestamp: 1, Value: 1},
+		{Metric: m, Timestamp: 2, Value: util.StaleNaN},
+	}
+	if _, err := ing.Push(ctx, util.ToWriteRequest(samples)); err != nil {
+		t.Fatal(err)
+	}
+	// Resending the marker is a no-op, but a different value isn't.
+	if _, err := ing.Push(ctx, util.ToWriteRequest(samples[1:])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ing.Push(ctx, util.ToWriteRequest([]*model.Sample{{Metric: m, Timestamp: 2, Value: 2}})); err != ErrDuplicateSampleForTimestamp {
+		t.Fatalf("expected ErrDuplicateSampleForTimestamp, got %v", err)
+	}
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ing.Query(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := util.FromQueryResponse(resp)
+	if len(res) != 1 || len(res[0].Values) != 2 || !util.IsStaleNaN(res[0].Values[1].Value) {
+		t.Fatalf("expected staleness marker to be stored, got %v", res)
+	}
+
+	// The series has gone away, so should be flushed without waiting for it
+	// to go idle.
+	state := ing.userState["1"]
+	series, ok := state.fpToSeries.get(m.FastFingerprint())
+	if !ok {
+		t.Fatal("series not found")
+	}
+	if !ing.shouldFlushSeries(series, false) {
+		t.Fatal("expected stale series to be flushed")
+	}
+}
+
+func TestIngesterRejectedSamples(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		MaxChunkAge:      99999 * time.Hour,
+	}
+	ing, err := New(cfg, &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ing.Stop()
+
+	ctx := user.WithID(context.Background(), "1")
+	foo := model.Metric{model.MetricNameLabel: "foo"}
+	bar := model.Metric{model.MetricNameLabel: "bar"}
+	if _, err := ing.Push(ctx, util.ToWriteRequest([]*model.Sample{{Metric: foo, Timestamp: 2, Value: 2}})); err != nil {
+		t.Fatal(err)
+	}
+
+	// An out of order sample fails the push, but doesn't stop the rest of it
+	// being appended.
+	samples := []*model.Sample{
+		{Metric: foo, Timestamp: 1, Value: 1},
+		{Metric: bar, Timestamp: 1, Value: 1},
+	}
+	if _, err := ing.Push(ctx, util.ToWriteRequest(samples)); err != ErrOutOfOrderSample {
+		t.Fatalf("expected ErrOutOfOrderSample, got %v", err)
+	}
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ing.Query(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := util.FromQueryResponse(resp); len(res) != 1 || len(res[0].Values) != 1 {
+		t.Fatalf("expected the valid sample to be appended, got %v", res)
+	}
+}
+
+func TestIngesterUserStats(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		MaxChunkAge:      99999 * time.Hour,
+	}
+	ing, err := New(cfg, &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ing.Stop()
+
+	ctx := user.WithID(context.Background(), "1")
+	samples := []*model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "i": "1"}, Timestamp: 10, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "i": "2"}, Timestamp: 20, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "bar"}, Timestamp: 30, Value: 1},
+	}
+	if _, err := ing.Push(ctx, util.ToWriteRequest(samples)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the number of series is returned unless series stats are asked
+	// for.
+	stats, err := ing.UserStats(ctx, &cortex.UserStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumSeries != 3 || stats.NumChunks != 0 || stats.SeriesCountByMetricName != nil {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	stats, err = ing.UserStats(ctx, &cortex.UserStatsRequest{IncludeSeriesStats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumSeries != 3 || stats.NumChunks != 3 || stats.MemoryBytes < 3*prom_chunk.ChunkLen {
+		t.Fatalf("unexpected series stats %v", stats)
+	}
+	if stats.OldestSampleMs != 10 || stats.NewestSampleMs != 30 {
+		t.Fatalf("expected samples from 10 to 30, got %d to %d", stats.OldestSampleMs, stats.NewestSampleMs)
+	}
+	counts := map[string]uint64{}
+	for _, c := range stats.SeriesCountByMetricName {
+		counts[c.MetricName] = c.NumSeries
+	}
+	if !reflect.DeepEqual(counts, map[string]uint64{"foo": 2, "bar": 1}) {
+		t.Fatalf("unexpected series counts by metric name %v", counts)
+	}
+}
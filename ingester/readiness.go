@@ -0,0 +1,59 @@
+package ingester
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weaveworks/cortex/ring"
+)
+
+// readinessStage is one of the conditions the ingester has to meet before it
+// is ready.
+type readinessStage struct {
+	name   string
+	ready  bool
+	reason string
+}
+
+// readinessStages returns the ingester's readiness stages, in the order they
+// are expected to be met:
+//
+//   - wal_replay: recovered data has been replayed.  There is no WAL yet, so
+//     this is met as soon as the ingester is created.
+//   - ring_join: this ingester is in the ring and ACTIVE.
+//   - ring_stable: all ingesters in the ring are ACTIVE and healthy, and its
+//     membership hasn't changed for MinReadyDuration, so tokens are not
+//     being transferred.
+func (i *Ingester) readinessStages() []readinessStage {
+	stages := []readinessStage{{name: "wal_replay"}}
+	select {
+	case <-i.replayed:
+		stages[0].ready = true
+	default:
+		stages[0].reason = "replaying"
+	}
+
+	if i.cfg.Ring == nil {
+		return stages
+	}
+
+	join := readinessStage{name: "ring_join"}
+	if state, ok := i.cfg.Ring.IngesterState(i.cfg.ID); !ok {
+		join.reason = fmt.Sprintf("%q not in ring", i.cfg.ID)
+	} else if state != ring.Active {
+		join.reason = fmt.Sprintf("state is %v", state)
+	} else {
+		join.ready = true
+	}
+
+	stable := readinessStage{name: "ring_stable"}
+	if !i.cfg.Ring.Ready() {
+		stable.reason = "not all ingesters are active and healthy"
+	} else if since := time.Now().Sub(i.cfg.Ring.LastChange()); since < i.cfg.MinReadyDuration {
+		stable.reason = fmt.Sprintf("ring changed %v ago", since)
+	} else {
+		stable.ready = true
+	}
+
+	return append(stages, join, stable)
+}
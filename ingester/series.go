@@ -7,6 +7,8 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
 )
 
 var discardedSamples = prometheus.NewCounterVec(
@@ -47,23 +49,43 @@ func newMemorySeries(m model.Metric) *memorySeries {
 	}
 }
 
-// add adds a sample pair to the series. It returns the number of newly
-// completed chunks (which are now eligible for persistence).
+// add adds a sample pair to the series. A sample before the last one is
+// rejected with ErrOutOfOrderSample, and one repeating it is ignored.  A
+// sample with the same timestamp as the last one but a different value is
+// handled according to duplicatePolicy, one of the util duplicate policies;
+// empty means reject.
 //
 // The caller must have locked the fingerprint of the series.
-func (s *memorySeries) add(v model.SamplePair) error {
+func (s *memorySeries) add(v model.SamplePair, duplicatePolicy string) error {
 	// Don't report "no-op appends", i.e. where timestamp and sample
 	// value are the same as for the last append, as they are a
 	// common occurrence when using client-side timestamps
-	// (e.g. Pushgateway or federation).
+	// (e.g. Pushgateway or federation).  Equal treats all NaNs as equal,
+	// so staleness markers are told apart from other NaNs explicitly.
 	if s.lastSampleValueSet &&
 		v.Timestamp == s.lastTime &&
-		v.Value.Equal(s.lastSampleValue) {
+		v.Value.Equal(s.lastSampleValue) &&
+		util.IsStaleNaN(v.Value) == util.IsStaleNaN(s.lastSampleValue) {
 		return nil
 	}
 	if v.Timestamp == s.lastTime {
-		discardedSamples.WithLabelValues(duplicateSample).Inc()
-		return ErrDuplicateSampleForTimestamp // Caused by the caller.
+		switch duplicatePolicy {
+		case util.KeepFirstDuplicate:
+			discardedSamples.WithLabelValues(duplicateSample).Inc()
+			return nil
+		case util.KeepLastDuplicate:
+			// The last sample can only be replaced while its chunk is open;
+			// otherwise it may already be flushed, so keep it.
+			replaced, err := s.replaceLast(v)
+			if err != nil || replaced {
+				return err
+			}
+			discardedSamples.WithLabelValues(duplicateSample).Inc()
+			return nil
+		default:
+			discardedSamples.WithLabelValues(duplicateSample).Inc()
+			return ErrDuplicateSampleForTimestamp // Caused by the caller.
+		}
 	}
 	if v.Timestamp < s.lastTime {
 		discardedSamples.WithLabelValues(outOfOrderTimestamp).Inc()
@@ -80,26 +102,82 @@ func (s *memorySeries) add(v model.SamplePair) error {
 	if err != nil {
 		return err
 	}
+	if err := s.replaceHead(chunks); err != nil {
+		return err
+	}
 
+	s.lastTime = v.Timestamp
+	s.lastSampleValue = v.Value
+	s.lastSampleValueSet = true
+	return nil
+}
+
+// replaceHead replaces the head chunk with the chunks resulting from adding
+// to it.
+func (s *memorySeries) replaceHead(chunks []chunk.Chunk) error {
 	// If we get a single chunk result, then just replace the head chunk with it
 	// (no need to update first/last time).  Otherwise, we'll need to update first
 	// and last time.
 	if len(chunks) == 1 {
 		s.head().C = chunks[0]
-	} else {
-		s.chunkDescs = s.chunkDescs[:len(s.chunkDescs)-1]
-		for _, c := range chunks {
-			lastTime, err := c.NewIterator().LastTimestamp()
-			if err != nil {
-				return err
-			}
-			s.chunkDescs = append(s.chunkDescs, newDesc(c, c.FirstTime(), lastTime))
+		return nil
+	}
+	s.chunkDescs = s.chunkDescs[:len(s.chunkDescs)-1]
+	for _, c := range chunks {
+		lastTime, err := c.NewIterator().LastTimestamp()
+		if err != nil {
+			return err
 		}
+		s.chunkDescs = append(s.chunkDescs, newDesc(c, c.FirstTime(), lastTime))
 	}
-
 	return nil
 }
 
+// replaceLast replaces the last sample in the series with v, which has the
+// same timestamp, by re-encoding the head chunk.  It returns false, without
+// changing anything, if the head chunk is closed.
+func (s *memorySeries) replaceLast(v model.SamplePair) (bool, error) {
+	if len(s.chunkDescs) == 0 || s.headChunkClosed {
+		return false, nil
+	}
+	head := s.head()
+	values, err := chunk.RangeValues(head.C.NewIterator(), metric.Interval{
+		OldestInclusive: head.FirstTime,
+		NewestInclusive: head.LastTime,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(values) == 0 || values[len(values)-1].Timestamp != v.Timestamp {
+		return false, nil
+	}
+	values[len(values)-1] = v
+
+	c, err := chunk.NewForEncoding(head.C.Encoding())
+	if err != nil {
+		return false, err
+	}
+	chunks := []chunk.Chunk{c}
+	for _, value := range values {
+		added, err := chunks[len(chunks)-1].Add(value)
+		if err != nil {
+			return false, err
+		}
+		chunks = append(chunks[:len(chunks)-1], added...)
+	}
+	if err := s.replaceHead(chunks); err != nil {
+		return false, err
+	}
+	s.lastSampleValue = v.Value
+	return true, nil
+}
+
+// isStale returns true if the last sample added to the series was a staleness
+// marker, meaning the series has gone away.
+func (s *memorySeries) isStale() bool {
+	return s.lastSampleValueSet && util.IsStaleNaN(s.lastSampleValue)
+}
+
 func (s *memorySeries) closeHead() {
 	s.headChunkClosed = true
 }
@@ -111,6 +189,21 @@ func (s *memorySeries) firstTime() model.Time {
 	return s.chunkDescs[0].FirstTime
 }
 
+// memoryBytes estimates the memory taken by the series' labels and in-memory
+// chunks. The caller must have locked the fingerprint of the memorySeries.
+func (s *memorySeries) memoryBytes() uint64 {
+	var bytes uint64
+	for name, value := range s.metric {
+		bytes += uint64(len(name) + len(value))
+	}
+	for _, d := range s.chunkDescs {
+		if d.C != nil {
+			bytes += chunk.ChunkLen
+		}
+	}
+	return bytes
+}
+
 // head returns a pointer to the head chunk descriptor. The caller must have
 // locked the fingerprint of the memorySeries. This method will panic if this
 // series has no chunk descriptors.
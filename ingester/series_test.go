@@ -0,0 +1,93 @@
+package ingester
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// add records the last sample appended, so out of order samples are
+// rejected, and resent ones ignored.  Until it did, these checks never
+// fired, and such samples were passed on to the chunk.
+func TestSeriesOrdering(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "foo"})
+	for _, tc := range []struct {
+		sample model.SamplePair
+		err    error
+	}{
+		{model.SamplePair{Timestamp: 1, Value: 1}, nil},
+		{model.SamplePair{Timestamp: 2, Value: 2}, nil},
+		{model.SamplePair{Timestamp: 2, Value: 2}, nil},
+		{model.SamplePair{Timestamp: 1, Value: 3}, ErrOutOfOrderSample},
+		{model.SamplePair{Timestamp: 2, Value: 3}, ErrDuplicateSampleForTimestamp},
+		{model.SamplePair{Timestamp: 3, Value: 3}, nil},
+	} {
+		if err := s.add(tc.sample, ""); err != tc.err {
+			t.Fatalf("%v: expected error %v, got %v", tc.sample, tc.err, err)
+		}
+	}
+	values, err := s.samplesForRange(model.Earliest, model.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}}
+	if !reflect.DeepEqual(want, values) {
+		t.Fatalf("expected %v, got %v", want, values)
+	}
+}
+
+func TestSeriesDuplicatePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		closed   bool
+		err      error
+		expected model.SampleValue
+	}{
+		{policy: "", err: ErrDuplicateSampleForTimestamp, expected: 1},
+		{policy: util.RejectDuplicates, err: ErrDuplicateSampleForTimestamp, expected: 1},
+		{policy: util.KeepFirstDuplicate, expected: 1},
+		{policy: util.KeepLastDuplicate, expected: 2},
+		// A closed head chunk may be being flushed, so can't be changed.
+		{policy: util.KeepLastDuplicate, closed: true, expected: 1},
+	} {
+		s := newMemorySeries(model.Metric{model.MetricNameLabel: "foo"})
+		for i := 0; i < 10; i++ {
+			if err := s.add(model.SamplePair{Timestamp: model.Time(i), Value: 0}, tc.policy); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.add(model.SamplePair{Timestamp: 10, Value: 1}, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+		if tc.closed {
+			s.closeHead()
+		}
+
+		if err := s.add(model.SamplePair{Timestamp: 10, Value: 2}, tc.policy); err != tc.err {
+			t.Fatalf("%q: expected error %v, got %v", tc.policy, tc.err, err)
+		}
+		values, err := s.samplesForRange(model.Earliest, model.Latest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 11 {
+			t.Fatalf("%q: expected 11 samples, got %v", tc.policy, values)
+		}
+		if last := values[len(values)-1]; last.Timestamp != 10 || last.Value != tc.expected {
+			t.Fatalf("%q: expected last sample to be %v, got %v", tc.policy, tc.expected, last)
+		}
+		for i, v := range values[:10] {
+			if v.Timestamp != model.Time(i) || v.Value != 0 {
+				t.Fatalf("%q: earlier samples changed: %v", tc.policy, values)
+			}
+		}
+
+		// Later samples are still appended after the replaced one.
+		if err := s.add(model.SamplePair{Timestamp: 11, Value: 3}, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
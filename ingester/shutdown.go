@@ -0,0 +1,105 @@
+package ingester
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// ShutdownStep is a step in shutting an ingester down safely, eg marking it
+// LEAVING in the ring, or flushing its chunks.
+type ShutdownStep struct {
+	Name string
+	Run  func()
+}
+
+// Shutdown runs an ingester's shutdown steps, in order, once, and reports
+// on their progress, so deployment tooling doing a rolling restart can wait
+// until the ingester's data is safe before deleting it, rather than waiting
+// for a timeout.  The steps run when Shutdown is POSTed to, or on Wait.
+type Shutdown struct {
+	steps []ShutdownStep
+	once  sync.Once
+	done  chan struct{}
+
+	mtx     sync.Mutex
+	step    string
+	started time.Time
+}
+
+// NewShutdown makes a new Shutdown running steps.
+func NewShutdown(steps ...ShutdownStep) *Shutdown {
+	return &Shutdown{
+		steps: steps,
+		done:  make(chan struct{}),
+		step:  "not started",
+	}
+}
+
+// Start starts the shutdown, if it hasn't already started, without waiting
+// for it.
+func (s *Shutdown) Start() {
+	s.once.Do(func() {
+		s.mtx.Lock()
+		s.started = time.Now()
+		s.mtx.Unlock()
+		go s.run()
+	})
+}
+
+// Wait starts the shutdown, if it hasn't already started, and waits for it
+// to finish.
+func (s *Shutdown) Wait() {
+	s.Start()
+	<-s.done
+}
+
+func (s *Shutdown) run() {
+	defer close(s.done)
+	for _, step := range s.steps {
+		s.setStep(step.Name)
+		log.Infof("Shutdown: %s", step.Name)
+		step.Run()
+	}
+	s.setStep("done")
+	log.Infof("Shutdown done after %v", time.Now().Sub(s.started))
+}
+
+func (s *Shutdown) setStep(step string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.step = step
+}
+
+// status returns the current step, and whether the shutdown is done.
+func (s *Shutdown) status() (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.done:
+		return s.step, true
+	default:
+	}
+	if s.started.IsZero() {
+		return s.step, false
+	}
+	return fmt.Sprintf("%s, shutting down for %v", s.step, time.Now().Sub(s.started)), false
+}
+
+// ServeHTTP starts the shutdown on POST.  For any method it then returns 204
+// once the shutdown is done, and 503 with the current step until then.
+func (s *Shutdown) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		s.Start()
+	}
+	step, done := s.status()
+	if done {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "shutdown: %s\n", step)
+}
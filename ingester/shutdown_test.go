@@ -0,0 +1,53 @@
+package ingester
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShutdown(t *testing.T) {
+	var (
+		steps   []string
+		leaving = make(chan struct{})
+		flushed = make(chan struct{})
+	)
+	shutdown := NewShutdown(
+		ShutdownStep{"leaving", func() {
+			steps = append(steps, "leaving")
+			<-leaving
+		}},
+		ShutdownStep{"flushing", func() {
+			steps = append(steps, "flushing")
+			<-flushed
+		}},
+	)
+
+	request := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		shutdown.ServeHTTP(w, httptest.NewRequest(method, "/shutdown", nil))
+		return w
+	}
+
+	// Getting the status doesn't start the shutdown.
+	if w := request("GET"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "not started") {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if w := request("POST"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	leaving <- struct{}{}
+	// The second step has started once the first has finished.
+	flushed <- struct{}{}
+
+	// Starting again, eg on SIGTERM after a POST, doesn't rerun the steps.
+	shutdown.Wait()
+	shutdown.Wait()
+	if w := request("POST"); w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if len(steps) != 2 || steps[0] != "leaving" || steps[1] != "flushing" {
+		t.Fatalf("unexpected steps %v", steps)
+	}
+}
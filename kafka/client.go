@@ -0,0 +1,219 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// ClientConfig configures connections to Kafka.  Brokers must run Kafka
+// 0.10 or later, for consumer groups and message timestamps.
+type ClientConfig struct {
+	// Addresses of the brokers to bootstrap from.
+	Brokers []string
+
+	// Identifies this process to the brokers, in their logs and quotas.
+	ClientID string
+
+	TLS util.TLSConfig
+}
+
+func (cfg ClientConfig) saramaConfig(c *sarama.Config) error {
+	c.Version = sarama.V0_10_0_0
+	if cfg.ClientID != "" {
+		c.ClientID = cfg.ClientID
+	}
+	tlsConfig, err := cfg.TLS.ClientConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tlsConfig
+	}
+	return nil
+}
+
+// SourceConfig configures a consumer group Source.
+type SourceConfig struct {
+	// The consumer group to join.  Each message is consumed by one member
+	// of the group, so consumers can be scaled by running more of them.
+	Group string
+
+	// The topics to consume.
+	Topics []string
+
+	// If set, a group with no committed offset for a partition starts from
+	// its oldest message rather than its newest.
+	FromOldest bool
+}
+
+// groupSource is a Source reading from a Kafka consumer group.
+type groupSource struct {
+	consumer *cluster.Consumer
+	messages chan *Message
+}
+
+// NewGroupSource joins a Kafka consumer group, returning a Source of the
+// messages of the partitions assigned to it.  Offsets marked are committed
+// periodically, and when the Source is closed.
+func NewGroupSource(clientCfg ClientConfig, cfg SourceConfig) (Source, error) {
+	if len(cfg.Topics) == 0 {
+		return nil, fmt.Errorf("no topics to consume")
+	}
+	config := cluster.NewConfig()
+	if err := clientCfg.saramaConfig(&config.Config); err != nil {
+		return nil, err
+	}
+	config.Consumer.Return.Errors = true
+	if cfg.FromOldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	consumer, err := cluster.NewConsumer(clientCfg.Brokers, cfg.Group, cfg.Topics, config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &groupSource{
+		consumer: consumer,
+		messages: make(chan *Message),
+	}
+	go s.loop()
+	go func() {
+		for err := range consumer.Errors() {
+			log.Warnf("Error consuming from Kafka: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// loop converts the consumer's messages, until it is closed.
+func (s *groupSource) loop() {
+	defer close(s.messages)
+	for m := range s.consumer.Messages() {
+		s.messages <- &Message{
+			Topic:     m.Topic,
+			Partition: m.Partition,
+			Offset:    m.Offset,
+			Key:       m.Key,
+			Value:     m.Value,
+		}
+	}
+}
+
+func (s *groupSource) Messages() <-chan *Message {
+	return s.messages
+}
+
+func (s *groupSource) MarkOffset(m *Message) {
+	s.consumer.MarkPartitionOffset(m.Topic, m.Partition, m.Offset, "")
+}
+
+// Close leaves the consumer group, committing the offsets marked.  Messages
+// not yet received from Messages are dropped, to be redelivered to the
+// group.
+func (s *groupSource) Close() error {
+	done := make(chan struct{})
+	go func() {
+		for range s.messages {
+		}
+		close(done)
+	}()
+	err := s.consumer.Close()
+	<-done
+	return err
+}
+
+// AsyncProducer is a Producer publishing to Kafka in the background.
+// Messages are queued in a buffer, from which they are forwarded to the
+// client, which batches and retries them; those which still fail are counted
+// as export failures.
+type AsyncProducer struct {
+	producer sarama.AsyncProducer
+	input    chan *sarama.ProducerMessage
+	done     chan struct{}
+
+	mtx    sync.RWMutex
+	closed bool
+}
+
+// NewAsyncProducer makes a new AsyncProducer, buffering up to bufferSize
+// messages.
+func NewAsyncProducer(clientCfg ClientConfig, bufferSize int) (*AsyncProducer, error) {
+	config := sarama.NewConfig()
+	if err := clientCfg.saramaConfig(config); err != nil {
+		return nil, err
+	}
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(clientCfg.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncProducer(producer, bufferSize), nil
+}
+
+func newAsyncProducer(producer sarama.AsyncProducer, bufferSize int) *AsyncProducer {
+	p := &AsyncProducer{
+		producer: producer,
+		input:    make(chan *sarama.ProducerMessage, bufferSize),
+		done:     make(chan struct{}),
+	}
+	errorsDone := make(chan struct{})
+	go func() {
+		defer close(errorsDone)
+		for err := range producer.Errors() {
+			log.Warnf("Error exporting samples to Kafka topic %s: %v", err.Msg.Topic, err.Err)
+			exportFailures.Inc()
+		}
+	}()
+	// The client's input channel is unbuffered, so messages are forwarded
+	// to it from our own buffer, which Produce never blocks on.
+	go func() {
+		defer close(p.done)
+		for m := range p.input {
+			producer.Input() <- m
+		}
+		producer.AsyncClose()
+		<-errorsDone
+	}()
+	return p
+}
+
+// Produce implements Producer.  If the producer's buffer is full, the
+// message is dropped, and counted, rather than holding up the push.
+func (p *AsyncProducer) Produce(topic string, key, value []byte) error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if p.closed {
+		return fmt.Errorf("producer closed")
+	}
+	select {
+	case p.input <- &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.ByteEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	}:
+		return nil
+	default:
+		exportDropped.Inc()
+		return fmt.Errorf("producer buffer full")
+	}
+}
+
+// Close flushes the messages buffered, and closes the producer.  Messages
+// produced afterwards are dropped.
+func (p *AsyncProducer) Close() error {
+	p.mtx.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.input)
+	}
+	p.mtx.Unlock()
+	<-p.done
+	return nil
+}
@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// blockingProducer is a sarama.AsyncProducer whose input is only read once
+// it is released.
+type blockingProducer struct {
+	input    chan *sarama.ProducerMessage
+	errors   chan *sarama.ProducerError
+	release  chan struct{}
+	received []*sarama.ProducerMessage
+	closed   chan struct{}
+}
+
+func newBlockingProducer() *blockingProducer {
+	p := &blockingProducer{
+		input:   make(chan *sarama.ProducerMessage),
+		errors:  make(chan *sarama.ProducerError),
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.closed)
+		defer close(p.errors)
+		<-p.release
+		for m := range p.input {
+			p.received = append(p.received, m)
+		}
+	}()
+	return p
+}
+
+func (p *blockingProducer) AsyncClose()                               { close(p.input) }
+func (p *blockingProducer) Close() error                              { p.AsyncClose(); return nil }
+func (p *blockingProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *blockingProducer) Successes() <-chan *sarama.ProducerMessage { return nil }
+func (p *blockingProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+func TestAsyncProducerBuffers(t *testing.T) {
+	fake := newBlockingProducer()
+	p := newAsyncProducer(fake, 2)
+
+	// One message is held by the forwarder, blocked on the client, and two
+	// more fill the buffer.
+	produced := 0
+	for i := 0; i < 10; i++ {
+		if err := p.Produce("topic", nil, []byte{byte(i)}); err == nil {
+			produced++
+		}
+	}
+	if produced < 2 || produced > 3 {
+		t.Fatalf("Expected the buffer to accept 2 or 3 messages, got %d", produced)
+	}
+
+	close(fake.release)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-fake.closed
+	if len(fake.received) != produced {
+		t.Fatalf("Expected %d messages to be flushed on close, got %d", produced, len(fake.received))
+	}
+	if err := p.Produce("topic", nil, nil); err == nil {
+		t.Fatal("Expected an error producing after close")
+	}
+}
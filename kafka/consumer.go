@@ -0,0 +1,211 @@
+// Package kafka implements a front-end which reads samples from Kafka and
+// pushes them through the distributor, decoupling producer spikes from
+// ingester capacity, and an exporter which publishes the samples the
+// distributor accepts to Kafka for downstream pipelines.
+//
+// The Consumer reads from a Source, such as a consumer group joined with
+// NewGroupSource, and the Exporter writes to a Producer, such as an
+// AsyncProducer.
+package kafka
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/storage/remote"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	messagesConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "kafka_messages_consumed_total",
+		Help:      "The total number of messages consumed from Kafka, by outcome.",
+	}, []string{"topic", "outcome"})
+	pushRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "kafka_push_retries_total",
+		Help:      "The total number of retried pushes of messages consumed from Kafka.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(messagesConsumed)
+	prometheus.MustRegister(pushRetries)
+}
+
+// Message is a message read from Kafka.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+}
+
+// Source is the interface to a Kafka consumer group.  Messages from a
+// partition must be delivered in order; MarkOffset is called once a message
+// has been pushed, after which it need not be redelivered.
+type Source interface {
+	Messages() <-chan *Message
+	MarkOffset(*Message)
+	Close() error
+}
+
+// Pusher is the interface to the distributor.
+type Pusher interface {
+	Push(context.Context, *remote.WriteRequest) (*cortex.WriteResponse, error)
+}
+
+// ParseTopicSettings parses per-topic settings of the form
+// "topic=value;topic=value".
+func ParseTopicSettings(s string) (map[string]string, error) {
+	settings := map[string]string{}
+	if s == "" {
+		return settings, nil
+	}
+	for _, setting := range strings.Split(s, ";") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid topic setting %q", setting)
+		}
+		settings[parts[0]] = parts[1]
+	}
+	return settings, nil
+}
+
+// Config configures a Consumer.
+type Config struct {
+	// The format of messages, per topic.  Topics not listed use
+	// DefaultFormat.
+	Formats       map[string]string
+	DefaultFormat string
+
+	// The tenant for each topic.  Messages on topics not listed here are
+	// for the tenant in their key (or the JSON message itself).
+	Tenants map[string]string
+
+	// How many times to retry pushing a message before dropping it.  If
+	// negative, retry forever, letting Kafka buffer the backlog.  Messages
+	// rejected as invalid or over a limit are dropped without retrying.
+	MaxRetries int
+}
+
+// Consumer reads messages from a Source and pushes them to a Pusher.
+type Consumer struct {
+	cfg    Config
+	source Source
+	pusher Pusher
+
+	quit chan struct{}
+	done sync.WaitGroup
+}
+
+// NewConsumer makes a new Consumer, and starts it consuming.
+func NewConsumer(cfg Config, source Source, pusher Pusher) *Consumer {
+	c := &Consumer{
+		cfg:    cfg,
+		source: source,
+		pusher: pusher,
+		quit:   make(chan struct{}),
+	}
+	c.done.Add(1)
+	go c.loop()
+	return c
+}
+
+// Stop stops the consumer and closes the source.
+func (c *Consumer) Stop() {
+	close(c.quit)
+	c.done.Wait()
+	if err := c.source.Close(); err != nil {
+		log.Warnf("Error closing Kafka source: %v", err)
+	}
+}
+
+func (c *Consumer) loop() {
+	defer c.done.Done()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case msg, ok := <-c.source.Messages():
+			if !ok {
+				return
+			}
+			if c.process(msg) {
+				c.source.MarkOffset(msg)
+			}
+		}
+	}
+}
+
+// process pushes a message, retrying with backoff.  It returns false if
+// the consumer was stopped before the message could be pushed, in which
+// case its offset shouldn't be marked.
+func (c *Consumer) process(msg *Message) bool {
+	format, ok := c.cfg.Formats[msg.Topic]
+	if !ok {
+		format = c.cfg.DefaultFormat
+	}
+	tenant, req, err := decode(format, msg.Value)
+	if err != nil {
+		log.Warnf("Dropping undecodable message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+		messagesConsumed.WithLabelValues(msg.Topic, "invalid").Inc()
+		return true
+	}
+	if t, ok := c.cfg.Tenants[msg.Topic]; ok {
+		tenant = t
+	} else if tenant == "" {
+		tenant = string(msg.Key)
+	}
+	if tenant == "" {
+		log.Warnf("Dropping message without a tenant at %s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+		messagesConsumed.WithLabelValues(msg.Topic, "invalid").Inc()
+		return true
+	}
+
+	ctx := user.WithID(context.Background(), tenant)
+	backoff := minBackoff
+	for tries := 0; ; tries++ {
+		_, err := c.pusher.Push(ctx, req)
+		if err == nil {
+			messagesConsumed.WithLabelValues(msg.Topic, "pushed").Inc()
+			return true
+		}
+		if !util.ErrorCodeOf(err).Retryable() {
+			log.Warnf("Dropping rejected message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			messagesConsumed.WithLabelValues(msg.Topic, "rejected").Inc()
+			return true
+		}
+		if c.cfg.MaxRetries >= 0 && tries >= c.cfg.MaxRetries {
+			log.Warnf("Dropping message at %s/%d/%d after %d tries: %v", msg.Topic, msg.Partition, msg.Offset, tries+1, err)
+			messagesConsumed.WithLabelValues(msg.Topic, "failed").Inc()
+			return true
+		}
+
+		pushRetries.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-c.quit:
+			return false
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
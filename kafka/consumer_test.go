@@ -0,0 +1,143 @@
+package kafka
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+type mockSource struct {
+	messages chan *Message
+	mtx      sync.Mutex
+	marked   []int64
+}
+
+func (s *mockSource) Messages() <-chan *Message { return s.messages }
+func (s *mockSource) Close() error              { return nil }
+func (s *mockSource) MarkOffset(m *Message) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.marked = append(s.marked, m.Offset)
+}
+
+type mockPusher struct {
+	failures int
+	err      error
+	mtx      sync.Mutex
+	pushed   map[string][]*model.Sample
+}
+
+func (p *mockPusher) Push(ctx context.Context, req *remote.WriteRequest) (*cortex.WriteResponse, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.failures > 0 {
+		p.failures--
+		return nil, fmt.Errorf("push failed")
+	}
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.pushed[userID] = append(p.pushed[userID], util.FromWriteRequest(req)...)
+	return &cortex.WriteResponse{}, nil
+}
+
+func TestConsumer(t *testing.T) {
+	sample := &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "foo", "bar": "baz"},
+		Timestamp: 1000,
+		Value:     1,
+	}
+	data, err := proto.Marshal(util.ToWriteRequest([]*model.Sample{sample}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &mockSource{messages: make(chan *Message, 10)}
+	pusher := &mockPusher{failures: 1, pushed: map[string][]*model.Sample{}}
+	source.messages <- &Message{Topic: "samples", Offset: 1, Key: []byte("1"), Value: snappy.Encode(nil, data)}
+	source.messages <- &Message{Topic: "json", Offset: 2, Value: []byte(`{"tenant": "2", "timeseries": [{"labels": {"__name__": "foo", "bar": "baz"}, "samples": [{"timestamp_ms": 1000, "value": 1}]}]}`)}
+	source.messages <- &Message{Topic: "json", Offset: 3, Value: []byte(`not json`)}
+	source.messages <- &Message{Topic: "fixed", Offset: 4, Key: []byte("1"), Value: snappy.Encode(nil, data)}
+	close(source.messages)
+
+	c := NewConsumer(Config{
+		Formats:       map[string]string{"json": FormatJSON},
+		DefaultFormat: FormatRemoteWrite,
+		Tenants:       map[string]string{"fixed": "3"},
+		MaxRetries:    -1,
+	}, source, pusher)
+	c.done.Wait()
+	c.Stop()
+
+	want := map[string][]*model.Sample{
+		"1": {sample},
+		"2": {sample},
+		"3": {sample},
+	}
+	if !reflect.DeepEqual(want, pusher.pushed) {
+		t.Fatalf("wrong samples pushed: %v", pusher.pushed)
+	}
+	if !reflect.DeepEqual([]int64{1, 2, 3, 4}, source.marked) {
+		t.Fatalf("wrong offsets marked: %v", source.marked)
+	}
+}
+
+func TestConsumerDropsRejected(t *testing.T) {
+	data, err := proto.Marshal(util.ToWriteRequest([]*model.Sample{{Metric: model.Metric{model.MetricNameLabel: "foo"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &mockSource{messages: make(chan *Message, 10)}
+	pusher := &mockPusher{err: util.NewError(util.ErrBadData, "bad data"), pushed: map[string][]*model.Sample{}}
+	source.messages <- &Message{Topic: "samples", Offset: 1, Key: []byte("1"), Value: snappy.Encode(nil, data)}
+	close(source.messages)
+
+	// Retrying forever, the consumer would never get past the message.
+	c := NewConsumer(Config{DefaultFormat: FormatRemoteWrite, MaxRetries: -1}, source, pusher)
+	c.done.Wait()
+	c.Stop()
+
+	if !reflect.DeepEqual([]int64{1}, source.marked) {
+		t.Fatalf("wrong offsets marked: %v", source.marked)
+	}
+}
+
+func TestParseTopicSettings(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want map[string]string
+		err  bool
+	}{
+		{"", map[string]string{}, false},
+		{"a=json", map[string]string{"a": FormatJSON}, false},
+		{"a=json;b=remote_write", map[string]string{"a": FormatJSON, "b": FormatRemoteWrite}, false},
+		{"a", nil, true},
+		{"a=", nil, true},
+		{"=json", nil, true},
+	} {
+		got, err := ParseTopicSettings(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%q: got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Supported message formats.
+const (
+	// FormatRemoteWrite is a snappy-compressed remote.WriteRequest, as sent
+	// by Prometheus' remote write.  Both the block and stream snappy formats
+	// are accepted.
+	FormatRemoteWrite = "remote_write"
+	// FormatJSON is a JSONMessage.
+	FormatJSON = "json"
+)
+
+// JSONMessage is the schema for JSON formatted messages:
+//
+//	{
+//	  "tenant": "1",
+//	  "timeseries": [
+//	    {
+//	      "labels": {"__name__": "up", "job": "foo"},
+//	      "samples": [{"timestamp_ms": 1483228800000, "value": 1}]
+//	    }
+//	  ]
+//	}
+//
+// The tenant is optional; if missing, the message key is used.
+type JSONMessage struct {
+	Tenant     string           `json:"tenant,omitempty"`
+	TimeSeries []JSONTimeSeries `json:"timeseries"`
+}
+
+// JSONTimeSeries is a series in a JSONMessage.
+type JSONTimeSeries struct {
+	Labels  model.Metric `json:"labels"`
+	Samples []JSONSample `json:"samples"`
+}
+
+// JSONSample is a sample in a JSONTimeSeries.
+type JSONSample struct {
+	TimestampMs int64   `json:"timestamp_ms"`
+	Value       float64 `json:"value"`
+}
+
+// decode decodes a message in the given format, returning the tenant it
+// names (if any) and the samples in it.
+func decode(format string, value []byte) (string, *remote.WriteRequest, error) {
+	switch format {
+	case FormatRemoteWrite:
+		req, err := decodeRemoteWrite(value)
+		return "", req, err
+	case FormatJSON:
+		return decodeJSON(value)
+	default:
+		return "", nil, fmt.Errorf("unknown message format %q", format)
+	}
+}
+
+func decodeRemoteWrite(value []byte) (*remote.WriteRequest, error) {
+	data, err := util.DecodeSnappy(value)
+	if err != nil {
+		return nil, err
+	}
+	var req remote.WriteRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func decodeJSON(value []byte) (string, *remote.WriteRequest, error) {
+	var msg JSONMessage
+	if err := json.Unmarshal(value, &msg); err != nil {
+		return "", nil, err
+	}
+	var samples []*model.Sample
+	for _, ts := range msg.TimeSeries {
+		if _, ok := ts.Labels[model.MetricNameLabel]; !ok {
+			return "", nil, fmt.Errorf("series without a metric name: %v", ts.Labels)
+		}
+		for _, s := range ts.Samples {
+			samples = append(samples, &model.Sample{
+				Metric:    ts.Labels,
+				Timestamp: model.Time(s.TimestampMs),
+				Value:     model.SampleValue(s.Value),
+			})
+		}
+	}
+	return msg.Tenant, util.ToWriteRequest(samples), nil
+}
@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	exportedSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "kafka_exported_samples_total",
+		Help:      "The total number of samples exported to Kafka.",
+	})
+	exportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "kafka_export_failures_total",
+		Help:      "The total number of batches of samples which could not be exported to Kafka.",
+	})
+	exportDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "kafka_export_dropped_total",
+		Help:      "The total number of batches of samples dropped because the Kafka producer's buffer was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(exportedSamples)
+	prometheus.MustRegister(exportFailures)
+	prometheus.MustRegister(exportDropped)
+}
+
+// Producer is the interface to a Kafka producer.  Produce must not block:
+// it should queue the message in a bounded buffer, returning an error if it
+// is full, for an asynchronous producer to batch and retry; see
+// AsyncProducer.
+type Producer interface {
+	Produce(topic string, key, value []byte) error
+}
+
+// ExporterConfig configures an Exporter.
+type ExporterConfig struct {
+	// Samples for each tenant are published to the topic TopicPrefix+tenant,
+	// keyed by tenant.
+	TopicPrefix string
+
+	// Metric selectors (eg `{job="foo"}`) for the series to export.  If
+	// empty, all series are exported.
+	Selectors []string
+
+	// The fraction of series to export, between 0 and 1.  Series are
+	// sampled by fingerprint, so either all or none of a series' samples
+	// are exported.  Zero means all series.
+	SampleRate float64
+}
+
+// Exporter publishes samples to Kafka, as remote.WriteRequest protobufs.
+// It implements distributor.SampleExporter.
+type Exporter struct {
+	cfg       ExporterConfig
+	producer  Producer
+	selectors []metric.LabelMatchers
+	threshold uint64
+}
+
+// NewExporter makes a new Exporter.
+func NewExporter(cfg ExporterConfig, producer Producer) (*Exporter, error) {
+	e := &Exporter{
+		cfg:      cfg,
+		producer: producer,
+	}
+	for _, s := range cfg.Selectors {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		e.selectors = append(e.selectors, matchers)
+	}
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		e.threshold = uint64(cfg.SampleRate * math.MaxUint64)
+	}
+	return e, nil
+}
+
+// Export implements distributor.SampleExporter.
+func (e *Exporter) Export(userID string, samples []*model.Sample) {
+	var selected []*model.Sample
+	for _, s := range samples {
+		if e.selected(s.Metric) {
+			selected = append(selected, s)
+		}
+	}
+	if len(selected) == 0 {
+		return
+	}
+
+	value, err := proto.Marshal(util.ToWriteRequest(selected))
+	if err != nil {
+		log.Errorf("Error marshalling samples for export: %v", err)
+		exportFailures.Inc()
+		return
+	}
+	if err := e.producer.Produce(e.cfg.TopicPrefix+userID, []byte(userID), value); err != nil {
+		log.Warnf("Error exporting samples for %s: %v", userID, err)
+		exportFailures.Inc()
+		return
+	}
+	exportedSamples.Add(float64(len(selected)))
+}
+
+func (e *Exporter) selected(m model.Metric) bool {
+	if e.threshold > 0 && uint64(m.Fingerprint()) >= e.threshold {
+		return false
+	}
+	if len(e.selectors) == 0 {
+		return true
+	}
+	for _, matchers := range e.selectors {
+		if matchAll(matchers, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAll(matchers metric.LabelMatchers, m model.Metric) bool {
+	for _, matcher := range matchers {
+		if !matcher.Match(m[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+type mockProducer struct {
+	messages map[string][]*model.Sample
+}
+
+func (p *mockProducer) Produce(topic string, key, value []byte) error {
+	var req remote.WriteRequest
+	if err := proto.Unmarshal(value, &req); err != nil {
+		return err
+	}
+	p.messages[topic] = append(p.messages[topic], util.FromWriteRequest(&req)...)
+	return nil
+}
+
+func TestExporter(t *testing.T) {
+	foo := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "foo", "job": "a"}, Timestamp: 1, Value: 1}
+	bar := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "bar", "job": "b"}, Timestamp: 1, Value: 1}
+
+	for _, tc := range []struct {
+		cfg  ExporterConfig
+		want map[string][]*model.Sample
+	}{
+		{
+			ExporterConfig{TopicPrefix: "cortex-"},
+			map[string][]*model.Sample{"cortex-1": {foo, bar}},
+		},
+		{
+			ExporterConfig{TopicPrefix: "cortex-", Selectors: []string{`{job="b"}`}},
+			map[string][]*model.Sample{"cortex-1": {bar}},
+		},
+		{
+			ExporterConfig{TopicPrefix: "cortex-", SampleRate: 0.0000001},
+			map[string][]*model.Sample{},
+		},
+	} {
+		producer := &mockProducer{messages: map[string][]*model.Sample{}}
+		exporter, err := NewExporter(tc.cfg, producer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter.Export("1", []*model.Sample{foo, bar})
+		if !reflect.DeepEqual(tc.want, producer.messages) {
+			t.Errorf("%+v: wrong samples exported: %v", tc.cfg, producer.messages)
+		}
+	}
+
+	if _, err := NewExporter(ExporterConfig{Selectors: []string{`{`}}, nil); err == nil {
+		t.Error("expected error for invalid selector")
+	}
+}
@@ -0,0 +1,72 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// CardinalityResponse is the response to a cardinality request.
+type CardinalityResponse struct {
+	Metric model.LabelValue `json:"metric"`
+	Series uint64           `json:"series"`
+}
+
+// CardinalityHandler estimates the number of series for a metric from the
+// index, without fetching any chunks.  Takes the "metric" parameter, and
+// optional "start" and "end" parameters (defaulting to the last hour).
+func CardinalityHandler(counter chunk.SeriesCounter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+		if abort {
+			return
+		}
+
+		metricName := model.LabelValue(r.FormValue("metric"))
+		if metricName == "" {
+			http.Error(w, "missing metric parameter", http.StatusBadRequest)
+			return
+		}
+		through, err := parseTime(r.FormValue("end"), model.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(r.FormValue("start"), through.Add(-time.Hour))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		series, err := counter.SeriesCount(ctx, from, through, metricName)
+		if err != nil {
+			util.WriteError(w, err)
+			return
+		}
+		util.WriteJSONResponse(w, CardinalityResponse{
+			Metric: metricName,
+			Series: series,
+		})
+	})
+}
+
+// parseTime parses a time as Unix seconds or RFC3339, as the Prometheus API
+// does.
+func parseTime(s string, def model.Time) (model.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		return model.TimeFromUnixNano(int64(t * float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return model.TimeFromUnixNano(t.UnixNano()), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
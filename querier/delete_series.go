@@ -0,0 +1,58 @@
+package querier
+
+import (
+	"net/http"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// DeleteSeriesHandler is like Prometheus's /api/v1/admin/tsdb/delete_series:
+// it deletes a tenant's samples of the series matching the match[] selectors
+// between start and end, which default to all time, from the chunk store.
+// Samples still in the ingesters aren't deleted, so will reappear once they
+// are flushed.
+func DeleteSeriesHandler(store chunk.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+		if abort {
+			return
+		}
+		r.ParseForm()
+		if len(r.Form["match[]"]) == 0 {
+			respondError(w, util.NewError(util.ErrBadData, "no match[] parameter provided"))
+			return
+		}
+		from, err := parseTime(r.FormValue("start"), model.Earliest)
+		if err != nil {
+			respondError(w, util.Error{Code: util.ErrBadData, Err: err})
+			return
+		}
+		through, err := parseTime(r.FormValue("end"), model.Latest)
+		if err != nil {
+			respondError(w, util.Error{Code: util.ErrBadData, Err: err})
+			return
+		}
+		var matcherSets []metric.LabelMatchers
+		for _, s := range r.Form["match[]"] {
+			matchers, err := promql.ParseMetricSelector(s)
+			if err != nil {
+				respondError(w, util.Error{Code: util.ErrBadData, Err: err})
+				return
+			}
+			matcherSets = append(matcherSets, matchers)
+		}
+
+		for _, matchers := range matcherSets {
+			if err := store.Delete(ctx, from, through, matchers...); err != nil {
+				respondError(w, err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
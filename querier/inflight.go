@@ -0,0 +1,197 @@
+package querier
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+var queriesKilled = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_queries_killed_total",
+	Help:      "Number of in-flight queries cancelled through the kill endpoint.",
+})
+
+func init() {
+	prometheus.MustRegister(queriesKilled)
+}
+
+// InflightQuery describes a query being served.
+type InflightQuery struct {
+	ID    string    `json:"id"`
+	Path  string    `json:"path"`
+	Query string    `json:"query,omitempty"`
+	Start time.Time `json:"start"`
+
+	// Bytes of chunks and samples loaded so far.
+	MemoryBytes int64 `json:"memory_bytes"`
+
+	cancel context.CancelFunc
+	memory *queryMemory
+}
+
+// InflightQueries tracks the queries being served for each user, by request
+// ID, so they can be listed and killed, and accounts the memory they use.
+type InflightQueries struct {
+	limits MemoryLimits
+
+	mtx     sync.Mutex
+	queries map[string]map[string]*InflightQuery
+	memory  map[string]*tenantMemory
+}
+
+// NewInflightQueries makes a new InflightQueries.
+func NewInflightQueries(limits MemoryLimits) *InflightQueries {
+	return &InflightQueries{
+		limits:  limits,
+		queries: map[string]map[string]*InflightQuery{},
+		memory:  map[string]*tenantMemory{},
+	}
+}
+
+// Wrap implements middleware.Interface.  Requests are served with a context
+// which is cancelled if the query is killed, and which accounts the memory
+// the query uses against the limits.  Requests without a user ID are passed
+// through untracked.
+func (q *InflightQueries) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get(user.UserIDHeaderName)
+		if userID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		requestID := util.GetRequestID(ctx)
+		if requestID == "" {
+			requestID = util.NewRequestID()
+			ctx = util.WithRequestID(ctx, requestID)
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		query := &InflightQuery{
+			ID:     requestID,
+			Path:   r.URL.Path,
+			Query:  r.FormValue("query"),
+			Start:  time.Now(),
+			cancel: cancel,
+		}
+		q.add(userID, query)
+		defer q.remove(userID, query)
+
+		next.ServeHTTP(w, r.WithContext(withQueryMemory(ctx, query.memory)))
+	})
+}
+
+func (q *InflightQueries) add(userID string, query *InflightQuery) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	queries, ok := q.queries[userID]
+	if !ok {
+		queries = map[string]*InflightQuery{}
+		q.queries[userID] = queries
+	}
+	queries[query.ID] = query
+
+	tenant, ok := q.memory[userID]
+	if !ok {
+		tenant = &tenantMemory{}
+		q.memory[userID] = tenant
+	}
+	tenant.queries++
+	query.memory = &queryMemory{limits: q.limits, tenant: tenant}
+}
+
+func (q *InflightQueries) remove(userID string, query *InflightQuery) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	queries := q.queries[userID]
+	// A client may reuse a request ID, so only remove our own entry.
+	if queries[query.ID] == query {
+		delete(queries, query.ID)
+	}
+	if len(queries) == 0 {
+		delete(q.queries, userID)
+	}
+
+	query.memory.release()
+	tenant := query.memory.tenant
+	tenant.queries--
+	if tenant.queries == 0 {
+		delete(q.memory, userID)
+	}
+}
+
+// List returns the user's in-flight queries, oldest first.
+func (q *InflightQueries) List(userID string) []InflightQuery {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	result := make([]InflightQuery, 0, len(q.queries[userID]))
+	for _, query := range q.queries[userID] {
+		listed := *query
+		listed.MemoryBytes = atomic.LoadInt64(&query.memory.used)
+		result = append(result, listed)
+	}
+	sort.Sort(byStart(result))
+	return result
+}
+
+// Kill cancels the user's query with the given request ID.  It returns false
+// if there is no such query.
+func (q *InflightQueries) Kill(userID, requestID string) bool {
+	q.mtx.Lock()
+	query, ok := q.queries[userID][requestID]
+	q.mtx.Unlock()
+	if !ok {
+		return false
+	}
+	query.cancel()
+	queriesKilled.Inc()
+	log.Infof("Killed query %s for user %s: %s", requestID, userID, query.Query)
+	return true
+}
+
+// RegisterHandlers registers the endpoints for listing the user's in-flight
+// queries (GET /queries) and killing one of them (DELETE /queries/{id}).
+func (q *InflightQueries) RegisterHandlers(router *mux.Router) {
+	router.Path("/queries").Methods("GET").Handler(http.HandlerFunc(q.listHandler))
+	router.Path("/queries/{id}").Methods("DELETE").Handler(http.HandlerFunc(q.killHandler))
+}
+
+func (q *InflightQueries) listHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get(user.UserIDHeaderName)
+	if userID == "" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	util.WriteJSONResponse(w, q.List(userID))
+}
+
+func (q *InflightQueries) killHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get(user.UserIDHeaderName)
+	if userID == "" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	if !q.Kill(userID, mux.Vars(r)["id"]) {
+		http.Error(w, "no such query", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type byStart []InflightQuery
+
+func (q byStart) Len() int           { return len(q) }
+func (q byStart) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q byStart) Less(i, j int) bool { return q[i].Start.Before(q[j].Start) }
@@ -0,0 +1,72 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestInflightQueriesKill(t *testing.T) {
+	inflight := NewInflightQueries(MemoryLimits{})
+	router := mux.NewRouter()
+	inflight.RegisterHandlers(router)
+
+	started := make(chan struct{})
+	done := make(chan error)
+	query := inflight.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		done <- r.Context().Err()
+	}))
+
+	req, _ := http.NewRequest("GET", "/api/v1/query?query=up", nil)
+	req.Header.Set(user.UserIDHeaderName, "1")
+	req = req.WithContext(util.WithRequestID(req.Context(), "abc"))
+	go query.ServeHTTP(httptest.NewRecorder(), req)
+	<-started
+
+	// Another user can neither see nor kill the query.
+	if queries := list(t, router, "2"); len(queries) != 0 {
+		t.Fatalf("user 2 sees queries: %v", queries)
+	}
+	if code := kill(router, "2", "abc"); code != http.StatusNotFound {
+		t.Fatalf("killing another user's query: got %d", code)
+	}
+
+	queries := list(t, router, "1")
+	if len(queries) != 1 || queries[0].ID != "abc" || queries[0].Query != "up" {
+		t.Fatalf("unexpected queries: %v", queries)
+	}
+	if code := kill(router, "1", "abc"); code != http.StatusNoContent {
+		t.Fatalf("killing query: got %d", code)
+	}
+	if err := <-done; err == nil {
+		t.Fatalf("query context not cancelled")
+	}
+}
+
+func list(t *testing.T, router http.Handler, userID string) []InflightQuery {
+	req, _ := http.NewRequest("GET", "/queries", nil)
+	req.Header.Set(user.UserIDHeaderName, userID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var queries []InflightQuery
+	if err := json.NewDecoder(w.Body).Decode(&queries); err != nil {
+		t.Fatal(err)
+	}
+	return queries
+}
+
+func kill(router http.Handler, userID, requestID string) int {
+	req, _ := http.NewRequest("DELETE", "/queries/"+requestID, nil)
+	req.Header.Set(user.UserIDHeaderName, userID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
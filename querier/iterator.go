@@ -5,6 +5,8 @@ import (
 
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
 )
 
 // This is a struct and not just a renamed type because otherwise the Metric
@@ -26,7 +28,9 @@ func (it sampleStreamIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePa
 	i := sort.Search(len(it.ss.Values), func(n int) bool {
 		return it.ss.Values[n].Timestamp.After(ts)
 	})
-	if i == 0 {
+	// A staleness marker means the series has gone away, so there is no value
+	// at ts, however recent the sample before the marker is.
+	if i == 0 || util.IsStaleNaN(it.ss.Values[i-1].Value) {
 		return model.SamplePair{Timestamp: model.Earliest}
 	}
 	return it.ss.Values[i-1]
@@ -45,7 +49,21 @@ func (it sampleStreamIterator) RangeValues(in metric.Interval) []model.SamplePai
 		return nil
 	}
 
-	return it.ss.Values[start:end]
+	// Staleness markers aren't values, so are left out of ranges.
+	values := it.ss.Values[start:end]
+	for i, v := range values {
+		if util.IsStaleNaN(v.Value) {
+			result := make([]model.SamplePair, i, len(values))
+			copy(result, values[:i])
+			for _, v := range values[i+1:] {
+				if !util.IsStaleNaN(v.Value) {
+					result = append(result, v)
+				}
+			}
+			return result
+		}
+	}
+	return values
 }
 
 func (it sampleStreamIterator) Close() {}
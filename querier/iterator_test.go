@@ -0,0 +1,53 @@
+package querier
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestIteratorStalenessMarkers(t *testing.T) {
+	it := sampleStreamIterator{
+		ss: &model.SampleStream{
+			Values: []model.SamplePair{
+				{Timestamp: 1000, Value: 1},
+				{Timestamp: 2000, Value: 2},
+				{Timestamp: 3000, Value: util.StaleNaN},
+				{Timestamp: 5000, Value: 5},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		ts   model.Time
+		want model.SamplePair
+	}{
+		{500, model.SamplePair{Timestamp: model.Earliest}},
+		{2500, model.SamplePair{Timestamp: 2000, Value: 2}},
+		// The series went away at 3000, so has no value until it comes back.
+		{3000, model.SamplePair{Timestamp: model.Earliest}},
+		{4000, model.SamplePair{Timestamp: model.Earliest}},
+		{5000, model.SamplePair{Timestamp: 5000, Value: 5}},
+	} {
+		if have := it.ValueAtOrBeforeTime(tc.ts); !reflect.DeepEqual(tc.want, have) {
+			t.Errorf("ValueAtOrBeforeTime(%v): want %v, have %v", tc.ts, tc.want, have)
+		}
+	}
+
+	for _, tc := range []struct {
+		in   metric.Interval
+		want []model.SamplePair
+	}{
+		{metric.Interval{OldestInclusive: 0, NewestInclusive: 2000}, []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}},
+		{metric.Interval{OldestInclusive: 0, NewestInclusive: 6000}, []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}, {Timestamp: 5000, Value: 5}}},
+		{metric.Interval{OldestInclusive: 2500, NewestInclusive: 4000}, []model.SamplePair{}},
+	} {
+		if have := it.RangeValues(tc.in); !reflect.DeepEqual(tc.want, have) {
+			t.Errorf("RangeValues(%v): want %v, have %v", tc.in, tc.want, have)
+		}
+	}
+}
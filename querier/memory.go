@@ -0,0 +1,111 @@
+package querier
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Approximate in-memory size of a sample.
+const sampleBytes = 16
+
+var (
+	queryMemoryBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "querier_query_memory_bytes",
+		Help:      "Bytes of chunks and samples loaded by each query.",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 4, 8),
+	})
+	memoryLimitExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "querier_memory_limit_exceeded_total",
+		Help:      "Number of queries aborted for exceeding a memory limit, by limit.",
+	}, []string{"limit"})
+)
+
+func init() {
+	prometheus.MustRegister(queryMemoryBytes)
+	prometheus.MustRegister(memoryLimitExceeded)
+}
+
+// MemoryLimits bound the bytes of chunks and samples queries may load.  Zero
+// means unlimited.
+type MemoryLimits struct {
+	MaxQueryBytes  int64
+	MaxTenantBytes int64
+}
+
+type memoryKey int
+
+const queryMemoryKey memoryKey = 0
+
+// tenantMemory is the memory used by a tenant's in-flight queries.
+type tenantMemory struct {
+	used    int64 // Accessed atomically.
+	queries int   // Protected by InflightQueries.mtx.
+}
+
+// queryMemory is the memory used by a query.  Memory is never released
+// while the query runs, as loaded chunks and samples are generally
+// referenced until it completes.
+type queryMemory struct {
+	limits MemoryLimits
+	used   int64 // Accessed atomically.
+	tenant *tenantMemory
+}
+
+func (m *queryMemory) reserve(bytes int64) error {
+	used := atomic.AddInt64(&m.used, bytes)
+	tenantUsed := atomic.AddInt64(&m.tenant.used, bytes)
+	if m.limits.MaxQueryBytes > 0 && used > m.limits.MaxQueryBytes {
+		memoryLimitExceeded.WithLabelValues("query").Inc()
+		return util.NewError(util.ErrLimitExceeded, "query exceeded the per-query memory limit of %d bytes; query a shorter range or fewer series", m.limits.MaxQueryBytes)
+	}
+	if m.limits.MaxTenantBytes > 0 && tenantUsed > m.limits.MaxTenantBytes {
+		memoryLimitExceeded.WithLabelValues("tenant").Inc()
+		return util.NewError(util.ErrLimitExceeded, "queries exceeded the per-tenant memory limit of %d bytes; retry when fewer queries are running", m.limits.MaxTenantBytes)
+	}
+	return nil
+}
+
+// release returns the query's memory to its tenant, once it has completed.
+func (m *queryMemory) release() {
+	used := atomic.LoadInt64(&m.used)
+	atomic.AddInt64(&m.tenant.used, -used)
+	queryMemoryBytes.Observe(float64(used))
+}
+
+func withQueryMemory(ctx context.Context, m *queryMemory) context.Context {
+	return context.WithValue(ctx, queryMemoryKey, m)
+}
+
+// reserveMemory accounts bytes to the query in the context, returning an
+// error if a limit is exceeded.  Queries served outside of
+// InflightQueries.Wrap, eg by the ruler, are not limited.
+func reserveMemory(ctx context.Context, bytes int64) error {
+	m, ok := ctx.Value(queryMemoryKey).(*queryMemory)
+	if !ok {
+		return nil
+	}
+	return m.reserve(bytes)
+}
+
+func chunksBytes(numChunks int) int64 {
+	return int64(numChunks) * prom_chunk.ChunkLen
+}
+
+func matrixBytes(matrix model.Matrix) int64 {
+	var bytes int64
+	for _, ss := range matrix {
+		bytes += int64(len(ss.Values)) * sampleBytes
+		for name, value := range ss.Metric {
+			bytes += int64(len(name) + len(value))
+		}
+	}
+	return bytes
+}
@@ -0,0 +1,90 @@
+package querier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+type matrixQuerier model.Matrix
+
+func (q matrixQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	return model.Matrix(q), nil
+}
+
+func (q matrixQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q matrixQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
+
+func TestQueryMemoryLimits(t *testing.T) {
+	// Two series of 10 samples each, with 9 bytes of labels: 338 bytes.
+	matrix := model.Matrix{}
+	for _, value := range []model.LabelValue{"a", "b"} {
+		matrix = append(matrix, &model.SampleStream{
+			Metric: model.Metric{model.MetricNameLabel: value},
+			Values: make([]model.SamplePair, 10),
+		})
+	}
+	querier := MergeQuerier{Queriers: []Querier{matrixQuerier(matrix)}}
+
+	for _, tc := range []struct {
+		limits  MemoryLimits
+		running int64 // Bytes already used by another of the tenant's queries.
+		ok      bool
+	}{
+		{MemoryLimits{}, 0, true},
+		{MemoryLimits{MaxQueryBytes: 400}, 0, true},
+		{MemoryLimits{MaxQueryBytes: 300}, 0, false},
+		{MemoryLimits{MaxTenantBytes: 400}, 0, true},
+		{MemoryLimits{MaxTenantBytes: 400}, 100, false},
+	} {
+		inflight := NewInflightQueries(tc.limits)
+		router := mux.NewRouter()
+		inflight.RegisterHandlers(router)
+
+		// Hold another query open, having used some memory.
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		go inflight.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reserveMemory(r.Context(), tc.running)
+			close(started)
+			<-release
+		})).ServeHTTP(httptest.NewRecorder(), newQueryRequest("other"))
+		<-started
+
+		var err error
+		inflight.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err = querier.QueryRange(r.Context(), 0, 0)
+		})).ServeHTTP(httptest.NewRecorder(), newQueryRequest("query"))
+		if tc.ok && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc, err)
+		} else if !tc.ok && util.ErrorCodeOf(err) != util.ErrLimitExceeded {
+			t.Errorf("%+v: expected limit exceeded, got %v", tc, err)
+		}
+
+		// Completed queries release their memory.
+		queries := list(t, router, "1")
+		if len(queries) != 1 || queries[0].MemoryBytes != tc.running {
+			t.Errorf("%+v: unexpected queries: %+v", tc, queries)
+		}
+	}
+}
+
+func newQueryRequest(requestID string) *http.Request {
+	req, _ := http.NewRequest("GET", "/api/v1/query_range", nil)
+	req.Header.Set(user.UserIDHeaderName, "1")
+	return req.WithContext(util.WithRequestID(req.Context(), requestID))
+}
@@ -0,0 +1,82 @@
+package querier
+
+import (
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// A Middleware wraps a Querier, to add behaviour such as limits, caching,
+// sharding or logging to the queries it serves, without the Querier or
+// other middleware knowing about it.
+type Middleware interface {
+	Wrap(Querier) Querier
+}
+
+// MiddlewareFunc is to Middleware as http.HandlerFunc is to http.Handler.
+type MiddlewareFunc func(Querier) Querier
+
+// Wrap implements Middleware.
+func (f MiddlewareFunc) Wrap(next Querier) Querier {
+	return f(next)
+}
+
+// MergeMiddleware produces a Middleware that applies several in turn, the
+// first outermost; ie MergeMiddleware(f, g).Wrap(q) == f.Wrap(g.Wrap(q)).
+func MergeMiddleware(middleware ...Middleware) Middleware {
+	return MiddlewareFunc(func(next Querier) Querier {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			next = middleware[i].Wrap(next)
+		}
+		return next
+	})
+}
+
+// MaxQueryLength is a Middleware rejecting queries over time ranges longer
+// than max.
+func MaxQueryLength(max time.Duration) Middleware {
+	return MiddlewareFunc(func(next Querier) Querier {
+		return maxQueryLength{next, max}
+	})
+}
+
+type maxQueryLength struct {
+	Querier
+	max time.Duration
+}
+
+func (q maxQueryLength) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	if length := to.Sub(from); length > q.max {
+		return nil, util.NewError(util.ErrLimitExceeded, "query length %v is longer than the limit of %v", length, q.max)
+	}
+	return q.Querier.Query(ctx, from, to, matchers...)
+}
+
+// LogSlowQueries is a Middleware logging queries which take longer than
+// threshold.
+func LogSlowQueries(threshold time.Duration) Middleware {
+	return MiddlewareFunc(func(next Querier) Querier {
+		return slowQueryLogger{next, threshold}
+	})
+}
+
+type slowQueryLogger struct {
+	Querier
+	threshold time.Duration
+}
+
+func (q slowQueryLogger) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	start := time.Now()
+	matrix, err := q.Querier.Query(ctx, from, to, matchers...)
+	if took := time.Since(start); took > q.threshold {
+		userID, _ := user.GetID(ctx)
+		log.Warnf("Slow query for user %s took %v: %v from %v to %v, %d series, err: %v", userID, took, matchers, from, to, len(matrix), err)
+	}
+	return matrix, err
+}
@@ -0,0 +1,53 @@
+package querier
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// tracingQuerier records the name of each middleware a query passes through.
+type tracingQuerier struct {
+	Querier
+	name  string
+	trace *[]string
+}
+
+func (q tracingQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	*q.trace = append(*q.trace, q.name)
+	return q.Querier.Query(ctx, from, to, matchers...)
+}
+
+func TestMergeMiddleware(t *testing.T) {
+	var trace []string
+	tracing := func(name string) Middleware {
+		return MiddlewareFunc(func(next Querier) Querier {
+			return tracingQuerier{next, name, &trace}
+		})
+	}
+
+	q := MergeMiddleware(tracing("a"), tracing("b"), MaxQueryLength(time.Hour), tracing("c")).Wrap(matrixQuerier{})
+	now := model.Now()
+	if _, err := q.Query(context.Background(), now.Add(-time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(trace, expected) {
+		t.Fatalf("expected %v, got %v", expected, trace)
+	}
+
+	// Queries which are too long stop at the limit.
+	trace = nil
+	_, err := q.Query(context.Background(), now.Add(-2*time.Hour), now)
+	if util.ErrorCodeOf(err) != util.ErrLimitExceeded {
+		t.Fatalf("expected a limit exceeded error, got %v", err)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(trace, expected) {
+		t.Fatalf("expected %v, got %v", expected, trace)
+	}
+}
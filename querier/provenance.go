@@ -0,0 +1,267 @@
+package querier
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+)
+
+// Where a query's samples came from, as reported by ProvenanceHandler.
+const (
+	chunkStoreSource = "chunk store"
+	ingestersSource  = "ingesters"
+)
+
+type provenanceKey int
+
+const queryProvenanceKey provenanceKey = 0
+
+// SourceProvenance describes what a query read for a series from one source.
+type SourceProvenance struct {
+	Source  string `json:"source"`
+	Samples int    `json:"samples"`
+
+	// The chunks read, and the index buckets they were found in, for the
+	// chunk store only.
+	Chunks  int      `json:"chunks,omitempty"`
+	Buckets []string `json:"buckets,omitempty"`
+}
+
+// SeriesProvenance describes where a query's samples for a series came from.
+type SeriesProvenance struct {
+	Metric  model.Metric       `json:"metric"`
+	Sources []SourceProvenance `json:"sources"`
+}
+
+// queryProvenance collects the provenance of the series read by a query.
+// The query's selectors may be evaluated concurrently, and may read the
+// same series more than once, so what they read is added up.
+type queryProvenance struct {
+	mtx    sync.Mutex
+	series map[model.Fingerprint]*SeriesProvenance
+}
+
+func (p *queryProvenance) add(m model.Metric, source SourceProvenance) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	fp := m.Fingerprint()
+	series, ok := p.series[fp]
+	if !ok {
+		series = &SeriesProvenance{Metric: m}
+		p.series[fp] = series
+	}
+	for i := range series.Sources {
+		existing := &series.Sources[i]
+		if existing.Source == source.Source {
+			existing.Samples += source.Samples
+			existing.Chunks += source.Chunks
+			existing.Buckets = uniqueStrings(append(existing.Buckets, source.Buckets...))
+			return
+		}
+	}
+	source.Buckets = uniqueStrings(source.Buckets)
+	series.Sources = append(series.Sources, source)
+}
+
+func (p *queryProvenance) list() []*SeriesProvenance {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	result := make([]*SeriesProvenance, 0, len(p.series))
+	for _, series := range p.series {
+		result = append(result, series)
+	}
+	sort.Sort(byProvenanceMetric(result))
+	return result
+}
+
+// annotate adds the provenance to a Prometheus query API response: to each
+// series in the result read as it is, and, as PromQL functions and
+// aggregations change series' labels, as a list of every series read.
+// Responses without a result are returned as they are.
+func (p *queryProvenance) annotate(body []byte) ([]byte, error) {
+	var resp, data map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(resp["data"], &data); err != nil || data["result"] == nil {
+		return body, nil
+	}
+
+	p.mtx.Lock()
+	var results []map[string]json.RawMessage
+	// Scalar and string results have no series.
+	if err := json.Unmarshal(data["result"], &results); err == nil {
+		for _, result := range results {
+			var m model.Metric
+			if err := json.Unmarshal(result["metric"], &m); err != nil {
+				p.mtx.Unlock()
+				return nil, err
+			}
+			if series, ok := p.series[m.Fingerprint()]; ok {
+				if result["provenance"], err = json.Marshal(series.Sources); err != nil {
+					p.mtx.Unlock()
+					return nil, err
+				}
+			}
+		}
+		if data["result"], err = json.Marshal(results); err != nil {
+			p.mtx.Unlock()
+			return nil, err
+		}
+	}
+	p.mtx.Unlock()
+
+	var err error
+	if data["provenance"], err = json.Marshal(p.list()); err != nil {
+		return nil, err
+	}
+	if resp["data"], err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// ProvenanceHandler wraps the Prometheus query API, so queries with the
+// debug=provenance parameter report where the samples of each series came
+// from: the ingesters or the chunk store, and for the chunk store how many
+// chunks were read and the index buckets they were found in.  It is for
+// diagnosing gaps and duplicates in query results.
+func ProvenanceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("debug") != "provenance" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p := &queryProvenance{series: map[model.Fingerprint]*SeriesProvenance{}}
+		buffered := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(buffered, r.WithContext(context.WithValue(r.Context(), queryProvenanceKey, p)))
+
+		body := buffered.body.Bytes()
+		if buffered.code == http.StatusOK {
+			if annotated, err := p.annotate(body); err != nil {
+				log.Warnf("Error annotating query response with provenance: %v", err)
+			} else {
+				body = annotated
+			}
+		}
+		for name, values := range buffered.header {
+			w.Header()[name] = values
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buffered.code)
+		w.Write(body)
+	})
+}
+
+// bufferedResponseWriter holds a response so it can be rewritten.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+// provenanceRecorder is a Querier recording the series it returns as coming
+// from source, for queries served by ProvenanceHandler.
+type provenanceRecorder struct {
+	Querier
+	source string
+}
+
+func (q provenanceRecorder) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	matrix, err := q.Querier.Query(ctx, from, to, matchers...)
+	if p, ok := ctx.Value(queryProvenanceKey).(*queryProvenance); ok && err == nil {
+		for _, ss := range matrix {
+			p.add(ss.Metric, SourceProvenance{Source: q.source, Samples: len(ss.Values)})
+		}
+	}
+	return matrix, err
+}
+
+// recordChunkProvenance records the chunks a ChunkQuerier read for a query,
+// and the samples they held, for queries served by ProvenanceHandler.
+// Series whose chunks held no samples in the query's range are recorded
+// too, as they may explain gaps.
+func recordChunkProvenance(ctx context.Context, store chunk.Store, from, to model.Time, chunks []chunk.Chunk, matrix model.Matrix) {
+	p, ok := ctx.Value(queryProvenanceKey).(*queryProvenance)
+	if !ok {
+		return
+	}
+	bucketer, _ := store.(chunk.IndexBucketer)
+
+	metrics := map[model.Fingerprint]model.Metric{}
+	sources := map[model.Fingerprint]*SourceProvenance{}
+	for _, c := range chunks {
+		fp := c.Metric.Fingerprint()
+		source, ok := sources[fp]
+		if !ok {
+			source = &SourceProvenance{Source: chunkStoreSource}
+			sources[fp] = source
+			metrics[fp] = c.Metric
+		}
+		source.Chunks++
+		if bucketer != nil {
+			// Chunks are only looked up in the buckets the query covers.
+			chunkFrom, chunkThrough := c.From, c.Through
+			if chunkFrom < from {
+				chunkFrom = from
+			}
+			if chunkThrough > to {
+				chunkThrough = to
+			}
+			source.Buckets = append(source.Buckets, bucketer.IndexBuckets(chunkFrom, chunkThrough)...)
+		}
+	}
+	for _, ss := range matrix {
+		if source, ok := sources[ss.Metric.Fingerprint()]; ok {
+			source.Samples += len(ss.Values)
+		}
+	}
+	for fp, source := range sources {
+		p.add(metrics[fp], *source)
+	}
+}
+
+// uniqueStrings sorts ss and removes duplicates, in place.
+func uniqueStrings(ss []string) []string {
+	if len(ss) == 0 {
+		return ss
+	}
+	sort.Strings(ss)
+	result := ss[:1]
+	for _, s := range ss[1:] {
+		if s != result[len(result)-1] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+type byProvenanceMetric []*SeriesProvenance
+
+func (ps byProvenanceMetric) Len() int      { return len(ps) }
+func (ps byProvenanceMetric) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byProvenanceMetric) Less(i, j int) bool {
+	return ps[i].Metric.String() < ps[j].Metric.String()
+}
@@ -0,0 +1,120 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestProvenanceHandler(t *testing.T) {
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	store := chunk.NewAWSStore(chunk.StoreConfig{
+		S3:         chunk.NewMemoryObjectClient(),
+		BucketName: "chunks",
+		DynamoDB:   chunk.NewMemoryIndexClient(),
+		TableName:  "index",
+	})
+	flushed := model.Metric{model.MetricNameLabel: "foo", "job": "a"}
+	if _, err := chunk.Backfill(ctx, store, []*model.Sample{
+		{Metric: flushed, Timestamp: now.Add(-2 * time.Minute), Value: 1},
+		{Metric: flushed, Timestamp: now.Add(-time.Minute), Value: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ingested := model.Metric{model.MetricNameLabel: "foo", "job": "b"}
+	queriers := NewQueryable(matrixQuerier{
+		{Metric: ingested, Values: []model.SamplePair{{Timestamp: now, Value: 3}}},
+		{Metric: flushed, Values: []model.SamplePair{{Timestamp: now, Value: 3}}},
+	}, store, "").Q.(MergeQuerier).Queriers
+
+	// Serve the results of the queriers as the query API would.
+	handler := ProvenanceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := user.WithID(r.Context(), "0")
+		matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result model.Matrix
+		for _, q := range queriers {
+			matrix, err := q.Query(ctx, now.Add(-time.Hour), now, matcher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, matrix[0])
+		}
+		util.WriteJSONResponse(w, map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "matrix",
+				"result":     result,
+			},
+		})
+	}))
+
+	type response struct {
+		Data struct {
+			Result []struct {
+				Metric     model.Metric
+				Provenance []SourceProvenance
+			}
+			Provenance []SeriesProvenance
+		}
+	}
+	query := func(url string) response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", url, w.Code)
+		}
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Without the debug parameter, nothing is added.
+	resp := query("/api/v1/query_range")
+	if len(resp.Data.Result) != 2 || resp.Data.Result[0].Provenance != nil || resp.Data.Provenance != nil {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	resp = query("/api/v1/query_range?debug=provenance")
+	buckets := store.IndexBuckets(now.Add(-2*time.Minute), now.Add(-time.Minute))
+	fromChunks := []SourceProvenance{
+		{Source: chunkStoreSource, Samples: 2, Chunks: 1, Buckets: buckets},
+		{Source: ingestersSource, Samples: 1},
+	}
+	fromIngesters := []SourceProvenance{{Source: ingestersSource, Samples: 1}}
+	if len(resp.Data.Result) != 2 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	for _, result := range resp.Data.Result {
+		expected := fromIngesters
+		if result.Metric.Equal(flushed) {
+			expected = fromChunks
+		}
+		if !reflect.DeepEqual(result.Provenance, expected) {
+			t.Fatalf("%v: expected %+v, got %+v", result.Metric, expected, result.Provenance)
+		}
+	}
+	expected := []SeriesProvenance{
+		{Metric: flushed, Sources: fromChunks},
+		{Metric: ingested, Sources: fromIngesters},
+	}
+	if !reflect.DeepEqual(resp.Data.Provenance, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, resp.Data.Provenance)
+	}
+}
@@ -13,16 +13,29 @@ import (
 	"github.com/weaveworks/cortex/util"
 )
 
-// NewQueryable creates a new promql.Engine for cortex.
-func NewQueryable(distributor Querier, chunkStore chunk.Store) Queryable {
+// How far back ChunkQuerier looks for label values.  Series older than this
+// are unlikely to be of interest to eg Grafana template variables, and
+// looking further back would read more of the index.
+const labelValuesLookback = 24 * time.Hour
+
+// NewQueryable creates a new promql.Engine for cortex.  Samples with the same
+// timestamp but different values are resolved with duplicatePolicy, one of
+// the util duplicate policies, taking flushed chunks as earlier than samples
+// still in the ingesters.  Queries to the chunk store and the ingesters are
+// each passed through middleware, in order, and record what they read for
+// ProvenanceHandler.
+func NewQueryable(distributor Querier, chunkStore chunk.Store, duplicatePolicy string, middleware ...Middleware) Queryable {
+	wrap := MergeMiddleware(middleware...)
 	return Queryable{
 		Q: MergeQuerier{
 			Queriers: []Querier{
-				distributor,
-				&ChunkQuerier{
-					Store: chunkStore,
-				},
+				wrap.Wrap(&ChunkQuerier{
+					Store:           chunkStore,
+					DuplicatePolicy: duplicatePolicy,
+				}),
+				wrap.Wrap(provenanceRecorder{distributor, ingestersSource}),
 			},
+			DuplicatePolicy: duplicatePolicy,
 		},
 	}
 }
@@ -38,29 +51,97 @@ type Querier interface {
 // A ChunkQuerier is a Querier that fetches samples from a ChunkStore.
 type ChunkQuerier struct {
 	Store chunk.Store
+
+	// How to resolve samples with the same timestamp in overlapping chunks;
+	// see chunk.ChunksToMatrixWithPolicy.
+	DuplicatePolicy string
 }
 
 // Query implements Querier and transforms a list of chunks into sample
 // matrices.
 func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	// If the store can look chunks up without fetching them, reserve the
+	// memory for them first, so queries that would use too much fail before
+	// paying for the fetches.
+	if lazy, ok := q.Store.(chunk.LazyStore); ok {
+		refs, err := lazy.GetChunkRefs(ctx, from, to, matchers...)
+		if err != nil {
+			return nil, err
+		}
+		if err := reserveMemory(ctx, chunksBytes(len(refs))); err != nil {
+			return nil, err
+		}
+		chunks, err := lazy.FetchChunks(ctx, from, to, refs)
+		if err != nil {
+			return nil, err
+		}
+		return q.chunksToMatrix(ctx, from, to, chunks)
+	}
+
 	// Get chunks for all matching series from ChunkStore.
 	chunks, err := q.Store.Get(ctx, from, to, matchers...)
 	if err != nil {
 		return nil, err
 	}
 
-	return chunk.ChunksToMatrix(chunks)
+	if err := reserveMemory(ctx, chunksBytes(len(chunks))); err != nil {
+		return nil, err
+	}
+	return q.chunksToMatrix(ctx, from, to, chunks)
+}
+
+func (q *ChunkQuerier) chunksToMatrix(ctx context.Context, from, to model.Time, chunks []chunk.Chunk) (model.Matrix, error) {
+	matrix, err := chunk.ChunksToMatrixWithPolicy(chunks, q.DuplicatePolicy)
+	if err != nil {
+		return nil, err
+	}
+	recordChunkProvenance(ctx, q.Store, from, to, chunks, matrix)
+	return matrix, nil
 }
 
 // LabelValuesForLabelName returns all of the label values that are associated with a given label name.
+// Only chunks from the last labelValuesLookback are considered, as the
+// request has no time range.
 func (q *ChunkQuerier) LabelValuesForLabelName(ctx context.Context, ln model.LabelName) (model.LabelValues, error) {
-	// TODO: Support querying historical label values at some point?
-	return nil, nil
+	now := model.Now()
+	return q.Store.LabelValues(ctx, now.Add(-labelValuesLookback), now, ln)
 }
 
-// MetricsForLabelMatchers is a noop for chunk querier.
+// MetricsForLabelMatchers returns the series matching any of the matcher
+// sets, if the store can list them from its index, without fetching chunks.
+// Matcher sets without a metric name, which the index can't serve, find
+// nothing, as do stores which can't list series.
 func (q *ChunkQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
-	return nil, nil
+	store, ok := q.Store.(chunk.SeriesStore)
+	if !ok {
+		return nil, nil
+	}
+
+	var result []metric.Metric
+	for _, matchers := range matcherSets {
+		if !hasMetricName(matchers) {
+			continue
+		}
+		ms, err := store.MetricsForLabelMatchers(ctx, from, through, matchers...)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ms {
+			result = append(result, metric.Metric{Metric: m})
+		}
+	}
+	return result, nil
+}
+
+// hasMetricName returns whether matchers have an equality matcher on the
+// metric name.
+func hasMetricName(matchers metric.LabelMatchers) bool {
+	for _, matcher := range matchers {
+		if matcher.Name == model.MetricNameLabel && matcher.Type == metric.Equal {
+			return true
+		}
+	}
+	return false
 }
 
 // Queryable is an adapter between Prometheus' Queryable and Querier.
@@ -77,51 +158,66 @@ func (q Queryable) Querier() (local.Querier, error) {
 // cortex.Queriers for the same query.
 type MergeQuerier struct {
 	Queriers []Querier
+
+	// How to resolve samples with the same timestamp but different values
+	// from different Queriers, taking earlier Queriers' samples as having
+	// come first.  Empty keeps the first.
+	DuplicatePolicy string
 }
 
 // QueryRange fetches series for a given time range and label matchers from multiple
 // promql.Queriers and returns the merged results as a map of series iterators.
 func (qm MergeQuerier) QueryRange(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
 	// Fetch samples from all queriers in parallel
-	matrices := make(chan model.Matrix)
-	errors := make(chan error)
-	for _, q := range qm.Queriers {
-		go func(q Querier) {
+	type queryResult struct {
+		index  int
+		matrix model.Matrix
+		err    error
+	}
+	results := make(chan queryResult)
+	for i, q := range qm.Queriers {
+		go func(i int, q Querier) {
 			matrix, err := q.Query(ctx, from, to, matchers...)
-			if err != nil {
-				errors <- err
-			} else {
-				matrices <- matrix
-			}
-		}(q)
+			results <- queryResult{i, matrix, err}
+		}(i, q)
 	}
 
-	// Group them by fingerprint (unsorted and with overlap).
-	fpToIt := map[model.Fingerprint]local.SeriesIterator{}
+	matrices := make([]model.Matrix, len(qm.Queriers))
 	var lastErr error
-	for i := 0; i < len(qm.Queriers); i++ {
-		select {
-		case err := <-errors:
+	for range qm.Queriers {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		if err := reserveMemory(ctx, matrixBytes(res.matrix)); err != nil {
 			lastErr = err
-
-		case matrix := <-matrices:
-			for _, ss := range matrix {
-				fp := ss.Metric.Fingerprint()
-				if it, ok := fpToIt[fp]; !ok {
-					fpToIt[fp] = sampleStreamIterator{
-						ss: ss,
-					}
-				} else {
-					ssIt := it.(sampleStreamIterator)
-					ssIt.ss.Values = util.MergeSamples(ssIt.ss.Values, ss.Values)
-				}
-			}
+			continue
 		}
+		matrices[res.index] = res.matrix
 	}
 	if lastErr != nil {
 		return nil, lastErr
 	}
 
+	// Group them by fingerprint (unsorted and with overlap), merging in the
+	// order of the queriers so duplicates are resolved the same way every
+	// time.
+	fpToIt := map[model.Fingerprint]local.SeriesIterator{}
+	for _, matrix := range matrices {
+		for _, ss := range matrix {
+			fp := ss.Metric.Fingerprint()
+			if it, ok := fpToIt[fp]; !ok {
+				fpToIt[fp] = sampleStreamIterator{
+					ss: ss,
+				}
+			} else {
+				ssIt := it.(sampleStreamIterator)
+				ssIt.ss.Values = util.MergeSamplesWithPolicy(ssIt.ss.Values, ss.Values, qm.DuplicatePolicy)
+			}
+		}
+	}
+
 	iterators := make([]local.SeriesIterator, 0, len(fpToIt))
 	for _, it := range fpToIt {
 		iterators = append(iterators, it)
@@ -141,7 +237,8 @@ func (qm MergeQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenes
 // MetricsForLabelMatchers Implements local.Querier.
 func (qm MergeQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
 	// NB we don't do this in parallel, as in practice we only have 2 queriers,
-	// one of which is the chunk store which doesn't implement this.
+	// one of which is the chunk store, which only implements this for
+	// recent index schemas.
 
 	metrics := map[model.Fingerprint]metric.Metric{}
 	for _, q := range qm.Queriers {
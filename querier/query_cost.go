@@ -0,0 +1,41 @@
+package querier
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// QueryCostHandler estimates the cost of querying a time range from the
+// bucket index, before running the query.  Takes optional "start" and "end"
+// parameters (defaulting to the last hour).
+func QueryCostHandler(estimator chunk.QueryCostEstimator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+		if abort {
+			return
+		}
+
+		through, err := parseTime(r.FormValue("end"), model.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(r.FormValue("start"), through.Add(-time.Hour))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cost, err := estimator.EstimateQueryCost(ctx, from, through)
+		if err != nil {
+			util.WriteError(w, err)
+			return
+		}
+		util.WriteJSONResponse(w, cost)
+	})
+}
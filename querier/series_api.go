@@ -0,0 +1,192 @@
+package querier
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// SeriesAPI implements the Prometheus /api/v1/series and label values
+// endpoints, limiting how many results are returned at once, as some tenants
+// have too many series for a single response.  Clients page through larger
+// results with the "limit" and "cursor" parameters: each page's response
+// holds the cursor for the next, if there is one.  Pages are cut from the
+// full, sorted result, so each request costs as much as an unpaginated one,
+// but responses stay bounded.
+type SeriesAPI struct {
+	querier    local.Querier
+	maxResults int
+}
+
+// NewSeriesAPI makes a new SeriesAPI.  If maxResults is non-zero, requests
+// without a limit fail if they match more results than it, and no page holds
+// more than it.
+func NewSeriesAPI(querier local.Querier, maxResults int) *SeriesAPI {
+	return &SeriesAPI{
+		querier:    querier,
+		maxResults: maxResults,
+	}
+}
+
+// Register registers the endpoints.  It must be called before any handler
+// for the /api/v1 prefix is registered.
+func (a *SeriesAPI) Register(router *mux.Router) {
+	router.Path("/api/v1/series").Methods("GET", "POST").Handler(http.HandlerFunc(a.series))
+	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(http.HandlerFunc(a.labelValues))
+}
+
+type pageResponse struct {
+	Status     string      `json:"status"`
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+func (a *SeriesAPI) series(w http.ResponseWriter, r *http.Request) {
+	ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+	if abort {
+		return
+	}
+	r.ParseForm()
+	if len(r.Form["match[]"]) == 0 {
+		respondError(w, util.NewError(util.ErrBadData, "no match[] parameter provided"))
+		return
+	}
+	from, err := parseTime(r.FormValue("start"), model.Earliest)
+	if err != nil {
+		respondError(w, util.Error{Code: util.ErrBadData, Err: err})
+		return
+	}
+	through, err := parseTime(r.FormValue("end"), model.Latest)
+	if err != nil {
+		respondError(w, util.Error{Code: util.ErrBadData, Err: err})
+		return
+	}
+	var matcherSets []metric.LabelMatchers
+	for _, s := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			respondError(w, util.Error{Code: util.ErrBadData, Err: err})
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	metrics, err := a.querier.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	// Series are paged in the order of their string forms, which are unique.
+	keyed := make(map[string]model.Metric, len(metrics))
+	keys := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		key := m.Metric.String()
+		if _, ok := keyed[key]; !ok {
+			keys = append(keys, key)
+		}
+		keyed[key] = m.Metric
+	}
+	sort.Strings(keys)
+
+	start, end, next, err := a.page(r, keys)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	data := make([]model.Metric, 0, end-start)
+	for _, key := range keys[start:end] {
+		data = append(data, keyed[key])
+	}
+	util.WriteJSONResponse(w, pageResponse{
+		Status:     "success",
+		Data:       data,
+		NextCursor: next,
+	})
+}
+
+func (a *SeriesAPI) labelValues(w http.ResponseWriter, r *http.Request) {
+	ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+	if abort {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if !model.LabelNameRE.MatchString(name) {
+		respondError(w, util.NewError(util.ErrBadData, "invalid label name: %q", name))
+		return
+	}
+
+	values, err := a.querier.LabelValuesForLabelName(ctx, model.LabelName(name))
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for _, v := range values {
+		keys = append(keys, string(v))
+	}
+	sort.Strings(keys)
+
+	start, end, next, err := a.page(r, keys)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	data := make(model.LabelValues, 0, end-start)
+	for _, key := range keys[start:end] {
+		data = append(data, model.LabelValue(key))
+	}
+	util.WriteJSONResponse(w, pageResponse{
+		Status:     "success",
+		Data:       data,
+		NextCursor: next,
+	})
+}
+
+// page returns the range of the sorted keys to respond to a request with,
+// following its "limit" and "cursor" parameters, and the cursor for the next
+// page, if any.
+func (a *SeriesAPI) page(r *http.Request, keys []string) (int, int, string, error) {
+	limit := 0
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, "", util.NewError(util.ErrBadData, "invalid limit %q", s)
+		}
+	}
+	if limit == 0 && a.maxResults > 0 && len(keys) > a.maxResults {
+		return 0, 0, "", util.NewError(util.ErrLimitExceeded, "%d results exceed the limit of %d; use the limit and cursor parameters to page through them", len(keys), a.maxResults)
+	}
+	if limit == 0 || (a.maxResults > 0 && limit > a.maxResults) {
+		limit = a.maxResults
+	}
+
+	start := 0
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return 0, 0, "", util.NewError(util.ErrBadData, "invalid cursor %q", cursor)
+		}
+		start = sort.SearchStrings(keys, string(after))
+		if start < len(keys) && keys[start] == string(after) {
+			start++
+		}
+	}
+	end := len(keys)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	next := ""
+	if end < len(keys) {
+		next = base64.RawURLEncoding.EncodeToString([]byte(keys[end-1]))
+	}
+	return start, end, next, nil
+}
@@ -0,0 +1,103 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// seriesQuerier is a Querier returning the same series for every request.
+type seriesQuerier []model.Metric
+
+func (q seriesQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	return nil, nil
+}
+
+func (q seriesQuerier) LabelValuesForLabelName(_ context.Context, name model.LabelName) (model.LabelValues, error) {
+	values := model.LabelValues{}
+	for _, m := range q {
+		values = append(values, m[name])
+	}
+	return values, nil
+}
+
+func (q seriesQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	metrics := []metric.Metric{}
+	for _, m := range q {
+		metrics = append(metrics, metric.Metric{Metric: m})
+	}
+	return metrics, nil
+}
+
+func TestSeriesAPIPagination(t *testing.T) {
+	series := seriesQuerier{}
+	for i := 4; i >= 0; i-- {
+		series = append(series, model.Metric{model.MetricNameLabel: "foo", "i": model.LabelValue(fmt.Sprint(i))})
+	}
+	router := mux.NewRouter()
+	NewSeriesAPI(MergeQuerier{Queriers: []Querier{series}}, 3).Register(router)
+
+	get := func(path string, params url.Values) (int, pageResponse, []string) {
+		req := httptest.NewRequest("GET", path+"?"+params.Encode(), nil)
+		req.Header.Set(user.UserIDHeaderName, "1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp struct {
+			pageResponse
+			Data []json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		data := []string{}
+		for _, d := range resp.Data {
+			data = append(data, string(d))
+		}
+		return w.Code, resp.pageResponse, data
+	}
+
+	for _, path := range []string{"/api/v1/series", "/api/v1/label/i/values"} {
+		params := url.Values{"match[]": {"foo"}}
+		if code, _, _ := get(path, params); code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected result over the limit to fail, got %d", path, code)
+		}
+
+		params.Set("limit", "2")
+		var pages [][]string
+		for {
+			code, resp, data := get(path, params)
+			if code != http.StatusOK {
+				t.Fatalf("%s: unexpected status %d", path, code)
+			}
+			pages = append(pages, data)
+			if resp.NextCursor == "" {
+				break
+			}
+			params.Set("cursor", resp.NextCursor)
+		}
+		if len(pages) != 3 || len(pages[0]) != 2 || len(pages[1]) != 2 || len(pages[2]) != 1 {
+			t.Fatalf("%s: unexpected pages %v", path, pages)
+		}
+		if path == "/api/v1/label/i/values" {
+			expected := [][]string{{`"0"`, `"1"`}, {`"2"`, `"3"`}, {`"4"`}}
+			if !reflect.DeepEqual(pages, expected) {
+				t.Fatalf("%s: expected %v, got %v", path, expected, pages)
+			}
+		}
+
+		params.Set("limit", "10")
+		params.Del("cursor")
+		if _, resp, data := get(path, params); len(data) != 3 || resp.NextCursor == "" {
+			t.Errorf("%s: expected limit to be capped, got %v, %q", path, data, resp.NextCursor)
+		}
+	}
+}
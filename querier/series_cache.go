@@ -0,0 +1,196 @@
+package querier
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+var seriesCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_series_cache_requests_total",
+	Help:      "Windows of queries' time ranges, by whether the series cache had their series: hit or miss.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(seriesCacheRequests)
+}
+
+// SeriesCacheConfig configures SeriesCache.
+type SeriesCacheConfig struct {
+	// Queries' time ranges are cached in windows of this length, aligned to
+	// multiples of it.
+	Window time.Duration
+
+	// How long a window's series are kept.
+	TTL time.Duration
+
+	// Only windows ending at least this long ago are cached, as samples may
+	// still arrive for more recent times.
+	MinAge time.Duration
+
+	// The most windows kept by each querier wrapped; beyond it, arbitrary
+	// ones are evicted.  If zero, nothing is cached.
+	MaxEntries int
+}
+
+// SeriesCache is a Middleware caching the series queries read, by tenant,
+// matchers and window of time, so queries repeated over overlapping time
+// ranges, such as rules re-evaluated every interval, only read the windows
+// they haven't already.  The part of a query too recent to be cached is
+// always read.  Queries served from the cache don't record provenance, nor
+// reserve query memory.
+func SeriesCache(cfg SeriesCacheConfig) Middleware {
+	return MiddlewareFunc(func(next Querier) Querier {
+		if cfg.Window <= 0 || cfg.MaxEntries <= 0 {
+			return next
+		}
+		return &seriesCache{
+			Querier: next,
+			cfg:     cfg,
+			entries: map[string]*seriesCacheEntry{},
+		}
+	})
+}
+
+type seriesCache struct {
+	Querier
+	cfg SeriesCacheConfig
+
+	mtx     sync.Mutex
+	entries map[string]*seriesCacheEntry
+}
+
+type seriesCacheEntry struct {
+	matrix  model.Matrix
+	expires time.Time
+}
+
+func (q *seriesCache) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return q.Querier.Query(ctx, from, to, matchers...)
+	}
+	var (
+		window    = model.Time(q.cfg.Window / time.Millisecond)
+		cacheable = model.TimeFromUnixNano(mtime.Now().Add(-q.cfg.MinAge).UnixNano())
+		selector  = matchersKey(matchers)
+		parts     []model.Matrix
+		rest      = from
+	)
+	for start := from - from%window; start <= to && start+window-1 <= cacheable; start += window {
+		matrix, err := q.window(ctx, userID, selector, start, start+window-1, matchers)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, clipMatrix(matrix, from, to))
+		rest = start + window
+	}
+	if rest <= to {
+		matrix, err := q.Querier.Query(ctx, rest, to, copyMatchers(matchers)...)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, clipMatrix(matrix, rest, to))
+	}
+	return mergeMatrices(parts), nil
+}
+
+// window returns the series matching matchers from start to end, from the
+// cache if it has them.
+func (q *seriesCache) window(ctx context.Context, userID, selector string, start, end model.Time, matchers []*metric.LabelMatcher) (model.Matrix, error) {
+	key := userID + ":" + strconv.FormatInt(int64(start), 10) + ":" + selector
+	now := mtime.Now()
+
+	q.mtx.Lock()
+	entry, ok := q.entries[key]
+	q.mtx.Unlock()
+	if ok && now.Before(entry.expires) {
+		seriesCacheRequests.WithLabelValues("hit").Inc()
+		return entry.matrix, nil
+	}
+	seriesCacheRequests.WithLabelValues("miss").Inc()
+
+	// Stores may modify the matchers they are given.
+	matrix, err := q.Querier.Query(ctx, start, end, copyMatchers(matchers)...)
+	if err != nil {
+		return nil, err
+	}
+	matrix = clipMatrix(matrix, start, end)
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if _, ok := q.entries[key]; !ok && len(q.entries) >= q.cfg.MaxEntries {
+		for evict := range q.entries {
+			delete(q.entries, evict)
+			break
+		}
+	}
+	q.entries[key] = &seriesCacheEntry{matrix: matrix, expires: now.Add(q.cfg.TTL)}
+	return matrix, nil
+}
+
+// matchersKey is a canonical form of matchers, whatever their order.
+func matchersKey(matchers []*metric.LabelMatcher) string {
+	strs := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		strs = append(strs, matcher.String())
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ",")
+}
+
+func copyMatchers(matchers []*metric.LabelMatcher) []*metric.LabelMatcher {
+	return append([]*metric.LabelMatcher(nil), matchers...)
+}
+
+// clipMatrix returns the samples in matrix from from to to, in new sample
+// streams, so the result can be cached and merged without either being
+// modified.  Series with no samples in the range are dropped.
+func clipMatrix(matrix model.Matrix, from, to model.Time) model.Matrix {
+	result := make(model.Matrix, 0, len(matrix))
+	for _, ss := range matrix {
+		var values []model.SamplePair
+		for _, v := range ss.Values {
+			if v.Timestamp >= from && v.Timestamp <= to {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			result = append(result, &model.SampleStream{Metric: ss.Metric, Values: values})
+		}
+	}
+	return result
+}
+
+// mergeMatrices merges matrices for consecutive time ranges, in order, into
+// one, copying the series' metrics and samples.
+func mergeMatrices(matrices []model.Matrix) model.Matrix {
+	var (
+		result model.Matrix
+		series = map[model.Fingerprint]*model.SampleStream{}
+	)
+	for _, matrix := range matrices {
+		for _, ss := range matrix {
+			fp := ss.Metric.Fingerprint()
+			existing, ok := series[fp]
+			if !ok {
+				existing = &model.SampleStream{Metric: ss.Metric.Clone()}
+				series[fp] = existing
+				result = append(result, existing)
+			}
+			existing.Values = append(existing.Values, ss.Values...)
+		}
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package querier
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// sampleQuerier serves a single series with a sample every 10s, whose value
+// is its timestamp, recording the time ranges it is queried for.
+type sampleQuerier struct {
+	matrixQuerier
+	ranges *[][2]model.Time
+}
+
+func (q sampleQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	*q.ranges = append(*q.ranges, [2]model.Time{from, to})
+	ss := &model.SampleStream{Metric: model.Metric{model.MetricNameLabel: "foo"}}
+	for t := from + (10000-from%10000)%10000; t <= to; t += 10000 {
+		ss.Values = append(ss.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(t)})
+	}
+	return model.Matrix{ss}, nil
+}
+
+func TestSeriesCache(t *testing.T) {
+	now := model.Time(1230000)
+	mtime.NowForce(now.Time())
+	defer mtime.NowReset()
+
+	var ranges [][2]model.Time
+	cached := SeriesCache(SeriesCacheConfig{Window: time.Minute, TTL: time.Hour, MinAge: time.Minute, MaxEntries: 100}).Wrap(sampleQuerier{ranges: &ranges})
+	uncached := sampleQuerier{ranges: new([][2]model.Time)}
+
+	ctx := user.WithID(context.Background(), "1")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from, to model.Time
+		expected [][2]model.Time
+	}{
+		// The first four whole minutes are cached; the rest, too recent, isn't.
+		{
+			now.Add(-5 * time.Minute), now,
+			[][2]model.Time{
+				{900000, 959999}, {960000, 1019999}, {1020000, 1079999}, {1080000, 1139999},
+				{1140000, now},
+			},
+		},
+		// A minute later, only the newly cached minute and the rest are read.
+		{
+			now.Add(-4 * time.Minute), now.Add(time.Minute),
+			[][2]model.Time{{1140000, 1199999}, {1200000, now.Add(time.Minute)}},
+		},
+	} {
+		mtime.NowForce(tc.to.Time())
+		ranges = nil
+		got, err := cached.Query(ctx, tc.from, tc.to, matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := uncached.Query(ctx, tc.from, tc.to, matcher)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("from %d to %d: expected %v, got %v", tc.from, tc.to, expected, got)
+		}
+		if !reflect.DeepEqual(ranges, tc.expected) {
+			t.Fatalf("from %d to %d: expected queries for %v, got %v", tc.from, tc.to, tc.expected, ranges)
+		}
+	}
+
+	// Other tenants' queries aren't served from the cache.
+	ranges = nil
+	if _, err := cached.Query(user.WithID(context.Background(), "2"), now.Add(-2*time.Minute), now, matcher); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 3 {
+		t.Fatalf("expected 3 queries, got %v", ranges)
+	}
+}
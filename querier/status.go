@@ -0,0 +1,232 @@
+package querier
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/version"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// StatusAPI implements the Prometheus /api/v1/status endpoints, so tooling
+// which probes Prometheus-compatible servers works against the querier.
+type StatusAPI struct {
+	startTime time.Time
+	headStats func(context.Context) (*HeadStats, error)
+}
+
+// HeadStats are stats of a user's series in ingesters' memory, standing in
+// for Prometheus' TSDB head.
+type HeadStats struct {
+	NumSeries   uint64
+	NumChunks   uint64
+	MemoryBytes uint64
+
+	// The range of time the samples cover, in milliseconds since the epoch.
+	MinTime, MaxTime int64
+
+	SeriesCountByMetricName map[string]uint64
+}
+
+// NewStatusAPI makes a new StatusAPI.  headStats returns the stats of the
+// in-memory series for the user in the context.
+func NewStatusAPI(headStats func(context.Context) (*HeadStats, error)) *StatusAPI {
+	return &StatusAPI{
+		startTime: time.Now(),
+		headStats: headStats,
+	}
+}
+
+// Register registers the status endpoints under /api/v1/status.  It must be
+// called before any handler for the /api/v1 prefix is registered.
+func (a *StatusAPI) Register(router *mux.Router) {
+	router.Path("/api/v1/status/buildinfo").Handler(http.HandlerFunc(a.buildInfo))
+	router.Path("/api/v1/status/config").Handler(http.HandlerFunc(a.config))
+	router.Path("/api/v1/status/flags").Handler(http.HandlerFunc(a.flags))
+	router.Path("/api/v1/status/runtimeinfo").Handler(http.HandlerFunc(a.runtimeInfo))
+	router.Path("/api/v1/status/tsdb").Handler(http.HandlerFunc(a.tsdb))
+}
+
+type statusResponse struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	util.WriteJSONResponse(w, statusResponse{
+		Status: "success",
+		Data:   data,
+	})
+}
+
+func respondError(w http.ResponseWriter, err error) {
+	util.WriteError(w, err)
+}
+
+func (a *StatusAPI) buildInfo(w http.ResponseWriter, r *http.Request) {
+	respond(w, map[string]string{
+		"version":   version.Version,
+		"revision":  version.Revision,
+		"branch":    version.Branch,
+		"buildUser": version.BuildUser,
+		"buildDate": version.BuildDate,
+		"goVersion": version.GoVersion,
+	})
+}
+
+// config returns an empty config, as Cortex has no Prometheus configuration
+// file.
+func (a *StatusAPI) config(w http.ResponseWriter, r *http.Request) {
+	respond(w, map[string]string{
+		"yaml": "",
+	})
+}
+
+// flags returns the process' flags, which any tenant can read, so values
+// which may be secret, or which configure other tenants, are redacted.
+func (a *StatusAPI) flags(w http.ResponseWriter, r *http.Request) {
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	respond(w, flags)
+}
+
+const redacted = "<redacted>"
+
+var (
+	// Flags holding credentials, or the files they are read from.
+	secretFlag = regexp.MustCompile(`(?i)(password|secret|token|username|key)(-file|-id)?$`)
+	// Flags naming tenants and their settings.
+	tenantFlag = regexp.MustCompile(`(?i)(overrides|forwarding-rules|tenants|cross-tenant-writes|userID)$`)
+	// Query parameters holding credentials, eg SAS tokens.
+	secretParam = regexp.MustCompile(`(?i)password|secret|token|key|sig|credential`)
+	urlPattern  = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^,;\s]+`)
+)
+
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretFlag.MatchString(name) || tenantFlag.MatchString(name) {
+		return redacted
+	}
+	return urlPattern.ReplaceAllStringFunc(value, redactURL)
+}
+
+// redactURL strips the credentials from a URL: its user info (eg
+// s3://key:secret@region/bucket), and secret query parameters.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	query := u.Query()
+	for k := range query {
+		if secretParam.MatchString(k) {
+			query.Set(k, redacted)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (a *StatusAPI) runtimeInfo(w http.ResponseWriter, r *http.Request) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = err.Error()
+	}
+	respond(w, map[string]interface{}{
+		"startTime":           a.startTime,
+		"CWD":                 cwd,
+		"reloadConfigSuccess": true,
+		"lastConfigTime":      a.startTime,
+		"goroutineCount":      runtime.NumGoroutine(),
+		"GOMAXPROCS":          runtime.GOMAXPROCS(0),
+		"GOGC":                os.Getenv("GOGC"),
+		"GODEBUG":             os.Getenv("GODEBUG"),
+		"storageRetention":    "",
+	})
+}
+
+// tsdbTopStats is how many of the largest stats are returned, as in
+// Prometheus.
+const tsdbTopStats = 10
+
+type tsdbHeadStats struct {
+	NumSeries     uint64 `json:"numSeries"`
+	ChunkCount    int64  `json:"chunkCount"`
+	MinTime       int64  `json:"minTime"`
+	MaxTime       int64  `json:"maxTime"`
+	MemoryInBytes uint64 `json:"memoryInBytes"`
+}
+
+type tsdbStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// byTSDBStatValue sorts stats largest first, then by name.
+type byTSDBStatValue []tsdbStat
+
+func (s byTSDBStatValue) Len() int      { return len(s) }
+func (s byTSDBStatValue) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byTSDBStatValue) Less(i, j int) bool {
+	if s[i].Value != s[j].Value {
+		return s[i].Value > s[j].Value
+	}
+	return s[i].Name < s[j].Name
+}
+
+// topTSDBStats returns the largest counts, largest first, as stats.
+func topTSDBStats(counts map[string]uint64) []tsdbStat {
+	stats := make([]tsdbStat, 0, len(counts))
+	for name, value := range counts {
+		stats = append(stats, tsdbStat{Name: name, Value: value})
+	}
+	sort.Sort(byTSDBStatValue(stats))
+	if len(stats) > tsdbTopStats {
+		stats = stats[:tsdbTopStats]
+	}
+	return stats
+}
+
+// tsdb approximates Prometheus' TSDB stats with those of the user's
+// in-memory series, so tenants can see where their cardinality comes from.
+// Only the head stats and the series counts by metric name are filled in.
+func (a *StatusAPI) tsdb(w http.ResponseWriter, r *http.Request) {
+	ctx, abort := util.ParseProtoRequest(w, r, nil, false)
+	if abort {
+		return
+	}
+	stats, err := a.headStats(ctx)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respond(w, map[string]interface{}{
+		"headStats": tsdbHeadStats{
+			NumSeries:     stats.NumSeries,
+			ChunkCount:    int64(stats.NumChunks),
+			MinTime:       stats.MinTime,
+			MaxTime:       stats.MaxTime,
+			MemoryInBytes: stats.MemoryBytes,
+		},
+		"seriesCountByMetricName":     topTSDBStats(stats.SeriesCountByMetricName),
+		"labelValueCountByLabelName":  []tsdbStat{},
+		"memoryInBytesByLabelName":    []tsdbStat{},
+		"seriesCountByLabelValuePair": []tsdbStat{},
+	})
+}
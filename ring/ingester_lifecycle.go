@@ -100,6 +100,11 @@ func RegisterIngester(consulClient ConsulClient, cfg IngesterRegistrationConfig)
 	return r, nil
 }
 
+// ID returns the ID this ingester is registered in the ring with.
+func (r *IngesterRegistration) ID() string {
+	return r.id
+}
+
 // ChangeState changes the state of an ingester in the ring.
 func (r *IngesterRegistration) ChangeState(state IngesterState) {
 	log.Info("Changing ingester state to: %v", state)
@@ -78,3 +78,37 @@ func poll(t *testing.T, d time.Duration, want interface{}, have func() interface
 		t.Fatalf("%s:%d: %v != %v", file, line, want, h)
 	}
 }
+
+func TestIngesterState(t *testing.T) {
+	consul := newMockConsulClient()
+	ring := New(consul, time.Second)
+
+	registra, err := RegisterIngester(consul, IngesterRegistrationConfig{
+		NumTokens: 1,
+		Addr:      "localhost",
+		Hostname:  "localhost",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll(t, 100*time.Millisecond, true, func() interface{} {
+		state, ok := ring.IngesterState(registra.ID())
+		return ok && state == Active
+	})
+	if ring.LastChange().IsZero() {
+		t.Fatal("expected ring change to be recorded")
+	}
+
+	registra.ChangeState(Leaving)
+	poll(t, 100*time.Millisecond, Leaving, func() interface{} {
+		state, _ := ring.IngesterState(registra.ID())
+		return state
+	})
+
+	registra.Unregister()
+	poll(t, 100*time.Millisecond, false, func() interface{} {
+		_, ok := ring.IngesterState(registra.ID())
+		return ok
+	})
+}
@@ -91,3 +91,23 @@ func (d *Desc) removeIngester(id string) {
 	}
 	d.Tokens = output
 }
+
+// sameMembership returns true if d and o have the same ingesters, in the same
+// states, owning the same tokens; heartbeat timestamps are ignored.
+func (d *Desc) sameMembership(o *Desc) bool {
+	if len(d.Ingesters) != len(o.Ingesters) || len(d.Tokens) != len(o.Tokens) {
+		return false
+	}
+	for id, ingester := range d.Ingesters {
+		other, ok := o.Ingesters[id]
+		if !ok || other.State != ingester.State {
+			return false
+		}
+	}
+	for i := range d.Tokens {
+		if d.Tokens[i] != o.Tokens[i] {
+			return false
+		}
+	}
+	return true
+}
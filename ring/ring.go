@@ -3,7 +3,6 @@ package ring
 // Based on https://raw.githubusercontent.com/stathat/consistent/master/consistent.go
 
 import (
-	"errors"
 	"math"
 	"sort"
 	"sync"
@@ -11,6 +10,8 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex/util"
 )
 
 const (
@@ -33,7 +34,7 @@ func (x uint32s) Less(i, j int) bool { return x[i] < x[j] }
 func (x uint32s) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 
 // ErrEmptyRing is the error returned when trying to get an element when nothing has been added to hash.
-var ErrEmptyRing = errors.New("empty circle")
+var ErrEmptyRing = util.NewError(util.ErrUnavailable, "empty circle")
 
 // Ring holds the information about the members of the consistent hash circle.
 type Ring struct {
@@ -44,6 +45,9 @@ type Ring struct {
 	mtx      sync.RWMutex
 	ringDesc Desc
 
+	// When the ring's membership last changed.
+	lastChange time.Time
+
 	ingesterOwnershipDesc *prometheus.Desc
 	numIngestersDesc      *prometheus.Desc
 	numTokensDesc         *prometheus.Desc
@@ -93,6 +97,9 @@ func (r *Ring) loop() {
 		ringDesc := value.(*Desc)
 		r.mtx.Lock()
 		defer r.mtx.Unlock()
+		if !r.ringDesc.sameMembership(ringDesc) {
+			r.lastChange = time.Now()
+		}
 		r.ringDesc = *ringDesc
 		return true
 	})
@@ -162,19 +169,22 @@ func (r *Ring) getInternal(key uint32, n int, op Operation) ([]IngesterDesc, err
 	return ingesters, nil
 }
 
-// GetAll returns all available ingesters in the circle.
-func (r *Ring) GetAll() []IngesterDesc {
+// GetAll returns all available ingesters in the circle, and how many more
+// are in it but unavailable, because they haven't heartbeated recently.
+func (r *Ring) GetAll() ([]IngesterDesc, int) {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 
 	ingesters := make([]IngesterDesc, 0, len(r.ringDesc.Ingesters))
+	unhealthy := 0
 	for _, ingester := range r.ringDesc.Ingesters {
 		if time.Now().Sub(ingester.Timestamp) > r.heartbeatTimeout {
+			unhealthy++
 			continue
 		}
 		ingesters = append(ingesters, ingester)
 	}
-	return ingesters
+	return ingesters, unhealthy
 }
 
 // Ready is true when all ingesters are active and healthy.
@@ -193,6 +203,27 @@ func (r *Ring) Ready() bool {
 	return len(r.ringDesc.Tokens) > 0
 }
 
+// IngesterState returns the state of the ingester with the given ID, and
+// false if it isn't in the ring or hasn't heartbeated recently.
+func (r *Ring) IngesterState(id string) (IngesterState, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	ingester, ok := r.ringDesc.Ingesters[id]
+	if !ok || time.Now().Sub(ingester.Timestamp) > r.heartbeatTimeout {
+		return 0, false
+	}
+	return ingester.State, true
+}
+
+// LastChange returns when ingesters last joined or left the ring, changed
+// state, or changed tokens.
+func (r *Ring) LastChange() time.Time {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.lastChange
+}
+
 func (r *Ring) search(key uint32) int {
 	i := sort.Search(len(r.ringDesc.Tokens), func(x int) bool {
 		return r.ringDesc.Tokens[x].Token > key
@@ -0,0 +1,98 @@
+package ruler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// How often workers prune their tenant's config history, when
+// Config.ConfigHistoryRetention is set.
+const configHistoryPruneInterval = time.Hour
+
+// ConfigVersion is a version of an organization's cortex config, as listed
+// in its history.
+type ConfigVersion struct {
+	ID      int       `json:"id"`
+	Created time.Time `json:"created_at"`
+}
+
+func orgConfigURL(configsAPIURL *url.URL, userID string) string {
+	return fmt.Sprintf("%s/api/configs/org/%s/cortex", configsAPIURL.String(), userID)
+}
+
+func doConfigsRequest(client *http.Client, method, url, userID string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-Scope-OrgID", userID)
+	return client.Do(req)
+}
+
+// DeleteOrgConfig deletes the organization's cortex config, and its
+// history, from a configs API server, eg when off-boarding them.  Rulers
+// stop evaluating the organization's rules once they see it is gone.  It
+// isn't an error if the organization has no config.
+func DeleteOrgConfig(client *http.Client, configsAPIURL *url.URL, userID string) error {
+	res, err := doConfigsRequest(client, "DELETE", orgConfigURL(configsAPIURL, userID), userID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// GetOrgConfigHistory returns the versions of the organization's cortex
+// config kept by a configs API server, oldest first.
+func GetOrgConfigHistory(client *http.Client, configsAPIURL *url.URL, userID string) ([]ConfigVersion, error) {
+	res, err := doConfigsRequest(client, "GET", orgConfigURL(configsAPIURL, userID)+"/history", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+	}
+	var history struct {
+		Versions []ConfigVersion `json:"versions"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&history); err != nil {
+		return nil, err
+	}
+	return history.Versions, nil
+}
+
+// PruneOrgConfigHistory deletes the versions of the organization's cortex
+// config created before the given time from a configs API server, other
+// than the current one.
+func PruneOrgConfigHistory(client *http.Client, configsAPIURL *url.URL, userID string, before time.Time) error {
+	url := orgConfigURL(configsAPIURL, userID) + "/history?" + url.Values{"before": {before.UTC().Format(time.RFC3339)}}.Encode()
+	res, err := doConfigsRequest(client, "DELETE", url, userID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// pruneConfigHistory prunes the worker's tenant's config versions older
+// than the retention period.
+func (w *worker) pruneConfigHistory() {
+	if err := PruneOrgConfigHistory(w.configsClient, w.configsAPIURL, w.userID, time.Now().Add(-w.configHistoryRetention)); err != nil {
+		log.Warnf("Could not prune configuration history for %v: %v", w.userID, err)
+	}
+}
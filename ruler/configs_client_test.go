@@ -0,0 +1,67 @@
+package ruler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigsClient(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Scope-OrgID")))
+		switch {
+		case r.URL.Path == "/api/configs/org/2/cortex" || r.URL.Path == "/api/configs/org/2/cortex/history":
+			http.NotFound(w, r)
+		case r.Method == "GET":
+			w.Write([]byte(`{"versions": [{"id": 1, "created_at": "2017-01-02T03:04:05Z"}, {"id": 2, "created_at": "2017-02-03T04:05:06Z"}]}`))
+		}
+	}))
+	defer server.Close()
+	configsAPIURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{}
+
+	// Deleting or pruning a missing config isn't an error.
+	for _, userID := range []string{"1", "2"} {
+		if err := DeleteOrgConfig(client, configsAPIURL, userID); err != nil {
+			t.Fatal(err)
+		}
+		if err := PruneOrgConfigHistory(client, configsAPIURL, userID, time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := GetOrgConfigHistory(client, configsAPIURL, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigVersion{
+		{ID: 1, Created: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{ID: 2, Created: time.Date(2017, 2, 3, 4, 5, 6, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("expected history %v, got %v", expected, history)
+	}
+	if history, err := GetOrgConfigHistory(client, configsAPIURL, "2"); err != nil || history != nil {
+		t.Errorf("expected no history, got %v, %v", history, err)
+	}
+
+	expectedRequests := []string{
+		"DELETE /api/configs/org/1/cortex 1",
+		"DELETE /api/configs/org/1/cortex/history?before=2017-02-01T00%3A00%3A00Z 1",
+		"DELETE /api/configs/org/2/cortex 2",
+		"DELETE /api/configs/org/2/cortex/history?before=2017-02-01T00%3A00%3A00Z 2",
+		"GET /api/configs/org/1/cortex/history 1",
+		"GET /api/configs/org/2/cortex/history 2",
+	}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Errorf("expected requests:\n%q\ngot:\n%q", expectedRequests, requests)
+	}
+}
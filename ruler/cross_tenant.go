@@ -0,0 +1,76 @@
+package ruler
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage"
+)
+
+var crossTenantSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "ruler_cross_tenant_samples_total",
+	Help:      "The total number of samples written by rules into a tenant other than their own.",
+}, []string{"source", "target"})
+
+func init() {
+	prometheus.MustRegister(crossTenantSamples)
+}
+
+// ParseCrossTenantWrites parses the tenants each tenant's rules may write
+// their results into, in the form
+// "tenant=aggregate;other-tenant=aggregate,other-aggregate".
+func ParseCrossTenantWrites(s string) (map[string][]string, error) {
+	writes := map[string][]string{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid cross-tenant write rule %q, expected tenant=target[,target...]", entry)
+		}
+		for _, target := range strings.Split(parts[1], ",") {
+			if target = strings.TrimSpace(target); target != "" {
+				writes[parts[0]] = append(writes[parts[0]], target)
+			}
+		}
+	}
+	return writes, nil
+}
+
+// crossTenantAppender counts the samples appended by one tenant's rules into
+// another tenant, so that such writes can be audited.
+type crossTenantAppender struct {
+	storage.SampleAppender
+	source, target string
+	samples        *int64
+}
+
+func newCrossTenantAppender(appender storage.SampleAppender, source, target string) crossTenantAppender {
+	return crossTenantAppender{
+		SampleAppender: appender,
+		source:         source,
+		target:         target,
+		samples:        new(int64),
+	}
+}
+
+func (a crossTenantAppender) Append(sample *model.Sample) error {
+	if err := a.SampleAppender.Append(sample); err != nil {
+		return err
+	}
+	atomic.AddInt64(a.samples, 1)
+	crossTenantSamples.WithLabelValues(a.source, a.target).Inc()
+	return nil
+}
+
+// written returns, and resets, the number of samples appended since it was
+// last called.
+func (a crossTenantAppender) written() int64 {
+	return atomic.SwapInt64(a.samples, 0)
+}
@@ -0,0 +1,410 @@
+package ruler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/util/strutil"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	alertmanagerPushPath = "/api/v1/alerts"
+
+	notificationTimeout    = 10 * time.Second
+	minNotificationBackoff = 100 * time.Millisecond
+	maxNotificationBackoff = 30 * time.Second
+)
+
+var (
+	notificationsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "ruler_notifications_queued",
+		Help:      "Batches of alert notifications waiting to be sent to the Alertmanager.",
+	})
+	notificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "ruler_notifications_total",
+		Help:      "Batches of alert notifications sent or dropped, and failed attempts to send them, by outcome: sent, failed (and to be retried), rejected (dropped as invalid by the Alertmanager), expired (dropped for being older than the maximum age), or overflowed (dropped as the oldest when the user's queue is full).",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(notificationsQueued)
+	prometheus.MustRegister(notificationsTotal)
+}
+
+// notification is a batch of alerts for one user, as queued and persisted.
+type notification struct {
+	UserID   string         `json:"user_id"`
+	Enqueued time.Time      `json:"enqueued"`
+	Alerts   []*model.Alert `json:"alerts"`
+
+	filename string
+}
+
+// notificationBackoff is when a user whose last notification failed may be
+// retried.
+type notificationBackoff struct {
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// notificationQueue sends alert notifications to the Alertmanager.  Each
+// user's notifications are queued separately, and sent in the order they
+// were queued, with users taking turns, so one user whose notifications
+// fail doesn't hold up the others.  Failed notifications are retried with
+// backoff until sent or older than maxAge, unless the Alertmanager rejects
+// them as invalid, when they are dropped.  If capacity is non-zero, each
+// user may have at most that many notifications queued, the oldest being
+// dropped to make room for new ones.  If dir is set, queued notifications
+// are written to it, and those found there on startup are redelivered, so
+// they survive restarts.
+type notificationQueue struct {
+	alertmanagerURL string
+	dir             string
+	maxAge          time.Duration
+	capacity        int
+	client          http.Client
+
+	mtx      sync.Mutex
+	pending  map[string][]*notification // By user ID, oldest first.
+	users    []string                   // Users with notifications pending, in turn order.
+	backoffs map[string]notificationBackoff
+	queued   int
+	seq      int
+
+	wake       chan struct{}
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+func newNotificationQueue(alertmanagerURL, dir string, maxAge time.Duration, capacity int) (*notificationQueue, error) {
+	q := &notificationQueue{
+		alertmanagerURL: strings.TrimRight(alertmanagerURL, "/"),
+		dir:             dir,
+		maxAge:          maxAge,
+		capacity:        capacity,
+		client:          http.Client{Timeout: notificationTimeout},
+		pending:         map[string][]*notification{},
+		backoffs:        map[string]notificationBackoff{},
+		wake:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		terminated:      make(chan struct{}),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+	}
+	go q.loop()
+	return q, nil
+}
+
+// load reads the notifications persisted by a previous process.  Their file
+// names sort in the order they were queued.
+func (q *notificationQueue) load() error {
+	filenames, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		n := &notification{filename: filename}
+		if err := json.Unmarshal(buf, n); err != nil {
+			log.Warnf("Discarding unreadable notification %s: %v", filename, err)
+			os.Remove(filename)
+			continue
+		}
+		if dropped := q.push(n); dropped != nil {
+			q.drop(dropped, "overflowed")
+		}
+	}
+	if q.queued > 0 {
+		log.Infof("Redelivering %d queued notifications", q.queued)
+	}
+	return nil
+}
+
+func (q *notificationQueue) enqueue(userID string, alerts []*model.Alert) {
+	n := &notification{UserID: userID, Enqueued: time.Now(), Alerts: alerts}
+
+	q.mtx.Lock()
+	q.seq++
+	seq := q.seq
+	q.mtx.Unlock()
+
+	if q.dir != "" {
+		if err := q.persist(n, seq); err != nil {
+			log.Warnf("Could not persist notification for %v, queueing it in memory: %v", userID, err)
+		}
+	}
+
+	q.mtx.Lock()
+	dropped := q.push(n)
+	q.mtx.Unlock()
+	if dropped != nil {
+		log.Warnf("Notification queue for %v full, dropping %d alert notifications queued at %v", userID, len(dropped.Alerts), dropped.Enqueued)
+		q.drop(dropped, "overflowed")
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push adds a notification to its user's queue, returning the oldest if
+// that makes the queue overflow.  q.mtx must be held, or the loop not yet
+// running.
+func (q *notificationQueue) push(n *notification) *notification {
+	if _, ok := q.pending[n.UserID]; !ok {
+		q.users = append(q.users, n.UserID)
+	}
+	q.pending[n.UserID] = append(q.pending[n.UserID], n)
+	q.queued++
+	notificationsQueued.Set(float64(q.queued))
+
+	if q.capacity > 0 && len(q.pending[n.UserID]) > q.capacity {
+		oldest := q.pending[n.UserID][0]
+		q.unlink(oldest)
+		return oldest
+	}
+	return nil
+}
+
+// persist writes a notification to a temporary file and renames it into
+// place, so a crash never leaves a partial notification to be redelivered.
+func (q *notificationQueue) persist(n *notification, seq int) error {
+	buf, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(q.dir, fmt.Sprintf("%020d-%010d.json", n.Enqueued.UnixNano(), seq))
+	tmp := filepath.Join(q.dir, fmt.Sprintf(".tmp-%010d", seq))
+	if err := ioutil.WriteFile(tmp, buf, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	n.filename = filename
+	return nil
+}
+
+func (q *notificationQueue) loop() {
+	defer close(q.terminated)
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		next, wait := q.next(time.Now())
+		if next == nil {
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-q.wake:
+			case <-retry:
+			case <-q.done:
+				return
+			}
+			continue
+		}
+
+		if q.maxAge > 0 && time.Since(next.Enqueued) > q.maxAge {
+			log.Warnf("Dropping %d alert notifications for %v queued at %v", len(next.Alerts), next.UserID, next.Enqueued)
+			q.remove(next, "expired")
+			continue
+		}
+
+		err := q.send(next)
+		switch {
+		case err == nil:
+			q.remove(next, "sent")
+		case !util.ErrorCodeOf(err).Retryable():
+			log.Warnf("Alertmanager rejected %d alert notifications for %v, dropping them: %v", len(next.Alerts), next.UserID, err)
+			q.remove(next, "rejected")
+		default:
+			log.Warnf("Error sending alert notifications for %v, will retry: %v", next.UserID, err)
+			notificationsTotal.WithLabelValues("failed").Inc()
+			q.failed(next.UserID)
+		}
+	}
+}
+
+// next returns the oldest notification of the first user in turn who isn't
+// waiting to retry, and moves them to the back of the turn order.  If there
+// is none, it returns how long until a user may be retried, or zero if no
+// user is waiting.
+func (q *notificationQueue) next(now time.Time) (*notification, time.Duration) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var wait time.Duration
+	for i, userID := range q.users {
+		if b, ok := q.backoffs[userID]; ok && now.Before(b.retryAt) {
+			if d := b.retryAt.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		copy(q.users[i:], q.users[i+1:])
+		q.users[len(q.users)-1] = userID
+		return q.pending[userID][0], 0
+	}
+	return nil, wait
+}
+
+// failed backs off retrying a user's notifications.
+func (q *notificationQueue) failed(userID string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	b := q.backoffs[userID]
+	if b.backoff *= 2; b.backoff < minNotificationBackoff {
+		b.backoff = minNotificationBackoff
+	} else if b.backoff > maxNotificationBackoff {
+		b.backoff = maxNotificationBackoff
+	}
+	b.retryAt = time.Now().Add(b.backoff)
+	q.backoffs[userID] = b
+}
+
+// remove removes a notification from the queue once it has been sent or
+// dropped, unless it overflowed while being sent.  If the Alertmanager
+// accepted or rejected it, the user is no longer backed off.
+func (q *notificationQueue) remove(n *notification, outcome string) {
+	q.mtx.Lock()
+	found := q.unlink(n)
+	if outcome == "sent" || outcome == "rejected" {
+		delete(q.backoffs, n.UserID)
+	}
+	q.mtx.Unlock()
+	if found {
+		q.drop(n, outcome)
+	}
+}
+
+// unlink removes a notification from its user's queue, returning whether it
+// was still there.  q.mtx must be held.
+func (q *notificationQueue) unlink(n *notification) bool {
+	pending := q.pending[n.UserID]
+	found := false
+	for i := range pending {
+		if pending[i] == n {
+			pending = append(pending[:i], pending[i+1:]...)
+			q.queued--
+			notificationsQueued.Set(float64(q.queued))
+			found = true
+			break
+		}
+	}
+	if len(pending) > 0 {
+		q.pending[n.UserID] = pending
+		return found
+	}
+	delete(q.pending, n.UserID)
+	delete(q.backoffs, n.UserID)
+	for i, userID := range q.users {
+		if userID == n.UserID {
+			q.users = append(q.users[:i], q.users[i+1:]...)
+			break
+		}
+	}
+	return found
+}
+
+// drop counts a removed notification, and deletes its file.
+func (q *notificationQueue) drop(n *notification, outcome string) {
+	notificationsTotal.WithLabelValues(outcome).Inc()
+	if n.filename != "" {
+		if err := os.Remove(n.filename); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Could not remove notification %s: %v", n.filename, err)
+		}
+	}
+}
+
+// send sends a notification.  Errors for responses the Alertmanager would
+// give again if retried aren't retryable.
+func (q *notificationQueue) send(n *notification) error {
+	buf, err := json.Marshal(n.Alerts)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", q.alertmanagerURL+alertmanagerPushPath, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(user.UserIDHeaderName, n.UserID)
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return util.NewError(util.ErrorCodeForHTTPStatus(resp.StatusCode), "bad response status %v", resp.Status)
+	}
+	return nil
+}
+
+// stop stops sending notifications.  Those not yet sent stay persisted, to
+// be redelivered on restart.
+func (q *notificationQueue) stop() {
+	close(q.done)
+	<-q.terminated
+}
+
+// notifyingRule is an alerting rule which queues notifications for its
+// firing alerts each time it is evaluated, as rules.Group does for
+// Prometheus.  Resolved alerts aren't available from rules.AlertingRule, so
+// the Alertmanager resolves alerts once they stop being sent.
+type notifyingRule struct {
+	*rules.AlertingRule
+	holdDuration time.Duration
+	expr         promql.Expr
+}
+
+// alerts returns the rule's firing alerts, to be sent to the Alertmanager.
+func (r notifyingRule) alerts(externalURL string) []*model.Alert {
+	var result []*model.Alert
+	for _, alert := range r.ActiveAlerts() {
+		if alert.State != rules.StateFiring {
+			continue
+		}
+		result = append(result, &model.Alert{
+			StartsAt:     alert.ActiveAt.Add(r.holdDuration).Time(),
+			Labels:       alert.Labels,
+			Annotations:  alert.Annotations,
+			GeneratorURL: externalURL + strutil.GraphLinkForExpression(r.expr.String()),
+		})
+	}
+	return result
+}
@@ -0,0 +1,213 @@
+package ruler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// fakeAlertmanager records the alert names it is sent, by user, responding
+// with the status set for the user, or 200.
+type fakeAlertmanager struct {
+	mtx      sync.Mutex
+	status   map[string]int
+	received map[string][]string
+	requests int
+}
+
+func newFakeAlertmanager() *fakeAlertmanager {
+	return &fakeAlertmanager{
+		status:   map[string]int{},
+		received: map[string][]string{},
+	}
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var alerts []*model.Alert
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userID := r.Header.Get(user.UserIDHeaderName)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.requests++
+	if status, ok := f.status[userID]; ok {
+		w.WriteHeader(status)
+		return
+	}
+	for _, alert := range alerts {
+		f.received[userID] = append(f.received[userID], alert.Name())
+	}
+}
+
+func (f *fakeAlertmanager) setStatus(userID string, status int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if status == http.StatusOK {
+		delete(f.status, userID)
+	} else {
+		f.status[userID] = status
+	}
+}
+
+func (f *fakeAlertmanager) receivedBy(userID string) interface{} {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string{}, f.received[userID]...)
+}
+
+func (f *fakeAlertmanager) requestCount() interface{} {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.requests
+}
+
+func alertsNamed(name string) []*model.Alert {
+	return []*model.Alert{{Labels: model.LabelSet{model.AlertNameLabel: model.LabelValue(name)}}}
+}
+
+// poll repeatedly evaluates have until it returns want, or d passes.
+func poll(t *testing.T, d time.Duration, want interface{}, have func() interface{}) {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if reflect.DeepEqual(want, have()) {
+			return
+		}
+		time.Sleep(d / 100)
+	}
+	if h := have(); !reflect.DeepEqual(want, h) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Fatalf("%s:%d: %v != %v", file, line, want, h)
+	}
+}
+
+func TestNotificationQueueSkipsFailingUser(t *testing.T) {
+	am := newFakeAlertmanager()
+	am.setStatus("1", http.StatusServiceUnavailable)
+	server := httptest.NewServer(am)
+	defer server.Close()
+	q, err := newNotificationQueue(server.URL, "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.stop()
+
+	q.enqueue("1", alertsNamed("a"))
+	q.enqueue("1", alertsNamed("b"))
+	q.enqueue("2", alertsNamed("c"))
+	q.enqueue("2", alertsNamed("d"))
+	poll(t, time.Second, []string{"c", "d"}, func() interface{} { return am.receivedBy("2") })
+
+	// Once the Alertmanager recovers, user 1's are sent, in order.
+	am.setStatus("1", http.StatusOK)
+	poll(t, time.Second, []string{"a", "b"}, func() interface{} { return am.receivedBy("1") })
+}
+
+func TestNotificationQueueDropsRejected(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		sent   []string
+	}{
+		{http.StatusBadRequest, []string{"b"}},
+		{http.StatusUnprocessableEntity, []string{"b"}},
+		// Rate limited notifications are retried.
+		{http.StatusTooManyRequests, []string{"a", "b"}},
+	} {
+		am := newFakeAlertmanager()
+		am.setStatus("1", tc.status)
+		server := httptest.NewServer(am)
+		q, err := newNotificationQueue(server.URL, "", time.Hour, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q.enqueue("1", alertsNamed("a"))
+		poll(t, time.Second, true, func() interface{} { return am.requestCount().(int) > 0 })
+		am.setStatus("1", http.StatusOK)
+		q.enqueue("1", alertsNamed("b"))
+		poll(t, time.Second, tc.sent, func() interface{} { return am.receivedBy("1") })
+
+		q.stop()
+		server.Close()
+	}
+}
+
+func TestNotificationQueueCapacity(t *testing.T) {
+	am := newFakeAlertmanager()
+	am.setStatus("1", http.StatusServiceUnavailable)
+	server := httptest.NewServer(am)
+	defer server.Close()
+	q, err := newNotificationQueue(server.URL, "", time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.stop()
+
+	// User 1 is backed off once their first notification fails.
+	q.enqueue("1", alertsNamed("a"))
+	poll(t, time.Second, true, func() interface{} { return am.requestCount().(int) > 0 })
+	for _, name := range []string{"b", "c", "d"} {
+		q.enqueue("1", alertsNamed(name))
+	}
+	q.enqueue("2", alertsNamed("e"))
+
+	am.setStatus("1", http.StatusOK)
+	poll(t, 2*time.Second, []string{"c", "d"}, func() interface{} { return am.receivedBy("1") })
+	poll(t, time.Second, []string{"e"}, func() interface{} { return am.receivedBy("2") })
+}
+
+func TestNotificationQueueRedelivers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex-notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	am := newFakeAlertmanager()
+	am.setStatus("1", http.StatusServiceUnavailable)
+	server := httptest.NewServer(am)
+	defer server.Close()
+	q, err := newNotificationQueue(server.URL, dir, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		q.enqueue("1", alertsNamed(name))
+	}
+	q.stop()
+
+	// Only the notifications which didn't overflow are kept.
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 2 {
+		t.Fatalf("expected 2 persisted notifications, got %v", filenames)
+	}
+
+	am.setStatus("1", http.StatusOK)
+	q, err = newNotificationQueue(server.URL, dir, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.stop()
+	poll(t, time.Second, []string{"b", "c"}, func() interface{} { return am.receivedBy("1") })
+	poll(t, time.Second, 0, func() interface{} {
+		filenames, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return len(filenames)
+	})
+}
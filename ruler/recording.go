@@ -0,0 +1,111 @@
+package ruler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage"
+)
+
+var recordedSeriesDiscarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "ruler_recorded_samples_discarded_total",
+	Help:      "The number of samples of recording rules discarded because they would take their tenant over its recorded series limit.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(recordedSeriesDiscarded)
+}
+
+// recordingLimits forces the series a tenant's recording rules write into a
+// metric name namespace, eg "recorded:", so they can be told apart from raw
+// data, and limits how many of them there are, separately from the raw
+// data, so runaway recording rules can't crowd it out.
+type recordingLimits struct {
+	userID    string
+	namespace string // Including the trailing colon, or empty.
+	maxSeries int    // If zero, there is no limit.
+
+	mtx       sync.Mutex
+	series    map[model.Fingerprint]struct{}
+	discarded int
+}
+
+// newRecordingLimits makes recordingLimits for userID.  namespace must be a
+// valid metric name, without the colon.
+func newRecordingLimits(userID, namespace string, maxSeries int) (*recordingLimits, error) {
+	l := &recordingLimits{
+		userID:    userID,
+		maxSeries: maxSeries,
+		series:    map[model.Fingerprint]struct{}{},
+	}
+	if namespace != "" {
+		if !model.IsValidMetricName(model.LabelValue(namespace)) || strings.Contains(namespace, ":") {
+			return nil, fmt.Errorf("invalid recording namespace %q", namespace)
+		}
+		l.namespace = namespace + ":"
+	}
+	return l, nil
+}
+
+// reset starts a new round of evaluations, in which each series recorded
+// counts against the limit afresh.  It returns how many samples were
+// discarded in the last round.
+func (l *recordingLimits) reset() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	discarded := l.discarded
+	l.series = map[model.Fingerprint]struct{}{}
+	l.discarded = 0
+	return discarded
+}
+
+// admit returns whether a sample of metric may be recorded.
+func (l *recordingLimits) admit(metric model.Metric) bool {
+	if l.maxSeries <= 0 {
+		return true
+	}
+	fp := metric.Fingerprint()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, ok := l.series[fp]; ok {
+		return true
+	}
+	if len(l.series) >= l.maxSeries {
+		l.discarded++
+		recordedSeriesDiscarded.WithLabelValues(l.userID).Inc()
+		return false
+	}
+	l.series[fp] = struct{}{}
+	return true
+}
+
+// appender wraps appender so samples appended to it are renamed into the
+// namespace, and dropped if they are over the limit.
+func (l *recordingLimits) appender(appender storage.SampleAppender) storage.SampleAppender {
+	return recordingAppender{SampleAppender: appender, limits: l}
+}
+
+type recordingAppender struct {
+	storage.SampleAppender
+	limits *recordingLimits
+}
+
+func (a recordingAppender) Append(sample *model.Sample) error {
+	if namespace := a.limits.namespace; namespace != "" {
+		name := sample.Metric[model.MetricNameLabel]
+		if !strings.HasPrefix(string(name), namespace) {
+			renamed := *sample
+			renamed.Metric = sample.Metric.Clone()
+			renamed.Metric[model.MetricNameLabel] = model.LabelValue(namespace) + name
+			sample = &renamed
+		}
+	}
+	if !a.limits.admit(sample.Metric) {
+		return nil
+	}
+	return a.SampleAppender.Append(sample)
+}
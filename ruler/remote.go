@@ -0,0 +1,148 @@
+package ruler
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// queryClient evaluates PromQL expressions using a querier's HTTP API, so
+// the ruler doesn't need its own query engine and chunk store.
+type queryClient struct {
+	url    *url.URL
+	client http.Client
+}
+
+func newQueryClient(querierURL string, timeout time.Duration) (*queryClient, error) {
+	u, err := url.Parse(querierURL)
+	if err != nil {
+		return nil, err
+	}
+	return &queryClient{
+		url: u,
+		client: http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+type queryResponse struct {
+	Status    string    `json:"status"`
+	Data      queryData `json:"data"`
+	ErrorType string    `json:"errorType"`
+	Error     string    `json:"error"`
+}
+
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// instantQuery evaluates expr at ts, for the user in the context.  The
+// request is cancelled with the context.
+func (c *queryClient) instantQuery(ctx context.Context, expr string, ts model.Time) (model.Vector, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *c.url
+	u.Path += "/api/v1/query"
+	u.RawQuery = url.Values{
+		"query": {expr},
+		"time":  {strconv.FormatFloat(float64(ts)/1e3, 'f', -1, 64)},
+	}.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(user.UserIDHeaderName, userID)
+	resp, err := ctxhttp.Do(ctx, &c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var qr queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+		return nil, fmt.Errorf("error decoding response from querier (status %s): %v", resp.Status, err)
+	}
+	if qr.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s: %s", qr.ErrorType, qr.Error)
+	}
+
+	switch qr.Data.ResultType {
+	case model.ValVector:
+		var vector model.Vector
+		if err := json.Unmarshal(qr.Data.Result, &vector); err != nil {
+			return nil, err
+		}
+		return vector, nil
+	case model.ValScalar:
+		var scalar model.Scalar
+		if err := json.Unmarshal(qr.Data.Result, &scalar); err != nil {
+			return nil, err
+		}
+		return model.Vector{&model.Sample{
+			Value:     scalar.Value,
+			Timestamp: scalar.Timestamp,
+			Metric:    model.Metric{},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("rule result is not a vector or scalar")
+	}
+}
+
+// remoteRecordingRule is a rules.Rule which behaves like
+// rules.RecordingRule, but evaluates its expression using a queryClient.
+type remoteRecordingRule struct {
+	name   string
+	vector promql.Expr
+	labels model.LabelSet
+	client *queryClient
+}
+
+func (rule remoteRecordingRule) Name() string {
+	return rule.name
+}
+
+// Eval implements rules.Rule.  The engine is ignored.
+func (rule remoteRecordingRule) Eval(ctx context.Context, timestamp model.Time, _ *promql.Engine, _ string) (model.Vector, error) {
+	vector, err := rule.client.instantQuery(ctx, rule.vector.String(), timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Override the metric name and labels.
+	for _, sample := range vector {
+		sample.Metric[model.MetricNameLabel] = model.LabelValue(rule.name)
+
+		for label, value := range rule.labels {
+			if value == "" {
+				delete(sample.Metric, label)
+			} else {
+				sample.Metric[label] = value
+			}
+		}
+	}
+	return vector, nil
+}
+
+func (rule remoteRecordingRule) String() string {
+	return fmt.Sprintf("%s%s = %s\n", rule.name, rule.labels, rule.vector)
+}
+
+func (rule remoteRecordingRule) HTMLSnippet(pathPrefix string) template.HTML {
+	return template.HTML(template.HTMLEscapeString(rule.String()))
+}
@@ -0,0 +1,114 @@
+package ruler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestInstantQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		want    model.Vector
+		wantErr bool
+	}{
+		{
+			name:   "vector",
+			status: http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"foo"},"value":[1.5,"2"]}]}}`,
+			want:   model.Vector{{Metric: model.Metric{model.MetricNameLabel: "foo"}, Timestamp: 1500, Value: 2}},
+		},
+		{
+			name:   "scalar",
+			status: http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"scalar","result":[1.5,"2"]}}`,
+			want:   model.Vector{{Metric: model.Metric{}, Timestamp: 1500, Value: 2}},
+		},
+		{
+			name:    "querier error",
+			status:  http.StatusUnprocessableEntity,
+			body:    `{"status":"error","errorType":"execution","error":"query timed out"}`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			status:  http.StatusBadGateway,
+			body:    `<html>Bad Gateway</html>`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed result",
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":{"resultType":"vector","result":{"foo":"bar"}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "matrix",
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			wantErr: true,
+		},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/prom/api/v1/query" || r.URL.Query().Get("query") != "foo" || r.URL.Query().Get("time") != "1.5" {
+				t.Errorf("%s: unexpected request %v", tc.name, r.URL)
+			}
+			if userID := r.Header.Get(user.UserIDHeaderName); userID != "user" {
+				t.Errorf("%s: expected user ID \"user\", got %q", tc.name, userID)
+			}
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+		client, err := newQueryClient(server.URL+"/api/prom", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector, err := client.instantQuery(user.WithID(context.Background(), "user"), "foo", 1500)
+		server.Close()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.want, vector) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, vector)
+		}
+	}
+}
+
+func TestInstantQueryCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := newQueryClient(server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(user.WithID(context.Background(), "user"))
+	errs := make(chan error)
+	go func() {
+		_, err := client.instantQuery(ctx, "foo", 0)
+		errs <- err
+	}()
+	cancel()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected an error from a cancelled query")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not cancelled")
+	}
+}
@@ -3,30 +3,105 @@ package ruler
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/storage"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/experimental"
 	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/user"
 	"github.com/weaveworks/cortex/util"
 )
 
+var (
+	evalDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "ruler_rule_evaluation_duration_seconds",
+		Help:      "The duration of rule evaluations.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	evalFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "ruler_rule_evaluation_failures_total",
+		Help:      "The total number of rule evaluation failures.",
+	})
+	configUpdateLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "ruler_config_update_latency_seconds",
+		Help:      "Time from a changed config being fetched to its rules first being evaluated.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(evalDuration)
+	prometheus.MustRegister(evalFailures)
+	prometheus.MustRegister(configUpdateLatency)
+}
+
 // Config is the configuration for the recording rules server.
 type Config struct {
 	DistributorConfig distributor.Config
 	ConfigsAPIURL     string
+	ConfigsTLS        util.TLSConfig
 	ExternalURL       string
 	// How frequently to evaluate rules by default.
 	EvaluationInterval time.Duration
+	// How frequently to check for config changes, and how long a changed
+	// config must stay unchanged before its rules are loaded and evaluated.
+	ConfigPollInterval time.Duration
+	ConfigDebounce     time.Duration
+	// If non-zero, each tenant's worker prunes versions of their config
+	// older than this from the configs API server's history, hourly.
+	ConfigHistoryRetention time.Duration
+	// How far behind the current time to evaluate rules by default, so that
+	// they don't see the most recent, still-arriving samples.  Can be
+	// overridden per tenant and per rules file in the tenant's config.
+	EvaluationDelay time.Duration
+	// If set, rules are evaluated by querying the querier at this URL (eg
+	// http://querier/api/prom) rather than with an embedded query engine.
+	// Alerting rules are not supported in this mode.
+	QuerierURL   string
+	QueryTimeout time.Duration
+	// If set, notifications for firing alerts are sent to the Alertmanager
+	// at this URL.  They are queued, and retried until sent or older than
+	// NotificationMaxAge, or dropped if the Alertmanager rejects them.
+	// Each tenant's are queued separately, so one tenant's failures don't
+	// hold up the others, and if NotificationQueueCapacity is non-zero,
+	// each tenant's oldest are dropped once it has that many queued.  If
+	// NotificationQueueDir is set, the queue is persisted there so
+	// notifications survive restarts.
+	AlertmanagerURL           string
+	NotificationQueueDir      string
+	NotificationMaxAge        time.Duration
+	NotificationQueueCapacity int
+	// Tenants each tenant's rules may write their results into, eg for
+	// cross-team rollups in an aggregate tenant.  Rules files opt in via
+	// output_tenants in the tenant's config.
+	CrossTenantWrites map[string][]string
+	// If set, the series recording rules write are renamed into this metric
+	// name namespace, eg "recorded" gives "recorded:job:requests:rate5m".
+	// If non-zero, each tenant's recording rules may write at most
+	// MaxRecordedSeries series per evaluation; samples of further series
+	// are dropped.  Both can be overridden per tenant.
+	RecordingNamespace string
+	MaxRecordedSeries  int
+	// Caches the series rules read, so consecutive evaluations don't re-read
+	// them from the ingesters and chunk store.
+	SeriesCache querier.SeriesCacheConfig
 	// XXX: Currently single tenant only (which is awful) as the most
 	// expedient way of getting *something* working.
 	UserID string
@@ -39,7 +114,10 @@ type Ruler struct {
 	distributor *distributor.Distributor
 
 	configsAPIURL *url.URL
+	configsClient *http.Client
 	externalURL   *url.URL
+	queryClient   *queryClient
+	notifications *notificationQueue
 }
 
 // Worker does a thing until it's told to stop.
@@ -49,23 +127,82 @@ type Worker interface {
 }
 
 type worker struct {
-	delay         time.Duration
-	userID        string
-	configsAPIURL *url.URL
-	opts          *rules.ManagerOptions
+	delay                  time.Duration
+	evaluationDelay        time.Duration
+	configPollInterval     time.Duration
+	configDebounce         time.Duration
+	userID                 string
+	outputTenants          []string
+	recordingNamespace     string
+	maxRecordedSeries      int
+	distributor            *distributor.Distributor
+	configsAPIURL          *url.URL
+	configsClient          *http.Client
+	configHistoryRetention time.Duration
+	opts                   *rules.ManagerOptions
+	cancel                 context.CancelFunc
+	queryClient            *queryClient
+	notifications          *notificationQueue
+
+	// Set from the tenant's config when its rules are loaded.
+	recording *recordingLimits
 
 	done       chan struct{}
 	terminated chan struct{}
 }
 
+// ruleGroup is a set of rules evaluated with the same evaluation delay, and
+// written to the same tenant.
+type ruleGroup struct {
+	name            string
+	rules           []rules.Rule
+	evaluationDelay time.Duration
+
+	// Set if the group's results are written to another tenant.
+	outputTenant string
+	appender     crossTenantAppender
+}
+
 func (w *worker) Run() {
 	defer close(w.terminated)
-	var rs []rules.Rule
-	var group *rules.Group
+	var (
+		groups  []ruleGroup
+		version string
+
+		// A changed config waiting for further changes to settle.
+		pending         *cortexConfig
+		pendingVersion  string
+		pendingDetected time.Time
+		debounce        <-chan time.Time
+	)
+	// There's no config yet, so the first one found is used without
+	// debouncing.  It's looked for straight away, then every tick.
+	loadFirst := func() {
+		cfg, v, err := getOrgConfig(w.configsClient, w.configsAPIURL, w.userID)
+		if err == errConfigNotFound {
+			return
+		} else if err != nil {
+			log.Warnf("Could not get configuration for %v: %v", w.userID, err)
+			return
+		}
+		if groups, err = w.loadRules(cfg); err != nil {
+			log.Warnf("Could not load rules for %v: %v", w.userID, err)
+			return
+		}
+		version = v
+	}
+	loadFirst()
 	tick := time.NewTicker(w.delay)
 	defer tick.Stop()
+	poll := time.NewTicker(w.configPollInterval)
+	defer poll.Stop()
+	var prune <-chan time.Time
+	if w.configHistoryRetention > 0 {
+		pruneTicker := time.NewTicker(configHistoryPruneInterval)
+		defer pruneTicker.Stop()
+		prune = pruneTicker.C
+	}
 	for {
-		var err error
 		select {
 		case <-w.done:
 			return
@@ -76,34 +213,212 @@ func (w *worker) Run() {
 		case <-w.done:
 			return
 		case <-tick.C:
-			if group == nil {
-				rs, err = w.loadRules()
-				if err != nil {
-					log.Warnf("Could not get configuration for %v: %v", w.userID, err)
-					continue
-				}
-				group = rules.NewGroup("default", w.delay, rs, w.opts)
-			} else {
-				group.Eval()
+			if version == "" {
+				loadFirst()
+				continue
+			}
+			w.evaluateGroups(groups)
+		case <-poll.C:
+			if version == "" {
+				continue
+			}
+			cfg, v, err := getOrgConfig(w.configsClient, w.configsAPIURL, w.userID)
+			if err == errConfigNotFound {
+				// The tenant's config has been deleted, eg because they've
+				// been off-boarded, so stop evaluating their rules until
+				// they have one again.
+				log.Infof("Configuration for %v deleted, dropping its rules", w.userID)
+				groups, version = nil, ""
+				pending, pendingVersion, debounce = nil, "", nil
+				continue
+			} else if err != nil {
+				log.Warnf("Could not get configuration for %v: %v", w.userID, err)
+				continue
+			}
+			if v == version {
+				// Changed back before the debounce fired, so the pending
+				// config is superseded.
+				pending, pendingVersion, debounce = nil, "", nil
+				continue
+			}
+			if v == pendingVersion {
+				continue
+			}
+			if pending == nil {
+				pendingDetected = time.Now()
+			}
+			pending, pendingVersion = cfg, v
+			debounce = time.After(w.configDebounce)
+		case <-prune:
+			w.pruneConfigHistory()
+		case <-debounce:
+			// Don't retry a broken config until it changes again.
+			version = pendingVersion
+			gs, err := w.loadRules(pending)
+			pending, pendingVersion, debounce = nil, "", nil
+			if err != nil {
+				log.Warnf("Could not load rules for %v: %v", w.userID, err)
+				continue
 			}
+			// Evaluate the new rules now, rather than up to an interval later.
+			groups = gs
+			w.evaluateGroups(groups)
+			configUpdateLatency.Observe(time.Since(pendingDetected).Seconds())
 		}
 	}
 }
 
-func (w *worker) loadRules() ([]rules.Rule, error) {
-	cfg, err := getOrgConfig(w.configsAPIURL, w.userID)
-	if err != nil {
-		return nil, fmt.Errorf("Error fetching config: %v", err)
+func (w *worker) evaluateGroups(groups []ruleGroup) {
+	now := model.Now()
+	for _, g := range groups {
+		w.evaluate(g, now.Add(-g.evaluationDelay))
+		if g.outputTenant != "" {
+			log.Infof("Rules file %s of %v wrote %d samples to tenant %v", g.name, w.userID, g.appender.written(), g.outputTenant)
+		}
+	}
+	if w.recording != nil {
+		if discarded := w.recording.reset(); discarded > 0 {
+			log.Warnf("Discarded %d samples of recording rules of %v, over the limit of %d series", discarded, w.userID, w.recording.maxSeries)
+		}
+	}
+}
+
+// evaluate evaluates all the rules in a group, in parallel, at the given
+// time.  It mirrors rules.Group.Eval, which always evaluates at the current
+// time.
+func (w *worker) evaluate(g ruleGroup, ts model.Time) {
+	var appender storage.SampleAppender = w.opts.SampleAppender
+	if g.outputTenant != "" {
+		appender = g.appender
+	}
+	recordingAppender := appender
+	if w.recording != nil {
+		recordingAppender = w.recording.appender(appender)
+	}
+	var wg sync.WaitGroup
+	for _, rule := range g.rules {
+		wg.Add(1)
+		go func(rule rules.Rule) {
+			defer wg.Done()
+			defer func(t time.Time) {
+				evalDuration.Observe(time.Since(t).Seconds())
+			}(time.Now())
+
+			vector, err := rule.Eval(w.opts.Context, ts, w.opts.QueryEngine, w.opts.ExternalURL.Path)
+			if err != nil {
+				log.Warnf("Error evaluating rule %q for %v: %v", rule, w.userID, err)
+				evalFailures.Inc()
+				return
+			}
+			// Only recording rules' series are namespaced and limited, not
+			// alerting rules' ALERTS series.
+			ruleAppender := recordingAppender
+			if _, ok := rule.(notifyingRule); ok {
+				ruleAppender = appender
+			}
+			for _, sample := range vector {
+				if err := ruleAppender.Append(sample); err != nil {
+					log.Warnf("Rule evaluation result discarded for %v: %v", w.userID, err)
+				}
+			}
+			if rule, ok := rule.(notifyingRule); ok && w.notifications != nil {
+				if alerts := rule.alerts(w.opts.ExternalURL.String()); len(alerts) > 0 {
+					w.notifications.enqueue(w.userID, alerts)
+				}
+			}
+		}(rule)
+	}
+	wg.Wait()
+}
+
+func (w *worker) loadRules(cfg *cortexConfig) ([]ruleGroup, error) {
+	evaluationDelay := w.evaluationDelay
+	if cfg.EvaluationDelay != "" {
+		d, err := model.ParseDuration(cfg.EvaluationDelay)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing evaluation delay: %v", err)
+		}
+		evaluationDelay = time.Duration(d)
+	}
+	namespace, maxSeries := w.recordingNamespace, w.maxRecordedSeries
+	if cfg.RecordingNamespace != "" {
+		namespace = cfg.RecordingNamespace
+	}
+	if cfg.MaxRecordedSeries != 0 {
+		maxSeries = cfg.MaxRecordedSeries
+	}
+	var recording *recordingLimits
+	if namespace != "" || maxSeries > 0 {
+		var err error
+		if recording, err = newRecordingLimits(w.userID, namespace, maxSeries); err != nil {
+			return nil, err
+		}
 	}
-	rs, err := loadRules(cfg.RulesFiles)
+
+	defs, err := templateDefs(w.userID, w.opts.ExternalURL.String(), cfg.TemplateVariables)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing rules: %v", err)
+		return nil, err
+	}
+
+	groups := make([]ruleGroup, 0, len(cfg.RulesFiles))
+	for fn, content := range cfg.RulesFiles {
+		rs, err := loadRules(map[string]string{fn: content}, w.queryClient, defs)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing rules: %v", err)
+		}
+		group := ruleGroup{
+			name:            fn,
+			rules:           rs,
+			evaluationDelay: evaluationDelay,
+		}
+		if delay, ok := cfg.GroupEvaluationDelays[fn]; ok {
+			d, err := model.ParseDuration(delay)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing evaluation delay for %s: %v", fn, err)
+			}
+			group.evaluationDelay = time.Duration(d)
+		}
+		if target, ok := cfg.OutputTenants[fn]; ok && target != w.userID {
+			if err := w.checkOutputTenant(fn, target, rs); err != nil {
+				return nil, err
+			}
+			log.Infof("Rules file %s of %v writes its results to tenant %v", fn, w.userID, target)
+			group.outputTenant = target
+			group.appender = newCrossTenantAppender(appenderAdapter{
+				distributor: w.distributor,
+				ctx:         user.WithID(context.Background(), target),
+			}, w.userID, target)
+		}
+		groups = append(groups, group)
+	}
+	w.recording = recording
+	return groups, nil
+}
+
+// checkOutputTenant checks that the rules in a rules file may write their
+// results into the target tenant.
+func (w *worker) checkOutputTenant(fn, target string, rs []rules.Rule) error {
+	allowed := false
+	for _, t := range w.outputTenants {
+		allowed = allowed || t == target
+	}
+	if !allowed {
+		return fmt.Errorf("Rules file %s may not write to tenant %s", fn, target)
+	}
+	for _, rule := range rs {
+		// Alerts' notifications go to the rules' own tenant, so only
+		// recording rules may write elsewhere.
+		if _, ok := rule.(notifyingRule); ok {
+			return fmt.Errorf("Rules file %s writes to tenant %s, but has alerting rule %s", fn, target, rule.Name())
+		}
 	}
-	return rs, nil
+	return nil
 }
 
+// Stop stops the worker, cancelling any evaluation in progress.
 func (w *worker) Stop() {
 	close(w.done)
+	w.cancel()
 	<-w.terminated
 }
 
@@ -117,6 +432,37 @@ func New(chunkStore chunk.Store, cfg Config) (*Ruler, error) {
 	if err != nil {
 		return nil, err
 	}
+	configsTLS, err := cfg.ConfigsTLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	configsClient := &http.Client{}
+	if configsTLS != nil {
+		configsClient.Transport = &http.Transport{TLSClientConfig: configsTLS}
+	}
+
+	if cfg.ConfigPollInterval <= 0 {
+		cfg.ConfigPollInterval = cfg.EvaluationInterval
+	}
+
+	var client *queryClient
+	if cfg.QuerierURL != "" {
+		if err := experimental.RemoteRuler.Require("-ruler.querier.url"); err != nil {
+			return nil, err
+		}
+		client, err = newQueryClient(cfg.QuerierURL, cfg.QueryTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var notifications *notificationQueue
+	if cfg.AlertmanagerURL != "" {
+		notifications, err = newNotificationQueue(cfg.AlertmanagerURL, cfg.NotificationQueueDir, cfg.NotificationMaxAge, cfg.NotificationQueueCapacity)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	d, err := distributor.New(cfg.DistributorConfig)
 	if err != nil {
@@ -127,27 +473,55 @@ func New(chunkStore chunk.Store, cfg Config) (*Ruler, error) {
 		chunkStore:    chunkStore,
 		distributor:   d,
 		configsAPIURL: configsAPIURL,
+		configsClient: configsClient,
 		externalURL:   externalURL,
+		queryClient:   client,
+		notifications: notifications,
 	}, nil
 }
 
+// Stop stops sending alert notifications.  Any not yet sent are redelivered
+// on restart, if the notification queue is persisted.
+func (r *Ruler) Stop() {
+	if r.notifications != nil {
+		r.notifications.stop()
+	}
+}
+
 // GetWorkerFor gets a rules recording worker for the given user.
 // It will keep polling until it can construct one.
 func (r *Ruler) GetWorkerFor(userID string) Worker {
 	delay := time.Duration(r.cfg.EvaluationInterval)
+	ctx, cancel := context.WithCancel(user.WithID(context.Background(), userID))
 	return &worker{
-		delay:         delay,
-		userID:        userID,
-		configsAPIURL: r.configsAPIURL,
-		opts:          r.getManagerOptions(userID),
+		delay:                  delay,
+		evaluationDelay:        r.cfg.EvaluationDelay,
+		configPollInterval:     r.cfg.ConfigPollInterval,
+		configDebounce:         r.cfg.ConfigDebounce,
+		userID:                 userID,
+		outputTenants:          r.cfg.CrossTenantWrites[userID],
+		recordingNamespace:     r.cfg.RecordingNamespace,
+		maxRecordedSeries:      r.cfg.MaxRecordedSeries,
+		distributor:            r.distributor,
+		configsAPIURL:          r.configsAPIURL,
+		configsClient:          r.configsClient,
+		configHistoryRetention: r.cfg.ConfigHistoryRetention,
+		opts:                   r.getManagerOptions(ctx),
+		cancel:                 cancel,
+		queryClient:            r.queryClient,
+		notifications:          r.notifications,
+		done:                   make(chan struct{}),
+		terminated:             make(chan struct{}),
 	}
 }
 
-func (r *Ruler) getManagerOptions(userID string) *rules.ManagerOptions {
-	ctx := user.WithID(context.Background(), userID)
+func (r *Ruler) getManagerOptions(ctx context.Context) *rules.ManagerOptions {
 	appender := appenderAdapter{distributor: r.distributor, ctx: ctx}
-	queryable := querier.NewQueryable(r.distributor, r.chunkStore)
-	engine := promql.NewEngine(queryable, nil)
+	var engine *promql.Engine
+	if r.queryClient == nil {
+		queryable := querier.NewQueryable(r.distributor, r.chunkStore, r.cfg.DistributorConfig.DuplicatePolicy, querier.SeriesCache(r.cfg.SeriesCache))
+		engine = promql.NewEngine(queryable, nil)
+	}
 	return &rules.ManagerOptions{
 		SampleAppender: appender,
 		Notifier:       nil,
@@ -157,10 +531,12 @@ func (r *Ruler) getManagerOptions(userID string) *rules.ManagerOptions {
 	}
 }
 
-// loadRules loads rules.
+// loadRules loads rules.  If client is non-nil, recording rules are
+// evaluated with it, and alerting rules are skipped.  Alerting rules'
+// annotation templates are prefixed with templateDefs.
 //
 // Strongly inspired by `loadGroups` in Prometheus.
-func loadRules(files map[string]string) ([]rules.Rule, error) {
+func loadRules(files map[string]string, client *queryClient, templateDefs string) ([]rules.Rule, error) {
 	result := []rules.Rule{}
 	for fn, content := range files {
 		stmts, err := promql.ParseStmts(string(content))
@@ -173,10 +549,27 @@ func loadRules(files map[string]string) ([]rules.Rule, error) {
 
 			switch r := stmt.(type) {
 			case *promql.AlertStmt:
-				rule = rules.NewAlertingRule(r.Name, r.Expr, r.Duration, r.Labels, r.Annotations)
+				if client != nil {
+					log.Warnf("Skipping alerting rule %s in %s: not supported when evaluating rules remotely", r.Name, fn)
+					continue
+				}
+				rule = notifyingRule{
+					AlertingRule: rules.NewAlertingRule(r.Name, r.Expr, r.Duration, r.Labels, withTemplateDefs(templateDefs, r.Annotations)),
+					holdDuration: r.Duration,
+					expr:         r.Expr,
+				}
 
 			case *promql.RecordStmt:
-				rule = rules.NewRecordingRule(r.Name, r.Expr, r.Labels)
+				if client != nil {
+					rule = remoteRecordingRule{
+						name:   r.Name,
+						vector: r.Expr,
+						labels: r.Labels,
+						client: client,
+					}
+				} else {
+					rule = rules.NewRecordingRule(r.Name, r.Expr, r.Labels)
+				}
 
 			default:
 				panic("ruler.loadRules: unknown statement type")
@@ -206,29 +599,57 @@ func (a appenderAdapter) NeedsThrottling() bool {
 
 type cortexConfig struct {
 	RulesFiles map[string]string `json:"rules_files"`
+
+	// Overrides for the ruler's evaluation delay, for the whole tenant and
+	// per rules file, as Prometheus durations (eg "30s").
+	EvaluationDelay       string            `json:"evaluation_delay,omitempty"`
+	GroupEvaluationDelays map[string]string `json:"group_evaluation_delays,omitempty"`
+
+	// Tenants to write the results of rules files' recording rules into,
+	// instead of this one, by rules file.  Each must be allowed by the
+	// ruler's configuration.
+	OutputTenants map[string]string `json:"output_tenants,omitempty"`
+
+	// Overrides for the ruler's recording namespace and recorded series
+	// limit.
+	RecordingNamespace string `json:"recording_namespace,omitempty"`
+	MaxRecordedSeries  int    `json:"max_recorded_series,omitempty"`
+
+	// Static metadata about the tenant, eg its dashboards' org ID, which
+	// alert annotation templates may use as variables, eg
+	// $grafana_org; see templateDefs.
+	TemplateVariables map[string]string `json:"template_variables,omitempty"`
 }
 
-// getOrgConfig gets the organization's cortex config from a configs api server.
-func getOrgConfig(configsAPIURL *url.URL, userID string) (*cortexConfig, error) {
+// errConfigNotFound is returned by getOrgConfig when the organization has
+// no cortex config, eg because it has been deleted.
+var errConfigNotFound = fmt.Errorf("config not found")
+
+// getOrgConfig gets the organization's cortex config from a configs api
+// server, and a version which changes whenever the config does.
+func getOrgConfig(client *http.Client, configsAPIURL *url.URL, userID string) (*cortexConfig, string, error) {
 	// TODO: Extract configs client logic into go client library (ala users)
 	// TODO: Fix configs server so that we not need org ID in the URL to get authenticated org
-	url := fmt.Sprintf("%s/api/configs/org/%s/cortex", configsAPIURL.String(), userID)
-	req, err := http.NewRequest("GET", url, nil)
+	res, err := doConfigsRequest(client, "GET", orgConfigURL(configsAPIURL, userID), userID)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	req.Header.Add("X-Scope-OrgID", userID)
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", errConfigNotFound
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+		return nil, "", fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
 	}
 	var config cortexConfig
-	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
-		return nil, err
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, "", err
 	}
-	return &config, nil
+	h := fnv.New64a()
+	h.Write(body)
+	return &config, fmt.Sprintf("%x", h.Sum64()), nil
 }
@@ -0,0 +1,162 @@
+package ruler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/rules"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// fakeConfigs serves a tenant's rules config, with a recording rule of each
+// of the given names.
+type fakeConfigs struct {
+	mtx   sync.Mutex
+	rules []string
+}
+
+func (f *fakeConfigs) set(rules ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rules = rules
+}
+
+func (f *fakeConfigs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	cfg := cortexConfig{RulesFiles: map[string]string{}}
+	for _, name := range f.rules {
+		cfg.RulesFiles[name+".rules"] = name + " = vector(1)"
+	}
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// fakeAppender records the names of the series appended.
+type fakeAppender struct {
+	mtx   sync.Mutex
+	names []model.LabelValue
+}
+
+func (a *fakeAppender) Append(s *model.Sample) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.names = append(a.names, s.Metric[model.MetricNameLabel])
+	return nil
+}
+
+func (a *fakeAppender) NeedsThrottling() bool { return false }
+
+func (a *fakeAppender) appended() []model.LabelValue {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return append([]model.LabelValue(nil), a.names...)
+}
+
+// runTestWorker runs a worker evaluating the rules configs serves, with
+// a querier returning 1 for every query.  Rules are only evaluated on the
+// tick an hour after starting, or when a changed config is loaded.
+func runTestWorker(t *testing.T, configs *fakeConfigs, debounce time.Duration) (*fakeAppender, func()) {
+	configsServer := httptest.NewServer(configs)
+	querier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`))
+	}))
+	configsAPIURL, err := url.Parse(configsServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newQueryClient(querier.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appender := &fakeAppender{}
+	ctx, cancel := context.WithCancel(user.WithID(context.Background(), "user"))
+	w := &worker{
+		delay:              time.Hour,
+		configPollInterval: 10 * time.Millisecond,
+		configDebounce:     debounce,
+		userID:             "user",
+		configsAPIURL:      configsAPIURL,
+		configsClient:      &http.Client{},
+		opts: &rules.ManagerOptions{
+			SampleAppender: appender,
+			Context:        ctx,
+			ExternalURL:    &url.URL{},
+		},
+		cancel:      cancel,
+		queryClient: client,
+		done:        make(chan struct{}),
+		terminated:  make(chan struct{}),
+	}
+	go w.Run()
+	return appender, func() {
+		w.Stop()
+		querier.Close()
+		configsServer.Close()
+	}
+}
+
+// waitForAppended waits for the rule name to be appended, returning how long
+// it took.
+func waitForAppended(t *testing.T, appender *fakeAppender, name model.LabelValue) time.Duration {
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		for _, n := range appender.appended() {
+			if n == name {
+				return time.Since(start)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s never appended, got %v", name, appender.appended())
+	return 0
+}
+
+func TestWorkerConfigDebounce(t *testing.T) {
+	configs := &fakeConfigs{}
+	configs.set("a")
+	appender, stop := runTestWorker(t, configs, 200*time.Millisecond)
+	defer stop()
+
+	// The first config is loaded straight away, but only evaluated on the
+	// next tick.  A changed config is loaded once it has been unchanged for
+	// the debounce period, and its rules evaluated straight away, rather
+	// than on the next tick.
+	time.Sleep(50 * time.Millisecond)
+	configs.set("b")
+	if took := waitForAppended(t, appender, "b"); took < 200*time.Millisecond {
+		t.Fatalf("expected the changed config to be debounced, but it was loaded after %v", took)
+	}
+	if names := appender.appended(); len(names) != 1 {
+		t.Fatalf("expected only the changed config's rules to be evaluated, got %v", names)
+	}
+}
+
+func TestWorkerConfigDebounceSuperseded(t *testing.T) {
+	configs := &fakeConfigs{}
+	configs.set("a")
+	appender, stop := runTestWorker(t, configs, 300*time.Millisecond)
+	defer stop()
+
+	// A config changed back before the debounce fires is never loaded.
+	time.Sleep(50 * time.Millisecond)
+	configs.set("b")
+	time.Sleep(100 * time.Millisecond)
+	configs.set("a")
+	time.Sleep(500 * time.Millisecond)
+	if names := appender.appended(); len(names) != 0 {
+		t.Fatalf("expected no rules to be evaluated, got %v", names)
+	}
+
+	// Later changes are still loaded.
+	configs.set("c")
+	waitForAppended(t, appender, "c")
+}
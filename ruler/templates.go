@@ -0,0 +1,63 @@
+package ruler
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+var templateVariableRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Template variables defined by Prometheus or the ruler, which tenants'
+// own template variables may not replace.
+var reservedTemplateVariables = map[string]bool{
+	"labels":      true,
+	"value":       true,
+	"tenant":      true,
+	"externalURL": true,
+}
+
+// templateDefs returns template actions defining the variables alert
+// annotation templates may use besides Prometheus' $labels and $value:
+// $tenant, the tenant's ID, $externalURL, the ruler's external URL, and the
+// tenant's own template variables from its config, eg to link alerts to the
+// tenant's dashboards.  Prometheus only gives templates the alert's data,
+// so the variables are defined by prefixing the templates with these.
+func templateDefs(userID, externalURL string, vars map[string]string) (string, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if !templateVariableRE.MatchString(name) {
+			return "", fmt.Errorf("invalid template variable name %q", name)
+		}
+		if reservedTemplateVariables[name] {
+			return "", fmt.Errorf("template variable $%s is reserved", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{{$tenant := %s}}{{$externalURL := %s}}", strconv.Quote(userID), strconv.Quote(externalURL))
+	for _, name := range names {
+		fmt.Fprintf(&buf, "{{$%s := %s}}", name, strconv.Quote(vars[name]))
+	}
+	return buf.String(), nil
+}
+
+// withTemplateDefs returns ls with defs prefixed to each value which is a
+// template, leaving plain values as they are.
+func withTemplateDefs(defs string, ls model.LabelSet) model.LabelSet {
+	result := make(model.LabelSet, len(ls))
+	for name, value := range ls {
+		if strings.Contains(string(value), "{{") {
+			value = model.LabelValue(defs) + value
+		}
+		result[name] = value
+	}
+	return result
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// Policies for samples of a series with the same timestamp as an earlier
+// one, but a different value.
+const (
+	// RejectDuplicates rejects the later sample with an error.  This is the
+	// default.
+	RejectDuplicates = "reject"
+	// KeepFirstDuplicate silently drops the later sample.
+	KeepFirstDuplicate = "keep-first"
+	// KeepLastDuplicate replaces the earlier sample with the later one.
+	KeepLastDuplicate = "keep-last"
+)
+
+// ValidateDuplicatePolicy returns an error if policy isn't one of the
+// above.
+func ValidateDuplicatePolicy(policy string) error {
+	switch policy {
+	case RejectDuplicates, KeepFirstDuplicate, KeepLastDuplicate:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate sample policy %q: must be %s, %s or %s", policy, RejectDuplicates, KeepFirstDuplicate, KeepLastDuplicate)
+}
+
+// MergeSamplesWithPolicy merges and dedupes two sets of already sorted sample
+// pairs, where b's samples came after a's.  Of two samples with the same
+// timestamp, KeepLastDuplicate keeps b's, and the other policies keep a's, as
+// duplicates which have been stored can no longer be rejected.
+func MergeSamplesWithPolicy(a, b []model.SamplePair, policy string) []model.SamplePair {
+	if policy != KeepLastDuplicate {
+		return MergeSamples(a, b)
+	}
+	return MergeSamples(b, a)
+}
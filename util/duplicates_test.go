@@ -0,0 +1,29 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMergeSamplesWithPolicy(t *testing.T) {
+	a := []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}
+	b := []model.SamplePair{{Timestamp: 2, Value: 20}, {Timestamp: 3, Value: 30}}
+	for _, tc := range []struct {
+		policy   string
+		expected []model.SamplePair
+	}{
+		{RejectDuplicates, []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 30}}},
+		{KeepFirstDuplicate, []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 30}}},
+		{KeepLastDuplicate, []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 20}, {Timestamp: 3, Value: 30}}},
+	} {
+		if have := MergeSamplesWithPolicy(a, b, tc.policy); !reflect.DeepEqual(have, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.policy, tc.expected, have)
+		}
+	}
+
+	if err := ValidateDuplicatePolicy("keep-some"); err == nil {
+		t.Error("expected an invalid policy to be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// ErrorCode classifies errors returned to users, so that clients, and our
+// own retry logic, can tell which failures are worth retrying.  The codes
+// are part of the API, and must not change.
+type ErrorCode string
+
+// Error codes.
+const (
+	// The user is sending or querying too fast; retry later.
+	ErrRateLimited ErrorCode = "rate_limited"
+	// The request exceeds a limit, and will fail again if retried.
+	ErrLimitExceeded ErrorCode = "limit_exceeded"
+	// The request is invalid, and will fail again if retried.
+	ErrBadData ErrorCode = "bad_data"
+	// Something went wrong on our side; the request may be retried.
+	ErrInternal ErrorCode = "internal"
+	// Not enough of the system is available to serve the request; retry
+	// later.
+	ErrUnavailable ErrorCode = "unavailable"
+)
+
+// Retryable returns true if a request failing with this code may succeed if
+// retried.
+func (c ErrorCode) Retryable() bool {
+	switch c {
+	case ErrBadData, ErrLimitExceeded:
+		return false
+	default:
+		return true
+	}
+}
+
+// HTTPStatus returns the HTTP status code for errors with this code.
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrLimitExceeded:
+		return http.StatusUnprocessableEntity
+	case ErrBadData:
+		return http.StatusBadRequest
+	case ErrUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCCode returns the gRPC status code for errors with this code.
+func (c ErrorCode) GRPCCode() codes.Code {
+	switch c {
+	case ErrRateLimited:
+		return codes.ResourceExhausted
+	case ErrLimitExceeded:
+		return codes.FailedPrecondition
+	case ErrBadData:
+		return codes.InvalidArgument
+	case ErrUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// CodedError is implemented by errors which know their ErrorCode.
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+}
+
+// Error is an error with an ErrorCode.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+// NewError makes a new Error.
+func NewError(code ErrorCode, format string, args ...interface{}) error {
+	return Error{
+		Code: code,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+func (e Error) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorCode implements CodedError.
+func (e Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// ErrorCodeOf returns the code for an error.  Errors without one are
+// internal errors, except for timeouts, and errors from gRPC calls, which
+// are classified by their gRPC status code.
+func ErrorCodeOf(err error) ErrorCode {
+	if e, ok := err.(CodedError); ok {
+		return e.ErrorCode()
+	}
+	if err == context.DeadlineExceeded {
+		return ErrUnavailable
+	}
+	switch grpc.Code(err) {
+	case codes.ResourceExhausted:
+		return ErrRateLimited
+	case codes.FailedPrecondition:
+		return ErrLimitExceeded
+	case codes.InvalidArgument:
+		return ErrBadData
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return ErrUnavailable
+	default:
+		return ErrInternal
+	}
+}
+
+// ErrorCodeForHTTPStatus returns the code for an error response from an
+// HTTP server.
+func ErrorCodeForHTTPStatus(status int) ErrorCode {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case status == http.StatusUnprocessableEntity:
+		return ErrLimitExceeded
+	case status/100 == 4:
+		return ErrBadData
+	case status == http.StatusServiceUnavailable, status == http.StatusGatewayTimeout:
+		return ErrUnavailable
+	default:
+		return ErrInternal
+	}
+}
+
+// errorResponse is the body of error responses, in the style of the
+// Prometheus API.
+type errorResponse struct {
+	Status    string    `json:"status"`
+	ErrorType ErrorCode `json:"errorType"`
+	Error     string    `json:"error"`
+}
+
+// WriteError writes an error response, with the status code and a
+// machine-readable body for the error's code.
+func WriteError(w http.ResponseWriter, err error) {
+	code := ErrorCodeOf(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code.HTTPStatus())
+	json.NewEncoder(w).Encode(errorResponse{
+		Status:    "error",
+		ErrorType: code,
+		Error:     err.Error(),
+	})
+}
+
+// ToGRPCError converts an error to a gRPC error with the status code for its
+// ErrorCode.  gRPC errors are returned unchanged.
+func ToGRPCError(err error) error {
+	if err == nil || grpc.Code(err) != codes.Unknown {
+		return err
+	}
+	return grpc.Errorf(ErrorCodeOf(err).GRPCCode(), "%s", err.Error())
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		code      ErrorCode
+		status    int
+		retryable bool
+	}{
+		{NewError(ErrBadData, "bad"), ErrBadData, http.StatusBadRequest, false},
+		{NewError(ErrLimitExceeded, "too big"), ErrLimitExceeded, http.StatusUnprocessableEntity, false},
+		{NewError(ErrRateLimited, "too fast"), ErrRateLimited, http.StatusTooManyRequests, true},
+		{NewError(ErrUnavailable, "down"), ErrUnavailable, http.StatusServiceUnavailable, true},
+		{fmt.Errorf("oops"), ErrInternal, http.StatusInternalServerError, true},
+	} {
+		// Codes survive a round trip through gRPC.
+		for _, err := range []error{tc.err, ToGRPCError(tc.err)} {
+			if code := ErrorCodeOf(err); code != tc.code {
+				t.Errorf("%v: expected code %s, got %s", err, tc.code, code)
+			}
+		}
+		if retryable := tc.code.Retryable(); retryable != tc.retryable {
+			t.Errorf("%s: expected retryable=%v", tc.code, tc.retryable)
+		}
+		if code := ErrorCodeForHTTPStatus(tc.status); code != tc.code {
+			t.Errorf("HTTP status %d: expected code %s, got %s", tc.status, tc.code, code)
+		}
+
+		w := httptest.NewRecorder()
+		WriteError(w, tc.err)
+		if w.Code != tc.status {
+			t.Errorf("%v: expected status %d, got %d", tc.err, tc.status, w.Code)
+		}
+		var resp errorResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ErrorType != tc.code || resp.Error != tc.err.Error() {
+			t.Errorf("%v: unexpected response %+v", tc.err, resp)
+		}
+	}
+}
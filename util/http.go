@@ -2,9 +2,12 @@ package util
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
-	"io"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
@@ -14,7 +17,10 @@ import (
 	"github.com/weaveworks/cortex/user"
 )
 
-// ParseProtoRequest parses a proto from the body of a http request.
+// ParseProtoRequest parses a proto from the body of a http request.  If
+// compressed, the body is decoded according to its Content-Encoding, which
+// may be snappy (the default, as sent by Prometheus), gzip or identity;
+// others are rejected with a 415.
 func ParseProtoRequest(w http.ResponseWriter, r *http.Request, req proto.Message, compressed bool) (ctx context.Context, abort bool) {
 	userID := r.Header.Get(user.UserIDHeaderName)
 	if userID == "" {
@@ -27,27 +33,74 @@ func ParseProtoRequest(w http.ResponseWriter, r *http.Request, req proto.Message
 		return ctx, false
 	}
 
-	var reader io.Reader = r.Body
-	if compressed {
-		reader = snappy.NewReader(r.Body)
-	}
-
 	buf := bytes.Buffer{}
-	if _, err := buf.ReadFrom(reader); err != nil {
-		log.Errorf(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		log.Errorf("Error reading request: %v", err)
+		WriteError(w, Error{Code: ErrBadData, Err: err})
 		return nil, true
 	}
 
-	if err := proto.Unmarshal(buf.Bytes(), req); err != nil {
-		log.Errorf(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	data := buf.Bytes()
+	if compressed {
+		encoding := r.Header.Get("Content-Encoding")
+		decode, ok := bodyDecoders[strings.ToLower(strings.TrimSpace(encoding))]
+		if !ok {
+			w.Header().Set("Accept-Encoding", supportedEncodings)
+			http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q, must be one of: %s", encoding, supportedEncodings), http.StatusUnsupportedMediaType)
+			return nil, true
+		}
+		var err error
+		if data, err = decode(data); err != nil {
+			log.Errorf("Error decompressing request: %v", err)
+			WriteError(w, Error{Code: ErrBadData, Err: err})
+			return nil, true
+		}
+	}
+
+	// Unknown fields, such as the metadata sent by newer remote_write
+	// revisions, are ignored.
+	if err := proto.Unmarshal(data, req); err != nil {
+		log.Errorf("Error unmarshalling request: %v", err)
+		WriteError(w, Error{Code: ErrBadData, Err: err})
 		return nil, true
 	}
 
 	return ctx, false
 }
 
+// bodyDecoders decode compressed request bodies, by Content-Encoding.
+var bodyDecoders = map[string]func([]byte) ([]byte, error){
+	"":         DecodeSnappy,
+	"snappy":   DecodeSnappy,
+	"gzip":     decodeGzip,
+	"identity": func(data []byte) ([]byte, error) { return data, nil },
+}
+
+const supportedEncodings = "snappy, gzip, identity"
+
+func decodeGzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// snappyStreamMagic starts every snappy stream, with the stream identifier
+// chunk.
+var snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// DecodeSnappy decodes snappy-compressed data, in either the stream format
+// (as sent by Prometheus 1.x remote write) or the block format (as sent by
+// Prometheus 2.x).
+func DecodeSnappy(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, snappyStreamMagic) {
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(data)))
+	}
+	return snappy.Decode(nil, data)
+}
+
 // WriteJSONResponse writes some JSON as a HTTP response.
 func WriteJSONResponse(w http.ResponseWriter, v interface{}) {
 	data, err := json.Marshal(v)
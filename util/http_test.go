@@ -0,0 +1,94 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+func TestParseProtoRequestUnknownFields(t *testing.T) {
+	want := ToWriteRequest([]*model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "foo"}, Timestamp: 1, Value: StaleNaN},
+	})
+	buf, err := proto.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newer remote_write revisions send metric metadata in field 3, which
+	// must be ignored rather than rejected.
+	buf = append(buf, proto.EncodeVarint(3<<3|2)...)
+	buf = append(buf, proto.EncodeVarint(3)...)
+	buf = append(buf, 0x08, 0x01, 0x12)
+
+	r := httptest.NewRequest("POST", "/push", bytes.NewReader(snappy.Encode(nil, buf)))
+	r.Header.Set(user.UserIDHeaderName, "1")
+	w := httptest.NewRecorder()
+	var have remote.WriteRequest
+	if _, abort := ParseProtoRequest(w, r, &have, true); abort {
+		t.Fatalf("request rejected: %d %s", w.Code, w.Body.String())
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	samples := FromWriteRequest(&have)
+	if len(samples) != 1 || !IsStaleNaN(samples[0].Value) {
+		t.Fatalf("staleness marker not preserved: %v", samples)
+	}
+}
+
+func TestParseProtoRequestEncodings(t *testing.T) {
+	want := ToWriteRequest([]*model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "foo"}, Timestamp: 1, Value: 2},
+	})
+	buf, err := proto.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(buf)
+	gw.Close()
+
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"", snappy.Encode(nil, buf), http.StatusOK},
+		{"snappy", snappy.Encode(nil, buf), http.StatusOK},
+		{"gzip", gzipped.Bytes(), http.StatusOK},
+		{"identity", buf, http.StatusOK},
+		{"br", buf, http.StatusUnsupportedMediaType},
+		{"gzip", buf, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("POST", "/push", bytes.NewReader(tc.body))
+		r.Header.Set(user.UserIDHeaderName, "1")
+		if tc.encoding != "" {
+			r.Header.Set("Content-Encoding", tc.encoding)
+		}
+		w := httptest.NewRecorder()
+		var have remote.WriteRequest
+		_, abort := ParseProtoRequest(w, r, &have, true)
+		if abort != (tc.status != http.StatusOK) || w.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d %s", tc.encoding, tc.status, w.Code, w.Body.String())
+			continue
+		}
+		if !abort && !reflect.DeepEqual(FromWriteRequest(&have), FromWriteRequest(want)) {
+			t.Errorf("%q: unexpected request %v", tc.encoding, have)
+		}
+		if tc.status == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Encoding") == "" {
+			t.Errorf("%q: expected the supported encodings in the response", tc.encoding)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminAuth is HTTP middleware restricting access to admin endpoints, such
+// as the ring page, which can forget ingesters.  Requests must come from one
+// of AllowedNets, if any are set, and carry Username and Password as basic
+// auth credentials, if Username is set.
+type AdminAuth struct {
+	AllowedNets []*net.IPNet
+	Username    string
+	Password    string
+}
+
+// Wrap implements middleware.Interface
+func (a AdminAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(r.RemoteAddr) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if a.Username != "" {
+			username, password, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="cortex admin"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a AdminAuth) allowed(remoteAddr string) bool {
+	if len(a.AllowedNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.AllowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAllowList parses a comma-separated list of CIDRs (eg 10.0.0.0/8) and
+// IP addresses, for AdminAuth.AllowedNets.
+func ParseAllowList(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
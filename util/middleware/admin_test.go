@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestParseAllowList(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		nets []*net.IPNet
+		err  bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"10.0.0.0/8", []*net.IPNet{mustParseCIDR("10.0.0.0/8")}, false},
+		{"10.0.0.0/8, 192.168.1.2", []*net.IPNet{mustParseCIDR("10.0.0.0/8"), mustParseCIDR("192.168.1.2/32")}, false},
+		{"fd00::/8,::1", []*net.IPNet{mustParseCIDR("fd00::/8"), mustParseCIDR("::1/128")}, false},
+		// IPv4-mapped IPv6 addresses are IPv4 addresses.
+		{"::ffff:10.1.2.3", []*net.IPNet{mustParseCIDR("10.1.2.3/32")}, false},
+		{"10.0.0.300", nil, true},
+		{"10.0.0.0/33", nil, true},
+		{"localhost", nil, true},
+		{"10.0.0.0/8,bad", nil, true},
+	} {
+		nets, err := ParseAllowList(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(nets, tc.nets) {
+			t.Errorf("%q: expected %v, got %v", tc.in, tc.nets, nets)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	allowed, err := ParseAllowList("10.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name               string
+		auth               AdminAuth
+		remoteAddr         string
+		username, password string
+		status             int
+	}{
+		{"open", AdminAuth{}, "192.168.0.1:1234", "", "", http.StatusOK},
+		{"open, malformed address", AdminAuth{}, "garbage", "", "", http.StatusOK},
+		{"allowed IPv4", AdminAuth{AllowedNets: allowed}, "10.1.2.3:1234", "", "", http.StatusOK},
+		{"allowed IPv6", AdminAuth{AllowedNets: allowed}, "[2001:db8::1]:1234", "", "", http.StatusOK},
+		{"allowed IPv4-mapped IPv6", AdminAuth{AllowedNets: allowed}, "[::ffff:10.1.2.3]:1234", "", "", http.StatusOK},
+		{"allowed, no port", AdminAuth{AllowedNets: allowed}, "10.1.2.3", "", "", http.StatusOK},
+		{"forbidden IPv4", AdminAuth{AllowedNets: allowed}, "192.168.0.1:1234", "", "", http.StatusForbidden},
+		{"forbidden IPv6", AdminAuth{AllowedNets: allowed}, "[2001:db8::2]:1234", "", "", http.StatusForbidden},
+		{"forbidden IPv4-mapped IPv6", AdminAuth{AllowedNets: allowed}, "[::ffff:192.168.0.1]:1234", "", "", http.StatusForbidden},
+		{"malformed address", AdminAuth{AllowedNets: allowed}, "garbage:1234", "", "", http.StatusForbidden},
+		{"empty address", AdminAuth{AllowedNets: allowed}, "", "", "", http.StatusForbidden},
+		{"authorized", AdminAuth{Username: "admin", Password: "secret"}, "192.168.0.1:1234", "admin", "secret", http.StatusOK},
+		{"no credentials", AdminAuth{Username: "admin", Password: "secret"}, "192.168.0.1:1234", "", "", http.StatusUnauthorized},
+		{"wrong password", AdminAuth{Username: "admin", Password: "secret"}, "192.168.0.1:1234", "admin", "guess", http.StatusUnauthorized},
+		{"wrong username", AdminAuth{Username: "admin", Password: "secret"}, "192.168.0.1:1234", "root", "secret", http.StatusUnauthorized},
+		{"authorized and allowed", AdminAuth{AllowedNets: allowed, Username: "admin", Password: "secret"}, "10.1.2.3:1234", "admin", "secret", http.StatusOK},
+		// Requests from disallowed addresses are refused before checking
+		// credentials.
+		{"authorized but forbidden", AdminAuth{AllowedNets: allowed, Username: "admin", Password: "secret"}, "192.168.0.1:1234", "admin", "secret", http.StatusForbidden},
+	} {
+		handler := tc.auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest("GET", "/ring", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		if tc.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected WWW-Authenticate header", tc.name)
+		}
+	}
+}
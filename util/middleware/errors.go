@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// ServerErrorInterceptor converts errors to gRPC errors with the status code for their util.ErrorCode,
+// so clients can tell which are worth retrying.
+func ServerErrorInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, util.ToGRPCError(err)
+}
@@ -6,19 +6,22 @@ import (
 	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex/util"
 )
 
 const gRPC = "gRPC"
 
-// ServerLoggingInterceptor logs gRPC requests, errors and latency.
+// ServerLoggingInterceptor logs gRPC requests, errors and latency, with the
+// request ID if ServerRequestIDInterceptor runs before it.
 func ServerLoggingInterceptor(logSuccess bool) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		begin := time.Now()
 		resp, err := handler(ctx, req)
 		if err != nil {
-			log.Errorf("%s %s (%v) %s", gRPC, info.FullMethod, err, time.Since(begin))
+			log.Errorf("%s %s (%v) %s request_id=%s", gRPC, info.FullMethod, err, time.Since(begin), util.GetRequestID(ctx))
 		} else if logSuccess {
-			log.Infof("%s %s (success) %s", gRPC, info.FullMethod, time.Since(begin))
+			log.Infof("%s %s (success) %s request_id=%s", gRPC, info.FullMethod, time.Since(begin), util.GetRequestID(ctx))
 		}
 		return resp, err
 	}
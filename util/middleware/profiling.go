@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	gocontext "context"
+	"net/http"
+	"runtime/pprof"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Names of the pprof labels set on goroutines serving requests.
+const (
+	tenantProfileLabel    = "tenant"
+	requestIDProfileLabel = "request_id"
+)
+
+// ProfileLabels is HTTP middleware which labels the goroutines serving each
+// request, and those they start, with the tenant and request ID, so CPU
+// profiles captured from /debug/pprof/profile can be broken down by them.
+// It must come after RequestID.
+type ProfileLabels struct{}
+
+// Wrap implements middleware.Interface
+func (ProfileLabels) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels := profileLabels(r.Header.Get(user.UserIDHeaderName), util.GetRequestID(r.Context()))
+		pprof.Do(r.Context(), labels, func(ctx gocontext.Context) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
+
+// ServerProfileLabelsInterceptor labels the goroutines serving gRPC requests
+// like ProfileLabels.  It must come after ServerRequestIDInterceptor and
+// ServerUserHeaderInterceptor.
+func ServerProfileLabelsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	userID, _ := user.GetID(ctx)
+	pprof.Do(ctx, profileLabels(userID, util.GetRequestID(ctx)), func(ctx gocontext.Context) {
+		resp, err = handler(ctx, req)
+	})
+	return resp, err
+}
+
+func profileLabels(userID, requestID string) pprof.LabelSet {
+	labels := []string{}
+	if userID != "" {
+		labels = append(labels, tenantProfileLabel, userID)
+	}
+	if requestID != "" {
+		labels = append(labels, requestIDProfileLabel, requestID)
+	}
+	return pprof.Labels(labels...)
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// RequestID is HTTP middleware which gives each request an ID, taken from the
+// X-Request-ID header if the client set one, and otherwise generated.  The ID
+// is put in the request's context and echoed in the response headers.
+type RequestID struct{}
+
+// Wrap implements middleware.Interface
+func (RequestID) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(util.RequestIDHeaderName)
+		if requestID == "" {
+			requestID = util.NewRequestID()
+			r.Header.Set(util.RequestIDHeaderName, requestID)
+		}
+		w.Header().Set(util.RequestIDHeaderName, requestID)
+		next.ServeHTTP(w, r.WithContext(util.WithRequestID(r.Context(), requestID)))
+	})
+}
+
+// ClientRequestIDInterceptor propagates the request ID from the context to gRPC metadata, if there is one.
+func ClientRequestIDInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	requestID := util.GetRequestID(ctx)
+	if requestID == "" {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		md = metadata.New(map[string]string{util.LowerRequestIDHeaderName: requestID})
+	} else {
+		md = md.Copy()
+		md[util.LowerRequestIDHeaderName] = []string{requestID}
+	}
+	newCtx := metadata.NewContext(ctx, md)
+
+	return invoker(newCtx, method, req, reply, cc, opts...)
+}
+
+// ServerRequestIDInterceptor propagates the request ID from the gRPC metadata back to our context.
+// Requests without one are given a new ID.
+func ServerRequestIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := ""
+	if md, ok := metadata.FromContext(ctx); ok {
+		if requestIDs := md[util.LowerRequestIDHeaderName]; len(requestIDs) == 1 {
+			requestID = requestIDs[0]
+		}
+	}
+	if requestID == "" {
+		requestID = util.NewRequestID()
+	}
+	return handler(util.WithRequestID(ctx, requestID), req)
+}
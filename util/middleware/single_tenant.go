@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/weaveworks/cortex/user"
+)
+
+// FakeUserID is the tenant every request is made as when multi-tenancy is
+// disabled.
+const FakeUserID = "fake"
+
+// SingleTenant is HTTP middleware for running without multi-tenancy, eg for
+// a single team or local testing: it sets every request's tenant header to
+// UserID, replacing any the client sent, so clients needn't send one.
+type SingleTenant struct {
+	UserID string
+}
+
+// Wrap implements middleware.Interface
+func (s SingleTenant) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(user.UserIDHeaderName, s.UserID)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"golang.org/x/net/context"
+)
+
+// RequestIDHeaderName is the HTTP header carrying a request's ID.
+const RequestIDHeaderName = "X-Request-ID"
+
+// LowerRequestIDHeaderName as gRPC / HTTP2.0 headers are lowercased.
+const LowerRequestIDHeaderName = "x-request-id"
+
+type requestIDContextKey struct{}
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// WithRequestID returns a derived context containing the request ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// GetRequestID returns the request ID from the context, or "" if it has none.
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
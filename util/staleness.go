@@ -0,0 +1,19 @@
+package util
+
+import (
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+// StaleNaN is the value Prometheus 2.x writes as a staleness marker, to say a
+// series has gone away.  It is a NaN with a particular bit pattern, distinct
+// from any NaN produced by arithmetic, so must be compared by its bits.
+var StaleNaN = model.SampleValue(math.Float64frombits(staleNaNBits))
+
+const staleNaNBits = 0x7ff0000000000002
+
+// IsStaleNaN returns true if v is a staleness marker.
+func IsStaleNaN(v model.SampleValue) bool {
+	return math.Float64bits(float64(v)) == staleNaNBits
+}
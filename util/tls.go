@@ -0,0 +1,105 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig configures TLS, with optional client certificate verification,
+// for an internal server or client.  The zero value disables TLS.
+type TLSConfig struct {
+	// Certificate and key to present to peers.  Required for servers, and
+	// for clients of servers which verify client certificates.
+	CertFile string
+	KeyFile  string
+
+	// CA certificates to verify peers' certificates with.  Servers with a CA
+	// require clients to present certificates signed by it; clients without
+	// one use the system's CAs.
+	CAFile string
+
+	// Name to verify servers' certificates against, if not their hostname.
+	ServerName string
+}
+
+// RegisterFlags registers flags for the config, named <prefix>.tls.*, where
+// what describes the servers or clients it configures.
+func (c *TLSConfig) RegisterFlags(f *flag.FlagSet, prefix, what string) {
+	f.StringVar(&c.CertFile, prefix+".tls.cert-file", "", "TLS certificate file for "+what+". If neither it nor a CA file is set, TLS is not used.")
+	f.StringVar(&c.KeyFile, prefix+".tls.key-file", "", "TLS key file for "+what+".")
+	f.StringVar(&c.CAFile, prefix+".tls.ca-file", "", "CA certificates file to verify peers' certificates with for "+what+". Servers then require client certificates.")
+	f.StringVar(&c.ServerName, prefix+".tls.server-name", "", "Name to verify servers' certificates against, if not their hostname, for "+what+".")
+}
+
+// Enabled returns whether TLS is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.CAFile != ""
+}
+
+// ServerConfig returns the tls.Config for a server, or nil if TLS isn't
+// configured.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("TLS servers need a certificate and key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the tls.Config for a client, or nil if TLS isn't
+// configured.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: c.ServerName,
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a certificate, signed by parent (or self-signed if nil),
+// and its key to dir, returning their filenames, and the certificate and key
+// to sign others with.
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(time.Hour)
+	caFile, _, ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ingester"},
+		DNSNames:     []string{"ingester"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "distributor"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverConfig, err := TLSConfig{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile}.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name   string
+		config TLSConfig
+		ok     bool
+	}{
+		{"client certificate", TLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}, true},
+		{"server name", TLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile, ServerName: "ingester"}, true},
+		{"no client certificate", TLSConfig{CAFile: caFile}, false},
+		{"wrong server name", TLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile, ServerName: "ruler"}, false},
+	} {
+		clientConfig, err := tc.config.ClientConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected success %v, got error %v", tc.name, tc.ok, err)
+		}
+	}
+
+	if config, err := (TLSConfig{}).ServerConfig(); config != nil || err != nil {
+		t.Errorf("expected no TLS by default, got %v, %v", config, err)
+	}
+	if _, err := (TLSConfig{CAFile: caFile}).ServerConfig(); err == nil {
+		t.Error("expected error for server without a certificate")
+	}
+}